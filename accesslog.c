@@ -0,0 +1,136 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <errno.h>
+#include <pthread.h>
+#include <sys/stat.h>
+
+#include "accesslog.h"
+
+struct AccessLog {
+    char path[256];
+    FILE* file;             // stdout for "-"
+    bool is_stdout;
+    long long size;         // Bytes in the file as of the last write
+    long long max_size;
+    int max_files;
+    bool failing;           // A write failed and was reported
+    pthread_mutex_t lock;
+};
+
+// Call with the lock held
+static bool open_file(AccessLog* log, char* error, size_t error_size) {
+    FILE* file = fopen(log->path, "a");
+    if (!file) {
+        snprintf(error, error_size, "%s: %s", log->path, strerror(errno));
+        return false;
+    }
+    // A line at a time, so that a crash loses nothing already logged
+    setvbuf(file, NULL, _IOLBF, 0);
+    struct stat info;
+    log->size = fstat(fileno(file), &info) == 0 ? (long long)info.st_size : 0;
+    if (log->file) fclose(log->file);
+    log->file = file;
+    return true;
+}
+
+AccessLog* access_log_open(const char* path, long long max_size, int max_files,
+                           char* error, size_t error_size) {
+    AccessLog* log = calloc(1, sizeof(AccessLog));
+    if (strlen(path) >= sizeof(log->path) - 4) {
+        snprintf(error, error_size, "access log path too long");
+        free(log);
+        return NULL;
+    }
+    snprintf(log->path, sizeof(log->path), "%s", path);
+    log->max_size = max_size;
+    log->max_files = max_files > 0 ? max_files : 1;
+    log->is_stdout = strcmp(path, "-") == 0;
+    if (log->is_stdout) {
+        log->file = stdout;
+    } else if (!open_file(log, error, error_size)) {
+        free(log);
+        return NULL;
+    }
+    pthread_mutex_init(&log->lock, NULL);
+    return log;
+}
+
+void access_log_close(AccessLog* log) {
+    if (log->file && !log->is_stdout) fclose(log->file);
+    pthread_mutex_destroy(&log->lock);
+    free(log);
+}
+
+// Shifts PATH.N along to PATH.N+1, dropping the last, and moves PATH to
+// PATH.1. Call with the lock held.
+static void rotate(AccessLog* log) {
+    char from[sizeof(log->path) + 16];
+    char to[sizeof(log->path) + 16];
+    snprintf(to, sizeof(to), "%s.%d", log->path, log->max_files);
+    remove(to);
+    for (int i = log->max_files - 1; i >= 1; i--) {
+        snprintf(from, sizeof(from), "%s.%d", log->path, i);
+        snprintf(to, sizeof(to), "%s.%d", log->path, i + 1);
+        rename(from, to);
+    }
+    snprintf(to, sizeof(to), "%s.1", log->path);
+    // On failure lines keep going to the file already open, and the next
+    // try waits until another max_size bytes have been written
+    char error[320];
+    if (rename(log->path, to) != 0) {
+        fprintf(stderr, "Failed to rotate the access log %s: %s\n", log->path, strerror(errno));
+        log->size = 0;
+    } else if (!open_file(log, error, sizeof(error))) {
+        fprintf(stderr, "Failed to open the access log after rotating it: %s\n", error);
+        log->size = 0;
+    }
+}
+
+void access_log_write(AccessLog* log, const char* line) {
+    size_t length = strlen(line);
+    pthread_mutex_lock(&log->lock);
+    if (!log->is_stdout && log->max_size > 0 && log->size > 0 &&
+        log->size + (long long)length > log->max_size) {
+        rotate(log);
+    }
+    bool written = log->file && fwrite(line, 1, length, log->file) == length &&
+                   fflush(log->file) == 0;
+    if (written) {
+        log->size += length;
+        log->failing = false;
+    } else if (!log->failing) {
+        fprintf(stderr, "Failed to write to the access log %s\n", log->path);
+        log->failing = true;
+    }
+    pthread_mutex_unlock(&log->lock);
+}
+
+bool access_log_reopen(AccessLog* log, char* error, size_t error_size) {
+    if (log->is_stdout) return true;
+    pthread_mutex_lock(&log->lock);
+    bool ok = open_file(log, error, error_size);
+    pthread_mutex_unlock(&log->lock);
+    return ok;
+}
+
+void access_log_escape(const char* text, char* out, size_t out_size) {
+    size_t length = 0;
+    for (const unsigned char* c = (const unsigned char*)text; *c; c++) {
+        char escaped[8];
+        if (*c == '"' || *c == '\\') {
+            snprintf(escaped, sizeof(escaped), "\\%c", *c);
+        } else if (*c < 0x20 || *c >= 0x7f) {
+            snprintf(escaped, sizeof(escaped), "\\x%02x", *c);
+        } else {
+            snprintf(escaped, sizeof(escaped), "%c", *c);
+        }
+        size_t escaped_length = strlen(escaped);
+        if (length + escaped_length >= out_size) break;
+        memcpy(out + length, escaped, escaped_length);
+        length += escaped_length;
+    }
+    if (out_size > 0) out[length] = '\0';
+}
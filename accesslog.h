@@ -0,0 +1,33 @@
+#ifndef ACCESSLOG_H
+#define ACCESSLOG_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+// A file of one line per request, in the Common or Combined Log Format
+// that Apache and nginx write, so log analysers and fail2ban read it as
+// they would theirs. Once a line would take the file past max_size bytes
+// it is rotated: PATH.1 becomes PATH.2 and so on, the oldest past
+// max_files is deleted, and PATH becomes PATH.1. Safe to share between
+// threads.
+typedef struct AccessLog AccessLog;
+
+// path "-" writes to stdout, which is never rotated. max_size 0 never
+// rotates; max_files is how many rotated files are kept, at least 1.
+AccessLog* access_log_open(const char* path, long long max_size, int max_files,
+                           char* error, size_t error_size);
+void access_log_close(AccessLog* log);
+
+// Appends line, which ends with its newline, rotating first if it's due.
+// A write that fails is reported on stderr once until one succeeds again.
+void access_log_write(AccessLog* log, const char* line);
+
+// Opens path again, for when logrotate or the like has moved it away
+bool access_log_reopen(AccessLog* log, char* error, size_t error_size);
+
+// Writes text to out as the inside of a quoted log field: '"' and '\' escaped
+// with '\', control and non-ASCII bytes as \xhh, as Apache does. Stops
+// short rather than split an escape when out fills up.
+void access_log_escape(const char* text, char* out, size_t out_size);
+
+#endif
@@ -0,0 +1,775 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <ctype.h>
+#include <fcntl.h>
+#include <unistd.h>
+#include <sys/stat.h>
+
+#if defined(HAVE_OPENSSL) && defined(HAVE_CURL)
+#include <openssl/bn.h>
+#include <openssl/ec.h>
+#include <openssl/err.h>
+#include <openssl/evp.h>
+#include <openssl/pem.h>
+#include <openssl/x509.h>
+#include <openssl/x509v3.h>
+#include <curl/curl.h>
+#endif
+
+#include "acme.h"
+
+#if defined(HAVE_OPENSSL) && defined(HAVE_CURL)
+#include "webserver.h"
+
+#define ACME_CHALLENGE_DIR "/.well-known/acme-challenge/"
+#define ACME_POLLS 30               // Checks of an authorization or order before giving up
+#define ACME_POLL_INTERVAL 2        // Seconds between them
+#define ACME_URL_LENGTH 512
+
+// One conversation with the CA: its directory, the account key and the
+// nonce the next request must carry
+typedef struct {
+    const AcmeOptions* options;
+    EVP_PKEY* account_key;
+    char jwk[256];                  // The account key's public JWK
+    char thumbprint[64];            // base64url SHA-256 of jwk, for key authorizations
+    char kid[ACME_URL_LENGTH];      // The account's URL, once registered
+    char nonce[128];
+    char new_nonce[ACME_URL_LENGTH];
+    char new_account[ACME_URL_LENGTH];
+    char new_order[ACME_URL_LENGTH];
+} AcmeSession;
+
+typedef struct {
+    long status;
+    StringBuilder body;
+    char location[ACME_URL_LENGTH];
+    char nonce[128];
+} AcmeReply;
+
+static void openssl_error(const char* what, char* error, size_t error_size) {
+    char reason[256];
+    ERR_error_string_n(ERR_get_error(), reason, sizeof(reason));
+    ERR_clear_error();
+    snprintf(error, error_size, "%s: %s", what, reason);
+}
+
+// Writes length bytes of data as unpadded base64url, RFC 4648 section 5
+static char* base64url(const unsigned char* data, size_t length) {
+    char* out = malloc(4 * ((length + 2) / 3) + 1);
+    int written = EVP_EncodeBlock((unsigned char*)out, data, length);
+    while (written > 0 && out[written - 1] == '=') written--;
+    out[written] = '\0';
+    for (char* p = out; *p; p++) {
+        if (*p == '+') *p = '-';
+        if (*p == '/') *p = '_';
+    }
+    return out;
+}
+
+// ============= Keys =============
+
+static EVP_PKEY* generate_key(void) {
+    EVP_PKEY* key = NULL;
+    EVP_PKEY_CTX* ctx = EVP_PKEY_CTX_new_id(EVP_PKEY_EC, NULL);
+    if (!ctx || EVP_PKEY_keygen_init(ctx) != 1 ||
+        EVP_PKEY_CTX_set_ec_paramgen_curve_nid(ctx, NID_X9_62_prime256v1) != 1 ||
+        EVP_PKEY_keygen(ctx, &key) != 1) {
+        key = NULL;
+    }
+    EVP_PKEY_CTX_free(ctx);
+    return key;
+}
+
+// Writes key as PEM to path, readable only by us, through a temporary file
+// so a reader never sees half of it
+static bool write_key(EVP_PKEY* key, const char* path, char* error, size_t error_size) {
+    char temporary[600];
+    snprintf(temporary, sizeof(temporary), "%s.tmp", path);
+    int fd = open(temporary, O_WRONLY | O_CREAT | O_TRUNC, 0600);
+    FILE* file = fd >= 0 ? fdopen(fd, "w") : NULL;
+    if (!file) {
+        if (fd >= 0) close(fd);
+        snprintf(error, error_size, "cannot write %s", temporary);
+        return false;
+    }
+    bool ok = PEM_write_PrivateKey(file, key, NULL, NULL, 0, NULL, NULL) == 1;
+    ok = fclose(file) == 0 && ok;
+    if (!ok || rename(temporary, path) != 0) {
+        unlink(temporary);
+        snprintf(error, error_size, "cannot write %s", path);
+        return false;
+    }
+    return true;
+}
+
+// Reads the account key, making one the first time
+static EVP_PKEY* load_account_key(const char* path, char* error, size_t error_size) {
+    FILE* file = fopen(path, "r");
+    if (file) {
+        EVP_PKEY* key = PEM_read_PrivateKey(file, NULL, NULL, NULL);
+        fclose(file);
+        if (!key || EVP_PKEY_base_id(key) != EVP_PKEY_EC || EVP_PKEY_bits(key) != 256) {
+            EVP_PKEY_free(key);
+            snprintf(error, error_size, "%s is not an EC P-256 private key", path);
+            return NULL;
+        }
+        return key;
+    }
+    EVP_PKEY* key = generate_key();
+    if (!key) {
+        openssl_error("cannot make an account key", error, error_size);
+        return NULL;
+    }
+    if (!write_key(key, path, error, error_size)) {
+        EVP_PKEY_free(key);
+        return NULL;
+    }
+    return key;
+}
+
+// Fills in the account key's JWK and its RFC 7638 thumbprint. The
+// uncompressed point, 04 || x || y, ends the DER public key.
+static bool describe_account_key(AcmeSession* session, char* error, size_t error_size) {
+    unsigned char* der = NULL;
+    int length = i2d_PUBKEY(session->account_key, &der);
+    if (length < 65 || der[length - 65] != 0x04) {
+        OPENSSL_free(der);
+        snprintf(error, error_size, "cannot read the account key's public point");
+        return false;
+    }
+    char* x = base64url(der + length - 64, 32);
+    char* y = base64url(der + length - 32, 32);
+    OPENSSL_free(der);
+    // Members in lexical order, no whitespace, as the thumbprint requires
+    snprintf(session->jwk, sizeof(session->jwk),
+             "{\"crv\":\"P-256\",\"kty\":\"EC\",\"x\":\"%s\",\"y\":\"%s\"}", x, y);
+    free(x);
+    free(y);
+
+    unsigned char digest[EVP_MAX_MD_SIZE];
+    unsigned int digest_length;
+    EVP_Digest(session->jwk, strlen(session->jwk), digest, &digest_length, EVP_sha256(), NULL);
+    char* thumbprint = base64url(digest, digest_length);
+    snprintf(session->thumbprint, sizeof(session->thumbprint), "%s", thumbprint);
+    free(thumbprint);
+    return true;
+}
+
+// ES256 over data: r and s, 32 bytes each, base64url encoded
+static char* sign_es256(EVP_PKEY* key, const char* data) {
+    EVP_MD_CTX* md = EVP_MD_CTX_new();
+    unsigned char der[128];
+    size_t der_length = sizeof(der);
+    bool ok = EVP_DigestSignInit(md, NULL, EVP_sha256(), NULL, key) == 1 &&
+              EVP_DigestSign(md, der, &der_length, (const unsigned char*)data, strlen(data)) == 1;
+    EVP_MD_CTX_free(md);
+    if (!ok) return NULL;
+
+    const unsigned char* p = der;
+    ECDSA_SIG* signature = d2i_ECDSA_SIG(NULL, &p, der_length);
+    if (!signature) return NULL;
+    const BIGNUM* r;
+    const BIGNUM* s;
+    ECDSA_SIG_get0(signature, &r, &s);
+    unsigned char raw[64];
+    BN_bn2binpad(r, raw, 32);
+    BN_bn2binpad(s, raw + 32, 32);
+    ECDSA_SIG_free(signature);
+    return base64url(raw, sizeof(raw));
+}
+
+// ============= HTTP =============
+
+static size_t append_body(char* data, size_t size, size_t count, void* userdata) {
+    AcmeReply* reply = userdata;
+    sb_appendf(&reply->body, "%.*s", (int)(size * count), data);
+    return size * count;
+}
+
+// Copies the value of a "Name: value" header line into out if it is name's
+static void read_header(const char* line, size_t length, const char* name, char* out,
+                        size_t out_size) {
+    size_t name_length = strlen(name);
+    if (length <= name_length || strncasecmp(line, name, name_length) != 0 ||
+        line[name_length] != ':') {
+        return;
+    }
+    const char* value = line + name_length + 1;
+    const char* end = line + length;
+    while (value < end && (*value == ' ' || *value == '\t')) value++;
+    while (end > value && isspace((unsigned char)end[-1])) end--;
+    if ((size_t)(end - value) < out_size) snprintf(out, out_size, "%.*s", (int)(end - value), value);
+}
+
+static size_t read_headers(char* line, size_t size, size_t count, void* userdata) {
+    AcmeReply* reply = userdata;
+    read_header(line, size * count, "Replay-Nonce", reply->nonce, sizeof(reply->nonce));
+    read_header(line, size * count, "Location", reply->location, sizeof(reply->location));
+    return size * count;
+}
+
+// GETs url, or POSTs a JWS to it when jws isn't NULL, or only asks for its
+// headers with head. A reply that came back is freed with acme_reply_free().
+static bool acme_http(AcmeSession* session, const char* url, const char* jws, bool head,
+                      AcmeReply* reply, char* error, size_t error_size) {
+    memset(reply, 0, sizeof(*reply));
+    sb_init(&reply->body);
+    CURL* curl = curl_easy_init();
+    if (!curl) {
+        sb_free(&reply->body);
+        snprintf(error, error_size, "cannot create HTTP client");
+        return false;
+    }
+    struct curl_slist* headers = curl_slist_append(NULL, "Content-Type: application/jose+json");
+    curl_easy_setopt(curl, CURLOPT_URL, url);
+    curl_easy_setopt(curl, CURLOPT_TIMEOUT, (long)session->options->timeout);
+    curl_easy_setopt(curl, CURLOPT_NOSIGNAL, 1L);
+    curl_easy_setopt(curl, CURLOPT_PROTOCOLS_STR, "http,https");
+    curl_easy_setopt(curl, CURLOPT_USERAGENT, "phoneval-acme");
+    curl_easy_setopt(curl, CURLOPT_WRITEFUNCTION, append_body);
+    curl_easy_setopt(curl, CURLOPT_WRITEDATA, reply);
+    curl_easy_setopt(curl, CURLOPT_HEADERFUNCTION, read_headers);
+    curl_easy_setopt(curl, CURLOPT_HEADERDATA, reply);
+    if (head) curl_easy_setopt(curl, CURLOPT_NOBODY, 1L);
+    if (jws) {
+        curl_easy_setopt(curl, CURLOPT_HTTPHEADER, headers);
+        curl_easy_setopt(curl, CURLOPT_POSTFIELDS, jws);
+    }
+
+    CURLcode rc = curl_easy_perform(curl);
+    if (rc == CURLE_OK) curl_easy_getinfo(curl, CURLINFO_RESPONSE_CODE, &reply->status);
+    curl_slist_free_all(headers);
+    curl_easy_cleanup(curl);
+    if (rc != CURLE_OK) {
+        sb_free(&reply->body);
+        snprintf(error, error_size, "%s: %s", url, curl_easy_strerror(rc));
+        return false;
+    }
+    if (reply->nonce[0]) snprintf(session->nonce, sizeof(session->nonce), "%s", reply->nonce);
+    return true;
+}
+
+static void acme_reply_free(AcmeReply* reply) {
+    sb_free(&reply->body);
+}
+
+// Sets error from a reply the CA refused, with the detail of its problem
+// document (RFC 7807) when there is one
+static void acme_problem(const char* what, AcmeReply* reply, char* error, size_t error_size) {
+    char detail[256] = "";
+    if (reply->body.data) json_get_string(reply->body.data, "detail", detail, sizeof(detail));
+    snprintf(error, error_size, "%s: HTTP %ld%s%s", what, reply->status, detail[0] ? ", " : "",
+             detail);
+}
+
+static bool is_bad_nonce(AcmeReply* reply) {
+    char type[128] = "";
+    if (reply->body.data) json_get_string(reply->body.data, "type", type, sizeof(type));
+    return reply->status == 400 && strcmp(type, "urn:ietf:params:acme:error:badNonce") == 0;
+}
+
+// POSTs payload to url as a JWS signed with the account key, by its kid once
+// registered and by its JWK before. An empty payload is a POST-as-GET. A
+// nonce the CA turns down is retried once with the fresh one it sends back.
+static bool acme_post(AcmeSession* session, const char* url, const char* payload,
+                      AcmeReply* reply, char* error, size_t error_size) {
+    memset(reply, 0, sizeof(*reply));
+    for (int attempt = 0; attempt < 2; attempt++) {
+        if (!session->nonce[0]) {
+            AcmeReply nonce_reply;
+            bool ok = acme_http(session, session->new_nonce, NULL, true, &nonce_reply,
+                                error, error_size);
+            acme_reply_free(&nonce_reply);
+            if (!ok) return false;
+            if (!session->nonce[0]) {
+                snprintf(error, error_size, "newNonce: no Replay-Nonce");
+                return false;
+            }
+        }
+
+        StringBuilder protected_header;
+        sb_init(&protected_header);
+        sb_appendf(&protected_header, "{\"alg\":\"ES256\",%s%s%s,\"nonce\":\"%s\",\"url\":\"%s\"}",
+                   session->kid[0] ? "\"kid\":\"" : "\"jwk\":",
+                   session->kid[0] ? session->kid : session->jwk,
+                   session->kid[0] ? "\"" : "", session->nonce, url);
+        session->nonce[0] = '\0';   // Each is good for one request
+        char* encoded_header = base64url((const unsigned char*)protected_header.data,
+                                         protected_header.length);
+        char* encoded_payload = base64url((const unsigned char*)payload, strlen(payload));
+        sb_free(&protected_header);
+
+        StringBuilder signing_input;
+        sb_init(&signing_input);
+        sb_appendf(&signing_input, "%s.%s", encoded_header, encoded_payload);
+        char* signature = sign_es256(session->account_key, signing_input.data);
+        sb_free(&signing_input);
+        if (!signature) {
+            free(encoded_header);
+            free(encoded_payload);
+            openssl_error("cannot sign a request", error, error_size);
+            return false;
+        }
+
+        StringBuilder jws;
+        sb_init(&jws);
+        sb_appendf(&jws, "{\"protected\":\"%s\",\"payload\":\"%s\",\"signature\":\"%s\"}",
+                   encoded_header, encoded_payload, signature);
+        free(encoded_header);
+        free(encoded_payload);
+        free(signature);
+        bool ok = acme_http(session, url, jws.data, false, reply, error, error_size);
+        sb_free(&jws);
+        if (!ok) return false;
+        if (attempt == 0 && is_bad_nonce(reply)) {
+            acme_reply_free(reply);
+            continue;
+        }
+        return true;
+    }
+    return true;
+}
+
+// ============= JSON =============
+
+static void skip_space(const char** p) {
+    while (isspace((unsigned char)**p)) (*p)++;
+}
+
+// The first element of the JSON array at p, NULL if it is empty or p isn't an array
+static const char* array_first(const char* p) {
+    if (!p || *p != '[') return NULL;
+    p++;
+    skip_space(&p);
+    return *p == ']' ? NULL : p;
+}
+
+// The element after the one at p, NULL after the last
+static const char* array_next(const char* p) {
+    p = json_skip_value(p);
+    if (!p) return NULL;
+    skip_space(&p);
+    if (*p != ',') return NULL;
+    p++;
+    skip_space(&p);
+    return p;
+}
+
+// ============= Orders =============
+
+static bool read_directory(AcmeSession* session, char* error, size_t error_size) {
+    AcmeReply reply;
+    bool ok = acme_http(session, session->options->directory, NULL, false, &reply,
+                        error, error_size);
+    if (!ok) return false;
+    if (reply.status != 200) {
+        acme_problem("directory", &reply, error, error_size);
+        ok = false;
+    }
+    if (ok && (!json_get_string(reply.body.data, "newNonce", session->new_nonce,
+                                sizeof(session->new_nonce)) ||
+               !json_get_string(reply.body.data, "newAccount", session->new_account,
+                                sizeof(session->new_account)) ||
+               !json_get_string(reply.body.data, "newOrder", session->new_order,
+                                sizeof(session->new_order)))) {
+        snprintf(error, error_size, "directory: no newNonce, newAccount or newOrder");
+        ok = false;
+    }
+    acme_reply_free(&reply);
+    return ok;
+}
+
+// Registers the account key, or finds the account it already has; either
+// way the CA answers with the account's URL in Location
+static bool register_account(AcmeSession* session, char* error, size_t error_size) {
+    char escaped_email[256];
+    json_escape(session->options->email, escaped_email, sizeof(escaped_email));
+    char payload[400];
+    if (session->options->email[0]) {
+        snprintf(payload, sizeof(payload),
+                 "{\"termsOfServiceAgreed\":true,\"contact\":[\"mailto:%s\"]}", escaped_email);
+    } else {
+        snprintf(payload, sizeof(payload), "{\"termsOfServiceAgreed\":true}");
+    }
+    AcmeReply reply;
+    if (!acme_post(session, session->new_account, payload, &reply, error, error_size)) return false;
+    bool ok = (reply.status == 200 || reply.status == 201) && reply.location[0];
+    if (ok) {
+        snprintf(session->kid, sizeof(session->kid), "%s", reply.location);
+    } else {
+        acme_problem("newAccount", &reply, error, error_size);
+    }
+    acme_reply_free(&reply);
+    return ok;
+}
+
+// POST-as-GETs url until its status is no longer one of waiting (a space
+// separated list). The last reply is left in reply.
+static bool poll_status(AcmeSession* session, const char* what, const char* url,
+                        const char* waiting, AcmeReply* reply, char* status, size_t status_size,
+                        char* error, size_t error_size) {
+    for (int poll = 0; poll < ACME_POLLS; poll++) {
+        if (poll > 0) sleep(ACME_POLL_INTERVAL);
+        if (!acme_post(session, url, "", reply, error, error_size)) return false;
+        if (reply->status != 200) {
+            acme_problem(what, reply, error, error_size);
+            acme_reply_free(reply);
+            return false;
+        }
+        status[0] = '\0';
+        json_get_string(reply->body.data, "status", status, status_size);
+        char padded[64];
+        snprintf(padded, sizeof(padded), " %s ", status);
+        char list[64];
+        snprintf(list, sizeof(list), " %s ", waiting);
+        if (!status[0] || !strstr(list, padded)) return true;
+        acme_reply_free(reply);
+    }
+    snprintf(error, error_size, "%s: still %s after %d seconds", what, status,
+             ACME_POLLS * ACME_POLL_INTERVAL);
+    return false;
+}
+
+// Tokens are base64url, which also keeps the challenge file in its directory
+static bool is_token(const char* token) {
+    if (!token[0]) return false;
+    for (const char* p = token; *p; p++) {
+        if (!isalnum((unsigned char)*p) && *p != '-' && *p != '_') return false;
+    }
+    return true;
+}
+
+static bool write_challenge(const char* webroot, const char* token, const char* content,
+                            char* path, size_t path_size, char* error, size_t error_size) {
+    // The webroot and .well-known may not be there yet
+    char directory[600];
+    snprintf(directory, sizeof(directory), "%s/.well-known", webroot);
+    mkdir(webroot, 0755);
+    mkdir(directory, 0755);
+    snprintf(directory, sizeof(directory), "%s%s", webroot, ACME_CHALLENGE_DIR);
+    mkdir(directory, 0755);
+
+    snprintf(path, path_size, "%s%s", directory, token);
+    FILE* file = fopen(path, "w");
+    if (!file || fputs(content, file) < 0 || fclose(file) != 0) {
+        snprintf(error, error_size, "cannot write %s", path);
+        return false;
+    }
+    return true;
+}
+
+// Proves control of an authorization's domain with its http-01 challenge.
+// Authorizations that are already valid, e.g. from a recent order, need
+// nothing.
+static bool authorize(AcmeSession* session, const char* url, char* error, size_t error_size) {
+    AcmeReply reply;
+    char status[32];
+    if (!poll_status(session, "authorization", url, "", &reply, status, sizeof(status),
+                     error, error_size)) {
+        return false;
+    }
+    if (strcmp(status, "valid") == 0) {
+        acme_reply_free(&reply);
+        return true;
+    }
+
+    char domain[256] = "";
+    json_get_string(json_member(reply.body.data, "identifier"), "value", domain, sizeof(domain));
+    char challenge_url[ACME_URL_LENGTH] = "";
+    char token[128] = "";
+    for (const char* challenge = array_first(json_member(reply.body.data, "challenges"));
+         challenge; challenge = array_next(challenge)) {
+        char type[32];
+        if (json_get_string(challenge, "type", type, sizeof(type)) && strcmp(type, "http-01") == 0) {
+            json_get_string(challenge, "url", challenge_url, sizeof(challenge_url));
+            json_get_string(challenge, "token", token, sizeof(token));
+            break;
+        }
+    }
+    acme_reply_free(&reply);
+    if (strcmp(status, "pending") != 0 || !challenge_url[0] || !is_token(token)) {
+        snprintf(error, error_size, "authorization for %s: %s, with no http-01 challenge to answer",
+                 domain, status);
+        return false;
+    }
+
+    char key_authorization[256];
+    snprintf(key_authorization, sizeof(key_authorization), "%s.%s", token, session->thumbprint);
+    char path[800];
+    if (!write_challenge(session->options->webroot, token, key_authorization, path, sizeof(path),
+                         error, error_size)) {
+        return false;
+    }
+
+    // An empty object tells the CA to go and look
+    bool ok = acme_post(session, challenge_url, "{}", &reply, error, error_size);
+    if (ok) {
+        if (reply.status != 200) {
+            acme_problem("challenge", &reply, error, error_size);
+            ok = false;
+        }
+        acme_reply_free(&reply);
+    }
+    ok = ok && poll_status(session, "authorization", url, "pending processing", &reply, status,
+                           sizeof(status), error, error_size);
+    if (ok && strcmp(status, "valid") != 0) {
+        // The failed challenge's error says what the CA saw
+        char detail[256] = "";
+        for (const char* challenge = array_first(json_member(reply.body.data, "challenges"));
+             challenge && !detail[0]; challenge = array_next(challenge)) {
+            json_get_string(json_member(challenge, "error"), "detail", detail, sizeof(detail));
+        }
+        snprintf(error, error_size, "authorization for %s: %s%s%s", domain, status,
+                 detail[0] ? ", " : "", detail);
+        ok = false;
+    }
+    acme_reply_free(&reply);
+    unlink(path);
+    return ok;
+}
+
+// A CSR for the domains, signed with key, as base64url DER
+static char* make_csr(const AcmeOptions* options, EVP_PKEY* key) {
+    X509_REQ* request = X509_REQ_new();
+    X509_NAME* name = X509_NAME_new();
+    X509_NAME_add_entry_by_txt(name, "CN", MBSTRING_ASC,
+                               (const unsigned char*)options->domains[0], -1, -1, 0);
+    X509_REQ_set_version(request, 0);
+    X509_REQ_set_subject_name(request, name);
+    X509_NAME_free(name);
+    X509_REQ_set_pubkey(request, key);
+
+    StringBuilder names;
+    sb_init(&names);
+    for (int i = 0; i < options->domain_count; i++) {
+        sb_appendf(&names, "%sDNS:%s", i > 0 ? "," : "", options->domains[i]);
+    }
+    STACK_OF(X509_EXTENSION)* extensions = sk_X509_EXTENSION_new_null();
+    X509_EXTENSION* alt_names = X509V3_EXT_conf_nid(NULL, NULL, NID_subject_alt_name, names.data);
+    sb_free(&names);
+
+    char* encoded = NULL;
+    if (alt_names && sk_X509_EXTENSION_push(extensions, alt_names) &&
+        X509_REQ_add_extensions(request, extensions) == 1 &&
+        X509_REQ_sign(request, key, EVP_sha256()) > 0) {
+        unsigned char* der = NULL;
+        int length = i2d_X509_REQ(request, &der);
+        if (length > 0) encoded = base64url(der, length);
+        OPENSSL_free(der);
+    }
+    sk_X509_EXTENSION_pop_free(extensions, X509_EXTENSION_free);
+    X509_REQ_free(request);
+    return encoded;
+}
+
+// Writes text to path through a temporary file
+static bool write_file(const char* path, const char* text, char* error, size_t error_size) {
+    char temporary[600];
+    snprintf(temporary, sizeof(temporary), "%s.tmp", path);
+    FILE* file = fopen(temporary, "w");
+    bool ok = file && fputs(text, file) >= 0;
+    ok = file && fclose(file) == 0 && ok;
+    if (!ok || rename(temporary, path) != 0) {
+        unlink(temporary);
+        snprintf(error, error_size, "cannot write %s", path);
+        return false;
+    }
+    return true;
+}
+
+// Finalizes a ready order with a CSR for a new key, waits for the
+// certificate and writes it and the key out
+static bool finalize(AcmeSession* session, const char* order_url, const char* finalize_url,
+                     char* error, size_t error_size) {
+    EVP_PKEY* key = generate_key();
+    char* csr = key ? make_csr(session->options, key) : NULL;
+    if (!csr) {
+        EVP_PKEY_free(key);
+        openssl_error("cannot make a certificate request", error, error_size);
+        return false;
+    }
+    char* payload = malloc(strlen(csr) + 16);
+    sprintf(payload, "{\"csr\":\"%s\"}", csr);
+    free(csr);
+
+    AcmeReply reply;
+    bool ok = acme_post(session, finalize_url, payload, &reply, error, error_size);
+    free(payload);
+    if (ok) {
+        if (reply.status != 200) {
+            acme_problem("finalize", &reply, error, error_size);
+            ok = false;
+        }
+        acme_reply_free(&reply);
+    }
+
+    char status[32];
+    char certificate_url[ACME_URL_LENGTH] = "";
+    ok = ok && poll_status(session, "order", order_url, "ready processing", &reply, status,
+                           sizeof(status), error, error_size);
+    if (ok) {
+        json_get_string(reply.body.data, "certificate", certificate_url, sizeof(certificate_url));
+        acme_reply_free(&reply);
+        if (strcmp(status, "valid") != 0 || !certificate_url[0]) {
+            snprintf(error, error_size, "order: %s, with no certificate", status);
+            ok = false;
+        }
+    }
+
+    // The chain, leaf first, as PEM
+    ok = ok && acme_post(session, certificate_url, "", &reply, error, error_size);
+    if (ok) {
+        if (reply.status != 200 || !reply.body.data ||
+            !strstr(reply.body.data, "-----BEGIN CERTIFICATE-----")) {
+            acme_problem("certificate", &reply, error, error_size);
+            ok = false;
+        }
+        // The key goes first: until the chain replaces the old one, a
+        // reload fails and keeps what it has
+        ok = ok && write_key(key, session->options->key_file, error, error_size) &&
+             write_file(session->options->cert_file, reply.body.data, error, error_size);
+        acme_reply_free(&reply);
+    }
+    EVP_PKEY_free(key);
+    return ok;
+}
+
+static bool place_order(AcmeSession* session, char* error, size_t error_size) {
+    const AcmeOptions* options = session->options;
+    StringBuilder payload;
+    sb_init(&payload);
+    sb_append(&payload, "{\"identifiers\":[");
+    for (int i = 0; i < options->domain_count; i++) {
+        char escaped[512];
+        json_escape(options->domains[i], escaped, sizeof(escaped));
+        sb_appendf(&payload, "%s{\"type\":\"dns\",\"value\":\"%s\"}", i > 0 ? "," : "", escaped);
+    }
+    sb_append(&payload, "]}");
+
+    AcmeReply reply;
+    bool ok = acme_post(session, session->new_order, payload.data, &reply, error, error_size);
+    sb_free(&payload);
+    if (!ok) return false;
+    if (reply.status != 201 || !reply.location[0]) {
+        acme_problem("newOrder", &reply, error, error_size);
+        acme_reply_free(&reply);
+        return false;
+    }
+
+    char order_url[ACME_URL_LENGTH];
+    char finalize_url[ACME_URL_LENGTH] = "";
+    snprintf(order_url, sizeof(order_url), "%s", reply.location);
+    json_get_string(reply.body.data, "finalize", finalize_url, sizeof(finalize_url));
+    char (*authorizations)[ACME_URL_LENGTH] = calloc(ACME_MAX_DOMAINS, ACME_URL_LENGTH);
+    int count = 0;
+    for (const char* url = array_first(json_member(reply.body.data, "authorizations"));
+         url && count < ACME_MAX_DOMAINS; url = array_next(url)) {
+        if (json_read_string(url, authorizations[count], ACME_URL_LENGTH)) count++;
+    }
+    acme_reply_free(&reply);
+
+    ok = finalize_url[0] != '\0';
+    if (!ok) snprintf(error, error_size, "newOrder: no finalize URL");
+    for (int i = 0; i < count && ok; i++) {
+        ok = authorize(session, authorizations[i], error, error_size);
+    }
+    free(authorizations);
+    return ok && finalize(session, order_url, finalize_url, error, error_size);
+}
+
+bool acme_setup(char* error, size_t error_size) {
+    curl_global_init(CURL_GLOBAL_DEFAULT);
+    return true;
+}
+
+int acme_days_left(const char* cert_file) {
+    FILE* file = fopen(cert_file, "r");
+    if (!file) return -1;
+    X509* certificate = PEM_read_X509(file, NULL, NULL, NULL);
+    fclose(file);
+    if (!certificate) return -1;
+    int days = -1;
+    int seconds;
+    if (ASN1_TIME_diff(&days, &seconds, NULL, X509_get0_notAfter(certificate)) != 1) days = -1;
+    if (days == 0 && seconds < 0) days = -1;
+    X509_free(certificate);
+    return days;
+}
+
+bool acme_write_placeholder(const AcmeOptions* options, char* error, size_t error_size) {
+    EVP_PKEY* key = generate_key();
+    X509* certificate = X509_new();
+    X509_NAME* name = X509_NAME_new();
+    X509_NAME_add_entry_by_txt(name, "CN", MBSTRING_ASC,
+                               (const unsigned char*)options->domains[0], -1, -1, 0);
+    bool ok = key && X509_set_version(certificate, 2) == 1 &&
+              ASN1_INTEGER_set(X509_get_serialNumber(certificate), 1) == 1 &&
+              X509_gmtime_adj(X509_getm_notBefore(certificate), 0) &&
+              X509_gmtime_adj(X509_getm_notAfter(certificate), 24 * 60 * 60) &&
+              X509_set_subject_name(certificate, name) == 1 &&
+              X509_set_issuer_name(certificate, name) == 1 &&
+              X509_set_pubkey(certificate, key) == 1 &&
+              X509_sign(certificate, key, EVP_sha256()) > 0;
+    X509_NAME_free(name);
+    if (!ok) {
+        openssl_error("cannot make a placeholder certificate", error, error_size);
+    }
+
+    char* pem = NULL;
+    if (ok) {
+        BIO* bio = BIO_new(BIO_s_mem());
+        PEM_write_bio_X509(bio, certificate);
+        char* data;
+        long length = BIO_get_mem_data(bio, &data);
+        pem = malloc(length + 1);
+        memcpy(pem, data, length);
+        pem[length] = '\0';
+        BIO_free(bio);
+    }
+    ok = ok && write_key(key, options->key_file, error, error_size) &&
+         write_file(options->cert_file, pem, error, error_size);
+    free(pem);
+    X509_free(certificate);
+    EVP_PKEY_free(key);
+    return ok;
+}
+
+bool acme_obtain(const AcmeOptions* options, char* error, size_t error_size) {
+    if (options->domain_count < 1) {
+        snprintf(error, error_size, "no domains to order a certificate for");
+        return false;
+    }
+    AcmeSession session = {0};
+    session.options = options;
+    session.account_key = load_account_key(options->account_key, error, error_size);
+    if (!session.account_key) return false;
+    bool ok = describe_account_key(&session, error, error_size) &&
+              read_directory(&session, error, error_size) &&
+              register_account(&session, error, error_size) &&
+              place_order(&session, error, error_size);
+    EVP_PKEY_free(session.account_key);
+    return ok;
+}
+#else
+bool acme_setup(char* error, size_t error_size) {
+    snprintf(error, error_size, "built without ACME support (make WITH_TLS=1 WITH_CURL=1)");
+    return false;
+}
+
+int acme_days_left(const char* cert_file) {
+    return -1;
+}
+
+bool acme_write_placeholder(const AcmeOptions* options, char* error, size_t error_size) {
+    return acme_setup(error, error_size);
+}
+
+bool acme_obtain(const AcmeOptions* options, char* error, size_t error_size) {
+    return acme_setup(error, error_size);
+}
+#endif
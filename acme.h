@@ -0,0 +1,47 @@
+#ifndef ACME_H
+#define ACME_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+// Certificates for the HTTPS listener from an ACME CA such as Let's
+// Encrypt (RFC 8555), using OpenSSL and libcurl. Each domain is proved
+// with an http-01 challenge: the key authorization is written under
+// webroot/.well-known/acme-challenge/, which the plain HTTP listener
+// serves, and removed once the CA has looked.
+
+#define ACME_MAX_DOMAINS 8
+
+typedef struct {
+    const char* directory;      // The CA's directory URL
+    const char* domains[ACME_MAX_DOMAINS];  // The first is the subject
+    int domain_count;
+    const char* email;          // Contact for the CA's expiry notices, "" for none
+    const char* account_key;    // PEM file, an EC P-256 key made on first use
+    const char* webroot;        // Where challenge files go
+    const char* cert_file;      // Written with the issued chain
+    const char* key_file;       // Written with the certificate's new key
+    int timeout;                // Seconds per request to the CA
+} AcmeOptions;
+
+// Gets libcurl ready for acme_obtain(). False, with error set, when built
+// without OpenSSL or libcurl.
+bool acme_setup(char* error, size_t error_size);
+
+// Whole days until the certificate in cert_file expires, negative once it
+// has, and -1 as well if there is no certificate to read
+int acme_days_left(const char* cert_file);
+
+// Writes a self-signed certificate for the domains, valid for a day, and
+// its key to cert_file and key_file, so HTTPS can start before the first
+// order is issued
+bool acme_write_placeholder(const AcmeOptions* options, char* error, size_t error_size);
+
+// Registers the account if need be, orders a certificate for the domains,
+// answers their challenges and writes the chain and a new key over
+// cert_file and key_file. Blocks until the CA is done or gives up. False,
+// with error set, if any step fails; nothing is written before the chain
+// has been downloaded.
+bool acme_obtain(const AcmeOptions* options, char* error, size_t error_size);
+
+#endif
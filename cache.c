@@ -0,0 +1,263 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <pthread.h>
+
+#include "cache.h"
+
+// Entries are both chained in a hash bin and linked in use order, most
+// recently used first
+typedef struct Entry {
+    char* key;
+    long long expires;      // Unix seconds
+    struct Entry* bin_next;
+    struct Entry* newer;
+    struct Entry* older;
+    unsigned char value[];
+} Entry;
+
+struct Cache {
+    int capacity;
+    int ttl;
+    size_t value_size;
+    Entry** bins;           // capacity of them, so chains stay short
+    Entry* newest;
+    Entry* oldest;
+    int count;
+    pthread_mutex_t lock;
+    Redis* redis;           // Shared, in place of everything above, when set
+    char prefix[64];
+};
+
+#define SCAN_COUNT "1000"       // Keys asked for per SCAN while clearing a shared cache
+
+// FNV-1a
+static unsigned int hash_key(const char* key) {
+    unsigned int hash = 2166136261u;
+    for (; *key; key++) {
+        hash ^= (unsigned char)*key;
+        hash *= 16777619u;
+    }
+    return hash;
+}
+
+// Caller holds the lock
+static Entry** find(Cache* cache, const char* key) {
+    Entry** link = &cache->bins[hash_key(key) % cache->capacity];
+    while (*link && strcmp((*link)->key, key) != 0) {
+        link = &(*link)->bin_next;
+    }
+    return link;
+}
+
+// Takes entry out of the use order. Caller holds the lock.
+static void unlink_use(Cache* cache, Entry* entry) {
+    if (entry->newer) entry->newer->older = entry->older;
+    else cache->newest = entry->older;
+    if (entry->older) entry->older->newer = entry->newer;
+    else cache->oldest = entry->newer;
+    entry->newer = entry->older = NULL;
+}
+
+// Caller holds the lock
+static void mark_used(Cache* cache, Entry* entry) {
+    entry->older = cache->newest;
+    entry->newer = NULL;
+    if (cache->newest) cache->newest->newer = entry;
+    cache->newest = entry;
+    if (!cache->oldest) cache->oldest = entry;
+}
+
+// Unlinks and frees entry, which link points to. Caller holds the lock.
+static void remove_entry(Cache* cache, Entry** link) {
+    Entry* entry = *link;
+    *link = entry->bin_next;
+    unlink_use(cache, entry);
+    free(entry->key);
+    free(entry);
+    cache->count--;
+}
+
+// prefix followed by key, heap allocated
+static char* shared_key(const Cache* cache, const char* key) {
+    size_t length = strlen(cache->prefix) + strlen(key);
+    char* name = malloc(length + 1);
+    snprintf(name, length + 1, "%s%s", cache->prefix, key);
+    return name;
+}
+
+static bool shared_get(Cache* cache, const char* key, void* value) {
+    char* name = shared_key(cache, key);
+    const char* argv[] = {"GET", name};
+    size_t lengths[] = {3, strlen(name)};
+    RedisReply reply;
+    bool found = redis_command(cache->redis, 2, argv, lengths, &reply);
+    if (found) {
+        found = reply.count == 1 && reply.values[0] && reply.lengths[0] == cache->value_size;
+        if (found) memcpy(value, reply.values[0], cache->value_size);
+        redis_reply_free(&reply);
+    }
+    free(name);
+    return found;
+}
+
+static void shared_put(Cache* cache, const char* key, const void* value) {
+    char* name = shared_key(cache, key);
+    char ttl[16];
+    snprintf(ttl, sizeof(ttl), "%d", cache->ttl);
+    const char* argv[] = {"SET", name, value, "EX", ttl};
+    size_t lengths[] = {3, strlen(name), cache->value_size, 2, strlen(ttl)};
+    redis_command(cache->redis, 5, argv, lengths, NULL);
+    free(name);
+}
+
+// Unlinks the prefix's keys a SCAN page at a time
+static void shared_clear(Cache* cache) {
+    char pattern[72];
+    snprintf(pattern, sizeof(pattern), "%s*", cache->prefix);
+    char cursor[24] = "0";
+    do {
+        const char* argv[] = {"SCAN", cursor, "MATCH", pattern, "COUNT", SCAN_COUNT};
+        size_t lengths[] = {4, strlen(cursor), 5, strlen(pattern), 5, strlen(SCAN_COUNT)};
+        RedisReply reply;
+        if (!redis_command(cache->redis, 6, argv, lengths, &reply)) return;
+        if (reply.count < 1 || !reply.values[0]) {
+            redis_reply_free(&reply);
+            return;
+        }
+
+        // The reply is the next cursor followed by the keys found. It is
+        // reused as the command: UNLINK in the cursor's place, then the keys.
+        snprintf(cursor, sizeof(cursor), "%s", reply.values[0]);
+        free(reply.values[0]);
+        reply.values[0] = NULL;
+        if (reply.count > 1) {
+            const char** command = (const char**)reply.values;
+            command[0] = "UNLINK";
+            reply.lengths[0] = 6;
+            redis_command(cache->redis, reply.count, command, reply.lengths, NULL);
+            command[0] = NULL;
+        }
+        redis_reply_free(&reply);
+    } while (strcmp(cursor, "0") != 0);
+}
+
+Cache* cache_create(int capacity, int ttl, size_t value_size) {
+    Cache* cache = calloc(1, sizeof(Cache));
+    cache->capacity = capacity > 0 ? capacity : 1;
+    cache->ttl = ttl > 0 ? ttl : 1;
+    cache->value_size = value_size;
+    cache->bins = calloc(cache->capacity, sizeof(Entry*));
+    pthread_mutex_init(&cache->lock, NULL);
+    return cache;
+}
+
+Cache* cache_create_shared(Redis* redis, const char* prefix, int ttl, size_t value_size) {
+    Cache* cache = calloc(1, sizeof(Cache));
+    cache->ttl = ttl > 0 ? ttl : 1;
+    cache->value_size = value_size;
+    cache->redis = redis;
+    snprintf(cache->prefix, sizeof(cache->prefix), "%s", prefix);
+    return cache;
+}
+
+void cache_free(Cache* cache) {
+    if (cache->redis) {
+        // The keys are shared, and outlive this replica
+        free(cache);
+        return;
+    }
+    cache_clear(cache);
+    free(cache->bins);
+    pthread_mutex_destroy(&cache->lock);
+    free(cache);
+}
+
+bool cache_get(Cache* cache, const char* key, long long now, void* value) {
+    if (cache->redis) return shared_get(cache, key, value);
+
+    pthread_mutex_lock(&cache->lock);
+    Entry** link = find(cache, key);
+    bool found = false;
+    if (*link && (*link)->expires <= now) {
+        remove_entry(cache, link);
+    } else if (*link) {
+        Entry* entry = *link;
+        memcpy(value, entry->value, cache->value_size);
+        unlink_use(cache, entry);
+        mark_used(cache, entry);
+        found = true;
+    }
+    pthread_mutex_unlock(&cache->lock);
+    return found;
+}
+
+void cache_put(Cache* cache, const char* key, long long now, const void* value) {
+    if (cache->redis) {
+        shared_put(cache, key, value);
+        return;
+    }
+
+    pthread_mutex_lock(&cache->lock);
+    Entry** link = find(cache, key);
+    if (*link) {
+        remove_entry(cache, link);
+    } else if (cache->count == cache->capacity) {
+        remove_entry(cache, find(cache, cache->oldest->key));
+        link = find(cache, key);
+    }
+
+    Entry* entry = malloc(sizeof(Entry) + cache->value_size);
+    entry->key = strdup(key);
+    entry->expires = now + cache->ttl;
+    memcpy(entry->value, value, cache->value_size);
+    entry->bin_next = *link;
+    *link = entry;
+    mark_used(cache, entry);
+    cache->count++;
+    pthread_mutex_unlock(&cache->lock);
+}
+
+void cache_clear(Cache* cache) {
+    if (cache->redis) {
+        shared_clear(cache);
+        return;
+    }
+
+    pthread_mutex_lock(&cache->lock);
+    for (int i = 0; i < cache->capacity; i++) {
+        Entry* entry = cache->bins[i];
+        while (entry) {
+            Entry* next = entry->bin_next;
+            free(entry->key);
+            free(entry);
+            entry = next;
+        }
+        cache->bins[i] = NULL;
+    }
+    cache->newest = cache->oldest = NULL;
+    cache->count = 0;
+    pthread_mutex_unlock(&cache->lock);
+}
+
+int cache_evict_expired(Cache* cache, long long now) {
+    if (cache->redis) return 0;
+
+    pthread_mutex_lock(&cache->lock);
+    int evicted = 0;
+    for (int i = 0; i < cache->capacity; i++) {
+        Entry** link = &cache->bins[i];
+        while (*link) {
+            if ((*link)->expires <= now) {
+                remove_entry(cache, link);
+                evicted++;
+            } else {
+                link = &(*link)->bin_next;
+            }
+        }
+    }
+    pthread_mutex_unlock(&cache->lock);
+    return evicted;
+}
@@ -0,0 +1,40 @@
+#ifndef CACHE_H
+#define CACHE_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+#include "redis.h"
+
+// Fixed-size values by string key, at most capacity of them, each kept ttl
+// seconds from when it was put. Once full, putting a new key evicts the one
+// used longest ago. Safe to share between threads.
+typedef struct Cache Cache;
+
+Cache* cache_create(int capacity, int ttl, size_t value_size);
+
+// A cache kept in Redis under keys starting with prefix, shared by every
+// replica using the same server. Redis decides what to evict when it runs
+// out of memory (see its maxmemory-policy), so there is no capacity.
+// Values are stored as their bytes, so the replicas sharing one have to
+// agree on their layout. A failing server makes every get miss.
+Cache* cache_create_shared(Redis* redis, const char* prefix, int ttl, size_t value_size);
+void cache_free(Cache* cache);
+
+// Copies the value for key into value (value_size bytes) and returns true,
+// or returns false if it isn't cached or has expired. now is Unix seconds.
+bool cache_get(Cache* cache, const char* key, long long now, void* value);
+
+// Caches a copy of value for key, replacing any value it had
+void cache_put(Cache* cache, const char* key, long long now, const void* value);
+
+// Forgets every key, e.g. once what the values were worked out from
+// changes. For a shared cache that is every replica's keys.
+void cache_clear(Cache* cache);
+
+// Frees the keys expired by now and returns how many there were. Expired
+// keys are otherwise only dropped when looked up or pushed out. Redis
+// expires a shared cache's keys itself, so that is a no-op.
+int cache_evict_expired(Cache* cache, long long now);
+
+#endif
@@ -0,0 +1,218 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+#include <pthread.h>
+
+#ifdef HAVE_CURL
+#include <curl/curl.h>
+#endif
+
+#include "callback.h"
+#include "signature.h"
+
+bool callback_url_valid(const char* url) {
+    return (strncmp(url, "http://", 7) == 0 || strncmp(url, "https://", 8) == 0) &&
+           strlen(url) < CALLBACK_MAX_URL;
+}
+
+#ifdef HAVE_CURL
+typedef struct Delivery {
+    char url[CALLBACK_MAX_URL];
+    char event[64];
+    char* body;
+    int attempts;           // Made so far
+    time_t due;             // When to make the next one
+    struct Delivery* next;
+} Delivery;
+
+struct CallbackQueue {
+    char secret[128];
+    int timeout;
+    int retries;
+    int backoff;
+    Delivery* pending;      // Soonest due first
+    bool stopping;
+    pthread_t thread;
+    pthread_mutex_t lock;
+    pthread_cond_t changed;
+};
+
+// Call with the lock held
+static void schedule(CallbackQueue* queue, Delivery* delivery) {
+    Delivery** link = &queue->pending;
+    while (*link && (*link)->due <= delivery->due) link = &(*link)->next;
+    delivery->next = *link;
+    *link = delivery;
+    pthread_cond_signal(&queue->changed);
+}
+
+static size_t discard_body(char* data, size_t size, size_t count, void* userdata) {
+    return size * count;
+}
+
+// Makes one attempt. Returns the HTTP status, or 0 with error set when no
+// response came back.
+static long post(CallbackQueue* queue, const Delivery* delivery, char* error, size_t error_size) {
+    CURL* curl = curl_easy_init();
+    if (!curl) {
+        snprintf(error, error_size, "cannot create HTTP client");
+        return 0;
+    }
+
+    // Signed afresh on every attempt so the timestamp stays current
+    char timestamp[32];
+    snprintf(timestamp, sizeof(timestamp), "%lld", (long long)time(NULL));
+    size_t signed_length = strlen(timestamp) + 1 + strlen(delivery->body);
+    char* signed_data = malloc(signed_length + 1);
+    snprintf(signed_data, signed_length + 1, "%s\n%s", timestamp, delivery->body);
+    char digest[SIGNATURE_HEX_LENGTH + 1];
+    hmac_sha256_hex(queue->secret, strlen(queue->secret), signed_data, signed_length, digest);
+    free(signed_data);
+
+    char header[160];
+    struct curl_slist* headers = curl_slist_append(NULL, "Content-Type: application/json");
+    snprintf(header, sizeof(header), "X-Phoneval-Event: %s", delivery->event);
+    headers = curl_slist_append(headers, header);
+    snprintf(header, sizeof(header), "X-Phoneval-Timestamp: %s", timestamp);
+    headers = curl_slist_append(headers, header);
+    snprintf(header, sizeof(header), "X-Phoneval-Signature: sha256=%s", digest);
+    headers = curl_slist_append(headers, header);
+
+    curl_easy_setopt(curl, CURLOPT_URL, delivery->url);
+    curl_easy_setopt(curl, CURLOPT_TIMEOUT, (long)queue->timeout);
+    curl_easy_setopt(curl, CURLOPT_NOSIGNAL, 1L);
+    curl_easy_setopt(curl, CURLOPT_PROTOCOLS_STR, "http,https");
+    curl_easy_setopt(curl, CURLOPT_HTTPHEADER, headers);
+    curl_easy_setopt(curl, CURLOPT_POSTFIELDS, delivery->body);
+    curl_easy_setopt(curl, CURLOPT_WRITEFUNCTION, discard_body);
+
+    long status = 0;
+    CURLcode rc = curl_easy_perform(curl);
+    if (rc != CURLE_OK) {
+        snprintf(error, error_size, "%s", curl_easy_strerror(rc));
+    } else {
+        curl_easy_getinfo(curl, CURLINFO_RESPONSE_CODE, &status);
+        snprintf(error, error_size, "HTTP %ld", status);
+    }
+    curl_slist_free_all(headers);
+    curl_easy_cleanup(curl);
+    return status;
+}
+
+static void* delivery_thread(void* arg) {
+    CallbackQueue* queue = arg;
+
+    pthread_mutex_lock(&queue->lock);
+    while (!queue->stopping) {
+        if (!queue->pending) {
+            pthread_cond_wait(&queue->changed, &queue->lock);
+            continue;
+        }
+        if (queue->pending->due > time(NULL)) {
+            struct timespec until = {queue->pending->due, 0};
+            pthread_cond_timedwait(&queue->changed, &queue->lock, &until);
+            continue;
+        }
+
+        Delivery* delivery = queue->pending;
+        queue->pending = delivery->next;
+        pthread_mutex_unlock(&queue->lock);
+
+        char error[256];
+        long status = post(queue, delivery, error, sizeof(error));
+        delivery->attempts++;
+        bool delivered = status >= 200 && status < 300;
+        bool retry = !delivered && (status == 0 || status == 408 || status == 429 || status >= 500);
+
+        pthread_mutex_lock(&queue->lock);
+        if (retry && delivery->attempts <= queue->retries) {
+            delivery->due = time(NULL) + ((time_t)queue->backoff << (delivery->attempts - 1));
+            schedule(queue, delivery);
+        } else {
+            if (!delivered) {
+                fprintf(stderr, "Gave up on %s callback after %d attempt(s): %s\n",
+                        delivery->event, delivery->attempts, error);
+            }
+            free(delivery->body);
+            free(delivery);
+        }
+    }
+    pthread_mutex_unlock(&queue->lock);
+    return NULL;
+}
+
+CallbackQueue* callback_queue_create(const char* secret, int timeout, int retries, int backoff,
+                                     char* error, size_t error_size) {
+    if (strlen(secret) >= sizeof(((CallbackQueue*)0)->secret)) {
+        snprintf(error, error_size, "callback secret too long");
+        return NULL;
+    }
+    curl_global_init(CURL_GLOBAL_DEFAULT);
+
+    CallbackQueue* queue = calloc(1, sizeof(CallbackQueue));
+    snprintf(queue->secret, sizeof(queue->secret), "%s", secret);
+    queue->timeout = timeout;
+    queue->retries = retries;
+    queue->backoff = backoff;
+    pthread_mutex_init(&queue->lock, NULL);
+    pthread_cond_init(&queue->changed, NULL);
+    if (pthread_create(&queue->thread, NULL, delivery_thread, queue) != 0) {
+        snprintf(error, error_size, "cannot start the delivery thread");
+        pthread_mutex_destroy(&queue->lock);
+        pthread_cond_destroy(&queue->changed);
+        free(queue);
+        return NULL;
+    }
+    return queue;
+}
+
+void callback_queue_free(CallbackQueue* queue) {
+    pthread_mutex_lock(&queue->lock);
+    queue->stopping = true;
+    pthread_cond_signal(&queue->changed);
+    pthread_mutex_unlock(&queue->lock);
+    pthread_join(queue->thread, NULL);
+
+    int dropped = 0;
+    while (queue->pending) {
+        Delivery* delivery = queue->pending;
+        queue->pending = delivery->next;
+        free(delivery->body);
+        free(delivery);
+        dropped++;
+    }
+    if (dropped > 0) {
+        fprintf(stderr, "Dropped %d callback(s) waiting for a retry\n", dropped);
+    }
+    pthread_mutex_destroy(&queue->lock);
+    pthread_cond_destroy(&queue->changed);
+    free(queue);
+}
+
+void callback_send(CallbackQueue* queue, const char* url, const char* event, const char* body) {
+    Delivery* delivery = calloc(1, sizeof(Delivery));
+    snprintf(delivery->url, sizeof(delivery->url), "%s", url);
+    snprintf(delivery->event, sizeof(delivery->event), "%s", event);
+    delivery->body = strdup(body);
+    delivery->due = time(NULL);
+
+    pthread_mutex_lock(&queue->lock);
+    schedule(queue, delivery);
+    pthread_mutex_unlock(&queue->lock);
+}
+#else
+CallbackQueue* callback_queue_create(const char* secret, int timeout, int retries, int backoff,
+                                     char* error, size_t error_size) {
+    snprintf(error, error_size, "built without callback support (make WITH_CURL=1)");
+    return NULL;
+}
+
+void callback_queue_free(CallbackQueue* queue) {
+}
+
+void callback_send(CallbackQueue* queue, const char* url, const char* event, const char* body) {
+}
+#endif
@@ -0,0 +1,33 @@
+#ifndef CALLBACK_H
+#define CALLBACK_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+// Signed JSON POSTs to URLs that clients register, e.g. to be told when a
+// job finishes. Each request carries
+//   X-Phoneval-Event: job.completed
+//   X-Phoneval-Timestamp: 1792108800
+//   X-Phoneval-Signature: sha256=<hex HMAC-SHA256 of timestamp "\n" body>
+// Deliveries run on a background thread. A network error, 408, 429 or 5xx
+// is retried after backoff seconds, doubling each time; any other status
+// ends the delivery. Safe to share between threads.
+typedef struct CallbackQueue CallbackQueue;
+
+#define CALLBACK_MAX_URL 512        // Longest URL, with its NUL
+
+// timeout is per attempt, in seconds. retries is how many times a failed
+// delivery is tried again. Fails if built without curl.
+CallbackQueue* callback_queue_create(const char* secret, int timeout, int retries, int backoff,
+                                     char* error, size_t error_size);
+
+// Drops deliveries still waiting for a retry
+void callback_queue_free(CallbackQueue* queue);
+
+// Queues body (JSON) for POSTing to url
+void callback_send(CallbackQueue* queue, const char* url, const char* event, const char* body);
+
+// An http:// or https:// URL short enough to queue
+bool callback_url_valid(const char* url);
+
+#endif
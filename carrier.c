@@ -0,0 +1,315 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <ctype.h>
+
+#ifdef HAVE_CURL
+#include <curl/curl.h>
+#endif
+
+#include "carrier.h"
+#include "tracing.h"
+
+static const char* status_names[] = {"unknown", "active", "unreachable", "disconnected"};
+
+static const char* source_names[] = {"lookup", "portability"};
+
+const char* line_status_string(LineStatus status) {
+    return status_names[status];
+}
+
+const char* carrier_source_string(CarrierSource source) {
+    return source_names[source];
+}
+
+// Finds "key": and returns the start of its value
+static const char* find_value(const char* json, const char* key) {
+    char pattern[128];
+    snprintf(pattern, sizeof(pattern), "\"%s\"", key);
+    const char* p = strstr(json, pattern);
+    if (!p) return NULL;
+
+    p += strlen(pattern);
+    while (isspace((unsigned char)*p)) p++;
+    if (*p != ':') return NULL;
+    p++;
+    while (isspace((unsigned char)*p)) p++;
+    return p;
+}
+
+bool carrier_json_string(const char* json, const char* key, char* out, size_t out_size) {
+    const char* p = find_value(json, key);
+    if (!p || *p != '"') return false;
+
+    p++;
+    size_t len = 0;
+    while (*p && *p != '"' && len + 1 < out_size) {
+        if (*p == '\\' && p[1]) p++;
+        out[len++] = *p++;
+    }
+    out[len] = '\0';
+    return true;
+}
+
+int carrier_json_bool(const char* json, const char* key) {
+    const char* p = find_value(json, key);
+    if (!p) return -1;
+    if (strncmp(p, "true", 4) == 0) return 1;
+    if (strncmp(p, "false", 5) == 0) return 0;
+    return -1;
+}
+
+#ifdef HAVE_CURL
+static size_t append_body(char* data, size_t size, size_t count, void* userdata) {
+    char** body = userdata;
+    size_t old_len = strlen(*body);
+    size_t add = size * count;
+    char* grown = realloc(*body, old_len + add + 1);
+    if (!grown) return 0;
+    memcpy(grown + old_len, data, add);
+    grown[old_len + add] = '\0';
+    *body = grown;
+    return add;
+}
+
+// Progress callback: a non-zero return aborts the transfer
+static int check_context(void* ctx, curl_off_t download_total, curl_off_t downloaded,
+                         curl_off_t upload_total, curl_off_t uploaded) {
+    return context_done(ctx);
+}
+
+// GETs url, or POSTs json to it when that isn't NULL
+static char* http_request(const Context* ctx, const char* url, const char* userpwd,
+                          const char* json, int timeout, long* status, char* error,
+                          size_t error_size) {
+    CURL* curl = curl_easy_init();
+    if (!curl) {
+        snprintf(error, error_size, "cannot create HTTP client");
+        return NULL;
+    }
+
+    char* body = calloc(1, 1);
+    curl_easy_setopt(curl, CURLOPT_URL, url);
+    curl_easy_setopt(curl, CURLOPT_TIMEOUT, (long)timeout);
+    // Signals can't interrupt DNS lookups on worker threads
+    curl_easy_setopt(curl, CURLOPT_NOSIGNAL, 1L);
+    curl_easy_setopt(curl, CURLOPT_WRITEFUNCTION, append_body);
+    curl_easy_setopt(curl, CURLOPT_WRITEDATA, &body);
+    if (ctx) {
+        // libcurl calls it at least once a second while the transfer runs
+        curl_easy_setopt(curl, CURLOPT_XFERINFOFUNCTION, check_context);
+        curl_easy_setopt(curl, CURLOPT_XFERINFODATA, (void*)ctx);
+        curl_easy_setopt(curl, CURLOPT_NOPROGRESS, 0L);
+    }
+    if (userpwd) {
+        curl_easy_setopt(curl, CURLOPT_USERPWD, userpwd);
+    }
+    struct curl_slist* headers = NULL;
+    if (json) {
+        headers = curl_slist_append(headers, "Content-Type: application/json");
+        curl_easy_setopt(curl, CURLOPT_POSTFIELDS, json);
+    }
+    // So that a provider taking part in tracing joins the request's trace
+    if (ctx && ctx->span) {
+        char traceparent[TRACEPARENT_LENGTH];
+        char header[TRACEPARENT_LENGTH + 16];
+        span_traceparent(ctx->span, traceparent, sizeof(traceparent));
+        snprintf(header, sizeof(header), "traceparent: %s", traceparent);
+        headers = curl_slist_append(headers, header);
+    }
+    if (headers) curl_easy_setopt(curl, CURLOPT_HTTPHEADER, headers);
+
+    CURLcode rc = curl_easy_perform(curl);
+    if (rc != CURLE_OK) {
+        snprintf(error, error_size, "%s", rc == CURLE_ABORTED_BY_CALLBACK ? "request cancelled"
+                                                                          : curl_easy_strerror(rc));
+        free(body);
+        body = NULL;
+    } else {
+        curl_easy_getinfo(curl, CURLINFO_RESPONSE_CODE, status);
+    }
+    curl_easy_cleanup(curl);
+    curl_slist_free_all(headers);
+    return body;
+}
+
+char* carrier_http_get(const Context* ctx, const char* url, const char* userpwd, int timeout,
+                       long* status, char* error, size_t error_size) {
+    return http_request(ctx, url, userpwd, NULL, timeout, status, error, error_size);
+}
+
+char* carrier_http_post_json(const Context* ctx, const char* url, const char* userpwd,
+                             const char* json, int timeout, long* status, char* error,
+                             size_t error_size) {
+    return http_request(ctx, url, userpwd, json, timeout, status, error, error_size);
+}
+#endif
+
+CarrierLookup* carrier_lookup_open(const char* dsn, int timeout, char* error, size_t error_size) {
+    if (strncmp(dsn, "twilio://", 9) == 0) {
+#ifdef HAVE_CURL
+        char credentials[512];
+        snprintf(credentials, sizeof(credentials), "%s", dsn + 9);
+        char* colon = strchr(credentials, ':');
+        if (!colon || colon == credentials || !colon[1]) {
+            snprintf(error, error_size, "expected twilio://ACCOUNT_SID:AUTH_TOKEN");
+            return NULL;
+        }
+        *colon = '\0';
+        curl_global_init(CURL_GLOBAL_DEFAULT);
+        return twilio_lookup_open(credentials, colon + 1, timeout, error, error_size);
+#else
+        snprintf(error, error_size, "built without carrier lookup support (make WITH_CURL=1)");
+        return NULL;
+#endif
+    }
+
+    if (strncmp(dsn, "hlr:", 4) == 0) {
+#ifdef HAVE_CURL
+        if (strncmp(dsn + 4, "http://", 7) != 0 && strncmp(dsn + 4, "https://", 8) != 0) {
+            snprintf(error, error_size, "expected hlr:https://HOST/PATH");
+            return NULL;
+        }
+        curl_global_init(CURL_GLOBAL_DEFAULT);
+        return hlr_lookup_open(dsn + 4, timeout, error, error_size);
+#else
+        snprintf(error, error_size, "built without carrier lookup support (make WITH_CURL=1)");
+        return NULL;
+#endif
+    }
+
+    // Not echoed back, the DSN may hold a secret
+    snprintf(error, error_size, "expected twilio://ACCOUNT_SID:AUTH_TOKEN or hlr:URL");
+    return NULL;
+}
+
+// ============= Resilient Lookup =============
+
+typedef struct {
+    CarrierLookup* inner;
+    Resilience* resilience;
+    char name[64];
+} ResilientLookup;
+
+// The arguments of one lookup, for each attempt at it
+typedef struct {
+    CarrierLookup* inner;
+    const char* number;
+    CarrierInfo* info;
+    CarrierResult result;
+} LookupAttempt;
+
+static bool attempt_lookup(void* arg, const Context* ctx, char* error, size_t error_size) {
+    LookupAttempt* attempt = arg;
+    attempt->result = attempt->inner->lookup(attempt->inner, ctx, attempt->number, attempt->info,
+                                             error, error_size);
+    return attempt->result != CARRIER_ERROR;
+}
+
+static CarrierResult resilient_lookup(CarrierLookup* lookup, const Context* ctx,
+                                      const char* number, CarrierInfo* info, char* error,
+                                      size_t error_size) {
+    ResilientLookup* resilient = lookup->data;
+    LookupAttempt attempt = {resilient->inner, number, info, CARRIER_ERROR};
+    if (!resilience_call(resilient->resilience, ctx, attempt_lookup, &attempt, error, error_size)) {
+        return CARRIER_ERROR;
+    }
+    return attempt.result;
+}
+
+static void resilient_close(CarrierLookup* lookup) {
+    ResilientLookup* resilient = lookup->data;
+    resilient->inner->close(resilient->inner);
+    resilience_free(resilient->resilience);
+    free(resilient);
+    free(lookup);
+}
+
+CarrierLookup* resilient_carrier_lookup_wrap(CarrierLookup* inner, const char* name,
+                                             const ResiliencePolicy* policy) {
+    ResilientLookup* resilient = calloc(1, sizeof(ResilientLookup));
+    resilient->inner = inner;
+    snprintf(resilient->name, sizeof(resilient->name), "%s", name ? name : inner->name);
+    resilient->resilience = resilience_create("carrier", resilient->name, policy);
+
+    CarrierLookup* lookup = calloc(1, sizeof(CarrierLookup));
+    lookup->name = resilient->name;
+    lookup->lookup = resilient_lookup;
+    lookup->close = resilient_close;
+    lookup->data = resilient;
+    return lookup;
+}
+
+// ============= Routed Lookup =============
+
+typedef struct {
+    CarrierLookup* providers[ROUTE_MAX_PROVIDERS];
+    ProviderRoute routes[ROUTE_MAX_PROVIDERS];
+    int count;
+    char names[256];        // "hlr, twilio", the lookup's name
+} RoutedLookup;
+
+static CarrierResult routed_lookup(CarrierLookup* lookup, const Context* ctx, const char* number,
+                                   CarrierInfo* info, char* error, size_t error_size) {
+    RoutedLookup* routed = lookup->data;
+    char region[3];
+    int order[ROUTE_MAX_PROVIDERS];
+    route_region(number, region);
+    int count = route_order(routed->routes, routed->count, region, order);
+    if (count == 0) {
+        snprintf(error, error_size, "no provider for region %s", *region ? region : "unknown");
+        return CARRIER_NO_PROVIDER;
+    }
+
+    // Each provider's error, "hlr: HTTP 503; twilio: timed out"
+    size_t used = 0;
+    error[0] = '\0';
+    Span* span = ctx ? ctx->span : NULL;
+    for (int i = 0; i < count && (i == 0 || !context_done(ctx)); i++) {
+        CarrierLookup* provider = routed->providers[order[i]];
+        char provider_error[256] = "";
+        span_set_string(span, "peer.service", provider->name);
+        span_set_int(span, "provider.failovers", i);
+        CarrierResult result = provider->lookup(provider, ctx, number, info, provider_error,
+                                                sizeof(provider_error));
+        if (result != CARRIER_ERROR) return result;
+        if (used < error_size) {
+            used += (size_t)snprintf(error + used, error_size - used, "%s%s: %s", used ? "; " : "",
+                                     provider->name, provider_error);
+        }
+    }
+    return CARRIER_ERROR;
+}
+
+static void routed_close(CarrierLookup* lookup) {
+    RoutedLookup* routed = lookup->data;
+    for (int i = 0; i < routed->count; i++) {
+        routed->providers[i]->close(routed->providers[i]);
+    }
+    free(routed);
+    free(lookup);
+}
+
+CarrierLookup* routed_carrier_lookup_create(void) {
+    CarrierLookup* lookup = calloc(1, sizeof(CarrierLookup));
+    RoutedLookup* routed = calloc(1, sizeof(RoutedLookup));
+    lookup->name = routed->names;
+    lookup->lookup = routed_lookup;
+    lookup->close = routed_close;
+    lookup->data = routed;
+    return lookup;
+}
+
+bool routed_carrier_lookup_add(CarrierLookup* lookup, CarrierLookup* provider,
+                               const ProviderRoute* route) {
+    RoutedLookup* routed = lookup->data;
+    if (routed->count == ROUTE_MAX_PROVIDERS) return false;
+    routed->providers[routed->count] = provider;
+    routed->routes[routed->count] = *route;
+    routed->routes[routed->count].dsn = NULL;
+    routed->count++;
+    size_t length = strlen(routed->names);
+    snprintf(routed->names + length, sizeof(routed->names) - length, "%s%s", length ? ", " : "",
+             provider->name);
+    return true;
+}
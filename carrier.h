@@ -0,0 +1,103 @@
+#ifndef CARRIER_H
+#define CARRIER_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+#include "context.h"
+#include "resilience.h"
+#include "routing.h"
+
+// What a lookup provider knows about a number's line
+typedef enum {
+    LINE_STATUS_UNKNOWN,
+    LINE_STATUS_ACTIVE,
+    LINE_STATUS_UNREACHABLE,    // Switched off or out of coverage
+    LINE_STATUS_DISCONNECTED    // Not assigned to a subscriber
+} LineStatus;
+
+// Where an answer came from
+typedef enum {
+    CARRIER_SOURCE_LOOKUP,          // The provider, asked about this number
+    CARRIER_SOURCE_PORTABILITY      // The offline portability dataset
+} CarrierSource;
+
+typedef struct {
+    char carrier[128];      // Current network, after any port
+    char line_type[32];     // As the provider reports it, e.g. "mobile"
+    char mcc[4];            // Mobile country and network codes
+    char mnc[4];
+    int ported;             // 1 or 0, -1 if the provider doesn't say
+    LineStatus status;
+    CarrierSource source;
+    char as_of[11];         // YYYY-MM-DD of the portability dataset it came from
+} CarrierInfo;
+
+typedef enum {
+    CARRIER_OK,
+    CARRIER_NOT_FOUND,
+    CARRIER_ERROR,
+    CARRIER_NO_PROVIDER     // None of the routed providers serves the number's region
+} CarrierResult;
+
+// Carrier/HLR lookup provider. Each implementation fills in the operations
+// and keeps its own state in data. lookup may be called from many threads.
+typedef struct CarrierLookup CarrierLookup;
+struct CarrierLookup {
+    const char* name;
+
+    // number is in E.164 form. On CARRIER_ERROR, error says why. The call
+    // to the provider is abandoned once ctx is done; NULL waits it out.
+    CarrierResult (*lookup)(CarrierLookup* lookup, const Context* ctx, const char* number,
+                            CarrierInfo* info, char* error, size_t error_size);
+    void (*close)(CarrierLookup* lookup);
+
+    void* data;
+};
+
+#ifdef HAVE_CURL
+CarrierLookup* twilio_lookup_open(const char* account_sid, const char* auth_token, int timeout,
+                                  char* error, size_t error_size);
+CarrierLookup* hlr_lookup_open(const char* url, int timeout, char* error, size_t error_size);
+
+// GETs url and returns the heap allocated body, caller frees. userpwd is
+// "user:password" for basic auth or NULL. Sets *status to the HTTP status.
+// Gives up, as if it had timed out, once ctx is done.
+char* carrier_http_get(const Context* ctx, const char* url, const char* userpwd, int timeout,
+                       long* status, char* error, size_t error_size);
+// POSTs json to url, otherwise as carrier_http_get()
+char* carrier_http_post_json(const Context* ctx, const char* url, const char* userpwd,
+                             const char* json, int timeout, long* status, char* error,
+                             size_t error_size);
+#endif
+
+// Opens a provider from a DSN: "twilio://ACCOUNT_SID:AUTH_TOKEN" or
+// "hlr:https://host/path?key=..." for a generic HLR HTTP API. timeout is
+// in seconds.
+CarrierLookup* carrier_lookup_open(const char* dsn, int timeout, char* error, size_t error_size);
+
+// Wraps a provider so that failed lookups are retried and a circuit
+// breaker stops calling it while it's down, per policy (see
+// resilience.h). name is the wrapper's, for logs and metrics, NULL for
+// inner's. Closing the wrapper closes the inner provider.
+CarrierLookup* resilient_carrier_lookup_wrap(CarrierLookup* inner, const char* name,
+                                             const ResiliencePolicy* policy);
+
+// A lookup sending each number to the providers added to it as route says
+// (see routing.h), trying the next when one fails. Its error then names
+// each provider's. Numbers no provider serves get CARRIER_NO_PROVIDER.
+// Closing it closes the providers.
+CarrierLookup* routed_carrier_lookup_create(void);
+// False once it has ROUTE_MAX_PROVIDERS
+bool routed_carrier_lookup_add(CarrierLookup* routed, CarrierLookup* provider,
+                               const ProviderRoute* route);
+
+// Pulls fields out of a provider's JSON reply. Keys are matched anywhere
+// in the document, so they must be unique within it.
+bool carrier_json_string(const char* json, const char* key, char* out, size_t out_size);
+int carrier_json_bool(const char* json, const char* key);   // 1, 0 or -1 if absent
+
+const char* line_status_string(LineStatus status);
+const char* carrier_source_string(CarrierSource source);
+
+#endif
@@ -0,0 +1,87 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include "carrier.h"
+
+// Generic HLR lookup over HTTP. The number is appended to the configured
+// URL as number=%2B<E.164 digits> and the reply is expected to be JSON:
+//   {"carrier": "Vodafone UK", "mcc": "234", "mnc": "15", "ported": true,
+//    "status": "active", "type": "mobile"}
+// status is "active", "absent" (switched off or roaming out of reach) or
+// "disconnected"; missing fields are reported as unknown. A 404 means the
+// number isn't known to the network.
+
+typedef struct {
+    char url[512];
+    int timeout;
+} HlrLookup;
+
+static LineStatus parse_line_status(const char* status) {
+    if (strcmp(status, "active") == 0) return LINE_STATUS_ACTIVE;
+    if (strcmp(status, "absent") == 0 || strcmp(status, "unreachable") == 0) {
+        return LINE_STATUS_UNREACHABLE;
+    }
+    if (strcmp(status, "disconnected") == 0 || strcmp(status, "inactive") == 0) {
+        return LINE_STATUS_DISCONNECTED;
+    }
+    return LINE_STATUS_UNKNOWN;
+}
+
+static CarrierResult hlr_lookup(CarrierLookup* lookup, const Context* ctx, const char* number,
+                                CarrierInfo* info, char* error, size_t error_size) {
+    HlrLookup* hlr = lookup->data;
+
+    char url[640];
+    snprintf(url, sizeof(url), "%s%cnumber=%%2B%s", hlr->url, strchr(hlr->url, '?') ? '&' : '?',
+             number[0] == '+' ? number + 1 : number);
+
+    long status = 0;
+    char* body = carrier_http_get(ctx, url, NULL, hlr->timeout, &status, error, error_size);
+    if (!body) return CARRIER_ERROR;
+
+    CarrierResult result = CARRIER_OK;
+    if (status == 404) {
+        result = CARRIER_NOT_FOUND;
+    } else if (status != 200) {
+        snprintf(error, error_size, "HLR returned %ld", status);
+        result = CARRIER_ERROR;
+    } else {
+        memset(info, 0, sizeof(*info));
+        carrier_json_string(body, "carrier", info->carrier, sizeof(info->carrier));
+        carrier_json_string(body, "type", info->line_type, sizeof(info->line_type));
+        carrier_json_string(body, "mcc", info->mcc, sizeof(info->mcc));
+        carrier_json_string(body, "mnc", info->mnc, sizeof(info->mnc));
+        info->ported = carrier_json_bool(body, "ported");
+
+        char line_status[32] = "";
+        carrier_json_string(body, "status", line_status, sizeof(line_status));
+        info->status = parse_line_status(line_status);
+    }
+
+    free(body);
+    return result;
+}
+
+static void hlr_close(CarrierLookup* lookup) {
+    free(lookup->data);
+    free(lookup);
+}
+
+CarrierLookup* hlr_lookup_open(const char* url, int timeout, char* error, size_t error_size) {
+    if (strlen(url) >= sizeof(((HlrLookup*)0)->url)) {
+        snprintf(error, error_size, "HLR URL too long");
+        return NULL;
+    }
+
+    HlrLookup* hlr = calloc(1, sizeof(HlrLookup));
+    snprintf(hlr->url, sizeof(hlr->url), "%s", url);
+    hlr->timeout = timeout;
+
+    CarrierLookup* lookup = calloc(1, sizeof(CarrierLookup));
+    lookup->name = "hlr";
+    lookup->lookup = hlr_lookup;
+    lookup->close = hlr_close;
+    lookup->data = hlr;
+    return lookup;
+}
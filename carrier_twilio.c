@@ -0,0 +1,85 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include "carrier.h"
+
+// Twilio Lookup v2 with the Line Type Intelligence and Line Status packages:
+// https://www.twilio.com/docs/lookup/v2-api
+#define TWILIO_LOOKUP_URL "https://lookups.twilio.com/v2/PhoneNumbers/"
+
+typedef struct {
+    char userpwd[256];      // ACCOUNT_SID:AUTH_TOKEN
+    int timeout;
+} TwilioLookup;
+
+static LineStatus parse_line_status(const char* status) {
+    if (strcmp(status, "active") == 0) return LINE_STATUS_ACTIVE;
+    if (strcmp(status, "unreachable") == 0) return LINE_STATUS_UNREACHABLE;
+    if (strcmp(status, "inactive") == 0) return LINE_STATUS_DISCONNECTED;
+    return LINE_STATUS_UNKNOWN;
+}
+
+static CarrierResult twilio_lookup(CarrierLookup* lookup, const Context* ctx, const char* number,
+                                   CarrierInfo* info, char* error, size_t error_size) {
+    TwilioLookup* twilio = lookup->data;
+
+    // The leading + is URL encoded
+    char url[256];
+    snprintf(url, sizeof(url), TWILIO_LOOKUP_URL "%%2B%s?Fields=line_type_intelligence,line_status",
+             number[0] == '+' ? number + 1 : number);
+
+    long status = 0;
+    char* body = carrier_http_get(ctx, url, twilio->userpwd, twilio->timeout, &status,
+                                  error, error_size);
+    if (!body) return CARRIER_ERROR;
+
+    CarrierResult result = CARRIER_OK;
+    if (status == 404) {
+        result = CARRIER_NOT_FOUND;
+    } else if (status != 200) {
+        char message[128] = "";
+        carrier_json_string(body, "message", message, sizeof(message));
+        snprintf(error, error_size, "Twilio returned %ld%s%s", status, message[0] ? ": " : "", message);
+        result = CARRIER_ERROR;
+    } else {
+        memset(info, 0, sizeof(*info));
+        carrier_json_string(body, "carrier_name", info->carrier, sizeof(info->carrier));
+        carrier_json_string(body, "type", info->line_type, sizeof(info->line_type));
+        carrier_json_string(body, "mobile_country_code", info->mcc, sizeof(info->mcc));
+        carrier_json_string(body, "mobile_network_code", info->mnc, sizeof(info->mnc));
+        // Lookup v2 doesn't report porting
+        info->ported = -1;
+
+        char line_status[32] = "";
+        carrier_json_string(body, "status", line_status, sizeof(line_status));
+        info->status = parse_line_status(line_status);
+    }
+
+    free(body);
+    return result;
+}
+
+static void twilio_close(CarrierLookup* lookup) {
+    free(lookup->data);
+    free(lookup);
+}
+
+CarrierLookup* twilio_lookup_open(const char* account_sid, const char* auth_token, int timeout,
+                                  char* error, size_t error_size) {
+    TwilioLookup* twilio = calloc(1, sizeof(TwilioLookup));
+    int len = snprintf(twilio->userpwd, sizeof(twilio->userpwd), "%s:%s", account_sid, auth_token);
+    if (len < 0 || (size_t)len >= sizeof(twilio->userpwd)) {
+        snprintf(error, error_size, "Twilio credentials too long");
+        free(twilio);
+        return NULL;
+    }
+    twilio->timeout = timeout;
+
+    CarrierLookup* lookup = calloc(1, sizeof(CarrierLookup));
+    lookup->name = "twilio";
+    lookup->lookup = twilio_lookup;
+    lookup->close = twilio_close;
+    lookup->data = twilio;
+    return lookup;
+}
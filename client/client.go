@@ -0,0 +1,286 @@
+// Package client calls the phone validator's JSON API (/api/v1) from Go:
+// validating numbers, one at a time or in batches, and managing users.
+//
+// Requests are retried when the server turns them away with 429 or 503,
+// after its Retry-After delay, and, for requests that are safe to repeat,
+// when the connection fails or the server answers 502 or 504. Every method
+// takes a context.Context, which bounds the request and its retries.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults for the retry options
+const (
+	DefaultMaxRetries = 3
+	DefaultMinBackoff = 250 * time.Millisecond
+	DefaultMaxBackoff = 10 * time.Second
+)
+
+// Client is safe for concurrent use
+type Client struct {
+	baseURL    *url.URL
+	apiKey     string
+	httpClient *http.Client
+	userAgent  string
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// Option configures a Client in New
+type Option func(*Client)
+
+// WithAPIKey sends key as "Authorization: Bearer <key>" on every request
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithHTTPClient replaces http.DefaultClient, e.g. for a timeout or a
+// custom transport
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// WithUserAgent sets the User-Agent header
+func WithUserAgent(userAgent string) Option {
+	return func(c *Client) { c.userAgent = userAgent }
+}
+
+// WithRetries sets how many times a request is retried after the first
+// attempt; 0 turns retrying off
+func WithRetries(maxRetries int) Option {
+	return func(c *Client) { c.maxRetries = maxRetries }
+}
+
+// WithBackoff sets the delay before the first retry, doubled for each one
+// after it up to max. Each delay is jittered by up to half. A Retry-After
+// from the server is used instead when there is one.
+func WithBackoff(min, max time.Duration) Option {
+	return func(c *Client) {
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
+// New returns a client for the server at baseURL, e.g.
+// "https://validator.example.com"
+func New(baseURL string, options ...Option) (*Client, error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("phone validator: invalid base URL: %w", err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" {
+		return nil, fmt.Errorf("phone validator: base URL %q must be http:// or https:// with a host", baseURL)
+	}
+	parsed.Path = strings.TrimSuffix(parsed.Path, "/")
+
+	c := &Client{
+		baseURL:    parsed,
+		httpClient: http.DefaultClient,
+		userAgent:  "phone-validator-go",
+		maxRetries: DefaultMaxRetries,
+		minBackoff: DefaultMinBackoff,
+		maxBackoff: DefaultMaxBackoff,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c, nil
+}
+
+// Error is a response outside 2xx, carrying the server's error body:
+// {"error": {"code": ..., "message": ..., "details": ...}}. Use errors.As
+// to get at it.
+type Error struct {
+	StatusCode int
+	Code       string          // Stable machine-readable code, e.g. "user_not_found"
+	Message    string          // For people
+	Details    json.RawMessage // Code specific, nil if the server sent none
+	RetryAfter time.Duration   // From Retry-After on 429 and 503, 0 without one
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("phone validator: HTTP %d", e.StatusCode)
+	}
+	return fmt.Sprintf("phone validator: HTTP %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// ErrorCode is the Code of err's *Error, "" if err isn't one
+func ErrorCode(err error) string {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return ""
+}
+
+// request is one API call, sent again as is on each retry
+type request struct {
+	method     string
+	path       string
+	query      url.Values
+	body       any
+	header     http.Header
+	idempotent bool // Safe to repeat even if the server may have run it
+}
+
+// do sends req, retrying as the package comment says, and decodes a 2xx
+// body into out unless out is nil
+func (c *Client) do(ctx context.Context, req request, out any) error {
+	var body []byte
+	if req.body != nil {
+		var err error
+		if body, err = json.Marshal(req.body); err != nil {
+			return fmt.Errorf("phone validator: encoding request: %w", err)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := c.send(ctx, req, body, out)
+		if err == nil || attempt >= c.maxRetries || !retryable(err, req.idempotent) {
+			return err
+		}
+
+		delay := c.backoff(attempt)
+		var apiErr *Error
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+			delay = apiErr.RetryAfter
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// send makes one attempt at req
+func (c *Client) send(ctx context.Context, req request, body []byte, out any) error {
+	target := *c.baseURL
+	target.Path += req.path
+	target.RawQuery = req.query.Encode()
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, target.String(), reader)
+	if err != nil {
+		return fmt.Errorf("phone validator: %w", err)
+	}
+	for name, values := range req.header {
+		httpReq.Header[name] = values
+	}
+	httpReq.Header.Set("Accept", "application/json")
+	httpReq.Header.Set("User-Agent", c.userAgent)
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return &transportError{err}
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return &transportError{err}
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return decodeError(resp, data)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("phone validator: decoding %s %s response: %w", req.method, req.path, err)
+	}
+	return nil
+}
+
+// transportError is a request that got no complete response
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string { return "phone validator: " + e.err.Error() }
+func (e *transportError) Unwrap() error { return e.err }
+
+// retryable says whether err is worth another attempt. 429 and 503 mean
+// the server didn't run the request, so any request can be sent again;
+// anything else may have reached it, so only idempotent ones are.
+func retryable(err error, idempotent bool) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			return true
+		case http.StatusBadGateway, http.StatusGatewayTimeout:
+			return idempotent
+		}
+		return false
+	}
+	var transportErr *transportError
+	return errors.As(err, &transportErr) && idempotent
+}
+
+// backoff is the jittered delay before retry attempt+1
+func (c *Client) backoff(attempt int) time.Duration {
+	delay := c.minBackoff
+	for i := 0; i < attempt && delay < c.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > c.maxBackoff {
+		delay = c.maxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+func decodeError(resp *http.Response, data []byte) error {
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	var body struct {
+		Error struct {
+			Code    string          `json:"code"`
+			Message string          `json:"message"`
+			Details json.RawMessage `json:"details"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(data, &body) == nil {
+		apiErr.Code = body.Error.Code
+		apiErr.Message = body.Error.Message
+		apiErr.Details = body.Error.Details
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return apiErr
+}
@@ -0,0 +1,343 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// server answers each request with the next of responses, the last one
+// again once they run out, and records what it was sent
+type server struct {
+	mu        sync.Mutex
+	responses []response
+	requests  []recorded
+}
+
+type response struct {
+	status int
+	header map[string]string
+	body   string
+}
+
+type recorded struct {
+	method string
+	uri    string
+	header http.Header
+	body   string
+}
+
+func newServer(t *testing.T, responses ...response) (*server, *Client) {
+	s := &server{responses: responses}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	c, err := New(ts.URL, WithAPIKey("secret"), WithBackoff(time.Millisecond, 5*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, c
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	s.requests = append(s.requests, recorded{r.Method, r.URL.RequestURI(), r.Header.Clone(), string(body)})
+	next := s.responses[0]
+	if len(s.responses) > 1 {
+		s.responses = s.responses[1:]
+	}
+	s.mu.Unlock()
+
+	for name, value := range next.header {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(next.status)
+	io.WriteString(w, next.body)
+}
+
+func (s *server) sent() []recorded {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]recorded(nil), s.requests...)
+}
+
+func TestNewRejectsBadBaseURL(t *testing.T) {
+	for _, baseURL := range []string{"", "localhost:8080", "ftp://example.com", "http://"} {
+		if _, err := New(baseURL); err == nil {
+			t.Errorf("New(%q) succeeded", baseURL)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	s, c := newServer(t, response{200, nil, `{"number": "020 7946 0958", "valid": true,
+		"is_possible": true, "e164": "+442079460958", "country_code": 44, "region": "GB",
+		"type": "fixed_line", "timezones": ["Europe/London"], "location": null}`})
+
+	result, err := c.Validate(context.Background(), "020 7946 0958",
+		&ValidateOptions{Region: "GB", Geocode: true, Carrier: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid || result.E164 != "+442079460958" || result.CountryCode != 44 ||
+		result.Type != "fixed_line" || len(result.Timezones) != 1 || result.Location != nil {
+		t.Errorf("result = %+v", result)
+	}
+
+	req := s.sent()[0]
+	if req.method != "POST" || req.uri != "/api/v1/validate?carrier=true&geocode=true" {
+		t.Errorf("sent %s %s", req.method, req.uri)
+	}
+	if got := req.header.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("Authorization = %q", got)
+	}
+	if req.body != `{"number":"020 7946 0958","region":"GB"}` {
+		t.Errorf("body = %s", req.body)
+	}
+}
+
+func TestValidateBatch(t *testing.T) {
+	s, c := newServer(t, response{200, nil, `{"results": [
+		{"number": "+442079460958", "valid": true},
+		{"number": "12", "valid": false, "reason": "TOO_SHORT"}],
+		"summary": {"total": 2, "valid": 1, "invalid": 1}}`})
+
+	result, err := c.ValidateBatch(context.Background(), []string{"+442079460958", "12"},
+		&ValidateOptions{Enrich: "hubspot", CNAM: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Results) != 2 || result.Results[1].Reason != "TOO_SHORT" || result.Summary.Invalid != 1 {
+		t.Errorf("result = %+v", result)
+	}
+	req := s.sent()[0]
+	if req.uri != "/api/v1/validate/batch?enrich=hubspot" {
+		t.Errorf("sent %s", req.uri)
+	}
+	if req.body != `{"numbers":["+442079460958","12"]}` {
+		t.Errorf("body = %s", req.body)
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	_, c := newServer(t, response{404, nil,
+		`{"error": {"code": "user_not_found", "message": "User not found"}}`})
+
+	_, err := c.GetUser(context.Background(), 7)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want *Error", err)
+	}
+	if apiErr.StatusCode != 404 || apiErr.Code != "user_not_found" || apiErr.Message != "User not found" {
+		t.Errorf("err = %+v", apiErr)
+	}
+	if ErrorCode(err) != "user_not_found" {
+		t.Errorf("ErrorCode = %q", ErrorCode(err))
+	}
+}
+
+func TestRetriesRateLimitedRequests(t *testing.T) {
+	limited := response{429, nil, `{"error": {"code": "rate_limited", "message": "Rate limit exceeded"}}`}
+	s, c := newServer(t, limited, limited, response{200, nil, `{"number": "1", "valid": false}`})
+
+	if _, err := c.Validate(context.Background(), "1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.sent()); n != 3 {
+		t.Errorf("sent %d requests, want 3", n)
+	}
+}
+
+func TestGivesUpAfterMaxRetries(t *testing.T) {
+	s, c := newServer(t, response{503, nil, `{"error": {"code": "queue_full", "message": "Queue full"}}`})
+	WithRetries(2)(c)
+
+	_, err := c.Validate(context.Background(), "1", nil)
+	if ErrorCode(err) != "queue_full" {
+		t.Fatalf("err = %v", err)
+	}
+	if n := len(s.sent()); n != 3 {
+		t.Errorf("sent %d requests, want 3", n)
+	}
+}
+
+func TestDoesNotRetryClientErrors(t *testing.T) {
+	s, c := newServer(t, response{422, nil, `{"error": {"code": "invalid_fields", "message": "Invalid"}}`})
+
+	if _, err := c.CreateUser(context.Background(), UserInput{Name: "Jo"}); ErrorCode(err) != "invalid_fields" {
+		t.Fatalf("err = %v", err)
+	}
+	if n := len(s.sent()); n != 1 {
+		t.Errorf("sent %d requests, want 1", n)
+	}
+}
+
+func TestRestoreIsNotRetriedAfterBadGateway(t *testing.T) {
+	s, c := newServer(t, response{502, nil, ""})
+
+	if _, err := c.RestoreUser(context.Background(), 3); err == nil {
+		t.Fatal("RestoreUser succeeded")
+	}
+	if n := len(s.sent()); n != 1 {
+		t.Errorf("sent %d requests, want 1", n)
+	}
+}
+
+func TestRetryAfterDelay(t *testing.T) {
+	s, c := newServer(t, response{429, map[string]string{"Retry-After": "1"}, ""},
+		response{200, nil, `{"users": [], "count": 0, "total": 0, "page": 1, "per_page": 100}`})
+
+	start := time.Now()
+	if _, err := c.ListUsers(context.Background(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %v, want Retry-After's 1s", elapsed)
+	}
+	if n := len(s.sent()); n != 2 {
+		t.Errorf("sent %d requests, want 2", n)
+	}
+}
+
+func TestRetryAfterPastDeadline(t *testing.T) {
+	s, c := newServer(t, response{429, map[string]string{"Retry-After": "30"}, ""})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err := c.ListUsers(ctx, nil)
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != 429 || apiErr.RetryAfter != 30*time.Second {
+		t.Fatalf("err = %v, want the 429", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("waited %v for a retry the deadline doesn't allow", elapsed)
+	}
+	if n := len(s.sent()); n != 1 {
+		t.Errorf("sent %d requests, want 1", n)
+	}
+}
+
+func TestContextCancelled(t *testing.T) {
+	_, c := newServer(t, response{200, nil, `{}`})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.GetUser(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestCreateUserKeepsIdempotencyKeyAcrossRetries(t *testing.T) {
+	s, c := newServer(t, response{503, nil, ""},
+		response{201, nil, `{"id": 5, "name": "John", "email": "john@example.com", "phone": null}`})
+
+	user, err := c.CreateUser(context.Background(), UserInput{Name: "John", Email: "john@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != 5 || user.Phone != "" || user.DeletedAt != nil {
+		t.Errorf("user = %+v", user)
+	}
+
+	sent := s.sent()
+	if len(sent) != 2 {
+		t.Fatalf("sent %d requests, want 2", len(sent))
+	}
+	first := sent[0].header.Get("Idempotency-Key")
+	if first == "" || sent[1].header.Get("Idempotency-Key") != first {
+		t.Errorf("Idempotency-Key %q then %q", first, sent[1].header.Get("Idempotency-Key"))
+	}
+	if sent[0].body != sent[1].body || sent[0].body != `{"name":"John","email":"john@example.com"}` {
+		t.Errorf("bodies %s and %s", sent[0].body, sent[1].body)
+	}
+}
+
+func TestUsersCRUD(t *testing.T) {
+	user := `{"id": 5, "name": "John", "email": "john@example.com", "phone": "+14155550100",
+		"deleted_at": null, "phone_invalid_since": "2026-01-02T03:04:05Z",
+		"phone_invalid_reason": "INVALID_FOR_REGION"}`
+	s, c := newServer(t,
+		response{200, nil, `{"users": [` + user + `], "count": 1, "total": 9, "page": 2, "per_page": 1}`},
+		response{200, nil, user},
+		response{200, nil, user},
+		response{200, nil, user},
+		response{200, nil, `{"success": true, "message": "User deleted"}`},
+		response{200, nil, user})
+	ctx := context.Background()
+
+	page, err := c.ListUsers(ctx, &ListUsersOptions{Page: 2, PerPage: 1, Sort: "-name", Query: "jo",
+		Deleted: "include", PhoneInvalid: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 9 || len(page.Users) != 1 || page.Users[0].PhoneInvalidSince == nil ||
+		!page.Users[0].PhoneInvalidSince.Equal(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("page = %+v", page)
+	}
+	if _, err := c.GetUser(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ReplaceUser(ctx, 5, UserInput{Name: "John", Email: "john@example.com",
+		Phone: "415 555 0100", Region: "US"}); err != nil {
+		t.Fatal(err)
+	}
+	empty := ""
+	if _, err := c.UpdateUser(ctx, 5, UserPatch{Phone: &empty}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteUser(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.RestoreUser(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []recorded{
+		{method: "GET", uri: "/api/v1/users?deleted=include&page=2&per_page=1&phone_invalid=true&q=jo&sort=-name"},
+		{method: "GET", uri: "/api/v1/users/5"},
+		{method: "PUT", uri: "/api/v1/users/5",
+			body: `{"name":"John","email":"john@example.com","phone":"415 555 0100","region":"US"}`},
+		{method: "PATCH", uri: "/api/v1/users/5", body: `{"phone":""}`},
+		{method: "DELETE", uri: "/api/v1/users/5"},
+		{method: "POST", uri: "/api/v1/users/5/restore"},
+	}
+	sent := s.sent()
+	if len(sent) != len(want) {
+		t.Fatalf("sent %d requests, want %d", len(sent), len(want))
+	}
+	for i, w := range want {
+		if sent[i].method != w.method || sent[i].uri != w.uri || sent[i].body != w.body {
+			t.Errorf("request %d = %s %s %s, want %s %s %s", i, sent[i].method, sent[i].uri,
+				sent[i].body, w.method, w.uri, w.body)
+		}
+	}
+}
+
+func TestDuplicateUserDetails(t *testing.T) {
+	_, c := newServer(t, response{409, nil, `{"error": {"code": "duplicate_user",
+		"message": "A user with that email or phone exists", "details": {"id": 3, "fields": ["email"]}}}`})
+
+	_, err := c.CreateUser(context.Background(), UserInput{Name: "Jo", Email: "jo@example.com"})
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.Code != "duplicate_user" {
+		t.Fatalf("err = %v", err)
+	}
+	var details struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.Unmarshal(apiErr.Details, &details); err != nil || details.ID != 3 {
+		t.Errorf("details = %s", apiErr.Details)
+	}
+	if !strings.Contains(err.Error(), "409 duplicate_user") {
+		t.Errorf("Error() = %q", err.Error())
+	}
+}
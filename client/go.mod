@@ -0,0 +1,3 @@
+module github.com/mi8bsd/phone-validator-wp/client
+
+go 1.22
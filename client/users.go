@@ -0,0 +1,155 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// User is a user as the server stores it
+type User struct {
+	ID                 int64      `json:"id"`
+	Name               string     `json:"name"`
+	Email              string     `json:"email"`
+	Phone              string     `json:"phone"`                // E.164, "" if the user has none
+	DeletedAt          *time.Time `json:"deleted_at"`           // Set only in ListUsers with Deleted
+	PhoneInvalidSince  *time.Time `json:"phone_invalid_since"`  // When re-validation flagged the phone
+	PhoneInvalidReason string     `json:"phone_invalid_reason"` // e.g. "INVALID_FOR_REGION"
+}
+
+// UserInput is a new user, or all of an existing one's fields for
+// ReplaceUser. Phone may be in any format, with Region for one without a
+// + prefix; it is stored in E.164.
+type UserInput struct {
+	Name   string `json:"name"`
+	Email  string `json:"email"`
+	Phone  string `json:"phone,omitempty"`
+	Region string `json:"region,omitempty"`
+}
+
+// UserPatch changes the fields that aren't nil and keeps the rest. A
+// pointer to "" for Phone clears it.
+type UserPatch struct {
+	Name   *string `json:"name,omitempty"`
+	Email  *string `json:"email,omitempty"`
+	Phone  *string `json:"phone,omitempty"`
+	Region *string `json:"region,omitempty"`
+}
+
+// ListUsersOptions picks the page of users ListUsers returns. Zero values
+// take the server's defaults: page 1 of 100, sorted by id.
+type ListUsersOptions struct {
+	Page         int
+	PerPage      int    // Up to 1000
+	Sort         string // "id", "name", "email" or "phone", with a leading - for descending
+	Query        string // Only users whose name, email or phone contains this
+	Deleted      string // "exclude", "include" or "only"
+	PhoneInvalid bool   // Only users whose phone re-validation flagged
+}
+
+// UserPage is one page of users. Total counts all the matching users.
+type UserPage struct {
+	Users   []User `json:"users"`
+	Count   int    `json:"count"`
+	Total   int    `json:"total"`
+	Page    int    `json:"page"`
+	PerPage int    `json:"per_page"`
+}
+
+// ListUsers returns one page of users
+func (c *Client) ListUsers(ctx context.Context, options *ListUsersOptions) (*UserPage, error) {
+	query := url.Values{}
+	if options != nil {
+		if options.Page > 0 {
+			query.Set("page", strconv.Itoa(options.Page))
+		}
+		if options.PerPage > 0 {
+			query.Set("per_page", strconv.Itoa(options.PerPage))
+		}
+		if options.Sort != "" {
+			query.Set("sort", options.Sort)
+		}
+		if options.Query != "" {
+			query.Set("q", options.Query)
+		}
+		if options.Deleted != "" {
+			query.Set("deleted", options.Deleted)
+		}
+		if options.PhoneInvalid {
+			query.Set("phone_invalid", "true")
+		}
+	}
+
+	var page UserPage
+	err := c.do(ctx, request{method: "GET", path: "/api/v1/users", query: query, idempotent: true}, &page)
+	if err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// GetUser returns the user with id; a deleted one is "user_not_found"
+func (c *Client) GetUser(ctx context.Context, id int64) (*User, error) {
+	return c.user(ctx, request{method: "GET", path: userPath(id), idempotent: true})
+}
+
+// CreateUser adds a user. An email or phone that another user has is a
+// 409 "duplicate_user", with the other user's id in Details. It is sent
+// with an Idempotency-Key, so a retry after a dropped connection can't
+// create the user twice.
+func (c *Client) CreateUser(ctx context.Context, input UserInput) (*User, error) {
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	header.Set("Idempotency-Key", key)
+	return c.user(ctx, request{method: "POST", path: "/api/v1/users", body: input, header: header,
+		idempotent: true})
+}
+
+// ReplaceUser sets all of a user's fields
+func (c *Client) ReplaceUser(ctx context.Context, id int64, input UserInput) (*User, error) {
+	return c.user(ctx, request{method: "PUT", path: userPath(id), body: input, idempotent: true})
+}
+
+// UpdateUser changes some of a user's fields
+func (c *Client) UpdateUser(ctx context.Context, id int64, patch UserPatch) (*User, error) {
+	return c.user(ctx, request{method: "PATCH", path: userPath(id), body: patch, idempotent: true})
+}
+
+// DeleteUser soft deletes a user, who can be restored with RestoreUser
+// until the server purges them
+func (c *Client) DeleteUser(ctx context.Context, id int64) error {
+	return c.do(ctx, request{method: "DELETE", path: userPath(id), idempotent: true}, nil)
+}
+
+// RestoreUser undoes DeleteUser. A user that isn't deleted is a 409
+// "user_not_deleted".
+func (c *Client) RestoreUser(ctx context.Context, id int64) (*User, error) {
+	return c.user(ctx, request{method: "POST", path: userPath(id) + "/restore"})
+}
+
+func (c *Client) user(ctx context.Context, req request) (*User, error) {
+	var user User
+	if err := c.do(ctx, req, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func userPath(id int64) string {
+	return "/api/v1/users/" + strconv.FormatInt(id, 10)
+}
+
+func newIdempotencyKey() (string, error) {
+	var key [16]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key[:]), nil
+}
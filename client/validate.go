@@ -0,0 +1,157 @@
+package client
+
+import (
+	"context"
+	"net/url"
+)
+
+// ValidateOptions are the optional parts of a validation. The zero value
+// validates numbers that start with + and nothing else.
+type ValidateOptions struct {
+	Region  string // ISO 3166-1 alpha-2 region for numbers without a + prefix, e.g. "GB"
+	Geocode bool   // Add the city or area of geographic numbers as Location
+	Enrich  string // "hubspot" or "salesforce" to add an Enrichment block
+	Carrier bool   // Validate only: look up the carrier of a valid number
+	CNAM    bool   // Validate only: look up the caller name of a valid +1 number
+}
+
+// ValidationResult is the server's answer for one number. Fields past
+// Valid are only set when the number parsed, and the lookups only when
+// asked for in ValidateOptions.
+type ValidationResult struct {
+	Number        string      `json:"number"` // The input as given
+	Valid         bool        `json:"valid"`
+	IsPossible    bool        `json:"is_possible"`
+	Reason        string      `json:"reason,omitempty"` // e.g. "TOO_SHORT", when not valid
+	Blocked       bool        `json:"blocked"`
+	BlockedReason string      `json:"blocked_reason,omitempty"`
+	Rule          *RuleMatch  `json:"rule,omitempty"`
+	E164          string      `json:"e164,omitempty"`
+	Extension     string      `json:"extension,omitempty"`
+	CountryCode   int         `json:"country_code,omitempty"`
+	Region        string      `json:"region,omitempty"`
+	Type          string      `json:"type,omitempty"` // e.g. "mobile" or "fixed_line"
+	RiskScore     int         `json:"risk_score,omitempty"`
+	Flags         *RiskFlags  `json:"flags,omitempty"`
+	Timezones     []string    `json:"timezones,omitempty"`
+	Location      *string     `json:"location,omitempty"` // With Geocode; nil when there is no known location
+	Carrier       *Carrier    `json:"carrier,omitempty"`
+	CNAM          *CNAM       `json:"cnam,omitempty"`
+	Enrichment    *Enrichment `json:"enrichment,omitempty"`
+}
+
+// RuleMatch is the validation rule that decided a result
+type RuleMatch struct {
+	ID     int64  `json:"id"`
+	Action string `json:"action"` // "allow" or "deny"
+}
+
+// RiskFlags are what went into RiskScore
+type RiskFlags struct {
+	VoIP              bool `json:"voip"`
+	Disposable        bool `json:"disposable"`
+	RecentlyAllocated bool `json:"recently_allocated"`
+}
+
+// Carrier is the network a number is on now
+type Carrier struct {
+	Name     string `json:"name,omitempty"`
+	LineType string `json:"line_type,omitempty"`
+	MCC      string `json:"mcc,omitempty"`
+	MNC      string `json:"mnc,omitempty"`
+	Ported   *bool  `json:"ported,omitempty"` // nil when the provider doesn't say
+	Status   string `json:"status,omitempty"` // "unknown", "active", "unreachable" or "disconnected"
+	Source   string `json:"source,omitempty"` // "lookup" or "portability"
+	AsOf     string `json:"as_of,omitempty"`  // Date of the portability dataset
+	Stale    bool   `json:"stale,omitempty"`
+}
+
+// CNAM is a number's registered caller name
+type CNAM struct {
+	Name *string `json:"name"` // nil when no name is registered
+	Type *string `json:"type"` // "business", "consumer" or nil
+}
+
+// Enrichment holds CRM properties for a number
+type Enrichment struct {
+	CRM        string         `json:"crm"`
+	Properties map[string]any `json:"properties"`
+}
+
+// BatchSummary counts a batch's results
+type BatchSummary struct {
+	Total   int `json:"total"`
+	Valid   int `json:"valid"`
+	Invalid int `json:"invalid"`
+}
+
+// BatchResult has one result per number, in the order they were given
+type BatchResult struct {
+	Results []ValidationResult `json:"results"`
+	Summary BatchSummary       `json:"summary"`
+}
+
+// MaxBatchSize is the most numbers ValidateBatch takes at once
+const MaxBatchSize = 10000
+
+// Validate validates one number. A number that doesn't parse is not an
+// error: it comes back with Valid false and a Reason.
+func (c *Client) Validate(ctx context.Context, number string, options *ValidateOptions) (*ValidationResult, error) {
+	if options == nil {
+		options = &ValidateOptions{}
+	}
+	query := options.query()
+	if options.Carrier {
+		query.Set("carrier", "true")
+	}
+	if options.CNAM {
+		query.Set("cnam", "true")
+	}
+	body := struct {
+		Number string `json:"number"`
+		Region string `json:"region,omitempty"`
+	}{number, options.Region}
+
+	var result ValidationResult
+	err := c.do(ctx, request{method: "POST", path: "/api/v1/validate", query: query, body: body,
+		idempotent: true}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ValidateBatch validates up to MaxBatchSize numbers in one request.
+// Carrier and CNAM in options don't apply to batches.
+func (c *Client) ValidateBatch(ctx context.Context, numbers []string, options *ValidateOptions) (*BatchResult, error) {
+	if options == nil {
+		options = &ValidateOptions{}
+	}
+	body := struct {
+		Numbers []string `json:"numbers"`
+		Region  string   `json:"region,omitempty"`
+	}{numbers, options.Region}
+	if body.Numbers == nil {
+		body.Numbers = []string{}
+	}
+
+	var result BatchResult
+	err := c.do(ctx, request{method: "POST", path: "/api/v1/validate/batch", query: options.query(),
+		body: body, idempotent: true}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// query has the parameters Validate and ValidateBatch share
+func (o *ValidateOptions) query() url.Values {
+	query := url.Values{}
+	if o.Geocode {
+		query.Set("geocode", "true")
+	}
+	if o.Enrich != "" {
+		query.Set("enrich", o.Enrich)
+	}
+	return query
+}
@@ -0,0 +1,177 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+#ifdef HAVE_CURL
+#include <curl/curl.h>
+#endif
+
+#include "cnam.h"
+#include "tracing.h"
+
+CnamLookup* cnam_lookup_open(const char* dsn, int timeout, char* error, size_t error_size) {
+    if (strncmp(dsn, "twilio://", 9) == 0) {
+#ifdef HAVE_CURL
+        char credentials[512];
+        snprintf(credentials, sizeof(credentials), "%s", dsn + 9);
+        char* colon = strchr(credentials, ':');
+        if (!colon || colon == credentials || !colon[1]) {
+            snprintf(error, error_size, "expected twilio://ACCOUNT_SID:AUTH_TOKEN");
+            return NULL;
+        }
+        *colon = '\0';
+        curl_global_init(CURL_GLOBAL_DEFAULT);
+        return twilio_cnam_open(credentials, colon + 1, timeout, error, error_size);
+#else
+        snprintf(error, error_size, "built without caller name lookup support (make WITH_CURL=1)");
+        return NULL;
+#endif
+    }
+
+    if (strncmp(dsn, "cnam:", 5) == 0) {
+#ifdef HAVE_CURL
+        if (strncmp(dsn + 5, "http://", 7) != 0 && strncmp(dsn + 5, "https://", 8) != 0) {
+            snprintf(error, error_size, "expected cnam:https://HOST/PATH");
+            return NULL;
+        }
+        curl_global_init(CURL_GLOBAL_DEFAULT);
+        return http_cnam_open(dsn + 5, timeout, error, error_size);
+#else
+        snprintf(error, error_size, "built without caller name lookup support (make WITH_CURL=1)");
+        return NULL;
+#endif
+    }
+
+    // Not echoed back, the DSN may hold a secret
+    snprintf(error, error_size, "expected twilio://ACCOUNT_SID:AUTH_TOKEN or cnam:URL");
+    return NULL;
+}
+
+// ============= Resilient Lookup =============
+
+typedef struct {
+    CnamLookup* inner;
+    Resilience* resilience;
+    char name[64];
+} ResilientCnam;
+
+// The arguments of one lookup, for each attempt at it
+typedef struct {
+    CnamLookup* inner;
+    const char* number;
+    CnamInfo* info;
+    CnamResult result;
+} CnamAttempt;
+
+static bool attempt_lookup(void* arg, const Context* ctx, char* error, size_t error_size) {
+    CnamAttempt* attempt = arg;
+    attempt->result = attempt->inner->lookup(attempt->inner, ctx, attempt->number, attempt->info,
+                                             error, error_size);
+    return attempt->result != CNAM_ERROR;
+}
+
+static CnamResult resilient_lookup(CnamLookup* lookup, const Context* ctx, const char* number,
+                                   CnamInfo* info, char* error, size_t error_size) {
+    ResilientCnam* resilient = lookup->data;
+    CnamAttempt attempt = {resilient->inner, number, info, CNAM_ERROR};
+    if (!resilience_call(resilient->resilience, ctx, attempt_lookup, &attempt, error, error_size)) {
+        return CNAM_ERROR;
+    }
+    return attempt.result;
+}
+
+static void resilient_close(CnamLookup* lookup) {
+    ResilientCnam* resilient = lookup->data;
+    resilient->inner->close(resilient->inner);
+    resilience_free(resilient->resilience);
+    free(resilient);
+    free(lookup);
+}
+
+CnamLookup* resilient_cnam_lookup_wrap(CnamLookup* inner, const char* name,
+                                       const ResiliencePolicy* policy) {
+    ResilientCnam* resilient = calloc(1, sizeof(ResilientCnam));
+    resilient->inner = inner;
+    snprintf(resilient->name, sizeof(resilient->name), "%s", name ? name : inner->name);
+    resilient->resilience = resilience_create("cnam", resilient->name, policy);
+
+    CnamLookup* lookup = calloc(1, sizeof(CnamLookup));
+    lookup->name = resilient->name;
+    lookup->lookup = resilient_lookup;
+    lookup->close = resilient_close;
+    lookup->data = resilient;
+    return lookup;
+}
+
+// ============= Routed Lookup =============
+
+typedef struct {
+    CnamLookup* providers[ROUTE_MAX_PROVIDERS];
+    ProviderRoute routes[ROUTE_MAX_PROVIDERS];
+    int count;
+    char names[256];
+} RoutedCnam;
+
+static CnamResult routed_lookup(CnamLookup* lookup, const Context* ctx, const char* number,
+                                CnamInfo* info, char* error, size_t error_size) {
+    RoutedCnam* routed = lookup->data;
+    char region[3];
+    int order[ROUTE_MAX_PROVIDERS];
+    route_region(number, region);
+    int count = route_order(routed->routes, routed->count, region, order);
+    if (count == 0) {
+        snprintf(error, error_size, "no provider for region %s", *region ? region : "unknown");
+        return CNAM_NO_PROVIDER;
+    }
+
+    size_t used = 0;
+    error[0] = '\0';
+    Span* span = ctx ? ctx->span : NULL;
+    for (int i = 0; i < count && (i == 0 || !context_done(ctx)); i++) {
+        CnamLookup* provider = routed->providers[order[i]];
+        char provider_error[256] = "";
+        span_set_string(span, "peer.service", provider->name);
+        span_set_int(span, "provider.failovers", i);
+        CnamResult result = provider->lookup(provider, ctx, number, info, provider_error,
+                                             sizeof(provider_error));
+        if (result != CNAM_ERROR) return result;
+        if (used < error_size) {
+            used += (size_t)snprintf(error + used, error_size - used, "%s%s: %s", used ? "; " : "",
+                                     provider->name, provider_error);
+        }
+    }
+    return CNAM_ERROR;
+}
+
+static void routed_close(CnamLookup* lookup) {
+    RoutedCnam* routed = lookup->data;
+    for (int i = 0; i < routed->count; i++) {
+        routed->providers[i]->close(routed->providers[i]);
+    }
+    free(routed);
+    free(lookup);
+}
+
+CnamLookup* routed_cnam_lookup_create(void) {
+    CnamLookup* lookup = calloc(1, sizeof(CnamLookup));
+    RoutedCnam* routed = calloc(1, sizeof(RoutedCnam));
+    lookup->name = routed->names;
+    lookup->lookup = routed_lookup;
+    lookup->close = routed_close;
+    lookup->data = routed;
+    return lookup;
+}
+
+bool routed_cnam_lookup_add(CnamLookup* lookup, CnamLookup* provider,
+                            const ProviderRoute* route) {
+    RoutedCnam* routed = lookup->data;
+    if (routed->count == ROUTE_MAX_PROVIDERS) return false;
+    routed->providers[routed->count] = provider;
+    routed->routes[routed->count] = *route;
+    routed->routes[routed->count].dsn = NULL;
+    routed->count++;
+    size_t length = strlen(routed->names);
+    snprintf(routed->names + length, sizeof(routed->names) - length, "%s%s", length ? ", " : "",
+             provider->name);
+    return true;
+}
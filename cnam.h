@@ -0,0 +1,63 @@
+#ifndef CNAM_H
+#define CNAM_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+#include "context.h"
+#include "resilience.h"
+#include "routing.h"
+
+// The name a North American number is registered under in the CNAM
+// (calling name) databases, as shown on caller ID
+typedef struct {
+    char name[64];          // Usually at most 15 characters, e.g. "ACME PLUMBING"
+    char type[16];          // "business", "consumer" or empty if not reported
+} CnamInfo;
+
+typedef enum {
+    CNAM_OK,
+    CNAM_NOT_FOUND,         // No name is registered for the number
+    CNAM_ERROR,
+    CNAM_NO_PROVIDER        // None of the routed providers serves the number's region
+} CnamResult;
+
+// Caller name lookup provider, like CarrierLookup: each implementation
+// fills in the operations and keeps its own state in data. lookup may be
+// called from many threads.
+typedef struct CnamLookup CnamLookup;
+struct CnamLookup {
+    const char* name;
+
+    // number is in E.164 form. On CNAM_ERROR, error says why. The call to
+    // the provider is abandoned once ctx is done; NULL waits it out.
+    CnamResult (*lookup)(CnamLookup* lookup, const Context* ctx, const char* number,
+                         CnamInfo* info, char* error, size_t error_size);
+    void (*close)(CnamLookup* lookup);
+
+    void* data;
+};
+
+#ifdef HAVE_CURL
+CnamLookup* twilio_cnam_open(const char* account_sid, const char* auth_token, int timeout,
+                             char* error, size_t error_size);
+CnamLookup* http_cnam_open(const char* url, int timeout, char* error, size_t error_size);
+#endif
+
+// Opens a provider from a DSN: "twilio://ACCOUNT_SID:AUTH_TOKEN" for
+// Twilio Lookup's caller name package or "cnam:https://host/path?key=..."
+// for a generic CNAM HTTP API. timeout is in seconds.
+CnamLookup* cnam_lookup_open(const char* dsn, int timeout, char* error, size_t error_size);
+
+// Wraps a provider in retries and a circuit breaker, as
+// resilient_carrier_lookup_wrap() does
+CnamLookup* resilient_cnam_lookup_wrap(CnamLookup* inner, const char* name,
+                                       const ResiliencePolicy* policy);
+
+// Routes numbers between providers by region, failing over between them,
+// as routed_carrier_lookup_create() does
+CnamLookup* routed_cnam_lookup_create(void);
+bool routed_cnam_lookup_add(CnamLookup* routed, CnamLookup* provider,
+                            const ProviderRoute* route);
+
+#endif
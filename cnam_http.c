@@ -0,0 +1,75 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+#include "carrier.h"
+#include "cnam.h"
+
+// Generic CNAM lookup over HTTP. The number is appended to the configured
+// URL as number=%2B<E.164 digits> and the reply is expected to be JSON:
+//   {"name": "ACME PLUMBING", "type": "business"}
+// type is "business" or "consumer" and may be left out. A 404, or an empty
+// or missing name, means no name is registered.
+
+typedef struct {
+    char url[512];
+    int timeout;
+} HttpCnam;
+
+static CnamResult http_cnam_lookup(CnamLookup* lookup, const Context* ctx, const char* number,
+                                   CnamInfo* info, char* error, size_t error_size) {
+    HttpCnam* http = lookup->data;
+
+    char url[640];
+    snprintf(url, sizeof(url), "%s%cnumber=%%2B%s", http->url, strchr(http->url, '?') ? '&' : '?',
+             number[0] == '+' ? number + 1 : number);
+
+    long status = 0;
+    char* body = carrier_http_get(ctx, url, NULL, http->timeout, &status, error, error_size);
+    if (!body) return CNAM_ERROR;
+
+    CnamResult result = CNAM_OK;
+    if (status == 404) {
+        result = CNAM_NOT_FOUND;
+    } else if (status != 200) {
+        snprintf(error, error_size, "CNAM provider returned %ld", status);
+        result = CNAM_ERROR;
+    } else {
+        memset(info, 0, sizeof(*info));
+        if (!carrier_json_string(body, "name", info->name, sizeof(info->name)) || !info->name[0]) {
+            result = CNAM_NOT_FOUND;
+        } else {
+            char type[sizeof(info->type)] = "";
+            carrier_json_string(body, "type", type, sizeof(type));
+            if (strcmp(type, "business") == 0 || strcmp(type, "consumer") == 0) {
+                snprintf(info->type, sizeof(info->type), "%s", type);
+            }
+        }
+    }
+
+    free(body);
+    return result;
+}
+
+static void http_cnam_close(CnamLookup* lookup) {
+    free(lookup->data);
+    free(lookup);
+}
+
+CnamLookup* http_cnam_open(const char* url, int timeout, char* error, size_t error_size) {
+    if (strlen(url) >= sizeof(((HttpCnam*)0)->url)) {
+        snprintf(error, error_size, "CNAM URL too long");
+        return NULL;
+    }
+
+    HttpCnam* http = calloc(1, sizeof(HttpCnam));
+    snprintf(http->url, sizeof(http->url), "%s", url);
+    http->timeout = timeout;
+
+    CnamLookup* lookup = calloc(1, sizeof(CnamLookup));
+    lookup->name = "cnam";
+    lookup->lookup = http_cnam_lookup;
+    lookup->close = http_cnam_close;
+    lookup->data = http;
+    return lookup;
+}
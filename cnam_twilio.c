@@ -0,0 +1,85 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <ctype.h>
+
+#include "carrier.h"
+#include "cnam.h"
+
+// Twilio Lookup v2 with the Caller Name package, US numbers only:
+// https://www.twilio.com/docs/lookup/v2-api/caller-name
+#define TWILIO_LOOKUP_URL "https://lookups.twilio.com/v2/PhoneNumbers/"
+
+typedef struct {
+    char userpwd[256];      // ACCOUNT_SID:AUTH_TOKEN
+    int timeout;
+} TwilioCnam;
+
+static CnamResult twilio_cnam_lookup(CnamLookup* lookup, const Context* ctx, const char* number,
+                                     CnamInfo* info, char* error, size_t error_size) {
+    TwilioCnam* twilio = lookup->data;
+
+    // The leading + is URL encoded
+    char url[256];
+    snprintf(url, sizeof(url), TWILIO_LOOKUP_URL "%%2B%s?Fields=caller_name",
+             number[0] == '+' ? number + 1 : number);
+
+    long status = 0;
+    char* body = carrier_http_get(ctx, url, twilio->userpwd, twilio->timeout, &status,
+                                  error, error_size);
+    if (!body) return CNAM_ERROR;
+
+    CnamResult result = CNAM_OK;
+    if (status == 404) {
+        result = CNAM_NOT_FOUND;
+    } else if (status != 200) {
+        char message[128] = "";
+        carrier_json_string(body, "message", message, sizeof(message));
+        snprintf(error, error_size, "Twilio returned %ld%s%s", status, message[0] ? ": " : "", message);
+        result = CNAM_ERROR;
+    } else {
+        // {"caller_name": {"caller_name": "ACME", "caller_type": "BUSINESS", ...}},
+        // so the name is the second "caller_name" and null when there is none
+        memset(info, 0, sizeof(*info));
+        const char* package = strstr(body, "\"caller_name\"");
+        if (!package || !carrier_json_string(package + 1, "caller_name", info->name, sizeof(info->name)) ||
+            !info->name[0]) {
+            result = CNAM_NOT_FOUND;
+        } else {
+            char type[32] = "";
+            carrier_json_string(body, "caller_type", type, sizeof(type));
+            if (strcmp(type, "BUSINESS") == 0 || strcmp(type, "CONSUMER") == 0) {
+                for (int i = 0; type[i] && i + 1 < (int)sizeof(info->type); i++) {
+                    info->type[i] = (char)tolower((unsigned char)type[i]);
+                }
+            }
+        }
+    }
+
+    free(body);
+    return result;
+}
+
+static void twilio_cnam_close(CnamLookup* lookup) {
+    free(lookup->data);
+    free(lookup);
+}
+
+CnamLookup* twilio_cnam_open(const char* account_sid, const char* auth_token, int timeout,
+                             char* error, size_t error_size) {
+    TwilioCnam* twilio = calloc(1, sizeof(TwilioCnam));
+    int len = snprintf(twilio->userpwd, sizeof(twilio->userpwd), "%s:%s", account_sid, auth_token);
+    if (len < 0 || (size_t)len >= sizeof(twilio->userpwd)) {
+        snprintf(error, error_size, "Twilio credentials too long");
+        free(twilio);
+        return NULL;
+    }
+    twilio->timeout = timeout;
+
+    CnamLookup* lookup = calloc(1, sizeof(CnamLookup));
+    lookup->name = "twilio";
+    lookup->lookup = twilio_cnam_lookup;
+    lookup->close = twilio_cnam_close;
+    lookup->data = twilio;
+    return lookup;
+}
@@ -0,0 +1,944 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <ctype.h>
+#include <limits.h>
+
+#include "config.h"
+#include "phonevalidator.h"
+
+// Option names accepted in files, PHONEVAL_* variables and flags
+static const char* option_names[] = {
+    "port", "read_timeout", "write_timeout", "shutdown_timeout",
+    "store", "store_backup", "store_migrate", "store_table_prefix", "metadata", "log_level", "api_keys",
+    "ip_rate_limit", "ip_rate_burst", "key_rate_limit", "key_rate_burst",
+    "cors_origins", "cors_methods", "cors_headers", "cors_max_age",
+    "webhook_phone_fields", "webhook_region", "response_format",
+    "hmac_secrets", "hmac_window", "carrier_lookup", "carrier_timeout",
+    "history_key", "callback_secret", "callback_timeout", "callback_retries", "public_url",
+    "grpc_port", "duplicate_users", "admin_users", "session_timeout",
+    "tls_cert", "tls_key", "tls_port", "acme_webroot", "acme_directory", "acme_domains",
+    "acme_email", "acme_account_key", "acme_renew_days", "idempotency_ttl",
+    "max_body_size", "bulk_max_body_size", "request_timeout", "bulk_timeout",
+    "validation_cache_size", "validation_cache_ttl", "redis", "normalization",
+    "short_codes", "stripe_webhook_secret", "stripe_plans", "user_retention_days",
+    "wp_url", "wp_user", "wp_application_password", "wp_phone_meta", "wp_sync_interval",
+    "wp_sync_conflicts", "hubspot_fields", "salesforce_fields", "email_checks", "email_timeout",
+    "email_smtp_helo", "portability", "portability_max_age",
+    "cnam_lookup", "cnam_cache_size", "cnam_cache_ttl",
+    "history_retention_days", "history_scrub_days", "metadata_refresh_interval", "cache_evict_interval",
+    "revalidate_interval", "revalidate_webhook", "task_jitter", "disabled_tasks", "receipt_secret",
+    "encryption_keys", "notify", "invalid_spike_percent", "invalid_spike_min", "debug_endpoints", "dev_mode",
+    "access_log", "access_log_format", "access_log_max_size", "access_log_max_files",
+    "otlp_endpoint", "trace_sample_ratio", "trace_service_name",
+    "provider_retries", "provider_backoff_ms", "breaker_failures", "breaker_cooldown",
+    "otp_sender", "otp_timeout", "otp_ttl", "otp_length", "otp_max_attempts", "otp_resend_interval",
+    "otp_message",
+};
+
+#define OPTION_COUNT (int)(sizeof(option_names) / sizeof(option_names[0]))
+
+static const char* level_names[] = {"debug", "info", "warn", "error"};
+
+// Phone field names used by the stock Contact Form 7, WPForms and Gravity
+// Forms templates
+static const char* default_phone_fields[] = {"phone", "your-phone", "tel", "your-tel", "telephone"};
+
+// CrmAttribute names, in order
+static const char* crm_attribute_names[] = {
+    "e164", "national", "valid", "country", "country_code", "line_type",
+    "carrier", "location", "timezone", "risk_score", "voip",
+};
+
+// Custom contact properties a HubSpot portal would add for these, with the
+// built-in phone property taking the E.164 form
+static const char* default_hubspot_fields[] = {
+    "e164=phone", "valid=phone_valid", "line_type=phone_line_type", "carrier=phone_carrier",
+    "country=phone_country", "location=phone_location", "timezone=phone_timezone",
+    "risk_score=phone_risk_score",
+};
+
+// The same as custom fields on a Salesforce Contact or Lead
+static const char* default_salesforce_fields[] = {
+    "e164=Phone", "valid=Phone_Valid__c", "line_type=Phone_Line_Type__c",
+    "carrier=Phone_Carrier__c", "country=Phone_Country__c", "location=Phone_Location__c",
+    "timezone=Phone_Timezone__c", "risk_score=Phone_Risk_Score__c",
+};
+
+// User meta keys WooCommerce and the common phone field plugins use
+static const char* default_phone_meta[] = {"phone", "billing_phone", "phone_number", "mobile"};
+
+void config_defaults(Config* config) {
+    memset(config, 0, sizeof(Config));
+    config->port = 8080;
+    config->read_timeout = 30;
+    config->write_timeout = 30;
+    config->shutdown_timeout = 25;   // Below Kubernetes' default 30s grace period
+    snprintf(config->store, sizeof(config->store), "%s", CONFIG_DEFAULT_STORE);
+    config->store_backup = true;
+    config->store_migrate = true;
+    config->log_level = LOG_INFO;
+    config->ip_rate_burst = 20;
+    config->key_rate_burst = 100;
+    snprintf(config->cors_methods, sizeof(config->cors_methods), "GET, POST, PUT, PATCH, DELETE, OPTIONS");
+    snprintf(config->cors_headers, sizeof(config->cors_headers), "Content-Type, Authorization, Idempotency-Key");
+    config->cors_max_age = 600;
+    config->hmac_window = 300;
+    config->carrier_timeout = 5;
+    config->provider_retries = 2;
+    config->provider_backoff_ms = 200;
+    config->breaker_failures = 5;
+    config->breaker_cooldown = 30;
+    config->portability_max_age = 30;
+    config->cnam_cache_size = 10000;
+    config->cnam_cache_ttl = 86400;
+    config->callback_timeout = 10;
+    config->callback_retries = 5;
+    config->session_timeout = 28800;
+    config->idempotency_ttl = 86400;
+    config->max_body_size = 1024 * 1024;
+    config->bulk_max_body_size = 16 * 1024 * 1024;
+    config->request_timeout = 10;
+    config->bulk_timeout = 300;
+    config->validation_cache_size = 10000;
+    config->validation_cache_ttl = 600;
+    config->normalization = PHONE_NORMALIZE_ALL;
+    config->user_retention_days = 30;
+    config->metadata_refresh_interval = 300;
+    config->cache_evict_interval = 300;
+    config->task_jitter = 10;
+    config->invalid_spike_percent = 50;
+    config->invalid_spike_min = 20;
+    config->access_log_format = ACCESS_LOG_COMBINED;
+    config->access_log_max_size = 100LL * 1024 * 1024;
+    config->access_log_max_files = 5;
+    config->trace_sample_ratio = 1;
+    snprintf(config->trace_service_name, sizeof(config->trace_service_name), "phoneval");
+    config->email_timeout = 5;
+    config->otp_timeout = 10;
+    config->otp_ttl = 300;
+    config->otp_length = 6;
+    config->otp_max_attempts = 5;
+    config->otp_resend_interval = 30;
+    snprintf(config->otp_message, sizeof(config->otp_message), "Your verification code is {code}");
+    for (int i = 0; i < (int)(sizeof(default_phone_meta) / sizeof(default_phone_meta[0])); i++) {
+        snprintf(config->wp_phone_meta[config->wp_phone_meta_count++],
+                 sizeof(config->wp_phone_meta[0]), "%s", default_phone_meta[i]);
+    }
+    config->tls_port = 8443;
+    snprintf(config->acme_account_key, sizeof(config->acme_account_key), "acme_account.pem");
+    config->acme_renew_days = 30;
+    for (int i = 0; i < (int)(sizeof(default_phone_fields) / sizeof(default_phone_fields[0])); i++) {
+        snprintf(config->webhook_phone_fields[config->webhook_phone_field_count++],
+                 sizeof(config->webhook_phone_fields[0]), "%s", default_phone_fields[i]);
+    }
+    for (int i = 0; i < (int)(sizeof(default_hubspot_fields) / sizeof(default_hubspot_fields[0])); i++) {
+        snprintf(config->hubspot_fields[config->hubspot_field_count++],
+                 sizeof(config->hubspot_fields[0]), "%s", default_hubspot_fields[i]);
+    }
+    for (int i = 0; i < (int)(sizeof(default_salesforce_fields) / sizeof(default_salesforce_fields[0])); i++) {
+        snprintf(config->salesforce_fields[config->salesforce_field_count++],
+                 sizeof(config->salesforce_fields[0]), "%s", default_salesforce_fields[i]);
+    }
+}
+
+const char* log_level_string(LogLevel level) {
+    return level_names[level];
+}
+
+bool crm_field_parse(const char* entry, CrmAttribute* attribute, const char** property) {
+    const char* equals = strchr(entry, '=');
+    if (!equals || !equals[1]) return false;
+    size_t length = equals - entry;
+    for (int i = 0; i < (int)(sizeof(crm_attribute_names) / sizeof(crm_attribute_names[0])); i++) {
+        if (strlen(crm_attribute_names[i]) == length && strncmp(entry, crm_attribute_names[i], length) == 0) {
+            *attribute = (CrmAttribute)i;
+            *property = equals + 1;
+            return true;
+        }
+    }
+    return false;
+}
+
+// Trims whitespace in place and returns the start of the trimmed text
+static char* trim(char* text) {
+    while (isspace((unsigned char)*text)) text++;
+    char* end = text + strlen(text);
+    while (end > text && isspace((unsigned char)end[-1])) end--;
+    *end = '\0';
+    return text;
+}
+
+// Removes one pair of matching surrounding quotes
+static char* unquote(char* text) {
+    size_t length = strlen(text);
+    if (length >= 2 && (text[0] == '"' || text[0] == '\'') && text[length - 1] == text[0]) {
+        text[length - 1] = '\0';
+        return text + 1;
+    }
+    return text;
+}
+
+static bool parse_int(const char* value, int min, int max, int* out) {
+    char* end;
+    long number = strtol(value, &end, 10);
+    if (end == value || *end != '\0' || number < min || number > max) return false;
+    *out = (int)number;
+    return true;
+}
+
+static bool parse_double(const char* value, double min, double max, double* out) {
+    char* end;
+    double number = strtod(value, &end);
+    if (end == value || *end != '\0' || number < min || number > max) return false;
+    *out = number;
+    return true;
+}
+
+// Splits "a,b" or ["a", "b"] into items, a fixed array of item_size
+// byte strings
+static bool parse_list(const char* name, const char* value, char* items, int max_items,
+                       size_t item_size, int* count, char* error, size_t error_size) {
+    char list[CONFIG_MAX_VALUE_LENGTH * 4];
+    snprintf(list, sizeof(list), "%s", value);
+
+    char* text = trim(list);
+    size_t length = strlen(text);
+    if (length >= 2 && text[0] == '[' && text[length - 1] == ']') {
+        text[length - 1] = '\0';
+        text++;
+    }
+
+    *count = 0;
+    char* saveptr = NULL;
+    for (char* item = strtok_r(text, ",", &saveptr); item; item = strtok_r(NULL, ",", &saveptr)) {
+        char* entry = unquote(trim(item));
+        if (!*entry) continue;
+        if (*count == max_items) {
+            snprintf(error, error_size, "%s: more than %d entries", name, max_items);
+            return false;
+        }
+        if (strlen(entry) >= item_size) {
+            snprintf(error, error_size, "%s: entry longer than %zu characters", name, item_size - 1);
+            return false;
+        }
+        snprintf(items + (*count)++ * item_size, item_size, "%s", entry);
+    }
+    return true;
+}
+
+bool config_set(Config* config, const char* name, const char* value,
+                char* error, size_t error_size) {
+    int* timeout = NULL;
+    if (strcmp(name, "read_timeout") == 0) timeout = &config->read_timeout;
+    if (strcmp(name, "write_timeout") == 0) timeout = &config->write_timeout;
+    if (strcmp(name, "shutdown_timeout") == 0) timeout = &config->shutdown_timeout;
+
+    if (timeout) {
+        if (!parse_int(value, 0, 86400, timeout)) {
+            snprintf(error, error_size, "%s: expected seconds, got \"%s\"", name, value);
+            return false;
+        }
+    } else if (strcmp(name, "ip_rate_limit") == 0 || strcmp(name, "key_rate_limit") == 0) {
+        double* rate = strcmp(name, "ip_rate_limit") == 0 ? &config->ip_rate_limit
+                                                          : &config->key_rate_limit;
+        if (!parse_double(value, 0, 1e6, rate)) {
+            snprintf(error, error_size, "%s: expected requests per second, got \"%s\"", name, value);
+            return false;
+        }
+    } else if (strcmp(name, "ip_rate_burst") == 0 || strcmp(name, "key_rate_burst") == 0) {
+        int* burst = strcmp(name, "ip_rate_burst") == 0 ? &config->ip_rate_burst
+                                                        : &config->key_rate_burst;
+        if (!parse_int(value, 1, 1000000, burst)) {
+            snprintf(error, error_size, "%s: expected a positive request count, got \"%s\"", name, value);
+            return false;
+        }
+    } else if (strcmp(name, "port") == 0) {
+        if (!parse_int(value, 1, 65535, &config->port)) {
+            snprintf(error, error_size, "port: expected 1-65535, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "grpc_port") == 0) {
+        if (!parse_int(value, 0, 65535, &config->grpc_port)) {
+            snprintf(error, error_size, "grpc_port: expected 0-65535, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "tls_port") == 0) {
+        if (!parse_int(value, 1, 65535, &config->tls_port)) {
+            snprintf(error, error_size, "tls_port: expected 1-65535, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "store") == 0 || strcmp(name, "metadata") == 0 ||
+               strcmp(name, "tls_cert") == 0 ||
+               strcmp(name, "tls_key") == 0 || strcmp(name, "acme_webroot") == 0 ||
+               strcmp(name, "acme_account_key") == 0 ||
+               strcmp(name, "redis") == 0 || strcmp(name, "portability") == 0) {
+        char* target = strcmp(name, "store") == 0 ? config->store
+                     : strcmp(name, "metadata") == 0 ? config->metadata
+                     : strcmp(name, "portability") == 0 ? config->portability
+                     : strcmp(name, "tls_cert") == 0 ? config->tls_cert
+                     : strcmp(name, "tls_key") == 0 ? config->tls_key
+                     : strcmp(name, "acme_webroot") == 0 ? config->acme_webroot
+                     : strcmp(name, "acme_account_key") == 0 ? config->acme_account_key
+                     : config->redis;
+        if (strlen(value) >= CONFIG_MAX_VALUE_LENGTH) {
+            snprintf(error, error_size, "%s: value too long", name);
+            return false;
+        }
+        snprintf(target, CONFIG_MAX_VALUE_LENGTH, "%s", value);
+    } else if (strcmp(name, "acme_directory") == 0) {
+        if (value[0] && strncmp(value, "http://", 7) != 0 && strncmp(value, "https://", 8) != 0) {
+            snprintf(error, error_size, "acme_directory: expected an http:// or https:// URL, got \"%s\"",
+                     value);
+            return false;
+        }
+        if (strlen(value) >= sizeof(config->acme_directory)) {
+            snprintf(error, error_size, "acme_directory: value too long");
+            return false;
+        }
+        snprintf(config->acme_directory, sizeof(config->acme_directory), "%s", value);
+    } else if (strcmp(name, "acme_domains") == 0) {
+        return parse_list(name, value, config->acme_domains[0], CONFIG_MAX_ACME_DOMAINS,
+                          sizeof(config->acme_domains[0]), &config->acme_domain_count,
+                          error, error_size);
+    } else if (strcmp(name, "acme_email") == 0) {
+        if (value[0] && !strchr(value, '@')) {
+            snprintf(error, error_size, "acme_email: expected an email address, got \"%s\"", value);
+            return false;
+        }
+        if (strlen(value) >= sizeof(config->acme_email)) {
+            snprintf(error, error_size, "acme_email: value too long");
+            return false;
+        }
+        snprintf(config->acme_email, sizeof(config->acme_email), "%s", value);
+    } else if (strcmp(name, "acme_renew_days") == 0) {
+        if (!parse_int(value, 1, 60, &config->acme_renew_days)) {
+            snprintf(error, error_size, "acme_renew_days: expected 1-60 days, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "store_backup") == 0) {
+        if (strcmp(value, "true") == 0) {
+            config->store_backup = true;
+        } else if (strcmp(value, "false") == 0) {
+            config->store_backup = false;
+        } else {
+            snprintf(error, error_size, "store_backup: expected true or false, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "store_table_prefix") == 0) {
+        size_t length = strlen(value);
+        bool ok = length < sizeof(config->store_table_prefix);
+        for (size_t i = 0; i < length && ok; i++) {
+            ok = isalnum((unsigned char)value[i]) || value[i] == '_';
+        }
+        if (!ok) {
+            snprintf(error, error_size, "store_table_prefix: expected up to 32 letters, digits and _ "
+                     "such as wp_phoneval_, got \"%s\"", value);
+            return false;
+        }
+        snprintf(config->store_table_prefix, sizeof(config->store_table_prefix), "%s", value);
+    } else if (strcmp(name, "store_migrate") == 0) {
+        if (strcmp(value, "true") == 0) {
+            config->store_migrate = true;
+        } else if (strcmp(value, "false") == 0) {
+            config->store_migrate = false;
+        } else {
+            snprintf(error, error_size, "store_migrate: expected true or false, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "log_level") == 0) {
+        for (int i = 0; i < (int)(sizeof(level_names) / sizeof(level_names[0])); i++) {
+            if (strcmp(value, level_names[i]) == 0) {
+                config->log_level = (LogLevel)i;
+                return true;
+            }
+        }
+        snprintf(error, error_size, "log_level: expected debug, info, warn or error, got \"%s\"", value);
+        return false;
+    } else if (strcmp(name, "api_keys") == 0) {
+        return parse_list(name, value, config->api_keys[0], CONFIG_MAX_API_KEYS,
+                          sizeof(config->api_keys[0]), &config->api_key_count, error, error_size);
+    } else if (strcmp(name, "cors_origins") == 0) {
+        return parse_list(name, value, config->cors_origins[0], CONFIG_MAX_CORS_ORIGINS,
+                          sizeof(config->cors_origins[0]), &config->cors_origin_count,
+                          error, error_size);
+    } else if (strcmp(name, "cors_methods") == 0 || strcmp(name, "cors_headers") == 0) {
+        char* target = strcmp(name, "cors_methods") == 0 ? config->cors_methods
+                                                         : config->cors_headers;
+        if (strlen(value) >= sizeof(config->cors_methods)) {
+            snprintf(error, error_size, "%s: value too long", name);
+            return false;
+        }
+        snprintf(target, sizeof(config->cors_methods), "%s", value);
+    } else if (strcmp(name, "cors_max_age") == 0) {
+        if (!parse_int(value, 0, 86400, &config->cors_max_age)) {
+            snprintf(error, error_size, "cors_max_age: expected seconds, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "webhook_phone_fields") == 0) {
+        return parse_list(name, value, config->webhook_phone_fields[0], CONFIG_MAX_PHONE_FIELDS,
+                          sizeof(config->webhook_phone_fields[0]),
+                          &config->webhook_phone_field_count, error, error_size);
+    } else if (strcmp(name, "normalization") == 0) {
+        char steps[8][32];
+        int count;
+        if (!parse_list(name, value, steps[0], 8, sizeof(steps[0]), &count, error, error_size)) {
+            return false;
+        }
+        config->normalization = 0;
+        for (int i = 0; i < count; i++) {
+            PhoneNormalizeStep step = phone_normalize_step_from_string(steps[i]);
+            if (!step) {
+                snprintf(error, error_size, "normalization: expected digits, punctuation, vanity "
+                         "or trunk_prefix, got \"%s\"", steps[i]);
+                return false;
+            }
+            config->normalization |= step;
+        }
+    } else if (strcmp(name, "webhook_region") == 0) {
+        if (value[0] && (strlen(value) != 2 || !isupper((unsigned char)value[0]) ||
+                         !isupper((unsigned char)value[1]))) {
+            snprintf(error, error_size, "webhook_region: expected a region code such as GB, got \"%s\"", value);
+            return false;
+        }
+        snprintf(config->webhook_region, sizeof(config->webhook_region), "%s", value);
+    } else if (strcmp(name, "hmac_secrets") == 0) {
+        return parse_list(name, value, config->hmac_secrets[0], CONFIG_MAX_HMAC_SECRETS,
+                          sizeof(config->hmac_secrets[0]), &config->hmac_secret_count,
+                          error, error_size);
+    } else if (strcmp(name, "hmac_window") == 0) {
+        if (!parse_int(value, 1, 86400, &config->hmac_window)) {
+            snprintf(error, error_size, "hmac_window: expected seconds, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "carrier_timeout") == 0) {
+        if (!parse_int(value, 1, 60, &config->carrier_timeout)) {
+            snprintf(error, error_size, "carrier_timeout: expected 1-60 seconds, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "provider_retries") == 0) {
+        if (!parse_int(value, 0, 10, &config->provider_retries)) {
+            snprintf(error, error_size, "provider_retries: expected 0-10 retries, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "provider_backoff_ms") == 0) {
+        if (!parse_int(value, 0, 60000, &config->provider_backoff_ms)) {
+            snprintf(error, error_size, "provider_backoff_ms: expected 0-60000 milliseconds, got \"%s\"",
+                     value);
+            return false;
+        }
+    } else if (strcmp(name, "breaker_failures") == 0) {
+        if (!parse_int(value, 0, 1000, &config->breaker_failures)) {
+            snprintf(error, error_size, "breaker_failures: expected 0-1000 failures, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "breaker_cooldown") == 0) {
+        if (!parse_int(value, 1, 3600, &config->breaker_cooldown)) {
+            snprintf(error, error_size, "breaker_cooldown: expected 1-3600 seconds, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "portability_max_age") == 0) {
+        if (!parse_int(value, 1, 3650, &config->portability_max_age)) {
+            snprintf(error, error_size, "portability_max_age: expected 1-3650 days, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "cnam_cache_size") == 0) {
+        if (!parse_int(value, 0, 1000000, &config->cnam_cache_size)) {
+            snprintf(error, error_size, "cnam_cache_size: expected 0-1000000 entries, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "cnam_cache_ttl") == 0) {
+        if (!parse_int(value, 1, 2592000, &config->cnam_cache_ttl)) {
+            snprintf(error, error_size, "cnam_cache_ttl: expected 1-2592000 seconds, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "history_key") == 0) {
+        if (strlen(value) >= sizeof(config->history_key)) {
+            snprintf(error, error_size, "history_key: value too long");
+            return false;
+        }
+        snprintf(config->history_key, sizeof(config->history_key), "%s", value);
+    } else if (strcmp(name, "stripe_webhook_secret") == 0) {
+        if (strlen(value) >= sizeof(config->stripe_webhook_secret)) {
+            snprintf(error, error_size, "stripe_webhook_secret: value too long");
+            return false;
+        }
+        snprintf(config->stripe_webhook_secret, sizeof(config->stripe_webhook_secret), "%s", value);
+    } else if (strcmp(name, "stripe_plans") == 0) {
+        if (!parse_list(name, value, config->stripe_plans[0], CONFIG_MAX_STRIPE_PLANS,
+                        sizeof(config->stripe_plans[0]), &config->stripe_plan_count,
+                        error, error_size)) {
+            return false;
+        }
+        for (int i = 0; i < config->stripe_plan_count; i++) {
+            const char* quota = strchr(config->stripe_plans[i], '=');
+            char* end = NULL;
+            if (quota && quota != config->stripe_plans[i]) strtoll(quota + 1, &end, 10);
+            if (!end || end == quota + 1 || *end || quota[1] == '-') {
+                snprintf(error, error_size, "stripe_plans: expected price_id=monthly_quota, got \"%.64s\"",
+                         config->stripe_plans[i]);
+                return false;
+            }
+        }
+    } else if (strcmp(name, "callback_secret") == 0) {
+        if (strlen(value) >= sizeof(config->callback_secret)) {
+            snprintf(error, error_size, "callback_secret: value too long");
+            return false;
+        }
+        snprintf(config->callback_secret, sizeof(config->callback_secret), "%s", value);
+    } else if (strcmp(name, "receipt_secret") == 0) {
+        if (strlen(value) >= sizeof(config->receipt_secret)) {
+            snprintf(error, error_size, "receipt_secret: value too long");
+            return false;
+        }
+        snprintf(config->receipt_secret, sizeof(config->receipt_secret), "%s", value);
+    } else if (strcmp(name, "encryption_keys") == 0) {
+        return parse_list(name, value, config->encryption_keys[0], CONFIG_MAX_ENCRYPTION_KEYS,
+                          sizeof(config->encryption_keys[0]), &config->encryption_key_count,
+                          error, error_size);
+    } else if (strcmp(name, "callback_timeout") == 0) {
+        if (!parse_int(value, 1, 60, &config->callback_timeout)) {
+            snprintf(error, error_size, "callback_timeout: expected 1-60 seconds, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "callback_retries") == 0) {
+        if (!parse_int(value, 0, 10, &config->callback_retries)) {
+            snprintf(error, error_size, "callback_retries: expected 0-10, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "public_url") == 0) {
+        if (value[0] && strncmp(value, "http://", 7) != 0 && strncmp(value, "https://", 8) != 0) {
+            snprintf(error, error_size, "public_url: expected an http:// or https:// URL, got \"%s\"", value);
+            return false;
+        }
+        if (strlen(value) >= sizeof(config->public_url)) {
+            snprintf(error, error_size, "public_url: value too long");
+            return false;
+        }
+        snprintf(config->public_url, sizeof(config->public_url), "%s", value);
+        // Paths are appended with their leading slash
+        size_t len = strlen(config->public_url);
+        while (len > 0 && config->public_url[len - 1] == '/') {
+            config->public_url[--len] = '\0';
+        }
+    } else if (strcmp(name, "response_format") == 0) {
+        if (strcmp(value, "default") == 0) {
+            config->response_format = RESPONSE_FORMAT_DEFAULT;
+        } else if (strcmp(value, "wp") == 0) {
+            config->response_format = RESPONSE_FORMAT_WP;
+        } else {
+            snprintf(error, error_size, "response_format: expected default or wp, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "duplicate_users") == 0) {
+        if (strcmp(value, "reject") == 0) {
+            config->duplicate_users = DUPLICATE_USERS_REJECT;
+        } else if (strcmp(value, "merge") == 0) {
+            config->duplicate_users = DUPLICATE_USERS_MERGE;
+        } else {
+            snprintf(error, error_size, "duplicate_users: expected reject or merge, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "short_codes") == 0) {
+        if (strcmp(value, "reject") == 0) {
+            config->short_codes = SHORT_CODES_REJECT;
+        } else if (strcmp(value, "accept") == 0) {
+            config->short_codes = SHORT_CODES_ACCEPT;
+        } else {
+            snprintf(error, error_size, "short_codes: expected reject or accept, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "admin_users") == 0) {
+        if (!parse_list(name, value, config->admin_users[0], CONFIG_MAX_ADMIN_USERS,
+                        sizeof(config->admin_users[0]), &config->admin_user_count,
+                        error, error_size)) {
+            return false;
+        }
+        for (int i = 0; i < config->admin_user_count; i++) {
+            const char* hash = strchr(config->admin_users[i], ':');
+            if (!hash || hash == config->admin_users[i] || hash[1] != '$') {
+                snprintf(error, error_size, "admin_users: expected name:<password hash>, got \"%.64s\"",
+                         config->admin_users[i]);
+                return false;
+            }
+        }
+    } else if (strcmp(name, "session_timeout") == 0) {
+        if (!parse_int(value, 60, 2592000, &config->session_timeout)) {
+            snprintf(error, error_size, "session_timeout: expected 60-2592000 seconds, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "wp_url") == 0) {
+        if (value[0] && strncmp(value, "http://", 7) != 0 && strncmp(value, "https://", 8) != 0) {
+            snprintf(error, error_size, "wp_url: expected an http:// or https:// URL, got \"%s\"", value);
+            return false;
+        }
+        if (strlen(value) >= sizeof(config->wp_url)) {
+            snprintf(error, error_size, "wp_url: value too long");
+            return false;
+        }
+        snprintf(config->wp_url, sizeof(config->wp_url), "%s", value);
+        // /wp-json/... is appended with its leading slash
+        size_t len = strlen(config->wp_url);
+        while (len > 0 && config->wp_url[len - 1] == '/') {
+            config->wp_url[--len] = '\0';
+        }
+    } else if (strcmp(name, "wp_user") == 0 || strcmp(name, "wp_application_password") == 0) {
+        char* target = strcmp(name, "wp_user") == 0 ? config->wp_user : config->wp_application_password;
+        if (strlen(value) >= sizeof(config->wp_user)) {
+            snprintf(error, error_size, "%s: value too long", name);
+            return false;
+        }
+        snprintf(target, sizeof(config->wp_user), "%s", value);
+    } else if (strcmp(name, "wp_phone_meta") == 0) {
+        return parse_list(name, value, config->wp_phone_meta[0], CONFIG_MAX_PHONE_FIELDS,
+                          sizeof(config->wp_phone_meta[0]), &config->wp_phone_meta_count,
+                          error, error_size);
+    } else if (strcmp(name, "wp_sync_interval") == 0) {
+        if (!parse_int(value, 0, 86400, &config->wp_sync_interval) ||
+            (config->wp_sync_interval > 0 && config->wp_sync_interval < 60)) {
+            snprintf(error, error_size, "wp_sync_interval: expected 0 or 60-86400 seconds, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "wp_sync_conflicts") == 0) {
+        if (strcmp(value, "wordpress") == 0) {
+            config->wp_sync_conflicts = WP_SYNC_CONFLICTS_WORDPRESS;
+        } else if (strcmp(value, "local") == 0) {
+            config->wp_sync_conflicts = WP_SYNC_CONFLICTS_LOCAL;
+        } else if (strcmp(value, "skip") == 0) {
+            config->wp_sync_conflicts = WP_SYNC_CONFLICTS_SKIP;
+        } else {
+            snprintf(error, error_size, "wp_sync_conflicts: expected wordpress, local or skip, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "hubspot_fields") == 0 || strcmp(name, "salesforce_fields") == 0) {
+        bool hubspot = strcmp(name, "hubspot_fields") == 0;
+        char (*fields)[96] = hubspot ? config->hubspot_fields : config->salesforce_fields;
+        int* count = hubspot ? &config->hubspot_field_count : &config->salesforce_field_count;
+        if (!parse_list(name, value, fields[0], CONFIG_MAX_CRM_FIELDS, sizeof(fields[0]), count,
+                        error, error_size)) {
+            return false;
+        }
+        for (int i = 0; i < *count; i++) {
+            CrmAttribute attribute;
+            const char* property;
+            if (!crm_field_parse(fields[i], &attribute, &property)) {
+                snprintf(error, error_size,
+                         "%s: expected attribute=property with attribute one of e164, national, "
+                         "valid, country, country_code, line_type, carrier, location, timezone, "
+                         "risk_score or voip, got \"%.64s\"", name, fields[i]);
+                return false;
+            }
+        }
+    } else if (strcmp(name, "email_checks") == 0) {
+        if (strcmp(value, "syntax") == 0) {
+            config->email_checks = EMAIL_CHECKS_SYNTAX;
+        } else if (strcmp(value, "mx") == 0) {
+            config->email_checks = EMAIL_CHECKS_MX;
+        } else {
+            snprintf(error, error_size, "email_checks: expected syntax or mx, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "email_timeout") == 0) {
+        if (!parse_int(value, 1, 60, &config->email_timeout)) {
+            snprintf(error, error_size, "email_timeout: expected 1-60 seconds, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "email_smtp_helo") == 0) {
+        if (strlen(value) >= sizeof(config->email_smtp_helo) || strpbrk(value, " \t\r\n")) {
+            snprintf(error, error_size, "email_smtp_helo: expected a host name, got \"%.64s\"", value);
+            return false;
+        }
+        snprintf(config->email_smtp_helo, sizeof(config->email_smtp_helo), "%s", value);
+    } else if (strcmp(name, "user_retention_days") == 0) {
+        if (!parse_int(value, 0, 3650, &config->user_retention_days)) {
+            snprintf(error, error_size, "user_retention_days: expected 0-3650 days, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "history_retention_days") == 0) {
+        if (!parse_int(value, 0, 3650, &config->history_retention_days)) {
+            snprintf(error, error_size, "history_retention_days: expected 0-3650 days, got \"%s\"",
+                     value);
+            return false;
+        }
+    } else if (strcmp(name, "history_scrub_days") == 0) {
+        if (!parse_int(value, 0, 3650, &config->history_scrub_days)) {
+            snprintf(error, error_size, "history_scrub_days: expected 0-3650 days, got \"%s\"",
+                     value);
+            return false;
+        }
+    } else if (strcmp(name, "metadata_refresh_interval") == 0 ||
+               strcmp(name, "cache_evict_interval") == 0) {
+        int* target = strcmp(name, "metadata_refresh_interval") == 0
+            ? &config->metadata_refresh_interval : &config->cache_evict_interval;
+        if (!parse_int(value, 0, 86400, target) || (*target > 0 && *target < 10)) {
+            snprintf(error, error_size, "%s: expected 0 or 10-86400 seconds, got \"%s\"", name, value);
+            return false;
+        }
+    } else if (strcmp(name, "revalidate_interval") == 0) {
+        if (!parse_int(value, 0, 2592000, &config->revalidate_interval) ||
+            (config->revalidate_interval > 0 && config->revalidate_interval < 3600)) {
+            snprintf(error, error_size, "revalidate_interval: expected 0 or 3600-2592000 seconds, "
+                     "got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "revalidate_webhook") == 0) {
+        if (value[0] && strncmp(value, "http://", 7) != 0 && strncmp(value, "https://", 8) != 0) {
+            snprintf(error, error_size,
+                     "revalidate_webhook: expected an http:// or https:// URL, got \"%s\"", value);
+            return false;
+        }
+        if (strlen(value) >= sizeof(config->revalidate_webhook)) {
+            snprintf(error, error_size, "revalidate_webhook: value too long");
+            return false;
+        }
+        snprintf(config->revalidate_webhook, sizeof(config->revalidate_webhook), "%s", value);
+    } else if (strcmp(name, "task_jitter") == 0) {
+        if (!parse_int(value, 0, 50, &config->task_jitter)) {
+            snprintf(error, error_size, "task_jitter: expected 0-50 percent, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "disabled_tasks") == 0) {
+        return parse_list(name, value, config->disabled_tasks[0], CONFIG_MAX_TASKS,
+                          sizeof(config->disabled_tasks[0]), &config->disabled_task_count,
+                          error, error_size);
+    } else if (strcmp(name, "carrier_lookup") == 0) {
+        return parse_list(name, value, config->carrier_lookup[0], CONFIG_MAX_PROVIDERS,
+                          sizeof(config->carrier_lookup[0]), &config->carrier_lookup_count,
+                          error, error_size);
+    } else if (strcmp(name, "cnam_lookup") == 0) {
+        return parse_list(name, value, config->cnam_lookup[0], CONFIG_MAX_PROVIDERS,
+                          sizeof(config->cnam_lookup[0]), &config->cnam_lookup_count,
+                          error, error_size);
+    } else if (strcmp(name, "notify") == 0) {
+        return parse_list(name, value, config->notify[0], CONFIG_MAX_NOTIFIERS,
+                          sizeof(config->notify[0]), &config->notify_count, error, error_size);
+    } else if (strcmp(name, "invalid_spike_percent") == 0) {
+        if (!parse_int(value, 1, 100, &config->invalid_spike_percent)) {
+            snprintf(error, error_size, "invalid_spike_percent: expected 1-100 percent, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "invalid_spike_min") == 0) {
+        if (!parse_int(value, 1, 1000000, &config->invalid_spike_min)) {
+            snprintf(error, error_size, "invalid_spike_min: expected 1-1000000 validations, got \"%s\"",
+                     value);
+            return false;
+        }
+    } else if (strcmp(name, "debug_endpoints") == 0) {
+        if (strcmp(value, "true") == 0) {
+            config->debug_endpoints = true;
+        } else if (strcmp(value, "false") == 0) {
+            config->debug_endpoints = false;
+        } else {
+            snprintf(error, error_size, "debug_endpoints: expected true or false, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "dev_mode") == 0) {
+        if (strcmp(value, "true") == 0) {
+            config->dev_mode = true;
+        } else if (strcmp(value, "false") == 0) {
+            config->dev_mode = false;
+        } else {
+            snprintf(error, error_size, "dev_mode: expected true or false, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "access_log") == 0) {
+        if (strlen(value) >= sizeof(config->access_log)) {
+            snprintf(error, error_size, "access_log: value too long");
+            return false;
+        }
+        snprintf(config->access_log, sizeof(config->access_log), "%s", value);
+    } else if (strcmp(name, "access_log_format") == 0) {
+        if (strcmp(value, "common") == 0) {
+            config->access_log_format = ACCESS_LOG_COMMON;
+        } else if (strcmp(value, "combined") == 0) {
+            config->access_log_format = ACCESS_LOG_COMBINED;
+        } else {
+            snprintf(error, error_size, "access_log_format: expected common or combined, got \"%s\"",
+                     value);
+            return false;
+        }
+    } else if (strcmp(name, "access_log_max_size") == 0) {
+        int size;
+        if (!parse_int(value, 0, INT_MAX, &size) || (size > 0 && size < 1024 * 1024)) {
+            snprintf(error, error_size,
+                     "access_log_max_size: expected 0 or 1048576-2147483647 bytes, got \"%s\"", value);
+            return false;
+        }
+        config->access_log_max_size = size;
+    } else if (strcmp(name, "access_log_max_files") == 0) {
+        if (!parse_int(value, 1, 100, &config->access_log_max_files)) {
+            snprintf(error, error_size, "access_log_max_files: expected 1-100 files, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "otlp_endpoint") == 0) {
+        if (value[0] && strncmp(value, "http://", 7) != 0) {
+            snprintf(error, error_size, "otlp_endpoint: expected an http:// URL, got \"%s\"", value);
+            return false;
+        }
+        if (strlen(value) >= sizeof(config->otlp_endpoint)) {
+            snprintf(error, error_size, "otlp_endpoint: value too long");
+            return false;
+        }
+        snprintf(config->otlp_endpoint, sizeof(config->otlp_endpoint), "%s", value);
+    } else if (strcmp(name, "trace_sample_ratio") == 0) {
+        if (!parse_double(value, 0, 1, &config->trace_sample_ratio)) {
+            snprintf(error, error_size, "trace_sample_ratio: expected 0-1, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "trace_service_name") == 0) {
+        if (!value[0] || strlen(value) >= sizeof(config->trace_service_name)) {
+            snprintf(error, error_size, "trace_service_name: expected 1-63 characters, got \"%s\"",
+                     value);
+            return false;
+        }
+        snprintf(config->trace_service_name, sizeof(config->trace_service_name), "%s", value);
+    } else if (strcmp(name, "otp_sender") == 0) {
+        return parse_list(name, value, config->otp_sender[0], CONFIG_MAX_PROVIDERS,
+                          sizeof(config->otp_sender[0]), &config->otp_sender_count,
+                          error, error_size);
+    } else if (strcmp(name, "otp_timeout") == 0) {
+        if (!parse_int(value, 1, 60, &config->otp_timeout)) {
+            snprintf(error, error_size, "otp_timeout: expected 1-60 seconds, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "otp_ttl") == 0) {
+        if (!parse_int(value, 60, 3600, &config->otp_ttl)) {
+            snprintf(error, error_size, "otp_ttl: expected 60-3600 seconds, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "otp_length") == 0) {
+        if (!parse_int(value, 4, 10, &config->otp_length)) {
+            snprintf(error, error_size, "otp_length: expected 4-10 digits, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "otp_max_attempts") == 0) {
+        if (!parse_int(value, 1, 20, &config->otp_max_attempts)) {
+            snprintf(error, error_size, "otp_max_attempts: expected 1-20 attempts, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "otp_resend_interval") == 0) {
+        if (!parse_int(value, 0, 3600, &config->otp_resend_interval)) {
+            snprintf(error, error_size, "otp_resend_interval: expected 0-3600 seconds, got \"%s\"",
+                     value);
+            return false;
+        }
+    } else if (strcmp(name, "otp_message") == 0) {
+        if (!value[0] || strlen(value) >= sizeof(config->otp_message)) {
+            snprintf(error, error_size, "otp_message: expected 1-160 characters, got \"%s\"", value);
+            return false;
+        }
+        snprintf(config->otp_message, sizeof(config->otp_message), "%s", value);
+    } else if (strcmp(name, "idempotency_ttl") == 0) {
+        if (!parse_int(value, 60, 604800, &config->idempotency_ttl)) {
+            snprintf(error, error_size, "idempotency_ttl: expected 60-604800 seconds, got \"%s\"", value);
+            return false;
+        }
+    } else if (strcmp(name, "max_body_size") == 0 || strcmp(name, "bulk_max_body_size") == 0) {
+        int* target = strcmp(name, "max_body_size") == 0 ? &config->max_body_size
+                                                          : &config->bulk_max_body_size;
+        if (!parse_int(value, 1024, 256 * 1024 * 1024, target)) {
+            snprintf(error, error_size, "%s: expected 1024-268435456 bytes, got \"%s\"", name, value);
+            return false;
+        }
+    } else if (strcmp(name, "request_timeout") == 0 || strcmp(name, "bulk_timeout") == 0) {
+        int* target = strcmp(name, "request_timeout") == 0 ? &config->request_timeout
+                                                            : &config->bulk_timeout;
+        if (!parse_int(value, 1, 3600, target)) {
+            snprintf(error, error_size, "%s: expected 1-3600 seconds, got \"%s\"", name, value);
+            return false;
+        }
+    } else if (strcmp(name, "validation_cache_size") == 0) {
+        if (!parse_int(value, 0, 1000000, &config->validation_cache_size)) {
+            snprintf(error, error_size, "validation_cache_size: expected 0-1000000 entries, got \"%s\"",
+                     value);
+            return false;
+        }
+    } else if (strcmp(name, "validation_cache_ttl") == 0) {
+        if (!parse_int(value, 1, 86400, &config->validation_cache_ttl)) {
+            snprintf(error, error_size, "validation_cache_ttl: expected 1-86400 seconds, got \"%s\"",
+                     value);
+            return false;
+        }
+    } else {
+        snprintf(error, error_size, "unknown option \"%s\"", name);
+        return false;
+    }
+    return true;
+}
+
+bool config_load_file(Config* config, const char* path, char* error, size_t error_size) {
+    FILE* file = fopen(path, "r");
+    if (!file) {
+        snprintf(error, error_size, "cannot open %s", path);
+        return false;
+    }
+
+    char line[CONFIG_MAX_VALUE_LENGTH * 4];
+    int line_number = 0;
+    bool ok = true;
+
+    while (ok && fgets(line, sizeof(line), file)) {
+        line_number++;
+
+        // Drop comments that aren't inside a quoted string
+        char quote = 0;
+        for (char* p = line; *p; p++) {
+            if (quote) {
+                if (*p == quote) quote = 0;
+            } else if (*p == '"' || *p == '\'') {
+                quote = *p;
+            } else if (*p == '#') {
+                *p = '\0';
+                break;
+            }
+        }
+
+        char* text = trim(line);
+        if (!*text) continue;
+
+        char* equals = strchr(text, '=');
+        if (!equals) {
+            snprintf(error, error_size, "%s line %d: expected name = value", path, line_number);
+            ok = false;
+            break;
+        }
+        *equals = '\0';
+        char* name = trim(text);
+        char* value = trim(equals + 1);
+        if (value[0] != '[') {
+            value = unquote(value);
+        }
+
+        char problem[256];
+        if (!config_set(config, name, value, problem, sizeof(problem))) {
+            snprintf(error, error_size, "%s line %d: %s", path, line_number, problem);
+            ok = false;
+        }
+    }
+
+    fclose(file);
+    return ok;
+}
+
+bool config_load_env(Config* config, char* error, size_t error_size) {
+    for (int i = 0; i < OPTION_COUNT; i++) {
+        char variable[64] = "PHONEVAL_";
+        size_t pos = strlen(variable);
+        for (const char* p = option_names[i]; *p && pos + 1 < sizeof(variable); p++) {
+            variable[pos++] = (char)toupper((unsigned char)*p);
+        }
+        variable[pos] = '\0';
+
+        const char* value = getenv(variable);
+        if (!value) continue;
+
+        char problem[256];
+        if (!config_set(config, option_names[i], value, problem, sizeof(problem))) {
+            snprintf(error, error_size, "%s: %s", variable, problem);
+            return false;
+        }
+    }
+    return true;
+}
@@ -0,0 +1,244 @@
+#ifndef CONFIG_H
+#define CONFIG_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+#define CONFIG_MAX_API_KEYS 32
+#define CONFIG_MAX_CORS_ORIGINS 16
+#define CONFIG_MAX_PHONE_FIELDS 16
+#define CONFIG_MAX_HMAC_SECRETS 4
+#define CONFIG_MAX_ADMIN_USERS 16
+#define CONFIG_MAX_STRIPE_PLANS 16
+#define CONFIG_MAX_CRM_FIELDS 16
+#define CONFIG_MAX_TASKS 16
+#define CONFIG_MAX_ENCRYPTION_KEYS 8
+#define CONFIG_MAX_NOTIFIERS 16
+#define CONFIG_MAX_PROVIDERS 8
+#define CONFIG_MAX_ACME_DOMAINS 8
+#define CONFIG_MAX_VALUE_LENGTH 512
+
+// The store when none is configured: a database file in the working
+// directory wherever SQLite was built in, so data outlives a restart
+#ifdef HAVE_SQLITE
+#define CONFIG_DEFAULT_STORE "sqlite:phoneval.db"
+#else
+#define CONFIG_DEFAULT_STORE "memory"
+#endif
+
+typedef enum {
+    LOG_DEBUG,
+    LOG_INFO,
+    LOG_WARN,
+    LOG_ERROR
+} LogLevel;
+
+// Shape of error bodies: the default {"error": {...}} envelope, or
+// WordPress REST's {"code", "message", "data": {"status"}}
+typedef enum {
+    RESPONSE_FORMAT_DEFAULT,
+    RESPONSE_FORMAT_WP
+} ResponseFormat;
+
+// What creating a user whose email or phone is taken does: fail with a
+// 409, or update the existing user with the new fields
+typedef enum {
+    DUPLICATE_USERS_REJECT,
+    DUPLICATE_USERS_MERGE
+} DuplicateUsers;
+
+// Which side a WordPress sync keeps when a user's phone changed on both
+// since the last sync: WordPress's, ours, or neither until someone decides
+typedef enum {
+    WP_SYNC_CONFLICTS_WORDPRESS,
+    WP_SYNC_CONFLICTS_LOCAL,
+    WP_SYNC_CONFLICTS_SKIP
+} WpSyncConflicts;
+
+// What forms do with short codes and emergency numbers such as 911:
+// reject them like any invalid number, or take them as dialled
+typedef enum {
+    SHORT_CODES_REJECT,
+    SHORT_CODES_ACCEPT
+} ShortCodes;
+
+// What a user's email has to pass: the form of an address, or also a
+// domain whose DNS says where its mail goes
+typedef enum {
+    EMAIL_CHECKS_SYNTAX,
+    EMAIL_CHECKS_MX
+} EmailChecks;
+
+// Lines access_log writes: Common Log Format, host ident user [time]
+// "request" status bytes, or Combined, which adds "referer" "user agent"
+typedef enum {
+    ACCESS_LOG_COMMON,
+    ACCESS_LOG_COMBINED
+} AccessLogFormat;
+
+// What a CRM field mapping can fill in from a validation result, named
+// as in hubspot_fields and salesforce_fields ("e164=phone")
+typedef enum {
+    CRM_ATTRIBUTE_E164,
+    CRM_ATTRIBUTE_NATIONAL,
+    CRM_ATTRIBUTE_VALID,
+    CRM_ATTRIBUTE_COUNTRY,
+    CRM_ATTRIBUTE_COUNTRY_CODE,
+    CRM_ATTRIBUTE_LINE_TYPE,
+    CRM_ATTRIBUTE_CARRIER,
+    CRM_ATTRIBUTE_LOCATION,
+    CRM_ATTRIBUTE_TIMEZONE,
+    CRM_ATTRIBUTE_RISK_SCORE,
+    CRM_ATTRIBUTE_VOIP
+} CrmAttribute;
+
+// Server settings. Later sources override earlier ones:
+// defaults, then the config file, then PHONEVAL_* environment variables,
+// then command-line flags.
+typedef struct {
+    int port;
+    int read_timeout;       // Seconds, 0 waits forever
+    int write_timeout;      // Seconds, 0 waits forever
+    int shutdown_timeout;   // Seconds to drain in-flight requests
+    char store[CONFIG_MAX_VALUE_LENGTH];      // Storage DSN
+    bool store_backup;      // Copy a SQLite store's database to PATH.bak on shutdown
+    bool store_migrate;     // Apply pending schema migrations at startup
+    char store_table_prefix[33];   // Before a MySQL store's table names, e.g. wp_phoneval_
+    char metadata[CONFIG_MAX_VALUE_LENGTH];   // Numbering plan file, empty for embedded
+    LogLevel log_level;
+    double ip_rate_limit;   // Requests per second per client IP, 0 disables
+    int ip_rate_burst;
+    double key_rate_limit;  // Requests per second per API key, 0 disables
+    int key_rate_burst;
+    char api_keys[CONFIG_MAX_API_KEYS][128];  // Accepted for /admin, empty allows any
+    int api_key_count;
+    char cors_origins[CONFIG_MAX_CORS_ORIGINS][256];  // "*" allows any, empty disables CORS
+    int cors_origin_count;
+    char cors_methods[256];     // Access-Control-Allow-Methods for preflights
+    char cors_headers[256];     // Access-Control-Allow-Headers for preflights
+    int cors_max_age;           // Seconds browsers may cache a preflight
+    char webhook_phone_fields[CONFIG_MAX_PHONE_FIELDS][64];  // Form fields /wp/webhook validates
+    int webhook_phone_field_count;
+    char webhook_region[8];     // Default region for /wp/ numbers without a + prefix
+    char hmac_secrets[CONFIG_MAX_HMAC_SECRETS][128];  // Shared secrets for signed requests, empty disables
+    int hmac_secret_count;
+    int hmac_window;            // Seconds a signed request's timestamp stays valid
+    ResponseFormat response_format;  // Per request override: ?format=wp or ?format=default
+    char carrier_lookup[CONFIG_MAX_PROVIDERS][CONFIG_MAX_VALUE_LENGTH];  // Carrier/HLR providers, "DSN" or "REGIONS=DSN" in order tried, empty disables
+    int carrier_lookup_count;
+    int carrier_timeout;        // Seconds to wait for the provider
+    int provider_retries;       // Times a failed carrier or caller name lookup is tried again
+    int provider_backoff_ms;    // Before the first retry, doubling after each
+    int breaker_failures;       // Failed lookups in a row that stop calls to a provider, 0 never does
+    int breaker_cooldown;       // Seconds calls stay stopped before one is tried
+    char portability[CONFIG_MAX_VALUE_LENGTH];  // Number portability dataset file, empty for none
+    int portability_max_age;    // Days before the dataset is reported stale
+    char cnam_lookup[CONFIG_MAX_PROVIDERS][CONFIG_MAX_VALUE_LENGTH];  // Caller name providers, as carrier_lookup
+    int cnam_lookup_count;
+    int cnam_cache_size;        // Caller names kept per number, 0 disables the cache
+    int cnam_cache_ttl;         // Seconds a cached caller name is reused
+    char history_key[128];      // HMAC key for number hashes in the validation history
+    char callback_secret[128];  // Signs job callbacks, empty disables them
+    char receipt_secret[128];   // Signs privacy request receipts, empty disables those requests
+    char encryption_keys[CONFIG_MAX_ENCRYPTION_KEYS][96];  // "id:<64 hex>" sealing users' emails and phones, the first seals, empty disables
+    int encryption_key_count;
+    int callback_timeout;       // Seconds to wait for a callback receiver
+    int callback_retries;       // Times a failed callback is tried again
+    char public_url[256];       // Base URL for links in callbacks, e.g. https://phoneval.example.com
+    int grpc_port;              // Port for the gRPC service, 0 disables it
+    DuplicateUsers duplicate_users;
+    char admin_users[CONFIG_MAX_ADMIN_USERS][192];  // "name:<bcrypt hash>" for the admin pages, empty allows any
+    int admin_user_count;
+    int session_timeout;        // Seconds an admin session lasts after its last request
+    int idempotency_ttl;        // Seconds an Idempotency-Key and its response are kept
+    int max_body_size;          // Bytes of request body most routes accept
+    int bulk_max_body_size;     // Bytes of request body batch and job routes accept
+    int request_timeout;        // Seconds most routes may take to answer
+    int bulk_timeout;           // Seconds batch, CSV and job routes may take
+    int validation_cache_size;  // Validation results kept for repeated inputs, 0 disables the cache
+    int validation_cache_ttl;   // Seconds a cached validation result is reused
+    int normalization;          // PhoneNormalizeStep bits applied to input before parsing
+    ShortCodes short_codes;     // For the WordPress webhook, WooCommerce checkout and user phones
+    char redis[CONFIG_MAX_VALUE_LENGTH];  // redis:// URL for state shared between replicas, empty keeps it local
+    char tls_cert[CONFIG_MAX_VALUE_LENGTH];     // PEM certificate chain, empty disables HTTPS
+    char tls_key[CONFIG_MAX_VALUE_LENGTH];      // PEM private key for tls_cert
+    int tls_port;               // Port for HTTPS, once tls_cert is set
+    char acme_webroot[CONFIG_MAX_VALUE_LENGTH]; // Serves /.well-known/acme-challenge/ from here, empty disables
+    char acme_directory[CONFIG_MAX_VALUE_LENGTH];   // ACME CA whose certificates tls_cert holds, empty disables
+    char acme_domains[CONFIG_MAX_ACME_DOMAINS][256];  // Names the certificate is for, the first its subject
+    int acme_domain_count;
+    char acme_email[256];       // Contact the CA sends expiry notices to, empty for none
+    char acme_account_key[CONFIG_MAX_VALUE_LENGTH]; // The account's PEM key, made on first use
+    int acme_renew_days;        // Days before expiry the certificate is renewed
+    char stripe_webhook_secret[128];    // Verifies /stripe/webhook ("whsec_..."), empty disables it
+    char stripe_plans[CONFIG_MAX_STRIPE_PLANS][128];  // "price_id=monthly_quota", 0 for no limit
+    int stripe_plan_count;
+    int user_retention_days;    // Days a soft deleted user can be restored before it is purged, 0 keeps it
+    char wp_url[256];           // WordPress site users are imported from, e.g. https://shop.example.com
+    char wp_user[128];          // WordPress login the application password belongs to
+    char wp_application_password[128];  // From the user's WordPress profile, empty disables REST imports
+    char wp_phone_meta[CONFIG_MAX_PHONE_FIELDS][64];  // User meta keys an import takes the phone from
+    int wp_phone_meta_count;
+    int wp_sync_interval;       // Seconds between syncs with wp_url, 0 syncs only when asked
+    WpSyncConflicts wp_sync_conflicts;
+    char hubspot_fields[CONFIG_MAX_CRM_FIELDS][96];     // "attribute=property" for ?enrich=hubspot
+    int hubspot_field_count;
+    char salesforce_fields[CONFIG_MAX_CRM_FIELDS][96];  // "attribute=Field__c" for ?enrich=salesforce
+    int salesforce_field_count;
+    EmailChecks email_checks;   // For users' email fields
+    int email_timeout;          // Seconds for each DNS query and SMTP reply
+    char email_smtp_helo[256];  // Host name SMTP callouts introduce themselves as, empty disables them
+    int history_retention_days; // Days validation history is kept, 0 keeps it
+    int history_scrub_days;     // Days validation history keeps its number hashes, 0 keeps them
+    int metadata_refresh_interval;  // Seconds between checks for changed metadata and portability files, 0 disables
+    int cache_evict_interval;   // Seconds between sweeps of expired cache entries, 0 disables
+    int revalidate_interval;    // Seconds between re-validations of users' phones, 0 runs them only when asked
+    char revalidate_webhook[256];   // Told about phones a re-validation flags, empty tells no one
+    int task_jitter;            // Percent of a task's interval its runs are spread over
+    char disabled_tasks[CONFIG_MAX_TASKS][32];  // Scheduled tasks that only run when asked
+    int disabled_task_count;
+    char notify[CONFIG_MAX_NOTIFIERS][544];  // "event=DSN" alerting a notifier to event, "*=DSN" to every event
+    int notify_count;
+    int invalid_spike_percent;  // Percent of recent validations that must be invalid to alert
+    int invalid_spike_min;      // Validations needed in the window before it can alert
+    bool debug_endpoints;       // Serve /admin/debug/ (process stats, threads, heap, CPU profiles)
+    bool dev_mode;              // Serve /api/dev/ and allow --seed-demo, for local development
+    char access_log[256];       // File of a line per request, "-" for stdout, empty for none
+    AccessLogFormat access_log_format;
+    long long access_log_max_size;  // Bytes before the file is rotated, 0 for never
+    int access_log_max_files;   // Rotated files kept
+    char otlp_endpoint[256];    // Collector spans are sent to over OTLP/HTTP, empty disables tracing
+    double trace_sample_ratio;  // Share of new traces recorded; a traceparent's sampled flag decides for the rest
+    char trace_service_name[64];    // service.name of every span, e.g. to tell staging from production
+    char otp_sender[CONFIG_MAX_PROVIDERS][CONFIG_MAX_VALUE_LENGTH];  // Where /api/v1/otp/send texts codes from, as carrier_lookup, empty disables it
+    int otp_sender_count;
+    int otp_timeout;            // Seconds to wait for otp_sender
+    int otp_ttl;                // Seconds a code can be verified for
+    int otp_length;             // Digits in a code
+    int otp_max_attempts;       // Wrong codes before one is thrown away
+    int otp_resend_interval;    // Seconds before another code can be sent to the same number
+    char otp_message[161];      // Text sent, "{code}" is replaced by the code
+} Config;
+
+void config_defaults(Config* config);
+
+// Sets a single option by name, e.g. "read_timeout". Flags use the same
+// names with dashes ("--read-timeout").
+bool config_set(Config* config, const char* name, const char* value,
+                char* error, size_t error_size);
+
+// Reads "name = value" lines; strings may be quoted and lists such as
+// api_keys may be written ["a", "b"]. Errors name the offending line.
+bool config_load_file(Config* config, const char* path, char* error, size_t error_size);
+
+// Applies PHONEVAL_<NAME> variables, e.g. PHONEVAL_PORT=9090.
+// Lists such as PHONEVAL_API_KEYS are comma separated.
+bool config_load_env(Config* config, char* error, size_t error_size);
+
+const char* log_level_string(LogLevel level);
+
+// Splits a hubspot_fields or salesforce_fields entry, "attribute=property",
+// pointing *property into it. False if the attribute isn't one it knows.
+bool crm_field_parse(const char* entry, CrmAttribute* attribute, const char** property);
+
+#endif
@@ -0,0 +1,25 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <poll.h>
+#include <sys/socket.h>
+
+#include "context.h"
+#include "metrics.h"
+
+bool context_abandoned(const Context* ctx) {
+    if (!ctx || ctx->sock < 0) return false;
+
+    struct pollfd watch = {.fd = ctx->sock, .events = POLLIN};
+    if (poll(&watch, 1, 0) <= 0) return false;
+    if (watch.revents & (POLLHUP | POLLERR | POLLNVAL)) return true;
+
+    // Readable: either more data or the end of the stream
+    char byte;
+    return recv(ctx->sock, &byte, 1, MSG_PEEK | MSG_DONTWAIT) == 0;
+}
+
+bool context_done(const Context* ctx) {
+    if (!ctx) return false;
+    if (ctx->deadline > 0 && metrics_now() > ctx->deadline) return true;
+    return context_abandoned(ctx);
+}
@@ -0,0 +1,30 @@
+#ifndef CONTEXT_H
+#define CONTEXT_H
+
+#include <stdbool.h>
+
+struct Span;
+
+// How often blocking work that can't be woken (a query on the database
+// server, an HTTP call to a lookup provider) asks whether it is still wanted
+#define CONTEXT_POLL_MS 100
+
+// Why a request's work is being done, so that slow calls made for it can
+// stop once nobody is waiting for the answer. Stores and lookup providers
+// take one with each call; NULL means the work is always wanted, as for
+// background jobs and startup.
+typedef struct {
+    double deadline;        // metrics_now() time after which the answer is thrown away, 0 for none
+    int sock;               // Client socket to watch for a hang up, -1 for none
+    struct Span* span;      // Tracing span the work belongs under, NULL when untraced (see tracing.h)
+    bool sandbox;           // For a sandbox API key: answered from test data, no provider called (see sandbox.h)
+} Context;
+
+// True once the deadline has passed or the client has hung up
+bool context_done(const Context* ctx);
+
+// True once the client has closed its end of the connection. Data still
+// waiting to be read, such as an unread body, doesn't count.
+bool context_abandoned(const Context* ctx);
+
+#endif
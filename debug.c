@@ -0,0 +1,308 @@
+#define _GNU_SOURCE     // mallinfo2(), malloc_info()
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <ctype.h>
+#include <signal.h>
+#include <unistd.h>
+#include <dirent.h>
+#include <malloc.h>
+#include <pthread.h>
+#include <execinfo.h>
+#include <sys/time.h>
+
+#include "debug.h"
+
+// Frames the profiler's own signal handling adds to the top of a sample:
+// the handler and the kernel's return trampoline
+#define PROFILE_SKIP_FRAMES 2
+
+// ============= Process =============
+
+// Fields 3 on of a /proc/.../stat line, after the parenthesised name,
+// which may itself hold spaces and parentheses
+static bool read_stat(const char* path, char* name, size_t name_size, char* fields,
+                      size_t fields_size) {
+    FILE* file = fopen(path, "r");
+    if (!file) return false;
+    char line[1024];
+    bool ok = fgets(line, sizeof(line), file) != NULL;
+    fclose(file);
+    char* open = ok ? strchr(line, '(') : NULL;
+    char* close = ok ? strrchr(line, ')') : NULL;
+    if (!open || !close || close < open || close[1] != ' ') return false;
+    if (name) snprintf(name, name_size, "%.*s", (int)(close - open - 1), open + 1);
+    snprintf(fields, fields_size, "%s", close + 2);
+    return true;
+}
+
+bool debug_process_info(DebugProcessInfo* info) {
+    memset(info, 0, sizeof(*info));
+    info->pid = getpid();
+
+    char fields[1024];
+    if (!read_stat("/proc/self/stat", NULL, 0, fields, sizeof(fields))) return false;
+    // state ppid pgrp session tty_nr tpgid flags minflt cminflt majflt
+    // cmajflt utime stime cutime cstime priority nice num_threads
+    // itrealvalue starttime vsize rss
+    unsigned long long utime, stime, starttime, vsize;
+    long long rss;
+    int threads;
+    if (sscanf(fields, "%*c %*d %*d %*d %*d %*d %*u %*u %*u %*u %*u %llu %llu %*d %*d %*d %*d %d "
+               "%*d %llu %llu %lld", &utime, &stime, &threads, &starttime, &vsize, &rss) != 6) {
+        return false;
+    }
+    double ticks = (double)sysconf(_SC_CLK_TCK);
+    long page_size = sysconf(_SC_PAGESIZE);
+    info->threads = threads;
+    info->cpu_user = utime / ticks;
+    info->cpu_system = stime / ticks;
+    info->virtual_bytes = (long long)vsize;
+    info->rss_bytes = rss * page_size;
+
+    double uptime = 0;
+    FILE* file = fopen("/proc/uptime", "r");
+    if (file) {
+        if (fscanf(file, "%lf", &uptime) != 1) uptime = 0;
+        fclose(file);
+    }
+    info->uptime = uptime > starttime / ticks ? uptime - starttime / ticks : 0;
+
+    DIR* fds = opendir("/proc/self/fd");
+    if (fds) {
+        struct dirent* entry;
+        while ((entry = readdir(fds))) {
+            if (isdigit((unsigned char)entry->d_name[0])) info->open_fds++;
+        }
+        closedir(fds);
+        info->open_fds--;   // The one reading the directory
+    }
+
+    struct mallinfo2 heap = mallinfo2();
+    info->heap_arena_bytes = (long long)heap.arena;
+    info->heap_in_use_bytes = (long long)(heap.uordblks + heap.hblkhd);
+    info->heap_free_bytes = (long long)heap.fordblks;
+    info->heap_mmap_bytes = (long long)heap.hblkhd;
+    return true;
+}
+
+static int compare_threads(const void* a, const void* b) {
+    return ((const DebugThreadInfo*)a)->tid - ((const DebugThreadInfo*)b)->tid;
+}
+
+int debug_threads(DebugThreadInfo** threads) {
+    *threads = NULL;
+    DIR* tasks = opendir("/proc/self/task");
+    if (!tasks) return -1;
+
+    int count = 0;
+    int capacity = 0;
+    double ticks = (double)sysconf(_SC_CLK_TCK);
+    struct dirent* entry;
+    while ((entry = readdir(tasks))) {
+        if (!isdigit((unsigned char)entry->d_name[0])) continue;
+        char path[64];
+        char fields[1024];
+        DebugThreadInfo thread = {0};
+        thread.tid = atoi(entry->d_name);
+        snprintf(path, sizeof(path), "/proc/self/task/%d/stat", thread.tid);
+        // A thread that exits in between is left out
+        if (!read_stat(path, thread.name, sizeof(thread.name), fields, sizeof(fields))) continue;
+        unsigned long long utime = 0, stime = 0;
+        sscanf(fields, "%c %*d %*d %*d %*d %*d %*u %*u %*u %*u %*u %llu %llu", &thread.state,
+               &utime, &stime);
+        thread.cpu_user = utime / ticks;
+        thread.cpu_system = stime / ticks;
+
+        if (count == capacity) {
+            capacity = capacity ? capacity * 2 : 32;
+            *threads = realloc(*threads, capacity * sizeof(DebugThreadInfo));
+        }
+        (*threads)[count++] = thread;
+    }
+    closedir(tasks);
+    qsort(*threads, count, sizeof(DebugThreadInfo), compare_threads);
+    return count;
+}
+
+char* debug_heap_xml(void) {
+    char* xml = NULL;
+    size_t length = 0;
+    FILE* out = open_memstream(&xml, &length);
+    if (!out) return NULL;
+    malloc_info(0, out);
+    fclose(out);
+    return xml;
+}
+
+// ============= Profiler =============
+
+typedef struct {
+    void* frames[DEBUG_MAX_FRAMES];
+    int count;
+} Sample;
+
+// Written by the SIGPROF handler, which may run on any thread at once, so
+// slots are claimed with an atomic add; read once the timer is off and no
+// handler is still running
+static Sample* samples = NULL;
+static int sample_capacity = 0;
+static int sample_next = 0;
+static int handlers_running = 0;
+static bool profiling = false;
+static pthread_mutex_t profile_lock = PTHREAD_MUTEX_INITIALIZER;
+
+static void profile_handler(int sig) {
+    (void)sig;
+    __atomic_add_fetch(&handlers_running, 1, __ATOMIC_SEQ_CST);
+    if (__atomic_load_n(&profiling, __ATOMIC_SEQ_CST)) {
+        int slot = __atomic_fetch_add(&sample_next, 1, __ATOMIC_RELAXED);
+        if (slot < sample_capacity) {
+            samples[slot].count = backtrace(samples[slot].frames, DEBUG_MAX_FRAMES);
+        }
+    }
+    __atomic_sub_fetch(&handlers_running, 1, __ATOMIC_SEQ_CST);
+}
+
+bool debug_profile_start(int hz, int max_samples, char* error, size_t error_size) {
+    pthread_mutex_lock(&profile_lock);
+    if (profiling) {
+        pthread_mutex_unlock(&profile_lock);
+        snprintf(error, error_size, "a profile is already running");
+        return false;
+    }
+    samples = calloc(max_samples, sizeof(Sample));
+    if (!samples) {
+        pthread_mutex_unlock(&profile_lock);
+        snprintf(error, error_size, "no memory for %d samples", max_samples);
+        return false;
+    }
+    sample_capacity = max_samples;
+    sample_next = 0;
+
+    // backtrace() loads libgcc on first use, which isn't safe inside a
+    // signal handler, so warm it up here
+    void* warm_up[1];
+    backtrace(warm_up, 1);
+
+    // SA_RESTART so that a sample landing in a blocking call doesn't fail it
+    struct sigaction action;
+    memset(&action, 0, sizeof(action));
+    action.sa_handler = profile_handler;
+    action.sa_flags = SA_RESTART;
+    sigemptyset(&action.sa_mask);
+    sigaction(SIGPROF, &action, NULL);
+
+    __atomic_store_n(&profiling, true, __ATOMIC_SEQ_CST);
+    struct itimerval timer = {{0, 1000000 / hz}, {0, 1000000 / hz}};
+    setitimer(ITIMER_PROF, &timer, NULL);
+    pthread_mutex_unlock(&profile_lock);
+    return true;
+}
+
+// The function a "module(function+0x1c) [0x...]" line from
+// backtrace_symbols() names, or its module's file name without one
+static void frame_name(const char* symbol, char* out, size_t out_size) {
+    const char* open = strchr(symbol, '(');
+    if (open && open[1] != '+' && open[1] != ')') {
+        snprintf(out, out_size, "%.*s", (int)strcspn(open + 1, "+)"), open + 1);
+        return;
+    }
+    size_t module_length = open ? (size_t)(open - symbol) : strcspn(symbol, " ");
+    const char* slash = memrchr(symbol, '/', module_length);
+    const char* module = slash ? slash + 1 : symbol;
+    snprintf(out, out_size, "[%.*s]", (int)(symbol + module_length - module), module);
+}
+
+typedef struct {
+    char* stack;
+    int count;
+} Stack;
+
+static int compare_strings(const void* a, const void* b) {
+    return strcmp(*(char* const*)a, *(char* const*)b);
+}
+
+static int compare_stacks(const void* a, const void* b) {
+    const Stack* x = a;
+    const Stack* y = b;
+    if (x->count != y->count) return y->count - x->count;
+    return strcmp(x->stack, y->stack);
+}
+
+char* debug_profile_stop(int* sample_count, int* dropped) {
+    pthread_mutex_lock(&profile_lock);
+    __atomic_store_n(&profiling, false, __ATOMIC_SEQ_CST);
+    struct itimerval off = {{0, 0}, {0, 0}};
+    setitimer(ITIMER_PROF, &off, NULL);
+    // A signal already on its way is ignored rather than killing the
+    // process with SIGPROF's default action
+    struct sigaction ignore;
+    memset(&ignore, 0, sizeof(ignore));
+    ignore.sa_handler = SIG_IGN;
+    sigemptyset(&ignore.sa_mask);
+    sigaction(SIGPROF, &ignore, NULL);
+    while (__atomic_load_n(&handlers_running, __ATOMIC_SEQ_CST) > 0) usleep(1000);
+
+    int taken = __atomic_load_n(&sample_next, __ATOMIC_RELAXED);
+    int count = taken < sample_capacity ? taken : sample_capacity;
+    *sample_count = count;
+    *dropped = taken - count;
+
+    // Each sample's frames outermost first, joined with ';'
+    char** stacks = calloc(count > 0 ? count : 1, sizeof(char*));
+    int stack_count = 0;
+    for (int i = 0; i < count; i++) {
+        Sample* sample = &samples[i];
+        if (sample->count <= PROFILE_SKIP_FRAMES) continue;
+        char** symbols = backtrace_symbols(sample->frames, sample->count);
+        if (!symbols) continue;
+        size_t length = 0;
+        char* stack = malloc(sample->count * 64 + 1);
+        stack[0] = '\0';
+        for (int f = sample->count - 1; f >= PROFILE_SKIP_FRAMES; f--) {
+            char name[64];
+            frame_name(symbols[f], name, sizeof(name));
+            // ';' and ' ' separate frames and the count
+            for (char* c = name; *c; c++) {
+                if (*c == ';' || *c == ' ') *c = '_';
+            }
+            length += sprintf(stack + length, "%s%s", length ? ";" : "", name);
+        }
+        free(symbols);
+        stacks[stack_count++] = stack;
+    }
+    free(samples);
+    samples = NULL;
+    sample_capacity = 0;
+    pthread_mutex_unlock(&profile_lock);
+
+    // Identical stacks end up next to each other, then the most sampled go
+    // first
+    qsort(stacks, stack_count, sizeof(char*), compare_strings);
+    Stack* distinct = calloc(stack_count > 0 ? stack_count : 1, sizeof(Stack));
+    int distinct_count = 0;
+    for (int i = 0; i < stack_count; i++) {
+        if (distinct_count > 0 && strcmp(distinct[distinct_count - 1].stack, stacks[i]) == 0) {
+            distinct[distinct_count - 1].count++;
+            free(stacks[i]);
+        } else {
+            distinct[distinct_count].stack = stacks[i];
+            distinct[distinct_count++].count = 1;
+        }
+    }
+    free(stacks);
+    qsort(distinct, distinct_count, sizeof(Stack), compare_stacks);
+
+    char* text = NULL;
+    size_t text_length = 0;
+    FILE* out = open_memstream(&text, &text_length);
+    for (int i = 0; i < distinct_count; i++) {
+        if (out) fprintf(out, "%s %d\n", distinct[i].stack, distinct[i].count);
+        free(distinct[i].stack);
+    }
+    free(distinct);
+    if (out) fclose(out);
+    return text;
+}
@@ -0,0 +1,58 @@
+#ifndef DEBUG_H
+#define DEBUG_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+// Runtime introspection for the /admin/debug routes: what the process is
+// using, its threads, the allocator's state and a sampling CPU profiler.
+// Everything is read from /proc/self and glibc, so it is Linux only.
+
+#define DEBUG_MAX_FRAMES 64         // Deepest stack a profile sample keeps
+#define DEBUG_THREAD_NAME_LENGTH 16 // As prctl(PR_SET_NAME) allows, with its NUL
+
+typedef struct {
+    int pid;
+    double uptime;              // Seconds since the process started
+    int threads;
+    int open_fds;
+    long long rss_bytes;        // Resident
+    long long virtual_bytes;
+    double cpu_user;            // Seconds
+    double cpu_system;
+    long long heap_arena_bytes; // Taken from the system by malloc, outside mmap()ed blocks
+    long long heap_in_use_bytes;
+    long long heap_free_bytes;  // Held by malloc but not handed out
+    long long heap_mmap_bytes;  // Large allocations mmap()ed on their own
+} DebugProcessInfo;
+
+typedef struct {
+    int tid;
+    char name[DEBUG_THREAD_NAME_LENGTH];
+    char state;                 // R running, S sleeping, D disk wait, ... as in /proc
+    double cpu_user;            // Seconds
+    double cpu_system;
+} DebugThreadInfo;
+
+bool debug_process_info(DebugProcessInfo* info);
+
+// Every thread of the process, lowest id first. The caller frees *threads.
+// Returns -1 if /proc can't be read.
+int debug_threads(DebugThreadInfo** threads);
+
+// malloc_info()'s XML description of every arena. The caller frees it.
+char* debug_heap_xml(void);
+
+// Samples the stacks of threads using CPU hz times per CPU second, into a
+// buffer of room for max_samples, until debug_profile_stop(). One profile
+// runs at a time: false if another is running.
+bool debug_profile_start(int hz, int max_samples, char* error, size_t error_size);
+
+// Stops the profile and returns it as collapsed stacks, one
+// "outer;...;inner count" line per distinct stack, most sampled first, as
+// flamegraph.pl and speedscope read. Functions without a dynamic symbol
+// show as their module. *samples is set to the samples taken and *dropped
+// to those that didn't fit. The caller frees the text.
+char* debug_profile_stop(int* samples, int* dropped);
+
+#endif
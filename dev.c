@@ -0,0 +1,129 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+
+#include "dev.h"
+#include "seed.h"
+
+#define SEED_HISTORY_BATCH 500      // History records seed_demo() writes at a time
+
+// The history record demo validation index of count would have left.
+// Validated here rather than by validate_number(), so /metrics only
+// counts real traffic.
+static void seed_history_record(int index, int count, long long now, HistoryRecord* record) {
+    SeedValidation validation;
+    seed_validation(index, count, now, &validation);
+    ValidationResult result = {0};
+    snprintf(result.input, sizeof(result.input), "%s", validation.input);
+    result.error = phone_parse(validation.input, NULL, &result.number);
+    result.reason = result.error == PHONE_OK ? phone_validity_reason(&result.number) : result.error;
+    if (validation.blocked && result.reason == PHONE_OK) {
+        result.blocked = true;
+        snprintf(result.blocked_reason, sizeof(result.blocked_reason), "%s", SEED_BLOCKED_REASON);
+    }
+    history_record_fill(record, &result, validation.caller, 0, validation.source,
+                        validation.timestamp);
+}
+
+bool seed_demo(const Context* ctx, int users, int history, SeedReport* report) {
+    memset(report, 0, sizeof(*report));
+    User user;
+    bool deleted;
+    seed_user(0, &user, &deleted);
+    user.phone[0] = '\0';
+    User existing;
+    StoreResult result = store->find_duplicate(store, ctx, &user, &existing);
+    if (result == STORE_OK) {
+        report->already_seeded = true;
+        return true;
+    } else if (result != STORE_NOT_FOUND) {
+        return false;
+    }
+    
+    long long now = time(NULL);
+    for (int i = 0; i < users; i++) {
+        seed_user(i, &user, &deleted);
+        if (store->create(store, ctx, &user) != STORE_OK) return false;
+        report->users++;
+        if (deleted) {
+            if (store->remove(store, ctx, user.id, now) != STORE_OK) return false;
+            report->deleted++;
+        }
+    }
+    
+    HistoryRecord* records = calloc(SEED_HISTORY_BATCH, sizeof(HistoryRecord));
+    for (int i = 0; i < history;) {
+        int count = 0;
+        while (count < SEED_HISTORY_BATCH && i < history) {
+            seed_history_record(i++, history, now, &records[count++]);
+        }
+        if (store->add_history(store, ctx, records, count) != STORE_OK) {
+            free(records);
+            return false;
+        }
+        report->history += count;
+    }
+    free(records);
+    return true;
+}
+
+static void seed_report_to_json(const SeedReport* report, StringBuilder* sb) {
+    sb_appendf(sb, "{\"already_seeded\": %s, \"users\": %d, \"deleted\": %d, \"history\": %d}",
+               report->already_seeded ? "true" : "false", report->users, report->deleted,
+               report->history);
+}
+
+void dev_middleware(HttpRequest* req, HttpResponse* res, Chain* chain) {
+    if (!config.dev_mode) {
+        set_error_response(res, 501, "dev_mode_disabled", "Dev mode is turned off", NULL);
+        return;
+    }
+    chain_next(req, res, chain);
+}
+
+// Reads the body's member field, a count from 0 to max, into value, which
+// is left alone when the member is absent
+static void read_seed_count(HttpRequest* req, FieldErrors* errors, const char* field, int max,
+                            int* value) {
+    const char* p = json_member(req->body, field);
+    if (!p) return;
+    char* end;
+    long count = strtol(p, &end, 10);
+    if (end == p || count < 0 || count > max) {
+        char message[64];
+        snprintf(message, sizeof(message), "Must be a whole number from 0 to %d", max);
+        field_errors_add(errors, field, "invalid_count", message);
+        return;
+    }
+    *value = (int)count;
+}
+
+void handle_dev_seed(HttpRequest* req, HttpResponse* res) {
+    int users = SEED_USERS;
+    int history = SEED_HISTORY;
+    FieldErrors errors;
+    field_errors_init(&errors);
+    read_seed_count(req, &errors, "users", SEED_MAX_USERS, &users);
+    read_seed_count(req, &errors, "history", SEED_MAX_HISTORY, &history);
+    if (!field_errors_finish(&errors, res)) return;
+    
+    SeedReport report;
+    bool ok = seed_demo(&req->context, users, history, &report);
+    if (report.users > 0 || report.history > 0) {
+        printf("Seeded %d demo user(s) and %d history record(s)\n", report.users, report.history);
+    }
+    if (!ok) {
+        error_internal(res, "Failed to seed demo data");
+        return;
+    }
+    
+    StringBuilder sb;
+    sb_init(&sb);
+    seed_report_to_json(&report, &sb);
+    if (!report.already_seeded) record_audit(req, "demo.seed", "", 0, NULL, sb.data);
+    set_json_response(res, report.already_seeded ? 200 : 201, sb.data);
+    sb_free(&sb);
+}
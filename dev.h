@@ -0,0 +1,33 @@
+#ifndef DEV_H
+#define DEV_H
+
+#include "webserver.h"
+
+// What dev_mode turns on: the /api/dev/ routes and --seed-demo, which fill
+// the store with the demo users and history seed.h makes up, for trying
+// the dashboard and pagination out locally.
+
+// What seed_demo() added
+typedef struct {
+    bool already_seeded;
+    int users;
+    int deleted;            // Of users, how many were soft deleted
+    int history;
+} SeedReport;
+
+// Adds users demo users and history demo validations (see seed.h) for the
+// operator. A store that already has the first demo user's email is taken
+// as seeded and left alone, so that starting with --seed-demo again adds
+// nothing twice. Returns false if the store failed, with what was added
+// until then in report.
+bool seed_demo(const Context* ctx, int users, int history, SeedReport* report);
+
+// The /api/dev/ routes, which answer 501 dev_mode_disabled unless dev_mode
+// is on. Runs after the key has been checked.
+void dev_middleware(HttpRequest* req, HttpResponse* res, Chain* chain);
+
+// POST /api/dev/seed: demo users and history, SEED_USERS and SEED_HISTORY
+// of them unless the body asks for other counts
+void handle_dev_seed(HttpRequest* req, HttpResponse* res);
+
+#endif
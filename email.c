@@ -0,0 +1,343 @@
+#define _DEFAULT_SOURCE
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <ctype.h>
+#include <errno.h>
+#include <fcntl.h>
+#include <netdb.h>
+#include <poll.h>
+#include <unistd.h>
+#include <sys/socket.h>
+#include <netinet/in.h>
+#include <arpa/nameser.h>
+#include <resolv.h>
+
+#include "email.h"
+
+static const char* error_names[] = {
+    "OK", "MISSING_AT", "TOO_LONG", "INVALID_LOCAL_PART", "INVALID_DOMAIN"
+};
+
+static const char* mx_result_names[] = {"found", "none", "null", "unknown"};
+
+static const char* smtp_result_names[] = {"accepted", "rejected", "unknown"};
+
+const char* email_error_string(EmailError error) {
+    return error_names[error];
+}
+
+const char* email_mx_result_string(EmailMxResult result) {
+    return mx_result_names[result];
+}
+
+const char* email_smtp_result_string(EmailSmtpResult result) {
+    return smtp_result_names[result];
+}
+
+// ============= Syntax =============
+
+// RFC 5322 atext, plus the UTF-8 that RFC 6531 allows in local parts
+static bool is_atext(unsigned char c) {
+    return isalnum(c) || c >= 0x80 || strchr("!#$%&'*+-/=?^_`{|}~", c) != NULL;
+}
+
+static bool valid_local_part(const char* start, size_t length) {
+    if (length == 0 || length > 64) return false;
+    if (start[0] == '.' || start[length - 1] == '.') return false;
+    for (size_t i = 0; i < length; i++) {
+        if (start[i] == '.') {
+            if (start[i + 1] == '.') return false;
+        } else if (!is_atext((unsigned char)start[i])) {
+            return false;
+        }
+    }
+    return true;
+}
+
+// Letters, digits and inner hyphens, 1-63 per label, at least two labels
+// and a top level that isn't all digits. Internationalized domains are
+// written in their xn-- form.
+static bool valid_domain(const char* domain) {
+    size_t length = strlen(domain);
+    if (length == 0 || length > 253) return false;
+
+    int labels = 0;
+    bool numeric = true;
+    const char* label = domain;
+    while (1) {
+        const char* end = strchr(label, '.');
+        size_t label_length = end ? (size_t)(end - label) : strlen(label);
+        if (label_length == 0 || label_length > 63) return false;
+        if (label[0] == '-' || label[label_length - 1] == '-') return false;
+        numeric = true;
+        for (size_t i = 0; i < label_length; i++) {
+            unsigned char c = (unsigned char)label[i];
+            if (!isalnum(c) && c != '-') return false;
+            if (!isdigit(c)) numeric = false;
+        }
+        labels++;
+        if (!end) break;
+        label = end + 1;
+    }
+    return labels >= 2 && !numeric;
+}
+
+EmailError email_check_syntax(const char* email, char* domain, size_t domain_size) {
+    const char* at = strrchr(email, '@');
+    if (!at) return EMAIL_MISSING_AT;
+    if (strlen(email) > EMAIL_MAX_LENGTH) return EMAIL_TOO_LONG;
+    if (!valid_local_part(email, at - email)) return EMAIL_INVALID_LOCAL_PART;
+    if (!valid_domain(at + 1) || strlen(at + 1) >= domain_size) return EMAIL_INVALID_DOMAIN;
+
+    size_t i = 0;
+    for (const char* p = at + 1; *p; p++) {
+        domain[i++] = (char)tolower((unsigned char)*p);
+    }
+    domain[i] = '\0';
+    return EMAIL_OK;
+}
+
+// ============= MX Lookup =============
+
+// Sends one query. Returns the answer's length, 0 when the name has no
+// records of type, -1 when it doesn't exist and -2 when nobody answered.
+static int query(res_state state, const char* domain, int type, unsigned char* answer,
+                 int answer_size) {
+    int length = res_nquery(state, domain, ns_c_in, type, answer, answer_size);
+    if (length >= 0) return length;
+    switch (state->res_h_errno) {
+        case NO_DATA: return 0;
+        case HOST_NOT_FOUND: return -1;
+        default: return -2;
+    }
+}
+
+// Counts the records of type in an answer
+static int count_records(const unsigned char* answer, int length, int type) {
+    ns_msg message;
+    if (ns_initparse(answer, length, &message) < 0) return 0;
+
+    int found = 0;
+    for (int i = 0; i < ns_msg_count(message, ns_s_an); i++) {
+        ns_rr record;
+        if (ns_parserr(&message, ns_s_an, i, &record) == 0 && (int)ns_rr_type(record) == type) {
+            found++;
+        }
+    }
+    return found;
+}
+
+// Reads the MX records of an answer into hosts, in preference order.
+// Returns how many there were in all, null MX records included.
+static int read_mx_records(const unsigned char* answer, int length, EmailMx* hosts, int max,
+                           int* count) {
+    ns_msg message;
+    *count = 0;
+    if (ns_initparse(answer, length, &message) < 0) return 0;
+
+    int records = 0;
+    for (int i = 0; i < ns_msg_count(message, ns_s_an); i++) {
+        ns_rr record;
+        if (ns_parserr(&message, ns_s_an, i, &record) < 0 || ns_rr_type(record) != ns_t_mx ||
+            ns_rr_rdlen(record) < 3) {
+            continue;
+        }
+        records++;
+
+        EmailMx mx;
+        mx.preference = ns_get16(ns_rr_rdata(record));
+        if (ns_name_uncompress(ns_msg_base(message), ns_msg_end(message), ns_rr_rdata(record) + 2,
+                               mx.host, sizeof(mx.host)) < 0) {
+            continue;
+        }
+        if (strcmp(mx.host, ".") == 0) mx.host[0] = '\0';
+
+        // Insertion sort, dropping the least preferred once full
+        int at = *count;
+        while (at > 0 && hosts[at - 1].preference > mx.preference) at--;
+        if (at >= max) continue;
+        int last = *count < max ? *count : max - 1;
+        memmove(&hosts[at + 1], &hosts[at], (last - at) * sizeof(EmailMx));
+        hosts[at] = mx;
+        if (*count < max) (*count)++;
+    }
+    return records;
+}
+
+EmailMxResult email_lookup_mx(const char* domain, int timeout, EmailMx* hosts, int max,
+                              int* count, char* error, size_t error_size) {
+    *count = 0;
+    struct __res_state state;
+    memset(&state, 0, sizeof(state));
+    if (res_ninit(&state) != 0) {
+        snprintf(error, error_size, "cannot read the resolver configuration");
+        return EMAIL_MX_ERROR;
+    }
+    state.retrans = timeout;
+    state.retry = 1;
+
+    unsigned char answer[NS_PACKETSZ * 4];
+    EmailMxResult result = EMAIL_MX_NONE;
+    int length = query(&state, domain, ns_t_mx, answer, sizeof(answer));
+    if (length > 0 && read_mx_records(answer, length, hosts, max, count) > 0) {
+        // A lone null MX says the domain takes no mail at all; next to
+        // other records it is a mistake, and skipped
+        result = *count == 1 && !hosts[0].host[0] ? EMAIL_MX_NULL : EMAIL_MX_FOUND;
+        int kept = 0;
+        for (int i = 0; i < *count; i++) {
+            if (hosts[i].host[0]) hosts[kept++] = hosts[i];
+        }
+        *count = kept;
+        if (result == EMAIL_MX_FOUND && kept == 0) result = EMAIL_MX_NONE;
+    } else if (length >= 0) {
+        // No MX records: mail goes to the domain's own address, if it has one
+        int types[] = {ns_t_a, ns_t_aaaa};
+        for (int i = 0; i < 2 && result == EMAIL_MX_NONE; i++) {
+            int found = query(&state, domain, types[i], answer, sizeof(answer));
+            if (found == -2) {
+                result = EMAIL_MX_ERROR;
+            } else if (found > 0 && count_records(answer, found, types[i]) > 0 && max > 0) {
+                snprintf(hosts[0].host, sizeof(hosts[0].host), "%s", domain);
+                hosts[0].preference = 0;
+                *count = 1;
+                result = EMAIL_MX_FOUND;
+            }
+        }
+    } else if (length == -2) {
+        result = EMAIL_MX_ERROR;
+    }
+    if (result == EMAIL_MX_ERROR) {
+        snprintf(error, error_size, "no answer from the DNS for %s", domain);
+    }
+    res_nclose(&state);
+    return result;
+}
+
+// ============= SMTP Callout =============
+
+// Waits up to timeout seconds for events on sock, in CONTEXT_POLL_MS
+// slices so that a finished ctx is noticed
+static bool wait_socket(int sock, short events, int timeout, const Context* ctx) {
+    struct pollfd watch = {.fd = sock, .events = events};
+    for (int waited = 0; waited < timeout * 1000; waited += CONTEXT_POLL_MS) {
+        int ready = poll(&watch, 1, CONTEXT_POLL_MS);
+        if (ready > 0) return true;
+        if (ready < 0 && errno != EINTR) return false;
+        if (context_done(ctx)) return false;
+    }
+    return false;
+}
+
+int smtp_connect(const Context* ctx, const char* host, const char* port, int timeout,
+                 char* error, size_t error_size) {
+    struct addrinfo hints = {0};
+    hints.ai_family = AF_UNSPEC;
+    hints.ai_socktype = SOCK_STREAM;
+    struct addrinfo* addresses;
+    int status = getaddrinfo(host, port, &hints, &addresses);
+    if (status != 0) {
+        snprintf(error, error_size, "%s: %s", host, gai_strerror(status));
+        return -1;
+    }
+
+    int sock = -1;
+    for (struct addrinfo* address = addresses; address && sock < 0; address = address->ai_next) {
+        sock = socket(address->ai_family, address->ai_socktype, address->ai_protocol);
+        if (sock < 0) continue;
+        fcntl(sock, F_SETFL, fcntl(sock, F_GETFL) | O_NONBLOCK);
+
+        int connect_error = 0;
+        socklen_t size = sizeof(connect_error);
+        if (connect(sock, address->ai_addr, address->ai_addrlen) < 0 &&
+            (errno != EINPROGRESS || !wait_socket(sock, POLLOUT, timeout, ctx) ||
+             getsockopt(sock, SOL_SOCKET, SO_ERROR, &connect_error, &size) < 0 || connect_error)) {
+            snprintf(error, error_size, "%s: cannot connect on port %s", host, port);
+            close(sock);
+            sock = -1;
+        }
+    }
+    freeaddrinfo(addresses);
+    return sock;
+}
+
+int smtp_read_reply(int sock, int timeout, const Context* ctx) {
+    char reply[1024];
+    size_t length = 0;
+    size_t line = 0;
+    while (1) {
+        // A line whose code is followed by a space ends the reply
+        char* end;
+        while ((end = memchr(reply + line, '\n', length - line))) {
+            if (end - (reply + line) >= 3 && (reply[line + 3] == ' ' || reply[line + 3] == '\r')) {
+                return atoi(reply + line);
+            }
+            line = end + 1 - reply;
+        }
+        memmove(reply, reply + line, length - line);
+        length -= line;
+        line = 0;
+        if (length == sizeof(reply)) return 0;
+
+        if (!wait_socket(sock, POLLIN, timeout, ctx)) return 0;
+        ssize_t got = recv(sock, reply + length, sizeof(reply) - length, 0);
+        if (got <= 0) return 0;
+        length += got;
+    }
+}
+
+int smtp_command(int sock, const char* command, int timeout, const Context* ctx) {
+    // A message's DATA may not fit the socket's buffer in one go
+    size_t length = strlen(command);
+    for (size_t sent = 0; sent < length;) {
+        if (!wait_socket(sock, POLLOUT, timeout, ctx)) return 0;
+        ssize_t wrote = send(sock, command + sent, length - sent, MSG_NOSIGNAL);
+        if (wrote < 0 && errno != EAGAIN && errno != EINTR) return 0;
+        if (wrote > 0) sent += wrote;
+    }
+    return smtp_read_reply(sock, timeout, ctx);
+}
+
+EmailSmtpResult email_smtp_callout(const Context* ctx, const EmailMx* hosts, int count,
+                                   const char* email, const char* helo, int timeout,
+                                   int* code, char* host, size_t host_size,
+                                   char* error, size_t error_size) {
+    *code = 0;
+    host[0] = '\0';
+    snprintf(error, error_size, "no mail exchanger to ask");
+
+    for (int i = 0; i < count && !context_done(ctx); i++) {
+        int sock = smtp_connect(ctx, hosts[i].host, "25", timeout, error, error_size);
+        if (sock < 0) continue;
+
+        // Only a server that won't talk at all is worth trying the next one for
+        char command[EMAIL_MAX_LENGTH + 300];
+        snprintf(command, sizeof(command), "EHLO %s\r\n", helo);
+        if (smtp_read_reply(sock, timeout, ctx) != 220 ||
+            smtp_command(sock, command, timeout, ctx) != 250) {
+            snprintf(error, error_size, "%s: did not greet", hosts[i].host);
+            close(sock);
+            continue;
+        }
+
+        snprintf(host, host_size, "%s", hosts[i].host);
+        EmailSmtpResult result = EMAIL_SMTP_UNKNOWN;
+        if (smtp_command(sock, "MAIL FROM:<>\r\n", timeout, ctx) == 250) {
+            snprintf(command, sizeof(command), "RCPT TO:<%s>\r\n", email);
+            *code = smtp_command(sock, command, timeout, ctx);
+            if (*code == 250 || *code == 251) {
+                result = EMAIL_SMTP_ACCEPTED;
+            } else if (*code >= 500 && *code < 600) {
+                result = EMAIL_SMTP_REJECTED;
+            }
+        }
+        if (result == EMAIL_SMTP_UNKNOWN) {
+            snprintf(error, error_size, "%s: answered %d", hosts[i].host, *code);
+        }
+        smtp_command(sock, "QUIT\r\n", 1, ctx);
+        close(sock);
+        return result;
+    }
+    return EMAIL_SMTP_UNKNOWN;
+}
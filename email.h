@@ -0,0 +1,84 @@
+#ifndef EMAIL_H
+#define EMAIL_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+#include "context.h"
+
+#define EMAIL_MAX_LENGTH 254        // RFC 5321's limit on a path, less the brackets
+#define EMAIL_MAX_MX 8              // Exchangers kept per domain
+
+// Why an address isn't one mail can be sent to, by its form alone
+typedef enum {
+    EMAIL_OK,
+    EMAIL_MISSING_AT,
+    EMAIL_TOO_LONG,
+    EMAIL_INVALID_LOCAL_PART,
+    EMAIL_INVALID_DOMAIN
+} EmailError;
+
+// What the DNS says about where a domain's mail goes
+typedef enum {
+    EMAIL_MX_FOUND,         // MX records, or an address the mail falls back to
+    EMAIL_MX_NONE,          // The domain doesn't exist or has nowhere to deliver
+    EMAIL_MX_NULL,          // A null MX (RFC 7505): the domain takes no mail
+    EMAIL_MX_ERROR          // The resolver didn't answer, so nobody knows
+} EmailMxResult;
+
+typedef struct {
+    char host[256];
+    int preference;
+} EmailMx;
+
+// What a mail exchanger said to RCPT TO
+typedef enum {
+    EMAIL_SMTP_ACCEPTED,
+    EMAIL_SMTP_REJECTED,
+    EMAIL_SMTP_UNKNOWN      // No answer, or a temporary failure such as greylisting
+} EmailSmtpResult;
+
+// Checks email against the dot-atom form of RFC 5322 that mail systems
+// take: no quoted local parts, comments or IP address domains, and a
+// domain of at least two labels. On EMAIL_OK domain gets the part after
+// the @, lowercased.
+EmailError email_check_syntax(const char* email, char* domain, size_t domain_size);
+
+// Looks up domain's mail exchangers, most preferred first, at most max of
+// them. Without MX records the domain itself receives mail if it has an
+// address (RFC 5321 section 5.1). timeout is in seconds per try. On
+// EMAIL_MX_ERROR, error says why.
+EmailMxResult email_lookup_mx(const char* domain, int timeout, EmailMx* hosts, int max,
+                              int* count, char* error, size_t error_size);
+
+// Asks the exchangers, in order until one answers, whether they would take
+// mail for email, without sending any: EHLO helo, MAIL FROM:<>, RCPT TO,
+// QUIT. *code gets the reply to RCPT TO, 0 if no exchanger got that far,
+// and host the exchanger that gave it. timeout is in seconds per reply.
+// Gives up once ctx is done.
+EmailSmtpResult email_smtp_callout(const Context* ctx, const EmailMx* hosts, int count,
+                                   const char* email, const char* helo, int timeout,
+                                   int* code, char* host, size_t host_size,
+                                   char* error, size_t error_size);
+
+// The SMTP client the callout is made of, also used to send notifications
+// (see notify.h). timeout is in seconds per reply; each gives up once ctx
+// is done, NULL waits it out.
+
+// Connects to port of host, trying each of its addresses. Returns a
+// non-blocking socket or -1.
+int smtp_connect(const Context* ctx, const char* host, const char* port, int timeout,
+                 char* error, size_t error_size);
+
+// Reads a reply, every line of a multi-line one, and returns its code, or
+// 0 if the server went quiet or hung up
+int smtp_read_reply(int sock, int timeout, const Context* ctx);
+
+// Sends a command and returns the code of the reply to it
+int smtp_command(int sock, const char* command, int timeout, const Context* ctx);
+
+const char* email_error_string(EmailError error);
+const char* email_mx_result_string(EmailMxResult result);
+const char* email_smtp_result_string(EmailSmtpResult result);
+
+#endif
@@ -0,0 +1,622 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <ctype.h>
+#include <stdint.h>
+
+#include "encode.h"
+
+#define ENCODING_COUNT 4
+#define ENCODE_MAX_DEPTH 32
+#define CSV_MAX_COLUMNS 256
+
+// Media types each encoding answers to, the first being the one it's sent as
+static const struct {
+    Encoding encoding;
+    const char* type;
+} media_types[] = {
+    {ENCODING_JSON, "application/json"},
+    {ENCODING_XML, "application/xml"},
+    {ENCODING_XML, "text/xml"},
+    {ENCODING_CSV, "text/csv"},
+    {ENCODING_MSGPACK, "application/msgpack"},
+    {ENCODING_MSGPACK, "application/x-msgpack"},
+};
+
+#define MEDIA_TYPE_COUNT (int)(sizeof(media_types) / sizeof(media_types[0]))
+
+static const char* content_types[ENCODING_COUNT] = {
+    "application/json",
+    "application/xml; charset=utf-8",
+    "text/csv; charset=utf-8",
+    "application/msgpack",
+};
+
+// ============= Negotiation =============
+
+// How specifically range names type: 2 exactly, 1 as type/*, 0 as */*,
+// -1 not at all
+static int range_matches(const char* range, const char* type) {
+    if (strcmp(range, "*/*") == 0) return 0;
+    size_t length = strlen(range);
+    if (length > 2 && strcmp(range + length - 2, "/*") == 0) {
+        return strncasecmp(range, type, length - 1) == 0 ? 1 : -1;
+    }
+    return strcasecmp(range, type) == 0 ? 2 : -1;
+}
+
+bool encoding_negotiate(const char* accept, Encoding* encoding) {
+    *encoding = ENCODING_JSON;
+    if (!accept || !accept[0]) return true;
+
+    // Each encoding takes the q of the most specific range naming it
+    double quality[ENCODING_COUNT] = {0};
+    int specificity[ENCODING_COUNT] = {-1, -1, -1, -1};
+    for (const char* p = accept; *p; ) {
+        size_t length = strcspn(p, ",");
+        char range[128];
+        snprintf(range, sizeof(range), "%.*s", (int)length, p);
+        p += length;
+        if (*p == ',') p++;
+
+        double q = 1;
+        char* params = strchr(range, ';');
+        if (params) {
+            *params++ = '\0';
+            char* saved;
+            for (char* param = strtok_r(params, ";", &saved); param;
+                 param = strtok_r(NULL, ";", &saved)) {
+                while (isspace((unsigned char)*param)) param++;
+                if (strncmp(param, "q=", 2) == 0) q = strtod(param + 2, NULL);
+            }
+        }
+        char* type = range;
+        while (isspace((unsigned char)*type)) type++;
+        size_t end = strlen(type);
+        while (end > 0 && isspace((unsigned char)type[end - 1])) type[--end] = '\0';
+
+        for (int i = 0; i < MEDIA_TYPE_COUNT; i++) {
+            int match = range_matches(type, media_types[i].type);
+            Encoding e = media_types[i].encoding;
+            if (match > specificity[e] || (match == specificity[e] && match >= 0 && q > quality[e])) {
+                specificity[e] = match;
+                quality[e] = q;
+            }
+        }
+    }
+
+    int best = -1;
+    for (int e = 0; e < ENCODING_COUNT; e++) {
+        if (quality[e] > 0 && (best < 0 || quality[e] > quality[best])) best = e;
+    }
+    if (best < 0) return false;
+    *encoding = (Encoding)best;
+    return true;
+}
+
+const char* encoding_content_type(Encoding encoding) {
+    return content_types[encoding];
+}
+
+const char* encoding_available(void) {
+    return "application/json, application/xml, text/csv, application/msgpack";
+}
+
+// ============= Buffers =============
+
+typedef struct {
+    char* data;
+    size_t length;
+    size_t capacity;
+} Buffer;
+
+static void buffer_append(Buffer* buffer, const void* data, size_t length) {
+    if (buffer->length + length + 1 > buffer->capacity) {
+        size_t capacity = buffer->capacity ? buffer->capacity : 256;
+        while (buffer->length + length + 1 > capacity) capacity *= 2;
+        buffer->data = realloc(buffer->data, capacity);
+        buffer->capacity = capacity;
+    }
+    memcpy(buffer->data + buffer->length, data, length);
+    buffer->length += length;
+    buffer->data[buffer->length] = '\0';
+}
+
+static void buffer_puts(Buffer* buffer, const char* text) {
+    buffer_append(buffer, text, strlen(text));
+}
+
+static void buffer_byte(Buffer* buffer, unsigned char byte) {
+    buffer_append(buffer, &byte, 1);
+}
+
+// ============= JSON Parsing =============
+
+typedef enum {
+    NODE_NULL,
+    NODE_BOOL,
+    NODE_NUMBER,
+    NODE_STRING,
+    NODE_ARRAY,
+    NODE_OBJECT
+} NodeType;
+
+typedef struct Node {
+    NodeType type;
+    char* key;              // Member name, for children of an object
+    char* text;             // Strings decoded, numbers and booleans as written
+    struct Node* children;
+    int count;
+} Node;
+
+typedef struct {
+    const char* p;
+    const char* end;
+} Parser;
+
+static void free_node(Node* node) {
+    for (int i = 0; i < node->count; i++) free_node(&node->children[i]);
+    free(node->children);
+    free(node->key);
+    free(node->text);
+}
+
+static void skip_space(Parser* parser) {
+    while (parser->p < parser->end && isspace((unsigned char)*parser->p)) parser->p++;
+}
+
+static bool read_hex4(Parser* parser, unsigned* value) {
+    if (parser->end - parser->p < 4) return false;
+    *value = 0;
+    for (int i = 0; i < 4; i++) {
+        char c = *parser->p++;
+        if (!isxdigit((unsigned char)c)) return false;
+        *value = *value * 16 + (isdigit((unsigned char)c) ? c - '0' : tolower((unsigned char)c) - 'a' + 10);
+    }
+    return true;
+}
+
+static void append_utf8(Buffer* out, unsigned code) {
+    if (code < 0x80) {
+        buffer_byte(out, code);
+    } else if (code < 0x800) {
+        buffer_byte(out, 0xC0 | code >> 6);
+        buffer_byte(out, 0x80 | (code & 0x3F));
+    } else if (code < 0x10000) {
+        buffer_byte(out, 0xE0 | code >> 12);
+        buffer_byte(out, 0x80 | (code >> 6 & 0x3F));
+        buffer_byte(out, 0x80 | (code & 0x3F));
+    } else {
+        buffer_byte(out, 0xF0 | code >> 18);
+        buffer_byte(out, 0x80 | (code >> 12 & 0x3F));
+        buffer_byte(out, 0x80 | (code >> 6 & 0x3F));
+        buffer_byte(out, 0x80 | (code & 0x3F));
+    }
+}
+
+// Reads the string at parser->p, which is past the opening quote
+static char* parse_string(Parser* parser) {
+    Buffer out = {0};
+    buffer_puts(&out, "");
+    while (parser->p < parser->end && *parser->p != '"') {
+        char c = *parser->p++;
+        if (c != '\\') {
+            buffer_byte(&out, c);
+            continue;
+        }
+        if (parser->p >= parser->end) break;
+        c = *parser->p++;
+        unsigned code;
+        switch (c) {
+            case 'n': buffer_byte(&out, '\n'); break;
+            case 't': buffer_byte(&out, '\t'); break;
+            case 'r': buffer_byte(&out, '\r'); break;
+            case 'b': buffer_byte(&out, '\b'); break;
+            case 'f': buffer_byte(&out, '\f'); break;
+            case 'u':
+                if (!read_hex4(parser, &code)) {
+                    free(out.data);
+                    return NULL;
+                }
+                // A high surrogate pairs with the \u escape after it
+                if (code >= 0xD800 && code < 0xDC00 && parser->end - parser->p >= 6 &&
+                    parser->p[0] == '\\' && parser->p[1] == 'u') {
+                    unsigned low;
+                    parser->p += 2;
+                    if (!read_hex4(parser, &low)) {
+                        free(out.data);
+                        return NULL;
+                    }
+                    code = 0x10000 + ((code - 0xD800) << 10) + (low - 0xDC00);
+                }
+                append_utf8(&out, code);
+                break;
+            default: buffer_byte(&out, c); break;
+        }
+    }
+    if (parser->p >= parser->end) {
+        free(out.data);
+        return NULL;
+    }
+    parser->p++;
+    return out.data;
+}
+
+static bool parse_value(Parser* parser, Node* node, int depth);
+
+// Parses the members of an object or the items of an array, parser->p
+// being past the opening bracket
+static bool parse_children(Parser* parser, Node* node, char close, int depth) {
+    int capacity = 0;
+    skip_space(parser);
+    if (parser->p < parser->end && *parser->p == close) {
+        parser->p++;
+        return true;
+    }
+    while (1) {
+        Node child = {0};
+        skip_space(parser);
+        if (close == '}') {
+            if (parser->p >= parser->end || *parser->p != '"') return false;
+            parser->p++;
+            child.key = parse_string(parser);
+            if (!child.key) return false;
+            skip_space(parser);
+            if (parser->p >= parser->end || *parser->p != ':') {
+                free(child.key);
+                return false;
+            }
+            parser->p++;
+        }
+        if (!parse_value(parser, &child, depth + 1)) {
+            free_node(&child);
+            return false;
+        }
+        if (node->count == capacity) {
+            capacity = capacity ? capacity * 2 : 8;
+            node->children = realloc(node->children, capacity * sizeof(Node));
+        }
+        node->children[node->count++] = child;
+
+        skip_space(parser);
+        if (parser->p >= parser->end) return false;
+        char c = *parser->p++;
+        if (c == close) return true;
+        if (c != ',') return false;
+    }
+}
+
+static bool parse_value(Parser* parser, Node* node, int depth) {
+    skip_space(parser);
+    if (parser->p >= parser->end || depth > ENCODE_MAX_DEPTH) return false;
+
+    char c = *parser->p;
+    if (c == '{' || c == '[') {
+        node->type = c == '{' ? NODE_OBJECT : NODE_ARRAY;
+        parser->p++;
+        return parse_children(parser, node, c == '{' ? '}' : ']', depth);
+    }
+    if (c == '"') {
+        node->type = NODE_STRING;
+        parser->p++;
+        node->text = parse_string(parser);
+        return node->text != NULL;
+    }
+
+    const char* start = parser->p;
+    while (parser->p < parser->end && (isalnum((unsigned char)*parser->p) ||
+           *parser->p == '-' || *parser->p == '+' || *parser->p == '.')) {
+        parser->p++;
+    }
+    size_t length = parser->p - start;
+    if (length == 4 && strncmp(start, "null", 4) == 0) {
+        node->type = NODE_NULL;
+        return true;
+    }
+    if ((length == 4 && strncmp(start, "true", 4) == 0) ||
+        (length == 5 && strncmp(start, "false", 5) == 0)) {
+        node->type = NODE_BOOL;
+    } else if (length > 0 && (isdigit((unsigned char)*start) || *start == '-')) {
+        node->type = NODE_NUMBER;
+    } else {
+        return false;
+    }
+    node->text = strndup(start, length);
+    return true;
+}
+
+static bool is_scalar(const Node* node) {
+    return node->type != NODE_ARRAY && node->type != NODE_OBJECT;
+}
+
+// ============= XML =============
+
+// Keys become element names, so anything XML doesn't allow in a name is
+// replaced with _
+static void xml_name(Buffer* out, const char* key) {
+    if (!isalpha((unsigned char)key[0]) && key[0] != '_') buffer_byte(out, '_');
+    for (const char* p = key; *p; p++) {
+        bool allowed = isalnum((unsigned char)*p) || *p == '_' || *p == '-' || *p == '.';
+        buffer_byte(out, allowed ? *p : '_');
+    }
+}
+
+static void xml_text(Buffer* out, const char* text) {
+    for (const char* p = text; *p; p++) {
+        switch (*p) {
+            case '&': buffer_puts(out, "&amp;"); break;
+            case '<': buffer_puts(out, "&lt;"); break;
+            case '>': buffer_puts(out, "&gt;"); break;
+            case '"': buffer_puts(out, "&quot;"); break;
+            default:
+                // Control characters other than tab and newlines aren't
+                // allowed in XML 1.0 at all
+                if ((unsigned char)*p >= 0x20 || *p == '\t' || *p == '\n' || *p == '\r') {
+                    buffer_byte(out, *p);
+                }
+                break;
+        }
+    }
+}
+
+static void write_xml(Buffer* out, const Node* node, const char* name, int depth) {
+    for (int i = 0; i < depth; i++) buffer_puts(out, "  ");
+    buffer_byte(out, '<');
+    xml_name(out, name);
+    if (node->type == NODE_NULL || (!is_scalar(node) && node->count == 0)) {
+        buffer_puts(out, "/>\n");
+        return;
+    }
+    buffer_byte(out, '>');
+
+    if (is_scalar(node)) {
+        xml_text(out, node->text);
+    } else {
+        buffer_byte(out, '\n');
+        for (int i = 0; i < node->count; i++) {
+            const Node* child = &node->children[i];
+            write_xml(out, child, node->type == NODE_OBJECT ? child->key : "item", depth + 1);
+        }
+        for (int i = 0; i < depth; i++) buffer_puts(out, "  ");
+    }
+    buffer_puts(out, "</");
+    xml_name(out, name);
+    buffer_puts(out, ">\n");
+}
+
+// ============= CSV =============
+
+typedef struct {
+    char* name;
+    char* value;
+} Cell;
+
+typedef struct {
+    Cell* cells;
+    int count;
+    int capacity;
+} Cells;
+
+static void add_cell(Cells* cells, const char* name, const char* value) {
+    if (cells->count == cells->capacity) {
+        cells->capacity = cells->capacity ? cells->capacity * 2 : 16;
+        cells->cells = realloc(cells->cells, cells->capacity * sizeof(Cell));
+    }
+    cells->cells[cells->count].name = strdup(name[0] ? name : "value");
+    cells->cells[cells->count].value = strdup(value);
+    cells->count++;
+}
+
+static void free_cells(Cells* cells) {
+    for (int i = 0; i < cells->count; i++) {
+        free(cells->cells[i].name);
+        free(cells->cells[i].value);
+    }
+    free(cells->cells);
+}
+
+// One cell per scalar under node, named by the keys (or array indexes)
+// leading to it joined with dots. Arrays of scalars go in one cell, the
+// values separated by semicolons.
+static void flatten(const Node* node, const char* prefix, Cells* cells) {
+    if (is_scalar(node)) {
+        add_cell(cells, prefix, node->text ? node->text : "");
+        return;
+    }
+
+    bool scalars = node->type == NODE_ARRAY;
+    for (int i = 0; i < node->count && scalars; i++) scalars = is_scalar(&node->children[i]);
+    if (scalars) {
+        Buffer joined = {0};
+        buffer_puts(&joined, "");
+        for (int i = 0; i < node->count; i++) {
+            if (i > 0) buffer_byte(&joined, ';');
+            if (node->children[i].text) buffer_puts(&joined, node->children[i].text);
+        }
+        add_cell(cells, prefix, joined.data);
+        free(joined.data);
+        return;
+    }
+
+    for (int i = 0; i < node->count; i++) {
+        const Node* child = &node->children[i];
+        char name[512];
+        char index[16];
+        snprintf(index, sizeof(index), "%d", i);
+        const char* part = node->type == NODE_OBJECT ? child->key : index;
+        snprintf(name, sizeof(name), "%s%s%s", prefix, prefix[0] ? "." : "", part);
+        flatten(child, name, cells);
+    }
+}
+
+static void csv_value(Buffer* out, const char* value) {
+    if (!value[strcspn(value, ",\"\r\n")]) {
+        buffer_puts(out, value);
+        return;
+    }
+    buffer_byte(out, '"');
+    for (const char* p = value; *p; p++) {
+        if (*p == '"') buffer_byte(out, '"');
+        buffer_byte(out, *p);
+    }
+    buffer_byte(out, '"');
+}
+
+static bool is_table(const Node* node) {
+    if (node->type != NODE_ARRAY || node->count == 0) return false;
+    for (int i = 0; i < node->count; i++) {
+        if (node->children[i].type != NODE_OBJECT) return false;
+    }
+    return true;
+}
+
+static void write_csv(Buffer* out, const Node* root) {
+    // The rows: a list of objects, or else the whole value as one row
+    const Node* rows = root;
+    int row_count = 1;
+    if (root->type == NODE_ARRAY) {
+        rows = root->children;
+        row_count = root->count;
+    } else {
+        for (int i = 0; root->type == NODE_OBJECT && i < root->count; i++) {
+            if (is_table(&root->children[i])) {
+                rows = root->children[i].children;
+                row_count = root->children[i].count;
+                break;
+            }
+        }
+    }
+
+    Cells* flattened = calloc(row_count > 0 ? row_count : 1, sizeof(Cells));
+    const char* columns[CSV_MAX_COLUMNS];
+    int column_count = 0;
+    for (int r = 0; r < row_count; r++) {
+        flatten(&rows[r], "", &flattened[r]);
+        for (int c = 0; c < flattened[r].count; c++) {
+            const char* name = flattened[r].cells[c].name;
+            int j = 0;
+            while (j < column_count && strcmp(columns[j], name) != 0) j++;
+            if (j == column_count && column_count < CSV_MAX_COLUMNS) columns[column_count++] = name;
+        }
+    }
+
+    for (int j = 0; j < column_count; j++) {
+        if (j > 0) buffer_byte(out, ',');
+        csv_value(out, columns[j]);
+    }
+    if (column_count > 0) buffer_puts(out, "\r\n");
+    for (int r = 0; r < row_count; r++) {
+        for (int j = 0; j < column_count; j++) {
+            if (j > 0) buffer_byte(out, ',');
+            for (int c = 0; c < flattened[r].count; c++) {
+                if (strcmp(flattened[r].cells[c].name, columns[j]) == 0) {
+                    csv_value(out, flattened[r].cells[c].value);
+                    break;
+                }
+            }
+        }
+        buffer_puts(out, "\r\n");
+    }
+
+    for (int r = 0; r < row_count; r++) free_cells(&flattened[r]);
+    free(flattened);
+}
+
+// ============= MessagePack =============
+
+static void msgpack_length(Buffer* out, size_t length, unsigned char fix, size_t fix_max,
+                           unsigned char type8, unsigned char type16, unsigned char type32) {
+    if (length <= fix_max) {
+        buffer_byte(out, fix | length);
+    } else if (type8 && length <= 0xFF) {
+        buffer_byte(out, type8);
+        buffer_byte(out, length);
+    } else if (length <= 0xFFFF) {
+        buffer_byte(out, type16);
+        buffer_byte(out, length >> 8);
+        buffer_byte(out, length);
+    } else {
+        buffer_byte(out, type32);
+        for (int shift = 24; shift >= 0; shift -= 8) buffer_byte(out, length >> shift);
+    }
+}
+
+static void msgpack_string(Buffer* out, const char* text) {
+    size_t length = strlen(text);
+    msgpack_length(out, length, 0xA0, 31, 0xD9, 0xDA, 0xDB);
+    buffer_append(out, text, length);
+}
+
+static void msgpack_number(Buffer* out, const char* text) {
+    char* end;
+    bool integer = !text[strcspn(text, ".eE")];
+    long long value = integer ? strtoll(text, &end, 10) : 0;
+    if (integer && !*end) {
+        if (value >= 0 && value <= 0x7F) {
+            buffer_byte(out, value);
+        } else if (value < 0 && value >= -32) {
+            buffer_byte(out, (unsigned char)(int8_t)value);
+        } else {
+            // int64 covers the rest; MessagePack readers widen it as needed
+            buffer_byte(out, 0xD3);
+            for (int shift = 56; shift >= 0; shift -= 8) buffer_byte(out, (uint64_t)value >> shift);
+        }
+        return;
+    }
+    double real = strtod(text, NULL);
+    uint64_t bits;
+    memcpy(&bits, &real, sizeof(bits));
+    buffer_byte(out, 0xCB);
+    for (int shift = 56; shift >= 0; shift -= 8) buffer_byte(out, bits >> shift);
+}
+
+static void write_msgpack(Buffer* out, const Node* node) {
+    switch (node->type) {
+        case NODE_NULL: buffer_byte(out, 0xC0); break;
+        case NODE_BOOL: buffer_byte(out, node->text[0] == 't' ? 0xC3 : 0xC2); break;
+        case NODE_NUMBER: msgpack_number(out, node->text); break;
+        case NODE_STRING: msgpack_string(out, node->text); break;
+        case NODE_ARRAY:
+            msgpack_length(out, node->count, 0x90, 15, 0, 0xDC, 0xDD);
+            for (int i = 0; i < node->count; i++) write_msgpack(out, &node->children[i]);
+            break;
+        case NODE_OBJECT:
+            msgpack_length(out, node->count, 0x80, 15, 0, 0xDE, 0xDF);
+            for (int i = 0; i < node->count; i++) {
+                msgpack_string(out, node->children[i].key);
+                write_msgpack(out, &node->children[i]);
+            }
+            break;
+    }
+}
+
+// ============= Encoding =============
+
+char* encode_json(const char* json, size_t json_length, Encoding encoding, size_t* length) {
+    Parser parser = {json, json + json_length};
+    Node root = {0};
+    bool parsed = parse_value(&parser, &root, 0);
+    skip_space(&parser);
+    if (!parsed || parser.p != parser.end) {
+        free_node(&root);
+        return NULL;
+    }
+
+    Buffer out = {0};
+    buffer_puts(&out, "");
+    switch (encoding) {
+        case ENCODING_JSON: buffer_append(&out, json, json_length); break;
+        case ENCODING_XML:
+            buffer_puts(&out, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n");
+            write_xml(&out, &root, "response", 0);
+            break;
+        case ENCODING_CSV: write_csv(&out, &root); break;
+        case ENCODING_MSGPACK: write_msgpack(&out, &root); break;
+    }
+    free_node(&root);
+    *length = out.length;
+    return out.data;
+}
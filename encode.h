@@ -0,0 +1,37 @@
+#ifndef ENCODE_H
+#define ENCODE_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+// Other encodings of the JSON that handlers produce, for clients that ask
+// for them in Accept. The JSON is parsed and written out again, so
+// handlers don't need to know about any of them.
+
+typedef enum {
+    ENCODING_JSON,
+    ENCODING_XML,
+    ENCODING_CSV,
+    ENCODING_MSGPACK
+} Encoding;
+
+// Picks the encoding an Accept header rates highest, taking JSON when it
+// ties. A missing or empty header means JSON. Returns false if none of
+// them is acceptable.
+bool encoding_negotiate(const char* accept, Encoding* encoding);
+
+const char* encoding_content_type(Encoding encoding);
+
+// "application/json, application/xml, ..." for telling a client what it
+// could have asked for
+const char* encoding_available(void);
+
+// Re-encodes json. Objects become XML elements named after their keys
+// (array items are <item>), MessagePack maps, or CSV columns: a top level
+// array of objects, or the first one found in the top level object, gives
+// one row per object, anything else a single row. Nested keys are joined
+// with dots. Returns a heap buffer of *length bytes, NUL terminated, or
+// NULL if json doesn't parse.
+char* encode_json(const char* json, size_t json_length, Encoding encoding, size_t* length);
+
+#endif
@@ -0,0 +1,285 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <ctype.h>
+
+#ifdef HAVE_LIBCRYPTO
+#include <openssl/crypto.h>
+#include <openssl/evp.h>
+#include <openssl/hmac.h>
+#include <openssl/rand.h>
+#endif
+
+#include "encryption.h"
+
+#define KEYRING_MAX_KEYS 8
+#define KEY_SIZE 32             // AES-256
+#define NONCE_SIZE 12
+#define TAG_SIZE 16
+
+bool is_sealed(const char* value) {
+    return strncmp(value, SEALED_PREFIX, strlen(SEALED_PREFIX)) == 0;
+}
+
+#ifdef HAVE_LIBCRYPTO
+typedef struct {
+    char id[KEY_ID_LENGTH + 1];
+    unsigned char key[KEY_SIZE];
+    unsigned char index_key[KEY_SIZE];  // Derived from key, for blind indexes
+} Key;
+
+// What a key's blind index key is derived with, so that the key itself is
+// only ever used for AES-GCM
+#define INDEX_KEY_LABEL "phoneval blind index"
+
+struct Keyring {
+    Key keys[KEYRING_MAX_KEYS];     // The first seals
+    int count;
+};
+
+Keyring* keyring_create(char* error, size_t error_size) {
+    return calloc(1, sizeof(Keyring));
+}
+
+void keyring_free(Keyring* keyring) {
+    if (!keyring) return;
+    OPENSSL_cleanse(keyring, sizeof(*keyring));
+    free(keyring);
+}
+
+static int hex_digit(char c) {
+    if (c >= '0' && c <= '9') return c - '0';
+    if (c >= 'a' && c <= 'f') return c - 'a' + 10;
+    if (c >= 'A' && c <= 'F') return c - 'A' + 10;
+    return -1;
+}
+
+bool keyring_add(Keyring* keyring, const char* key, char* error, size_t error_size) {
+    // Nothing of the key itself goes in error, which may be logged
+    const char* colon = strchr(key, ':');
+    size_t id_length = colon ? (size_t)(colon - key) : 0;
+    if (id_length == 0 || id_length > KEY_ID_LENGTH || strlen(colon + 1) != KEY_SIZE * 2) {
+        snprintf(error, error_size, "expected an id of 1-%d characters, \":\" and %d hex digits",
+                 KEY_ID_LENGTH, KEY_SIZE * 2);
+        return false;
+    }
+    if (keyring->count == KEYRING_MAX_KEYS) {
+        snprintf(error, error_size, "more than %d keys", KEYRING_MAX_KEYS);
+        return false;
+    }
+    Key* added = &keyring->keys[keyring->count];
+    memcpy(added->id, key, id_length);
+    added->id[id_length] = '\0';
+    for (size_t i = 0; i < id_length; i++) {
+        unsigned char c = (unsigned char)key[i];
+        if (!isalnum(c) && c != '-' && c != '_') {
+            snprintf(error, error_size, "key ids may only hold letters, digits, - and _");
+            return false;
+        }
+    }
+    for (int i = 0; i < keyring->count; i++) {
+        if (strcmp(keyring->keys[i].id, added->id) == 0) {
+            snprintf(error, error_size, "key id \"%s\" is used twice", added->id);
+            return false;
+        }
+    }
+    for (int i = 0; i < KEY_SIZE; i++) {
+        int high = hex_digit(colon[1 + i * 2]);
+        int low = hex_digit(colon[2 + i * 2]);
+        if (high < 0 || low < 0) {
+            OPENSSL_cleanse(added->key, sizeof(added->key));
+            snprintf(error, error_size, "key \"%s\" isn't all hex digits", added->id);
+            return false;
+        }
+        added->key[i] = (unsigned char)(high << 4 | low);
+    }
+    if (!HMAC(EVP_sha256(), added->key, KEY_SIZE, (const unsigned char*)INDEX_KEY_LABEL,
+              strlen(INDEX_KEY_LABEL), added->index_key, NULL)) {
+        snprintf(error, error_size, "cannot derive key \"%s\"'s index key", added->id);
+        OPENSSL_cleanse(added, sizeof(*added));
+        return false;
+    }
+    keyring->count++;
+    return true;
+}
+
+const char* keyring_current(const Keyring* keyring) {
+    return keyring->count > 0 ? keyring->keys[0].id : "";
+}
+
+int keyring_count(const Keyring* keyring) {
+    return keyring->count;
+}
+
+bool keyring_blind_index(const Keyring* keyring, int key, const char* field, const char* value,
+                         char* out, size_t out_size) {
+    if (key < 0 || key >= keyring->count || out_size < BLIND_INDEX_LENGTH + 1) return false;
+    const Key* index_key = &keyring->keys[key];
+
+    // The field and value, a newline between them so that neither can
+    // run into the other
+    size_t field_length = strlen(field);
+    size_t value_length = strlen(value);
+    unsigned char* data = malloc(field_length + 1 + value_length);
+    memcpy(data, field, field_length);
+    data[field_length] = '\n';
+    memcpy(data + field_length + 1, value, value_length);
+    unsigned char digest[32];
+    bool ok = HMAC(EVP_sha256(), index_key->index_key, KEY_SIZE, data,
+                   field_length + 1 + value_length, digest, NULL) != NULL;
+    OPENSSL_cleanse(data, field_length + 1 + value_length);
+    free(data);
+    if (!ok) return false;
+
+    int length = snprintf(out, out_size, "%s:", index_key->id);
+    for (int i = 0; i < 32; i++) {
+        length += snprintf(out + length, out_size - length, "%02x", digest[i]);
+    }
+    return true;
+}
+
+bool keyring_seal(const Keyring* keyring, const char* field, const char* value, char* out,
+                  size_t out_size) {
+    size_t length = strlen(value);
+    if (keyring->count == 0 || out_size < SEALED_LENGTH(length) + 1) return false;
+    const Key* key = &keyring->keys[0];
+
+    unsigned char* sealed = malloc(NONCE_SIZE + length + TAG_SIZE);
+    bool ok = RAND_bytes(sealed, NONCE_SIZE) == 1;
+    EVP_CIPHER_CTX* cipher = EVP_CIPHER_CTX_new();
+    int written = 0;
+    int final = 0;
+    ok = ok && cipher &&
+         EVP_EncryptInit_ex(cipher, EVP_aes_256_gcm(), NULL, key->key, sealed) == 1 &&
+         EVP_EncryptUpdate(cipher, NULL, &written, (const unsigned char*)field,
+                           (int)strlen(field)) == 1 &&
+         EVP_EncryptUpdate(cipher, sealed + NONCE_SIZE, &written, (const unsigned char*)value,
+                           (int)length) == 1 &&
+         EVP_EncryptFinal_ex(cipher, sealed + NONCE_SIZE + written, &final) == 1 &&
+         EVP_CIPHER_CTX_ctrl(cipher, EVP_CTRL_GCM_GET_TAG, TAG_SIZE,
+                             sealed + NONCE_SIZE + length) == 1;
+    EVP_CIPHER_CTX_free(cipher);
+
+    if (ok) {
+        int prefix = snprintf(out, out_size, SEALED_PREFIX "%s:", key->id);
+        EVP_EncodeBlock((unsigned char*)out + prefix, sealed, (int)(NONCE_SIZE + length + TAG_SIZE));
+    }
+    free(sealed);
+    return ok;
+}
+
+// The key value was sealed under, or NULL
+static const Key* sealing_key(const Keyring* keyring, const char* value, const char** data) {
+    const char* id = value + strlen(SEALED_PREFIX);
+    const char* colon = strchr(id, ':');
+    if (!colon) return NULL;
+    for (int i = 0; i < keyring->count; i++) {
+        const Key* key = &keyring->keys[i];
+        if (strlen(key->id) == (size_t)(colon - id) && strncmp(key->id, id, colon - id) == 0) {
+            *data = colon + 1;
+            return key;
+        }
+    }
+    return NULL;
+}
+
+bool keyring_open(const Keyring* keyring, const char* field, const char* value, char* out,
+                  size_t out_size, char* error, size_t error_size) {
+    if (!is_sealed(value)) {
+        if (strlen(value) >= out_size) {
+            snprintf(error, error_size, "value too long");
+            return false;
+        }
+        snprintf(out, out_size, "%s", value);
+        return true;
+    }
+    const char* data;
+    const Key* key = sealing_key(keyring, value, &data);
+    if (!key) {
+        snprintf(error, error_size, "sealed with a key that isn't in encryption_keys");
+        return false;
+    }
+
+    size_t encoded = strlen(data);
+    unsigned char* sealed = malloc(encoded / 4 * 3 + 3);
+    int decoded = encoded % 4 == 0 ? EVP_DecodeBlock(sealed, (const unsigned char*)data, (int)encoded)
+                                   : -1;
+    // EVP_DecodeBlock counts the padding as data
+    for (size_t i = encoded; decoded > 0 && i > 0 && data[i - 1] == '='; i--) decoded--;
+    int length = decoded - NONCE_SIZE - TAG_SIZE;
+    if (length < 0 || (size_t)length >= out_size) {
+        free(sealed);
+        snprintf(error, error_size, "malformed sealed value");
+        return false;
+    }
+
+    EVP_CIPHER_CTX* cipher = EVP_CIPHER_CTX_new();
+    int written = 0;
+    int final = 0;
+    bool ok = cipher &&
+              EVP_DecryptInit_ex(cipher, EVP_aes_256_gcm(), NULL, key->key, sealed) == 1 &&
+              EVP_DecryptUpdate(cipher, NULL, &written, (const unsigned char*)field,
+                                (int)strlen(field)) == 1 &&
+              EVP_DecryptUpdate(cipher, (unsigned char*)out, &written, sealed + NONCE_SIZE,
+                                length) == 1 &&
+              EVP_CIPHER_CTX_ctrl(cipher, EVP_CTRL_GCM_SET_TAG, TAG_SIZE,
+                                  sealed + NONCE_SIZE + length) == 1 &&
+              EVP_DecryptFinal_ex(cipher, (unsigned char*)out + written, &final) == 1;
+    EVP_CIPHER_CTX_free(cipher);
+    free(sealed);
+    if (!ok) {
+        OPENSSL_cleanse(out, length);
+        out[0] = '\0';
+        snprintf(error, error_size, "sealed value doesn't authenticate");
+        return false;
+    }
+    out[length] = '\0';
+    return true;
+}
+
+bool is_sealed_current(const Keyring* keyring, const char* value) {
+    const char* data;
+    return is_sealed(value) && keyring->count > 0 &&
+           sealing_key(keyring, value, &data) == &keyring->keys[0];
+}
+#else
+Keyring* keyring_create(char* error, size_t error_size) {
+    snprintf(error, error_size, "built without encryption support (make WITH_ENCRYPTION=1)");
+    return NULL;
+}
+
+void keyring_free(Keyring* keyring) {
+}
+
+bool keyring_add(Keyring* keyring, const char* key, char* error, size_t error_size) {
+    return false;
+}
+
+const char* keyring_current(const Keyring* keyring) {
+    return "";
+}
+
+int keyring_count(const Keyring* keyring) {
+    return 0;
+}
+
+bool keyring_blind_index(const Keyring* keyring, int key, const char* field, const char* value,
+                         char* out, size_t out_size) {
+    return false;
+}
+
+bool keyring_seal(const Keyring* keyring, const char* field, const char* value, char* out,
+                  size_t out_size) {
+    return false;
+}
+
+bool keyring_open(const Keyring* keyring, const char* field, const char* value, char* out,
+                  size_t out_size, char* error, size_t error_size) {
+    snprintf(error, error_size, "built without encryption support (make WITH_ENCRYPTION=1)");
+    return false;
+}
+
+bool is_sealed_current(const Keyring* keyring, const char* value) {
+    return false;
+}
+#endif
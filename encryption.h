@@ -0,0 +1,65 @@
+#ifndef ENCRYPTION_H
+#define ENCRYPTION_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+// Field encryption for personal data kept at rest, with AES-256-GCM. A
+// value is sealed under the keyring's current key as "enc:", the key's
+// id, ":" and the base64 of a random nonce, the ciphertext and its tag.
+// The field it is sealed as, which names the value and whose it is, e.g.
+// "email:42", is authenticated with it, so a sealed email can't be passed
+// off as a phone or as another user's email. Keys that were current before
+// stay in the keyring to open what they sealed. Safe to share between
+// threads once every key is added.
+typedef struct Keyring Keyring;
+
+#define KEY_ID_LENGTH 16
+#define SEALED_PREFIX "enc:"
+
+// Characters in a blind index, see keyring_blind_index()
+#define BLIND_INDEX_LENGTH (KEY_ID_LENGTH + 1 + 64)
+
+// Most characters sealing a value of length characters takes
+#define SEALED_LENGTH(length) \
+    (sizeof(SEALED_PREFIX) - 1 + KEY_ID_LENGTH + 1 + (12 + (length) + 16 + 2) / 3 * 4)
+
+// Returns NULL with error set when built without encryption support
+Keyring* keyring_create(char* error, size_t error_size);
+void keyring_free(Keyring* keyring);
+
+// Adds a key given as its id, ":" and 64 hex digits (32 bytes), e.g. from
+// openssl rand -hex 32. The first key added seals; the rest only open.
+bool keyring_add(Keyring* keyring, const char* key, char* error, size_t error_size);
+
+// Id of the key that seals
+const char* keyring_current(const Keyring* keyring);
+
+// Keys added, the one that seals first
+int keyring_count(const Keyring* keyring);
+
+// Seals value, part of field, into out. False if out is too small.
+bool keyring_seal(const Keyring* keyring, const char* field, const char* value, char* out,
+                  size_t out_size);
+
+// Opens a sealed value of field into out. A value that isn't sealed, such
+// as one stored before encryption was turned on, is copied as it is.
+// False with error set if its key isn't in the keyring or it was altered.
+bool keyring_open(const Keyring* keyring, const char* field, const char* value, char* out,
+                  size_t out_size, char* error, size_t error_size);
+
+// Writes the blind index of value, part of field, under the keyring's
+// key-th key: the key's id, ":" and the hex HMAC-SHA256 of field and value
+// under a key derived from it. Equal values get equal indexes, so a store
+// can find a sealed value without opening every one, and without the key
+// an index gives away nothing but that equality. False if there's no such
+// key or out is too small.
+bool keyring_blind_index(const Keyring* keyring, int key, const char* field, const char* value,
+                         char* out, size_t out_size);
+
+bool is_sealed(const char* value);
+
+// Whether value is sealed under the current key
+bool is_sealed_current(const Keyring* keyring, const char* value);
+
+#endif
@@ -0,0 +1,453 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <stdint.h>
+#include <sys/types.h>
+#include <sys/socket.h>
+#include <poll.h>
+
+#ifdef HAVE_GRPC
+#include <nghttp2/nghttp2.h>
+#endif
+
+#include "grpc.h"
+
+#ifdef HAVE_GRPC
+#define GRPC_MAX_METADATA 16
+#define GRPC_MAX_STREAMS 100
+#define GRPC_SEND_BUFFER 65536      // Unsent bytes a call may pile up before grpc_send waits
+#define GRPC_FLOW_TIMEOUT 30        // Seconds to wait for a client to make room
+#define GRPC_IDLE_TIMEOUT 300       // Seconds without calls before a connection is closed
+
+typedef struct GrpcConnection GrpcConnection;
+
+struct GrpcCall {
+    int32_t id;
+    GrpcConnection* connection;
+    char path[128];
+    char metadata[GRPC_MAX_METADATA][2][256];   // Name, value
+    int metadata_count;
+
+    unsigned char* request;     // Framed, as received
+    size_t request_length;
+    bool too_large;
+    bool received;              // The client has sent everything
+    bool started;               // Handed to the handler
+    bool running;
+    bool closed;                // Stream gone, free once the handler returns
+
+    unsigned char* out;         // Framed messages not yet taken by nghttp2
+    size_t out_offset;
+    size_t out_length;
+    size_t out_capacity;
+    bool responded;             // Response headers submitted
+    bool finished;              // No more messages, trailers go after out
+
+    GrpcStatus status;
+    char message[256];
+    struct GrpcCall* next;
+};
+
+struct GrpcConnection {
+    int sock;
+    nghttp2_session* session;
+    GrpcHandler handler;
+    void* context;
+    bool broken;
+    GrpcCall* calls;
+};
+
+static void free_call(GrpcCall* call) {
+    free(call->request);
+    free(call->out);
+    free(call);
+}
+
+static void unlink_call(GrpcConnection* connection, GrpcCall* call) {
+    for (GrpcCall** link = &connection->calls; *link; link = &(*link)->next) {
+        if (*link == call) {
+            *link = call->next;
+            return;
+        }
+    }
+}
+
+// grpc-message is percent-encoded, leaving printable ASCII other than %
+static void percent_encode(const char* text, char* out, size_t out_size) {
+    static const char hex[] = "0123456789ABCDEF";
+    size_t o = 0;
+    for (const unsigned char* p = (const unsigned char*)text; *p && o + 4 <= out_size; p++) {
+        if (*p >= 0x20 && *p <= 0x7E && *p != '%') {
+            out[o++] = *p;
+        } else {
+            out[o++] = '%';
+            out[o++] = hex[*p >> 4];
+            out[o++] = hex[*p & 15];
+        }
+    }
+    out[o] = '\0';
+}
+
+// ============= nghttp2 Callbacks =============
+
+static ssize_t send_callback(nghttp2_session* session, const uint8_t* data, size_t length,
+                             int flags, void* user_data) {
+    GrpcConnection* connection = user_data;
+    size_t sent = 0;
+    while (sent < length) {
+        ssize_t n = send(connection->sock, data + sent, length - sent, 0);
+        if (n <= 0) {
+            connection->broken = true;
+            return NGHTTP2_ERR_CALLBACK_FAILURE;
+        }
+        sent += n;
+    }
+    return length;
+}
+
+static int on_begin_headers(nghttp2_session* session, const nghttp2_frame* frame,
+                            void* user_data) {
+    GrpcConnection* connection = user_data;
+    if (frame->hd.type != NGHTTP2_HEADERS || frame->headers.cat != NGHTTP2_HCAT_REQUEST) {
+        return 0;
+    }
+    GrpcCall* call = calloc(1, sizeof(GrpcCall));
+    call->id = frame->hd.stream_id;
+    call->connection = connection;
+    call->next = connection->calls;
+    connection->calls = call;
+    nghttp2_session_set_stream_user_data(session, call->id, call);
+    return 0;
+}
+
+static int on_header(nghttp2_session* session, const nghttp2_frame* frame,
+                     const uint8_t* name, size_t name_length,
+                     const uint8_t* value, size_t value_length,
+                     uint8_t flags, void* user_data) {
+    GrpcCall* call = nghttp2_session_get_stream_user_data(session, frame->hd.stream_id);
+    if (!call) return 0;
+
+    if (name_length == 5 && memcmp(name, ":path", 5) == 0) {
+        snprintf(call->path, sizeof(call->path), "%.*s", (int)value_length, value);
+    } else if (name[0] != ':' && call->metadata_count < GRPC_MAX_METADATA) {
+        char (*entry)[256] = call->metadata[call->metadata_count++];
+        snprintf(entry[0], sizeof(entry[0]), "%.*s", (int)name_length, name);
+        snprintf(entry[1], sizeof(entry[1]), "%.*s", (int)value_length, value);
+    }
+    return 0;
+}
+
+static int on_data_chunk(nghttp2_session* session, uint8_t flags, int32_t stream_id,
+                         const uint8_t* data, size_t length, void* user_data) {
+    GrpcCall* call = nghttp2_session_get_stream_user_data(session, stream_id);
+    if (!call || call->too_large) return 0;
+
+    // Room for the 5 byte frame prefix on top of the message
+    if (call->request_length + length > GRPC_MAX_MESSAGE + 5) {
+        call->too_large = true;
+        free(call->request);
+        call->request = NULL;
+        call->request_length = 0;
+        return 0;
+    }
+    call->request = realloc(call->request, call->request_length + length);
+    memcpy(call->request + call->request_length, data, length);
+    call->request_length += length;
+    return 0;
+}
+
+static int on_frame_recv(nghttp2_session* session, const nghttp2_frame* frame, void* user_data) {
+    if ((frame->hd.type == NGHTTP2_HEADERS || frame->hd.type == NGHTTP2_DATA) &&
+        (frame->hd.flags & NGHTTP2_FLAG_END_STREAM)) {
+        GrpcCall* call = nghttp2_session_get_stream_user_data(session, frame->hd.stream_id);
+        if (call) call->received = true;
+    }
+    return 0;
+}
+
+static int on_stream_close(nghttp2_session* session, int32_t stream_id, uint32_t error_code,
+                           void* user_data) {
+    GrpcConnection* connection = user_data;
+    GrpcCall* call = nghttp2_session_get_stream_user_data(session, stream_id);
+    if (!call) return 0;
+
+    call->closed = true;
+    if (!call->running) {
+        unlink_call(connection, call);
+        free_call(call);
+    }
+    return 0;
+}
+
+// Hands nghttp2 the queued messages, then the trailers once the call is done
+static ssize_t read_response(nghttp2_session* session, int32_t stream_id, uint8_t* buffer,
+                             size_t length, uint32_t* flags, nghttp2_data_source* source,
+                             void* user_data) {
+    GrpcCall* call = source->ptr;
+    size_t available = call->out_length - call->out_offset;
+    if (available == 0) {
+        if (!call->finished) return NGHTTP2_ERR_DEFERRED;
+
+        char status[16];
+        char message[sizeof(call->message) * 3];
+        snprintf(status, sizeof(status), "%d", call->status);
+        percent_encode(call->message, message, sizeof(message));
+        nghttp2_nv trailers[] = {
+            {(uint8_t*)"grpc-status", (uint8_t*)status, 11, strlen(status), NGHTTP2_NV_FLAG_NONE},
+            {(uint8_t*)"grpc-message", (uint8_t*)message, 12, strlen(message), NGHTTP2_NV_FLAG_NONE}
+        };
+        *flags |= NGHTTP2_DATA_FLAG_EOF | NGHTTP2_DATA_FLAG_NO_END_STREAM;
+        nghttp2_submit_trailer(session, stream_id, trailers, message[0] ? 2 : 1);
+        return 0;
+    }
+
+    size_t n = available < length ? available : length;
+    memcpy(buffer, call->out + call->out_offset, n);
+    call->out_offset += n;
+    if (call->out_offset == call->out_length) {
+        call->out_offset = call->out_length = 0;
+    }
+    return n;
+}
+
+// ============= Calls =============
+
+static void submit_response(GrpcCall* call) {
+    nghttp2_nv headers[] = {
+        {(uint8_t*)":status", (uint8_t*)"200", 7, 3, NGHTTP2_NV_FLAG_NONE},
+        {(uint8_t*)"content-type", (uint8_t*)"application/grpc", 12, 16, NGHTTP2_NV_FLAG_NONE}
+    };
+    nghttp2_data_provider provider;
+    provider.source.ptr = call;
+    provider.read_callback = read_response;
+    nghttp2_submit_response(call->connection->session, call->id, headers, 2, &provider);
+    call->responded = true;
+}
+
+static bool flush(GrpcConnection* connection) {
+    if (!connection->broken && nghttp2_session_send(connection->session) != 0) {
+        connection->broken = true;
+    }
+    return !connection->broken;
+}
+
+static bool receive(GrpcConnection* connection) {
+    uint8_t buffer[16384];
+    ssize_t n = recv(connection->sock, buffer, sizeof(buffer), 0);
+    if (n <= 0 || nghttp2_session_mem_recv(connection->session, buffer, n) < 0) {
+        connection->broken = true;
+    }
+    return !connection->broken;
+}
+
+static bool wait_readable(int sock, int seconds) {
+    struct pollfd readable = {sock, POLLIN, 0};
+    return poll(&readable, 1, seconds * 1000) > 0;
+}
+
+const char* grpc_call_path(const GrpcCall* call) {
+    return call->path;
+}
+
+const char* grpc_call_metadata(const GrpcCall* call, const char* name) {
+    for (int i = 0; i < call->metadata_count; i++) {
+        if (strcmp(call->metadata[i][0], name) == 0) return call->metadata[i][1];
+    }
+    return NULL;
+}
+
+void* grpc_call_context(const GrpcCall* call) {
+    return call->connection->context;
+}
+
+void grpc_set_status(GrpcCall* call, GrpcStatus status, const char* message) {
+    call->status = status;
+    snprintf(call->message, sizeof(call->message), "%s", message ? message : "");
+}
+
+GrpcStatus grpc_call_status(const GrpcCall* call) {
+    return call->status;
+}
+
+bool grpc_send(GrpcCall* call, const unsigned char* message, size_t length) {
+    GrpcConnection* connection = call->connection;
+    if (call->closed || connection->broken) return false;
+
+    // Each message goes out behind an uncompressed flag and its length
+    size_t needed = call->out_length + 5 + length;
+    if (needed > call->out_capacity) {
+        call->out_capacity = needed > call->out_capacity * 2 ? needed : call->out_capacity * 2;
+        call->out = realloc(call->out, call->out_capacity);
+    }
+    unsigned char* prefix = call->out + call->out_length;
+    prefix[0] = 0;
+    prefix[1] = (unsigned char)(length >> 24);
+    prefix[2] = (unsigned char)(length >> 16);
+    prefix[3] = (unsigned char)(length >> 8);
+    prefix[4] = (unsigned char)length;
+    memcpy(prefix + 5, message, length);
+    call->out_length = needed;
+
+    if (!call->responded) {
+        submit_response(call);
+    } else {
+        nghttp2_session_resume_data(connection->session, call->id);
+    }
+    if (!flush(connection)) return false;
+
+    // Let the client's flow control catch up rather than buffering a whole
+    // stream of results
+    while (!call->closed && call->out_length - call->out_offset > GRPC_SEND_BUFFER) {
+        if (!wait_readable(connection->sock, GRPC_FLOW_TIMEOUT)) {
+            connection->broken = true;
+            return false;
+        }
+        if (!receive(connection) || !flush(connection)) return false;
+    }
+    return !call->closed;
+}
+
+// Checks the request and runs the handler on its message
+static void run_call(GrpcConnection* connection, GrpcCall* call) {
+    call->started = true;
+    const char* content_type = grpc_call_metadata(call, "content-type");
+    if (!content_type || strncmp(content_type, "application/grpc", 16) != 0) {
+        // Not gRPC at all, so answered the way the spec says in plain HTTP
+        nghttp2_nv headers[] = {{(uint8_t*)":status", (uint8_t*)"415", 7, 3, NGHTTP2_NV_FLAG_NONE}};
+        nghttp2_submit_response(connection->session, call->id, headers, 1, NULL);
+        call->responded = call->finished = true;
+        return;
+    }
+
+    const unsigned char* framed = call->request;
+    size_t message_length = call->request_length >= 5
+        ? (size_t)framed[1] << 24 | (size_t)framed[2] << 16 | (size_t)framed[3] << 8 | framed[4]
+        : 0;
+    if (call->too_large) {
+        grpc_set_status(call, GRPC_RESOURCE_EXHAUSTED, "Request message too large");
+    } else if (call->request_length < 5 || message_length != call->request_length - 5) {
+        // Unary and server streaming calls take exactly one message
+        grpc_set_status(call, GRPC_INTERNAL, "Expected exactly one request message");
+    } else if (framed[0] != 0) {
+        grpc_set_status(call, GRPC_UNIMPLEMENTED, "Compressed messages are not supported");
+    } else {
+        call->running = true;
+        connection->handler(call, framed + 5, message_length);
+        call->running = false;
+    }
+
+    call->finished = true;
+    if (call->closed) {
+        unlink_call(connection, call);
+        free_call(call);
+    } else if (!call->responded) {
+        submit_response(call);
+    } else {
+        nghttp2_session_resume_data(connection->session, call->id);
+    }
+}
+
+// Runs every call whose request has fully arrived. Handlers may take in
+// more frames while they send, so the list is searched again each time.
+static void run_received_calls(GrpcConnection* connection) {
+    while (!connection->broken) {
+        GrpcCall* call = connection->calls;
+        while (call && (call->started || !call->received)) call = call->next;
+        if (!call) return;
+        run_call(connection, call);
+    }
+}
+
+void grpc_serve(int sock, GrpcHandler handler, bool (*stopping)(void), void* context) {
+    GrpcConnection connection = {0};
+    connection.sock = sock;
+    connection.handler = handler;
+    connection.context = context;
+
+    nghttp2_session_callbacks* callbacks;
+    nghttp2_session_callbacks_new(&callbacks);
+    nghttp2_session_callbacks_set_send_callback(callbacks, send_callback);
+    nghttp2_session_callbacks_set_on_begin_headers_callback(callbacks, on_begin_headers);
+    nghttp2_session_callbacks_set_on_header_callback(callbacks, on_header);
+    nghttp2_session_callbacks_set_on_data_chunk_recv_callback(callbacks, on_data_chunk);
+    nghttp2_session_callbacks_set_on_frame_recv_callback(callbacks, on_frame_recv);
+    nghttp2_session_callbacks_set_on_stream_close_callback(callbacks, on_stream_close);
+    nghttp2_session_server_new(&connection.session, callbacks, &connection);
+    nghttp2_session_callbacks_del(callbacks);
+
+    nghttp2_settings_entry settings[] = {{NGHTTP2_SETTINGS_MAX_CONCURRENT_STREAMS, GRPC_MAX_STREAMS}};
+    nghttp2_submit_settings(connection.session, NGHTTP2_FLAG_NONE, settings, 1);
+
+    bool going_away = false;
+    int idle = 0;
+    while (flush(&connection)) {
+        run_received_calls(&connection);
+        if (!flush(&connection)) break;
+        if (!nghttp2_session_want_read(connection.session) &&
+            !nghttp2_session_want_write(connection.session)) {
+            break;
+        }
+
+        // GOAWAY lets the client finish what it started and go elsewhere
+        // for anything new
+        if (!going_away && (stopping() || idle >= GRPC_IDLE_TIMEOUT)) {
+            nghttp2_submit_goaway(connection.session, NGHTTP2_FLAG_NONE,
+                                  nghttp2_session_get_last_proc_stream_id(connection.session),
+                                  NGHTTP2_NO_ERROR, NULL, 0);
+            going_away = true;
+            continue;
+        }
+
+        if (!wait_readable(sock, 1)) {
+            idle = connection.calls ? 0 : idle + 1;
+            continue;
+        }
+        idle = 0;
+        if (!receive(&connection)) break;
+    }
+
+    while (connection.calls) {
+        GrpcCall* call = connection.calls;
+        connection.calls = call->next;
+        free_call(call);
+    }
+    nghttp2_session_del(connection.session);
+}
+
+bool grpc_available(char* error, size_t error_size) {
+    return true;
+}
+#else
+void grpc_serve(int sock, GrpcHandler handler, bool (*stopping)(void), void* context) {
+}
+
+bool grpc_available(char* error, size_t error_size) {
+    snprintf(error, error_size, "built without gRPC support (make WITH_GRPC=1)");
+    return false;
+}
+
+const char* grpc_call_path(const GrpcCall* call) {
+    return "";
+}
+
+const char* grpc_call_metadata(const GrpcCall* call, const char* name) {
+    return NULL;
+}
+
+void* grpc_call_context(const GrpcCall* call) {
+    return NULL;
+}
+
+bool grpc_send(GrpcCall* call, const unsigned char* message, size_t length) {
+    return false;
+}
+
+void grpc_set_status(GrpcCall* call, GrpcStatus status, const char* message) {
+}
+
+GrpcStatus grpc_call_status(const GrpcCall* call) {
+    return GRPC_UNIMPLEMENTED;
+}
+#endif
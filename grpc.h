@@ -0,0 +1,60 @@
+#ifndef GRPC_H
+#define GRPC_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+// Server side of gRPC over HTTP/2, using nghttp2. Only the transport lives
+// here: calls are read whole and handed to a handler, which answers with
+// protobuf messages it encodes itself (see protobuf.h).
+
+// Status codes from the gRPC spec that the service uses
+typedef enum {
+    GRPC_OK = 0,
+    GRPC_INVALID_ARGUMENT = 3,
+    GRPC_NOT_FOUND = 5,
+    GRPC_PERMISSION_DENIED = 7,
+    GRPC_RESOURCE_EXHAUSTED = 8,
+    GRPC_FAILED_PRECONDITION = 9,
+    GRPC_UNIMPLEMENTED = 12,
+    GRPC_INTERNAL = 13,
+    GRPC_UNAVAILABLE = 14,
+    GRPC_UNAUTHENTICATED = 16
+} GrpcStatus;
+
+#define GRPC_MAX_MESSAGE (4 * 1024 * 1024)  // Largest request, as in gRPC's default
+
+typedef struct GrpcCall GrpcCall;
+
+// Called once per call with its request message. Runs on the connection's
+// thread; further calls on the connection wait until it returns.
+typedef void (*GrpcHandler)(GrpcCall* call, const unsigned char* request, size_t length);
+
+// Serves calls on an accepted socket until the client hangs up. Once
+// stopping returns true (it is asked every second) the client is told to
+// go away and the calls already started are finished. context is handed
+// back by grpc_call_context().
+void grpc_serve(int sock, GrpcHandler handler, bool (*stopping)(void), void* context);
+
+// False, with error set, when built without nghttp2
+bool grpc_available(char* error, size_t error_size);
+
+// The method, e.g. "/phonevalidator.v1.PhoneValidator/Validate"
+const char* grpc_call_path(const GrpcCall* call);
+
+// Request metadata by lowercase name, or NULL
+const char* grpc_call_metadata(const GrpcCall* call, const char* name);
+
+void* grpc_call_context(const GrpcCall* call);
+
+// Sends one response message. Blocks while the client is slow to read.
+// Returns false once the call is gone (cancelled, or the connection broke).
+bool grpc_send(GrpcCall* call, const unsigned char* message, size_t length);
+
+// Ends the call with status once the handler returns. Without it, the
+// call ends OK.
+void grpc_set_status(GrpcCall* call, GrpcStatus status, const char* message);
+
+GrpcStatus grpc_call_status(const GrpcCall* call);
+
+#endif
@@ -0,0 +1,437 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <ctype.h>
+#include <stdint.h>
+#include <sys/types.h>
+#include <poll.h>
+
+#ifdef HAVE_HTTP2
+#include <nghttp2/nghttp2.h>
+#endif
+
+#include "http2.h"
+#include "tls.h"
+
+#ifdef HAVE_HTTP2
+#define HTTP2_MAX_STREAMS 100
+#define HTTP2_MAX_RESPONSE_HEADERS 32
+#define HTTP2_IDLE_TIMEOUT 60       // Seconds without streams before a connection is closed
+
+typedef struct Http2Connection Http2Connection;
+
+struct Http2Stream {
+    int32_t id;
+    Http2Connection* connection;
+    char method[16];
+    char path[512];
+    char headers[4096];         // "name: value\r\n" lines
+    size_t headers_length;
+    char cookie[2048];          // Cookie fields, joined with "; "
+
+    char* body;
+    size_t body_length;
+    bool too_large;
+    bool received;              // The client has sent everything
+    bool started;               // Handed to the handler
+    bool running;
+    bool closed;                // Stream gone, free once the handler returns
+
+    unsigned char* out;         // Response body not yet taken by nghttp2
+    size_t out_offset;
+    size_t out_length;
+    bool responded;
+    struct Http2Stream* next;
+};
+
+struct Http2Connection {
+    int sock;
+    nghttp2_session* session;
+    Http2Handler handler;
+    void* context;
+    bool broken;
+    Http2Stream* streams;
+};
+
+// Connection specific headers, which HTTP/2 doesn't allow
+static const char* hop_by_hop_headers[] = {
+    "connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade"
+};
+
+static void free_stream(Http2Stream* stream) {
+    free(stream->body);
+    free(stream->out);
+    free(stream);
+}
+
+static void unlink_stream(Http2Connection* connection, Http2Stream* stream) {
+    for (Http2Stream** link = &connection->streams; *link; link = &(*link)->next) {
+        if (*link == stream) {
+            *link = stream->next;
+            return;
+        }
+    }
+}
+
+static void append_header(Http2Stream* stream, const char* name, size_t name_length,
+                          const char* value, size_t value_length) {
+    size_t room = sizeof(stream->headers) - stream->headers_length;
+    if (name_length + value_length + 4 >= room) return;
+    stream->headers_length += snprintf(stream->headers + stream->headers_length, room,
+                                       "%.*s: %.*s\r\n", (int)name_length, name,
+                                       (int)value_length, value);
+}
+
+// ============= nghttp2 Callbacks =============
+
+static ssize_t send_callback(nghttp2_session* session, const uint8_t* data, size_t length,
+                             int flags, void* user_data) {
+    Http2Connection* connection = user_data;
+    size_t sent = 0;
+    while (sent < length) {
+        ssize_t n = net_send(connection->sock, data + sent, length - sent);
+        if (n <= 0) {
+            connection->broken = true;
+            return NGHTTP2_ERR_CALLBACK_FAILURE;
+        }
+        sent += n;
+    }
+    return length;
+}
+
+static int on_begin_headers(nghttp2_session* session, const nghttp2_frame* frame,
+                            void* user_data) {
+    Http2Connection* connection = user_data;
+    if (frame->hd.type != NGHTTP2_HEADERS || frame->headers.cat != NGHTTP2_HCAT_REQUEST) {
+        return 0;
+    }
+    Http2Stream* stream = calloc(1, sizeof(Http2Stream));
+    stream->id = frame->hd.stream_id;
+    stream->connection = connection;
+    stream->next = connection->streams;
+    connection->streams = stream;
+    nghttp2_session_set_stream_user_data(session, stream->id, stream);
+    return 0;
+}
+
+static int on_header(nghttp2_session* session, const nghttp2_frame* frame,
+                     const uint8_t* name, size_t name_length,
+                     const uint8_t* value, size_t value_length,
+                     uint8_t flags, void* user_data) {
+    Http2Stream* stream = nghttp2_session_get_stream_user_data(session, frame->hd.stream_id);
+    if (!stream) return 0;
+
+    if (name_length == 7 && memcmp(name, ":method", 7) == 0) {
+        snprintf(stream->method, sizeof(stream->method), "%.*s", (int)value_length, value);
+    } else if (name_length == 5 && memcmp(name, ":path", 5) == 0) {
+        snprintf(stream->path, sizeof(stream->path), "%.*s", (int)value_length, value);
+    } else if (name_length == 10 && memcmp(name, ":authority", 10) == 0) {
+        append_header(stream, "host", 4, (const char*)value, value_length);
+    } else if (name_length == 6 && memcmp(name, "cookie", 6) == 0) {
+        // Clients may split the Cookie header into one field per cookie
+        size_t used = strlen(stream->cookie);
+        snprintf(stream->cookie + used, sizeof(stream->cookie) - used, "%s%.*s",
+                 used ? "; " : "", (int)value_length, value);
+    } else if (name[0] != ':') {
+        append_header(stream, (const char*)name, name_length, (const char*)value, value_length);
+    }
+    return 0;
+}
+
+static int on_data_chunk(nghttp2_session* session, uint8_t flags, int32_t stream_id,
+                         const uint8_t* data, size_t length, void* user_data) {
+    Http2Stream* stream = nghttp2_session_get_stream_user_data(session, stream_id);
+    if (!stream || stream->too_large) return 0;
+
+    if (stream->body_length + length > HTTP2_MAX_BODY) {
+        stream->too_large = true;
+        free(stream->body);
+        stream->body = NULL;
+        stream->body_length = 0;
+        return 0;
+    }
+    stream->body = realloc(stream->body, stream->body_length + length + 1);
+    memcpy(stream->body + stream->body_length, data, length);
+    stream->body_length += length;
+    return 0;
+}
+
+static int on_frame_recv(nghttp2_session* session, const nghttp2_frame* frame, void* user_data) {
+    if ((frame->hd.type == NGHTTP2_HEADERS || frame->hd.type == NGHTTP2_DATA) &&
+        (frame->hd.flags & NGHTTP2_FLAG_END_STREAM)) {
+        Http2Stream* stream = nghttp2_session_get_stream_user_data(session, frame->hd.stream_id);
+        if (stream) stream->received = true;
+    }
+    return 0;
+}
+
+static int on_stream_close(nghttp2_session* session, int32_t stream_id, uint32_t error_code,
+                           void* user_data) {
+    Http2Connection* connection = user_data;
+    Http2Stream* stream = nghttp2_session_get_stream_user_data(session, stream_id);
+    if (!stream) return 0;
+
+    stream->closed = true;
+    if (!stream->running) {
+        unlink_stream(connection, stream);
+        free_stream(stream);
+    }
+    return 0;
+}
+
+static ssize_t read_response(nghttp2_session* session, int32_t stream_id, uint8_t* buffer,
+                             size_t length, uint32_t* flags, nghttp2_data_source* source,
+                             void* user_data) {
+    Http2Stream* stream = source->ptr;
+    size_t available = stream->out_length - stream->out_offset;
+    size_t n = available < length ? available : length;
+    memcpy(buffer, stream->out + stream->out_offset, n);
+    stream->out_offset += n;
+    if (stream->out_offset == stream->out_length) *flags |= NGHTTP2_DATA_FLAG_EOF;
+    return n;
+}
+
+// ============= Streams =============
+
+const char* http2_stream_method(const Http2Stream* stream) {
+    return stream->method;
+}
+
+const char* http2_stream_path(const Http2Stream* stream) {
+    return stream->path;
+}
+
+const char* http2_stream_headers(const Http2Stream* stream) {
+    return stream->headers;
+}
+
+const char* http2_stream_body(const Http2Stream* stream, size_t* length) {
+    *length = stream->body_length;
+    return stream->body ? stream->body : "";
+}
+
+bool http2_stream_too_large(const Http2Stream* stream) {
+    return stream->too_large;
+}
+
+void* http2_stream_context(const Http2Stream* stream) {
+    return stream->connection->context;
+}
+
+void http2_respond(Http2Stream* stream, int status, const char* headers,
+                   const void* body, size_t length) {
+    if (stream->responded || stream->closed) return;
+    stream->responded = true;
+
+    char status_text[8];
+    snprintf(status_text, sizeof(status_text), "%d", status);
+    nghttp2_nv nva[HTTP2_MAX_RESPONSE_HEADERS + 1];
+    char names[HTTP2_MAX_RESPONSE_HEADERS][64];
+    size_t count = 0;
+    nva[count++] = (nghttp2_nv){(uint8_t*)":status", (uint8_t*)status_text, 7,
+                                strlen(status_text), NGHTTP2_NV_FLAG_NONE};
+
+    // Values point into headers, which nghttp2 copies before this returns
+    for (const char* line = headers; *line && count <= HTTP2_MAX_RESPONSE_HEADERS; ) {
+        const char* end = strstr(line, "\r\n");
+        if (!end) break;
+        const char* colon = memchr(line, ':', end - line);
+        size_t name_length = colon ? (size_t)(colon - line) : 0;
+        if (name_length > 0 && name_length < sizeof(names[0])) {
+            char* name = names[count - 1];
+            for (size_t i = 0; i < name_length; i++) {
+                name[i] = (char)tolower((unsigned char)line[i]);
+            }
+            name[name_length] = '\0';
+            bool allowed = true;
+            for (size_t i = 0; i < sizeof(hop_by_hop_headers) / sizeof(hop_by_hop_headers[0]); i++) {
+                if (strcmp(name, hop_by_hop_headers[i]) == 0) allowed = false;
+            }
+            const char* value = colon + 1;
+            while (value < end && (*value == ' ' || *value == '\t')) value++;
+            if (allowed) {
+                nva[count++] = (nghttp2_nv){(uint8_t*)name, (uint8_t*)value, name_length,
+                                            (size_t)(end - value), NGHTTP2_NV_FLAG_NONE};
+            }
+        }
+        line = end + 2;
+    }
+
+    if (length == 0) {
+        nghttp2_submit_response(stream->connection->session, stream->id, nva, count, NULL);
+        return;
+    }
+    stream->out = malloc(length);
+    memcpy(stream->out, body, length);
+    stream->out_length = length;
+    nghttp2_data_provider provider;
+    provider.source.ptr = stream;
+    provider.read_callback = read_response;
+    nghttp2_submit_response(stream->connection->session, stream->id, nva, count, &provider);
+}
+
+void http2_require_http1(Http2Stream* stream) {
+    if (stream->responded || stream->closed) return;
+    stream->responded = true;
+    nghttp2_submit_rst_stream(stream->connection->session, NGHTTP2_FLAG_NONE, stream->id,
+                              NGHTTP2_HTTP_1_1_REQUIRED);
+}
+
+// ============= Connections =============
+
+static bool flush(Http2Connection* connection) {
+    if (!connection->broken && nghttp2_session_send(connection->session) != 0) {
+        connection->broken = true;
+    }
+    return !connection->broken;
+}
+
+static bool receive(Http2Connection* connection) {
+    uint8_t buffer[16384];
+    ssize_t n = net_recv(connection->sock, buffer, sizeof(buffer));
+    if (n <= 0 || nghttp2_session_mem_recv(connection->session, buffer, n) < 0) {
+        connection->broken = true;
+    }
+    return !connection->broken;
+}
+
+// TLS may already hold decrypted bytes that poll() can't see
+static bool wait_readable(int sock, int seconds) {
+    if (net_pending(sock) > 0) return true;
+    struct pollfd readable = {sock, POLLIN, 0};
+    return poll(&readable, 1, seconds * 1000) > 0;
+}
+
+static void run_stream(Http2Connection* connection, Http2Stream* stream) {
+    stream->started = true;
+    if (stream->body) stream->body[stream->body_length] = '\0';
+    if (stream->cookie[0]) {
+        append_header(stream, "cookie", 6, stream->cookie, strlen(stream->cookie));
+    }
+    stream->running = true;
+    connection->handler(stream);
+    stream->running = false;
+
+    if (stream->closed) {
+        unlink_stream(connection, stream);
+        free_stream(stream);
+    } else if (!stream->responded) {
+        nghttp2_submit_rst_stream(connection->session, NGHTTP2_FLAG_NONE, stream->id,
+                                  NGHTTP2_INTERNAL_ERROR);
+    }
+}
+
+// Runs every stream whose request has fully arrived, oldest first
+static void run_received_streams(Http2Connection* connection) {
+    while (!connection->broken) {
+        Http2Stream* next = NULL;
+        for (Http2Stream* stream = connection->streams; stream; stream = stream->next) {
+            if (!stream->started && stream->received) next = stream;
+        }
+        if (!next) return;
+        run_stream(connection, next);
+    }
+}
+
+void http2_serve(int sock, Http2Handler handler, bool (*stopping)(void), void* context) {
+    Http2Connection connection = {0};
+    connection.sock = sock;
+    connection.handler = handler;
+    connection.context = context;
+
+    nghttp2_session_callbacks* callbacks;
+    nghttp2_session_callbacks_new(&callbacks);
+    nghttp2_session_callbacks_set_send_callback(callbacks, send_callback);
+    nghttp2_session_callbacks_set_on_begin_headers_callback(callbacks, on_begin_headers);
+    nghttp2_session_callbacks_set_on_header_callback(callbacks, on_header);
+    nghttp2_session_callbacks_set_on_data_chunk_recv_callback(callbacks, on_data_chunk);
+    nghttp2_session_callbacks_set_on_frame_recv_callback(callbacks, on_frame_recv);
+    nghttp2_session_callbacks_set_on_stream_close_callback(callbacks, on_stream_close);
+    nghttp2_session_server_new(&connection.session, callbacks, &connection);
+    nghttp2_session_callbacks_del(callbacks);
+
+    nghttp2_settings_entry settings[] = {{NGHTTP2_SETTINGS_MAX_CONCURRENT_STREAMS, HTTP2_MAX_STREAMS}};
+    nghttp2_submit_settings(connection.session, NGHTTP2_FLAG_NONE, settings, 1);
+
+    bool going_away = false;
+    int idle = 0;
+    while (flush(&connection)) {
+        run_received_streams(&connection);
+        if (!flush(&connection)) break;
+        if (!nghttp2_session_want_read(connection.session) &&
+            !nghttp2_session_want_write(connection.session)) {
+            break;
+        }
+
+        // GOAWAY lets the client finish what it started and go elsewhere
+        // for anything new
+        if (!going_away && (stopping() || idle >= HTTP2_IDLE_TIMEOUT)) {
+            nghttp2_submit_goaway(connection.session, NGHTTP2_FLAG_NONE,
+                                  nghttp2_session_get_last_proc_stream_id(connection.session),
+                                  NGHTTP2_NO_ERROR, NULL, 0);
+            going_away = true;
+            continue;
+        }
+
+        if (!wait_readable(sock, 1)) {
+            idle = connection.streams ? 0 : idle + 1;
+            continue;
+        }
+        idle = 0;
+        if (!receive(&connection)) break;
+    }
+
+    while (connection.streams) {
+        Http2Stream* stream = connection.streams;
+        connection.streams = stream->next;
+        free_stream(stream);
+    }
+    nghttp2_session_del(connection.session);
+}
+
+bool http2_available(char* error, size_t error_size) {
+    return true;
+}
+#else
+void http2_serve(int sock, Http2Handler handler, bool (*stopping)(void), void* context) {
+}
+
+bool http2_available(char* error, size_t error_size) {
+    snprintf(error, error_size, "built without HTTP/2 support (make WITH_HTTP2=1)");
+    return false;
+}
+
+const char* http2_stream_method(const Http2Stream* stream) {
+    return "";
+}
+
+const char* http2_stream_path(const Http2Stream* stream) {
+    return "";
+}
+
+const char* http2_stream_headers(const Http2Stream* stream) {
+    return "";
+}
+
+const char* http2_stream_body(const Http2Stream* stream, size_t* length) {
+    *length = 0;
+    return "";
+}
+
+bool http2_stream_too_large(const Http2Stream* stream) {
+    return false;
+}
+
+void* http2_stream_context(const Http2Stream* stream) {
+    return NULL;
+}
+
+void http2_respond(Http2Stream* stream, int status, const char* headers,
+                   const void* body, size_t length) {
+}
+
+void http2_require_http1(Http2Stream* stream) {
+}
+#endif
@@ -0,0 +1,56 @@
+#ifndef HTTP2_H
+#define HTTP2_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+// Server side of HTTP/2 for the HTTPS listener, using nghttp2. Like
+// grpc.c, each stream's request is read whole and handed to a handler,
+// which answers it with http2_respond(). I/O goes through net_send() and
+// net_recv(), so the socket is expected to have a TLS session.
+
+#define HTTP2_MAX_BODY (4 * 1024 * 1024)   // Larger requests are handed over with too_large set
+
+typedef struct Http2Stream Http2Stream;
+
+// Called once per stream with its request. Runs on the connection's
+// thread; further streams on the connection wait until it returns.
+typedef void (*Http2Handler)(Http2Stream* stream);
+
+// Serves streams on sock until the client hangs up. Once stopping returns
+// true (it is asked every second) the client is told to go away and the
+// streams already started are finished. context is handed back by
+// http2_stream_context().
+void http2_serve(int sock, Http2Handler handler, bool (*stopping)(void), void* context);
+
+// False, with error set, when built without nghttp2
+bool http2_available(char* error, size_t error_size);
+
+// The :method and :path pseudo-headers, the path with any query string
+const char* http2_stream_method(const Http2Stream* stream);
+const char* http2_stream_path(const Http2Stream* stream);
+
+// The other request headers as "name: value\r\n" lines, starting with
+// host: from :authority. Cookie headers are joined into one.
+const char* http2_stream_headers(const Http2Stream* stream);
+
+// The body, NUL terminated
+const char* http2_stream_body(const Http2Stream* stream, size_t* length);
+
+// The body was over HTTP2_MAX_BODY and has been dropped
+bool http2_stream_too_large(const Http2Stream* stream);
+
+void* http2_stream_context(const Http2Stream* stream);
+
+// Answers the stream. headers holds "Name: value\r\n" lines; names are
+// sent in lowercase and headers HTTP/2 forbids, such as Connection, are
+// left out. body is copied.
+void http2_respond(Http2Stream* stream, int status, const char* headers,
+                   const void* body, size_t length);
+
+// Resets the stream with HTTP_1_1_REQUIRED, for requests that can only be
+// served over HTTP/1.1. Clients such as curl and browsers then retry on a
+// new HTTP/1.1 connection.
+void http2_require_http1(Http2Stream* stream);
+
+#endif
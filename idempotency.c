@@ -0,0 +1,258 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <pthread.h>
+
+#include "idempotency.h"
+
+#define SWEEP_INTERVAL 64       // Keys claimed between sweeps of expired ones
+#define CLAIM_TIMEOUT 60        // Seconds before an unfinished claim lapses, e.g. after a crash
+
+typedef struct Entry {
+    char key[IDEMPOTENCY_HASH_LENGTH + 1];
+    char request_hash[IDEMPOTENCY_HASH_LENGTH + 1];
+    bool finished;
+    long long claimed;      // Unix seconds
+    long long expires;
+    StoredResponse response;
+    struct Entry* next;
+} Entry;
+
+struct IdempotencyStore {
+    int ttl;
+    Entry* entries;
+    int claims;
+    pthread_mutex_t lock;
+    Redis* redis;           // Shared keys, in place of entries, when set
+    char prefix[64];
+};
+
+// Each shared key is a hash: request_hash and finished ("0" while
+// claimed), then status, content_type, headers and body once finished.
+
+// KEYS[1] is the key, ARGV the request hash and CLAIM_TIMEOUT. Returns
+// {state}, plus the stored status, content type, headers and body for
+// "replay".
+static const char* begin_script =
+    "local entry = redis.call('HMGET', KEYS[1], 'request_hash', 'finished', "
+    "'status', 'content_type', 'headers', 'body')\n"
+    "if not entry[1] then\n"
+    "  redis.call('HSET', KEYS[1], 'request_hash', ARGV[1], 'finished', '0')\n"
+    "  redis.call('EXPIRE', KEYS[1], ARGV[2])\n"
+    "  return {'started'}\n"
+    "end\n"
+    "if entry[1] ~= ARGV[1] then return {'mismatch'} end\n"
+    "if entry[2] ~= '1' then return {'in_progress'} end\n"
+    "return {'replay', entry[3], entry[4], entry[5], entry[6]}\n";
+
+// ARGV is the status, content type, headers, body and ttl. Only a claimed
+// key is finished.
+static const char* finish_script =
+    "if redis.call('HGET', KEYS[1], 'finished') ~= '0' then return 0 end\n"
+    "redis.call('HSET', KEYS[1], 'finished', '1', 'status', ARGV[1], "
+    "'content_type', ARGV[2], 'headers', ARGV[3], 'body', ARGV[4])\n"
+    "redis.call('EXPIRE', KEYS[1], ARGV[5])\n"
+    "return 1\n";
+
+static const char* release_script =
+    "if redis.call('HGET', KEYS[1], 'finished') == '0' then redis.call('DEL', KEYS[1]) end\n"
+    "return 0\n";
+
+static void copy_response(StoredResponse* to, const StoredResponse* from) {
+    *to = *from;
+    to->body = malloc(from->body_length + 1);
+    memcpy(to->body, from->body, from->body_length);
+    to->body[from->body_length] = '\0';
+    to->headers = strdup(from->headers ? from->headers : "");
+}
+
+static void free_entry(Entry* entry) {
+    if (entry->finished) stored_response_free(&entry->response);
+    free(entry);
+}
+
+// Caller holds the lock
+static void sweep(IdempotencyStore* store, long long now) {
+    Entry** link = &store->entries;
+    while (*link) {
+        Entry* entry = *link;
+        if (entry->expires <= now) {
+            *link = entry->next;
+            free_entry(entry);
+        } else {
+            link = &entry->next;
+        }
+    }
+}
+
+// Caller holds the lock
+static Entry** find(IdempotencyStore* store, const char* key) {
+    Entry** link = &store->entries;
+    while (*link && strcmp((*link)->key, key) != 0) {
+        link = &(*link)->next;
+    }
+    return link;
+}
+
+IdempotencyStore* idempotency_store_create(int ttl) {
+    IdempotencyStore* store = calloc(1, sizeof(IdempotencyStore));
+    store->ttl = ttl > 0 ? ttl : 1;
+    pthread_mutex_init(&store->lock, NULL);
+    return store;
+}
+
+IdempotencyStore* idempotency_store_create_shared(Redis* redis, const char* prefix, int ttl) {
+    IdempotencyStore* store = idempotency_store_create(ttl);
+    store->redis = redis;
+    snprintf(store->prefix, sizeof(store->prefix), "%s", prefix);
+    return store;
+}
+
+static IdempotencyState shared_begin(IdempotencyStore* store, const char* key,
+                                     const char* request_hash, StoredResponse* response) {
+    char name[128];
+    char claim_timeout[16];
+    snprintf(name, sizeof(name), "%s%s", store->prefix, key);
+    snprintf(claim_timeout, sizeof(claim_timeout), "%d", CLAIM_TIMEOUT);
+    const char* argv[] = {"EVAL", begin_script, "1", name, request_hash, claim_timeout};
+    size_t lengths[] = {4, strlen(begin_script), 1, strlen(name), strlen(request_hash),
+                        strlen(claim_timeout)};
+
+    RedisReply reply;
+    if (!redis_command(store->redis, 6, argv, lengths, &reply)) return IDEMPOTENCY_STARTED;
+    IdempotencyState state = IDEMPOTENCY_STARTED;
+    const char* name_of_state = reply.count > 0 && reply.values[0] ? reply.values[0] : "";
+    if (strcmp(name_of_state, "mismatch") == 0) {
+        state = IDEMPOTENCY_MISMATCH;
+    } else if (strcmp(name_of_state, "in_progress") == 0) {
+        state = IDEMPOTENCY_IN_PROGRESS;
+    } else if (strcmp(name_of_state, "replay") == 0 && reply.count == 5 &&
+               reply.values[1] && reply.values[2] && reply.values[3] && reply.values[4]) {
+        memset(response, 0, sizeof(*response));
+        response->status = atoi(reply.values[1]);
+        snprintf(response->content_type, sizeof(response->content_type), "%s", reply.values[2]);
+        response->headers = reply.values[3];
+        response->body = reply.values[4];
+        response->body_length = reply.lengths[4];
+        reply.values[3] = reply.values[4] = NULL;
+        state = IDEMPOTENCY_REPLAY;
+    }
+    redis_reply_free(&reply);
+    return state;
+}
+
+static void shared_finish(IdempotencyStore* store, const char* key,
+                          const StoredResponse* response) {
+    char name[128];
+    char status[16];
+    char ttl[16];
+    snprintf(name, sizeof(name), "%s%s", store->prefix, key);
+    snprintf(status, sizeof(status), "%d", response->status);
+    snprintf(ttl, sizeof(ttl), "%d", store->ttl);
+    const char* headers = response->headers ? response->headers : "";
+    const char* argv[] = {"EVAL", finish_script, "1", name, status, response->content_type,
+                          headers, response->body ? response->body : "", ttl};
+    size_t lengths[] = {4, strlen(finish_script), 1, strlen(name), strlen(status),
+                        strlen(response->content_type), strlen(headers), response->body_length,
+                        strlen(ttl)};
+    redis_command(store->redis, 9, argv, lengths, NULL);
+}
+
+static void shared_release(IdempotencyStore* store, const char* key) {
+    char name[128];
+    snprintf(name, sizeof(name), "%s%s", store->prefix, key);
+    const char* argv[] = {"EVAL", release_script, "1", name};
+    size_t lengths[] = {4, strlen(release_script), 1, strlen(name)};
+    redis_command(store->redis, 4, argv, lengths, NULL);
+}
+
+void idempotency_store_free(IdempotencyStore* store) {
+    Entry* entry = store->entries;
+    while (entry) {
+        Entry* next = entry->next;
+        free_entry(entry);
+        entry = next;
+    }
+    pthread_mutex_destroy(&store->lock);
+    free(store);
+}
+
+IdempotencyState idempotency_begin(IdempotencyStore* store, const char* key,
+                                   const char* request_hash, long long now,
+                                   StoredResponse* response) {
+    if (store->redis) return shared_begin(store, key, request_hash, response);
+
+    pthread_mutex_lock(&store->lock);
+    Entry** link = find(store, key);
+    Entry* entry = *link;
+    if (entry && (entry->expires <= now ||
+                  (!entry->finished && entry->claimed + CLAIM_TIMEOUT <= now))) {
+        *link = entry->next;
+        free_entry(entry);
+        entry = NULL;
+    }
+
+    IdempotencyState state;
+    if (entry && strcmp(entry->request_hash, request_hash) != 0) {
+        state = IDEMPOTENCY_MISMATCH;
+    } else if (entry && !entry->finished) {
+        state = IDEMPOTENCY_IN_PROGRESS;
+    } else if (entry) {
+        copy_response(response, &entry->response);
+        state = IDEMPOTENCY_REPLAY;
+    } else {
+        if (++store->claims % SWEEP_INTERVAL == 0) {
+            sweep(store, now);
+        }
+        entry = calloc(1, sizeof(Entry));
+        strncpy(entry->key, key, IDEMPOTENCY_HASH_LENGTH);
+        strncpy(entry->request_hash, request_hash, IDEMPOTENCY_HASH_LENGTH);
+        entry->claimed = now;
+        entry->expires = now + store->ttl;
+        entry->next = store->entries;
+        store->entries = entry;
+        state = IDEMPOTENCY_STARTED;
+    }
+    pthread_mutex_unlock(&store->lock);
+    return state;
+}
+
+void idempotency_finish(IdempotencyStore* store, const char* key, const StoredResponse* response) {
+    if (store->redis) {
+        shared_finish(store, key, response);
+        return;
+    }
+
+    pthread_mutex_lock(&store->lock);
+    Entry* entry = *find(store, key);
+    if (entry && !entry->finished) {
+        copy_response(&entry->response, response);
+        entry->finished = true;
+    }
+    pthread_mutex_unlock(&store->lock);
+}
+
+void idempotency_release(IdempotencyStore* store, const char* key) {
+    if (store->redis) {
+        shared_release(store, key);
+        return;
+    }
+
+    pthread_mutex_lock(&store->lock);
+    Entry** link = find(store, key);
+    Entry* entry = *link;
+    if (entry && !entry->finished) {
+        *link = entry->next;
+        free_entry(entry);
+    }
+    pthread_mutex_unlock(&store->lock);
+}
+
+void stored_response_free(StoredResponse* response) {
+    free(response->body);
+    free(response->headers);
+    response->body = NULL;
+    response->headers = NULL;
+}
@@ -0,0 +1,58 @@
+#ifndef IDEMPOTENCY_H
+#define IDEMPOTENCY_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+#include "redis.h"
+
+#define IDEMPOTENCY_HASH_LENGTH 64  // Hex SHA-256, as from sha256_hex()
+
+// What a POST sent with an Idempotency-Key answered, kept so that a retry
+// with the same key gets the same answer instead of running again
+typedef struct {
+    int status;
+    char content_type[64];
+    char* body;             // Heap allocated, may hold NUL bytes
+    size_t body_length;
+    char* headers;          // "Name: value\r\n" lines the route added, heap allocated
+} StoredResponse;
+
+typedef enum {
+    IDEMPOTENCY_STARTED,    // New key, claimed for this request: run it, then finish or release
+    IDEMPOTENCY_REPLAY,     // Finished before, the stored response was copied out
+    IDEMPOTENCY_IN_PROGRESS,// Another request with the key hasn't finished yet
+    IDEMPOTENCY_MISMATCH    // The key was used for a different request body
+} IdempotencyState;
+
+// Keys in memory, each kept ttl seconds from when it was first seen. Keys
+// are opaque to the store; callers scope them (per caller and route) by
+// hashing. Safe to share between threads.
+typedef struct IdempotencyStore IdempotencyStore;
+
+IdempotencyStore* idempotency_store_create(int ttl);
+
+// Keys kept in Redis under names starting with prefix, so a retry that
+// lands on another replica is still replayed. Each is kept ttl seconds from
+// when its response is finished. While the server can't be reached every
+// request runs as new.
+IdempotencyStore* idempotency_store_create_shared(Redis* redis, const char* prefix, int ttl);
+
+void idempotency_store_free(IdempotencyStore* store);
+
+// Claims key for a request whose body hashes to request_hash, or reports
+// why it can't be. On IDEMPOTENCY_REPLAY response is filled in and must be
+// freed with stored_response_free().
+IdempotencyState idempotency_begin(IdempotencyStore* store, const char* key,
+                                   const char* request_hash, long long now,
+                                   StoredResponse* response);
+
+// Keeps the response for a key claimed with idempotency_begin(), copying it
+void idempotency_finish(IdempotencyStore* store, const char* key, const StoredResponse* response);
+
+// Gives up a claimed key without keeping anything, so a retry runs again
+void idempotency_release(IdempotencyStore* store, const char* key);
+
+void stored_response_free(StoredResponse* response);
+
+#endif
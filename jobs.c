@@ -0,0 +1,514 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+#include <pthread.h>
+
+#include "jobs.h"
+
+#define MAX_JOB_SIZE 100000
+#define MAX_PENDING_JOBS 16         // Queued or running, more are turned away with 503
+#define JOB_WORKERS 2               // Jobs validated at once
+#define JOB_BLOCK_ROWS 500          // Numbers validated between progress updates
+#define JOB_RETENTION 3600          // Seconds a finished job's results are kept
+#define JOB_RETRY_AFTER 30          // Seconds to wait when the queue is full
+#define JOB_RESULTS_DEFAULT_LIMIT 100
+#define JOB_RESULTS_MAX_LIMIT 1000
+#define STREAM_KEEPALIVE 15         // Seconds between SSE comments while a job is quiet
+
+typedef enum {
+    JOB_QUEUED,
+    JOB_RUNNING,
+    JOB_COMPLETED,
+    JOB_FAILED
+} JobStatus;
+
+static const char* job_status_names[] = {"queued", "running", "completed", "failed"};
+
+// An asynchronous batch. Everything but numbers is guarded by jobs_lock;
+// numbers belongs to the worker once the job is running.
+typedef struct Job {
+    char id[33];
+    JobStatus status;
+    char error[128];        // Why a failed job failed
+    char (*numbers)[128];   // Freed once validated
+    int total;
+    int processed;          // Results ready, in input order
+    int valid;
+    StringBuilder results;  // Result objects back to back
+    size_t* offsets;        // Where each result starts in results, total + 1 of them
+    char region[8];
+    bool geocode;
+    char caller[17];        // Fingerprint of the submitting key, for history
+    int tenant_id;          // Tenant of the submitting key
+    bool sandbox;           // Submitted with a sandbox key, so neither recorded nor counted
+    char callback_url[CALLBACK_MAX_URL];  // POSTed a summary when the job finishes, empty for none
+    long long created_at;
+    long long started_at;   // 0 until it happens
+    long long finished_at;
+    struct Job* next;
+} Job;
+
+// Submitted jobs, oldest first. Workers wait on jobs_queued for new ones,
+// event streams on jobs_progress for new results.
+static Job* jobs = NULL;
+static int pending_jobs = 0;       // Queued or running
+static pthread_mutex_t jobs_lock = PTHREAD_MUTEX_INITIALIZER;
+static pthread_cond_t jobs_queued = PTHREAD_COND_INITIALIZER;
+static pthread_cond_t jobs_progress = PTHREAD_COND_INITIALIZER;
+
+static void free_job(Job* job) {
+    free(job->numbers);
+    sb_free(&job->results);
+    free(job->offsets);
+    free(job);
+}
+
+// 128 random bits in hex, so that a job's results can't be guessed at
+static bool new_job_id(char* out) {
+    unsigned char bytes[16];
+    FILE* random = fopen("/dev/urandom", "rb");
+    if (!random) return false;
+    bool ok = fread(bytes, 1, sizeof(bytes), random) == sizeof(bytes);
+    fclose(random);
+    for (size_t i = 0; ok && i < sizeof(bytes); i++) {
+        sprintf(out + i * 2, "%02x", bytes[i]);
+    }
+    return ok;
+}
+
+// Drops jobs that finished more than JOB_RETENTION seconds ago. Call with
+// jobs_lock held.
+static void prune_jobs(long long now) {
+    Job** link = &jobs;
+    while (*link) {
+        Job* job = *link;
+        if (job->finished_at && now - job->finished_at > JOB_RETENTION) {
+            *link = job->next;
+            free_job(job);
+        } else {
+            link = &job->next;
+        }
+    }
+}
+
+// Call with jobs_lock held
+static Job* find_job(const char* id) {
+    for (Job* job = jobs; job; job = job->next) {
+        if (strcmp(job->id, id) == 0) return job;
+    }
+    return NULL;
+}
+
+// The :id segment of /api/v1/jobs/:id[/results]
+static void path_job_id(HttpRequest* req, char* out, size_t out_size) {
+    const char* id = req->path + strlen(API_V1 "/jobs/");
+    size_t len = strcspn(id, "/");
+    snprintf(out, out_size, "%.*s", (int)(len < out_size ? len : out_size - 1), id);
+}
+
+static void job_to_json(const Job* job, char* out, size_t out_size);
+
+// Marks a job done and queues its callback, if it asked for one, and the
+// job.completed notification
+static void finish_job(Job* job, JobStatus status, const char* error) {
+    pthread_mutex_lock(&jobs_lock);
+    job->status = status;
+    snprintf(job->error, sizeof(job->error), "%s", error ? error : "");
+    job->finished_at = time(NULL);
+    pending_jobs--;
+    free(job->numbers);
+    job->numbers = NULL;
+    
+    const char* event = status == JOB_COMPLETED ? "job.completed" : "job.failed";
+    char json[1024];
+    char payload[1100];
+    job_to_json(job, json, sizeof(json));
+    snprintf(payload, sizeof(payload), "{\"event\": \"%s\", \"job\": %s}", event, json);
+    char subject[256];
+    if (status == JOB_COMPLETED) {
+        snprintf(subject, sizeof(subject), "Job %s completed: %d of %d numbers valid", job->id,
+                 job->valid, job->total);
+    } else {
+        snprintf(subject, sizeof(subject), "Job %s failed after %d of %d numbers: %s", job->id,
+                 job->processed, job->total, job->error);
+    }
+    pthread_cond_broadcast(&jobs_progress);
+    pthread_mutex_unlock(&jobs_lock);
+    
+    if (job->callback_url[0] && callbacks) {
+        callback_send(callbacks, job->callback_url, event, payload);
+    }
+    notify(notifications, NOTIFY_JOB_COMPLETED, subject, json);
+}
+
+// Validates a running job JOB_BLOCK_ROWS numbers at a time, publishing each
+// block's results as it goes so they can be paged through before the end
+static void run_job(Job* job) {
+    NumberLists lists;
+    if (!fetch_number_lists(NULL, job->caller, job->tenant_id, &lists)) {
+        finish_job(job, JOB_FAILED, "Failed to load number lists");
+        return;
+    }
+    // The request that submitted the job is gone, so only shutdown stops
+    // it; the Context just carries on whether it is a sandbox job
+    Context ctx = {.deadline = 0, .sock = -1, .sandbox = job->sandbox};
+    
+    ValidationResult* block = malloc(sizeof(ValidationResult) * JOB_BLOCK_ROWS);
+    StringBuilder sb;
+    sb_init(&sb);
+    const char* error = NULL;
+    for (int start = 0; start < job->total; start += JOB_BLOCK_ROWS) {
+        pthread_mutex_lock(&connections_lock);
+        bool stopping = shutting_down;
+        pthread_mutex_unlock(&connections_lock);
+        if (stopping) {
+            error = "The server shut down before the job finished";
+            break;
+        }
+        
+        int count = job->total - start < JOB_BLOCK_ROWS ? job->total - start : JOB_BLOCK_ROWS;
+        size_t offsets[JOB_BLOCK_ROWS];
+        int valid = 0;
+        sb.length = 0;
+        for (int i = 0; i < count; i++) {
+            ValidationResult* result = &block[i];
+            validate_number(&ctx, job->numbers[start + i], job->region, result);
+            check_number_lists(&lists, result);
+            if (job->geocode) {
+                geocode_result(result);
+            }
+            if (result->error == PHONE_OK && result->number.valid) {
+                valid++;
+            }
+            
+            char json[VALIDATION_JSON_SIZE];
+            validation_result_to_json(result, json, sizeof(json));
+            offsets[i] = sb.length;
+            sb_append(&sb, json);
+        }
+        if (!job->sandbox) record_history_as(job->caller, job->tenant_id, "job", block, count);
+        
+        pthread_mutex_lock(&jobs_lock);
+        size_t base = job->results.length;
+        for (int i = 0; i < count; i++) {
+            job->offsets[start + i] = base + offsets[i];
+        }
+        sb_append(&job->results, sb.data);
+        job->offsets[start + count] = job->results.length;
+        job->processed += count;
+        job->valid += valid;
+        pthread_cond_broadcast(&jobs_progress);
+        pthread_mutex_unlock(&jobs_lock);
+    }
+    sb_free(&sb);
+    free(block);
+    free_number_lists(&lists);
+    finish_job(job, error ? JOB_FAILED : JOB_COMPLETED, error);
+}
+
+// Runs queued jobs oldest first, JOB_WORKERS of them at a time
+static void* job_worker(void* arg) {
+    while (1) {
+        pthread_mutex_lock(&jobs_lock);
+        Job* job = NULL;
+        while (!job) {
+            for (job = jobs; job && job->status != JOB_QUEUED; job = job->next);
+            if (!job) pthread_cond_wait(&jobs_queued, &jobs_lock);
+        }
+        job->status = JOB_RUNNING;
+        job->started_at = time(NULL);
+        pthread_mutex_unlock(&jobs_lock);
+        
+        // A running job counts as an in-flight connection, so that shutdown
+        // waits for it to stop using the store
+        pthread_mutex_lock(&connections_lock);
+        active_connections++;
+        pthread_mutex_unlock(&connections_lock);
+        
+        run_job(job);
+        
+        pthread_mutex_lock(&connections_lock);
+        if (--active_connections == 0) {
+            pthread_cond_broadcast(&connections_drained);
+        }
+        pthread_mutex_unlock(&connections_lock);
+    }
+    return NULL;
+}
+
+void start_job_workers(void) {
+    for (int i = 0; i < JOB_WORKERS; i++) {
+        pthread_t worker;
+        if (pthread_create(&worker, NULL, job_worker, NULL) == 0) {
+            pthread_detach(worker);
+        }
+    }
+}
+
+int jobs_pending(void) {
+    pthread_mutex_lock(&jobs_lock);
+    int count = pending_jobs;
+    pthread_mutex_unlock(&jobs_lock);
+    return count;
+}
+
+// Call with jobs_lock held
+static void job_to_json(const Job* job, char* out, size_t out_size) {
+    char created[32];
+    char started[40] = "null";
+    char finished[40] = "null";
+    format_utc_time(job->created_at, created, sizeof(created));
+    if (job->started_at) {
+        started[0] = '"';
+        format_utc_time(job->started_at, started + 1, sizeof(started) - 2);
+        strcat(started, "\"");
+    }
+    if (job->finished_at) {
+        finished[0] = '"';
+        format_utc_time(job->finished_at, finished + 1, sizeof(finished) - 2);
+        strcat(finished, "\"");
+    }
+    
+    char error[288] = "";
+    if (job->status == JOB_FAILED) {
+        char escaped[256];
+        json_escape(job->error, escaped, sizeof(escaped));
+        snprintf(error, sizeof(error), ", \"error\": \"%s\"", escaped);
+    }
+    
+    snprintf(out, out_size,
+             "{\"id\": \"%s\", \"status\": \"%s\"%s, \"total\": %d, \"processed\": %d, "
+             "\"valid\": %d, \"invalid\": %d, \"created_at\": \"%s\", \"started_at\": %s, "
+             "\"finished_at\": %s, \"results_url\": \"%s" API_V1 "/jobs/%s/results\"}",
+             job->id, job_status_names[job->status], error, job->total, job->processed,
+             job->valid, job->processed - job->valid, created, started, finished,
+             config.public_url, job->id);
+}
+
+void handle_job_create(HttpRequest* req, HttpResponse* res) {
+    char callback_url[600] = "";
+    json_get_string(req->body, "callback_url", callback_url, sizeof(callback_url));
+    if (callback_url[0] && !callbacks) {
+        set_error_response(res, 501, "callbacks_disabled",
+                           "Job callbacks are not configured on this server", NULL);
+        return;
+    }
+    if (callback_url[0] && !callback_url_valid(callback_url)) {
+        error_bad_request(res, "invalid_field", "callback_url must be an http:// or https:// URL");
+        return;
+    }
+    
+    Job* job = calloc(1, sizeof(Job));
+    if (!read_number_array(req->body, MAX_JOB_SIZE, &job->numbers, &job->total, res)) {
+        free(job);
+        return;
+    }
+    strcpy(job->callback_url, callback_url);    // callback_url_valid() checked the length
+    if (!new_job_id(job->id)) {
+        free(job->numbers);
+        free(job);
+        error_internal(res, "Failed to create a job ID");
+        return;
+    }
+    json_get_string(req->body, "region", job->region, sizeof(job->region));
+    job->geocode = get_query_flag(req, "geocode");
+    caller_fingerprint(req, job->caller, sizeof(job->caller));
+    job->tenant_id = request_tenant(req);
+    job->sandbox = req->context.sandbox;
+    job->offsets = calloc(job->total + 1, sizeof(size_t));
+    sb_init(&job->results);
+    job->created_at = time(NULL);
+    
+    pthread_mutex_lock(&jobs_lock);
+    prune_jobs(job->created_at);
+    if (pending_jobs >= MAX_PENDING_JOBS) {
+        pthread_mutex_unlock(&jobs_lock);
+        free_job(job);
+        char retry_value[16];
+        char details[64];
+        snprintf(retry_value, sizeof(retry_value), "%d", JOB_RETRY_AFTER);
+        snprintf(details, sizeof(details), "{\"retry_after\": %d}", JOB_RETRY_AFTER);
+        add_response_header(res, "Retry-After", retry_value);
+        set_error_response(res, 503, "queue_full", "Too many jobs waiting, try again later",
+                           details);
+        return;
+    }
+    Job** link = &jobs;
+    while (*link) link = &(*link)->next;
+    *link = job;
+    pending_jobs++;
+    
+    char json[1024];
+    job_to_json(job, json, sizeof(json));
+    char location[128];
+    snprintf(location, sizeof(location), API_V1 "/jobs/%s", job->id);
+    pthread_cond_signal(&jobs_queued);
+    pthread_mutex_unlock(&jobs_lock);
+    
+    add_response_header(res, "Location", location);
+    set_json_response(res, 202, json);
+}
+
+void handle_job_get(HttpRequest* req, HttpResponse* res) {
+    char id[64];
+    path_job_id(req, id, sizeof(id));
+    
+    pthread_mutex_lock(&jobs_lock);
+    prune_jobs(time(NULL));
+    Job* job = find_job(id);
+    if (!job) {
+        pthread_mutex_unlock(&jobs_lock);
+        error_not_found(res, "job_not_found", "Job not found");
+        return;
+    }
+    char json[1024];
+    job_to_json(job, json, sizeof(json));
+    pthread_mutex_unlock(&jobs_lock);
+    
+    set_json_response(res, 200, json);
+}
+
+// Results so far, in input order. While a job runs, processed says how
+// many there are to page through.
+void handle_job_results(HttpRequest* req, HttpResponse* res) {
+    int limit = JOB_RESULTS_DEFAULT_LIMIT;
+    int offset = 0;
+    char value[32];
+    if (get_query_param(req, "limit", value, sizeof(value)) && value[0]) {
+        limit = atoi(value);
+        if (limit < 1 || limit > JOB_RESULTS_MAX_LIMIT) {
+            char message[64];
+            snprintf(message, sizeof(message), "limit must be 1-%d", JOB_RESULTS_MAX_LIMIT);
+            error_bad_request(res, "invalid_field", message);
+            return;
+        }
+    }
+    if (get_query_param(req, "offset", value, sizeof(value))) {
+        offset = atoi(value) > 0 ? atoi(value) : 0;
+    }
+    
+    char id[64];
+    path_job_id(req, id, sizeof(id));
+    
+    pthread_mutex_lock(&jobs_lock);
+    prune_jobs(time(NULL));
+    Job* job = find_job(id);
+    if (!job) {
+        pthread_mutex_unlock(&jobs_lock);
+        error_not_found(res, "job_not_found", "Job not found");
+        return;
+    }
+    
+    int start = offset < job->processed ? offset : job->processed;
+    int end = start + limit < job->processed ? start + limit : job->processed;
+    StringBuilder sb;
+    sb_init(&sb);
+    sb_appendf(&sb, "{\"id\": \"%s\", \"status\": \"%s\", \"results\": [", job->id,
+               job_status_names[job->status]);
+    for (int i = start; i < end; i++) {
+        size_t from = job->offsets[i];
+        sb_appendf(&sb, "%s%.*s", i > start ? ", " : "", (int)(job->offsets[i + 1] - from),
+                   job->results.data + from);
+    }
+    sb_appendf(&sb, "], \"count\": %d, \"total\": %d, \"processed\": %d, \"limit\": %d, "
+               "\"offset\": %d}", end - start, job->total, job->processed, limit, offset);
+    pthread_mutex_unlock(&jobs_lock);
+    
+    set_json_response(res, 200, sb.data);
+    sb_free(&sb);
+}
+
+// Server-Sent Events for a job: each result as it is published, progress
+// after each block and done with the final status. A result's event id is
+// its index + 1, so a reconnecting EventSource resumes via Last-Event-ID.
+void handle_job_stream(HttpRequest* req, HttpResponse* res) {
+    char id[64];
+    if (!get_query_param(req, "job", id, sizeof(id)) || !id[0]) {
+        error_missing_field(res, "job");
+        return;
+    }
+    char last_event_id[32];
+    int sent = 0;
+    if (get_header(req, "Last-Event-ID", last_event_id, sizeof(last_event_id))) {
+        sent = atoi(last_event_id) > 0 ? atoi(last_event_id) : 0;
+    }
+    
+    pthread_mutex_lock(&jobs_lock);
+    prune_jobs(time(NULL));
+    Job* job = find_job(id);
+    if (job && sent > job->total) sent = job->total;
+    pthread_mutex_unlock(&jobs_lock);
+    if (!job) {
+        error_not_found(res, "job_not_found", "Job not found");
+        return;
+    }
+    
+    add_response_header(res, "Cache-Control", "no-cache");
+    // Stops nginx from buffering the events
+    add_response_header(res, "X-Accel-Buffering", "no");
+    if (!stream_begin(req, res, 200, "text/event-stream")) return;
+    
+    StringBuilder sb;
+    sb_init(&sb);
+    int reported = -1;
+    bool done = false;
+    while (!done) {
+        sb.length = 0;
+        sb.data[0] = '\0';
+        
+        // The job is looked up afresh each time, it may have expired
+        pthread_mutex_lock(&jobs_lock);
+        job = find_job(id);
+        if (job && job->processed <= sent && !job->finished_at) {
+            struct timespec deadline;
+            clock_gettime(CLOCK_REALTIME, &deadline);
+            deadline.tv_sec += STREAM_KEEPALIVE;
+            pthread_cond_timedwait(&jobs_progress, &jobs_lock, &deadline);
+            job = find_job(id);
+        }
+        if (!job) {
+            pthread_mutex_unlock(&jobs_lock);
+            break;
+        }
+        
+        int end = job->processed < sent + JOB_RESULTS_MAX_LIMIT ? job->processed
+                                                                : sent + JOB_RESULTS_MAX_LIMIT;
+        for (int i = sent; i < end; i++) {
+            // Skip the result's opening brace to put index first
+            size_t from = job->offsets[i] + 1;
+            sb_appendf(&sb, "id: %d\nevent: result\ndata: {\"index\": %d, %.*s\n\n", i + 1, i,
+                       (int)(job->offsets[i + 1] - from), job->results.data + from);
+        }
+        sent = end > sent ? end : sent;
+        if (sent == job->processed && sent != reported) {
+            sb_appendf(&sb, "event: progress\ndata: {\"processed\": %d, \"total\": %d, "
+                       "\"valid\": %d, \"invalid\": %d}\n\n", job->processed, job->total,
+                       job->valid, job->processed - job->valid);
+            reported = sent;
+        }
+        if (job->finished_at && sent == job->processed) {
+            char json[1024];
+            job_to_json(job, json, sizeof(json));
+            sb_appendf(&sb, "event: done\ndata: %s\n\n", json);
+            done = true;
+        }
+        pthread_mutex_unlock(&jobs_lock);
+        
+        if (sb.length == 0) {
+            sb_append(&sb, ": keepalive\n\n");
+        }
+        if (!stream_write(req, sb.data, sb.length)) break;
+        
+        pthread_mutex_lock(&connections_lock);
+        bool stopping = shutting_down;
+        pthread_mutex_unlock(&connections_lock);
+        if (stopping) break;
+    }
+    if (done) {
+        stream_end(req);
+    }
+    sb_free(&sb);
+}
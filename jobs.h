@@ -0,0 +1,25 @@
+#ifndef JOBS_H
+#define JOBS_H
+
+#include "webserver.h"
+
+// Background validation jobs. POST /api/v1/jobs queues a list of numbers,
+// which JOB_WORKERS threads validate a block at a time, so the results can
+// be paged through, or streamed as Server-Sent Events, before the job ends.
+// Jobs live in memory and are forgotten an hour after they finish.
+
+// Starts the threads that run queued jobs
+void start_job_workers(void);
+
+// Jobs queued or running
+int jobs_pending(void);
+
+// POST /api/v1/jobs, GET /api/v1/jobs/:id and GET /api/v1/jobs/:id/results
+void handle_job_create(HttpRequest* req, HttpResponse* res);
+void handle_job_get(HttpRequest* req, HttpResponse* res);
+void handle_job_results(HttpRequest* req, HttpResponse* res);
+
+// GET /api/v1/stream?job=ID, a socket route
+void handle_job_stream(HttpRequest* req, HttpResponse* res);
+
+#endif
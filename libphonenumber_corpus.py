@@ -0,0 +1,72 @@
+#!/usr/bin/env python3
+"""Writes a corpus for ./webserver metadata-check --corpus: libphonenumber's
+own answers for its example numbers and for near misses of them, as
+number,region,valid,type,e164 rows.
+
+Needs the phonenumbers package (pip install phonenumbers), a port of
+libphonenumber; use the release whose XML you imported.
+
+    python3 libphonenumber_corpus.py > corpus.csv
+"""
+
+import sys
+
+import phonenumbers
+from phonenumbers import PhoneNumberFormat, PhoneNumberType
+
+TYPES = {
+    PhoneNumberType.FIXED_LINE: "fixed_line",
+    PhoneNumberType.MOBILE: "mobile",
+    PhoneNumberType.FIXED_LINE_OR_MOBILE: "fixed_line_or_mobile",
+    PhoneNumberType.TOLL_FREE: "toll_free",
+    PhoneNumberType.PREMIUM_RATE: "premium_rate",
+    PhoneNumberType.SHARED_COST: "shared_cost",
+    PhoneNumberType.VOIP: "voip",
+    PhoneNumberType.PERSONAL_NUMBER: "personal_number",
+    PhoneNumberType.PAGER: "pager",
+    PhoneNumberType.UAN: "uan",
+    PhoneNumberType.VOICEMAIL: "voicemail",
+    PhoneNumberType.UNKNOWN: "unknown",
+}
+
+
+def variants(national):
+    """The example, and numbers a digit away from it that are usually not
+    valid: one short, one long and the last digit changed."""
+    yield national
+    yield national[:-1]
+    yield national + "0"
+    yield national[:-1] + str((int(national[-1]) + 5) % 10)
+
+
+def row(raw, region):
+    try:
+        number = phonenumbers.parse(raw, region or None)
+    except phonenumbers.NumberParseException:
+        return None
+    valid = phonenumbers.is_valid_number(number)
+    kind = TYPES.get(phonenumbers.number_type(number), "unknown") if valid else "unknown"
+    e164 = phonenumbers.format_number(number, PhoneNumberFormat.E164)
+    return "%s,%s,%s,%s,%s" % (raw, region, "true" if valid else "false", kind, e164)
+
+
+def main():
+    out = sys.stdout
+    out.write("number,region,valid,type,e164\n")
+    for region in sorted(phonenumbers.SUPPORTED_REGIONS):
+        code = phonenumbers.country_code_for_region(region)
+        for kind in TYPES:
+            example = phonenumbers.example_number_for_type(region, kind)
+            if example is None or kind == PhoneNumberType.UNKNOWN:
+                continue
+            national = phonenumbers.national_significant_number(example)
+            for digits in variants(national):
+                # Once in international form and once as dialled at home
+                for raw, default in (("+%d%s" % (code, digits), ""), (digits, region)):
+                    line = row(raw, default)
+                    if line:
+                        out.write(line + "\n")
+
+
+if __name__ == "__main__":
+    main()
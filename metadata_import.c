@@ -0,0 +1,1115 @@
+#define _DEFAULT_SOURCE
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <ctype.h>
+#include <stdarg.h>
+#include <regex.h>
+
+#include "metadata_import.h"
+#include "phonevalidator.h"
+
+#define XML_MAX_DEPTH 64
+#define MAX_FORMAT_GROUPS 8
+#define UNBOUNDED 1000              // Longer than any number, for *, + and {n,}
+
+// ============= Buffers =============
+
+typedef struct {
+    char* data;
+    size_t length;
+    size_t capacity;
+} Buffer;
+
+static void buffer_append(Buffer* buffer, const void* data, size_t length) {
+    if (buffer->length + length + 1 > buffer->capacity) {
+        size_t capacity = buffer->capacity ? buffer->capacity : 256;
+        while (buffer->length + length + 1 > capacity) capacity *= 2;
+        buffer->data = realloc(buffer->data, capacity);
+        buffer->capacity = capacity;
+    }
+    memcpy(buffer->data + buffer->length, data, length);
+    buffer->length += length;
+    buffer->data[buffer->length] = '\0';
+}
+
+static void buffer_puts(Buffer* buffer, const char* text) {
+    buffer_append(buffer, text, strlen(text));
+}
+
+static void buffer_byte(Buffer* buffer, char byte) {
+    buffer_append(buffer, &byte, 1);
+}
+
+static void buffer_printf(Buffer* buffer, const char* format, ...) {
+    va_list args;
+    va_start(args, format);
+    int length = vsnprintf(NULL, 0, format, args);
+    va_end(args);
+    char* text = malloc(length + 1);
+    va_start(args, format);
+    vsnprintf(text, length + 1, format, args);
+    va_end(args);
+    buffer_append(buffer, text, length);
+    free(text);
+}
+
+// ============= XML Parsing =============
+
+// Just enough XML for libphonenumber's files: elements, attributes,
+// character data and CDATA, with comments, processing instructions and
+// the DOCTYPE skipped
+typedef struct XmlNode {
+    char* name;
+    char** attributes;      // Name, value, name, value, ...
+    int attribute_count;    // Pairs
+    char* text;             // Character data directly inside, entities decoded
+    struct XmlNode* children;
+    int count;
+} XmlNode;
+
+typedef struct {
+    const char* p;
+    const char* error;
+} XmlParser;
+
+static void xml_free(XmlNode* node) {
+    for (int i = 0; i < node->count; i++) xml_free(&node->children[i]);
+    for (int i = 0; i < node->attribute_count * 2; i++) free(node->attributes[i]);
+    free(node->children);
+    free(node->attributes);
+    free(node->name);
+    free(node->text);
+}
+
+// Appends text[0..length) with its entity and character references decoded
+static void xml_decode(Buffer* out, const char* text, size_t length) {
+    static const struct { const char* name; char c; } entities[] = {
+        {"amp", '&'}, {"lt", '<'}, {"gt", '>'}, {"quot", '"'}, {"apos", '\''},
+    };
+    const char* end = text + length;
+    for (const char* p = text; p < end; p++) {
+        const char* semicolon = *p == '&' ? memchr(p, ';', end - p) : NULL;
+        if (!semicolon || semicolon - p > 10) {
+            buffer_byte(out, *p);
+            continue;
+        }
+        const char* name = p + 1;
+        size_t name_length = semicolon - name;
+        bool decoded = false;
+        if (name_length > 1 && name[0] == '#') {
+            unsigned long code = name[1] == 'x' ? strtoul(name + 2, NULL, 16) : strtoul(name + 1, NULL, 10);
+            // The metadata is ASCII; anything wider stays as written
+            if (code > 0 && code < 0x80) {
+                buffer_byte(out, (char)code);
+                decoded = true;
+            }
+        }
+        for (size_t i = 0; !decoded && i < sizeof(entities) / sizeof(entities[0]); i++) {
+            if (strlen(entities[i].name) == name_length && strncmp(name, entities[i].name, name_length) == 0) {
+                buffer_byte(out, entities[i].c);
+                decoded = true;
+            }
+        }
+        if (decoded) {
+            p = semicolon;
+        } else {
+            buffer_byte(out, *p);
+        }
+    }
+}
+
+// Moves past the given terminator, false if the document ends first
+static bool xml_skip_past(XmlParser* parser, const char* terminator) {
+    const char* end = strstr(parser->p, terminator);
+    if (!end) return false;
+    parser->p = end + strlen(terminator);
+    return true;
+}
+
+static char* xml_read_name(XmlParser* parser) {
+    const char* start = parser->p;
+    while (*parser->p && !isspace((unsigned char)*parser->p) && !strchr("/>=", *parser->p)) parser->p++;
+    if (parser->p == start) return NULL;
+    return strndup(start, parser->p - start);
+}
+
+static void xml_skip_space(XmlParser* parser) {
+    while (isspace((unsigned char)*parser->p)) parser->p++;
+}
+
+// Reads the element at parser->p, which is at its '<'
+static bool xml_parse_element(XmlParser* parser, XmlNode* node, int depth) {
+    memset(node, 0, sizeof(*node));
+    if (depth > XML_MAX_DEPTH) {
+        parser->error = "elements nested too deeply";
+        return false;
+    }
+    parser->p++;
+    node->name = xml_read_name(parser);
+    if (!node->name) {
+        parser->error = "expected an element name";
+        return false;
+    }
+
+    while (1) {
+        xml_skip_space(parser);
+        if (strncmp(parser->p, "/>", 2) == 0) {
+            parser->p += 2;
+            node->text = strdup("");
+            return true;
+        }
+        if (*parser->p == '>') {
+            parser->p++;
+            break;
+        }
+        char* name = xml_read_name(parser);
+        xml_skip_space(parser);
+        if (!name || *parser->p != '=') {
+            free(name);
+            parser->error = "malformed attribute";
+            return false;
+        }
+        parser->p++;
+        xml_skip_space(parser);
+        char quote = *parser->p;
+        const char* close = (quote == '"' || quote == '\'') ? strchr(parser->p + 1, quote) : NULL;
+        if (!close) {
+            free(name);
+            parser->error = "unquoted attribute value";
+            return false;
+        }
+        Buffer value = {0};
+        buffer_puts(&value, "");
+        xml_decode(&value, parser->p + 1, close - parser->p - 1);
+        parser->p = close + 1;
+
+        node->attributes = realloc(node->attributes, sizeof(char*) * 2 * (node->attribute_count + 1));
+        node->attributes[node->attribute_count * 2] = name;
+        node->attributes[node->attribute_count * 2 + 1] = value.data;
+        node->attribute_count++;
+    }
+
+    Buffer text = {0};
+    buffer_puts(&text, "");
+    while (1) {
+        if (!*parser->p) {
+            parser->error = "document ends inside an element";
+        } else if (strncmp(parser->p, "</", 2) == 0) {
+            parser->p += 2;
+            size_t length = strlen(node->name);
+            if (strncmp(parser->p, node->name, length) != 0 || !xml_skip_past(parser, ">")) {
+                parser->error = "mismatched closing tag";
+            } else {
+                // Patterns and numbers sit on lines of their own
+                size_t start = strspn(text.data, " \t\r\n");
+                while (text.length > start && isspace((unsigned char)text.data[text.length - 1])) {
+                    text.data[--text.length] = '\0';
+                }
+                memmove(text.data, text.data + start, text.length - start + 1);
+                node->text = text.data;
+                return true;
+            }
+        } else if (strncmp(parser->p, "<!--", 4) == 0) {
+            if (xml_skip_past(parser, "-->")) continue;
+            parser->error = "unterminated comment";
+        } else if (strncmp(parser->p, "<![CDATA[", 9) == 0) {
+            const char* end = strstr(parser->p + 9, "]]>");
+            if (end) {
+                buffer_append(&text, parser->p + 9, end - parser->p - 9);
+                parser->p = end + 3;
+                continue;
+            }
+            parser->error = "unterminated CDATA section";
+        } else if (strncmp(parser->p, "<?", 2) == 0) {
+            if (xml_skip_past(parser, "?>")) continue;
+            parser->error = "unterminated processing instruction";
+        } else if (*parser->p == '<') {
+            node->children = realloc(node->children, sizeof(XmlNode) * (node->count + 1));
+            if (xml_parse_element(parser, &node->children[node->count], depth + 1)) {
+                node->count++;
+                continue;
+            }
+            xml_free(&node->children[node->count]);
+        } else {
+            const char* start = parser->p;
+            while (*parser->p && *parser->p != '<') parser->p++;
+            xml_decode(&text, start, parser->p - start);
+            continue;
+        }
+        if (parser->error) break;
+    }
+    free(text.data);
+    return false;
+}
+
+// Parses a whole document into root, or sets error
+static bool xml_parse(const char* xml, XmlNode* root, char* error, size_t error_size) {
+    XmlParser parser = {xml, NULL};
+    if (strncmp(parser.p, "\xEF\xBB\xBF", 3) == 0) parser.p += 3;
+    while (1) {
+        xml_skip_space(&parser);
+        bool skipped = true;
+        if (strncmp(parser.p, "<?", 2) == 0) {
+            skipped = xml_skip_past(&parser, "?>");
+        } else if (strncmp(parser.p, "<!--", 4) == 0) {
+            skipped = xml_skip_past(&parser, "-->");
+        } else if (strncmp(parser.p, "<!DOCTYPE", 9) == 0) {
+            // An internal subset in [...] may hold '>'
+            const char* bracket = strchr(parser.p, '[');
+            const char* close = strchr(parser.p, '>');
+            if (bracket && close && bracket < close) {
+                parser.p = bracket;
+                skipped = xml_skip_past(&parser, "]");
+            }
+            skipped = skipped && xml_skip_past(&parser, ">");
+        } else {
+            break;
+        }
+        if (!skipped) {
+            snprintf(error, error_size, "unterminated markup before the root element");
+            return false;
+        }
+    }
+    if (*parser.p != '<') {
+        snprintf(error, error_size, "no root element");
+        return false;
+    }
+    if (!xml_parse_element(&parser, root, 0)) {
+        xml_free(root);
+        snprintf(error, error_size, "%s at byte %ld", parser.error, (long)(parser.p - xml));
+        return false;
+    }
+    return true;
+}
+
+static const char* xml_attribute(const XmlNode* node, const char* name) {
+    for (int i = 0; i < node->attribute_count; i++) {
+        if (strcmp(node->attributes[i * 2], name) == 0) return node->attributes[i * 2 + 1];
+    }
+    return NULL;
+}
+
+static const XmlNode* xml_child(const XmlNode* node, const char* name) {
+    for (int i = 0; i < node->count; i++) {
+        if (strcmp(node->children[i].name, name) == 0) return &node->children[i];
+    }
+    return NULL;
+}
+
+// The territories of a metadata document, whichever file it is
+static const XmlNode* xml_territories(const XmlNode* root, char* error, size_t error_size) {
+    const XmlNode* territories = xml_child(root, "territories");
+    if (strcmp(root->name, "phoneNumberMetadata") != 0 || !territories) {
+        snprintf(error, error_size, "expected a libphonenumber <phoneNumberMetadata> document");
+        return NULL;
+    }
+    return territories;
+}
+
+// ============= Patterns =============
+
+// Rewrites a libphonenumber (Java) regular expression as a POSIX ERE:
+// whitespace dropped, \d spelled out and (?: groups made plain groups.
+// Returns false for what ERE can't express, such as lookaheads.
+static bool convert_pattern(const char* pattern, Buffer* out) {
+    bool in_class = false;
+    buffer_puts(out, "");
+    for (const char* p = pattern; *p; p++) {
+        if (isspace((unsigned char)*p)) continue;
+        if (*p == '\\') {
+            p++;
+            if (*p == 'd') {
+                buffer_puts(out, in_class ? "0-9" : "[0-9]");
+            } else if (*p && strchr("+.*?(){}|", *p)) {
+                if (!in_class) buffer_byte(out, '\\');
+                buffer_byte(out, *p);
+            } else {
+                return false;
+            }
+        } else if (in_class) {
+            if (*p == ']') in_class = false;
+            buffer_byte(out, *p);
+        } else if (*p == '[') {
+            in_class = true;
+            buffer_byte(out, *p);
+        } else if (*p == '(' && p[1] == '?') {
+            if (p[2] != ':') return false;
+            buffer_byte(out, '(');
+            p += 2;
+        } else {
+            buffer_byte(out, *p);
+        }
+    }
+    return !in_class;
+}
+
+// Converts pattern and checks it compiles the way the numbering plan
+// loader will compile it. Returns a heap string, or NULL.
+static char* convert_checked(const char* pattern, bool whole_number) {
+    Buffer converted = {0};
+    if (!pattern || !convert_pattern(pattern, &converted) || !converted.length) {
+        free(converted.data);
+        return NULL;
+    }
+    Buffer anchored = {0};
+    buffer_printf(&anchored, whole_number ? "^(%s)$" : "^(%s)", converted.data);
+    regex_t regex;
+    bool compiled = regcomp(&regex, anchored.data, REG_EXTENDED | REG_NOSUB) == 0;
+    if (compiled) regfree(&regex);
+    free(anchored.data);
+    if (!compiled) {
+        free(converted.data);
+        return NULL;
+    }
+    return converted.data;
+}
+
+static void length_alternation(const char** p, int* min, int* max);
+
+// Adds the lengths of one atom and its quantifier at *p to a sequence
+static void length_atom(const char** p, int* sequence_min, int* sequence_max) {
+    int atom_min = 1;
+    int atom_max = 1;
+    char c = *(*p)++;
+    if (c == '\\') {
+        if (**p) (*p)++;
+    } else if (c == '[') {
+        while (**p && **p != ']') {
+            if (**p == '\\' && (*p)[1]) (*p)++;
+            (*p)++;
+        }
+        if (**p) (*p)++;
+    } else if (c == '(') {
+        if (**p == '?' && (*p)[1] == ':') *p += 2;
+        length_alternation(p, &atom_min, &atom_max);
+        if (**p == ')') (*p)++;
+    }
+
+    if (**p == '?') {
+        atom_min = 0;
+        (*p)++;
+    } else if (**p == '*') {
+        atom_min = 0;
+        atom_max = UNBOUNDED;
+        (*p)++;
+    } else if (**p == '+') {
+        atom_max = UNBOUNDED;
+        (*p)++;
+    } else if (**p == '{') {
+        char* end;
+        int low = strtol(*p + 1, &end, 10);
+        int high = low;
+        if (*end == ',') {
+            high = end[1] == '}' ? UNBOUNDED : strtol(end + 1, &end, 10);
+            if (*end == ',') end++;
+        }
+        if (*end == '}') end++;
+        *p = end;
+        atom_min *= low;
+        atom_max = atom_max * high > UNBOUNDED ? UNBOUNDED : atom_max * high;
+    }
+    *sequence_min += atom_min;
+    *sequence_max = *sequence_max + atom_max > UNBOUNDED ? UNBOUNDED : *sequence_max + atom_max;
+}
+
+// Shortest and longest strings the alternation at *p matches, counting
+// every atom as one digit. Stops at the ')' that closes it.
+static void length_alternation(const char** p, int* min, int* max) {
+    *min = UNBOUNDED;
+    *max = 0;
+    while (1) {
+        int sequence_min = 0;
+        int sequence_max = 0;
+        while (**p && **p != '|' && **p != ')') {
+            if (isspace((unsigned char)**p)) {
+                (*p)++;
+                continue;
+            }
+            length_atom(p, &sequence_min, &sequence_max);
+        }
+        if (sequence_min < *min) *min = sequence_min;
+        if (sequence_max > *max) *max = sequence_max;
+        if (**p != '|') break;
+        (*p)++;
+    }
+}
+
+// Length ranges of the capturing groups of a numberFormat pattern such as
+// (\d{3})(\d{3,4}). Returns how many there are, -1 if anything but
+// capturing groups makes up the pattern.
+static int format_groups(const char* pattern, int* mins, int* maxes) {
+    int count = 0;
+    const char* p = pattern;
+    while (*p) {
+        if (isspace((unsigned char)*p)) {
+            p++;
+            continue;
+        }
+        if (*p != '(' || p[1] == '?' || count == MAX_FORMAT_GROUPS) return -1;
+        p++;
+        length_alternation(&p, &mins[count], &maxes[count]);
+        if (*p != ')') return -1;
+        p++;
+        count++;
+    }
+    return count;
+}
+
+// Parses possibleLengths' national attribute, "[4-6],8" or "9", into the
+// range it spans. Returns false for "-1", which marks an unused type.
+static bool parse_possible_lengths(const char* lengths, int* min, int* max) {
+    *min = UNBOUNDED;
+    *max = 0;
+    for (const char* p = lengths; *p; ) {
+        if (*p == '[' || *p == ',' || *p == ']' || *p == '-' || isspace((unsigned char)*p)) {
+            // A leading '-' is the -1 marker, not a range
+            if (*p == '-' && p == lengths) return false;
+            p++;
+            continue;
+        }
+        char* end;
+        long length = strtol(p, &end, 10);
+        if (end == p) return false;
+        if (length < *min) *min = length;
+        if (length > *max) *max = length;
+        p = end;
+    }
+    return *max > 0;
+}
+
+// The digits of the first string pattern matches, following the first
+// branch of every alternation: "0(?:0|11)" gives "00". For dialling
+// prefixes, which are short and plain.
+static void first_expansion(const char** p, Buffer* out) {
+    while (**p && **p != '|' && **p != ')') {
+        char c = *(*p)++;
+        size_t before = out->length;
+        if (c == '\\') {
+            if (**p == 'd') buffer_byte(out, '0');
+            if (**p) (*p)++;
+        } else if (c == '[') {
+            if (**p && **p != ']') buffer_byte(out, **p);
+            while (**p && **p != ']') (*p)++;
+            if (**p) (*p)++;
+        } else if (c == '(') {
+            if (**p == '?' && (*p)[1] == ':') *p += 2;
+            first_expansion(p, out);
+            int depth = 0;
+            while (**p && (depth > 0 || **p != ')')) {
+                if (**p == '(') depth++;
+                if (**p == ')') depth--;
+                (*p)++;
+            }
+            if (**p) (*p)++;
+        } else if (isdigit((unsigned char)c)) {
+            buffer_byte(out, c);
+        }
+
+        if (**p == '{') {
+            int count = atoi(*p + 1);
+            while (**p && **p != '}') (*p)++;
+            if (**p) (*p)++;
+            size_t atom_length = out->length - before;
+            for (int i = 1; i < count && atom_length > 0; i++) {
+                buffer_append(out, out->data + before, atom_length);
+            }
+        } else if (**p && strchr("?*+", **p)) {
+            (*p)++;
+        }
+    }
+}
+
+// ============= Import =============
+
+// Number type elements, in the order libphonenumber's getNumberType()
+// tries them. The ones with no type here still count towards validity.
+static const struct {
+    const char* element;
+    PhoneNumberType type;
+} type_elements[] = {
+    {"premiumRate", PHONE_TYPE_PREMIUM_RATE},
+    {"tollFree", PHONE_TYPE_TOLL_FREE},
+    {"sharedCost", PHONE_TYPE_SHARED_COST},
+    {"voip", PHONE_TYPE_VOIP},
+    {"personalNumber", PHONE_TYPE_UNKNOWN},
+    {"pager", PHONE_TYPE_UNKNOWN},
+    {"uan", PHONE_TYPE_UNKNOWN},
+    {"voicemail", PHONE_TYPE_UNKNOWN},
+    {"fixedLine", PHONE_TYPE_FIXED_LINE},
+    {"mobile", PHONE_TYPE_MOBILE},
+};
+
+#define TYPE_ELEMENT_COUNT (sizeof(type_elements) / sizeof(type_elements[0]))
+
+typedef struct {
+    PhoneNumberType type;
+    char* pattern;          // Converted
+    const char* example;
+    regex_t regex;
+} ImportType;
+
+typedef struct {
+    const XmlNode* node;
+    const char* id;
+    int country_code;
+    bool main;              // Listed first among the regions of its country code
+    char international_prefix[16];
+    const char* national_prefix;
+    int min_length;
+    int max_length;
+    Buffer pattern;         // Every type's pattern, one alternative each
+    ImportType types[TYPE_ELEMENT_COUNT];
+    int type_count;
+} ImportRegion;
+
+// A type element libphonenumber uses for this territory, as opposed to an
+// empty or "NA" placeholder
+static const XmlNode* used_type(const XmlNode* territory, const char* element) {
+    const XmlNode* desc = xml_child(territory, element);
+    if (!desc) return NULL;
+    const XmlNode* pattern = xml_child(desc, "nationalNumberPattern");
+    if (!pattern || !pattern->text[0] || strcmp(pattern->text, "NA") == 0) {
+        return NULL;
+    }
+    const XmlNode* lengths = xml_child(desc, "possibleLengths");
+    const char* national = lengths ? xml_attribute(lengths, "national") : NULL;
+    int min, max;
+    if (national && !parse_possible_lengths(national, &min, &max)) return NULL;
+    return desc;
+}
+
+// Reads a territory's region record and number types. Returns false, with
+// a warning, for one the plan can't hold.
+static bool import_region(const XmlNode* territory, ImportRegion* region, FILE* warnings) {
+    memset(region, 0, sizeof(*region));
+    region->node = territory;
+    region->id = xml_attribute(territory, "id");
+    const char* country_code = xml_attribute(territory, "countryCode");
+    if (!region->id || !country_code) {
+        fprintf(warnings, "skipped a territory without id or countryCode\n");
+        return false;
+    }
+    if (strcmp(region->id, "001") == 0) {
+        fprintf(warnings, "skipped non-geographic entity +%s\n", country_code);
+        return false;
+    }
+    region->country_code = atoi(country_code);
+    if (strlen(region->id) != 2 || region->country_code <= 0) {
+        fprintf(warnings, "skipped %s: invalid id or country code\n", region->id);
+        return false;
+    }
+    region->main = xml_attribute(territory, "mainCountryForCode") &&
+                   strcmp(xml_attribute(territory, "mainCountryForCode"), "true") == 0;
+    region->national_prefix = xml_attribute(territory, "nationalPrefix");
+    if (!region->national_prefix) region->national_prefix = "";
+
+    // A prefix given as a pattern has a preferred form to dial, or else its
+    // first
+    const char* idd = xml_attribute(territory, "preferredInternationalPrefix");
+    if (!idd) idd = xml_attribute(territory, "internationalPrefix");
+    Buffer prefix = {0};
+    buffer_puts(&prefix, "");
+    if (idd) first_expansion(&idd, &prefix);
+    snprintf(region->international_prefix, sizeof(region->international_prefix), "%s",
+             prefix.length ? prefix.data : "00");
+    free(prefix.data);
+
+    region->min_length = UNBOUNDED;
+    for (size_t i = 0; i < TYPE_ELEMENT_COUNT; i++) {
+        const XmlNode* desc = used_type(territory, type_elements[i].element);
+        if (!desc) continue;
+        const char* source = xml_child(desc, "nationalNumberPattern")->text;
+        char* pattern = convert_checked(source, true);
+        if (!pattern) {
+            fprintf(warnings, "%s: left out %s, its pattern isn't a POSIX ERE\n", region->id,
+                    type_elements[i].element);
+            continue;
+        }
+
+        const XmlNode* lengths = xml_child(desc, "possibleLengths");
+        const char* national = lengths ? xml_attribute(lengths, "national") : NULL;
+        int min, max;
+        if (!national || !parse_possible_lengths(national, &min, &max)) {
+            const char* p = source;
+            length_alternation(&p, &min, &max);
+        }
+        if (min < region->min_length) region->min_length = min;
+        if (max > region->max_length) region->max_length = max;
+
+        if (region->pattern.length) buffer_byte(&region->pattern, '|');
+        buffer_puts(&region->pattern, pattern);
+
+        if (type_elements[i].type == PHONE_TYPE_UNKNOWN) {
+            free(pattern);
+            continue;
+        }
+        // Plans that give fixed lines and mobiles the same pattern don't
+        // tell them apart
+        ImportType* fixed = region->type_count > 0 ? &region->types[region->type_count - 1] : NULL;
+        if (type_elements[i].type == PHONE_TYPE_MOBILE && fixed && fixed->type == PHONE_TYPE_FIXED_LINE &&
+            strcmp(fixed->pattern, pattern) == 0) {
+            fixed->type = PHONE_TYPE_FIXED_LINE_OR_MOBILE;
+            free(pattern);
+            continue;
+        }
+        ImportType* type = &region->types[region->type_count++];
+        type->type = type_elements[i].type;
+        type->pattern = pattern;
+        const XmlNode* example = xml_child(desc, "exampleNumber");
+        type->example = example ? example->text : NULL;
+    }
+
+    if (!region->pattern.length) {
+        fprintf(warnings, "skipped %s: no number type with a usable pattern\n", region->id);
+        return false;
+    }
+    if (region->min_length < 1 || region->max_length > PHONE_MAX_NATIONAL_LENGTH) {
+        fprintf(warnings, "skipped %s: lengths %d to %d don't fit a national number\n", region->id,
+                region->min_length, region->max_length);
+        return false;
+    }
+    for (int i = 0; i < region->type_count; i++) {
+        Buffer whole = {0};
+        buffer_printf(&whole, "^(%s)$", region->types[i].pattern);
+        regcomp(&region->types[i].regex, whole.data, REG_EXTENDED | REG_NOSUB);
+        free(whole.data);
+    }
+    return true;
+}
+
+static void free_region(ImportRegion* region) {
+    for (int i = 0; i < region->type_count; i++) {
+        free(region->types[i].pattern);
+        regfree(&region->types[i].regex);
+    }
+    free(region->pattern.data);
+}
+
+// Whether the plan will classify example as type, as the loader insists
+static bool example_holds(const ImportRegion* region, const ImportType* type, const char* example) {
+    int length = strlen(example);
+    if (!length || strspn(example, "0123456789") != (size_t)length ||
+        length < region->min_length || length > region->max_length) {
+        return false;
+    }
+    for (int i = 0; i < region->type_count; i++) {
+        if (regexec(&region->types[i].regex, example, 0, NULL, 0) == 0) {
+            return &region->types[i] == type;
+        }
+    }
+    return false;
+}
+
+// Replaces the first "$1" of format with the national prefix formatting
+// rule, "$NP$FG" or "($NP $FG)" and the like
+static void apply_national_rule(const char* format, const char* rule, const char* national_prefix,
+                                Buffer* out) {
+    buffer_puts(out, "");
+    const char* first = strstr(format, "$1");
+    if (!rule || !first) {
+        buffer_puts(out, format);
+        return;
+    }
+    buffer_append(out, format, first - format);
+    for (const char* p = rule; *p; p++) {
+        if (strncmp(p, "$NP", 3) == 0) {
+            buffer_puts(out, national_prefix);
+            p += 2;
+        } else if (strncmp(p, "$FG", 3) == 0) {
+            buffer_puts(out, "$1");
+            p += 2;
+        } else {
+            buffer_byte(out, *p);
+        }
+    }
+    buffer_puts(out, first + 2);
+}
+
+// Writes format with every $N replaced by an X for each digit of group N
+static void expand_template(const char* format, const int* lengths, int group_count, Buffer* out) {
+    buffer_puts(out, "");
+    for (const char* p = format; *p; p++) {
+        if (*p == '$' && p[1] >= '1' && p[1] - '1' < group_count) {
+            for (int i = 0; i < lengths[p[1] - '1']; i++) buffer_byte(out, 'X');
+            p++;
+        } else if (*p != ';' && *p != '\n') {
+            buffer_byte(out, *p);
+        }
+    }
+}
+
+// One format record per national number length the numberFormat covers,
+// each group taking as many digits as it can, as the pattern would
+static void import_format(const ImportRegion* region, const XmlNode* number_format, const char* rule,
+                          Buffer* plan, FILE* warnings) {
+    const char* pattern = xml_attribute(number_format, "pattern");
+    const XmlNode* format = xml_child(number_format, "format");
+    if (!pattern || !format) return;
+    int mins[MAX_FORMAT_GROUPS];
+    int maxes[MAX_FORMAT_GROUPS];
+    int group_count = format_groups(pattern, mins, maxes);
+    if (group_count <= 0) {
+        fprintf(warnings, "%s: left out format %s, it has digits outside its groups\n", region->id, pattern);
+        return;
+    }
+
+    // The last leadingDigits is the most specific
+    const char* leading_source = NULL;
+    for (int i = 0; i < number_format->count; i++) {
+        if (strcmp(number_format->children[i].name, "leadingDigits") == 0) {
+            leading_source = number_format->children[i].text;
+        }
+    }
+    char* leading = convert_checked(leading_source ? leading_source : pattern, false);
+    if (!leading) {
+        fprintf(warnings, "%s: left out format %s, its leading digits aren't a POSIX ERE\n", region->id,
+                pattern);
+        return;
+    }
+
+    const char* rule_attribute = xml_attribute(number_format, "nationalPrefixFormattingRule");
+    if (rule_attribute) rule = rule_attribute;
+    const XmlNode* intl = xml_child(number_format, "intlFormat");
+    // An intlFormat of NA keeps the format out of international numbers,
+    // which the plan has no way to say; they get the national layout
+    const char* international = intl && strcmp(intl->text, "NA") != 0 ? intl->text : format->text;
+    Buffer national = {0};
+    apply_national_rule(format->text, rule, region->national_prefix, &national);
+
+    int total_min = 0;
+    int total_max = 0;
+    for (int i = 0; i < group_count; i++) {
+        total_min += mins[i];
+        total_max += maxes[i];
+    }
+    if (total_min < region->min_length) total_min = region->min_length;
+    if (total_max > region->max_length) total_max = region->max_length;
+    for (int length = total_min; length <= total_max; length++) {
+        int lengths[MAX_FORMAT_GROUPS];
+        int left = length;
+        for (int i = 0; i < group_count; i++) left -= mins[i];
+        for (int i = 0; i < group_count; i++) {
+            int extra = maxes[i] - mins[i] < left ? maxes[i] - mins[i] : left;
+            lengths[i] = mins[i] + extra;
+            left -= extra;
+        }
+        if (left > 0) continue;
+
+        Buffer intl_template = {0};
+        Buffer national_template = {0};
+        expand_template(international, lengths, group_count, &intl_template);
+        expand_template(national.data, lengths, group_count, &national_template);
+        // Left empty where it's the national prefix and the international
+        // layout, which is what an empty field means
+        Buffer implied = {0};
+        buffer_printf(&implied, "%s%s", region->national_prefix, intl_template.data);
+        buffer_printf(plan, "format;%s;%s;%s;%s\n", region->id, leading, intl_template.data,
+                      strcmp(implied.data, national_template.data) == 0 ? "" : national_template.data);
+        free(implied.data);
+        free(intl_template.data);
+        free(national_template.data);
+    }
+    free(national.data);
+    free(leading);
+}
+
+// The formats of region, which libphonenumber takes from the main region
+// of its country code when it has none of its own
+static void import_formats(const ImportRegion* region, const ImportRegion* regions, int region_count,
+                           Buffer* plan, FILE* warnings) {
+    const XmlNode* formats = xml_child(region->node, "availableFormats");
+    const XmlNode* territory = region->node;
+    for (int i = 0; !formats && i < region_count; i++) {
+        if (regions[i].main && regions[i].country_code == region->country_code) {
+            territory = regions[i].node;
+            formats = xml_child(territory, "availableFormats");
+        }
+    }
+    if (!formats) return;
+    const char* rule = xml_attribute(territory, "nationalPrefixFormattingRule");
+    for (int i = 0; i < formats->count; i++) {
+        if (strcmp(formats->children[i].name, "numberFormat") == 0) {
+            import_format(region, &formats->children[i], rule, plan, warnings);
+        }
+    }
+}
+
+static const ImportRegion* find_import_region(const ImportRegion* regions, int count, const char* id) {
+    for (int i = 0; i < count; i++) {
+        if (strcmp(regions[i].id, id) == 0) return &regions[i];
+    }
+    return NULL;
+}
+
+// Emergency numbers and short codes of ShortNumberMetadata.xml
+static bool import_short_codes(const char* xml, const ImportRegion* regions, int region_count,
+                               Buffer* plan, FILE* warnings, char* error, size_t error_size) {
+    XmlNode root;
+    if (!xml_parse(xml, &root, error, error_size)) return false;
+    const XmlNode* territories = xml_territories(&root, error, error_size);
+    if (!territories) {
+        xml_free(&root);
+        return false;
+    }
+    static const struct { const char* element; const char* type; } short_elements[] = {
+        {"emergency", "emergency"}, {"shortCode", "short_code"},
+    };
+    for (int i = 0; i < territories->count; i++) {
+        const XmlNode* territory = &territories->children[i];
+        const char* id = xml_attribute(territory, "id");
+        if (!id || !find_import_region(regions, region_count, id)) continue;
+        for (size_t j = 0; j < sizeof(short_elements) / sizeof(short_elements[0]); j++) {
+            const XmlNode* desc = used_type(territory, short_elements[j].element);
+            if (!desc) continue;
+            char* pattern = convert_checked(xml_child(desc, "nationalNumberPattern")->text, true);
+            if (!pattern) {
+                fprintf(warnings, "%s: left out %s short codes, their pattern isn't a POSIX ERE\n", id,
+                        short_elements[j].element);
+                continue;
+            }
+            buffer_printf(plan, "short;%s;%s;%s\n", id, short_elements[j].type, pattern);
+            free(pattern);
+        }
+    }
+    xml_free(&root);
+    return true;
+}
+
+// Copies the records of merge that libphonenumber has no equivalent of,
+// for the regions imported
+static void merge_records(const char* merge, bool with_short, const ImportRegion* regions,
+                          int region_count, Buffer* plan) {
+    const char* kinds[] = {"geo;", "tz;", "risk;", "short;"};
+    int kind_count = with_short ? 4 : 3;
+    for (const char* line = merge; *line; ) {
+        const char* end = strchr(line, '\n');
+        size_t length = end ? (size_t)(end - line) : strlen(line);
+        for (int i = 0; i < kind_count; i++) {
+            size_t kind_length = strlen(kinds[i]);
+            char id[3] = {0};
+            if (length > kind_length + 2 && strncmp(line, kinds[i], kind_length) == 0 &&
+                line[kind_length + 2] == ';') {
+                memcpy(id, line + kind_length, 2);
+                if (find_import_region(regions, region_count, id)) {
+                    buffer_append(plan, line, length);
+                    buffer_byte(plan, '\n');
+                }
+            }
+        }
+        line = end ? end + 1 : line + length;
+    }
+}
+
+char* metadata_import(const char* xml, const MetadataImportOptions* options, FILE* warnings,
+                      char* error, size_t error_size) {
+    XmlNode root;
+    if (!xml_parse(xml, &root, error, error_size)) return NULL;
+    const XmlNode* territories = xml_territories(&root, error, error_size);
+    if (!territories) {
+        xml_free(&root);
+        return NULL;
+    }
+
+    ImportRegion* regions = calloc(territories->count + 1, sizeof(ImportRegion));
+    int region_count = 0;
+    for (int i = 0; i < territories->count; i++) {
+        if (strcmp(territories->children[i].name, "territory") != 0) continue;
+        if (import_region(&territories->children[i], &regions[region_count], warnings)) {
+            region_count++;
+        } else {
+            free_region(&regions[region_count]);
+        }
+    }
+    // A region alone on its country code is its main region whether or not
+    // it says so
+    for (int i = 0; i < region_count; i++) {
+        bool shared = false;
+        for (int j = 0; j < region_count; j++) {
+            shared |= j != i && regions[j].country_code == regions[i].country_code;
+        }
+        if (!shared) regions[i].main = true;
+    }
+
+    Buffer plan = {0};
+    buffer_puts(&plan, "# Numbering plan imported from libphonenumber's PhoneNumberMetadata.xml\n");
+    buffer_puts(&plan, "# by phone-validator metadata-import; see numbering_plan.txt for the format.\n\n");
+    buffer_printf(&plan, "version;%s\n\n", options && options->version ? options->version : "libphonenumber");
+
+    // Main regions first, since the first region listed for a country code
+    // is its main region
+    for (int pass = 0; pass < 2; pass++) {
+        for (int i = 0; i < region_count; i++) {
+            const ImportRegion* region = &regions[i];
+            if (region->main != (pass == 0)) continue;
+            buffer_printf(&plan, "region;%s;%d;%s;%s;%d;%d;%s\n", region->id, region->country_code,
+                          region->international_prefix, region->national_prefix, region->min_length,
+                          region->max_length, region->pattern.data);
+        }
+    }
+
+    for (int i = 0; i < region_count; i++) {
+        const ImportRegion* region = &regions[i];
+        buffer_puts(&plan, "\n");
+        for (int j = 0; j < region->type_count; j++) {
+            buffer_printf(&plan, "type;%s;%s;%s\n", region->id, phone_type_string(region->types[j].type),
+                          region->types[j].pattern);
+        }
+        for (int j = 0; j < region->type_count; j++) {
+            const ImportType* type = &region->types[j];
+            if (!type->example) continue;
+            if (!example_holds(region, type, type->example)) {
+                fprintf(warnings, "%s: left out %s example %s, the plan doesn't classify it as one\n",
+                        region->id, phone_type_string(type->type), type->example);
+                continue;
+            }
+            buffer_printf(&plan, "example;%s;%s;%s\n", region->id, phone_type_string(type->type),
+                          type->example);
+        }
+        import_formats(region, regions, region_count, &plan, warnings);
+    }
+
+    bool ok = true;
+    if (options && options->short_xml) {
+        buffer_puts(&plan, "\n");
+        ok = import_short_codes(options->short_xml, regions, region_count, &plan, warnings, error,
+                                error_size);
+    }
+    if (ok && options && options->merge) {
+        buffer_puts(&plan, "\n");
+        merge_records(options->merge, !options->short_xml, regions, region_count, &plan);
+    }
+
+    for (int i = 0; i < region_count; i++) free_region(&regions[i]);
+    free(regions);
+    xml_free(&root);
+
+    char load_error[256];
+    if (ok && !phone_load_metadata(plan.data, load_error, sizeof(load_error))) {
+        snprintf(error, error_size, "the imported plan doesn't load: %s", load_error);
+        ok = false;
+    }
+    if (!ok) {
+        free(plan.data);
+        return NULL;
+    }
+    return plan.data;
+}
+
+// ============= Compatibility Checks =============
+
+bool metadata_check_examples(const char* xml, FILE* out, MetadataCheckReport* report,
+                             char* error, size_t error_size) {
+    XmlNode root;
+    if (!xml_parse(xml, &root, error, error_size)) return false;
+    const XmlNode* territories = xml_territories(&root, error, error_size);
+    if (!territories) {
+        xml_free(&root);
+        return false;
+    }
+
+    for (int i = 0; i < territories->count; i++) {
+        const XmlNode* territory = &territories->children[i];
+        const char* id = xml_attribute(territory, "id");
+        const char* country_code = xml_attribute(territory, "countryCode");
+        if (!id || !country_code || strcmp(id, "001") == 0) continue;
+
+        for (size_t j = 0; j < TYPE_ELEMENT_COUNT; j++) {
+            const XmlNode* desc = used_type(territory, type_elements[j].element);
+            const XmlNode* example = desc ? xml_child(desc, "exampleNumber") : NULL;
+            if (!example) continue;
+            PhoneNumberType expected = type_elements[j].type;
+
+            char raw[64];
+            snprintf(raw, sizeof(raw), "+%s%s", country_code, example->text);
+            PhoneNumber number;
+            PhoneError err = phone_parse(raw, NULL, &number);
+            PhoneNumberType type = err == PHONE_OK ? phone_get_type(&number) : PHONE_TYPE_UNKNOWN;
+            // libphonenumber itself calls a fixed line or mobile example
+            // fixed_line_or_mobile when the other pattern matches it too
+            bool type_matches = type == expected ||
+                                (type == PHONE_TYPE_FIXED_LINE_OR_MOBILE &&
+                                 (expected == PHONE_TYPE_FIXED_LINE || expected == PHONE_TYPE_MOBILE));
+
+            report->checked++;
+            if (err != PHONE_OK) {
+                fprintf(out, "%s %s example %s: %s\n", id, type_elements[j].element, raw,
+                        phone_error_string(err));
+            } else if (!number.valid || strcmp(number.region, id) != 0 || !type_matches) {
+                fprintf(out, "%s %s example %s: got valid=%s region=%s type=%s\n", id,
+                        type_elements[j].element, raw, number.valid ? "true" : "false",
+                        number.region[0] ? number.region : "none", phone_type_string(type));
+            } else {
+                continue;
+            }
+            report->mismatches++;
+        }
+    }
+    xml_free(&root);
+    return true;
+}
+
+// Splits a CSV line of plain fields, no quoting, in place
+static int split_csv(char* line, char** fields, int max_fields) {
+    int count = 0;
+    fields[count++] = line;
+    for (char* p = line; *p && count < max_fields; p++) {
+        if (*p == ',') {
+            *p = '\0';
+            fields[count++] = p + 1;
+        }
+    }
+    return count;
+}
+
+bool metadata_check_corpus(const char* csv, FILE* out, MetadataCheckReport* report,
+                           char* error, size_t error_size) {
+    char* copy = strdup(csv);
+    int line_number = 0;
+    bool ok = true;
+    char* line = copy;
+    while (line && ok) {
+        char* next = strchr(line, '\n');
+        if (next) *next++ = '\0';
+        line_number++;
+        line[strcspn(line, "\r")] = '\0';
+        if (line_number == 1 || !line[0] || line[0] == '#') {
+            line = next;
+            continue;
+        }
+
+        char* fields[5];
+        if (split_csv(line, fields, 5) != 5 ||
+            (strcmp(fields[2], "true") != 0 && strcmp(fields[2], "false") != 0)) {
+            snprintf(error, error_size, "line %d: expected number,region,valid,type,e164", line_number);
+            ok = false;
+            break;
+        }
+        bool expected_valid = strcmp(fields[2], "true") == 0;
+        // Types the plan doesn't have, such as uan or pager, come out unknown
+        PhoneNumberType expected = phone_type_from_string(fields[3]);
+
+        PhoneNumber number;
+        PhoneError err = phone_parse(fields[0], fields[1][0] ? fields[1] : NULL, &number);
+        bool valid = err == PHONE_OK && number.valid;
+        PhoneNumberType type = valid ? phone_get_type(&number) : PHONE_TYPE_UNKNOWN;
+        char e164[PHONE_MAX_FORMATTED_LENGTH] = "";
+        if (err == PHONE_OK && number.country_code) {
+            phone_format(&number, PHONE_FORMAT_E164, e164, sizeof(e164));
+        }
+
+        report->checked++;
+        if (valid != expected_valid || (expected_valid && type != expected) ||
+            (fields[4][0] && valid && strcmp(e164, fields[4]) != 0)) {
+            fprintf(out, "line %d %s (%s): expected valid=%s type=%s e164=%s, got valid=%s type=%s e164=%s\n",
+                    line_number, fields[0], fields[1][0] ? fields[1] : "no region", fields[2],
+                    fields[3], fields[4][0] ? fields[4] : "none", valid ? "true" : "false",
+                    phone_type_string(type), e164[0] ? e164 : "none");
+            report->mismatches++;
+        }
+        line = next;
+    }
+    free(copy);
+    return ok;
+}
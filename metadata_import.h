@@ -0,0 +1,52 @@
+#ifndef METADATA_IMPORT_H
+#define METADATA_IMPORT_H
+
+#include <stdbool.h>
+#include <stddef.h>
+#include <stdio.h>
+
+// Conversion of Google's libphonenumber metadata (PhoneNumberMetadata.xml
+// and ShortNumberMetadata.xml from its resources directory) into the
+// records of numbering_plan.txt, and checks of the result against
+// libphonenumber's own answers.
+
+typedef struct {
+    const char* short_xml;  // ShortNumberMetadata.xml, NULL for no short records
+    // A numbering plan whose geo, tz and risk records, and short records
+    // when short_xml is NULL, are kept for the regions imported. NULL for
+    // none.
+    const char* merge;
+    const char* version;    // NULL for "libphonenumber"
+} MetadataImportOptions;
+
+// Converts xml, the text of PhoneNumberMetadata.xml, to a numbering plan.
+// Patterns become POSIX EREs, formats become one template per length they
+// cover, and a region is valid where any of its number types is, as in
+// libphonenumber. Whatever can't be carried over (non-geographic entities,
+// patterns ERE can't express, examples the plan would classify
+// differently) is left out with a line to warnings. The plan is loaded
+// once to check it, so it replaces the metadata in use. Returns a heap
+// string to free(), or NULL with error set.
+char* metadata_import(const char* xml, const MetadataImportOptions* options, FILE* warnings,
+                      char* error, size_t error_size);
+
+typedef struct {
+    int checked;
+    int mismatches;
+} MetadataCheckReport;
+
+// Parses every example number of xml against the metadata in use, which
+// should find it valid, in the example's region and of its type. Writes a
+// line per mismatch to out.
+bool metadata_check_examples(const char* xml, FILE* out, MetadataCheckReport* report,
+                             char* error, size_t error_size);
+
+// Checks each row of csv, "number,region,valid,type,e164" with a header
+// line, as libphonenumber answered it: number parsed with region as the
+// default region, valid true or false, type as libphonenumber names it in
+// lowercase, e164 empty where libphonenumber gave none. Writes a line per
+// mismatch to out.
+bool metadata_check_corpus(const char* csv, FILE* out, MetadataCheckReport* report,
+                           char* error, size_t error_size);
+
+#endif
@@ -0,0 +1,672 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+#include <pthread.h>
+
+#include "metrics.h"
+
+// Upper bounds in seconds, shared by every histogram
+static const double buckets[] = {0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5};
+
+#define BUCKET_COUNT (int)(sizeof(buckets) / sizeof(buckets[0]))
+
+// One label combination of a metric. Counters and gauges only use count.
+typedef struct {
+    char labels[192];       // Rendered, e.g. method="GET",route="/"
+    unsigned long bucket_counts[BUCKET_COUNT];
+    double sum;
+    unsigned long count;
+} Series;
+
+typedef struct {
+    const char* name;
+    const char* help;
+    bool histogram;
+    Series* series;
+    int series_count;
+    int series_capacity;
+    bool gauge;             // Set rather than counted up
+} Family;
+
+static Family requests_total = {
+    "http_requests_total", "HTTP requests by method, route and status.", false, NULL, 0, 0, false};
+static Family request_duration = {
+    "http_request_duration_seconds", "HTTP request latency by method and route.",
+    true, NULL, 0, 0, false};
+static Family validations_total = {
+    "phone_validations_total", "Validated numbers by region and validity.", false, NULL, 0, 0, false};
+static Family store_duration = {
+    "store_operation_duration_seconds", "Store operation latency.", true, NULL, 0, 0, false};
+static Family store_errors_total = {
+    "store_errors_total", "Store operations that failed.", false, NULL, 0, 0, false};
+static Family cache_lookups_total = {
+    "validation_cache_lookups_total", "Validation result cache lookups by result (hit or miss).",
+    false, NULL, 0, 0, false};
+static Family tenant_validations_total = {
+    "tenant_validations_total", "Validated numbers by tenant, counted against its monthly quota.",
+    false, NULL, 0, 0, false};
+static Family quota_rejections_total = {
+    "tenant_quota_rejections_total", "Requests refused because the tenant's monthly quota was used up.",
+    false, NULL, 0, 0, false};
+
+static Family provider_calls_total = {
+    "provider_calls_total",
+    "Calls to carrier, caller name and SMS providers by result "
+    "(ok, error or rejected by the breaker).",
+    false, NULL, 0, 0, false};
+static Family provider_retries_total = {
+    "provider_retries_total", "Provider calls tried again after a failed attempt.",
+    false, NULL, 0, 0, false};
+static Family breaker_state = {
+    "provider_circuit_breaker_state",
+    "1 for the state each provider's circuit breaker is in (closed, open or half_open), else 0.",
+    false, NULL, 0, 0, true};
+
+static Family* families[] = {
+    &requests_total, &request_duration, &validations_total, &store_duration, &store_errors_total,
+    &cache_lookups_total, &tenant_validations_total, &quota_rejections_total,
+    &provider_calls_total, &provider_retries_total, &breaker_state,
+};
+
+#define FAMILY_COUNT (int)(sizeof(families) / sizeof(families[0]))
+
+static pthread_mutex_t metrics_lock = PTHREAD_MUTEX_INITIALIZER;
+
+double metrics_now(void) {
+    struct timespec now;
+    clock_gettime(CLOCK_MONOTONIC, &now);
+    return now.tv_sec + now.tv_nsec / 1e9;
+}
+
+// Finds or creates the series for labels. Caller holds metrics_lock.
+static Series* get_series(Family* family, const char* labels) {
+    for (int i = 0; i < family->series_count; i++) {
+        if (strcmp(family->series[i].labels, labels) == 0) {
+            return &family->series[i];
+        }
+    }
+
+    if (family->series_count == family->series_capacity) {
+        family->series_capacity = family->series_capacity ? family->series_capacity * 2 : 16;
+        family->series = realloc(family->series, sizeof(Series) * family->series_capacity);
+    }
+    Series* series = &family->series[family->series_count++];
+    memset(series, 0, sizeof(Series));
+    snprintf(series->labels, sizeof(series->labels), "%s", labels);
+    return series;
+}
+
+static void add(Family* family, const char* labels, unsigned long count) {
+    pthread_mutex_lock(&metrics_lock);
+    get_series(family, labels)->count += count;
+    pthread_mutex_unlock(&metrics_lock);
+}
+
+static void increment(Family* family, const char* labels) {
+    add(family, labels, 1);
+}
+
+static void observe(Family* family, const char* labels, double seconds) {
+    pthread_mutex_lock(&metrics_lock);
+    Series* series = get_series(family, labels);
+    for (int i = 0; i < BUCKET_COUNT; i++) {
+        if (seconds <= buckets[i]) series->bucket_counts[i]++;
+    }
+    series->sum += seconds;
+    series->count++;
+    pthread_mutex_unlock(&metrics_lock);
+}
+
+void metrics_observe_request(const char* method, const char* route, int status, double seconds) {
+    char labels[192];
+    snprintf(labels, sizeof(labels), "method=\"%s\",route=\"%s\",status=\"%d\"", method, route, status);
+    increment(&requests_total, labels);
+
+    snprintf(labels, sizeof(labels), "method=\"%s\",route=\"%s\"", method, route);
+    observe(&request_duration, labels, seconds);
+}
+
+void metrics_count_validation(const char* region, bool valid) {
+    char labels[192];
+    snprintf(labels, sizeof(labels), "region=\"%s\",valid=\"%s\"",
+             region[0] ? region : "unknown", valid ? "true" : "false");
+    increment(&validations_total, labels);
+}
+
+void metrics_count_cache_lookup(bool hit) {
+    increment(&cache_lookups_total, hit ? "result=\"hit\"" : "result=\"miss\"");
+}
+
+void metrics_count_tenant_validations(int tenant_id, int count) {
+    char labels[192];
+    snprintf(labels, sizeof(labels), "tenant=\"%d\"", tenant_id);
+    add(&tenant_validations_total, labels, count);
+}
+
+void metrics_count_quota_rejection(int tenant_id) {
+    char labels[192];
+    snprintf(labels, sizeof(labels), "tenant=\"%d\"", tenant_id);
+    increment(&quota_rejections_total, labels);
+}
+
+void metrics_count_provider_call(const char* kind, const char* provider, const char* result) {
+    char labels[192];
+    snprintf(labels, sizeof(labels), "kind=\"%s\",provider=\"%s\",result=\"%s\"", kind, provider,
+             result);
+    increment(&provider_calls_total, labels);
+}
+
+void metrics_count_provider_retry(const char* kind, const char* provider) {
+    char labels[192];
+    snprintf(labels, sizeof(labels), "kind=\"%s\",provider=\"%s\"", kind, provider);
+    increment(&provider_retries_total, labels);
+}
+
+void metrics_set_breaker_state(const char* kind, const char* provider, BreakerState state) {
+    pthread_mutex_lock(&metrics_lock);
+    for (int s = BREAKER_CLOSED; s <= BREAKER_HALF_OPEN; s++) {
+        char labels[192];
+        snprintf(labels, sizeof(labels), "kind=\"%s\",provider=\"%s\",state=\"%s\"", kind,
+                 provider, breaker_state_string(s));
+        get_series(&breaker_state, labels)->count = s == (int)state;
+    }
+    pthread_mutex_unlock(&metrics_lock);
+}
+
+void metrics_observe_store(const char* operation, StoreResult result, double seconds) {
+    char labels[192];
+    snprintf(labels, sizeof(labels), "operation=\"%s\"", operation);
+    observe(&store_duration, labels, seconds);
+    if (result == STORE_ERROR) {
+        increment(&store_errors_total, labels);
+    }
+}
+
+char* metrics_render(void) {
+    char* text = NULL;
+    size_t size = 0;
+    FILE* out = open_memstream(&text, &size);
+
+    pthread_mutex_lock(&metrics_lock);
+    for (int f = 0; f < FAMILY_COUNT; f++) {
+        Family* family = families[f];
+        fprintf(out, "# HELP %s %s\n", family->name, family->help);
+        fprintf(out, "# TYPE %s %s\n", family->name,
+                family->histogram ? "histogram" : family->gauge ? "gauge" : "counter");
+
+        for (int i = 0; i < family->series_count; i++) {
+            Series* series = &family->series[i];
+            if (!family->histogram) {
+                fprintf(out, "%s{%s} %lu\n", family->name, series->labels, series->count);
+                continue;
+            }
+            for (int b = 0; b < BUCKET_COUNT; b++) {
+                fprintf(out, "%s_bucket{%s,le=\"%g\"} %lu\n",
+                        family->name, series->labels, buckets[b], series->bucket_counts[b]);
+            }
+            fprintf(out, "%s_bucket{%s,le=\"+Inf\"} %lu\n", family->name, series->labels, series->count);
+            fprintf(out, "%s_sum{%s} %.6f\n", family->name, series->labels, series->sum);
+            fprintf(out, "%s_count{%s} %lu\n", family->name, series->labels, series->count);
+        }
+    }
+    pthread_mutex_unlock(&metrics_lock);
+
+    fclose(out);
+    return text;
+}
+
+// Caller holds metrics_lock
+static unsigned long sum_counts(const Family* family, const char* label) {
+    unsigned long total = 0;
+    for (int i = 0; i < family->series_count; i++) {
+        if (!label || strstr(family->series[i].labels, label)) total += family->series[i].count;
+    }
+    return total;
+}
+
+void metrics_summary(MetricsSummary* summary) {
+    pthread_mutex_lock(&metrics_lock);
+    summary->requests = sum_counts(&requests_total, NULL);
+    summary->server_errors = sum_counts(&requests_total, "status=\"5");
+    summary->validations = sum_counts(&validations_total, NULL);
+    summary->invalid = sum_counts(&validations_total, "valid=\"false\"");
+    summary->store_errors = sum_counts(&store_errors_total, NULL);
+    pthread_mutex_unlock(&metrics_lock);
+}
+
+// ============= Instrumented Store =============
+
+static Store* inner_store(Store* store) {
+    return store->data;
+}
+
+static StoreResult timed_create(Store* store, const Context* ctx, User* user) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->create(inner_store(store), ctx, user);
+    metrics_observe_store("create", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_get(Store* store, const Context* ctx, int id, User* user) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->get(inner_store(store), ctx, id, user);
+    metrics_observe_store("get", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_list(Store* store, const Context* ctx, const UserFilter* filter,
+                              User** users, int* count, int* total) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->list(inner_store(store), ctx, filter, users, count,
+                                                  total);
+    metrics_observe_store("list", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_update(Store* store, const Context* ctx, const User* user) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->update(inner_store(store), ctx, user);
+    metrics_observe_store("update", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_link_user(Store* store, const Context* ctx, int id, int wp_id,
+                                   const char* wp_phone) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->link_user(inner_store(store), ctx, id, wp_id,
+                                                       wp_phone);
+    metrics_observe_store("link_user", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_flag_phone(Store* store, const Context* ctx, int id, const char* phone,
+                                    long long invalid_since, const char* reason) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->flag_phone(inner_store(store), ctx, id, phone,
+                                                        invalid_since, reason);
+    metrics_observe_store("flag_phone", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_rewrite_user(Store* store, const Context* ctx, const User* from,
+                                      const User* to) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->rewrite_user(inner_store(store), ctx, from, to);
+    metrics_observe_store("rewrite_user", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_find_duplicate(Store* store, const Context* ctx, const User* user,
+                                        User* existing) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->find_duplicate(inner_store(store), ctx, user,
+                                                            existing);
+    metrics_observe_store("find_duplicate", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_find_by_phone(Store* store, const Context* ctx, const char* phone,
+                                       User** users, int* count) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->find_by_phone(inner_store(store), ctx, phone, users,
+                                                           count);
+    metrics_observe_store("find_by_phone", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_find_by_index(Store* store, const Context* ctx, const char* email_index,
+                                       const char* phone_index, User** users, int* count) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->find_by_index(inner_store(store), ctx, email_index,
+                                                           phone_index, users, count);
+    metrics_observe_store("find_by_index", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_search_users(Store* store, const Context* ctx, const char* query,
+                                      int limit, UserMatch** matches, int* count) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->search_users(inner_store(store), ctx, query, limit,
+                                                          matches, count);
+    metrics_observe_store("search_users", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_remove(Store* store, const Context* ctx, int id, long long deleted_at) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->remove(inner_store(store), ctx, id, deleted_at);
+    metrics_observe_store("remove", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_restore(Store* store, const Context* ctx, int id) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->restore(inner_store(store), ctx, id);
+    metrics_observe_store("restore", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_purge_users(Store* store, const Context* ctx, long long deleted_before,
+                                     int* purged) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->purge_users(inner_store(store), ctx, deleted_before,
+                                                         purged);
+    metrics_observe_store("purge_users", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_erase_user(Store* store, const Context* ctx, int id) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->erase_user(inner_store(store), ctx, id);
+    metrics_observe_store("erase_user", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_create_entry(Store* store, const Context* ctx, ListEntry* entry) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->create_entry(inner_store(store), ctx, entry);
+    metrics_observe_store("create_entry", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_list_entries(Store* store, const Context* ctx, ListEntry** entries,
+                                      int* count) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->list_entries(inner_store(store), ctx, entries, count);
+    metrics_observe_store("list_entries", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_remove_entry(Store* store, const Context* ctx, ListName list, int id) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->remove_entry(inner_store(store), ctx, list, id);
+    metrics_observe_store("remove_entry", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_create_rule(Store* store, const Context* ctx, Rule* rule) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->create_rule(inner_store(store), ctx, rule);
+    metrics_observe_store("create_rule", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_list_rules(Store* store, const Context* ctx, Rule** rules, int* count) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->list_rules(inner_store(store), ctx, rules, count);
+    metrics_observe_store("list_rules", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_update_rule(Store* store, const Context* ctx, const Rule* rule) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->update_rule(inner_store(store), ctx, rule);
+    metrics_observe_store("update_rule", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_remove_rule(Store* store, const Context* ctx, int id) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->remove_rule(inner_store(store), ctx, id);
+    metrics_observe_store("remove_rule", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_create_profile(Store* store, const Context* ctx, FormProfile* profile) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->create_profile(inner_store(store), ctx, profile);
+    metrics_observe_store("create_profile", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_list_profiles(Store* store, const Context* ctx, FormProfile** profiles,
+                                       int* count) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->list_profiles(inner_store(store), ctx, profiles,
+                                                           count);
+    metrics_observe_store("list_profiles", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_update_profile(Store* store, const Context* ctx,
+                                        const FormProfile* profile) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->update_profile(inner_store(store), ctx, profile);
+    metrics_observe_store("update_profile", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_remove_profile(Store* store, const Context* ctx, int id) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->remove_profile(inner_store(store), ctx, id);
+    metrics_observe_store("remove_profile", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_create_tenant(Store* store, const Context* ctx, Tenant* tenant) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->create_tenant(inner_store(store), ctx, tenant);
+    metrics_observe_store("create_tenant", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_get_tenant(Store* store, const Context* ctx, int id, Tenant* tenant) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->get_tenant(inner_store(store), ctx, id, tenant);
+    metrics_observe_store("get_tenant", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_list_tenants(Store* store, const Context* ctx, Tenant** tenants,
+                                      int* count) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->list_tenants(inner_store(store), ctx, tenants, count);
+    metrics_observe_store("list_tenants", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_update_tenant(Store* store, const Context* ctx, const Tenant* tenant) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->update_tenant(inner_store(store), ctx, tenant);
+    metrics_observe_store("update_tenant", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_remove_tenant(Store* store, const Context* ctx, int id) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->remove_tenant(inner_store(store), ctx, id);
+    metrics_observe_store("remove_tenant", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_add_usage(Store* store, const Context* ctx, int tenant_id,
+                                   const char* month, long long count) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->add_usage(inner_store(store), ctx, tenant_id, month,
+                                                       count);
+    metrics_observe_store("add_usage", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_get_usage(Store* store, const Context* ctx, int tenant_id,
+                                   const char* month, TenantUsage* usage) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->get_usage(inner_store(store), ctx, tenant_id, month,
+                                                       usage);
+    metrics_observe_store("get_usage", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_list_usage(Store* store, const Context* ctx, int tenant_id,
+                                    TenantUsage** usage, int* count) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->list_usage(inner_store(store), ctx, tenant_id, usage,
+                                                        count);
+    metrics_observe_store("list_usage", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_create_key(Store* store, const Context* ctx, ApiKey* key) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->create_key(inner_store(store), ctx, key);
+    metrics_observe_store("create_key", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_find_key(Store* store, const Context* ctx, const char* key_hash,
+                                  ApiKey* key) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->find_key(inner_store(store), ctx, key_hash, key);
+    metrics_observe_store("find_key", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_list_keys(Store* store, const Context* ctx, ApiKey** keys, int* count) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->list_keys(inner_store(store), ctx, keys, count);
+    metrics_observe_store("list_keys", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_remove_key(Store* store, const Context* ctx, int id) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->remove_key(inner_store(store), ctx, id);
+    metrics_observe_store("remove_key", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_add_history(Store* store, const Context* ctx,
+                                     const HistoryRecord* records, int count) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->add_history(inner_store(store), ctx, records, count);
+    metrics_observe_store("add_history", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_list_history(Store* store, const Context* ctx, const HistoryFilter* filter,
+                                      HistoryRecord** records, int* count) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->list_history(inner_store(store), ctx, filter,
+                                                          records, count);
+    metrics_observe_store("list_history", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_count_history(Store* store, const Context* ctx,
+                                       const HistoryFilter* filter, HistoryCounts* counts) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->count_history(inner_store(store), ctx, filter, counts);
+    metrics_observe_store("count_history", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_purge_history(Store* store, const Context* ctx, long long created_before,
+                                       int* purged) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->purge_history(inner_store(store), ctx,
+                                                           created_before, purged);
+    metrics_observe_store("purge_history", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_scrub_history(Store* store, const Context* ctx, long long created_before,
+                                       int* scrubbed) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->scrub_history(inner_store(store), ctx,
+                                                           created_before, scrubbed);
+    metrics_observe_store("scrub_history", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_erase_history(Store* store, const Context* ctx, const char* number_hash,
+                                       int* erased) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->erase_history(inner_store(store), ctx, number_hash,
+                                                           erased);
+    metrics_observe_store("erase_history", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_add_audit(Store* store, const Context* ctx, AuditEntry* entry) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->add_audit(inner_store(store), ctx, entry);
+    metrics_observe_store("add_audit", result, metrics_now() - start);
+    return result;
+}
+
+static StoreResult timed_list_audit(Store* store, const Context* ctx, const AuditFilter* filter,
+                                    AuditEntry** entries, int* count) {
+    double start = metrics_now();
+    StoreResult result = inner_store(store)->list_audit(inner_store(store), ctx, filter,
+                                                        entries, count);
+    metrics_observe_store("list_audit", result, metrics_now() - start);
+    return result;
+}
+
+// Probes run every few seconds, so they are passed through untimed
+static StoreResult passthrough_ping(Store* store, const Context* ctx) {
+    return inner_store(store)->ping(inner_store(store), ctx);
+}
+
+static void timed_close(Store* store) {
+    inner_store(store)->close(inner_store(store));
+    free(store);
+}
+
+Store* metrics_store_wrap(Store* inner) {
+    Store* store = calloc(1, sizeof(Store));
+    store->name = inner->name;
+    store->create = timed_create;
+    store->get = timed_get;
+    store->list = timed_list;
+    store->update = timed_update;
+    store->link_user = timed_link_user;
+    store->flag_phone = timed_flag_phone;
+    store->rewrite_user = timed_rewrite_user;
+    store->find_duplicate = timed_find_duplicate;
+    store->find_by_phone = timed_find_by_phone;
+    store->find_by_index = timed_find_by_index;
+    store->search_users = timed_search_users;
+    store->remove = timed_remove;
+    store->restore = timed_restore;
+    store->purge_users = timed_purge_users;
+    store->erase_user = timed_erase_user;
+    store->create_entry = timed_create_entry;
+    store->list_entries = timed_list_entries;
+    store->remove_entry = timed_remove_entry;
+    store->create_rule = timed_create_rule;
+    store->list_rules = timed_list_rules;
+    store->update_rule = timed_update_rule;
+    store->remove_rule = timed_remove_rule;
+    store->create_profile = timed_create_profile;
+    store->list_profiles = timed_list_profiles;
+    store->update_profile = timed_update_profile;
+    store->remove_profile = timed_remove_profile;
+    store->create_key = timed_create_key;
+    store->find_key = timed_find_key;
+    store->list_keys = timed_list_keys;
+    store->remove_key = timed_remove_key;
+    store->add_history = timed_add_history;
+    store->list_history = timed_list_history;
+    store->count_history = timed_count_history;
+    store->purge_history = timed_purge_history;
+    store->scrub_history = timed_scrub_history;
+    store->erase_history = timed_erase_history;
+    store->add_audit = timed_add_audit;
+    store->list_audit = timed_list_audit;
+    store->create_tenant = timed_create_tenant;
+    store->get_tenant = timed_get_tenant;
+    store->list_tenants = timed_list_tenants;
+    store->update_tenant = timed_update_tenant;
+    store->remove_tenant = timed_remove_tenant;
+    store->add_usage = timed_add_usage;
+    store->get_usage = timed_get_usage;
+    store->list_usage = timed_list_usage;
+    store->ping = passthrough_ping;
+    store->close = timed_close;
+    store->data = inner;
+    return store;
+}
@@ -0,0 +1,47 @@
+#ifndef METRICS_H
+#define METRICS_H
+
+#include <stdbool.h>
+
+#include "store.h"
+#include "resilience.h"
+
+// Prometheus metrics. All functions are safe to call from any thread.
+
+// Monotonic clock in seconds, for timing durations
+double metrics_now(void);
+
+// route is the registered pattern (e.g. "/api/users/:id"), never the raw
+// path, so that label cardinality stays bounded
+void metrics_observe_request(const char* method, const char* route, int status, double seconds);
+void metrics_count_validation(const char* region, bool valid);
+void metrics_count_cache_lookup(bool hit);
+// Per tenant id, for reconciling billing against the monthly quotas
+void metrics_count_tenant_validations(int tenant_id, int count);
+void metrics_count_quota_rejection(int tenant_id);
+void metrics_observe_store(const char* operation, StoreResult result, double seconds);
+// kind is "carrier" or "cnam"; result "ok", "error" or "rejected" (by an
+// open circuit breaker)
+void metrics_count_provider_call(const char* kind, const char* provider, const char* result);
+void metrics_count_provider_retry(const char* kind, const char* provider);
+void metrics_set_breaker_state(const char* kind, const char* provider, BreakerState state);
+
+// Renders every series in the Prometheus text format, caller frees
+char* metrics_render(void);
+
+// Totals since the process started, for the admin dashboard
+typedef struct {
+    unsigned long requests;
+    unsigned long server_errors;    // Responses with a 5xx status
+    unsigned long validations;
+    unsigned long invalid;
+    unsigned long store_errors;
+} MetricsSummary;
+
+void metrics_summary(MetricsSummary* summary);
+
+// Wraps a store so that each operation is timed. Closing the wrapper
+// closes the inner store.
+Store* metrics_store_wrap(Store* inner);
+
+#endif
@@ -0,0 +1,127 @@
+#include <stdio.h>
+#include <string.h>
+
+#include "migrate.h"
+
+static const char* command_names[] = {"status", "up", "down"};
+
+bool migrate_command_parse(const char* name, MigrateCommand* command) {
+    for (int i = 0; i < (int)(sizeof(command_names) / sizeof(command_names[0])); i++) {
+        if (strcmp(name, command_names[i]) == 0) {
+            *command = (MigrateCommand)i;
+            return true;
+        }
+    }
+    return false;
+}
+
+bool migrate_current(const Migrator* migrator, int* version, char* error, size_t error_size) {
+    char sql[160];
+    snprintf(sql, sizeof(sql), "SELECT COALESCE(MAX(version), 0) FROM %s", migrator->table);
+    return migrator->exec(migrator->db, migrator->version_table, error, error_size) &&
+           migrator->query_int(migrator->db, sql, version, error, error_size);
+}
+
+// Runs sql and records the version as applied, or reverted, in one
+// transaction
+static bool step(const Migrator* migrator, const Migration* migration, bool up, char* error,
+                 size_t error_size) {
+    char record[160];
+    if (up) {
+        snprintf(record, sizeof(record), "INSERT INTO %s (version) VALUES (%d)", migrator->table,
+                 migration->version);
+    } else {
+        snprintf(record, sizeof(record), "DELETE FROM %s WHERE version = %d", migrator->table,
+                 migration->version);
+    }
+
+    char message[512];
+    bool ok = migrator->exec(migrator->db, "BEGIN", message, sizeof(message)) &&
+              migrator->exec(migrator->db, up ? migration->up : migration->down, message,
+                             sizeof(message)) &&
+              migrator->exec(migrator->db, record, message, sizeof(message)) &&
+              migrator->exec(migrator->db, "COMMIT", message, sizeof(message));
+    if (!ok) {
+        char ignored[256];
+        migrator->exec(migrator->db, "ROLLBACK", ignored, sizeof(ignored));
+        snprintf(error, error_size, "%s migration %d (%s): %s", up ? "applying" : "reverting",
+                 migration->version, migration->name, message);
+        return false;
+    }
+    printf("%s %s migration %d (%s)\n", up ? "Applied" : "Reverted", migrator->name,
+           migration->version, migration->name);
+    return true;
+}
+
+static bool newer_than_build(const Migrator* migrator, int current, char* error, size_t error_size) {
+    if (current <= migrator->count) return false;
+    snprintf(error, error_size, "the database is at schema version %d, newer than this build's %d; "
+             "revert it with the newer build's \"migrate down %d\" first",
+             current, migrator->count, migrator->count);
+    return true;
+}
+
+// Applies or reverts migrations one at a time from current to target
+static bool migrate_to(const Migrator* migrator, int current, int target, char* error,
+                       size_t error_size) {
+    for (int version = current + 1; version <= target; version++) {
+        if (!step(migrator, &migrator->migrations[version - 1], true, error, error_size)) return false;
+    }
+    for (int version = current; version > target; version--) {
+        if (!step(migrator, &migrator->migrations[version - 1], false, error, error_size)) return false;
+    }
+    return true;
+}
+
+bool migrate_startup(const Migrator* migrator, bool apply, char* error, size_t error_size) {
+    int current;
+    if (!migrate_current(migrator, &current, error, error_size) ||
+        newer_than_build(migrator, current, error, error_size)) {
+        return false;
+    }
+    if (current == migrator->count) return true;
+    if (!apply) {
+        snprintf(error, error_size, "%d schema migration(s) pending; run the migrate command or set "
+                 "store_migrate = true", migrator->count - current);
+        return false;
+    }
+    return migrate_to(migrator, current, migrator->count, error, error_size);
+}
+
+static void print_status(const Migrator* migrator, int current) {
+    printf("%s schema at version %d of %d\n", migrator->name, current, migrator->count);
+    for (int i = 0; i < migrator->count; i++) {
+        const Migration* migration = &migrator->migrations[i];
+        printf("  %04d %-32s %s\n", migration->version, migration->name,
+               migration->version <= current ? "applied" : "pending");
+    }
+}
+
+bool migrate_run(const Migrator* migrator, MigrateCommand command, int target, char* error,
+                 size_t error_size) {
+    int current;
+    if (!migrate_current(migrator, &current, error, error_size)) return false;
+    if (command == MIGRATE_STATUS) {
+        print_status(migrator, current);
+        return true;
+    }
+    if (newer_than_build(migrator, current, error, error_size)) return false;
+
+    if (target == MIGRATE_DEFAULT) {
+        target = command == MIGRATE_UP ? migrator->count : (current > 0 ? current - 1 : 0);
+    }
+    if (target < 0 || target > migrator->count) {
+        snprintf(error, error_size, "no version %d; this build's are 0 to %d", target, migrator->count);
+        return false;
+    }
+    if (command == MIGRATE_UP ? target < current : target > current) {
+        snprintf(error, error_size, "the database is at version %d, so %s %d would go the other way",
+                 current, command_names[command], target);
+        return false;
+    }
+    if (target == current) {
+        printf("%s schema already at version %d\n", migrator->name, current);
+        return true;
+    }
+    return migrate_to(migrator, current, target, error, error_size);
+}
@@ -0,0 +1,69 @@
+#ifndef MIGRATE_H
+#define MIGRATE_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+// Versioned schema migrations, shared by the SQL stores. Each store's
+// migrations are the migrations/STORE/NNNN_NAME.up.sql and .down.sql
+// pairs, embedded by the Makefile as migrations/STORE.inc. A database
+// keeps the versions applied to it in its schema_migrations table, and
+// each migration is applied or reverted in a transaction of its own,
+// together with that table's row. MySQL commits schema changes as it
+// makes them, so its migrations are a statement each, which fails or
+// doesn't as a whole. Never edit a shipped migration; add the next
+// version instead.
+
+typedef struct {
+    int version;            // NNNN, from 1 up with no gaps
+    const char* name;       // NAME, e.g. "users_phone"
+    const char* up;         // Statements, ';' separated
+    const char* down;       // Undoes up
+} Migration;
+
+typedef enum {
+    MIGRATE_STATUS,         // List migrations, applied or pending
+    MIGRATE_UP,             // Apply up to the target version
+    MIGRATE_DOWN,           // Revert down to the target version
+} MigrateCommand;
+
+// Target for MIGRATE_UP to apply every migration and for MIGRATE_DOWN
+// to revert the last one applied
+#define MIGRATE_DEFAULT -1
+
+// A database as a store's migrations see it
+typedef struct {
+    const char* name;               // The store, e.g. "Postgres", for messages
+    const Migration* migrations;    // In version order
+    int count;
+    const char* table;              // Of versions, "schema_migrations" unless prefixed
+    // CREATE TABLE IF NOT EXISTS for table, with at least a version
+    // INTEGER PRIMARY KEY column
+    const char* version_table;
+    void* db;
+    // Runs sql, which returns no rows
+    bool (*exec)(void* db, const char* sql, char* error, size_t error_size);
+    // Runs sql, which returns one row of one integer
+    bool (*query_int)(void* db, const char* sql, int* value, char* error, size_t error_size);
+} Migrator;
+
+// The version the database is at, 0 for none, creating the version
+// table if it isn't there
+bool migrate_current(const Migrator* migrator, int* version, char* error, size_t error_size);
+
+// What a store runs on opening: with apply, brings the schema up to
+// date, and without, fails if a migration is pending. Either way fails
+// if the database is at a version newer than this build knows, which
+// the newer build has to revert first.
+bool migrate_startup(const Migrator* migrator, bool apply, char* error, size_t error_size);
+
+// The migrate subcommand: prints the status or applies or reverts
+// migrations one at a time, each printed as it is done. Stops at the
+// first that fails, leaving the database at the version before it.
+bool migrate_run(const Migrator* migrator, MigrateCommand command, int target, char* error,
+                 size_t error_size);
+
+// "status", "up" or "down"; false for anything else
+bool migrate_command_parse(const char* name, MigrateCommand* command);
+
+#endif
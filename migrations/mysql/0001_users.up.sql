@@ -0,0 +1,16 @@
+-- {prefix} is the store_table_prefix, e.g. wp_phoneval_. The default
+-- collation compares emails case-insensitively, as WordPress does.
+CREATE TABLE {prefix}users (
+  id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  name VARCHAR(128) NOT NULL,
+  email VARCHAR(255) NOT NULL,
+  phone VARCHAR(128) NOT NULL DEFAULT '',
+  deleted_at BIGINT NOT NULL DEFAULT 0,
+  wp_id INT NOT NULL DEFAULT 0,
+  wp_phone VARCHAR(128) NOT NULL DEFAULT '',
+  phone_invalid_since BIGINT NOT NULL DEFAULT 0,
+  phone_invalid_reason VARCHAR(32) NOT NULL DEFAULT '',
+  KEY users_email (email),
+  KEY users_phone (phone),
+  KEY users_deleted_at (deleted_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1 @@
+DROP TABLE {prefix}number_lists;
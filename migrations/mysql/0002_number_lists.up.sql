@@ -0,0 +1,8 @@
+CREATE TABLE {prefix}number_lists (
+  id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  list VARCHAR(16) NOT NULL,
+  `match` VARCHAR(16) NOT NULL,
+  value VARCHAR(32) NOT NULL,
+  reason VARCHAR(128) NOT NULL,
+  tenant_id INT NOT NULL DEFAULT 0
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
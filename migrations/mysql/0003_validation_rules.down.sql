@@ -0,0 +1 @@
+DROP TABLE {prefix}validation_rules;
@@ -0,0 +1,10 @@
+CREATE TABLE {prefix}validation_rules (
+  id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  position INT NOT NULL,
+  action VARCHAR(16) NOT NULL,
+  `match` VARCHAR(16) NOT NULL,
+  match_values VARCHAR(256) NOT NULL,
+  caller VARCHAR(16) NOT NULL,
+  reason VARCHAR(128) NOT NULL,
+  tenant_id INT NOT NULL DEFAULT 0
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
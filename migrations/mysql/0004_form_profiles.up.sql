@@ -0,0 +1,9 @@
+CREATE TABLE {prefix}form_profiles (
+  id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  name VARCHAR(64) NOT NULL,
+  plugin VARCHAR(32) NOT NULL,
+  form_id VARCHAR(32) NOT NULL,
+  fields VARCHAR(256) NOT NULL,
+  region VARCHAR(8) NOT NULL,
+  tenant_id INT NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,13 @@
+CREATE TABLE {prefix}validation_history (
+  id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  created_at BIGINT NOT NULL,
+  number_hash VARCHAR(64) NOT NULL,
+  caller VARCHAR(16) NOT NULL,
+  source VARCHAR(16) NOT NULL,
+  result VARCHAR(16) NOT NULL,
+  reason VARCHAR(160) NOT NULL,
+  region VARCHAR(8) NOT NULL,
+  tenant_id INT NOT NULL DEFAULT 0,
+  KEY validation_history_created_at (created_at),
+  KEY validation_history_number_hash (number_hash)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
@@ -0,0 +1,9 @@
+CREATE TABLE {prefix}api_keys (
+  id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  name VARCHAR(128) NOT NULL,
+  key_hash VARCHAR(64) NOT NULL UNIQUE,
+  scopes INT NOT NULL,
+  created_at BIGINT NOT NULL,
+  tenant_id INT NOT NULL DEFAULT 0,
+  sandbox BOOLEAN NOT NULL DEFAULT FALSE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
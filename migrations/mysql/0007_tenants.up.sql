@@ -0,0 +1,11 @@
+CREATE TABLE {prefix}tenants (
+  id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  name VARCHAR(128) NOT NULL,
+  rate_limit DOUBLE NOT NULL,
+  rate_burst INT NOT NULL,
+  created_at BIGINT NOT NULL,
+  monthly_quota BIGINT NOT NULL DEFAULT 0,
+  suspended BOOLEAN NOT NULL DEFAULT FALSE,
+  stripe_customer VARCHAR(64) NOT NULL DEFAULT '',
+  billing_updated_at BIGINT NOT NULL DEFAULT 0
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
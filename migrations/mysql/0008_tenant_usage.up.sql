@@ -0,0 +1,6 @@
+CREATE TABLE {prefix}tenant_usage (
+  tenant_id INT NOT NULL,
+  month VARCHAR(8) NOT NULL,
+  validations BIGINT NOT NULL,
+  PRIMARY KEY (tenant_id, month)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
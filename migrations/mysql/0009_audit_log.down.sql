@@ -0,0 +1 @@
+DROP TABLE {prefix}audit_log;
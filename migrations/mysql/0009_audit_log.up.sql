@@ -0,0 +1,12 @@
+CREATE TABLE {prefix}audit_log (
+  id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  created_at BIGINT NOT NULL,
+  actor VARCHAR(80) NOT NULL,
+  client_ip VARCHAR(64) NOT NULL,
+  action VARCHAR(32) NOT NULL,
+  target VARCHAR(48) NOT NULL,
+  before_state TEXT NOT NULL,
+  after_state TEXT NOT NULL,
+  tenant_id INT NOT NULL,
+  KEY audit_log_created_at (created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci;
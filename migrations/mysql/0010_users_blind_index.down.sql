@@ -0,0 +1 @@
+ALTER TABLE {prefix}users DROP COLUMN phone_index, DROP COLUMN email_index;
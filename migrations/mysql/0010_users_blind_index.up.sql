@@ -0,0 +1,5 @@
+ALTER TABLE {prefix}users
+  ADD COLUMN email_index VARCHAR(81) NOT NULL DEFAULT '',
+  ADD COLUMN phone_index VARCHAR(81) NOT NULL DEFAULT '',
+  ADD KEY users_email_index (email_index),
+  ADD KEY users_phone_index (phone_index);
@@ -0,0 +1,7 @@
+CREATE TABLE number_lists (
+  id SERIAL PRIMARY KEY,
+  list TEXT NOT NULL,
+  match TEXT NOT NULL,
+  value TEXT NOT NULL,
+  reason TEXT NOT NULL
+);
@@ -0,0 +1 @@
+DROP TABLE validation_history;
@@ -0,0 +1,12 @@
+CREATE TABLE validation_history (
+  id SERIAL PRIMARY KEY,
+  created_at BIGINT NOT NULL,
+  number_hash TEXT NOT NULL,
+  caller TEXT NOT NULL,
+  source TEXT NOT NULL,
+  result TEXT NOT NULL,
+  reason TEXT NOT NULL,
+  region TEXT NOT NULL
+);
+CREATE INDEX validation_history_created_at ON validation_history (created_at);
+CREATE INDEX validation_history_number_hash ON validation_history (number_hash);
@@ -0,0 +1,2 @@
+CREATE INDEX users_email ON users (lower(email));
+CREATE INDEX users_phone ON users (phone) WHERE phone <> '';
@@ -0,0 +1,7 @@
+CREATE TABLE api_keys (
+  id SERIAL PRIMARY KEY,
+  name TEXT NOT NULL,
+  key_hash TEXT NOT NULL UNIQUE,
+  scopes INTEGER NOT NULL,
+  created_at BIGINT NOT NULL
+);
@@ -0,0 +1,9 @@
+CREATE TABLE validation_rules (
+  id SERIAL PRIMARY KEY,
+  position INTEGER NOT NULL,
+  action TEXT NOT NULL,
+  match TEXT NOT NULL,
+  match_values TEXT NOT NULL,
+  caller TEXT NOT NULL,
+  reason TEXT NOT NULL
+);
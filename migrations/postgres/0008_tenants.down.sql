@@ -0,0 +1,5 @@
+ALTER TABLE validation_history DROP COLUMN tenant_id;
+ALTER TABLE validation_rules DROP COLUMN tenant_id;
+ALTER TABLE number_lists DROP COLUMN tenant_id;
+ALTER TABLE api_keys DROP COLUMN tenant_id;
+DROP TABLE tenants;
@@ -0,0 +1,11 @@
+CREATE TABLE tenants (
+  id SERIAL PRIMARY KEY,
+  name TEXT NOT NULL,
+  rate_limit DOUBLE PRECISION NOT NULL,
+  rate_burst INTEGER NOT NULL,
+  created_at BIGINT NOT NULL
+);
+ALTER TABLE api_keys ADD COLUMN tenant_id INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE number_lists ADD COLUMN tenant_id INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE validation_rules ADD COLUMN tenant_id INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE validation_history ADD COLUMN tenant_id INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+DROP TABLE tenant_usage;
+ALTER TABLE tenants DROP COLUMN monthly_quota;
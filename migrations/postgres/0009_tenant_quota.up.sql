@@ -0,0 +1,7 @@
+ALTER TABLE tenants ADD COLUMN monthly_quota BIGINT NOT NULL DEFAULT 0;
+CREATE TABLE tenant_usage (
+  tenant_id INTEGER NOT NULL,
+  month TEXT NOT NULL,
+  validations BIGINT NOT NULL,
+  PRIMARY KEY (tenant_id, month)
+);
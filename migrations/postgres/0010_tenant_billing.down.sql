@@ -0,0 +1,3 @@
+ALTER TABLE tenants DROP COLUMN billing_updated_at;
+ALTER TABLE tenants DROP COLUMN stripe_customer;
+ALTER TABLE tenants DROP COLUMN suspended;
@@ -0,0 +1,3 @@
+ALTER TABLE tenants ADD COLUMN suspended BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE tenants ADD COLUMN stripe_customer TEXT NOT NULL DEFAULT '';
+ALTER TABLE tenants ADD COLUMN billing_updated_at BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+-- Takes users_deleted_at with it
+ALTER TABLE users DROP COLUMN deleted_at;
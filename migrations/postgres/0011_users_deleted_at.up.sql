@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN deleted_at BIGINT NOT NULL DEFAULT 0;
+CREATE INDEX users_deleted_at ON users (deleted_at) WHERE deleted_at <> 0;
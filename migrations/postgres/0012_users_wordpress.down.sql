@@ -0,0 +1,2 @@
+ALTER TABLE users DROP COLUMN wp_phone;
+ALTER TABLE users DROP COLUMN wp_id;
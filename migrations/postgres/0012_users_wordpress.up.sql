@@ -0,0 +1,2 @@
+ALTER TABLE users ADD COLUMN wp_id INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN wp_phone TEXT NOT NULL DEFAULT '';
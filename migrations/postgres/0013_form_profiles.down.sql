@@ -0,0 +1 @@
+DROP TABLE form_profiles;
@@ -0,0 +1,9 @@
+CREATE TABLE form_profiles (
+  id SERIAL PRIMARY KEY,
+  name TEXT NOT NULL,
+  plugin TEXT NOT NULL,
+  form_id TEXT NOT NULL,
+  fields TEXT NOT NULL,
+  region TEXT NOT NULL,
+  tenant_id INTEGER NOT NULL
+);
@@ -0,0 +1,2 @@
+-- pg_trgm stays, as other databases' objects may use it
+DROP INDEX users_search;
@@ -0,0 +1,5 @@
+-- For search_users. Creating pg_trgm takes a role allowed to; it is a
+-- trusted extension, which database owners may create, from 13 on.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+CREATE INDEX users_search ON users
+USING gin (lower(name || ' ' || email || ' ' || phone) gin_trgm_ops);
@@ -0,0 +1,3 @@
+-- Takes users_phone_invalid with it
+ALTER TABLE users DROP COLUMN phone_invalid_reason;
+ALTER TABLE users DROP COLUMN phone_invalid_since;
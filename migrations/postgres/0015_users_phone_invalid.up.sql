@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN phone_invalid_since BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN phone_invalid_reason TEXT NOT NULL DEFAULT '';
+CREATE INDEX users_phone_invalid ON users (phone_invalid_since) WHERE phone_invalid_since <> 0;
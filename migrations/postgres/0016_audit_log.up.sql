@@ -0,0 +1,12 @@
+CREATE TABLE audit_log (
+  id SERIAL PRIMARY KEY,
+  created_at BIGINT NOT NULL,
+  actor TEXT NOT NULL,
+  client_ip TEXT NOT NULL,
+  action TEXT NOT NULL,
+  target TEXT NOT NULL,
+  before_state TEXT NOT NULL,
+  after_state TEXT NOT NULL,
+  tenant_id INTEGER NOT NULL
+);
+CREATE INDEX audit_log_created_at ON audit_log (created_at);
@@ -0,0 +1,3 @@
+-- Takes users_email_index and users_phone_index with them
+ALTER TABLE users DROP COLUMN phone_index;
+ALTER TABLE users DROP COLUMN email_index;
@@ -0,0 +1,11 @@
+-- Everything, data included, as there is nothing before the baseline
+DROP TABLE users_fts;
+DROP TABLE audit_log;
+DROP TABLE tenant_usage;
+DROP TABLE tenants;
+DROP TABLE api_keys;
+DROP TABLE validation_history;
+DROP TABLE form_profiles;
+DROP TABLE validation_rules;
+DROP TABLE number_lists;
+DROP TABLE users;
@@ -0,0 +1,114 @@
+-- The schema as it was before migrations were versioned. A database from
+-- then has had the columns it lacked added first (see add_missing_columns
+-- in store_sqlite.c), so every statement here leaves alone what is there.
+CREATE TABLE IF NOT EXISTS users (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name TEXT NOT NULL,
+  email TEXT NOT NULL,
+  phone TEXT NOT NULL DEFAULT '',
+  deleted_at INTEGER NOT NULL DEFAULT 0,
+  wp_id INTEGER NOT NULL DEFAULT 0,
+  wp_phone TEXT NOT NULL DEFAULT '',
+  phone_invalid_since INTEGER NOT NULL DEFAULT 0,
+  phone_invalid_reason TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS number_lists (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  list TEXT NOT NULL,
+  match TEXT NOT NULL,
+  value TEXT NOT NULL,
+  reason TEXT NOT NULL,
+  tenant_id INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS validation_rules (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  position INTEGER NOT NULL,
+  action TEXT NOT NULL,
+  match TEXT NOT NULL,
+  match_values TEXT NOT NULL,
+  caller TEXT NOT NULL,
+  reason TEXT NOT NULL,
+  tenant_id INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS form_profiles (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name TEXT NOT NULL,
+  plugin TEXT NOT NULL,
+  form_id TEXT NOT NULL,
+  fields TEXT NOT NULL,
+  region TEXT NOT NULL,
+  tenant_id INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS validation_history (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  created_at INTEGER NOT NULL,
+  number_hash TEXT NOT NULL,
+  caller TEXT NOT NULL,
+  source TEXT NOT NULL,
+  result TEXT NOT NULL,
+  reason TEXT NOT NULL,
+  region TEXT NOT NULL,
+  tenant_id INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS api_keys (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name TEXT NOT NULL,
+  key_hash TEXT NOT NULL UNIQUE,
+  scopes INTEGER NOT NULL,
+  created_at INTEGER NOT NULL,
+  tenant_id INTEGER NOT NULL DEFAULT 0,
+  sandbox INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS tenants (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name TEXT NOT NULL,
+  rate_limit REAL NOT NULL,
+  rate_burst INTEGER NOT NULL,
+  created_at INTEGER NOT NULL,
+  monthly_quota INTEGER NOT NULL DEFAULT 0,
+  suspended INTEGER NOT NULL DEFAULT 0,
+  stripe_customer TEXT NOT NULL DEFAULT '',
+  billing_updated_at INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS tenant_usage (
+  tenant_id INTEGER NOT NULL,
+  month TEXT NOT NULL,
+  validations INTEGER NOT NULL,
+  PRIMARY KEY (tenant_id, month)
+);
+CREATE TABLE IF NOT EXISTS audit_log (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  created_at INTEGER NOT NULL,
+  actor TEXT NOT NULL,
+  client_ip TEXT NOT NULL,
+  action TEXT NOT NULL,
+  target TEXT NOT NULL,
+  before_state TEXT NOT NULL,
+  after_state TEXT NOT NULL,
+  tenant_id INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_log_created_at ON audit_log (created_at);
+CREATE INDEX IF NOT EXISTS validation_history_created_at ON validation_history (created_at);
+CREATE INDEX IF NOT EXISTS validation_history_number_hash ON validation_history (number_hash);
+CREATE INDEX IF NOT EXISTS users_email ON users (email COLLATE NOCASE);
+CREATE INDEX IF NOT EXISTS users_phone ON users (phone);
+CREATE INDEX IF NOT EXISTS users_deleted_at ON users (deleted_at) WHERE deleted_at <> 0;
+CREATE INDEX IF NOT EXISTS users_phone_invalid ON users (phone_invalid_since)
+WHERE phone_invalid_since <> 0;
+
+-- Full-text index of users' names and emails for search_users, kept in
+-- step with users by triggers. It holds no copy of the text.
+CREATE VIRTUAL TABLE IF NOT EXISTS users_fts USING fts5(name, email, content='users', content_rowid='id');
+CREATE TRIGGER IF NOT EXISTS users_fts_insert AFTER INSERT ON users BEGIN
+  INSERT INTO users_fts (rowid, name, email) VALUES (new.id, new.name, new.email);
+END;
+CREATE TRIGGER IF NOT EXISTS users_fts_delete AFTER DELETE ON users BEGIN
+  INSERT INTO users_fts (users_fts, rowid, name, email)
+  VALUES ('delete', old.id, old.name, old.email);
+END;
+CREATE TRIGGER IF NOT EXISTS users_fts_update AFTER UPDATE OF name, email ON users BEGIN
+  INSERT INTO users_fts (users_fts, rowid, name, email)
+  VALUES ('delete', old.id, old.name, old.email);
+  INSERT INTO users_fts (rowid, name, email) VALUES (new.id, new.name, new.email);
+END;
+INSERT INTO users_fts (users_fts) VALUES ('rebuild');
@@ -0,0 +1,4 @@
+DROP INDEX users_phone_index;
+DROP INDEX users_email_index;
+ALTER TABLE users DROP COLUMN phone_index;
+ALTER TABLE users DROP COLUMN email_index;
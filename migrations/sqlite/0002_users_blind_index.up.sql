@@ -0,0 +1,6 @@
+-- Keyed hashes of sealed emails and phones, set by the encrypted store so
+-- that it can find users by them. Empty when encryption is off.
+ALTER TABLE users ADD COLUMN email_index TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN phone_index TEXT NOT NULL DEFAULT '';
+CREATE INDEX users_email_index ON users (email_index);
+CREATE INDEX users_phone_index ON users (phone_index) WHERE phone_index <> '';
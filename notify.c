@@ -0,0 +1,312 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+#include <pthread.h>
+
+#include "notify.h"
+
+static const char* event_names[] = {
+    "quota.exhausted", "metadata.failed", "job.completed", "invalid.spike"
+};
+
+const char* notify_event_string(NotifyEvent event) {
+    return event >= 0 && event < NOTIFY_EVENT_COUNT ? event_names[event] : "unknown";
+}
+
+bool notify_event_parse(const char* name, NotifyEvent* event) {
+    for (int i = 0; i < NOTIFY_EVENT_COUNT; i++) {
+        if (strcmp(name, event_names[i]) == 0) {
+            *event = i;
+            return true;
+        }
+    }
+    return false;
+}
+
+// ============= Messages =============
+
+typedef struct {
+    char* data;
+    size_t length;
+    size_t capacity;
+} Buffer;
+
+static void buffer_append(Buffer* buffer, const char* text, size_t length) {
+    if (buffer->length + length + 1 > buffer->capacity) {
+        while (buffer->length + length + 1 > buffer->capacity) buffer->capacity *= 2;
+        buffer->data = realloc(buffer->data, buffer->capacity);
+    }
+    memcpy(buffer->data + buffer->length, text, length);
+    buffer->length += length;
+    buffer->data[buffer->length] = '\0';
+}
+
+static void buffer_append_text(Buffer* buffer, const char* text) {
+    buffer_append(buffer, text, strlen(text));
+}
+
+// Appends text as the inside of a JSON string
+static void buffer_append_escaped(Buffer* buffer, const char* text) {
+    for (const unsigned char* c = (const unsigned char*)text; *c; c++) {
+        char escaped[8];
+        switch (*c) {
+            case '"':  buffer_append_text(buffer, "\\\""); break;
+            case '\\': buffer_append_text(buffer, "\\\\"); break;
+            case '\n': buffer_append_text(buffer, "\\n"); break;
+            case '\r': buffer_append_text(buffer, "\\r"); break;
+            case '\t': buffer_append_text(buffer, "\\t"); break;
+            default:
+                if (*c < 0x20) {
+                    snprintf(escaped, sizeof(escaped), "\\u%04x", *c);
+                    buffer_append_text(buffer, escaped);
+                } else {
+                    buffer_append(buffer, (const char*)c, 1);
+                }
+        }
+    }
+}
+
+static void buffer_init(Buffer* buffer) {
+    buffer->capacity = 256;
+    buffer->length = 0;
+    buffer->data = malloc(buffer->capacity);
+    buffer->data[0] = '\0';
+}
+
+static void format_time(time_t when, char* out, size_t size) {
+    struct tm tm;
+    gmtime_r(&when, &tm);
+    strftime(out, size, "%Y-%m-%dT%H:%M:%SZ", &tm);
+}
+
+char* notification_json(const Notification* notification) {
+    char occurred_at[32];
+    format_time(notification->occurred_at, occurred_at, sizeof(occurred_at));
+
+    Buffer buffer;
+    buffer_init(&buffer);
+    buffer_append_text(&buffer, "{\"event\": \"");
+    buffer_append_text(&buffer, notify_event_string(notification->event));
+    buffer_append_text(&buffer, "\", \"subject\": \"");
+    buffer_append_escaped(&buffer, notification->subject);
+    buffer_append_text(&buffer, "\", \"occurred_at\": \"");
+    buffer_append_text(&buffer, occurred_at);
+    buffer_append_text(&buffer, "\", \"details\": ");
+    buffer_append_text(&buffer, notification->details);
+    buffer_append_text(&buffer, "}");
+    return buffer.data;
+}
+
+char* notification_slack_json(const Notification* notification) {
+    // Bold subject, then the details as a code block
+    Buffer buffer;
+    buffer_init(&buffer);
+    buffer_append_text(&buffer, "{\"text\": \"*");
+    buffer_append_escaped(&buffer, notification->subject);
+    buffer_append_text(&buffer, "*\\n```");
+    buffer_append_escaped(&buffer, notification->details);
+    buffer_append_text(&buffer, "```\"}");
+    return buffer.data;
+}
+
+// ============= Notifiers =============
+
+Notifier* notifier_open(const char* dsn, const char* secret, int timeout,
+                        char* error, size_t error_size) {
+    if (strlen(dsn) >= NOTIFY_MAX_DSN) {
+        snprintf(error, error_size, "notifier DSN longer than %d characters", NOTIFY_MAX_DSN - 1);
+        return NULL;
+    }
+    if (strncmp(dsn, "smtp://", 7) == 0) {
+        return smtp_notifier_open(dsn, timeout, error, error_size);
+    }
+
+    const char* url = NULL;
+    bool slack = strncmp(dsn, "slack:", 6) == 0;
+    if (slack) url = dsn + 6;
+    if (strncmp(dsn, "webhook:", 8) == 0) url = dsn + 8;
+    if (!url) {
+        snprintf(error, error_size, "unknown notifier \"%.*s\", expected smtp://, slack: or webhook:",
+                 (int)strcspn(dsn, ":"), dsn);
+        return NULL;
+    }
+    if (strncmp(url, "http://", 7) != 0 && strncmp(url, "https://", 8) != 0) {
+        snprintf(error, error_size, "%s: expected an http:// or https:// URL", slack ? "slack" : "webhook");
+        return NULL;
+    }
+#ifdef HAVE_CURL
+    return slack ? slack_notifier_open(url, timeout, error, error_size)
+                 : webhook_notifier_open(url, secret, timeout, error, error_size);
+#else
+    snprintf(error, error_size, "built without %s notifications (make WITH_CURL=1)",
+             slack ? "Slack" : "webhook");
+    return NULL;
+#endif
+}
+
+// ============= Queue =============
+
+typedef struct Delivery {
+    Notifier* notifier;
+    NotifyEvent event;
+    time_t occurred_at;
+    char* subject;
+    char* details;
+    int attempts;           // Made so far
+    time_t due;             // When to make the next one
+    struct Delivery* next;
+} Delivery;
+
+struct NotifyQueue {
+    Notifier** notifiers[NOTIFY_EVENT_COUNT];
+    int notifier_count[NOTIFY_EVENT_COUNT];
+    int retries;
+    int backoff;
+    Delivery* pending;      // Soonest due first
+    bool stopping;
+    pthread_t thread;
+    pthread_mutex_t lock;
+    pthread_cond_t changed;
+};
+
+static void delivery_free(Delivery* delivery) {
+    free(delivery->subject);
+    free(delivery->details);
+    free(delivery);
+}
+
+// Call with the lock held
+static void schedule(NotifyQueue* queue, Delivery* delivery) {
+    Delivery** link = &queue->pending;
+    while (*link && (*link)->due <= delivery->due) link = &(*link)->next;
+    delivery->next = *link;
+    *link = delivery;
+    pthread_cond_signal(&queue->changed);
+}
+
+static void* delivery_thread(void* arg) {
+    NotifyQueue* queue = arg;
+
+    pthread_mutex_lock(&queue->lock);
+    while (!queue->stopping) {
+        if (!queue->pending) {
+            pthread_cond_wait(&queue->changed, &queue->lock);
+            continue;
+        }
+        if (queue->pending->due > time(NULL)) {
+            struct timespec until = {queue->pending->due, 0};
+            pthread_cond_timedwait(&queue->changed, &queue->lock, &until);
+            continue;
+        }
+
+        Delivery* delivery = queue->pending;
+        queue->pending = delivery->next;
+        pthread_mutex_unlock(&queue->lock);
+
+        Notification notification = {
+            .event = delivery->event,
+            .occurred_at = delivery->occurred_at,
+            .subject = delivery->subject,
+            .details = delivery->details
+        };
+        char error[256] = "";
+        bool retry = false;
+        bool sent = delivery->notifier->send(delivery->notifier, &notification, &retry,
+                                             error, sizeof(error));
+        delivery->attempts++;
+
+        pthread_mutex_lock(&queue->lock);
+        if (!sent && retry && delivery->attempts <= queue->retries) {
+            delivery->due = time(NULL) + ((time_t)queue->backoff << (delivery->attempts - 1));
+            schedule(queue, delivery);
+        } else {
+            if (!sent) {
+                fprintf(stderr, "Gave up on %s notification by %s after %d attempt(s): %s\n",
+                        notify_event_string(delivery->event), delivery->notifier->name,
+                        delivery->attempts, error);
+            }
+            delivery_free(delivery);
+        }
+    }
+    pthread_mutex_unlock(&queue->lock);
+    return NULL;
+}
+
+NotifyQueue* notify_queue_create(int retries, int backoff, char* error, size_t error_size) {
+    NotifyQueue* queue = calloc(1, sizeof(NotifyQueue));
+    queue->retries = retries;
+    queue->backoff = backoff;
+    pthread_mutex_init(&queue->lock, NULL);
+    pthread_cond_init(&queue->changed, NULL);
+    if (pthread_create(&queue->thread, NULL, delivery_thread, queue) != 0) {
+        snprintf(error, error_size, "cannot start the notification thread");
+        pthread_mutex_destroy(&queue->lock);
+        pthread_cond_destroy(&queue->changed);
+        free(queue);
+        return NULL;
+    }
+    return queue;
+}
+
+void notify_queue_free(NotifyQueue* queue) {
+    pthread_mutex_lock(&queue->lock);
+    queue->stopping = true;
+    pthread_cond_signal(&queue->changed);
+    pthread_mutex_unlock(&queue->lock);
+    pthread_join(queue->thread, NULL);
+
+    int dropped = 0;
+    while (queue->pending) {
+        Delivery* delivery = queue->pending;
+        queue->pending = delivery->next;
+        delivery_free(delivery);
+        dropped++;
+    }
+    if (dropped > 0) {
+        fprintf(stderr, "Dropped %d notification(s) waiting to be sent\n", dropped);
+    }
+    for (int event = 0; event < NOTIFY_EVENT_COUNT; event++) {
+        for (int i = 0; i < queue->notifier_count[event]; i++) {
+            queue->notifiers[event][i]->close(queue->notifiers[event][i]);
+        }
+        free(queue->notifiers[event]);
+    }
+    pthread_mutex_destroy(&queue->lock);
+    pthread_cond_destroy(&queue->changed);
+    free(queue);
+}
+
+void notify_queue_add(NotifyQueue* queue, NotifyEvent event, Notifier* notifier) {
+    pthread_mutex_lock(&queue->lock);
+    int count = queue->notifier_count[event];
+    queue->notifiers[event] = realloc(queue->notifiers[event], (count + 1) * sizeof(Notifier*));
+    queue->notifiers[event][count] = notifier;
+    queue->notifier_count[event]++;
+    pthread_mutex_unlock(&queue->lock);
+}
+
+bool notify_wanted(const NotifyQueue* queue, NotifyEvent event) {
+    // Notifiers are only added at startup, before anyone asks
+    return queue && queue->notifier_count[event] > 0;
+}
+
+void notify(NotifyQueue* queue, NotifyEvent event, const char* subject, const char* details) {
+    if (!notify_wanted(queue, event)) return;
+
+    time_t now = time(NULL);
+    pthread_mutex_lock(&queue->lock);
+    for (int i = 0; i < queue->notifier_count[event]; i++) {
+        Delivery* delivery = calloc(1, sizeof(Delivery));
+        delivery->notifier = queue->notifiers[event][i];
+        delivery->event = event;
+        delivery->occurred_at = now;
+        delivery->subject = strdup(subject);
+        delivery->details = strdup(details ? details : "{}");
+        delivery->due = now;
+        schedule(queue, delivery);
+    }
+    pthread_mutex_unlock(&queue->lock);
+}
@@ -0,0 +1,118 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+#include <curl/curl.h>
+
+#include "notify.h"
+#include "signature.h"
+
+// Slack incoming webhooks and generic webhooks, both JSON POSTs
+typedef struct {
+    char url[NOTIFY_MAX_DSN];
+    char secret[128];       // Signs webhook requests, empty leaves them unsigned
+    bool slack;
+    int timeout;
+} HttpNotifier;
+
+static size_t discard_body(char* data, size_t size, size_t count, void* userdata) {
+    return size * count;
+}
+
+static bool http_send(Notifier* notifier, const Notification* notification, bool* retry,
+                      char* error, size_t error_size) {
+    HttpNotifier* http = notifier->data;
+    *retry = true;
+
+    CURL* curl = curl_easy_init();
+    if (!curl) {
+        snprintf(error, error_size, "cannot create HTTP client");
+        return false;
+    }
+
+    char* body = http->slack ? notification_slack_json(notification) : notification_json(notification);
+    char header[160];
+    struct curl_slist* headers = curl_slist_append(NULL, "Content-Type: application/json");
+    if (!http->slack) {
+        // The same headers as a job callback, see callback.h
+        snprintf(header, sizeof(header), "X-Phoneval-Event: %s",
+                 notify_event_string(notification->event));
+        headers = curl_slist_append(headers, header);
+    }
+    if (!http->slack && http->secret[0]) {
+        char timestamp[32];
+        snprintf(timestamp, sizeof(timestamp), "%lld", (long long)time(NULL));
+        size_t signed_length = strlen(timestamp) + 1 + strlen(body);
+        char* signed_data = malloc(signed_length + 1);
+        snprintf(signed_data, signed_length + 1, "%s\n%s", timestamp, body);
+        char digest[SIGNATURE_HEX_LENGTH + 1];
+        hmac_sha256_hex(http->secret, strlen(http->secret), signed_data, signed_length, digest);
+        free(signed_data);
+
+        snprintf(header, sizeof(header), "X-Phoneval-Timestamp: %s", timestamp);
+        headers = curl_slist_append(headers, header);
+        snprintf(header, sizeof(header), "X-Phoneval-Signature: sha256=%s", digest);
+        headers = curl_slist_append(headers, header);
+    }
+
+    curl_easy_setopt(curl, CURLOPT_URL, http->url);
+    curl_easy_setopt(curl, CURLOPT_TIMEOUT, (long)http->timeout);
+    curl_easy_setopt(curl, CURLOPT_NOSIGNAL, 1L);
+    curl_easy_setopt(curl, CURLOPT_PROTOCOLS_STR, "http,https");
+    curl_easy_setopt(curl, CURLOPT_HTTPHEADER, headers);
+    curl_easy_setopt(curl, CURLOPT_POSTFIELDS, body);
+    curl_easy_setopt(curl, CURLOPT_WRITEFUNCTION, discard_body);
+
+    long status = 0;
+    CURLcode rc = curl_easy_perform(curl);
+    if (rc != CURLE_OK) {
+        snprintf(error, error_size, "%s", curl_easy_strerror(rc));
+    } else {
+        curl_easy_getinfo(curl, CURLINFO_RESPONSE_CODE, &status);
+        snprintf(error, error_size, "HTTP %ld", status);
+    }
+    curl_slist_free_all(headers);
+    curl_easy_cleanup(curl);
+    free(body);
+
+    *retry = status == 0 || status == 408 || status == 429 || status >= 500;
+    return status >= 200 && status < 300;
+}
+
+static void http_close(Notifier* notifier) {
+    free(notifier->data);
+    free(notifier);
+}
+
+static Notifier* http_notifier_open(const char* name, const char* url, const char* secret,
+                                    int timeout, char* error, size_t error_size) {
+    HttpNotifier* http = calloc(1, sizeof(HttpNotifier));
+    if (strlen(url) >= sizeof(http->url) || strlen(secret) >= sizeof(http->secret)) {
+        snprintf(error, error_size, "%s: URL or secret too long", name);
+        free(http);
+        return NULL;
+    }
+    curl_global_init(CURL_GLOBAL_DEFAULT);
+    snprintf(http->url, sizeof(http->url), "%s", url);
+    snprintf(http->secret, sizeof(http->secret), "%s", secret);
+    http->slack = strcmp(name, "slack") == 0;
+    http->timeout = timeout;
+
+    Notifier* notifier = calloc(1, sizeof(Notifier));
+    notifier->name = name;
+    notifier->send = http_send;
+    notifier->close = http_close;
+    notifier->data = http;
+    return notifier;
+}
+
+Notifier* slack_notifier_open(const char* url, int timeout, char* error, size_t error_size) {
+    return http_notifier_open("slack", url, "", timeout, error, error_size);
+}
+
+Notifier* webhook_notifier_open(const char* url, const char* secret, int timeout,
+                                char* error, size_t error_size) {
+    return http_notifier_open("webhook", url, secret, timeout, error, error_size);
+}
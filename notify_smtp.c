@@ -0,0 +1,228 @@
+#define _DEFAULT_SOURCE
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+#include <unistd.h>
+
+#include "notify.h"
+#include "email.h"
+
+typedef struct {
+    char host[256];
+    char port[8];
+    char helo[256];
+    char from[EMAIL_MAX_LENGTH + 1];
+    char to[NOTIFY_MAX_RECIPIENTS][EMAIL_MAX_LENGTH + 1];
+    int to_count;
+    int timeout;
+} SmtpNotifier;
+
+// Appends text to the message, CRLF line endings and lines starting with a
+// dot doubled (RFC 5321 section 4.5.2)
+static void append_body(char** message, size_t* length, const char* text) {
+    size_t needed = *length + strlen(text) * 2 + 1;
+    *message = realloc(*message, needed);
+    char* out = *message + *length;
+    bool line_start = *length == 0 || (*message)[*length - 1] == '\n';
+    for (const char* c = text; *c; c++) {
+        if (line_start && *c == '.') *out++ = '.';
+        if (*c == '\n' && (c == text || c[-1] != '\r')) *out++ = '\r';
+        *out++ = *c;
+        line_start = *c == '\n';
+    }
+    *out = '\0';
+    *length = out - *message;
+}
+
+static bool smtp_send(Notifier* notifier, const Notification* notification, bool* retry,
+                      char* error, size_t error_size) {
+    SmtpNotifier* smtp = notifier->data;
+    *retry = true;
+
+    int sock = smtp_connect(NULL, smtp->host, smtp->port, smtp->timeout, error, error_size);
+    if (sock < 0) return false;
+
+    char command[EMAIL_MAX_LENGTH + 300];
+    snprintf(command, sizeof(command), "EHLO %s\r\n", smtp->helo);
+    int code = smtp_read_reply(sock, smtp->timeout, NULL);
+    if (code == 220) code = smtp_command(sock, command, smtp->timeout, NULL);
+    if (code != 250) {
+        snprintf(error, error_size, "%s: did not greet (%d)", smtp->host, code);
+        *retry = code == 0 || code / 100 == 4;
+        close(sock);
+        return false;
+    }
+
+    snprintf(command, sizeof(command), "MAIL FROM:<%s>\r\n", smtp->from);
+    code = smtp_command(sock, command, smtp->timeout, NULL);
+    int accepted = 0;
+    for (int i = 0; code == 250 && i < smtp->to_count; i++) {
+        snprintf(command, sizeof(command), "RCPT TO:<%s>\r\n", smtp->to[i]);
+        int rcpt = smtp_command(sock, command, smtp->timeout, NULL);
+        if (rcpt == 250 || rcpt == 251) {
+            accepted++;
+        } else {
+            fprintf(stderr, "SMTP relay %s refused %s (%d)\n", smtp->host, smtp->to[i], rcpt);
+        }
+    }
+    if (code == 250 && accepted == 0) {
+        snprintf(error, error_size, "%s: refused every recipient", smtp->host);
+        *retry = false;
+        smtp_command(sock, "QUIT\r\n", smtp->timeout, NULL);
+        close(sock);
+        return false;
+    }
+    if (code == 250) code = smtp_command(sock, "DATA\r\n", smtp->timeout, NULL);
+    if (code != 354) {
+        snprintf(error, error_size, "%s: refused the message (%d)", smtp->host, code);
+        *retry = code == 0 || code / 100 == 4;
+        close(sock);
+        return false;
+    }
+
+    // The subject goes in a header, so it must stay on one line
+    char subject[256];
+    snprintf(subject, sizeof(subject), "%s", notification->subject);
+    for (char* c = subject; *c; c++) {
+        if (*c == '\r' || *c == '\n') *c = ' ';
+    }
+    char date[64];
+    char occurred_at[32];
+    struct tm tm;
+    gmtime_r(&notification->occurred_at, &tm);
+    strftime(date, sizeof(date), "%a, %d %b %Y %H:%M:%S +0000", &tm);
+    strftime(occurred_at, sizeof(occurred_at), "%Y-%m-%dT%H:%M:%SZ", &tm);
+
+    char* message = NULL;
+    size_t length = 0;
+    char line[1024];
+    snprintf(line, sizeof(line), "From: <%s>\nTo: ", smtp->from);
+    append_body(&message, &length, line);
+    for (int i = 0; i < smtp->to_count; i++) {
+        snprintf(line, sizeof(line), "%s<%s>", i > 0 ? ", " : "", smtp->to[i]);
+        append_body(&message, &length, line);
+    }
+    snprintf(line, sizeof(line),
+             "\nSubject: [phoneval] %s\nDate: %s\nAuto-Submitted: auto-generated\n"
+             "Content-Type: text/plain; charset=utf-8\n\n%s\n\n", subject, date, subject);
+    append_body(&message, &length, line);
+    append_body(&message, &length, notification->details);
+    snprintf(line, sizeof(line), "\n\n-- \n%s at %s\n",
+             notify_event_string(notification->event), occurred_at);
+    append_body(&message, &length, line);
+    // The line that ends DATA, which mustn't be doubled
+    message = realloc(message, length + 4);
+    memcpy(message + length, ".\r\n", 4);
+
+    code = smtp_command(sock, message, smtp->timeout, NULL);
+    free(message);
+    smtp_command(sock, "QUIT\r\n", smtp->timeout, NULL);
+    close(sock);
+    if (code != 250) {
+        snprintf(error, error_size, "%s: refused the message (%d)", smtp->host, code);
+        *retry = code == 0 || code / 100 == 4;
+        return false;
+    }
+    return true;
+}
+
+static void smtp_close(Notifier* notifier) {
+    free(notifier->data);
+    free(notifier);
+}
+
+// Copies the query parameter at *query, "name=value", moving past it
+static bool next_param(const char** query, char* name, size_t name_size,
+                       char* value, size_t value_size) {
+    if (!**query) return false;
+    size_t length = strcspn(*query, "&");
+    const char* equals = memchr(*query, '=', length);
+    size_t name_length = equals ? (size_t)(equals - *query) : length;
+    snprintf(name, name_size, "%.*s", (int)name_length, *query);
+    if (equals) {
+        snprintf(value, value_size, "%.*s", (int)(length - name_length - 1), equals + 1);
+    } else {
+        value[0] = '\0';
+    }
+    *query += length + ((*query)[length] == '&');
+    return true;
+}
+
+Notifier* smtp_notifier_open(const char* dsn, int timeout, char* error, size_t error_size) {
+    SmtpNotifier* smtp = calloc(1, sizeof(SmtpNotifier));
+    smtp->timeout = timeout;
+    snprintf(smtp->port, sizeof(smtp->port), "25");
+
+    // smtp://host[:port][?from=...&to=...&to=...&helo=...]
+    const char* authority = dsn + strlen("smtp://");
+    size_t authority_length = strcspn(authority, "/?");
+    const char* colon = memchr(authority, ':', authority_length);
+    size_t host_length = colon ? (size_t)(colon - authority) : authority_length;
+    if (host_length == 0 || host_length >= sizeof(smtp->host) || memchr(authority, '@', authority_length)) {
+        snprintf(error, error_size, "smtp: expected smtp://host[:port]?from=...&to=..., "
+                 "without a login");
+        free(smtp);
+        return NULL;
+    }
+    snprintf(smtp->host, sizeof(smtp->host), "%.*s", (int)host_length, authority);
+    if (colon) {
+        size_t port_length = authority_length - host_length - 1;
+        char* end;
+        char port[8];
+        snprintf(port, sizeof(port), "%.*s", (int)port_length, colon + 1);
+        long number = strtol(port, &end, 10);
+        if (port_length == 0 || port_length >= sizeof(port) || *end || number < 1 || number > 65535) {
+            snprintf(error, error_size, "smtp: invalid port \"%.*s\"", (int)port_length, colon + 1);
+            free(smtp);
+            return NULL;
+        }
+        snprintf(smtp->port, sizeof(smtp->port), "%ld", number);
+    }
+    if (gethostname(smtp->helo, sizeof(smtp->helo) - 1) != 0 || !smtp->helo[0]) {
+        snprintf(smtp->helo, sizeof(smtp->helo), "localhost");
+    }
+
+    const char* query = strchr(authority, '?');
+    query = query ? query + 1 : "";
+    char name[32];
+    char value[EMAIL_MAX_LENGTH + 1];
+    while (next_param(&query, name, sizeof(name), value, sizeof(value))) {
+        char domain[256];
+        bool address = strcmp(name, "from") == 0 || strcmp(name, "to") == 0;
+        if (address && email_check_syntax(value, domain, sizeof(domain)) != EMAIL_OK) {
+            snprintf(error, error_size, "smtp: %s is not an email address: \"%s\"", name, value);
+            free(smtp);
+            return NULL;
+        }
+        if (strcmp(name, "from") == 0) {
+            snprintf(smtp->from, sizeof(smtp->from), "%s", value);
+        } else if (strcmp(name, "to") == 0) {
+            if (smtp->to_count == NOTIFY_MAX_RECIPIENTS) {
+                snprintf(error, error_size, "smtp: more than %d to= addresses", NOTIFY_MAX_RECIPIENTS);
+                free(smtp);
+                return NULL;
+            }
+            snprintf(smtp->to[smtp->to_count++], sizeof(smtp->to[0]), "%s", value);
+        } else if (strcmp(name, "helo") == 0 && value[0] && strlen(value) < sizeof(smtp->helo)) {
+            snprintf(smtp->helo, sizeof(smtp->helo), "%s", value);
+        } else {
+            snprintf(error, error_size, "smtp: unknown parameter \"%s\"", name);
+            free(smtp);
+            return NULL;
+        }
+    }
+    if (!smtp->from[0] || smtp->to_count == 0) {
+        snprintf(error, error_size, "smtp: needs from= and at least one to=");
+        free(smtp);
+        return NULL;
+    }
+
+    Notifier* notifier = calloc(1, sizeof(Notifier));
+    notifier->name = "smtp";
+    notifier->send = smtp_send;
+    notifier->close = smtp_close;
+    notifier->data = smtp;
+    return notifier;
+}
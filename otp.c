@@ -0,0 +1,357 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <pthread.h>
+
+#include "otp.h"
+#include "signature.h"
+#include "tracing.h"
+
+#define SWEEP_INTERVAL 64       // Codes issued between sweeps of expired ones
+
+typedef struct Entry {
+    char* key;
+    char code_hash[SIGNATURE_HEX_LENGTH + 1];
+    long long issued;       // Unix seconds
+    long long expires;
+    int attempts_left;
+    struct Entry* next;
+} Entry;
+
+struct OtpStore {
+    int ttl;
+    int max_attempts;
+    int resend_interval;
+    Entry* entries;
+    int issues;
+    pthread_mutex_t lock;
+};
+
+static void free_entry(Entry* entry) {
+    free(entry->key);
+    free(entry);
+}
+
+// Caller holds the lock
+static void sweep(OtpStore* store, long long now) {
+    Entry** link = &store->entries;
+    while (*link) {
+        Entry* entry = *link;
+        if (entry->expires <= now) {
+            *link = entry->next;
+            free_entry(entry);
+        } else {
+            link = &entry->next;
+        }
+    }
+}
+
+// Caller holds the lock
+static Entry** find(OtpStore* store, const char* key) {
+    Entry** link = &store->entries;
+    while (*link && strcmp((*link)->key, key) != 0) {
+        link = &(*link)->next;
+    }
+    return link;
+}
+
+// Caller holds the lock
+static void unlink_entry(Entry** link) {
+    Entry* entry = *link;
+    *link = entry->next;
+    free_entry(entry);
+}
+
+OtpStore* otp_store_create(int ttl, int max_attempts, int resend_interval) {
+    OtpStore* store = calloc(1, sizeof(OtpStore));
+    store->ttl = ttl > 0 ? ttl : 1;
+    store->max_attempts = max_attempts > 0 ? max_attempts : 1;
+    store->resend_interval = resend_interval;
+    pthread_mutex_init(&store->lock, NULL);
+    return store;
+}
+
+void otp_store_free(OtpStore* store) {
+    if (!store) return;
+    while (store->entries) unlink_entry(&store->entries);
+    pthread_mutex_destroy(&store->lock);
+    free(store);
+}
+
+// Digits from /dev/urandom, dropping bytes past the last multiple of 10
+// so that every digit is as likely
+static bool random_digits(char* out, int length) {
+    FILE* random = fopen("/dev/urandom", "rb");
+    if (!random) return false;
+    int count = 0;
+    while (count < length) {
+        int byte = fgetc(random);
+        if (byte == EOF) break;
+        if (byte < 250) out[count++] = '0' + byte % 10;
+    }
+    fclose(random);
+    out[count] = '\0';
+    return count == length;
+}
+
+int otp_issue(OtpStore* store, const char* key, int length, long long now, char* code) {
+    if (length < 1) length = 1;
+    if (length > OTP_MAX_LENGTH) length = OTP_MAX_LENGTH;
+
+    pthread_mutex_lock(&store->lock);
+    if (++store->issues % SWEEP_INTERVAL == 0) sweep(store, now);
+
+    Entry** link = find(store, key);
+    if (*link && (*link)->expires > now && now < (*link)->issued + store->resend_interval) {
+        int wait = (int)((*link)->issued + store->resend_interval - now);
+        pthread_mutex_unlock(&store->lock);
+        return wait;
+    }
+    if (!random_digits(code, length)) {
+        pthread_mutex_unlock(&store->lock);
+        return -1;
+    }
+
+    Entry* entry = *link;
+    if (!entry) {
+        entry = calloc(1, sizeof(Entry));
+        entry->key = strdup(key);
+        *link = entry;
+    }
+    sha256_hex(code, length, entry->code_hash);
+    entry->issued = now;
+    entry->expires = now + store->ttl;
+    entry->attempts_left = store->max_attempts;
+    pthread_mutex_unlock(&store->lock);
+    return 0;
+}
+
+void otp_revoke(OtpStore* store, const char* key) {
+    pthread_mutex_lock(&store->lock);
+    Entry** link = find(store, key);
+    if (*link) unlink_entry(link);
+    pthread_mutex_unlock(&store->lock);
+}
+
+OtpResult otp_verify(OtpStore* store, const char* key, const char* code, long long now,
+                     int* attempts_left) {
+    char code_hash[SIGNATURE_HEX_LENGTH + 1];
+    sha256_hex(code, strlen(code), code_hash);
+    *attempts_left = 0;
+
+    pthread_mutex_lock(&store->lock);
+    Entry** link = find(store, key);
+    OtpResult result;
+    if (!*link || (*link)->expires <= now) {
+        if (*link) unlink_entry(link);
+        result = OTP_NO_CODE;
+    } else if (signature_equal((*link)->code_hash, code_hash)) {
+        unlink_entry(link);
+        result = OTP_VERIFIED;
+    } else if (--(*link)->attempts_left > 0) {
+        *attempts_left = (*link)->attempts_left;
+        result = OTP_WRONG_CODE;
+    } else {
+        unlink_entry(link);
+        result = OTP_TOO_MANY_ATTEMPTS;
+    }
+    pthread_mutex_unlock(&store->lock);
+    return result;
+}
+
+void otp_message(const char* template, const char* code, char* out, size_t out_size) {
+    const char* placeholder = strstr(template, "{code}");
+    if (!placeholder) {
+        snprintf(out, out_size, "%s %s", template, code);
+        return;
+    }
+    snprintf(out, out_size, "%.*s%s%s", (int)(placeholder - template), template, code,
+             placeholder + 6);
+}
+
+// ============= Senders =============
+
+static bool log_send(OtpSender* sender, const Context* ctx, const char* to, const char* code,
+                     const char* message, char* error, size_t error_size) {
+    fprintf(stderr, "OTP for %s: %s\n", to, message);
+    return true;
+}
+
+static void log_close(OtpSender* sender) {
+    free(sender);
+}
+
+OtpSender* otp_sender_open(const char* dsn, const char* secret, int timeout,
+                           char* error, size_t error_size) {
+    if (strcmp(dsn, "log") == 0) {
+        OtpSender* sender = calloc(1, sizeof(OtpSender));
+        sender->name = "log";
+        sender->send = log_send;
+        sender->close = log_close;
+        return sender;
+    }
+
+    if (strncmp(dsn, "twilio://", 9) == 0) {
+#ifdef HAVE_CURL
+        char credentials[512];
+        snprintf(credentials, sizeof(credentials), "%s", dsn + 9);
+        char* colon = strchr(credentials, ':');
+        char* at = strrchr(credentials, '@');
+        if (!colon || colon == credentials || !at || at < colon + 2 || at[1] != '+') {
+            snprintf(error, error_size, "expected twilio://ACCOUNT_SID:AUTH_TOKEN@+FROM");
+            return NULL;
+        }
+        *colon = '\0';
+        *at = '\0';
+        return twilio_sms_open(credentials, colon + 1, at + 1, timeout, error, error_size);
+#else
+        snprintf(error, error_size, "built without SMS support (make WITH_CURL=1)");
+        return NULL;
+#endif
+    }
+
+    if (strncmp(dsn, "webhook:", 8) == 0) {
+#ifdef HAVE_CURL
+        if (strncmp(dsn + 8, "http://", 7) != 0 && strncmp(dsn + 8, "https://", 8) != 0) {
+            snprintf(error, error_size, "expected webhook:https://HOST/PATH");
+            return NULL;
+        }
+        return webhook_sms_open(dsn + 8, secret, timeout, error, error_size);
+#else
+        snprintf(error, error_size, "built without SMS support (make WITH_CURL=1)");
+        return NULL;
+#endif
+    }
+
+    // Not echoed back, the DSN may hold a secret
+    snprintf(error, error_size, "expected twilio://ACCOUNT_SID:AUTH_TOKEN@+FROM, webhook:URL or log");
+    return NULL;
+}
+
+// ============= Resilient Sender =============
+
+typedef struct {
+    OtpSender* inner;
+    Resilience* resilience;
+    char name[64];
+} ResilientSender;
+
+// The arguments of one send, for each attempt at it
+typedef struct {
+    OtpSender* inner;
+    const char* to;
+    const char* code;
+    const char* message;
+} SendAttempt;
+
+static bool attempt_send(void* arg, const Context* ctx, char* error, size_t error_size) {
+    SendAttempt* attempt = arg;
+    return attempt->inner->send(attempt->inner, ctx, attempt->to, attempt->code,
+                                attempt->message, error, error_size);
+}
+
+static bool resilient_send(OtpSender* sender, const Context* ctx, const char* to,
+                           const char* code, const char* message, char* error,
+                           size_t error_size) {
+    ResilientSender* resilient = sender->data;
+    SendAttempt attempt = {resilient->inner, to, code, message};
+    return resilience_call(resilient->resilience, ctx, attempt_send, &attempt, error, error_size);
+}
+
+static void resilient_close(OtpSender* sender) {
+    ResilientSender* resilient = sender->data;
+    resilient->inner->close(resilient->inner);
+    resilience_free(resilient->resilience);
+    free(resilient);
+    free(sender);
+}
+
+OtpSender* resilient_otp_sender_wrap(OtpSender* inner, const char* name,
+                                     const ResiliencePolicy* policy) {
+    ResilientSender* resilient = calloc(1, sizeof(ResilientSender));
+    resilient->inner = inner;
+    snprintf(resilient->name, sizeof(resilient->name), "%s", name ? name : inner->name);
+    resilient->resilience = resilience_create("sms", resilient->name, policy);
+
+    OtpSender* sender = calloc(1, sizeof(OtpSender));
+    sender->name = resilient->name;
+    sender->send = resilient_send;
+    sender->close = resilient_close;
+    sender->data = resilient;
+    return sender;
+}
+
+// ============= Routed Sender =============
+
+typedef struct {
+    OtpSender* senders[ROUTE_MAX_PROVIDERS];
+    ProviderRoute routes[ROUTE_MAX_PROVIDERS];
+    int count;
+    char names[256];        // "twilio, webhook", the sender's name
+} RoutedSender;
+
+static bool routed_send(OtpSender* sender, const Context* ctx, const char* to, const char* code,
+                        const char* message, char* error, size_t error_size) {
+    RoutedSender* routed = sender->data;
+    char region[3];
+    int order[ROUTE_MAX_PROVIDERS];
+    route_region(to, region);
+    int count = route_order(routed->routes, routed->count, region, order);
+    if (count == 0) {
+        snprintf(error, error_size, "no sender for region %s", *region ? region : "unknown");
+        return false;
+    }
+
+    // Each sender's error, "twilio: twilio answered HTTP 503; webhook: timed out"
+    size_t used = 0;
+    error[0] = '\0';
+    Span* span = ctx ? ctx->span : NULL;
+    for (int i = 0; i < count && (i == 0 || !context_done(ctx)); i++) {
+        OtpSender* next = routed->senders[order[i]];
+        char sender_error[256] = "";
+        span_set_string(span, "peer.service", next->name);
+        span_set_int(span, "provider.failovers", i);
+        if (next->send(next, ctx, to, code, message, sender_error, sizeof(sender_error))) {
+            return true;
+        }
+        if (used < error_size) {
+            used += (size_t)snprintf(error + used, error_size - used, "%s%s: %s", used ? "; " : "",
+                                     next->name, sender_error);
+        }
+    }
+    return false;
+}
+
+static void routed_close(OtpSender* sender) {
+    RoutedSender* routed = sender->data;
+    for (int i = 0; i < routed->count; i++) {
+        routed->senders[i]->close(routed->senders[i]);
+    }
+    free(routed);
+    free(sender);
+}
+
+OtpSender* routed_otp_sender_create(void) {
+    OtpSender* sender = calloc(1, sizeof(OtpSender));
+    RoutedSender* routed = calloc(1, sizeof(RoutedSender));
+    sender->name = routed->names;
+    sender->send = routed_send;
+    sender->close = routed_close;
+    sender->data = routed;
+    return sender;
+}
+
+bool routed_otp_sender_add(OtpSender* sender, OtpSender* next, const ProviderRoute* route) {
+    RoutedSender* routed = sender->data;
+    if (routed->count == ROUTE_MAX_PROVIDERS) return false;
+    routed->senders[routed->count] = next;
+    routed->routes[routed->count] = *route;
+    routed->routes[routed->count].dsn = NULL;
+    routed->count++;
+    size_t length = strlen(routed->names);
+    snprintf(routed->names + length, sizeof(routed->names) - length, "%s%s", length ? ", " : "",
+             next->name);
+    return true;
+}
@@ -0,0 +1,96 @@
+#ifndef OTP_H
+#define OTP_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+#include "context.h"
+#include "resilience.h"
+#include "routing.h"
+
+// One-time passcodes texted to a number, so that a site can check a user
+// can receive messages there before it trusts the number.
+
+#define OTP_MAX_LENGTH 10           // Most digits in a code
+#define OTP_MAX_MESSAGE 161         // Longest text, one SMS, with its NUL
+
+// Codes waiting to be checked, one per key (a number scoped by the
+// caller), held as hashes in memory. Safe to share between threads.
+typedef struct OtpStore OtpStore;
+
+// Codes last ttl seconds and allow max_attempts wrong guesses. A new code
+// for a key can't be issued within resend_interval seconds of the last.
+OtpStore* otp_store_create(int ttl, int max_attempts, int resend_interval);
+void otp_store_free(OtpStore* store);
+
+// Writes a new code of length digits for key to code, which must hold
+// length + 1 bytes, replacing any earlier one. Returns 0, or when one was
+// issued too recently the seconds until another may be, or -1 if no random
+// bytes could be read.
+int otp_issue(OtpStore* store, const char* key, int length, long long now, char* code);
+
+// Forgets key's code, e.g. when it couldn't be sent, so that the caller
+// can ask for another straight away
+void otp_revoke(OtpStore* store, const char* key);
+
+typedef enum {
+    OTP_VERIFIED,           // Right code; it is used up
+    OTP_WRONG_CODE,         // *attempts_left more guesses are allowed
+    OTP_NO_CODE,            // None issued, expired, or already used
+    OTP_TOO_MANY_ATTEMPTS   // That was the last guess; the code is gone
+} OtpResult;
+
+OtpResult otp_verify(OtpStore* store, const char* key, const char* code, long long now,
+                     int* attempts_left);
+
+// Replaces "{code}" in template with code
+void otp_message(const char* template, const char* code, char* out, size_t out_size);
+
+// Somewhere codes are sent. Each implementation fills in the operations
+// and keeps its own state in data.
+typedef struct OtpSender OtpSender;
+struct OtpSender {
+    const char* name;
+
+    // Sends message, which holds code, to to, an E.164 number. Gives up
+    // once ctx is done.
+    bool (*send)(OtpSender* sender, const Context* ctx, const char* to, const char* code,
+                 const char* message, char* error, size_t error_size);
+    void (*close)(OtpSender* sender);
+
+    void* data;
+};
+
+// Opens the sender a DSN names:
+//   twilio://ACCOUNT_SID:AUTH_TOKEN@+15005550006 (the number texts come from)
+//   webhook:https://sms.example.com/send
+//   log (writes codes to stderr instead of sending them, for development)
+// webhook: POSTs {"to": ..., "message": ..., "code": ...}, signed with
+// secret as job callbacks are when it isn't empty. timeout is in seconds.
+// twilio:// and webhook: need a build with curl.
+OtpSender* otp_sender_open(const char* dsn, const char* secret, int timeout,
+                           char* error, size_t error_size);
+
+// Wraps a sender so that failed sends are retried and a circuit breaker
+// stops calling it while it's down, per policy (see resilience.h). name
+// is the wrapper's, for logs and metrics, NULL for inner's. Closing the
+// wrapper closes the inner sender.
+OtpSender* resilient_otp_sender_wrap(OtpSender* inner, const char* name,
+                                     const ResiliencePolicy* policy);
+
+// A sender texting each number through the senders added to it as route
+// says (see routing.h), trying the next when one fails. Its error then
+// names each sender's, and numbers no sender serves fail with "no sender
+// for region". Closing it closes the senders.
+OtpSender* routed_otp_sender_create(void);
+// False once it has ROUTE_MAX_PROVIDERS
+bool routed_otp_sender_add(OtpSender* routed, OtpSender* sender, const ProviderRoute* route);
+
+#ifdef HAVE_CURL
+OtpSender* twilio_sms_open(const char* account_sid, const char* auth_token, const char* from,
+                           int timeout, char* error, size_t error_size);
+OtpSender* webhook_sms_open(const char* url, const char* secret, int timeout,
+                            char* error, size_t error_size);
+#endif
+
+#endif
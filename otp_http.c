@@ -0,0 +1,174 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+#include <curl/curl.h>
+
+#include "otp.h"
+#include "signature.h"
+
+// Twilio's Messages API, and a generic webhook for any other SMS gateway
+
+typedef struct {
+    char url[512];          // Twilio's Messages.json for the account, or the webhook's
+    char userpwd[256];      // "ACCOUNT_SID:AUTH_TOKEN" for Twilio, empty for webhooks
+    char from[32];          // Twilio number texts come from
+    char secret[128];       // Signs webhook requests, empty leaves them unsigned
+    bool twilio;
+    int timeout;
+} HttpSender;
+
+static size_t discard_body(char* data, size_t size, size_t count, void* userdata) {
+    return size * count;
+}
+
+// Progress callback: a non-zero return aborts the transfer
+static int check_context(void* ctx, curl_off_t download_total, curl_off_t downloaded,
+                         curl_off_t upload_total, curl_off_t uploaded) {
+    return context_done(ctx);
+}
+
+// The inside of a JSON string, control characters as \u escapes
+static char* json_escape_alloc(const char* text) {
+    char* out = malloc(strlen(text) * 6 + 1);
+    size_t length = 0;
+    for (const unsigned char* c = (const unsigned char*)text; *c; c++) {
+        if (*c == '"' || *c == '\\') {
+            out[length++] = '\\';
+            out[length++] = *c;
+        } else if (*c < 0x20) {
+            length += sprintf(out + length, "\\u%04x", *c);
+        } else {
+            out[length++] = *c;
+        }
+    }
+    out[length] = '\0';
+    return out;
+}
+
+static bool http_send(OtpSender* sender, const Context* ctx, const char* to, const char* code,
+                      const char* message, char* error, size_t error_size) {
+    HttpSender* http = sender->data;
+    CURL* curl = curl_easy_init();
+    if (!curl) {
+        snprintf(error, error_size, "cannot create HTTP client");
+        return false;
+    }
+
+    char* body;
+    struct curl_slist* headers = NULL;
+    if (http->twilio) {
+        char* escaped_to = curl_easy_escape(curl, to, 0);
+        char* escaped_from = curl_easy_escape(curl, http->from, 0);
+        char* escaped_message = curl_easy_escape(curl, message, 0);
+        size_t length = strlen(escaped_to) + strlen(escaped_from) + strlen(escaped_message) + 32;
+        body = malloc(length);
+        snprintf(body, length, "To=%s&From=%s&Body=%s", escaped_to, escaped_from, escaped_message);
+        curl_free(escaped_to);
+        curl_free(escaped_from);
+        curl_free(escaped_message);
+        curl_easy_setopt(curl, CURLOPT_USERPWD, http->userpwd);
+    } else {
+        char* escaped_message = json_escape_alloc(message);
+        size_t length = strlen(to) + strlen(escaped_message) + strlen(code) + 64;
+        body = malloc(length);
+        snprintf(body, length, "{\"to\": \"%s\", \"message\": \"%s\", \"code\": \"%s\"}",
+                 to, escaped_message, code);
+        free(escaped_message);
+
+        headers = curl_slist_append(headers, "Content-Type: application/json");
+        if (http->secret[0]) {
+            // Signed as job callbacks are, see callback.h
+            char timestamp[32];
+            char header[160];
+            snprintf(timestamp, sizeof(timestamp), "%lld", (long long)time(NULL));
+            size_t signed_length = strlen(timestamp) + 1 + strlen(body);
+            char* signed_data = malloc(signed_length + 1);
+            snprintf(signed_data, signed_length + 1, "%s\n%s", timestamp, body);
+            char digest[SIGNATURE_HEX_LENGTH + 1];
+            hmac_sha256_hex(http->secret, strlen(http->secret), signed_data, signed_length, digest);
+            free(signed_data);
+
+            snprintf(header, sizeof(header), "X-Phoneval-Timestamp: %s", timestamp);
+            headers = curl_slist_append(headers, header);
+            snprintf(header, sizeof(header), "X-Phoneval-Signature: sha256=%s", digest);
+            headers = curl_slist_append(headers, header);
+        }
+        curl_easy_setopt(curl, CURLOPT_HTTPHEADER, headers);
+    }
+
+    curl_easy_setopt(curl, CURLOPT_URL, http->url);
+    curl_easy_setopt(curl, CURLOPT_TIMEOUT, (long)http->timeout);
+    curl_easy_setopt(curl, CURLOPT_NOSIGNAL, 1L);
+    curl_easy_setopt(curl, CURLOPT_PROTOCOLS_STR, "http,https");
+    curl_easy_setopt(curl, CURLOPT_POSTFIELDS, body);
+    curl_easy_setopt(curl, CURLOPT_WRITEFUNCTION, discard_body);
+    if (ctx) {
+        curl_easy_setopt(curl, CURLOPT_XFERINFOFUNCTION, check_context);
+        curl_easy_setopt(curl, CURLOPT_XFERINFODATA, (void*)ctx);
+        curl_easy_setopt(curl, CURLOPT_NOPROGRESS, 0L);
+    }
+
+    long status = 0;
+    CURLcode rc = curl_easy_perform(curl);
+    if (rc != CURLE_OK) {
+        snprintf(error, error_size, "%s", rc == CURLE_ABORTED_BY_CALLBACK ? "request cancelled"
+                                                                          : curl_easy_strerror(rc));
+    } else {
+        curl_easy_getinfo(curl, CURLINFO_RESPONSE_CODE, &status);
+        snprintf(error, error_size, "%s answered HTTP %ld", sender->name, status);
+    }
+    curl_slist_free_all(headers);
+    curl_easy_cleanup(curl);
+    free(body);
+    return status >= 200 && status < 300;
+}
+
+static void http_close(OtpSender* sender) {
+    free(sender->data);
+    free(sender);
+}
+
+static OtpSender* http_sender_create(const char* name, HttpSender* http) {
+    curl_global_init(CURL_GLOBAL_DEFAULT);
+    OtpSender* sender = calloc(1, sizeof(OtpSender));
+    sender->name = name;
+    sender->send = http_send;
+    sender->close = http_close;
+    sender->data = http;
+    return sender;
+}
+
+OtpSender* twilio_sms_open(const char* account_sid, const char* auth_token, const char* from,
+                           int timeout, char* error, size_t error_size) {
+    HttpSender* http = calloc(1, sizeof(HttpSender));
+    if (strlen(account_sid) + strlen(auth_token) + 2 > sizeof(http->userpwd) ||
+        strlen(from) >= sizeof(http->from)) {
+        snprintf(error, error_size, "twilio: account, token or number too long");
+        free(http);
+        return NULL;
+    }
+    snprintf(http->url, sizeof(http->url),
+             "https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json", account_sid);
+    snprintf(http->userpwd, sizeof(http->userpwd), "%s:%s", account_sid, auth_token);
+    snprintf(http->from, sizeof(http->from), "%s", from);
+    http->twilio = true;
+    http->timeout = timeout;
+    return http_sender_create("twilio", http);
+}
+
+OtpSender* webhook_sms_open(const char* url, const char* secret, int timeout,
+                            char* error, size_t error_size) {
+    HttpSender* http = calloc(1, sizeof(HttpSender));
+    if (strlen(url) >= sizeof(http->url) || strlen(secret) >= sizeof(http->secret)) {
+        snprintf(error, error_size, "webhook: URL or secret too long");
+        free(http);
+        return NULL;
+    }
+    snprintf(http->url, sizeof(http->url), "%s", url);
+    snprintf(http->secret, sizeof(http->secret), "%s", secret);
+    http->timeout = timeout;
+    return http_sender_create("webhook", http);
+}
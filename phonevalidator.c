@@ -0,0 +1,1550 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <ctype.h>
+#include <regex.h>
+#include <pthread.h>
+
+#include "phonevalidator.h"
+
+// ============= Numbering Plan Metadata =============
+
+// A loaded numbering plan, each pattern compiled alongside its record
+typedef struct {
+    char version[64];
+    RegionMetadata* regions;
+    regex_t* region_patterns;
+    int region_count;
+    TypePattern* type_patterns;
+    regex_t* type_regexes;
+    int type_pattern_count;
+    NumberFormat* formats;
+    regex_t* format_regexes;
+    int format_count;
+    GeoPrefix* geo_prefixes;
+    int geo_prefix_count;
+    TimezonePrefix* timezone_prefixes;
+    int timezone_prefix_count;
+    RiskPrefix* risk_prefixes;
+    int risk_prefix_count;
+    ExampleNumber* examples;
+    int example_count;
+    TypePattern* short_codes;   // Typed emergency or short_code
+    regex_t* short_code_regexes;
+    int short_code_count;
+} PhoneMetadata;
+
+// Default metadata, generated from numbering_plan.txt by the Makefile
+static const char embedded_metadata[] =
+#include "numbering_plan.inc"
+;
+
+// Current metadata. Lookups hold the read lock for their whole duration
+// so a reload never frees tables that are still in use.
+static PhoneMetadata* metadata = NULL;
+static pthread_rwlock_t metadata_lock = PTHREAD_RWLOCK_INITIALIZER;
+
+static void free_metadata(PhoneMetadata* meta) {
+    if (!meta) return;
+    for (int i = 0; i < meta->region_count; i++) {
+        free(meta->regions[i].region);
+        free(meta->regions[i].international_prefix);
+        free(meta->regions[i].national_prefix);
+        free(meta->regions[i].pattern);
+        regfree(&meta->region_patterns[i]);
+    }
+    for (int i = 0; i < meta->type_pattern_count; i++) {
+        free(meta->type_patterns[i].region);
+        free(meta->type_patterns[i].pattern);
+        regfree(&meta->type_regexes[i]);
+    }
+    for (int i = 0; i < meta->format_count; i++) {
+        free(meta->formats[i].region);
+        free(meta->formats[i].leading_digits);
+        free(meta->formats[i].pattern);
+        free(meta->formats[i].national_pattern);
+        regfree(&meta->format_regexes[i]);
+    }
+    for (int i = 0; i < meta->geo_prefix_count; i++) {
+        free(meta->geo_prefixes[i].region);
+        free(meta->geo_prefixes[i].prefix);
+        free(meta->geo_prefixes[i].description);
+    }
+    for (int i = 0; i < meta->timezone_prefix_count; i++) {
+        free(meta->timezone_prefixes[i].region);
+        free(meta->timezone_prefixes[i].prefix);
+        free(meta->timezone_prefixes[i].zones);
+    }
+    for (int i = 0; i < meta->risk_prefix_count; i++) {
+        free(meta->risk_prefixes[i].region);
+        free(meta->risk_prefixes[i].prefix);
+    }
+    for (int i = 0; i < meta->example_count; i++) {
+        free(meta->examples[i].region);
+        free(meta->examples[i].national_number);
+    }
+    for (int i = 0; i < meta->short_code_count; i++) {
+        free(meta->short_codes[i].region);
+        free(meta->short_codes[i].pattern);
+        regfree(&meta->short_code_regexes[i]);
+    }
+    free(meta->regions);
+    free(meta->region_patterns);
+    free(meta->type_patterns);
+    free(meta->type_regexes);
+    free(meta->formats);
+    free(meta->format_regexes);
+    free(meta->geo_prefixes);
+    free(meta->timezone_prefixes);
+    free(meta->risk_prefixes);
+    free(meta->examples);
+    free(meta->short_codes);
+    free(meta->short_code_regexes);
+    free(meta);
+}
+
+// Patterns imported from libphonenumber run to several kilobytes
+static bool compile_pattern(regex_t* regex, const char* pattern, bool whole_number) {
+    size_t size = strlen(pattern) + 5;
+    char* anchored = malloc(size);
+    snprintf(anchored, size, whole_number ? "^(%s)$" : "^(%s)", pattern);
+    bool compiled = regcomp(regex, anchored, REG_EXTENDED | REG_NOSUB) == 0;
+    free(anchored);
+    return compiled;
+}
+
+// Splits a record on ';', keeping empty fields
+static int split_fields(char* line, char** fields, int max_fields) {
+    int count = 0;
+    fields[count++] = line;
+    for (char* p = line; *p && count < max_fields; p++) {
+        if (*p == ';') {
+            *p = '\0';
+            fields[count++] = p + 1;
+        }
+    }
+    return count;
+}
+
+static bool parse_int_field(const char* field, int* value) {
+    char* end;
+    long parsed = strtol(field, &end, 10);
+    if (field[0] == '\0' || *end != '\0' || parsed < 0 || parsed > 999) return false;
+    *value = (int)parsed;
+    return true;
+}
+
+static bool has_region(const PhoneMetadata* meta, const char* region) {
+    for (int i = 0; i < meta->region_count; i++) {
+        if (strcmp(meta->regions[i].region, region) == 0) return true;
+    }
+    return false;
+}
+
+static const char* add_region(PhoneMetadata* meta, char** fields, int field_count) {
+    RegionMetadata region;
+    if (field_count != 8) return "region records have 8 fields";
+    if (strlen(fields[1]) != 2) return "region code must be 2 letters";
+    if (!parse_int_field(fields[2], &region.country_code) || region.country_code == 0) {
+        return "invalid country code";
+    }
+    if (!parse_int_field(fields[5], &region.min_length) ||
+        !parse_int_field(fields[6], &region.max_length) ||
+        region.min_length > region.max_length ||
+        region.max_length > PHONE_MAX_NATIONAL_LENGTH) {
+        return "invalid length range";
+    }
+
+    int i = meta->region_count;
+    meta->regions = realloc(meta->regions, sizeof(RegionMetadata) * (i + 1));
+    meta->region_patterns = realloc(meta->region_patterns, sizeof(regex_t) * (i + 1));
+    if (!compile_pattern(&meta->region_patterns[i], fields[7], true)) return "invalid pattern";
+
+    region.region = strdup(fields[1]);
+    region.international_prefix = strdup(fields[3]);
+    region.national_prefix = strdup(fields[4]);
+    region.pattern = strdup(fields[7]);
+    meta->regions[i] = region;
+    meta->region_count++;
+    return NULL;
+}
+
+static const char* add_type_pattern(PhoneMetadata* meta, char** fields, int field_count) {
+    if (field_count != 4) return "type records have 4 fields";
+    if (!has_region(meta, fields[1])) return "type for undeclared region";
+    PhoneNumberType type = phone_type_from_string(fields[2]);
+    if (type == PHONE_TYPE_UNKNOWN) return "unknown number type";
+
+    int i = meta->type_pattern_count;
+    meta->type_patterns = realloc(meta->type_patterns, sizeof(TypePattern) * (i + 1));
+    meta->type_regexes = realloc(meta->type_regexes, sizeof(regex_t) * (i + 1));
+    if (!compile_pattern(&meta->type_regexes[i], fields[3], true)) return "invalid pattern";
+
+    meta->type_patterns[i].region = strdup(fields[1]);
+    meta->type_patterns[i].type = type;
+    meta->type_patterns[i].pattern = strdup(fields[3]);
+    meta->type_pattern_count++;
+    return NULL;
+}
+
+static const char* add_format(PhoneMetadata* meta, char** fields, int field_count) {
+    if (field_count != 5) return "format records have 5 fields";
+    if (!has_region(meta, fields[1])) return "format for undeclared region";
+    if (!fields[3][0]) return "format pattern is empty";
+
+    int i = meta->format_count;
+    meta->formats = realloc(meta->formats, sizeof(NumberFormat) * (i + 1));
+    meta->format_regexes = realloc(meta->format_regexes, sizeof(regex_t) * (i + 1));
+    if (!compile_pattern(&meta->format_regexes[i], fields[2], false)) return "invalid leading digits";
+
+    meta->formats[i].region = strdup(fields[1]);
+    meta->formats[i].leading_digits = strdup(fields[2]);
+    meta->formats[i].pattern = strdup(fields[3]);
+    meta->formats[i].national_pattern = fields[4][0] ? strdup(fields[4]) : NULL;
+    meta->format_count++;
+    return NULL;
+}
+
+static const char* add_geo_prefix(PhoneMetadata* meta, char** fields, int field_count) {
+    if (field_count != 4) return "geo records have 4 fields";
+    if (!has_region(meta, fields[1])) return "geo for undeclared region";
+    if (!fields[2][0] || strspn(fields[2], "0123456789") != strlen(fields[2])) {
+        return "geo prefix must be digits";
+    }
+    if (!fields[3][0]) return "geo description is empty";
+
+    int i = meta->geo_prefix_count;
+    meta->geo_prefixes = realloc(meta->geo_prefixes, sizeof(GeoPrefix) * (i + 1));
+    meta->geo_prefixes[i].region = strdup(fields[1]);
+    meta->geo_prefixes[i].prefix = strdup(fields[2]);
+    meta->geo_prefixes[i].description = strdup(fields[3]);
+    meta->geo_prefix_count++;
+    return NULL;
+}
+
+static const char* add_timezone_prefix(PhoneMetadata* meta, char** fields, int field_count) {
+    if (field_count != 4) return "tz records have 4 fields";
+    if (!has_region(meta, fields[1])) return "tz for undeclared region";
+    if (strspn(fields[2], "0123456789") != strlen(fields[2])) return "tz prefix must be digits";
+    if (!fields[3][0]) return "tz zone list is empty";
+
+    // Every zone has to fit a PHONE_MAX_TIMEZONE_LENGTH slot
+    int zone_count = 1;
+    size_t zone_length = 0;
+    for (const char* p = fields[3]; *p; p++) {
+        if (*p == ',') {
+            zone_count++;
+            zone_length = 0;
+        } else if (++zone_length >= PHONE_MAX_TIMEZONE_LENGTH) {
+            return "tz zone name too long";
+        }
+    }
+    if (zone_count > PHONE_MAX_TIMEZONES) return "too many tz zones";
+
+    int i = meta->timezone_prefix_count;
+    meta->timezone_prefixes = realloc(meta->timezone_prefixes, sizeof(TimezonePrefix) * (i + 1));
+    meta->timezone_prefixes[i].region = strdup(fields[1]);
+    meta->timezone_prefixes[i].prefix = strdup(fields[2]);
+    meta->timezone_prefixes[i].zones = strdup(fields[3]);
+    meta->timezone_prefix_count++;
+    return NULL;
+}
+
+static const char* add_risk_prefix(PhoneMetadata* meta, char** fields, int field_count) {
+    if (field_count != 4) return "risk records have 4 fields";
+    if (!has_region(meta, fields[1])) return "risk for undeclared region";
+    if (!fields[2][0] || strspn(fields[2], "0123456789") != strlen(fields[2])) {
+        return "risk prefix must be digits";
+    }
+
+    int flags = 0;
+    char* saveptr;
+    for (char* name = strtok_r(fields[3], ",", &saveptr); name; name = strtok_r(NULL, ",", &saveptr)) {
+        int flag = 0;
+        for (int bit = PHONE_RISK_VOIP; bit <= PHONE_RISK_RECENTLY_ALLOCATED; bit <<= 1) {
+            if (strcmp(name, phone_risk_flag_string(bit)) == 0) flag = bit;
+        }
+        if (!flag) return "unknown risk flag";
+        flags |= flag;
+    }
+    if (!flags) return "risk record has no flags";
+
+    int i = meta->risk_prefix_count;
+    meta->risk_prefixes = realloc(meta->risk_prefixes, sizeof(RiskPrefix) * (i + 1));
+    meta->risk_prefixes[i].region = strdup(fields[1]);
+    meta->risk_prefixes[i].prefix = strdup(fields[2]);
+    meta->risk_prefixes[i].flags = flags;
+    meta->risk_prefix_count++;
+    return NULL;
+}
+
+// The example has to be classified as its type by the type records
+// listed before it
+static const char* add_example(PhoneMetadata* meta, char** fields, int field_count) {
+    if (field_count != 4) return "example records have 4 fields";
+    int region = 0;
+    while (region < meta->region_count && strcmp(meta->regions[region].region, fields[1]) != 0) {
+        region++;
+    }
+    if (region == meta->region_count) return "example for undeclared region";
+    PhoneNumberType type = phone_type_from_string(fields[2]);
+    if (type == PHONE_TYPE_UNKNOWN) return "unknown number type";
+
+    const char* national = fields[3];
+    int length = strlen(national);
+    if (!national[0] || strspn(national, "0123456789") != (size_t)length) {
+        return "example must be digits";
+    }
+    if (length < meta->regions[region].min_length || length > meta->regions[region].max_length ||
+        regexec(&meta->region_patterns[region], national, 0, NULL, 0) != 0) {
+        return "example doesn't match its region";
+    }
+    int matched = 0;
+    while (matched < meta->type_pattern_count &&
+           (strcmp(meta->type_patterns[matched].region, fields[1]) != 0 ||
+            regexec(&meta->type_regexes[matched], national, 0, NULL, 0) != 0)) {
+        matched++;
+    }
+    if (matched == meta->type_pattern_count || meta->type_patterns[matched].type != type) {
+        return "example isn't classified as its type";
+    }
+
+    int i = meta->example_count;
+    meta->examples = realloc(meta->examples, sizeof(ExampleNumber) * (i + 1));
+    meta->examples[i].region = strdup(fields[1]);
+    meta->examples[i].type = type;
+    meta->examples[i].national_number = strdup(national);
+    meta->example_count++;
+    return NULL;
+}
+
+static const char* add_short_code(PhoneMetadata* meta, char** fields, int field_count) {
+    if (field_count != 4) return "short records have 4 fields";
+    if (!has_region(meta, fields[1])) return "short for undeclared region";
+    PhoneNumberType type;
+    if (strcmp(fields[2], phone_type_string(PHONE_TYPE_EMERGENCY)) == 0) {
+        type = PHONE_TYPE_EMERGENCY;
+    } else if (strcmp(fields[2], phone_type_string(PHONE_TYPE_SHORT_CODE)) == 0) {
+        type = PHONE_TYPE_SHORT_CODE;
+    } else {
+        return "short records are emergency or short_code";
+    }
+
+    int i = meta->short_code_count;
+    meta->short_codes = realloc(meta->short_codes, sizeof(TypePattern) * (i + 1));
+    meta->short_code_regexes = realloc(meta->short_code_regexes, sizeof(regex_t) * (i + 1));
+    if (!compile_pattern(&meta->short_code_regexes[i], fields[3], true)) return "invalid pattern";
+
+    meta->short_codes[i].region = strdup(fields[1]);
+    meta->short_codes[i].type = type;
+    meta->short_codes[i].pattern = strdup(fields[3]);
+    meta->short_code_count++;
+    return NULL;
+}
+
+bool phone_load_metadata(const char* text, char* error, size_t error_size) {
+    PhoneMetadata* meta = calloc(1, sizeof(PhoneMetadata));
+    char* copy = strdup(text);
+    const char* problem = NULL;
+    int line_number = 0;
+
+    char* line = copy;
+    while (line && !problem) {
+        char* next = strchr(line, '\n');
+        if (next) *next++ = '\0';
+        line_number++;
+
+        size_t len = strlen(line);
+        if (len > 0 && line[len - 1] == '\r') line[--len] = '\0';
+
+        if (len > 0 && line[0] != '#') {
+            char* fields[16];
+            int field_count = split_fields(line, fields, 16);
+
+            if (strcmp(fields[0], "version") == 0 && field_count == 2) {
+                snprintf(meta->version, sizeof(meta->version), "%s", fields[1]);
+            } else if (strcmp(fields[0], "region") == 0) {
+                problem = add_region(meta, fields, field_count);
+            } else if (strcmp(fields[0], "type") == 0) {
+                problem = add_type_pattern(meta, fields, field_count);
+            } else if (strcmp(fields[0], "format") == 0) {
+                problem = add_format(meta, fields, field_count);
+            } else if (strcmp(fields[0], "geo") == 0) {
+                problem = add_geo_prefix(meta, fields, field_count);
+            } else if (strcmp(fields[0], "tz") == 0) {
+                problem = add_timezone_prefix(meta, fields, field_count);
+            } else if (strcmp(fields[0], "risk") == 0) {
+                problem = add_risk_prefix(meta, fields, field_count);
+            } else if (strcmp(fields[0], "example") == 0) {
+                problem = add_example(meta, fields, field_count);
+            } else if (strcmp(fields[0], "short") == 0) {
+                problem = add_short_code(meta, fields, field_count);
+            } else {
+                problem = "unknown record";
+            }
+        }
+        line = next;
+    }
+    free(copy);
+
+    if (!problem && meta->region_count == 0) {
+        problem = "no regions defined";
+        line_number = 0;
+    }
+    if (problem) {
+        if (line_number > 0) {
+            snprintf(error, error_size, "line %d: %s", line_number, problem);
+        } else {
+            snprintf(error, error_size, "%s", problem);
+        }
+        free_metadata(meta);
+        return false;
+    }
+
+    pthread_rwlock_wrlock(&metadata_lock);
+    PhoneMetadata* old = metadata;
+    metadata = meta;
+    pthread_rwlock_unlock(&metadata_lock);
+
+    free_metadata(old);
+    return true;
+}
+
+bool phone_load_metadata_file(const char* path, char* error, size_t error_size) {
+    FILE* file = fopen(path, "rb");
+    if (!file) {
+        snprintf(error, error_size, "cannot open %s", path);
+        return false;
+    }
+
+    fseek(file, 0, SEEK_END);
+    long size = ftell(file);
+    fseek(file, 0, SEEK_SET);
+
+    char* text = malloc(size + 1);
+    size_t read = fread(text, 1, size, file);
+    text[read] = '\0';
+    fclose(file);
+
+    bool loaded = phone_load_metadata(text, error, error_size);
+    free(text);
+    return loaded;
+}
+
+void phone_init(void) {
+    char error[256];
+    if (!phone_load_metadata(embedded_metadata, error, sizeof(error))) {
+        fprintf(stderr, "Invalid embedded metadata: %s\n", error);
+        exit(1);
+    }
+}
+
+void phone_metadata_info(PhoneMetadataInfo* info) {
+    pthread_rwlock_rdlock(&metadata_lock);
+    snprintf(info->version, sizeof(info->version), "%s", metadata->version);
+    info->region_count = metadata->region_count;
+    info->type_pattern_count = metadata->type_pattern_count;
+    info->format_count = metadata->format_count;
+    info->geo_prefix_count = metadata->geo_prefix_count;
+    info->timezone_prefix_count = metadata->timezone_prefix_count;
+    info->risk_prefix_count = metadata->risk_prefix_count;
+    info->example_count = metadata->example_count;
+    info->short_code_count = metadata->short_code_count;
+    pthread_rwlock_unlock(&metadata_lock);
+}
+
+// Prefixes being spelled out from a pattern. A prefix is closed once the
+// pattern stops spelling it digit by digit.
+typedef struct {
+    char text[PHONE_MAX_PREFIXES][PHONE_MAX_PREFIX_LENGTH + 1];
+    bool closed[PHONE_MAX_PREFIXES];
+    int count;
+} Prefixes;
+
+static const char* spell_alternatives(const char* p, Prefixes* prefixes);
+
+// Digits a bracket expression such as "[1-57-9]" at p allows, and where it ends
+static const char* class_digits(const char* p, char* digits) {
+    int count = 0;
+    for (p++; *p && *p != ']'; p++) {
+        if (p[1] == '-' && p[2] && p[2] != ']') {
+            for (char c = p[0]; c <= p[2]; c++) digits[count++] = c;
+            p += 2;
+        } else {
+            digits[count++] = *p;
+        }
+    }
+    digits[count] = '\0';
+    return *p ? p + 1 : p;
+}
+
+// Appends each of choices to every open prefix, or closes them all if that
+// would make too many
+static void extend(Prefixes* prefixes, const char* choices) {
+    int open = 0;
+    for (int i = 0; i < prefixes->count; i++) {
+        if (!prefixes->closed[i]) open++;
+    }
+    int choice_count = strlen(choices);
+    if (choice_count == 10 || prefixes->count + open * (choice_count - 1) > PHONE_MAX_PREFIXES) {
+        for (int i = 0; i < prefixes->count; i++) prefixes->closed[i] = true;
+        return;
+    }
+
+    int count = prefixes->count;
+    for (int i = 0; i < count; i++) {
+        if (prefixes->closed[i]) continue;
+        size_t len = strlen(prefixes->text[i]);
+        if (len == PHONE_MAX_PREFIX_LENGTH) {
+            prefixes->closed[i] = true;
+            continue;
+        }
+        for (int c = choice_count - 1; c >= 0; c--) {
+            int target = c == 0 ? i : prefixes->count++;
+            if (target != i) {
+                memcpy(prefixes->text[target], prefixes->text[i], len);
+                prefixes->closed[target] = false;
+            }
+            prefixes->text[target][len] = choices[c];
+            prefixes->text[target][len + 1] = '\0';
+        }
+    }
+}
+
+// Spells out one branch of a pattern, up to the '|' or ')' ending it
+static const char* spell_sequence(const char* p, Prefixes* prefixes) {
+    while (*p && *p != '|' && *p != ')') {
+        Prefixes group;
+        char digits[16] = "";
+        const char* next;
+        if (*p == '(') {
+            group = *prefixes;
+            next = spell_alternatives(p + 1, &group);
+            if (*next == ')') next++;
+        } else if (*p == '[') {
+            next = class_digits(p, digits);
+        } else {
+            digits[0] = *p;
+            digits[1] = '\0';
+            next = p + 1;
+        }
+
+        // Anything repeated or optional ends the spelling here
+        if (*next == '?' || *next == '{' || *next == '*' || *next == '+' ||
+            (*p != '(' && !isdigit((unsigned char)digits[0]))) {
+            for (int i = 0; i < prefixes->count; i++) prefixes->closed[i] = true;
+        } else if (*p == '(') {
+            *prefixes = group;
+        } else {
+            extend(prefixes, digits);
+        }
+        p = next;
+        while (*p == '?' || *p == '*' || *p == '+') p++;
+        if (*p == '{') {
+            while (*p && *p != '}') p++;
+            if (*p) p++;
+        }
+    }
+    return p;
+}
+
+// Spells out "a|b|c" up to the ')' or end closing it, each branch starting
+// from the open prefixes given
+static const char* spell_alternatives(const char* p, Prefixes* prefixes) {
+    Prefixes start = *prefixes;
+    Prefixes all = {.count = 0};
+    for (;;) {
+        Prefixes branch = start;
+        p = spell_sequence(p, &branch);
+        for (int i = 0; i < branch.count; i++) {
+            int j = 0;
+            while (j < all.count && strcmp(all.text[j], branch.text[i]) != 0) j++;
+            if (j < all.count) continue;
+            if (all.count == PHONE_MAX_PREFIXES) {
+                *prefixes = start;
+                for (int k = 0; k < prefixes->count; k++) prefixes->closed[k] = true;
+                return p;
+            }
+            all.closed[all.count] = branch.closed[i];
+            strcpy(all.text[all.count++], branch.text[i]);
+        }
+        if (*p != '|') break;
+        p++;
+    }
+    *prefixes = all;
+    return p;
+}
+
+static int compare_prefixes(const void* a, const void* b) {
+    return strcmp(a, b);
+}
+
+// Fills prefixes, sorted, with the leading digits every number matching
+// pattern starts with one of. None if the pattern starts with something
+// open-ended.
+static int spell_prefixes(const char* pattern, char prefixes[][PHONE_MAX_PREFIX_LENGTH + 1]) {
+    Prefixes spelled = {.count = 1};
+    spell_alternatives(pattern, &spelled);
+    int count = 0;
+    for (int i = 0; i < spelled.count; i++) {
+        if (spelled.text[i][0]) strcpy(prefixes[count++], spelled.text[i]);
+    }
+    if (count < spelled.count) return 0;
+    qsort(prefixes, count, sizeof(prefixes[0]), compare_prefixes);
+    return count;
+}
+
+PhoneRegionInfo* phone_get_regions(int* count, char* version, size_t version_size) {
+    pthread_rwlock_rdlock(&metadata_lock);
+    snprintf(version, version_size, "%s", metadata->version);
+    PhoneRegionInfo* regions = calloc(metadata->region_count, sizeof(PhoneRegionInfo));
+    for (int i = 0; i < metadata->region_count; i++) {
+        const RegionMetadata* meta = &metadata->regions[i];
+        PhoneRegionInfo* info = &regions[i];
+        snprintf(info->region, sizeof(info->region), "%s", meta->region);
+        info->country_code = meta->country_code;
+        snprintf(info->national_prefix, sizeof(info->national_prefix), "%s", meta->national_prefix);
+        info->min_length = meta->min_length;
+        info->max_length = meta->max_length;
+        for (int j = 0; j < metadata->type_pattern_count; j++) {
+            if (metadata->type_patterns[j].type == PHONE_TYPE_MOBILE &&
+                strcmp(metadata->type_patterns[j].region, meta->region) == 0) {
+                info->mobile_prefix_count = spell_prefixes(metadata->type_patterns[j].pattern,
+                                                           info->mobile_prefixes);
+                break;
+            }
+        }
+    }
+    *count = metadata->region_count;
+    pthread_rwlock_unlock(&metadata_lock);
+    return regions;
+}
+
+// The helpers below expect the caller to hold metadata_lock
+
+static const RegionMetadata* find_region(const char* region) {
+    if (!region) return NULL;
+    for (int i = 0; i < metadata->region_count; i++) {
+        if (strcasecmp(metadata->regions[i].region, region) == 0) {
+            return &metadata->regions[i];
+        }
+    }
+    return NULL;
+}
+
+static bool is_known_country_code(int country_code) {
+    for (int i = 0; i < metadata->region_count; i++) {
+        if (metadata->regions[i].country_code == country_code) return true;
+    }
+    return false;
+}
+
+static bool matches_pattern(const RegionMetadata* meta, const char* national_number) {
+    return regexec(&metadata->region_patterns[meta - metadata->regions],
+                   national_number, 0, NULL, 0) == 0;
+}
+
+// Picks the region a national number belongs to within a country code
+static const RegionMetadata* region_for_number(int country_code, const char* national_number) {
+    const RegionMetadata* main_region = NULL;
+    for (int i = 0; i < metadata->region_count; i++) {
+        const RegionMetadata* region = &metadata->regions[i];
+        if (region->country_code != country_code) continue;
+        if (!main_region) {
+            main_region = region;
+        } else if (matches_pattern(region, national_number)) {
+            return region;
+        }
+    }
+    return main_region;
+}
+
+// The region's short code record national_number matches, if any
+static const TypePattern* find_short_code(const char* region, const char* national_number) {
+    for (int i = 0; i < metadata->short_code_count; i++) {
+        if (strcasecmp(metadata->short_codes[i].region, region) == 0 &&
+            regexec(&metadata->short_code_regexes[i], national_number, 0, NULL, 0) == 0) {
+            return &metadata->short_codes[i];
+        }
+    }
+    return NULL;
+}
+
+// ============= Normalization =============
+
+static int normalization = PHONE_NORMALIZE_ALL;
+
+void phone_set_normalization(int steps) {
+    normalization = steps;
+}
+
+PhoneNormalizeStep phone_normalize_step_from_string(const char* name) {
+    if (strcmp(name, "digits") == 0) return PHONE_NORMALIZE_DIGITS;
+    if (strcmp(name, "punctuation") == 0) return PHONE_NORMALIZE_PUNCTUATION;
+    if (strcmp(name, "vanity") == 0) return PHONE_NORMALIZE_VANITY;
+    if (strcmp(name, "trunk_prefix") == 0) return PHONE_NORMALIZE_TRUNK_PREFIX;
+    return 0;
+}
+
+// Decodes the UTF-8 sequence at text into a code point, setting length to
+// its bytes. A malformed byte decodes as itself.
+static unsigned decode_utf8(const unsigned char* text, int* length) {
+    if (text[0] >= 0xC0 && text[0] < 0xE0 && (text[1] & 0xC0) == 0x80) {
+        *length = 2;
+        return (text[0] & 0x1F) << 6 | (text[1] & 0x3F);
+    }
+    if (text[0] >= 0xE0 && text[0] < 0xF0 && (text[1] & 0xC0) == 0x80 &&
+        (text[2] & 0xC0) == 0x80) {
+        *length = 3;
+        return (text[0] & 0x0F) << 12 | (text[1] & 0x3F) << 6 | (text[2] & 0x3F);
+    }
+    *length = 1;
+    return text[0];
+}
+
+// Zero of each digit block that forms write numbers in: Arabic-Indic,
+// Extended Arabic-Indic (Persian, Urdu), Devanagari, Bengali, fullwidth
+static const unsigned digit_zeros[] = {0x0660, 0x06F0, 0x0966, 0x09E6, 0xFF10};
+
+static int unicode_digit(unsigned code) {
+    for (size_t i = 0; i < sizeof(digit_zeros) / sizeof(digit_zeros[0]); i++) {
+        if (code >= digit_zeros[i] && code <= digit_zeros[i] + 9) return code - digit_zeros[i];
+    }
+    return -1;
+}
+
+// Direction marks and isolates right-to-left fields wrap around digits,
+// and the byte order mark some editors paste
+static bool is_bidi_mark(unsigned code) {
+    return code == 0x200E || code == 0x200F || code == 0x061C || code == 0xFEFF ||
+           (code >= 0x202A && code <= 0x202E) || (code >= 0x2066 && code <= 0x2069);
+}
+
+// No-break and other wide spaces, dashes and the minus sign, the middle
+// dot, and fullwidth brackets, hyphen, period and slash
+static bool is_unicode_separator(unsigned code) {
+    return code == 0x00A0 || code == 0x00B7 || code == 0x202F || code == 0x205F ||
+           code == 0x2212 || code == 0x3000 || code == 0x30FB ||
+           (code >= 0x2000 && code <= 0x200B) || (code >= 0x2010 && code <= 0x2015) ||
+           code == 0xFF08 || code == 0xFF09 || code == 0xFF0D || code == 0xFF0E || code == 0xFF0F;
+}
+
+// ASCII that forms wrap numbers in but the parser doesn't accept. ',', ':',
+// ';' and '=' stay for extensions.
+static bool is_stray_punctuation(char c) {
+    return c != '\0' && strchr("[]{}<>_~*'\"!?|\\", c) != NULL;
+}
+
+static bool is_extension_word(const char* word, size_t length) {
+    return (length == 1 && strncasecmp(word, "x", 1) == 0) ||
+           (length == 3 && strncasecmp(word, "ext", 3) == 0) ||
+           (length == 9 && strncasecmp(word, "extension", 9) == 0);
+}
+
+// Replaces letters with the keypad digits they share a key with, once at
+// least three digits have been written, so words alone stay unparseable.
+// An extension marker ends the number.
+static void translate_vanity(char* text) {
+    static const char keypad[] = "22233344455566677778889999";
+    int digits = 0;
+    char* p = text;
+    while (*p) {
+        if (!isalpha((unsigned char)*p)) {
+            if (isdigit((unsigned char)*p)) digits++;
+            p++;
+            continue;
+        }
+        char* end = p;
+        while (isalpha((unsigned char)*end)) end++;
+        if (digits < 3 || is_extension_word(p, end - p)) return;
+        for (; p < end; p++) *p = keypad[toupper((unsigned char)*p) - 'A'];
+    }
+}
+
+void phone_normalize(const char* raw, int steps, char* out, size_t out_size) {
+    if (out_size == 0) return;
+    size_t len = 0;
+    const unsigned char* p = (const unsigned char*)raw;
+    while (*p && len + 1 < out_size) {
+        int length;
+        unsigned code = decode_utf8(p, &length);
+        int digit = unicode_digit(code);
+        if ((steps & PHONE_NORMALIZE_DIGITS) && digit >= 0) {
+            out[len++] = '0' + digit;
+        } else if ((steps & PHONE_NORMALIZE_DIGITS) && code == 0xFF0B) {
+            out[len++] = '+';
+        } else if ((steps & PHONE_NORMALIZE_DIGITS) && is_bidi_mark(code)) {
+            // Dropped
+        } else if ((steps & PHONE_NORMALIZE_PUNCTUATION) &&
+                   (is_unicode_separator(code) || (code < 0x80 && is_stray_punctuation((char)code)))) {
+            out[len++] = ' ';
+        } else if (len + length < out_size) {
+            memcpy(out + len, p, length);
+            len += length;
+        } else {
+            break;
+        }
+        p += length;
+    }
+    out[len] = '\0';
+
+    if (steps & PHONE_NORMALIZE_VANITY) translate_vanity(out);
+}
+
+// ============= Parsing =============
+
+const char* phone_error_string(PhoneError err) {
+    switch(err) {
+        case PHONE_OK: return "OK";
+        case PHONE_ERR_NOT_A_NUMBER: return "NOT_A_NUMBER";
+        case PHONE_ERR_INVALID_COUNTRY_CODE: return "INVALID_COUNTRY_CODE";
+        case PHONE_ERR_TOO_SHORT: return "TOO_SHORT";
+        case PHONE_ERR_TOO_LONG: return "TOO_LONG";
+        case PHONE_ERR_INVALID_FOR_REGION: return "INVALID_FOR_REGION";
+        case PHONE_ERR_SHORT_CODE: return "SHORT_CODE";
+        default: return "UNKNOWN";
+    }
+}
+
+const char* phone_error_message(PhoneError err) {
+    switch(err) {
+        case PHONE_OK: return "The number is well formed";
+        case PHONE_ERR_NOT_A_NUMBER: return "This doesn't look like a phone number";
+        case PHONE_ERR_INVALID_COUNTRY_CODE: return "The country calling code is not recognised";
+        case PHONE_ERR_TOO_SHORT: return "The number has too few digits";
+        case PHONE_ERR_TOO_LONG: return "The number has too many digits";
+        case PHONE_ERR_INVALID_FOR_REGION: return "The number is not in use in its region";
+        case PHONE_ERR_SHORT_CODE: return "Short codes and emergency numbers can't be used here";
+        default: return "The number could not be parsed";
+    }
+}
+
+static bool is_punctuation(char c) {
+    return c == ' ' || c == '-' || c == '.' || c == '(' || c == ')' || c == '/';
+}
+
+// Case-insensitive strstr
+static char* find_ignore_case(char* haystack, const char* needle) {
+    size_t len = strlen(needle);
+    for (; *haystack; haystack++) {
+        if (strncasecmp(haystack, needle, len) == 0) return haystack;
+    }
+    return NULL;
+}
+
+// Ways of writing an extension, longest first so "ext." isn't taken as "ext"
+static const char* extension_markers[] = {
+    ";ext=", "extension", "ext.", "ext", "x",
+};
+
+// Finds the earliest extension marker that follows at least one digit
+static char* find_extension_marker(char* input, size_t* marker_len) {
+    char* first_digit = input;
+    while (*first_digit && !isdigit((unsigned char)*first_digit)) first_digit++;
+    if (!*first_digit) return NULL;
+
+    char* found = NULL;
+    size_t count = sizeof(extension_markers) / sizeof(extension_markers[0]);
+    for (size_t i = 0; i < count; i++) {
+        char* marker = find_ignore_case(first_digit, extension_markers[i]);
+        if (marker && (!found || marker < found)) {
+            found = marker;
+            *marker_len = strlen(extension_markers[i]);
+        }
+    }
+    return found;
+}
+
+// Splits off an extension written as ";ext=123", "ext. 123", "x123" and
+// the like. Separators between the marker and the digits are skipped.
+static PhoneError extract_extension(char* input, PhoneNumber* number) {
+    size_t marker_len = 0;
+    char* ext = find_extension_marker(input, &marker_len);
+    if (!ext) return PHONE_OK;
+
+    *ext = '\0';
+    ext += marker_len;
+    while (*ext && (is_punctuation(*ext) || *ext == ':' || isspace((unsigned char)*ext))) ext++;
+
+    size_t len = strlen(ext);
+    while (len > 0 && isspace((unsigned char)ext[len - 1])) len--;
+    if (len == 0 || len > PHONE_MAX_EXTENSION_LENGTH) return PHONE_ERR_NOT_A_NUMBER;
+    for (size_t i = 0; i < len; i++) {
+        if (!isdigit((unsigned char)ext[i])) return PHONE_ERR_NOT_A_NUMBER;
+    }
+    memcpy(number->extension, ext, len);
+    number->extension[len] = '\0';
+
+    // Drop the comma in "555-2671, ext. 12"
+    len = strlen(input);
+    while (len > 0 && (input[len - 1] == ',' || isspace((unsigned char)input[len - 1]))) {
+        input[--len] = '\0';
+    }
+    return PHONE_OK;
+}
+
+static PhoneError parse_number(const char* raw, const char* default_region, PhoneNumber* number) {
+    memset(number, 0, sizeof(*number));
+    if (!raw) return PHONE_ERR_NOT_A_NUMBER;
+
+    char input[128];
+    strncpy(input, raw, sizeof(input) - 1);
+    input[sizeof(input) - 1] = '\0';
+
+    PhoneError err = extract_extension(input, number);
+    if (err != PHONE_OK) return err;
+
+    // Collect digits, rejecting anything that isn't punctuation
+    char digits[64];
+    int digit_count = 0;
+    bool international = false;
+    bool seen_digit = false;
+    for (const char* p = input; *p; p++) {
+        if (isdigit((unsigned char)*p)) {
+            if (digit_count >= (int)sizeof(digits) - 1) return PHONE_ERR_TOO_LONG;
+            digits[digit_count++] = *p;
+            seen_digit = true;
+        } else if (*p == '+' && !seen_digit && !international) {
+            international = true;
+        } else if (!is_punctuation(*p) && !isspace((unsigned char)*p)) {
+            return PHONE_ERR_NOT_A_NUMBER;
+        }
+    }
+    digits[digit_count] = '\0';
+    if (digit_count == 0) return PHONE_ERR_NOT_A_NUMBER;
+
+    // "00" or the default region's own dialing prefix (e.g. "011" from the
+    // US) means a country code follows, just like a leading '+'
+    const RegionMetadata* default_meta = find_region(default_region);
+    const char* national = digits;
+
+    // 911, 112 or a carrier's 55555: only reachable from within the region,
+    // and too short to be mistaken for a national number. Checked first, as
+    // Australia's 000 would otherwise start an international number.
+    if (!international && default_meta && digit_count < default_meta->min_length &&
+        find_short_code(default_meta->region, digits)) {
+        number->country_code = default_meta->country_code;
+        strcpy(number->national_number, digits);
+        strcpy(number->region, default_meta->region);
+        number->short_code = true;
+        return PHONE_OK;
+    }
+
+    if (!international) {
+        const char* idd = default_meta ? default_meta->international_prefix : "00";
+        if (strncmp(digits, idd, strlen(idd)) == 0) {
+            national += strlen(idd);
+            international = true;
+        } else if (strncmp(digits, "00", 2) == 0) {
+            national += 2;
+            international = true;
+        }
+    }
+
+    if (international) {
+        // Country codes are prefix-free, so the first match wins
+        int remaining = strlen(national);
+        int code = 0;
+        for (int len = 1; len <= 3 && len < remaining; len++) {
+            code = code * 10 + (national[len - 1] - '0');
+            if (is_known_country_code(code)) {
+                number->country_code = code;
+                national += len;
+                break;
+            }
+        }
+        if (number->country_code == 0) return PHONE_ERR_INVALID_COUNTRY_CODE;
+
+        // "+44 020 7946 0958", a national prefix kept out of habit
+        const RegionMetadata* meta = region_for_number(number->country_code, national);
+        size_t prefix_len = meta ? strlen(meta->national_prefix) : 0;
+        if ((normalization & PHONE_NORMALIZE_TRUNK_PREFIX) && prefix_len > 0 &&
+            strncmp(national, meta->national_prefix, prefix_len) == 0 &&
+            !matches_pattern(meta, national) &&
+            matches_pattern(region_for_number(number->country_code, national + prefix_len),
+                            national + prefix_len)) {
+            national += prefix_len;
+        }
+    } else {
+        if (!default_meta) {
+            // Kept for phone_is_same_number(), which compares them as is
+            size_t len = strlen(national);
+            if (len >= 2 && len <= PHONE_MAX_NATIONAL_LENGTH) strcpy(number->national_number, national);
+            return PHONE_ERR_INVALID_COUNTRY_CODE;
+        }
+        number->country_code = default_meta->country_code;
+
+        size_t prefix_len = strlen(default_meta->national_prefix);
+        if (prefix_len > 0 &&
+            strncmp(national, default_meta->national_prefix, prefix_len) == 0 &&
+            (int)(strlen(national) - prefix_len) >= default_meta->min_length) {
+            national += prefix_len;
+        }
+    }
+
+    size_t national_len = strlen(national);
+    if (national_len < 2) return PHONE_ERR_TOO_SHORT;
+    if (national_len > PHONE_MAX_NATIONAL_LENGTH) return PHONE_ERR_TOO_LONG;
+    strcpy(number->national_number, national);
+
+    const RegionMetadata* meta = region_for_number(number->country_code, number->national_number);
+    if (meta) {
+        strcpy(number->region, meta->region);
+        number->possible = (int)national_len >= meta->min_length &&
+                           (int)national_len <= meta->max_length;
+        number->valid = number->possible && matches_pattern(meta, number->national_number);
+    }
+
+    return PHONE_OK;
+}
+
+PhoneError phone_parse(const char* raw, const char* default_region, PhoneNumber* number) {
+    char normalized[256];
+    if (raw) phone_normalize(raw, normalization, normalized, sizeof(normalized));
+
+    pthread_rwlock_rdlock(&metadata_lock);
+    PhoneError err = parse_number(raw ? normalized : NULL, default_region, number);
+    pthread_rwlock_unlock(&metadata_lock);
+    return err;
+}
+
+PhoneError phone_validity_reason(const PhoneNumber* number) {
+    if (number->valid) return PHONE_OK;
+    if (number->short_code) return PHONE_ERR_SHORT_CODE;
+    if (number->possible) return PHONE_ERR_INVALID_FOR_REGION;
+
+    pthread_rwlock_rdlock(&metadata_lock);
+    const RegionMetadata* meta = find_region(number->region);
+    PhoneError reason = PHONE_ERR_INVALID_COUNTRY_CODE;
+    if (meta) {
+        reason = (int)strlen(number->national_number) < meta->min_length ? PHONE_ERR_TOO_SHORT
+                                                                         : PHONE_ERR_TOO_LONG;
+    }
+    pthread_rwlock_unlock(&metadata_lock);
+    return reason;
+}
+
+// ============= Matching =============
+
+// Like parse_number(), but a national number without a region to give it
+// a country code parses, with country_code 0
+static PhoneError parse_for_match(const char* raw, const char* default_region, PhoneNumber* number) {
+    char normalized[256];
+    phone_normalize(raw, normalization, normalized, sizeof(normalized));
+    PhoneError err = parse_number(normalized, default_region, number);
+    if (err == PHONE_ERR_INVALID_COUNTRY_CODE && number->country_code == 0 &&
+        number->national_number[0]) {
+        return PHONE_OK;
+    }
+    return err;
+}
+
+static bool is_suffix_of_other(const char* a, const char* b) {
+    size_t a_len = strlen(a);
+    size_t b_len = strlen(b);
+    return a_len < b_len ? strcmp(b + b_len - a_len, a) == 0 : strcmp(a + a_len - b_len, b) == 0;
+}
+
+PhoneMatch phone_is_same_number(const char* a, const char* b, const char* default_region) {
+    if (!a || !b) return PHONE_MATCH_NOT_A_NUMBER;
+
+    PhoneNumber first;
+    PhoneNumber second;
+    pthread_rwlock_rdlock(&metadata_lock);
+    bool parsed = parse_for_match(a, default_region, &first) == PHONE_OK &&
+                  parse_for_match(b, default_region, &second) == PHONE_OK;
+    pthread_rwlock_unlock(&metadata_lock);
+    if (!parsed) return PHONE_MATCH_NOT_A_NUMBER;
+
+    if (first.extension[0] && second.extension[0] &&
+        strcmp(first.extension, second.extension) != 0) {
+        return PHONE_MATCH_NO_MATCH;
+    }
+    bool same_national = strcmp(first.national_number, second.national_number) == 0 &&
+                         strcmp(first.extension, second.extension) == 0;
+    bool suffix = is_suffix_of_other(first.national_number, second.national_number);
+
+    if (first.country_code && second.country_code) {
+        if (first.country_code != second.country_code) return PHONE_MATCH_NO_MATCH;
+        if (same_national) return PHONE_MATCH_EXACT;
+        return suffix ? PHONE_MATCH_SHORT_NSN_MATCH : PHONE_MATCH_NO_MATCH;
+    }
+    if (same_national) return PHONE_MATCH_NSN_MATCH;
+    return suffix ? PHONE_MATCH_SHORT_NSN_MATCH : PHONE_MATCH_NO_MATCH;
+}
+
+const char* phone_match_string(PhoneMatch match) {
+    switch(match) {
+        case PHONE_MATCH_NO_MATCH: return "NO_MATCH";
+        case PHONE_MATCH_SHORT_NSN_MATCH: return "SHORT_NSN_MATCH";
+        case PHONE_MATCH_NSN_MATCH: return "NSN_MATCH";
+        case PHONE_MATCH_EXACT: return "EXACT";
+        default: return "NOT_A_NUMBER";
+    }
+}
+
+// ============= Classification =============
+
+PhoneNumberType phone_get_type(const PhoneNumber* number) {
+    if (number->short_code) {
+        pthread_rwlock_rdlock(&metadata_lock);
+        const TypePattern* short_code = find_short_code(number->region, number->national_number);
+        PhoneNumberType type = short_code ? short_code->type : PHONE_TYPE_UNKNOWN;
+        pthread_rwlock_unlock(&metadata_lock);
+        return type;
+    }
+    if (!number->valid) return PHONE_TYPE_UNKNOWN;
+
+    PhoneNumberType type = PHONE_TYPE_UNKNOWN;
+    pthread_rwlock_rdlock(&metadata_lock);
+    for (int i = 0; i < metadata->type_pattern_count; i++) {
+        if (strcmp(metadata->type_patterns[i].region, number->region) == 0 &&
+            regexec(&metadata->type_regexes[i], number->national_number, 0, NULL, 0) == 0) {
+            type = metadata->type_patterns[i].type;
+            break;
+        }
+    }
+    pthread_rwlock_unlock(&metadata_lock);
+    return type;
+}
+
+const char* phone_type_string(PhoneNumberType type) {
+    switch(type) {
+        case PHONE_TYPE_FIXED_LINE: return "fixed_line";
+        case PHONE_TYPE_MOBILE: return "mobile";
+        case PHONE_TYPE_FIXED_LINE_OR_MOBILE: return "fixed_line_or_mobile";
+        case PHONE_TYPE_TOLL_FREE: return "toll_free";
+        case PHONE_TYPE_PREMIUM_RATE: return "premium_rate";
+        case PHONE_TYPE_SHARED_COST: return "shared_cost";
+        case PHONE_TYPE_VOIP: return "voip";
+        case PHONE_TYPE_EMERGENCY: return "emergency";
+        case PHONE_TYPE_SHORT_CODE: return "short_code";
+        default: return "unknown";
+    }
+}
+
+// Types of type and example records; short code types come from short records
+PhoneNumberType phone_type_from_string(const char* name) {
+    for (int type = PHONE_TYPE_FIXED_LINE; type <= PHONE_TYPE_VOIP; type++) {
+        if (strcmp(phone_type_string(type), name) == 0) return type;
+    }
+    return PHONE_TYPE_UNKNOWN;
+}
+
+// Caller holds metadata_lock
+static const ExampleNumber* find_example(const char* region, PhoneNumberType type) {
+    for (int i = 0; i < metadata->example_count; i++) {
+        const ExampleNumber* example = &metadata->examples[i];
+        if (strcasecmp(example->region, region) == 0 &&
+            (type == PHONE_TYPE_UNKNOWN || example->type == type)) {
+            return example;
+        }
+    }
+    return NULL;
+}
+
+bool phone_get_example(const char* region, PhoneNumberType type, PhoneNumber* number) {
+    memset(number, 0, sizeof(*number));
+    if (!region) return false;
+
+    pthread_rwlock_rdlock(&metadata_lock);
+    const ExampleNumber* example = find_example(region, type);
+    if (!example && (type == PHONE_TYPE_FIXED_LINE || type == PHONE_TYPE_MOBILE)) {
+        example = find_example(region, PHONE_TYPE_FIXED_LINE_OR_MOBILE);
+    }
+    if (example) {
+        number->country_code = find_region(example->region)->country_code;
+        strcpy(number->national_number, example->national_number);
+        strcpy(number->region, example->region);
+        number->possible = true;
+        number->valid = true;
+    }
+    pthread_rwlock_unlock(&metadata_lock);
+    return example != NULL;
+}
+
+// ============= Geocoding =============
+
+bool phone_get_location(const PhoneNumber* number, char* out, size_t out_size) {
+    if (!number->valid) return false;
+
+    pthread_rwlock_rdlock(&metadata_lock);
+    const GeoPrefix* best = NULL;
+    size_t best_len = 0;
+    for (int i = 0; i < metadata->geo_prefix_count; i++) {
+        const GeoPrefix* geo = &metadata->geo_prefixes[i];
+        size_t len = strlen(geo->prefix);
+        if (len > best_len && strcmp(geo->region, number->region) == 0 &&
+            strncmp(geo->prefix, number->national_number, len) == 0) {
+            best = geo;
+            best_len = len;
+        }
+    }
+    if (best) {
+        snprintf(out, out_size, "%s", best->description);
+    }
+    pthread_rwlock_unlock(&metadata_lock);
+    return best != NULL;
+}
+
+int phone_get_timezones(const PhoneNumber* number, char zones[][PHONE_MAX_TIMEZONE_LENGTH],
+                        int max_zones) {
+    if (!number->valid) return 0;
+
+    pthread_rwlock_rdlock(&metadata_lock);
+    const TimezonePrefix* best = NULL;
+    size_t best_len = 0;
+    for (int i = 0; i < metadata->timezone_prefix_count; i++) {
+        const TimezonePrefix* tz = &metadata->timezone_prefixes[i];
+        size_t len = strlen(tz->prefix);
+        if ((!best || len > best_len) && strcmp(tz->region, number->region) == 0 &&
+            strncmp(tz->prefix, number->national_number, len) == 0) {
+            best = tz;
+            best_len = len;
+        }
+    }
+
+    int count = 0;
+    if (best) {
+        const char* zone = best->zones;
+        while (*zone && count < max_zones) {
+            size_t len = strcspn(zone, ",");
+            snprintf(zones[count++], PHONE_MAX_TIMEZONE_LENGTH, "%.*s", (int)len, zone);
+            zone += len;
+            if (*zone == ',') zone++;
+        }
+    }
+    pthread_rwlock_unlock(&metadata_lock);
+    return count;
+}
+
+// ============= Risk =============
+
+const char* phone_risk_flag_string(PhoneRiskFlag flag) {
+    switch(flag) {
+        case PHONE_RISK_VOIP: return "voip";
+        case PHONE_RISK_DISPOSABLE: return "disposable";
+        case PHONE_RISK_RECENTLY_ALLOCATED: return "recently_allocated";
+        default: return "unknown";
+    }
+}
+
+int phone_get_risk_flags(const PhoneNumber* number) {
+    if (!number->valid) return 0;
+
+    int flags = phone_get_type(number) == PHONE_TYPE_VOIP ? PHONE_RISK_VOIP : 0;
+    pthread_rwlock_rdlock(&metadata_lock);
+    for (int i = 0; i < metadata->risk_prefix_count; i++) {
+        const RiskPrefix* risk = &metadata->risk_prefixes[i];
+        if (strcmp(risk->region, number->region) == 0 &&
+            strncmp(risk->prefix, number->national_number, strlen(risk->prefix)) == 0) {
+            flags |= risk->flags;
+        }
+    }
+    pthread_rwlock_unlock(&metadata_lock);
+    return flags;
+}
+
+int phone_risk_score(int flags) {
+    int score = 0;
+    if (flags & PHONE_RISK_DISPOSABLE) score += 60;
+    if (flags & PHONE_RISK_VOIP) score += 30;
+    if (flags & PHONE_RISK_RECENTLY_ALLOCATED) score += 20;
+    return score > 100 ? 100 : score;
+}
+
+// ============= Formatting =============
+
+static int count_placeholders(const char* pattern) {
+    int count = 0;
+    for (; *pattern; pattern++) {
+        if (*pattern == 'X') count++;
+    }
+    return count;
+}
+
+static const NumberFormat* find_format(const PhoneNumber* number) {
+    int len = strlen(number->national_number);
+    for (int i = 0; i < metadata->format_count; i++) {
+        const NumberFormat* format = &metadata->formats[i];
+        if (strcmp(format->region, number->region) == 0 &&
+            count_placeholders(format->pattern) == len &&
+            regexec(&metadata->format_regexes[i], number->national_number, 0, NULL, 0) == 0) {
+            return format;
+        }
+    }
+    return NULL;
+}
+
+// Fills the X placeholders of a template with the number's digits
+static void apply_pattern(const char* pattern, const char* digits, char* out, size_t out_size) {
+    size_t pos = 0;
+    for (; *pattern && pos + 1 < out_size; pattern++) {
+        out[pos++] = (*pattern == 'X') ? *digits++ : *pattern;
+    }
+    out[pos] = '\0';
+}
+
+// Short codes as dialled, RFC 3966 ones as local numbers
+static bool format_short_code(const PhoneNumber* number, PhoneFormat style, char* out, size_t out_size) {
+    int len;
+    if (style == PHONE_FORMAT_RFC3966) {
+        len = snprintf(out, out_size, "tel:%s;phone-context=+%d",
+                       number->national_number, number->country_code);
+    } else {
+        len = snprintf(out, out_size, "%s", number->national_number);
+    }
+    return len >= 0 && (size_t)len < out_size;
+}
+
+static bool format_number(const PhoneNumber* number, PhoneFormat style, char* out, size_t out_size) {
+    if (number->short_code) return format_short_code(number, style, out, out_size);
+
+    const NumberFormat* format = find_format(number);
+    const RegionMetadata* meta = find_region(number->region);
+    char grouped[PHONE_MAX_FORMATTED_LENGTH];
+    char national[PHONE_MAX_FORMATTED_LENGTH];
+    int len = 0;
+
+    if (format) {
+        apply_pattern(format->pattern, number->national_number, grouped, sizeof(grouped));
+    } else {
+        snprintf(grouped, sizeof(grouped), "%s", number->national_number);
+    }
+
+    switch(style) {
+        case PHONE_FORMAT_E164:
+            len = snprintf(out, out_size, "+%d%s", number->country_code, number->national_number);
+            return len >= 0 && (size_t)len < out_size;
+
+        case PHONE_FORMAT_INTERNATIONAL:
+            len = snprintf(out, out_size, "+%d %s", number->country_code, grouped);
+            break;
+
+        case PHONE_FORMAT_NATIONAL:
+            if (format && format->national_pattern) {
+                apply_pattern(format->national_pattern, number->national_number,
+                              national, sizeof(national));
+            } else {
+                snprintf(national, sizeof(national), "%s%s",
+                         meta ? meta->national_prefix : "", grouped);
+            }
+            len = snprintf(out, out_size, "%s", national);
+            break;
+
+        case PHONE_FORMAT_RFC3966: {
+            // tel:+CC-GROUP-GROUP with every separator turned into a hyphen
+            len = snprintf(out, out_size, "tel:+%d", number->country_code);
+            bool pending_separator = true;
+            for (const char* p = grouped; *p && len >= 0 && (size_t)len + 2 < out_size; p++) {
+                if (isdigit((unsigned char)*p)) {
+                    if (pending_separator) out[len++] = '-';
+                    out[len++] = *p;
+                    pending_separator = false;
+                } else {
+                    pending_separator = true;
+                }
+            }
+            out[len] = '\0';
+            if (number->extension[0]) {
+                len += snprintf(out + len, out_size - len, ";ext=%s", number->extension);
+            }
+            return (size_t)len < out_size;
+        }
+
+        default:
+            return false;
+    }
+
+    if (len >= 0 && (size_t)len < out_size && number->extension[0]) {
+        len += snprintf(out + len, out_size - len, " ext. %s", number->extension);
+    }
+    return len >= 0 && (size_t)len < out_size;
+}
+
+bool phone_format(const PhoneNumber* number, PhoneFormat style, char* out, size_t out_size) {
+    pthread_rwlock_rdlock(&metadata_lock);
+    bool formatted = format_number(number, style, out, out_size);
+    pthread_rwlock_unlock(&metadata_lock);
+    return formatted;
+}
+
+// ============= As You Type =============
+
+// Applies as much of a template as the digits fill, stopping after the last
+// digit so that no separator runs ahead of the typing
+static void apply_partial_pattern(const char* pattern, const char* digits, char* out, size_t out_size) {
+    size_t pos = 0;
+    for (; *pattern && *digits && pos + 1 < out_size; pattern++) {
+        out[pos++] = (*pattern == 'X') ? *digits++ : *pattern;
+    }
+    out[pos] = '\0';
+}
+
+static bool has_digit(const char* text) {
+    for (; *text; text++) {
+        if (isdigit((unsigned char)*text)) return true;
+    }
+    return false;
+}
+
+// Picks the layout for a partly typed national number: one that fits it
+// exactly, else the first that still has room for more digits
+static const NumberFormat* find_partial_format(const char* region, const char* national) {
+    int len = strlen(national);
+    const NumberFormat* roomy = NULL;
+    for (int i = 0; i < metadata->format_count; i++) {
+        const NumberFormat* format = &metadata->formats[i];
+        if (strcmp(format->region, region) != 0 ||
+            regexec(&metadata->format_regexes[i], national, 0, NULL, 0) != 0) {
+            continue;
+        }
+        int placeholders = count_placeholders(format->pattern);
+        if (placeholders == len) return format;
+        if (placeholders > len && !roomy) roomy = format;
+    }
+    return roomy;
+}
+
+// Formats national digits, with the national prefix if one was typed.
+// Returns false if no layout fits.
+static bool format_partial_national(const RegionMetadata* meta, const char* national,
+                                    const char* prefix, char* out, size_t out_size) {
+    if (!*national) {
+        snprintf(out, out_size, "%s", prefix);
+        return true;
+    }
+    const NumberFormat* format = find_partial_format(meta->region, national);
+    if (!format) return false;
+
+    char grouped[PHONE_MAX_FORMATTED_LENGTH];
+    const char* national_pattern = format->national_pattern;
+    if (*prefix && national_pattern && strncmp(national_pattern, prefix, strlen(prefix)) == 0) {
+        // The national layout spells out the prefix, e.g. "8 (XXX) XXX-XX-XX"
+        apply_partial_pattern(national_pattern, national, out, out_size);
+    } else if (*prefix) {
+        // Same as phone_format()'s national style, except that plans with
+        // their own national layout keep the prefix apart: "1 415-555-2671"
+        apply_partial_pattern(format->pattern, national, grouped, sizeof(grouped));
+        snprintf(out, out_size, "%s%s%s", prefix, national_pattern ? " " : "", grouped);
+    } else if (national_pattern && !has_digit(national_pattern)) {
+        apply_partial_pattern(national_pattern, national, out, out_size);
+    } else {
+        apply_partial_pattern(format->pattern, national, out, out_size);
+    }
+    return true;
+}
+
+// Formats everything typed so far. Caller holds metadata_lock.
+static void format_typed(PhoneAsYouType* formatter) {
+    const char* typed = formatter->typed;
+    char* out = formatter->formatted;
+    size_t out_size = sizeof(formatter->formatted);
+    snprintf(out, out_size, "%s", typed);
+
+    const RegionMetadata* default_meta = find_region(formatter->region);
+    bool plus = typed[0] == '+';
+    const char* digits = plus ? typed + 1 : typed;
+
+    // "00" or the region's own dialing prefix works like a '+'
+    size_t idd_len = 0;
+    if (!plus) {
+        const char* idd = default_meta ? default_meta->international_prefix : "00";
+        if (strncmp(digits, idd, strlen(idd)) == 0) {
+            idd_len = strlen(idd);
+        } else if (strncmp(digits, "00", 2) == 0) {
+            idd_len = 2;
+        }
+    }
+
+    if (plus || idd_len > 0) {
+        const char* rest = digits + idd_len;
+        char lead[8];
+        snprintf(lead, sizeof(lead), "%.*s", plus ? 1 : (int)idd_len, typed);
+
+        // Country codes are prefix-free, so the first match wins
+        int code = 0;
+        int code_len = 0;
+        for (int len = 1; len <= 3 && len <= (int)strlen(rest); len++) {
+            code = code * 10 + (rest[len - 1] - '0');
+            if (is_known_country_code(code)) {
+                code_len = len;
+                break;
+            }
+        }
+        if (code_len == 0) {
+            if (!plus && *rest) snprintf(out, out_size, "%s %s", lead, rest);
+            return;
+        }
+
+        const char* national = rest + code_len;
+        const RegionMetadata* meta = region_for_number(code, national);
+        char grouped[48];
+        const NumberFormat* format = *national ? find_partial_format(meta->region, national) : NULL;
+        if (*national && !format) return;
+        if (format) {
+            apply_partial_pattern(format->pattern, national, grouped, sizeof(grouped));
+        } else {
+            grouped[0] = '\0';
+        }
+        snprintf(out, out_size, "%s%s%.*s%s%s", lead, plus ? "" : " ", code_len, rest,
+                 *grouped ? " " : "", grouped);
+        return;
+    }
+
+    if (!default_meta) return;
+
+    // A typed national prefix stays, as long as digits follow it that could
+    // still make up a full number
+    const char* prefix = default_meta->national_prefix;
+    size_t prefix_len = strlen(prefix);
+    char typed_prefix[8] = "";
+    const char* national = digits;
+    if (prefix_len > 0 && prefix_len < sizeof(typed_prefix) &&
+        strncmp(digits, prefix, prefix_len) == 0) {
+        snprintf(typed_prefix, sizeof(typed_prefix), "%s", prefix);
+        national += prefix_len;
+    }
+    if (strlen(national) > PHONE_MAX_NATIONAL_LENGTH) return;
+
+    char formatted[PHONE_MAX_FORMATTED_LENGTH];
+    if (format_partial_national(default_meta, national, typed_prefix, formatted, sizeof(formatted))) {
+        snprintf(out, out_size, "%s", formatted);
+    }
+}
+
+void phone_asyoutype_init(PhoneAsYouType* formatter, const char* default_region) {
+    memset(formatter, 0, sizeof(*formatter));
+    if (default_region) {
+        snprintf(formatter->region, sizeof(formatter->region), "%s", default_region);
+    }
+}
+
+const char* phone_asyoutype_input(PhoneAsYouType* formatter, char key) {
+    size_t len = strlen(formatter->typed);
+    bool accepted = isdigit((unsigned char)key) || (key == '+' && len == 0);
+    if (!accepted || len + 1 >= sizeof(formatter->typed)) {
+        return formatter->formatted;
+    }
+    formatter->typed[len] = key;
+    formatter->typed[len + 1] = '\0';
+
+    pthread_rwlock_rdlock(&metadata_lock);
+    format_typed(formatter);
+    pthread_rwlock_unlock(&metadata_lock);
+    return formatter->formatted;
+}
+
+int phone_asyoutype_position(const PhoneAsYouType* formatter, int digit_count) {
+    if (digit_count <= 0) return 0;
+    int seen = 0;
+    for (int i = 0; formatter->formatted[i]; i++) {
+        if (isdigit((unsigned char)formatter->formatted[i]) && ++seen == digit_count) {
+            return i + 1;
+        }
+    }
+    return strlen(formatter->formatted);
+}
@@ -0,0 +1,263 @@
+#ifndef PHONEVALIDATOR_H
+#define PHONEVALIDATOR_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+#define PHONE_MAX_NATIONAL_LENGTH 17
+#define PHONE_MAX_EXTENSION_LENGTH 10
+#define PHONE_MAX_FORMATTED_LENGTH 64
+#define PHONE_MAX_TIMEZONES 12
+#define PHONE_MAX_TIMEZONE_LENGTH 40
+#define PHONE_MAX_PREFIXES 32
+#define PHONE_MAX_PREFIX_LENGTH 6
+
+// Parse errors
+typedef enum {
+    PHONE_OK,
+    PHONE_ERR_NOT_A_NUMBER,
+    PHONE_ERR_INVALID_COUNTRY_CODE,
+    PHONE_ERR_TOO_SHORT,
+    PHONE_ERR_TOO_LONG,
+    PHONE_ERR_INVALID_FOR_REGION,   // Right length, but not a number the plan uses
+    PHONE_ERR_SHORT_CODE            // A short code or emergency number, not a full number
+} PhoneError;
+
+// Number types, classified from the numbering plan
+typedef enum {
+    PHONE_TYPE_UNKNOWN,
+    PHONE_TYPE_FIXED_LINE,
+    PHONE_TYPE_MOBILE,
+    PHONE_TYPE_FIXED_LINE_OR_MOBILE,   // Plans that don't distinguish, e.g. NANP
+    PHONE_TYPE_TOLL_FREE,
+    PHONE_TYPE_PREMIUM_RATE,
+    PHONE_TYPE_SHARED_COST,
+    PHONE_TYPE_VOIP,
+    PHONE_TYPE_EMERGENCY,           // Short codes only, e.g. 911 or 112
+    PHONE_TYPE_SHORT_CODE           // Service and carrier short codes, e.g. 311 or 55555
+} PhoneNumberType;
+
+// Output styles for phone_format()
+typedef enum {
+    PHONE_FORMAT_E164,          // +14155552671
+    PHONE_FORMAT_INTERNATIONAL, // +1 415-555-2671
+    PHONE_FORMAT_NATIONAL,      // (415) 555-2671
+    PHONE_FORMAT_RFC3966        // tel:+1-415-555-2671
+} PhoneFormat;
+
+// Clean-up applied to raw input before parsing, combined as a bit mask
+typedef enum {
+    PHONE_NORMALIZE_DIGITS = 1 << 0,        // Arabic-Indic, Devanagari, Bengali and fullwidth digits to ASCII, bidi marks dropped
+    PHONE_NORMALIZE_PUNCTUATION = 1 << 1,   // [] {} quotes, Unicode dashes and spaces to spaces
+    PHONE_NORMALIZE_VANITY = 1 << 2,        // Letters after the first three digits to keypad digits, 1-800-FLOWERS
+    PHONE_NORMALIZE_TRUNK_PREFIX = 1 << 3   // A national prefix written after the country code, +44 (0)20
+} PhoneNormalizeStep;
+
+#define PHONE_NORMALIZE_ALL (PHONE_NORMALIZE_DIGITS | PHONE_NORMALIZE_PUNCTUATION | \
+                             PHONE_NORMALIZE_VANITY | PHONE_NORMALIZE_TRUNK_PREFIX)
+
+// How closely two inputs name the same number, see phone_is_same_number()
+typedef enum {
+    PHONE_MATCH_NOT_A_NUMBER,       // Either input doesn't parse
+    PHONE_MATCH_NO_MATCH,
+    PHONE_MATCH_SHORT_NSN_MATCH,    // One national number ends with the other, e.g. "555 0100"
+    PHONE_MATCH_NSN_MATCH,          // Same national number, but one has no country code
+    PHONE_MATCH_EXACT               // Same country code, national number and extension
+} PhoneMatch;
+
+// Parsed phone number
+typedef struct {
+    int country_code;
+    char national_number[PHONE_MAX_NATIONAL_LENGTH + 1];
+    char extension[PHONE_MAX_EXTENSION_LENGTH + 1];
+    char region[3];     // ISO 3166-1 alpha-2, empty if unknown
+    bool possible;      // Length fits the region's plan
+    bool valid;         // Possible and matches the region's plan
+    bool short_code;    // One of region's short codes, never possible or valid
+} PhoneNumber;
+
+// Numbering plan for a single region
+typedef struct {
+    char* region;
+    int country_code;
+    char* international_prefix;
+    char* national_prefix;
+    int min_length;
+    int max_length;
+    char* pattern;          // POSIX ERE matching valid national numbers
+} RegionMetadata;
+
+// National numbers of a region that are of a given type
+typedef struct {
+    char* region;
+    PhoneNumberType type;
+    char* pattern;          // POSIX ERE matching the whole national number
+} TypePattern;
+
+// A valid national number of a region and type, for placeholder text and
+// test fixtures
+typedef struct {
+    char* region;
+    PhoneNumberType type;
+    char* national_number;
+} ExampleNumber;
+
+// Display layout for national numbers starting with leading_digits.
+// Each X in a template is replaced by one digit of the national number.
+typedef struct {
+    char* region;
+    char* leading_digits;   // POSIX ERE matched at the start
+    char* pattern;          // e.g. "XX XXXX XXXX"
+    char* national_pattern; // NULL means national prefix + pattern
+} NumberFormat;
+
+// Place served by national numbers starting with prefix, e.g. "212" in the
+// US is "New York, NY"
+typedef struct {
+    char* region;
+    char* prefix;           // Literal digits, the longest matching prefix wins
+    char* description;
+} GeoPrefix;
+
+// IANA time zones of national numbers starting with prefix. An empty
+// prefix covers the whole region.
+typedef struct {
+    char* region;
+    char* prefix;           // Literal digits, the longest matching prefix wins
+    char* zones;            // Comma separated, e.g. "America/New_York"
+} TimezonePrefix;
+
+// Risk signals attached to ranges, combined as a bit mask
+typedef enum {
+    PHONE_RISK_VOIP = 1 << 0,                   // Internet telephony, cheap to obtain in bulk
+    PHONE_RISK_DISPOSABLE = 1 << 1,             // Known throwaway or forwarding ranges
+    PHONE_RISK_RECENTLY_ALLOCATED = 1 << 2      // Opened recently, little history to go on
+} PhoneRiskFlag;
+
+// National numbers starting with prefix carry flags
+typedef struct {
+    char* region;
+    char* prefix;           // Literal digits, every matching prefix applies
+    int flags;              // PhoneRiskFlag bits
+} RiskPrefix;
+
+// State of an as-you-type formatter, see phone_asyoutype_input()
+typedef struct {
+    char region[3];                             // Default region
+    char typed[32];                             // Digits and a leading '+' so far
+    char formatted[PHONE_MAX_FORMATTED_LENGTH];
+} PhoneAsYouType;
+
+// A region as phone_get_regions() lists it, copied out of the metadata
+typedef struct {
+    char region[3];
+    int country_code;
+    char national_prefix[8];
+    int min_length;         // Digits in a national significant number
+    int max_length;
+    // Leading digits of its mobile numbers, as far as the mobile pattern
+    // spells them out, e.g. "15", "16", "17" for DE. None when the plan
+    // doesn't tell mobiles apart.
+    char mobile_prefixes[PHONE_MAX_PREFIXES][PHONE_MAX_PREFIX_LENGTH + 1];
+    int mobile_prefix_count;
+} PhoneRegionInfo;
+
+// Summary of the metadata currently in use
+typedef struct {
+    char version[64];
+    int region_count;
+    int type_pattern_count;
+    int format_count;
+    int geo_prefix_count;
+    int timezone_prefix_count;
+    int risk_prefix_count;
+    int example_count;
+    int short_code_count;
+} PhoneMetadataInfo;
+
+// Loads the embedded numbering plan, call once before parsing
+void phone_init(void);
+
+// Replace the numbering plan at runtime. On failure the current metadata
+// stays in place and error describes the offending line.
+bool phone_load_metadata(const char* text, char* error, size_t error_size);
+bool phone_load_metadata_file(const char* path, char* error, size_t error_size);
+void phone_metadata_info(PhoneMetadataInfo* info);
+// Every region of the metadata in use, in the order it lists them, as a
+// heap allocated array to free(). version is that metadata's version.
+PhoneRegionInfo* phone_get_regions(int* count, char* version, size_t version_size);
+
+// Steps phone_parse() applies, PHONE_NORMALIZE_ALL unless set. Call before
+// parsing on other threads.
+void phone_set_normalization(int steps);
+// Writes raw with the string steps applied; PHONE_NORMALIZE_TRUNK_PREFIX
+// needs the country code, so it is only applied while parsing
+void phone_normalize(const char* raw, int steps, char* out, size_t out_size);
+// "digits", "punctuation", "vanity" or "trunk_prefix", 0 for anything else
+PhoneNormalizeStep phone_normalize_step_from_string(const char* name);
+
+// Digits written nationally that are shorter than default_region's numbers
+// and match one of its short codes parse with short_code set
+PhoneError phone_parse(const char* raw, const char* default_region, PhoneNumber* number);
+const char* phone_error_string(PhoneError err);
+// Human readable explanation, e.g. for showing next to a form field
+const char* phone_error_message(PhoneError err);
+
+// Why a parsed number isn't valid: TOO_SHORT or TOO_LONG when it isn't even
+// possible, INVALID_FOR_REGION when it is, INVALID_COUNTRY_CODE when no
+// region claims it, SHORT_CODE for short codes. PHONE_OK for valid numbers.
+PhoneError phone_validity_reason(const PhoneNumber* number);
+
+// Compares two inputs, each parsed as by phone_parse(). Without a
+// default_region an input written nationally, "(415) 555-0100", has no
+// country code and can at best be an NSN_MATCH. Extensions that differ
+// never match; one missing makes at best a SHORT_NSN_MATCH.
+PhoneMatch phone_is_same_number(const char* a, const char* b, const char* default_region);
+const char* phone_match_string(PhoneMatch match);
+
+// Fills number with the region's example of the given type, or its first
+// example for PHONE_TYPE_UNKNOWN. A region whose plan doesn't tell fixed
+// lines from mobiles answers either with its fixed_line_or_mobile example.
+// Returns false if the metadata has none.
+bool phone_get_example(const char* region, PhoneNumberType type, PhoneNumber* number);
+
+// Returns PHONE_TYPE_UNKNOWN for invalid numbers, except that short codes
+// are PHONE_TYPE_EMERGENCY or PHONE_TYPE_SHORT_CODE
+PhoneNumberType phone_get_type(const PhoneNumber* number);
+const char* phone_type_string(PhoneNumberType type);
+PhoneNumberType phone_type_from_string(const char* name);
+
+// Writes the city or area a geographic number belongs to, e.g.
+// "London". Returns false for invalid numbers and for prefixes with no
+// known location, such as mobile ranges.
+bool phone_get_location(const PhoneNumber* number, char* out, size_t out_size);
+
+// Fills zones with the IANA time zones the number may be in and returns how
+// many. Geographic numbers usually have one; mobiles get every zone of
+// their region. 0 for invalid numbers.
+int phone_get_timezones(const PhoneNumber* number, char zones[][PHONE_MAX_TIMEZONE_LENGTH],
+                        int max_zones);
+
+// PhoneRiskFlag bits for a valid number: its risk ranges, plus
+// PHONE_RISK_VOIP for numbers of type voip. 0 for invalid numbers.
+int phone_get_risk_flags(const PhoneNumber* number);
+// 0 (no signals) to 100, weighting disposable over VoIP over new ranges
+int phone_risk_score(int flags);
+const char* phone_risk_flag_string(PhoneRiskFlag flag);
+
+// Writes the number in the given style, returns false if it doesn't fit.
+// Short codes can only be dialled within their region, so every style
+// writes them as dialled, RFC 3966 as a local tel: URI with a phone-context.
+bool phone_format(const PhoneNumber* number, PhoneFormat style, char* out, size_t out_size);
+
+// Formats a number as it is typed, one key at a time, for live form fields
+void phone_asyoutype_init(PhoneAsYouType* formatter, const char* default_region);
+// Takes one keystroke, ignoring anything but digits and a leading '+', and
+// returns the number formatted as far as it has been typed. Until a layout
+// fits, or once none does, the typed digits come back unformatted.
+const char* phone_asyoutype_input(PhoneAsYouType* formatter, char key);
+// Offset in the formatted text just after the first digit_count typed
+// digits, for keeping the cursor in place
+int phone_asyoutype_position(const PhoneAsYouType* formatter, int digit_count);
+
+#endif
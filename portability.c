@@ -0,0 +1,360 @@
+#define _XOPEN_SOURCE 700   // strptime()
+#define _DEFAULT_SOURCE     // timegm()
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <stdint.h>
+#include <pthread.h>
+
+#include "portability.h"
+
+#define MAX_E164_DIGITS 15
+#define CARRIER_BUCKETS 4096        // Carriers are interned through a hash of this many slots
+
+typedef struct {
+    char name[128];
+    char mcc[4];
+    char mnc[4];
+} PortCarrier;
+
+// A ported number, its E.164 digits as an integer
+typedef struct {
+    uint64_t number;
+    int carrier;
+    int line;               // Later lines win over earlier ones for the same number
+} PortedNumber;
+
+typedef struct {
+    char prefix[MAX_E164_DIGITS + 1];
+    int carrier;
+    int line;
+} PortRange;
+
+typedef struct {
+    char source[128];
+    char as_of[PORTABILITY_DATE_LENGTH + 1];
+    PortCarrier* carriers;
+    int carrier_count;
+    PortedNumber* ported;   // Sorted by number
+    int ported_count;
+    PortRange* ranges;      // Sorted by prefix
+    int range_count;
+} PortabilityData;
+
+// Current dataset, NULL until one is loaded. Lookups hold the read lock
+// for their whole duration so a load can't free it under them.
+static PortabilityData* data = NULL;
+static pthread_rwlock_t data_lock = PTHREAD_RWLOCK_INITIALIZER;
+
+static void free_data(PortabilityData* dataset) {
+    if (!dataset) return;
+    free(dataset->carriers);
+    free(dataset->ported);
+    free(dataset->ranges);
+    free(dataset);
+}
+
+// Splits a record on ';', keeping empty fields
+static int split_fields(char* line, char** fields, int max_fields) {
+    int count = 0;
+    fields[count++] = line;
+    for (char* p = line; *p && count < max_fields; p++) {
+        if (*p == ';') {
+            *p = '\0';
+            fields[count++] = p + 1;
+        }
+    }
+    return count;
+}
+
+static bool is_digits(const char* text, size_t min, size_t max) {
+    size_t length = strlen(text);
+    return length >= min && length <= max && strspn(text, "0123456789") == length;
+}
+
+// Whether text is a YYYY-MM-DD date, filling in tm
+static bool parse_date(const char* text, struct tm* tm) {
+    memset(tm, 0, sizeof(*tm));
+    if (strlen(text) != PORTABILITY_DATE_LENGTH) return false;
+    char* end = strptime(text, "%Y-%m-%d", tm);
+    return end && !*end;
+}
+
+typedef struct {
+    int* slots;             // Carrier index + 1, 0 for empty
+} CarrierTable;
+
+// djb2 over the name, mcc and mnc
+static unsigned long hash_carrier(const char* name, const char* mcc, const char* mnc) {
+    unsigned long hash = 5381;
+    for (const char* p = name; *p; p++) hash = hash * 33 + (unsigned char)*p;
+    for (const char* p = mcc; *p; p++) hash = hash * 33 + (unsigned char)*p;
+    hash = hash * 33 + ';';
+    for (const char* p = mnc; *p; p++) hash = hash * 33 + (unsigned char)*p;
+    return hash;
+}
+
+// Index of the carrier, added to the dataset on first sight. Returns -1
+// once the table is full.
+static int intern_carrier(PortabilityData* dataset, CarrierTable* table, char** fields) {
+    const char* name = fields[2];
+    const char* mcc = fields[3];
+    const char* mnc = fields[4];
+    unsigned long slot = hash_carrier(name, mcc, mnc) % CARRIER_BUCKETS;
+    for (int probes = 0; probes < CARRIER_BUCKETS; probes++) {
+        int index = table->slots[slot] - 1;
+        if (index < 0) {
+            int i = dataset->carrier_count++;
+            dataset->carriers = realloc(dataset->carriers, sizeof(PortCarrier) * dataset->carrier_count);
+            snprintf(dataset->carriers[i].name, sizeof(dataset->carriers[i].name), "%s", name);
+            snprintf(dataset->carriers[i].mcc, sizeof(dataset->carriers[i].mcc), "%s", mcc);
+            snprintf(dataset->carriers[i].mnc, sizeof(dataset->carriers[i].mnc), "%s", mnc);
+            table->slots[slot] = i + 1;
+            return i;
+        }
+        const PortCarrier* carrier = &dataset->carriers[index];
+        if (strcmp(carrier->name, name) == 0 && strcmp(carrier->mcc, mcc) == 0 &&
+            strcmp(carrier->mnc, mnc) == 0) {
+            return index;
+        }
+        slot = (slot + 1) % CARRIER_BUCKETS;
+    }
+    return -1;
+}
+
+// The fields port and range records share
+static const char* check_carrier_fields(char** fields, int field_count) {
+    if (field_count != 5) return "port and range records have 5 fields";
+    if (!fields[2][0]) return "carrier is empty";
+    if (strlen(fields[2]) >= sizeof(((PortCarrier*)0)->name)) return "carrier name too long";
+    if ((fields[3][0] && !is_digits(fields[3], 3, 3)) || (fields[4][0] && !is_digits(fields[4], 2, 3))) {
+        return "mcc must be 3 digits and mnc 2 or 3";
+    }
+    return NULL;
+}
+
+static int compare_ported(const void* a, const void* b) {
+    const PortedNumber* x = a;
+    const PortedNumber* y = b;
+    if (x->number != y->number) return x->number < y->number ? -1 : 1;
+    return x->line - y->line;
+}
+
+static int compare_ranges(const void* a, const void* b) {
+    const PortRange* x = a;
+    const PortRange* y = b;
+    int order = strcmp(x->prefix, y->prefix);
+    return order ? order : x->line - y->line;
+}
+
+bool portability_load(const char* text, char* error, size_t error_size) {
+    PortabilityData* dataset = calloc(1, sizeof(PortabilityData));
+    CarrierTable table = {calloc(CARRIER_BUCKETS, sizeof(int))};
+    int ported_capacity = 0;
+    int range_capacity = 0;
+    char* copy = strdup(text);
+    const char* problem = NULL;
+    int line_number = 0;
+
+    char* line = copy;
+    while (line && !problem) {
+        char* next = strchr(line, '\n');
+        if (next) *next++ = '\0';
+        line_number++;
+
+        size_t len = strlen(line);
+        if (len > 0 && line[len - 1] == '\r') line[--len] = '\0';
+
+        if (len > 0 && line[0] != '#') {
+            char* fields[8];
+            int field_count = split_fields(line, fields, 8);
+            struct tm tm;
+
+            if (strcmp(fields[0], "source") == 0 && field_count == 2) {
+                snprintf(dataset->source, sizeof(dataset->source), "%s", fields[1]);
+            } else if (strcmp(fields[0], "as_of") == 0 && field_count == 2) {
+                if (parse_date(fields[1], &tm)) {
+                    snprintf(dataset->as_of, sizeof(dataset->as_of), "%s", fields[1]);
+                } else {
+                    problem = "as_of must be a YYYY-MM-DD date";
+                }
+            } else if (strcmp(fields[0], "port") == 0) {
+                problem = check_carrier_fields(fields, field_count);
+                if (!problem && !is_digits(fields[1], 7, MAX_E164_DIGITS)) {
+                    problem = "ported number must be 7 to 15 E.164 digits";
+                }
+                int carrier = problem ? -1 : intern_carrier(dataset, &table, fields);
+                if (!problem && carrier < 0) problem = "too many carriers";
+                if (!problem) {
+                    if (dataset->ported_count == ported_capacity) {
+                        ported_capacity = ported_capacity ? ported_capacity * 2 : 1024;
+                        dataset->ported = realloc(dataset->ported, sizeof(PortedNumber) * ported_capacity);
+                    }
+                    dataset->ported[dataset->ported_count++] =
+                        (PortedNumber){strtoull(fields[1], NULL, 10), carrier, line_number};
+                }
+            } else if (strcmp(fields[0], "range") == 0) {
+                problem = check_carrier_fields(fields, field_count);
+                if (!problem && !is_digits(fields[1], 1, MAX_E164_DIGITS)) {
+                    problem = "range prefix must be 1 to 15 E.164 digits";
+                }
+                int carrier = problem ? -1 : intern_carrier(dataset, &table, fields);
+                if (!problem && carrier < 0) problem = "too many carriers";
+                if (!problem) {
+                    if (dataset->range_count == range_capacity) {
+                        range_capacity = range_capacity ? range_capacity * 2 : 64;
+                        dataset->ranges = realloc(dataset->ranges, sizeof(PortRange) * range_capacity);
+                    }
+                    PortRange* range = &dataset->ranges[dataset->range_count++];
+                    snprintf(range->prefix, sizeof(range->prefix), "%s", fields[1]);
+                    range->carrier = carrier;
+                    range->line = line_number;
+                }
+            } else {
+                problem = "unknown record";
+            }
+        }
+        line = next;
+    }
+    free(copy);
+    free(table.slots);
+
+    if (!problem && !dataset->as_of[0]) {
+        problem = "no as_of record";
+        line_number = 0;
+    }
+    if (problem) {
+        if (line_number > 0) {
+            snprintf(error, error_size, "line %d: %s", line_number, problem);
+        } else {
+            snprintf(error, error_size, "%s", problem);
+        }
+        free_data(dataset);
+        return false;
+    }
+
+    // Sorted for binary search, a later record for the same number or
+    // prefix after the earlier one it replaces
+    if (dataset->ported_count > 0) {
+        qsort(dataset->ported, dataset->ported_count, sizeof(PortedNumber), compare_ported);
+    }
+    if (dataset->range_count > 0) {
+        qsort(dataset->ranges, dataset->range_count, sizeof(PortRange), compare_ranges);
+    }
+
+    pthread_rwlock_wrlock(&data_lock);
+    PortabilityData* old = data;
+    data = dataset;
+    pthread_rwlock_unlock(&data_lock);
+
+    free_data(old);
+    return true;
+}
+
+bool portability_load_file(const char* path, char* error, size_t error_size) {
+    FILE* file = fopen(path, "rb");
+    if (!file) {
+        snprintf(error, error_size, "cannot open %s", path);
+        return false;
+    }
+
+    fseek(file, 0, SEEK_END);
+    long size = ftell(file);
+    fseek(file, 0, SEEK_SET);
+
+    char* text = malloc(size + 1);
+    size_t read = fread(text, 1, size, file);
+    text[read] = '\0';
+    fclose(file);
+
+    bool loaded = portability_load(text, error, error_size);
+    free(text);
+    return loaded;
+}
+
+void portability_info(PortabilityInfo* info) {
+    memset(info, 0, sizeof(*info));
+    pthread_rwlock_rdlock(&data_lock);
+    if (data) {
+        snprintf(info->source, sizeof(info->source), "%s", data->source);
+        snprintf(info->as_of, sizeof(info->as_of), "%s", data->as_of);
+        info->ported_count = data->ported_count;
+        info->range_count = data->range_count;
+        info->carrier_count = data->carrier_count;
+    }
+    pthread_rwlock_unlock(&data_lock);
+}
+
+// The last record for number, the one that counts
+static const PortedNumber* find_ported(uint64_t number) {
+    int low = 0;
+    int high = data->ported_count;
+    while (low < high) {
+        int middle = low + (high - low) / 2;
+        if (data->ported[middle].number <= number) {
+            low = middle + 1;
+        } else {
+            high = middle;
+        }
+    }
+    return low > 0 && data->ported[low - 1].number == number ? &data->ported[low - 1] : NULL;
+}
+
+static const PortRange* find_range(const char* prefix) {
+    int low = 0;
+    int high = data->range_count;
+    while (low < high) {
+        int middle = low + (high - low) / 2;
+        if (strcmp(data->ranges[middle].prefix, prefix) <= 0) {
+            low = middle + 1;
+        } else {
+            high = middle;
+        }
+    }
+    return low > 0 && strcmp(data->ranges[low - 1].prefix, prefix) == 0 ? &data->ranges[low - 1] : NULL;
+}
+
+bool portability_lookup(const char* e164, CarrierInfo* info) {
+    const char* digits = e164[0] == '+' ? e164 + 1 : e164;
+    if (!is_digits(digits, 1, MAX_E164_DIGITS)) return false;
+
+    pthread_rwlock_rdlock(&data_lock);
+    int carrier = -1;
+    int ported = 0;
+    if (data) {
+        const PortedNumber* number = find_ported(strtoull(digits, NULL, 10));
+        if (number) {
+            carrier = number->carrier;
+            ported = 1;
+        }
+        char prefix[MAX_E164_DIGITS + 1];
+        snprintf(prefix, sizeof(prefix), "%s", digits);
+        // The longest range that matches is the most specific allocation
+        for (size_t length = strlen(prefix); carrier < 0 && length > 0; length--) {
+            prefix[length] = '\0';
+            const PortRange* range = find_range(prefix);
+            if (range) carrier = range->carrier;
+        }
+    }
+    if (carrier >= 0) {
+        memset(info, 0, sizeof(*info));
+        const PortCarrier* found = &data->carriers[carrier];
+        snprintf(info->carrier, sizeof(info->carrier), "%s", found->name);
+        snprintf(info->mcc, sizeof(info->mcc), "%s", found->mcc);
+        snprintf(info->mnc, sizeof(info->mnc), "%s", found->mnc);
+        info->ported = ported;
+        info->status = LINE_STATUS_UNKNOWN;
+        info->source = CARRIER_SOURCE_PORTABILITY;
+        snprintf(info->as_of, sizeof(info->as_of), "%s", data->as_of);
+    }
+    pthread_rwlock_unlock(&data_lock);
+    return carrier >= 0;
+}
+
+int portability_age_days(const char* date, time_t now) {
+    struct tm tm;
+    if (!parse_date(date, &tm)) return -1;
+    time_t then = timegm(&tm);
+    return now > then ? (int)((now - then) / 86400) : 0;
+}
@@ -0,0 +1,46 @@
+#ifndef PORTABILITY_H
+#define PORTABILITY_H
+
+#include <stdbool.h>
+#include <stddef.h>
+#include <time.h>
+
+#include "carrier.h"
+
+// Offline mobile number portability (MNP): a national dataset of ported
+// numbers and of the ranges operators hold, which answers carrier lookups
+// without asking an HLR. Loaded from the records import-portability
+// writes, one per line, fields separated by ";":
+//
+// source;<who published the data>
+// as_of;<YYYY-MM-DD, the day the data describes>
+// port;<E.164 digits>;<carrier>;<mcc>;<mnc>
+// range;<leading E.164 digits>;<carrier>;<mcc>;<mnc>
+
+#define PORTABILITY_DATE_LENGTH 10
+
+typedef struct {
+    char source[128];
+    char as_of[PORTABILITY_DATE_LENGTH + 1];    // Empty when nothing is loaded
+    int ported_count;
+    int range_count;
+    int carrier_count;
+} PortabilityInfo;
+
+// Replaces the dataset in use. On failure the current one stays in place
+// and error describes the offending line.
+bool portability_load(const char* text, char* error, size_t error_size);
+bool portability_load_file(const char* path, char* error, size_t error_size);
+void portability_info(PortabilityInfo* info);
+
+// Fills info for an E.164 number ("+447700900123") the dataset covers:
+// the network a ported number moved to, with ported 1, or else the holder
+// of the longest range it falls in, with ported 0. source is
+// CARRIER_SOURCE_PORTABILITY and as_of the dataset's date. Returns false
+// for numbers it doesn't cover, and when nothing is loaded.
+bool portability_lookup(const char* e164, CarrierInfo* info);
+
+// Whole days from a YYYY-MM-DD date to now, -1 if it isn't one
+int portability_age_days(const char* date, time_t now);
+
+#endif
@@ -0,0 +1,435 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <time.h>
+
+#include "privacy.h"
+#include "session.h"
+#include "signature.h"
+
+#define ERASE_BATCH 1000            // Users or history records read at a time by erasures and exports
+
+// Appends "name": count, or null if the policy it belongs to is off
+static void append_retention_count(StringBuilder* sb, const char* name, bool on, int count) {
+    if (on) {
+        sb_appendf(sb, ", \"%s\": %d", name, count);
+    } else {
+        sb_appendf(sb, ", \"%s\": null", name);
+    }
+}
+
+// Applies every retention policy now, as the user_purge, history_purge and
+// history_scrub tasks would, and reports what each removed
+void handle_scrub(HttpRequest* req, HttpResponse* res) {
+    long long now = time(NULL);
+    int users_purged = 0;
+    int history_purged = 0;
+    int history_scrubbed = 0;
+    if (config.user_retention_days > 0 &&
+        store->purge_users(store, &req->context,
+                           now - (long long)config.user_retention_days * 86400,
+                           &users_purged) != STORE_OK) {
+        error_internal(res, "Failed to purge deleted users");
+        return;
+    }
+    if (config.history_retention_days > 0 &&
+        store->purge_history(store, &req->context,
+                             now - (long long)config.history_retention_days * 86400,
+                             &history_purged) != STORE_OK) {
+        error_internal(res, "Failed to purge validation history");
+        return;
+    }
+    if (config.history_scrub_days > 0 &&
+        store->scrub_history(store, &req->context,
+                             now - (long long)config.history_scrub_days * 86400,
+                             &history_scrubbed) != STORE_OK) {
+        error_internal(res, "Failed to scrub validation history");
+        return;
+    }
+    printf("Retention applied: %d user(s) purged, %d history record(s) purged, %d scrubbed\n",
+           users_purged, history_purged, history_scrubbed);
+    
+    char completed_at[32];
+    format_utc_time(time(NULL), completed_at, sizeof(completed_at));
+    StringBuilder sb;
+    sb_init(&sb);
+    sb_appendf(&sb, "{\"completed_at\": \"%s\"", completed_at);
+    append_retention_count(&sb, "users_purged", config.user_retention_days > 0, users_purged);
+    append_retention_count(&sb, "history_purged", config.history_retention_days > 0,
+                           history_purged);
+    append_retention_count(&sb, "history_scrubbed", config.history_scrub_days > 0,
+                           history_scrubbed);
+    sb_append(&sb, "}");
+    record_audit(req, "retention.scrub", "", 0, NULL, sb.data);
+    set_json_response(res, 200, sb.data);
+    sb_free(&sb);
+}
+
+// The E.164 form of phone, empty if it doesn't parse, and in number_hash
+// the hash its validation history is kept under. Users' phones are kept in
+// E.164, and history hashes E.164 when the number parsed and what was sent
+// when it didn't.
+static void subject_number(const char* phone, const char* region, char* e164, size_t e164_size,
+                           char* number_hash) {
+    ValidationResult number;
+    snprintf(number.input, sizeof(number.input), "%s", phone);
+    number.error = phone_parse(phone, region, &number.number);
+    e164[0] = '\0';
+    if (number.error == PHONE_OK) {
+        phone_format(&number.number, PHONE_FORMAT_E164, e164, e164_size);
+    }
+    history_number_hash(&number, number_hash);
+}
+
+// Adds to users, once each, every user listed by a search for term that
+// matches: email ignoring case, or phone exactly. Soft deleted users count.
+static bool find_subject_users(const Context* ctx, const char* term, bool by_email, User** users,
+                               int* count) {
+    UserFilter filter = {0};
+    filter.deleted = USERS_INCLUDE_DELETED;
+    filter.sort = USER_SORT_ID;
+    filter.limit = ERASE_BATCH;
+    snprintf(filter.query, sizeof(filter.query), "%s", term);
+    for (;;) {
+        User* page;
+        int page_count;
+        int total;
+        if (store->list(store, ctx, &filter, &page, &page_count, &total) != STORE_OK) return false;
+        for (int i = 0; i < page_count; i++) {
+            bool match = by_email ? strcasecmp(page[i].email, term) == 0
+                                  : strcmp(page[i].phone, term) == 0;
+            bool found = false;
+            for (int j = 0; j < *count && !found; j++) found = (*users)[j].id == page[i].id;
+            if (match && !found) {
+                *users = realloc(*users, sizeof(User) * (*count + 1));
+                (*users)[(*count)++] = page[i];
+            }
+        }
+        free(page);
+        if (page_count < filter.limit) return true;
+        filter.offset += page_count;
+    }
+}
+
+// What erase_subject() found and deleted
+typedef struct {
+    User* users;            // Every user found; ones already gone are erased either way
+    int user_count;
+    int users_erased;
+    int history_erased;
+    bool caches_cleared;
+} Erasure;
+
+// Deletes for good every user with email or e164, soft deleted or not, and
+// the validation history under number_hash. Any of them may be empty. With
+// a number, cached results are dropped too, since their keys hold numbers.
+// On failure, returns false with what failed in failure; what was erased
+// by then stays erased. Free erasure->users either way.
+static bool erase_subject(const Context* ctx, const char* email, const char* e164,
+                          const char* number_hash, Erasure* erasure, const char** failure) {
+    memset(erasure, 0, sizeof(*erasure));
+    if ((email[0] && !find_subject_users(ctx, email, true, &erasure->users, &erasure->user_count)) ||
+        (e164[0] && !find_subject_users(ctx, e164, false, &erasure->users, &erasure->user_count))) {
+        *failure = "Failed to find the users to erase";
+        return false;
+    }
+    for (int i = 0; i < erasure->user_count; i++) {
+        StoreResult result = store->erase_user(store, ctx, erasure->users[i].id);
+        if (result == STORE_ERROR) {
+            *failure = "Failed to erase a user";
+            return false;
+        }
+        if (result == STORE_OK) erasure->users_erased++;
+    }
+    if (number_hash[0] &&
+        store->erase_history(store, ctx, number_hash, &erasure->history_erased) != STORE_OK) {
+        *failure = "Failed to erase validation history";
+        return false;
+    }
+    if (number_hash[0]) {
+        if (validation_cache) cache_clear(validation_cache);
+        if (cnam_cache) cache_clear(cnam_cache);
+        erasure->caches_cleared = true;
+    }
+    // Says how much, never whose
+    printf("Erasure: %d user(s) and %d history record(s) deleted\n", erasure->users_erased,
+           erasure->history_erased);
+    return true;
+}
+
+// Records an erasure in the audit trail by how much it deleted, never
+// whose: the audit trail outlives it
+static void audit_erasure(HttpRequest* req, const char* action, const Erasure* erasure) {
+    StringBuilder sb;
+    sb_init(&sb);
+    sb_append(&sb, "{\"users_erased\": [");
+    for (int i = 0; i < erasure->user_count; i++) {
+        sb_appendf(&sb, "%s%d", i > 0 ? ", " : "", erasure->users[i].id);
+    }
+    sb_appendf(&sb, "], \"history_erased\": %d}", erasure->history_erased);
+    record_audit(req, action, "", 0, NULL, sb.data);
+    sb_free(&sb);
+}
+
+// Deletes for good what is kept about a person, by their email, phone or
+// both: every user with either and the validation history of the phone.
+// The response is the record of what was erased.
+void handle_erase(HttpRequest* req, HttpResponse* res) {
+    char email[128] = "";
+    char phone[128] = "";
+    char region[8] = "";
+    json_get_string(req->body, "email", email, sizeof(email));
+    json_get_string(req->body, "phone", phone, sizeof(phone));
+    json_get_string(req->body, "region", region, sizeof(region));
+    if (!email[0] && !phone[0]) {
+        error_bad_request(res, "missing_field", "Send the email, the phone or both to erase");
+        return;
+    }
+    
+    char e164[32] = "";
+    char number_hash[SIGNATURE_HEX_LENGTH + 1] = "";
+    if (phone[0]) subject_number(phone, region, e164, sizeof(e164), number_hash);
+    Erasure erasure;
+    const char* failure;
+    if (!erase_subject(&req->context, email, e164, number_hash, &erasure, &failure)) {
+        free(erasure.users);
+        error_internal(res, failure);
+        return;
+    }
+    audit_erasure(req, "subject.erase", &erasure);
+    
+    char completed_at[32];
+    format_utc_time(time(NULL), completed_at, sizeof(completed_at));
+    StringBuilder sb;
+    sb_init(&sb);
+    sb_append(&sb, "{\"users_erased\": [");
+    for (int i = 0; i < erasure.user_count; i++) {
+        sb_appendf(&sb, "%s%d", i > 0 ? ", " : "", erasure.users[i].id);
+    }
+    sb_appendf(&sb, "], \"history_erased\": %d, \"caches_cleared\": %s, \"completed_at\": \"%s\"}",
+               erasure.history_erased, erasure.caches_cleared ? "true" : "false", completed_at);
+    set_json_response(res, 200, sb.data);
+    sb_free(&sb);
+    free(erasure.users);
+}
+
+// Reads the phone and region of a privacy request and works out the
+// number's E.164 form and history hash. Without a receipt secret or a
+// phone, answers the request and returns false.
+static bool read_privacy_request(HttpRequest* req, HttpResponse* res, char* phone,
+                                 size_t phone_size, char* e164, size_t e164_size,
+                                 char* number_hash) {
+    if (!config.receipt_secret[0]) {
+        set_error_response(res, 501, "receipts_disabled",
+                           "Privacy requests need a receipt_secret to sign their receipts", NULL);
+        return false;
+    }
+    char region[8] = "";
+    if (!get_query_param(req, "phone", phone, phone_size) || !phone[0]) {
+        error_missing_field(res, "phone");
+        return false;
+    }
+    get_query_param(req, "region", region, sizeof(region));
+    subject_number(phone, region, e164, e164_size, number_hash);
+    return true;
+}
+
+// Starts a receipt: its id, what was asked for and when, and the number's
+// history hash, which stands in for the number itself
+static bool begin_receipt(StringBuilder* sb, const char* request, const char* number_hash) {
+    char id[SESSION_ID_LENGTH + 1];
+    if (!session_new_token(id)) return false;
+    char issued_at[32];
+    format_utc_time(time(NULL), issued_at, sizeof(issued_at));
+    sb_appendf(sb,
+               "{\"receipt\": {\"id\": \"%.32s\", \"request\": \"%s\", \"number_hash\": \"%s\", "
+               "\"issued_at\": \"%s\"",
+               id, request, number_hash, issued_at);
+    return true;
+}
+
+// Answers with json signed as callbacks are: X-Phoneval-Signature is
+// "sha256=" and the hex HMAC-SHA256, under receipt_secret, of
+// X-Phoneval-Timestamp, a newline and the body. Kept with its headers,
+// the response is the receipt.
+static void set_signed_json_response(HttpResponse* res, int status, const char* json) {
+    char timestamp[32];
+    snprintf(timestamp, sizeof(timestamp), "%lld", (long long)time(NULL));
+    size_t signed_length = strlen(timestamp) + 1 + strlen(json);
+    char* signed_data = malloc(signed_length + 1);
+    snprintf(signed_data, signed_length + 1, "%s\n%s", timestamp, json);
+    char digest[SIGNATURE_HEX_LENGTH + 1];
+    hmac_sha256_hex(config.receipt_secret, strlen(config.receipt_secret), signed_data,
+                    signed_length, digest);
+    free(signed_data);
+    
+    char signature[SIGNATURE_HEX_LENGTH + 8];
+    snprintf(signature, sizeof(signature), "sha256=%s", digest);
+    add_response_header(res, "X-Phoneval-Timestamp", timestamp);
+    add_response_header(res, "X-Phoneval-Signature", signature);
+    add_response_header(res, "Cache-Control", "no-store");
+    set_json_response(res, status, json);
+}
+
+// Blocklist and allowlist entries for exactly e164, from every tenant.
+// Returns a heap array, or NULL with count -1 when the store failed.
+static ListEntry* subject_list_entries(const Context* ctx, const char* e164, int* count) {
+    ListEntry* entries;
+    int entry_count;
+    *count = 0;
+    if (store->list_entries(store, ctx, &entries, &entry_count) != STORE_OK) {
+        *count = -1;
+        return NULL;
+    }
+    for (int i = 0; i < entry_count; i++) {
+        if (e164[0] && entries[i].match == MATCH_NUMBER && strcmp(entries[i].value, e164) == 0) {
+            entries[(*count)++] = entries[i];
+        }
+    }
+    return entries;
+}
+
+// Everything kept about a phone number, for a data subject access request:
+// the users with it, soft deleted or not, its validation history from
+// every tenant and the list entries for it. Cached results aren't listed;
+// they expire within cache_ttl and an erasure drops them.
+void handle_privacy_export(HttpRequest* req, HttpResponse* res) {
+    char phone[128];
+    char e164[32];
+    char number_hash[SIGNATURE_HEX_LENGTH + 1];
+    if (!read_privacy_request(req, res, phone, sizeof(phone), e164, sizeof(e164), number_hash)) {
+        return;
+    }
+    
+    User* users = NULL;
+    int user_count = 0;
+    if (e164[0] && !find_subject_users(&req->context, e164, false, &users, &user_count)) {
+        free(users);
+        error_internal(res, "Failed to find users");
+        return;
+    }
+    StringBuilder history;
+    sb_init(&history);
+    int history_count = 0;
+    HistoryFilter filter = {0};
+    snprintf(filter.number_hash, sizeof(filter.number_hash), "%s", number_hash);
+    filter.limit = ERASE_BATCH;
+    for (;;) {
+        HistoryRecord* records;
+        int count;
+        if (store->list_history(store, &req->context, &filter, &records, &count) != STORE_OK) {
+            free(users);
+            sb_free(&history);
+            error_internal(res, "Failed to load history");
+            return;
+        }
+        for (int i = 0; i < count; i++) {
+            char json[768];
+            history_record_to_json(&records[i], json, sizeof(json));
+            sb_appendf(&history, "%s%s", history_count++ > 0 ? ", " : "", json);
+        }
+        free(records);
+        if (count < filter.limit) break;
+        filter.offset += count;
+    }
+    int entry_count;
+    ListEntry* entries = subject_list_entries(&req->context, e164, &entry_count);
+    if (entry_count < 0) {
+        free(users);
+        sb_free(&history);
+        error_internal(res, "Failed to list entries");
+        return;
+    }
+    
+    StringBuilder sb;
+    sb_init(&sb);
+    if (!begin_receipt(&sb, "export", number_hash)) {
+        free(users);
+        free(entries);
+        sb_free(&history);
+        sb_free(&sb);
+        error_internal(res, "Failed to create a receipt id");
+        return;
+    }
+    sb_appendf(&sb, ", \"users\": %d, \"history\": %d, \"list_entries\": %d}",
+               user_count, history_count, entry_count);
+    char escaped[256];
+    json_escape(phone, escaped, sizeof(escaped));
+    sb_appendf(&sb, ", \"phone\": \"%s\", \"e164\": ", escaped);
+    if (e164[0]) {
+        sb_appendf(&sb, "\"%s\"", e164);
+    } else {
+        sb_append(&sb, "null");
+    }
+    sb_append(&sb, ", \"users\": [");
+    for (int i = 0; i < user_count; i++) {
+        char json[768];
+        user_to_json(&users[i], json, sizeof(json));
+        sb_appendf(&sb, "%s%s", i > 0 ? ", " : "", json);
+    }
+    sb_appendf(&sb, "], \"history\": [%s], \"list_entries\": [", history.data);
+    for (int i = 0; i < entry_count; i++) {
+        char json[512];
+        list_entry_to_json(&entries[i], json, sizeof(json));
+        sb_appendf(&sb, "%s%s", i > 0 ? ", " : "", json);
+    }
+    sb_append(&sb, "]}");
+    printf("Privacy export: %d user(s), %d history record(s), %d list entr%s\n",
+           user_count, history_count, entry_count, entry_count == 1 ? "y" : "ies");
+    set_signed_json_response(res, 200, sb.data);
+    sb_free(&sb);
+    sb_free(&history);
+    free(users);
+    free(entries);
+}
+
+// Erases what is kept about a phone number, as /admin/erase does for a
+// phone, for a data subject's erasure request. List entries for the number
+// are the operator's own decisions about it and are kept; the receipt says
+// how many, so they can be reviewed and deleted by hand.
+void handle_privacy_erase(HttpRequest* req, HttpResponse* res) {
+    char phone[128];
+    char e164[32];
+    char number_hash[SIGNATURE_HEX_LENGTH + 1];
+    if (!read_privacy_request(req, res, phone, sizeof(phone), e164, sizeof(e164), number_hash)) {
+        return;
+    }
+    
+    Erasure erasure;
+    const char* failure;
+    if (!erase_subject(&req->context, "", e164, number_hash, &erasure, &failure)) {
+        free(erasure.users);
+        error_internal(res, failure);
+        return;
+    }
+    audit_erasure(req, "privacy.erase", &erasure);
+    int entry_count;
+    free(subject_list_entries(&req->context, e164, &entry_count));
+    
+    StringBuilder sb;
+    sb_init(&sb);
+    if (!begin_receipt(&sb, "erasure", number_hash)) {
+        free(erasure.users);
+        sb_free(&sb);
+        error_internal(res, "Failed to create a receipt id");
+        return;
+    }
+    sb_append(&sb, ", \"users_erased\": [");
+    for (int i = 0; i < erasure.user_count; i++) {
+        sb_appendf(&sb, "%s%d", i > 0 ? ", " : "", erasure.users[i].id);
+    }
+    sb_appendf(&sb, "], \"history_erased\": %d, \"caches_cleared\": %s, \"list_entries_kept\": ",
+               erasure.history_erased, erasure.caches_cleared ? "true" : "false");
+    // The erasure is done by now, so entries that can't be listed are only left uncounted
+    if (entry_count < 0) {
+        sb_append(&sb, "null}}");
+    } else {
+        sb_appendf(&sb, "%d}}", entry_count);
+    }
+    set_signed_json_response(res, 200, sb.data);
+    sb_free(&sb);
+    free(erasure.users);
+}
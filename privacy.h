@@ -0,0 +1,26 @@
+#ifndef PRIVACY_H
+#define PRIVACY_H
+
+#include "webserver.h"
+
+// Retention and erasure: the operator's routes for applying retention
+// policies now and deleting what is kept about a person, and the
+// /api/v1/privacy routes that answer a data subject's access and erasure
+// requests with signed receipts. Erasures are recorded in the audit trail
+// by how much they deleted, never whose.
+
+// POST /admin/scrub: applies every retention policy now, as the
+// user_purge, history_purge and history_scrub tasks would
+void handle_scrub(HttpRequest* req, HttpResponse* res);
+
+// POST /admin/erase: deletes for good every user with the email or phone
+// sent, soft deleted or not, and the phone's validation history
+void handle_erase(HttpRequest* req, HttpResponse* res);
+
+// GET /api/v1/privacy/export and DELETE /api/v1/privacy/erase, for the
+// phone number in the query. Both answer with a receipt signed under receipt_secret, and 501
+// receipts_disabled without one.
+void handle_privacy_export(HttpRequest* req, HttpResponse* res);
+void handle_privacy_erase(HttpRequest* req, HttpResponse* res);
+
+#endif
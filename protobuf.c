@@ -0,0 +1,143 @@
+#include <stdlib.h>
+#include <string.h>
+
+#include "protobuf.h"
+
+#define PROTO_MAX_VARINT 10
+
+// ============= Writing =============
+
+void proto_writer_init(ProtoWriter* writer) {
+    writer->capacity = 256;
+    writer->data = malloc(writer->capacity);
+    writer->length = 0;
+}
+
+void proto_writer_free(ProtoWriter* writer) {
+    free(writer->data);
+    writer->data = NULL;
+    writer->length = writer->capacity = 0;
+}
+
+static void reserve(ProtoWriter* writer, size_t extra) {
+    if (writer->length + extra <= writer->capacity) return;
+    while (writer->length + extra > writer->capacity) writer->capacity *= 2;
+    writer->data = realloc(writer->data, writer->capacity);
+}
+
+static void write_varint(ProtoWriter* writer, uint64_t value) {
+    reserve(writer, PROTO_MAX_VARINT);
+    do {
+        unsigned char byte = value & 0x7F;
+        value >>= 7;
+        writer->data[writer->length++] = value ? byte | 0x80 : byte;
+    } while (value);
+}
+
+static void write_tag(ProtoWriter* writer, int field, ProtoWireType type) {
+    write_varint(writer, (uint64_t)field << 3 | type);
+}
+
+void proto_write_varint_field(ProtoWriter* writer, int field, uint64_t value) {
+    write_tag(writer, field, PROTO_VARINT);
+    write_varint(writer, value);
+}
+
+void proto_write_uint(ProtoWriter* writer, int field, uint64_t value) {
+    if (value) proto_write_varint_field(writer, field, value);
+}
+
+void proto_write_bool(ProtoWriter* writer, int field, bool value) {
+    if (value) proto_write_varint_field(writer, field, 1);
+}
+
+void proto_write_bytes(ProtoWriter* writer, int field, const void* data, size_t length) {
+    write_tag(writer, field, PROTO_LENGTH_DELIMITED);
+    write_varint(writer, length);
+    reserve(writer, length);
+    memcpy(writer->data + writer->length, data, length);
+    writer->length += length;
+}
+
+void proto_write_string(ProtoWriter* writer, int field, const char* value) {
+    if (value[0]) proto_write_bytes(writer, field, value, strlen(value));
+}
+
+void proto_write_message(ProtoWriter* writer, int field, const ProtoWriter* message) {
+    proto_write_bytes(writer, field, message->data, message->length);
+}
+
+// ============= Reading =============
+
+void proto_reader_init(ProtoReader* reader, const void* data, size_t length) {
+    reader->data = data;
+    reader->length = length;
+    reader->offset = 0;
+    reader->malformed = false;
+}
+
+static bool read_varint(ProtoReader* reader, uint64_t* value) {
+    *value = 0;
+    for (int shift = 0; shift < PROTO_MAX_VARINT * 7; shift += 7) {
+        if (reader->offset >= reader->length) return false;
+        unsigned char byte = reader->data[reader->offset++];
+        *value |= (uint64_t)(byte & 0x7F) << shift;
+        if (!(byte & 0x80)) return true;
+    }
+    return false;
+}
+
+bool proto_read_field(ProtoReader* reader, ProtoField* field) {
+    if (reader->malformed || reader->offset >= reader->length) return false;
+
+    uint64_t tag;
+    if (!read_varint(reader, &tag) || tag >> 3 == 0 || tag >> 3 > INT32_MAX) {
+        reader->malformed = true;
+        return false;
+    }
+    field->number = (int)(tag >> 3);
+    field->type = (ProtoWireType)(tag & 7);
+    field->value = 0;
+    field->bytes = NULL;
+    field->length = 0;
+
+    size_t skip = 0;
+    switch (field->type) {
+        case PROTO_VARINT:
+            if (!read_varint(reader, &field->value)) reader->malformed = true;
+            break;
+        case PROTO_LENGTH_DELIMITED:
+            if (!read_varint(reader, &field->value) ||
+                field->value > reader->length - reader->offset) {
+                reader->malformed = true;
+                break;
+            }
+            field->bytes = reader->data + reader->offset;
+            field->length = (size_t)field->value;
+            reader->offset += field->length;
+            break;
+        case PROTO_FIXED64:
+            skip = 8;
+            break;
+        case PROTO_FIXED32:
+            skip = 4;
+            break;
+        default:
+            // Groups are long deprecated and never appear in our messages
+            reader->malformed = true;
+            break;
+    }
+    if (skip > reader->length - reader->offset) {
+        reader->malformed = true;
+    }
+    reader->offset += reader->malformed ? 0 : skip;
+    return !reader->malformed;
+}
+
+bool proto_field_string(const ProtoField* field, char* out, size_t out_size) {
+    if (field->type != PROTO_LENGTH_DELIMITED) return false;
+    size_t length = field->length < out_size - 1 ? field->length : out_size - 1;
+    memcpy(out, field->bytes, length);
+    out[length] = '\0';
+    return true;
+}
@@ -0,0 +1,66 @@
+#ifndef PROTOBUF_H
+#define PROTOBUF_H
+
+#include <stdbool.h>
+#include <stddef.h>
+#include <stdint.h>
+
+// Just enough of the protocol buffers wire format for the gRPC service:
+// varints and length-delimited fields, written and read by field number.
+// The messages themselves are described in proto/phone_validator.proto.
+
+typedef enum {
+    PROTO_VARINT = 0,
+    PROTO_FIXED64 = 1,
+    PROTO_LENGTH_DELIMITED = 2,
+    PROTO_FIXED32 = 5
+} ProtoWireType;
+
+typedef struct {
+    unsigned char* data;
+    size_t length;
+    size_t capacity;
+} ProtoWriter;
+
+void proto_writer_init(ProtoWriter* writer);
+void proto_writer_free(ProtoWriter* writer);
+
+// Like proto3 itself, these skip fields holding their default (0, false,
+// ""), which readers take as the default anyway
+void proto_write_uint(ProtoWriter* writer, int field, uint64_t value);
+void proto_write_bool(ProtoWriter* writer, int field, bool value);
+void proto_write_string(ProtoWriter* writer, int field, const char* value);
+
+// Always written, for optional fields and embedded messages
+void proto_write_varint_field(ProtoWriter* writer, int field, uint64_t value);
+void proto_write_bytes(ProtoWriter* writer, int field, const void* data, size_t length);
+void proto_write_message(ProtoWriter* writer, int field, const ProtoWriter* message);
+
+typedef struct {
+    const unsigned char* data;
+    size_t length;
+    size_t offset;
+    bool malformed;         // Set when a field runs past the end
+} ProtoReader;
+
+// One field as read. Varints land in value; length-delimited fields in
+// bytes and length. Fixed-width fields are skipped, leaving both empty.
+typedef struct {
+    int number;
+    ProtoWireType type;
+    uint64_t value;
+    const unsigned char* bytes;
+    size_t length;
+} ProtoField;
+
+void proto_reader_init(ProtoReader* reader, const void* data, size_t length);
+
+// Reads the next field. Returns false at the end of the message or once it
+// turns out malformed.
+bool proto_read_field(ProtoReader* reader, ProtoField* field);
+
+// Copies a length-delimited field into out as a C string, truncating.
+// Returns false, leaving out alone, for any other wire type.
+bool proto_field_string(const ProtoField* field, char* out, size_t out_size);
+
+#endif
@@ -0,0 +1,181 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <math.h>
+#include <pthread.h>
+
+#include "ratelimit.h"
+
+#define BUCKET_BINS 1024
+#define SWEEP_INTERVAL 4096     // Insertions between sweeps of idle buckets
+
+typedef struct Bucket {
+    char key[128];
+    double tokens;
+    double updated;
+    double rate;
+    int burst;
+    struct Bucket* next;
+} Bucket;
+
+struct RateLimiter {
+    double rate;
+    int burst;
+    Bucket* bins[BUCKET_BINS];
+    int insertions;
+    pthread_mutex_t lock;
+    Redis* redis;           // Shared buckets, in place of bins, when set
+    char prefix[64];
+};
+
+// Refills and takes from the bucket in KEYS[1] atomically, by the server's
+// clock. ARGV is the rate and burst. Returns {1, 0} when allowed, otherwise
+// {0, seconds until the next token}. An idle bucket expires once it would
+// be full again.
+static const char* take_token_script =
+    "local rate = tonumber(ARGV[1])\n"
+    "local burst = tonumber(ARGV[2])\n"
+    "local time = redis.call('TIME')\n"
+    "local now = tonumber(time[1]) + tonumber(time[2]) / 1000000\n"
+    "local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated')\n"
+    "local tokens = tonumber(bucket[1]) or burst\n"
+    "local updated = tonumber(bucket[2]) or now\n"
+    "tokens = math.min(burst, tokens + math.max(0, now - updated) * rate)\n"
+    "local allowed = tokens >= 1\n"
+    "if allowed then tokens = tokens - 1 end\n"
+    "redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(now))\n"
+    "redis.call('EXPIRE', KEYS[1], math.ceil((burst - tokens) / rate) + 1)\n"
+    "if allowed then return {1, 0} end\n"
+    "return {0, math.max(1, math.ceil((1 - tokens) / rate))}\n";
+
+// FNV-1a
+static unsigned int hash_key(const char* key) {
+    unsigned int hash = 2166136261u;
+    for (; *key; key++) {
+        hash ^= (unsigned char)*key;
+        hash *= 16777619u;
+    }
+    return hash % BUCKET_BINS;
+}
+
+static void refill(Bucket* bucket, double now) {
+    bucket->tokens += (now - bucket->updated) * bucket->rate;
+    if (bucket->tokens > bucket->burst) bucket->tokens = bucket->burst;
+    bucket->updated = now;
+}
+
+// Drops buckets that have refilled completely; they behave exactly like
+// new ones, so forgetting them is free and keeps memory bounded by the
+// number of recently active clients. Caller holds the lock.
+static void sweep(RateLimiter* limiter, double now) {
+    for (int i = 0; i < BUCKET_BINS; i++) {
+        Bucket** link = &limiter->bins[i];
+        while (*link) {
+            Bucket* bucket = *link;
+            refill(bucket, now);
+            if (bucket->tokens >= bucket->burst) {
+                *link = bucket->next;
+                free(bucket);
+            } else {
+                link = &bucket->next;
+            }
+        }
+    }
+}
+
+RateLimiter* rate_limiter_create(double rate, int burst) {
+    RateLimiter* limiter = calloc(1, sizeof(RateLimiter));
+    limiter->rate = rate;
+    limiter->burst = burst > 0 ? burst : 1;
+    pthread_mutex_init(&limiter->lock, NULL);
+    return limiter;
+}
+
+RateLimiter* rate_limiter_create_shared(Redis* redis, const char* prefix, double rate, int burst) {
+    RateLimiter* limiter = rate_limiter_create(rate, burst);
+    limiter->redis = redis;
+    snprintf(limiter->prefix, sizeof(limiter->prefix), "%s", prefix);
+    return limiter;
+}
+
+static bool shared_allow(RateLimiter* limiter, const char* key, double rate, int burst,
+                         int* retry_after) {
+    char name[192];
+    char rate_text[32];
+    char burst_text[16];
+    snprintf(name, sizeof(name), "%s%s", limiter->prefix, key);
+    snprintf(rate_text, sizeof(rate_text), "%.17g", rate);
+    snprintf(burst_text, sizeof(burst_text), "%d", burst);
+    const char* argv[] = {"EVAL", take_token_script, "1", name, rate_text, burst_text};
+    size_t lengths[] = {4, strlen(take_token_script), 1, strlen(name), strlen(rate_text),
+                        strlen(burst_text)};
+
+    RedisReply reply;
+    if (!redis_command(limiter->redis, 6, argv, lengths, &reply)) return true;
+    bool allowed = reply.count != 2 || !reply.values[0] || strcmp(reply.values[0], "0") != 0;
+    if (!allowed) {
+        *retry_after = reply.values[1] ? atoi(reply.values[1]) : 1;
+    }
+    redis_reply_free(&reply);
+    return allowed;
+}
+
+void rate_limiter_free(RateLimiter* limiter) {
+    for (int i = 0; i < BUCKET_BINS; i++) {
+        Bucket* bucket = limiter->bins[i];
+        while (bucket) {
+            Bucket* next = bucket->next;
+            free(bucket);
+            bucket = next;
+        }
+    }
+    pthread_mutex_destroy(&limiter->lock);
+    free(limiter);
+}
+
+bool rate_limiter_allow(RateLimiter* limiter, const char* key, double now, int* retry_after) {
+    return rate_limiter_allow_with(limiter, key, limiter->rate, limiter->burst, now, retry_after);
+}
+
+bool rate_limiter_allow_with(RateLimiter* limiter, const char* key, double rate, int burst,
+                             double now, int* retry_after) {
+    if (burst < 1) burst = 1;
+    if (limiter->redis) return shared_allow(limiter, key, rate, burst, retry_after);
+
+    pthread_mutex_lock(&limiter->lock);
+
+    unsigned int bin = hash_key(key);
+    Bucket* bucket = limiter->bins[bin];
+    while (bucket && strcmp(bucket->key, key) != 0) {
+        bucket = bucket->next;
+    }
+
+    if (bucket) {
+        bucket->rate = rate;
+        bucket->burst = burst;
+        refill(bucket, now);
+    } else {
+        if (++limiter->insertions % SWEEP_INTERVAL == 0) {
+            sweep(limiter, now);
+        }
+        bucket = calloc(1, sizeof(Bucket));
+        strncpy(bucket->key, key, sizeof(bucket->key) - 1);
+        bucket->tokens = burst;
+        bucket->updated = now;
+        bucket->rate = rate;
+        bucket->burst = burst;
+        bucket->next = limiter->bins[bin];
+        limiter->bins[bin] = bucket;
+    }
+
+    bool allowed = bucket->tokens >= 1;
+    if (allowed) {
+        bucket->tokens -= 1;
+    } else {
+        *retry_after = (int)ceil((1 - bucket->tokens) / rate);
+        if (*retry_after < 1) *retry_after = 1;
+    }
+
+    pthread_mutex_unlock(&limiter->lock);
+    return allowed;
+}
@@ -0,0 +1,31 @@
+#ifndef RATELIMIT_H
+#define RATELIMIT_H
+
+#include <stdbool.h>
+
+#include "redis.h"
+
+// Token buckets keyed by an arbitrary string (client IP, API key). Each key
+// may burst up to burst requests, then gets rate requests per second.
+// Safe to share between threads.
+typedef struct RateLimiter RateLimiter;
+
+RateLimiter* rate_limiter_create(double rate, int burst);
+
+// Buckets kept in Redis under keys starting with prefix, so every replica
+// using the server takes from the same ones. Their clock is the server's,
+// not now. While the server can't be reached every request is allowed.
+RateLimiter* rate_limiter_create_shared(Redis* redis, const char* prefix, double rate, int burst);
+void rate_limiter_free(RateLimiter* limiter);
+
+// Takes a token for key at time now (seconds, monotonic). When the bucket is
+// empty returns false and sets retry_after to the whole seconds until the
+// next token.
+bool rate_limiter_allow(RateLimiter* limiter, const char* key, double now, int* retry_after);
+
+// As rate_limiter_allow(), with the bucket for key refilling at rate and
+// holding up to burst in place of the limiter's own
+bool rate_limiter_allow_with(RateLimiter* limiter, const char* key, double rate, int burst,
+                             double now, int* retry_after);
+
+#endif
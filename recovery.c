@@ -0,0 +1,109 @@
+#define _XOPEN_SOURCE 700   // sigaltstack() and SA_ONSTACK
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <signal.h>
+#include <unistd.h>
+#include <execinfo.h>
+
+#include "recovery.h"
+
+static const int crash_signals[] = {SIGSEGV, SIGBUS, SIGFPE, SIGILL, SIGABRT};
+
+#define CRASH_SIGNAL_COUNT (int)(sizeof(crash_signals) / sizeof(crash_signals[0]))
+#define ALTERNATE_STACK_SIZE (64 * 1024)
+
+static CrashReporter reporter = NULL;
+
+// Per-thread recovery state. The frames are captured inside the signal
+// handler, while the crashed stack still exists.
+static _Thread_local sigjmp_buf* recovery_point = NULL;
+static _Thread_local int crashed_signal = 0;
+static _Thread_local void* crashed_frames[RECOVERY_MAX_FRAMES];
+static _Thread_local int crashed_frame_count = 0;
+static _Thread_local void* alternate_stack = NULL;
+
+static void crash_handler(int sig) {
+    if (!recovery_point) {
+        // Not inside a request: fall back to the default action so the
+        // process dies (and dumps core) as it would have without us
+        signal(sig, SIG_DFL);
+        raise(sig);
+        return;
+    }
+
+    crashed_signal = sig;
+    crashed_frame_count = backtrace(crashed_frames, RECOVERY_MAX_FRAMES);
+
+    sigjmp_buf* point = recovery_point;
+    recovery_point = NULL;
+    siglongjmp(*point, 1);
+}
+
+void recovery_install(void) {
+    // backtrace() loads libgcc on first use, which isn't safe inside a
+    // signal handler, so warm it up here
+    void* warm_up[1];
+    backtrace(warm_up, 1);
+
+    struct sigaction action;
+    memset(&action, 0, sizeof(action));
+    action.sa_handler = crash_handler;
+    action.sa_flags = SA_ONSTACK | SA_NODEFER;
+    sigemptyset(&action.sa_mask);
+
+    for (int i = 0; i < CRASH_SIGNAL_COUNT; i++) {
+        sigaction(crash_signals[i], &action, NULL);
+    }
+}
+
+void recovery_set_reporter(CrashReporter crash_reporter) {
+    reporter = crash_reporter;
+}
+
+void recovery_thread_init(void) {
+    stack_t stack;
+    stack.ss_size = ALTERNATE_STACK_SIZE;
+    stack.ss_sp = malloc(stack.ss_size);
+    stack.ss_flags = 0;
+    if (stack.ss_sp && sigaltstack(&stack, NULL) == 0) {
+        alternate_stack = stack.ss_sp;
+    } else {
+        free(stack.ss_sp);
+    }
+}
+
+void recovery_thread_cleanup(void) {
+    if (!alternate_stack) return;
+
+    stack_t disable;
+    memset(&disable, 0, sizeof(disable));
+    disable.ss_flags = SS_DISABLE;
+    sigaltstack(&disable, NULL);
+    free(alternate_stack);
+    alternate_stack = NULL;
+}
+
+void recovery_arm(sigjmp_buf* point) {
+    recovery_point = point;
+}
+
+void recovery_report(const char* method, const char* path) {
+    CrashReport report;
+    report.signal = crashed_signal;
+    report.method = method;
+    report.path = path;
+    report.frame_count = crashed_frame_count;
+    memcpy(report.frames, crashed_frames, sizeof(void*) * crashed_frame_count);
+
+    flockfile(stderr);
+    fprintf(stderr, "Recovered from %s in %s %s\n", strsignal(crashed_signal), method, path);
+    fflush(stderr);
+    backtrace_symbols_fd(report.frames, report.frame_count, STDERR_FILENO);
+    funlockfile(stderr);
+
+    if (reporter) {
+        reporter(&report);
+    }
+}
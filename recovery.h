@@ -0,0 +1,41 @@
+#ifndef RECOVERY_H
+#define RECOVERY_H
+
+#include <setjmp.h>
+#include <stdbool.h>
+
+#define RECOVERY_MAX_FRAMES 64
+
+// What a crashed request looked like, passed to the reporter
+typedef struct {
+    int signal;
+    const char* method;
+    const char* path;
+    void* frames[RECOVERY_MAX_FRAMES];  // Return addresses, innermost first
+    int frame_count;
+} CrashReport;
+
+// Called after a crash has been turned into a 500, e.g. to forward it to
+// Sentry. Runs on the crashed request's thread.
+typedef void (*CrashReporter)(const CrashReport* report);
+
+// Installs handlers for SIGSEGV, SIGBUS, SIGFPE, SIGILL and SIGABRT. A
+// crash on a thread with an armed recovery point jumps back to it; any
+// other crash still terminates the process.
+void recovery_install(void);
+void recovery_set_reporter(CrashReporter reporter);
+
+// Each connection thread needs its own alternate signal stack so that a
+// stack overflow can be caught too
+void recovery_thread_init(void);
+void recovery_thread_cleanup(void);
+
+// Arms point for the calling thread; pass NULL to disarm. The caller must
+// have called sigsetjmp(*point, 1) and keep that frame alive while armed.
+void recovery_arm(sigjmp_buf* point);
+
+// After a jump back to the recovery point: the signal and the stack that
+// led to it. Logs the trace to stderr and calls the reporter.
+void recovery_report(const char* method, const char* path);
+
+#endif
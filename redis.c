@@ -0,0 +1,238 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdarg.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <pthread.h>
+
+#ifdef HAVE_REDIS
+#include <hiredis/hiredis.h>
+#endif
+
+#include "redis.h"
+
+void redis_reply_free(RedisReply* reply) {
+    for (int i = 0; i < reply->count; i++) {
+        free(reply->values[i]);
+    }
+    free(reply->values);
+    free(reply->lengths);
+    memset(reply, 0, sizeof(*reply));
+}
+
+#ifdef HAVE_REDIS
+#define REDIS_TIMEOUT 2         // Seconds to connect or wait for a reply
+
+struct Redis {
+    char host[256];
+    int port;
+    char user[128];
+    char password[256];
+    int db;
+    redisContext* conn;     // NULL after an error, until the next command reconnects
+    pthread_mutex_t lock;
+};
+
+static bool parse_url(Redis* redis, const char* url, char* error, size_t error_size) {
+    if (strncmp(url, "redis://", 8) != 0) {
+        snprintf(error, error_size, "expected redis://host[:port][/db], got \"%.64s\"", url);
+        return false;
+    }
+    const char* p = url + 8;
+    const char* at = strrchr(p, '@');
+    if (at) {
+        const char* colon = memchr(p, ':', at - p);
+        if (!colon) {
+            snprintf(error, error_size, "expected [user]:password@ before the host");
+            return false;
+        }
+        snprintf(redis->user, sizeof(redis->user), "%.*s", (int)(colon - p), p);
+        snprintf(redis->password, sizeof(redis->password), "%.*s", (int)(at - colon - 1), colon + 1);
+        p = at + 1;
+    }
+
+    size_t host_length = strcspn(p, ":/");
+    if (host_length == 0 || host_length >= sizeof(redis->host)) {
+        snprintf(error, error_size, "missing host");
+        return false;
+    }
+    snprintf(redis->host, sizeof(redis->host), "%.*s", (int)host_length, p);
+    p += host_length;
+
+    redis->port = 6379;
+    if (*p == ':') {
+        char* end;
+        long port = strtol(p + 1, &end, 10);
+        if (end == p + 1 || port < 1 || port > 65535) {
+            snprintf(error, error_size, "invalid port");
+            return false;
+        }
+        redis->port = (int)port;
+        p = end;
+    }
+    if (*p == '/' && p[1]) {
+        char* end;
+        long db = strtol(p + 1, &end, 10);
+        if (end == p + 1 || *end || db < 0) {
+            snprintf(error, error_size, "invalid database number");
+            return false;
+        }
+        redis->db = (int)db;
+    }
+    return true;
+}
+
+// Runs a command during connect, when an error reply means giving up
+static bool setup_command(redisContext* conn, const char* what, char* error, size_t error_size,
+                          const char* format, ...) {
+    va_list args;
+    va_start(args, format);
+    redisReply* reply = redisvCommand(conn, format, args);
+    va_end(args);
+    bool ok = reply && reply->type != REDIS_REPLY_ERROR;
+    if (!ok) {
+        snprintf(error, error_size, "%s: %s", what, reply ? reply->str : conn->errstr);
+    }
+    if (reply) freeReplyObject(reply);
+    return ok;
+}
+
+// Caller holds the lock
+static bool connect_redis(Redis* redis, char* error, size_t error_size) {
+    struct timeval timeout = {REDIS_TIMEOUT, 0};
+    redisContext* conn = redisConnectWithTimeout(redis->host, redis->port, timeout);
+    if (!conn || conn->err) {
+        snprintf(error, error_size, "cannot connect to %s:%d: %s", redis->host, redis->port,
+                 conn ? conn->errstr : "out of memory");
+        if (conn) redisFree(conn);
+        return false;
+    }
+    redisSetTimeout(conn, timeout);
+
+    bool ok = true;
+    if (redis->password[0] && redis->user[0]) {
+        ok = setup_command(conn, "AUTH", error, error_size, "AUTH %s %s", redis->user,
+                           redis->password);
+    } else if (redis->password[0]) {
+        ok = setup_command(conn, "AUTH", error, error_size, "AUTH %s", redis->password);
+    }
+    if (ok && redis->db > 0) {
+        ok = setup_command(conn, "SELECT", error, error_size, "SELECT %d", redis->db);
+    }
+    if (!ok) {
+        redisFree(conn);
+        return false;
+    }
+    redis->conn = conn;
+    return true;
+}
+
+static void add_value(RedisReply* reply, const char* value, size_t length) {
+    reply->values = realloc(reply->values, sizeof(char*) * (reply->count + 1));
+    reply->lengths = realloc(reply->lengths, sizeof(size_t) * (reply->count + 1));
+    char* copy = NULL;
+    if (value) {
+        copy = malloc(length + 1);
+        memcpy(copy, value, length);
+        copy[length] = '\0';
+    }
+    reply->values[reply->count] = copy;
+    reply->lengths[reply->count] = length;
+    reply->count++;
+}
+
+static void flatten(const redisReply* from, RedisReply* to) {
+    char number[24];
+    switch (from->type) {
+        case REDIS_REPLY_ARRAY:
+            for (size_t i = 0; i < from->elements; i++) {
+                flatten(from->element[i], to);
+            }
+            break;
+        case REDIS_REPLY_INTEGER:
+            snprintf(number, sizeof(number), "%lld", from->integer);
+            add_value(to, number, strlen(number));
+            break;
+        case REDIS_REPLY_NIL:
+            add_value(to, NULL, 0);
+            break;
+        default:
+            add_value(to, from->str, from->len);
+            break;
+    }
+}
+
+Redis* redis_open(const char* url, char* error, size_t error_size) {
+    Redis* redis = calloc(1, sizeof(Redis));
+    if (!parse_url(redis, url, error, error_size) || !connect_redis(redis, error, error_size)) {
+        free(redis);
+        return NULL;
+    }
+    pthread_mutex_init(&redis->lock, NULL);
+    return redis;
+}
+
+void redis_close(Redis* redis) {
+    if (redis->conn) redisFree(redis->conn);
+    pthread_mutex_destroy(&redis->lock);
+    free(redis);
+}
+
+bool redis_command(Redis* redis, int argc, const char** argv, const size_t* lengths,
+                   RedisReply* reply) {
+    char error[256] = "";
+    redisReply* answer = NULL;
+
+    pthread_mutex_lock(&redis->lock);
+    if (redis->conn || connect_redis(redis, error, sizeof(error))) {
+        answer = redisCommandArgv(redis->conn, argc, argv, lengths);
+        if (!answer) {
+            // The connection is unusable after an I/O error; the next
+            // command opens a new one
+            snprintf(error, sizeof(error), "%s", redis->conn->errstr);
+            redisFree(redis->conn);
+            redis->conn = NULL;
+        }
+    }
+    pthread_mutex_unlock(&redis->lock);
+
+    if (answer && answer->type == REDIS_REPLY_ERROR) {
+        snprintf(error, sizeof(error), "%s", answer->str);
+        freeReplyObject(answer);
+        answer = NULL;
+    }
+    if (!answer) {
+        fprintf(stderr, "Redis %.*s failed: %s\n", (int)lengths[0], argv[0], error);
+        return false;
+    }
+    if (reply) {
+        memset(reply, 0, sizeof(*reply));
+        flatten(answer, reply);
+    }
+    freeReplyObject(answer);
+    return true;
+}
+
+bool redis_available(char* error, size_t error_size) {
+    return true;
+}
+#else
+Redis* redis_open(const char* url, char* error, size_t error_size) {
+    redis_available(error, error_size);
+    return NULL;
+}
+
+void redis_close(Redis* redis) {
+}
+
+bool redis_command(Redis* redis, int argc, const char** argv, const size_t* lengths,
+                   RedisReply* reply) {
+    return false;
+}
+
+bool redis_available(char* error, size_t error_size) {
+    snprintf(error, error_size, "built without Redis support (make WITH_REDIS=1)");
+    return false;
+}
+#endif
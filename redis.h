@@ -0,0 +1,38 @@
+#ifndef REDIS_H
+#define REDIS_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+// Redis through hiredis, for state that replicas behind a load balancer
+// have to share: the validation cache, rate limit buckets and
+// Idempotency-Keys. One connection, used by one thread at a time and
+// reopened after an error. Safe to share between threads.
+typedef struct Redis Redis;
+
+// url is redis://[[user]:password@]host[:port][/db]. Returns NULL with
+// error set if the server can't be reached or refuses the password.
+Redis* redis_open(const char* url, char* error, size_t error_size);
+void redis_close(Redis* redis);
+
+// A reply flattened into a list: a string or status is one value, an
+// integer is one value in decimal, and an array contributes each of its
+// elements in turn. Nil is a NULL value.
+typedef struct {
+    int count;
+    char** values;          // Heap allocated and NUL terminated, may hold NUL bytes
+    size_t* lengths;
+} RedisReply;
+
+// Runs the command made of argc arguments, argv[i] being lengths[i] bytes.
+// Returns false, having logged why, if the server can't be reached or
+// answers with an error. reply may be NULL; otherwise it is filled in on
+// success and must be freed with redis_reply_free().
+bool redis_command(Redis* redis, int argc, const char** argv, const size_t* lengths,
+                   RedisReply* reply);
+void redis_reply_free(RedisReply* reply);
+
+// False, with error set, when built without hiredis
+bool redis_available(char* error, size_t error_size);
+
+#endif
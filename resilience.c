@@ -0,0 +1,184 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+#include <unistd.h>
+#include <pthread.h>
+
+#include "resilience.h"
+#include "metrics.h"
+#include "tracing.h"
+
+static const char* state_names[] = {"closed", "open", "half_open"};
+
+struct Resilience {
+    const char* kind;
+    const char* provider;
+    ResiliencePolicy policy;
+    pthread_mutex_t lock;
+    BreakerState state;
+    int failures;           // Failed attempts in a row
+    double opened_at;       // metrics_now() the breaker last opened
+    bool trial_running;     // Half open, and the trial call was let through
+    unsigned int seed;      // For backoff jitter
+};
+
+const char* breaker_state_string(BreakerState state) {
+    return state_names[state];
+}
+
+Resilience* resilience_create(const char* kind, const char* provider,
+                              const ResiliencePolicy* policy) {
+    Resilience* resilience = calloc(1, sizeof(Resilience));
+    resilience->kind = kind;
+    resilience->provider = provider;
+    resilience->policy = *policy;
+    resilience->state = BREAKER_CLOSED;
+    resilience->seed = (unsigned int)time(NULL) ^ (unsigned int)getpid();
+    pthread_mutex_init(&resilience->lock, NULL);
+    metrics_set_breaker_state(kind, provider, BREAKER_CLOSED);
+    return resilience;
+}
+
+void resilience_free(Resilience* resilience) {
+    pthread_mutex_destroy(&resilience->lock);
+    free(resilience);
+}
+
+BreakerState resilience_state(Resilience* resilience) {
+    pthread_mutex_lock(&resilience->lock);
+    BreakerState state = resilience->state;
+    pthread_mutex_unlock(&resilience->lock);
+    return state;
+}
+
+// Call with the lock held
+static void set_state(Resilience* resilience, BreakerState state) {
+    resilience->state = state;
+    metrics_set_breaker_state(resilience->kind, resilience->provider, state);
+}
+
+// Whether a call may go ahead, and if it is the half open breaker's trial.
+// Call with the lock held.
+static bool admit(Resilience* resilience, bool* trial, char* error, size_t error_size) {
+    *trial = false;
+    if (resilience->state == BREAKER_OPEN) {
+        double wait = resilience->opened_at + resilience->policy.cooldown - metrics_now();
+        if (wait > 0) {
+            snprintf(error, error_size, "circuit breaker open after %d failures, next try in %.0fs",
+                     resilience->failures, wait + 0.5);
+            return false;
+        }
+        set_state(resilience, BREAKER_HALF_OPEN);
+        resilience->trial_running = false;
+    }
+    if (resilience->state == BREAKER_HALF_OPEN) {
+        if (resilience->trial_running) {
+            snprintf(error, error_size, "circuit breaker half open, waiting on a trial call");
+            return false;
+        }
+        resilience->trial_running = true;
+        *trial = true;
+    }
+    return true;
+}
+
+static void record_success(Resilience* resilience) {
+    pthread_mutex_lock(&resilience->lock);
+    // Any answer shows the provider is back, trial or not
+    if (resilience->state != BREAKER_CLOSED) {
+        fprintf(stderr, "Circuit breaker for %s provider %s closed again\n", resilience->kind,
+                resilience->provider);
+        set_state(resilience, BREAKER_CLOSED);
+    }
+    resilience->failures = 0;
+    resilience->trial_running = false;
+    pthread_mutex_unlock(&resilience->lock);
+}
+
+// Returns whether the breaker is open now
+static bool record_failure(Resilience* resilience, const char* error) {
+    pthread_mutex_lock(&resilience->lock);
+    resilience->failures++;
+    bool opens = resilience->state == BREAKER_HALF_OPEN ||
+        (resilience->state == BREAKER_CLOSED && resilience->policy.failure_threshold > 0 &&
+         resilience->failures >= resilience->policy.failure_threshold);
+    if (opens) {
+        fprintf(stderr, "Circuit breaker for %s provider %s opened for %ds after %d failures: %s\n",
+                resilience->kind, resilience->provider, resilience->policy.cooldown,
+                resilience->failures, error);
+        set_state(resilience, BREAKER_OPEN);
+        resilience->opened_at = metrics_now();
+        resilience->trial_running = false;
+    }
+    bool open = resilience->state == BREAKER_OPEN;
+    pthread_mutex_unlock(&resilience->lock);
+    return open;
+}
+
+// Waits before retry number attempt (1 on), in CONTEXT_POLL_MS slices so
+// that a done ctx cuts it short. False if ctx is done, or would be before
+// the wait is over, so there's no point retrying.
+static bool back_off(Resilience* resilience, const Context* ctx, int attempt) {
+    int base = resilience->policy.backoff_ms << (attempt - 1 < 16 ? attempt - 1 : 16);
+    pthread_mutex_lock(&resilience->lock);
+    int jitter = base > 1 ? rand_r(&resilience->seed) % base : 0;
+    pthread_mutex_unlock(&resilience->lock);
+    double delay = (base / 2 + jitter) / 1000.0;
+    if (ctx && ctx->deadline > 0 && metrics_now() + delay >= ctx->deadline) return false;
+
+    double until = metrics_now() + delay;
+    for (;;) {
+        if (context_done(ctx)) return false;
+        double left = until - metrics_now();
+        if (left <= 0) return true;
+        double slice = left < CONTEXT_POLL_MS / 1000.0 ? left : CONTEXT_POLL_MS / 1000.0;
+        struct timespec pause = {0, (long)(slice * 1e9)};
+        nanosleep(&pause, NULL);
+    }
+}
+
+bool resilience_call(Resilience* resilience, const Context* ctx, ResilienceAttempt attempt,
+                     void* arg, char* error, size_t error_size) {
+    Span* span = ctx ? ctx->span : NULL;
+    bool trial;
+    pthread_mutex_lock(&resilience->lock);
+    bool admitted = admit(resilience, &trial, error, error_size);
+    pthread_mutex_unlock(&resilience->lock);
+    if (!admitted) {
+        metrics_count_provider_call(resilience->kind, resilience->provider, "rejected");
+        span_set_string(span, "provider.breaker", "open");
+        return false;
+    }
+
+    // A trial gets one attempt, so that a provider still down reopens the
+    // breaker as soon as possible
+    int retries = trial ? 0 : resilience->policy.retries;
+    for (int tries = 1;; tries++) {
+        span_set_int(span, "provider.attempts", tries);
+        if (attempt(arg, ctx, error, error_size)) {
+            record_success(resilience);
+            metrics_count_provider_call(resilience->kind, resilience->provider, "ok");
+            return true;
+        }
+        // A client that hung up says nothing about the provider; running
+        // out of time for the request does
+        if (context_abandoned(ctx)) {
+            if (trial) {
+                pthread_mutex_lock(&resilience->lock);
+                resilience->trial_running = false;
+                pthread_mutex_unlock(&resilience->lock);
+            }
+            break;
+        }
+        if (record_failure(resilience, error) || tries > retries ||
+            !back_off(resilience, ctx, tries)) {
+            break;
+        }
+        metrics_count_provider_retry(resilience->kind, resilience->provider);
+    }
+    metrics_count_provider_call(resilience->kind, resilience->provider, "error");
+    return false;
+}
@@ -0,0 +1,53 @@
+#ifndef RESILIENCE_H
+#define RESILIENCE_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+#include "context.h"
+
+// Retries and a circuit breaker around calls to an external provider, so
+// that one having an outage fails fast instead of holding every request
+// that needs it for the length of its timeout. The breaker opens after
+// failure_threshold calls in a row have failed, every attempt included;
+// while it's open calls fail at once. After cooldown seconds one trial
+// call is let through (half open): if it succeeds the breaker closes,
+// else it opens for another cooldown.
+
+typedef enum {
+    BREAKER_CLOSED,
+    BREAKER_OPEN,
+    BREAKER_HALF_OPEN
+} BreakerState;
+
+typedef struct {
+    int retries;            // Attempts after the first that fails, 0 for none
+    int backoff_ms;         // Before the first retry, doubling each time, give or take half
+    int failure_threshold;  // Failed calls in a row that open the breaker, 0 never opens it
+    int cooldown;           // Seconds the breaker stays open before a trial call
+} ResiliencePolicy;
+
+// One attempt at the call. True if the provider answered, whatever it
+// said; false, with error set, if it failed and trying again might help.
+typedef bool (*ResilienceAttempt)(void* arg, const Context* ctx, char* error, size_t error_size);
+
+typedef struct Resilience Resilience;
+
+// kind and provider name the provider in logs and metrics, e.g. "carrier"
+// and "twilio"; both are kept by reference
+Resilience* resilience_create(const char* kind, const char* provider,
+                              const ResiliencePolicy* policy);
+void resilience_free(Resilience* resilience);
+
+// Makes the call through the breaker, retrying failed attempts with
+// backoff while ctx isn't done. False with error set if it failed in the
+// end or the breaker refused it. Safe to call from many threads.
+bool resilience_call(Resilience* resilience, const Context* ctx, ResilienceAttempt attempt,
+                     void* arg, char* error, size_t error_size);
+
+BreakerState resilience_state(Resilience* resilience);
+
+// "closed", "open" or "half_open"
+const char* breaker_state_string(BreakerState state);
+
+#endif
@@ -0,0 +1,96 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <string.h>
+#include <ctype.h>
+
+#include "routing.h"
+#include "phonevalidator.h"
+
+// The European Union's member states, what "EU" in a region list names
+static const char* eu_regions[] = {
+    "AT", "BE", "BG", "CY", "CZ", "DE", "DK", "EE", "ES", "FI", "FR", "GR", "HR", "HU",
+    "IE", "IT", "LT", "LU", "LV", "MT", "NL", "PL", "PT", "RO", "SE", "SI", "SK",
+};
+
+static bool add_region(ProviderRoute* route, const char* region, char* error, size_t error_size) {
+    for (int i = 0; i < route->region_count; i++) {
+        if (strcmp(route->regions[i], region) == 0) return true;
+    }
+    if (route->region_count == ROUTE_MAX_REGIONS) {
+        snprintf(error, error_size, "more than %d regions", ROUTE_MAX_REGIONS);
+        return false;
+    }
+    snprintf(route->regions[route->region_count++], 3, "%s", region);
+    return true;
+}
+
+bool route_parse(const char* entry, ProviderRoute* route, char* error, size_t error_size) {
+    memset(route, 0, sizeof(ProviderRoute));
+    const char* equals = strchr(entry, '=');
+    const char* colon = strchr(entry, ':');
+    if (!equals || (colon && colon < equals)) {
+        route->dsn = entry;
+        return true;
+    }
+
+    route->dsn = equals + 1;
+    const char* p = entry;
+    while (p < equals) {
+        while (p < equals && isspace((unsigned char)*p)) p++;
+        const char* end = p;
+        while (end < equals && !isspace((unsigned char)*end)) end++;
+        if (end == p) break;
+
+        char region[8];
+        snprintf(region, sizeof(region), "%.*s", (int)(end - p), p);
+        if (strcmp(region, "EU") == 0) {
+            for (size_t i = 0; i < sizeof(eu_regions) / sizeof(eu_regions[0]); i++) {
+                if (!add_region(route, eu_regions[i], error, error_size)) return false;
+            }
+        } else if (strlen(region) == 2 && isupper((unsigned char)region[0]) &&
+                   isupper((unsigned char)region[1])) {
+            if (!add_region(route, region, error, error_size)) return false;
+        } else {
+            snprintf(error, error_size, "expected region codes such as \"DE FR\" or \"EU\" before "
+                     "'=', got \"%s\"", region);
+            return false;
+        }
+        p = end;
+    }
+    if (route->region_count == 0) {
+        snprintf(error, error_size, "no regions before '='");
+        return false;
+    }
+    if (!*route->dsn) {
+        snprintf(error, error_size, "no provider after '='");
+        return false;
+    }
+    return true;
+}
+
+static bool serves(const ProviderRoute* route, const char* region) {
+    for (int i = 0; i < route->region_count; i++) {
+        if (strcmp(route->regions[i], region) == 0) return true;
+    }
+    return false;
+}
+
+int route_order(const ProviderRoute* routes, int count, const char* region, int* order) {
+    int n = 0;
+    if (*region) {
+        for (int i = 0; i < count; i++) {
+            if (serves(&routes[i], region)) order[n++] = i;
+        }
+    }
+    for (int i = 0; i < count; i++) {
+        if (routes[i].region_count == 0) order[n++] = i;
+    }
+    return n;
+}
+
+void route_region(const char* number, char region[3]) {
+    PhoneNumber parsed;
+    region[0] = '\0';
+    if (phone_parse(number, NULL, &parsed) == PHONE_OK) snprintf(region, 3, "%s", parsed.region);
+}
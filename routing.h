@@ -0,0 +1,35 @@
+#ifndef ROUTING_H
+#define ROUTING_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+// Which of several lookup providers a number is sent to. Each provider
+// is configured as "DSN", serving every region, or "REGIONS=DSN" with
+// REGIONS ISO 3166-1 codes separated by spaces, "EU" standing for the
+// member states, e.g. "EU GB=hlr:https://...". A number tries the
+// providers naming its region first, then those serving every region,
+// each in the order configured, moving to the next when one fails.
+
+#define ROUTE_MAX_PROVIDERS 8
+#define ROUTE_MAX_REGIONS 48
+
+typedef struct {
+    char regions[ROUTE_MAX_REGIONS][3];
+    int region_count;           // 0 serves every region
+    const char* dsn;            // Points into the entry it was parsed from
+} ProviderRoute;
+
+// Splits a provider entry. A DSN has a ':' before any '=', so "=" before
+// the first ':' is taken to end a region list.
+bool route_parse(const char* entry, ProviderRoute* route, char* error, size_t error_size);
+
+// Fills order with the indexes of the routes a number should try, in
+// turn, and returns how many. region is the number's, "" when unknown,
+// which only routes serving every region take.
+int route_order(const ProviderRoute* routes, int count, const char* region, int* order);
+
+// The region an E.164 number belongs to, "" when the metadata doesn't say
+void route_region(const char* number, char region[3]);
+
+#endif
@@ -0,0 +1,99 @@
+#include <stdio.h>
+#include <string.h>
+
+#include "sandbox.h"
+
+// MCC 001, MNC 01 is the ITU's test network, which no real line is on
+static const SandboxNumber numbers[] = {
+    {.number = "+15005550001", .valid = false,
+     .carrier_result = CARRIER_NOT_FOUND, .cnam_result = CNAM_NOT_FOUND},
+    {.number = "+15005550006", .valid = true,
+     .carrier_result = CARRIER_OK,
+     .carrier = {.carrier = "Sandbox Mobile", .line_type = "mobile", .mcc = "001", .mnc = "01",
+                 .ported = 0, .status = LINE_STATUS_ACTIVE},
+     .cnam_result = CNAM_OK, .cnam = {.name = "SANDBOX CONSUMER", .type = "consumer"}},
+    {.number = "+15005550007", .valid = true,
+     .carrier_result = CARRIER_OK,
+     .carrier = {.carrier = "Sandbox Telecom", .line_type = "landline", .mcc = "001", .mnc = "01",
+                 .ported = 0, .status = LINE_STATUS_ACTIVE},
+     .cnam_result = CNAM_OK, .cnam = {.name = "SANDBOX BUSINESS", .type = "business"}},
+    {.number = "+15005550008", .valid = true,
+     .carrier_result = CARRIER_OK,
+     .carrier = {.carrier = "Sandbox VoIP", .line_type = "voip", .mcc = "001", .mnc = "01",
+                 .ported = 1, .status = LINE_STATUS_ACTIVE},
+     .cnam_result = CNAM_NOT_FOUND},
+    {.number = "+15005550009", .valid = true,
+     .carrier_result = CARRIER_NOT_FOUND, .cnam_result = CNAM_NOT_FOUND},
+    {.number = "+15005550010", .valid = true,
+     .carrier_result = CARRIER_ERROR, .cnam_result = CNAM_ERROR},
+};
+
+#define NUMBER_COUNT (int)(sizeof(numbers) / sizeof(numbers[0]))
+
+const SandboxNumber* sandbox_find(const char* number) {
+    for (int i = 0; i < NUMBER_COUNT; i++) {
+        if (strcmp(numbers[i].number, number) == 0) return &numbers[i];
+    }
+    return NULL;
+}
+
+const SandboxNumber* sandbox_numbers(int* count) {
+    *count = NUMBER_COUNT;
+    return numbers;
+}
+
+void sandbox_validity(PhoneNumber* number, PhoneError* reason) {
+    char e164[PHONE_MAX_FORMATTED_LENGTH];
+    phone_format(number, PHONE_FORMAT_E164, e164, sizeof(e164));
+    const SandboxNumber* test = sandbox_find(e164);
+    if (test) {
+        number->valid = test->valid;
+        *reason = test->valid ? PHONE_OK : PHONE_ERR_INVALID_FOR_REGION;
+    }
+}
+
+static CarrierResult sandbox_carrier(CarrierLookup* lookup, const Context* ctx, const char* number,
+                                     CarrierInfo* info, char* error, size_t error_size) {
+    const SandboxNumber* test = sandbox_find(number);
+    if (!test) {
+        snprintf(error, error_size, "not a sandbox test number");
+        return CARRIER_NO_PROVIDER;
+    }
+    if (test->carrier_result == CARRIER_ERROR) {
+        snprintf(error, error_size, "sandbox provider failure");
+    }
+    if (test->carrier_result == CARRIER_OK) *info = test->carrier;
+    return test->carrier_result;
+}
+
+static CnamResult sandbox_cnam(CnamLookup* lookup, const Context* ctx, const char* number,
+                               CnamInfo* info, char* error, size_t error_size) {
+    const SandboxNumber* test = sandbox_find(number);
+    if (!test) {
+        snprintf(error, error_size, "not a sandbox test number");
+        return CNAM_NO_PROVIDER;
+    }
+    if (test->cnam_result == CNAM_ERROR) {
+        snprintf(error, error_size, "sandbox provider failure");
+    }
+    if (test->cnam_result == CNAM_OK) *info = test->cnam;
+    return test->cnam_result;
+}
+
+// Shared by every sandbox request, so there's nothing to free
+static void close_carrier(CarrierLookup* lookup) {
+}
+
+static void close_cnam(CnamLookup* lookup) {
+}
+
+static CarrierLookup carrier_lookup = {"sandbox", sandbox_carrier, close_carrier, NULL};
+static CnamLookup cnam_lookup = {"sandbox", sandbox_cnam, close_cnam, NULL};
+
+CarrierLookup* sandbox_carrier_lookup(void) {
+    return &carrier_lookup;
+}
+
+CnamLookup* sandbox_cnam_lookup(void) {
+    return &cnam_lookup;
+}
@@ -0,0 +1,42 @@
+#ifndef SANDBOX_H
+#define SANDBOX_H
+
+#include <stdbool.h>
+
+#include "phonevalidator.h"
+#include "carrier.h"
+#include "cnam.h"
+
+// What requests made with a sandbox API key get, so that a plugin's CI
+// can run against a real server without paying for lookups or depending
+// on what a provider says today. Test numbers, +1 500 555 0xxx like
+// Twilio's, have fixed answers; carrier and caller name lookups for any
+// other number aren't made.
+
+typedef struct {
+    const char* number;         // E.164
+    bool valid;
+    CarrierResult carrier_result;
+    CarrierInfo carrier;        // For CARRIER_OK
+    CnamResult cnam_result;
+    CnamInfo cnam;              // For CNAM_OK
+} SandboxNumber;
+
+// The test number number (E.164) is, NULL if it isn't one
+const SandboxNumber* sandbox_find(const char* number);
+
+// Every test number, in order, for listing them
+const SandboxNumber* sandbox_numbers(int* count);
+
+// Makes number, as parsed, as valid as the test number it is says, with
+// reason to match, whatever the metadata does. Other numbers are left
+// alone.
+void sandbox_validity(PhoneNumber* number, PhoneError* reason);
+
+// Providers answering from the test numbers. Other numbers get
+// CARRIER_NO_PROVIDER and CNAM_NO_PROVIDER, as if no provider served them.
+// Shared, never to be closed.
+CarrierLookup* sandbox_carrier_lookup(void);
+CnamLookup* sandbox_cnam_lookup(void);
+
+#endif
@@ -0,0 +1,249 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+#include <unistd.h>
+#include <pthread.h>
+
+#include "scheduler.h"
+
+#define SCHEDULER_MAX_TASKS 16
+#define SCHEDULER_IDLE_WAKE 3600    // Seconds the thread sleeps when nothing is scheduled
+
+typedef struct Task {
+    TaskStatus status;
+    TaskRun run;
+    struct Scheduler* scheduler;
+} Task;
+
+struct Scheduler {
+    int jitter;
+    TaskBegin begin;
+    TaskEnd end;
+    Task tasks[SCHEDULER_MAX_TASKS];
+    int count;
+    int active;             // Run threads that haven't finished with the scheduler
+    unsigned int seed;
+    bool started;
+    bool stopping;
+    pthread_t thread;
+    pthread_mutex_t lock;
+    pthread_cond_t changed;
+};
+
+static double monotonic_now(void) {
+    struct timespec now;
+    clock_gettime(CLOCK_MONOTONIC, &now);
+    return now.tv_sec + now.tv_nsec / 1e9;
+}
+
+// Seconds from now until the next run of a task, within jitter percent of
+// its interval. Caller holds the lock.
+static long long next_delay(Scheduler* scheduler, int interval) {
+    int spread = (int)((long long)interval * scheduler->jitter / 100);
+    if (spread == 0) return interval;
+    long long delay = interval - spread + rand_r(&scheduler->seed) % (2 * spread + 1);
+    return delay > 0 ? delay : 1;
+}
+
+// Caller holds the lock
+static Task* find_task(Scheduler* scheduler, const char* name) {
+    for (int i = 0; i < scheduler->count; i++) {
+        if (strcmp(scheduler->tasks[i].status.name, name) == 0) return &scheduler->tasks[i];
+    }
+    return NULL;
+}
+
+static void* run_thread(void* arg) {
+    Task* task = arg;
+    Scheduler* scheduler = task->scheduler;
+    TaskEnd end = scheduler->end;
+
+    bool began = !scheduler->begin || scheduler->begin();
+    char message[TASK_MESSAGE_LENGTH] = "";
+    long long started = time(NULL);
+    double start = monotonic_now();
+    bool ok = began && task->run(message, sizeof(message));
+    double duration = monotonic_now() - start;
+
+    pthread_mutex_lock(&scheduler->lock);
+    TaskStatus* status = &task->status;
+    status->running = false;
+    if (began) {
+        status->last_run = started;
+        status->last_duration = duration;
+        status->last_ok = ok;
+        snprintf(status->last_message, sizeof(status->last_message), "%s", message);
+        status->runs++;
+        if (!ok) status->failures++;
+    }
+    status->next_run = status->enabled && status->interval > 0
+        ? (long long)time(NULL) + next_delay(scheduler, status->interval) : 0;
+    scheduler->active--;
+    pthread_cond_broadcast(&scheduler->changed);
+    pthread_mutex_unlock(&scheduler->lock);
+
+    if (began && end) end();
+    return NULL;
+}
+
+// Caller holds the lock
+static void start_run(Scheduler* scheduler, Task* task) {
+    pthread_t thread;
+    task->status.running = true;
+    task->status.next_run = 0;
+    scheduler->active++;
+    if (pthread_create(&thread, NULL, run_thread, task) == 0) {
+        pthread_detach(thread);
+        return;
+    }
+    task->status.running = false;
+    task->status.last_ok = false;
+    snprintf(task->status.last_message, sizeof(task->status.last_message),
+             "cannot start a thread");
+    task->status.failures++;
+    task->status.next_run = task->status.enabled && task->status.interval > 0
+        ? (long long)time(NULL) + next_delay(scheduler, task->status.interval) : 0;
+    scheduler->active--;
+}
+
+static void* scheduler_thread(void* arg) {
+    Scheduler* scheduler = arg;
+    pthread_mutex_lock(&scheduler->lock);
+    while (!scheduler->stopping) {
+        long long now = time(NULL);
+        long long wake = now + SCHEDULER_IDLE_WAKE;
+        for (int i = 0; i < scheduler->count; i++) {
+            Task* task = &scheduler->tasks[i];
+            if (task->status.running || !task->status.enabled || !task->status.next_run) continue;
+            if (task->status.next_run <= now) {
+                start_run(scheduler, task);
+            } else if (task->status.next_run < wake) {
+                wake = task->status.next_run;
+            }
+        }
+        // A run that couldn't start was put off, so look again soon
+        if (wake <= now) wake = now + 1;
+
+        struct timespec deadline = {.tv_sec = wake, .tv_nsec = 0};
+        pthread_cond_timedwait(&scheduler->changed, &scheduler->lock, &deadline);
+    }
+    pthread_mutex_unlock(&scheduler->lock);
+    return NULL;
+}
+
+Scheduler* scheduler_create(int jitter, TaskBegin begin, TaskEnd end) {
+    Scheduler* scheduler = calloc(1, sizeof(Scheduler));
+    scheduler->jitter = jitter < 0 ? 0 : jitter > 50 ? 50 : jitter;
+    scheduler->begin = begin;
+    scheduler->end = end;
+    scheduler->seed = (unsigned int)time(NULL) ^ (unsigned int)getpid();
+    pthread_mutex_init(&scheduler->lock, NULL);
+    pthread_cond_init(&scheduler->changed, NULL);
+    return scheduler;
+}
+
+void scheduler_add(Scheduler* scheduler, const char* name, int interval, bool enabled,
+                   TaskRun run) {
+    pthread_mutex_lock(&scheduler->lock);
+    if (scheduler->count < SCHEDULER_MAX_TASKS) {
+        Task* task = &scheduler->tasks[scheduler->count++];
+        memset(task, 0, sizeof(*task));
+        snprintf(task->status.name, sizeof(task->status.name), "%s", name);
+        task->status.interval = interval > 0 ? interval : 0;
+        task->status.enabled = enabled;
+        task->run = run;
+        task->scheduler = scheduler;
+    }
+    pthread_mutex_unlock(&scheduler->lock);
+}
+
+void scheduler_start(Scheduler* scheduler) {
+    pthread_mutex_lock(&scheduler->lock);
+    long long now = time(NULL);
+    for (int i = 0; i < scheduler->count; i++) {
+        TaskStatus* status = &scheduler->tasks[i].status;
+        if (!status->enabled || status->interval == 0) continue;
+        int spread = (int)((long long)status->interval * scheduler->jitter / 100);
+        status->next_run = now + (spread ? rand_r(&scheduler->seed) % (spread + 1) : 0);
+    }
+    scheduler->started = pthread_create(&scheduler->thread, NULL, scheduler_thread,
+                                        scheduler) == 0;
+    pthread_mutex_unlock(&scheduler->lock);
+}
+
+void scheduler_stop(Scheduler* scheduler) {
+    pthread_mutex_lock(&scheduler->lock);
+    scheduler->stopping = true;
+    pthread_cond_broadcast(&scheduler->changed);
+    bool started = scheduler->started;
+    scheduler->started = false;
+    pthread_mutex_unlock(&scheduler->lock);
+    if (started) pthread_join(scheduler->thread, NULL);
+}
+
+void scheduler_free(Scheduler* scheduler) {
+    scheduler_stop(scheduler);
+    pthread_mutex_lock(&scheduler->lock);
+    while (scheduler->active > 0) {
+        pthread_cond_wait(&scheduler->changed, &scheduler->lock);
+    }
+    pthread_mutex_unlock(&scheduler->lock);
+    pthread_cond_destroy(&scheduler->changed);
+    pthread_mutex_destroy(&scheduler->lock);
+    free(scheduler);
+}
+
+int scheduler_list(Scheduler* scheduler, TaskStatus** statuses) {
+    pthread_mutex_lock(&scheduler->lock);
+    int count = scheduler->count;
+    *statuses = malloc(sizeof(TaskStatus) * (count ? count : 1));
+    for (int i = 0; i < count; i++) {
+        (*statuses)[i] = scheduler->tasks[i].status;
+    }
+    pthread_mutex_unlock(&scheduler->lock);
+    return count;
+}
+
+bool scheduler_status(Scheduler* scheduler, const char* name, TaskStatus* status) {
+    pthread_mutex_lock(&scheduler->lock);
+    Task* task = find_task(scheduler, name);
+    if (task) *status = task->status;
+    pthread_mutex_unlock(&scheduler->lock);
+    return task != NULL;
+}
+
+bool scheduler_set_enabled(Scheduler* scheduler, const char* name, bool enabled) {
+    pthread_mutex_lock(&scheduler->lock);
+    Task* task = find_task(scheduler, name);
+    if (task && task->status.enabled != enabled) {
+        task->status.enabled = enabled;
+        // A run under way schedules the next one when it finishes
+        if (!task->status.running) {
+            task->status.next_run = enabled && task->status.interval > 0
+                ? (long long)time(NULL) + next_delay(scheduler, task->status.interval) : 0;
+        }
+        pthread_cond_broadcast(&scheduler->changed);
+    }
+    pthread_mutex_unlock(&scheduler->lock);
+    return task != NULL;
+}
+
+TaskTrigger scheduler_run_now(Scheduler* scheduler, const char* name) {
+    pthread_mutex_lock(&scheduler->lock);
+    Task* task = find_task(scheduler, name);
+    TaskTrigger trigger = TASK_STARTED;
+    if (!task) {
+        trigger = TASK_NOT_FOUND;
+    } else if (scheduler->stopping) {
+        trigger = TASK_STOPPING;
+    } else if (task->status.running) {
+        trigger = TASK_ALREADY_RUNNING;
+    } else {
+        start_run(scheduler, task);
+    }
+    pthread_mutex_unlock(&scheduler->lock);
+    return trigger;
+}
@@ -0,0 +1,75 @@
+#ifndef SCHEDULER_H
+#define SCHEDULER_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+// Runs periodic housekeeping tasks, each on its own thread so a slow one
+// doesn't hold up the others. A task's next run is due interval seconds
+// after its last one finished, give or take jitter percent of the interval
+// so that replicas started together don't all run it at once. The first
+// run comes within jitter percent of the interval from the start. Safe to
+// share between threads.
+typedef struct Scheduler Scheduler;
+
+#define TASK_NAME_LENGTH 32
+#define TASK_MESSAGE_LENGTH 256
+
+// Does one run of a task. Returns false if it failed; message says what it
+// did, or why it failed.
+typedef bool (*TaskRun)(char* message, size_t message_size);
+
+// Called before and after every run. A begin that returns false skips the
+// run, e.g. once the server is shutting down.
+typedef bool (*TaskBegin)(void);
+typedef void (*TaskEnd)(void);
+
+typedef struct {
+    char name[TASK_NAME_LENGTH];
+    int interval;               // Seconds between runs, 0 if it only runs when asked
+    bool enabled;               // Runs on its interval; any task can be run when asked
+    bool running;
+    long long next_run;         // Unix seconds, 0 when none is scheduled
+    long long last_run;         // When the last run started, 0 if there hasn't been one
+    double last_duration;       // Seconds
+    bool last_ok;
+    char last_message[TASK_MESSAGE_LENGTH];
+    int runs;
+    int failures;
+} TaskStatus;
+
+typedef enum {
+    TASK_STARTED,
+    TASK_NOT_FOUND,
+    TASK_ALREADY_RUNNING,
+    TASK_STOPPING               // The scheduler has been stopped
+} TaskTrigger;
+
+// jitter is a percentage, 0-50. begin and end may be NULL.
+Scheduler* scheduler_create(int jitter, TaskBegin begin, TaskEnd end);
+
+// Call before scheduler_start(). Tasks are listed in the order they were added.
+void scheduler_add(Scheduler* scheduler, const char* name, int interval, bool enabled,
+                   TaskRun run);
+
+void scheduler_start(Scheduler* scheduler);
+
+// Stops starting runs. Runs under way carry on; begin and end are how the
+// caller waits for them.
+void scheduler_stop(Scheduler* scheduler);
+
+// Call once no run is under way
+void scheduler_free(Scheduler* scheduler);
+
+// Returns a heap array of every task's status, caller frees
+int scheduler_list(Scheduler* scheduler, TaskStatus** statuses);
+bool scheduler_status(Scheduler* scheduler, const char* name, TaskStatus* status);
+
+// Turns a task's interval runs on or off. Enabling schedules its next run
+// an interval from now. False if there is no such task.
+bool scheduler_set_enabled(Scheduler* scheduler, const char* name, bool enabled);
+
+// Starts a run of a task now, whether or not it is enabled
+TaskTrigger scheduler_run_now(Scheduler* scheduler, const char* name);
+
+#endif
@@ -0,0 +1,225 @@
+#include <stdio.h>
+#include <stdint.h>
+#include <string.h>
+#include <ctype.h>
+
+#include "seed.h"
+#include "phonevalidator.h"
+#include "signature.h"
+
+// The names a region's users are given, by language more than by country
+typedef struct {
+    const char* first[8];
+    const char* last[8];
+} NameList;
+
+static const NameList english = {
+    {"James", "Olivia", "Liam", "Emma", "Noah", "Ava", "Jack", "Grace"},
+    {"Smith", "Johnson", "Brown", "Taylor", "Wilson", "Walker", "Murphy", "Clarke"}
+};
+static const NameList german = {
+    {"Lukas", "Anna", "Felix", "Lena", "Jonas", "Marie", "Paul", "Sophie"},
+    {"Mueller", "Schmidt", "Schneider", "Fischer", "Weber", "Wagner", "Becker", "Hoffmann"}
+};
+static const NameList french = {
+    {"Lucas", "Chloe", "Hugo", "Camille", "Louis", "Manon", "Jules", "Ines"},
+    {"Martin", "Bernard", "Dubois", "Thomas", "Robert", "Richard", "Petit", "Durand"}
+};
+static const NameList spanish = {
+    {"Mateo", "Lucia", "Santiago", "Sofia", "Diego", "Valeria", "Javier", "Carmen"},
+    {"Garcia", "Rodriguez", "Martinez", "Lopez", "Hernandez", "Gonzalez", "Perez", "Sanchez"}
+};
+static const NameList portuguese = {
+    {"Joao", "Ana", "Pedro", "Beatriz", "Gabriel", "Mariana", "Rafael", "Larissa"},
+    {"Silva", "Santos", "Oliveira", "Souza", "Lima", "Pereira", "Costa", "Almeida"}
+};
+static const NameList italian = {
+    {"Leonardo", "Giulia", "Francesco", "Chiara", "Alessandro", "Martina", "Lorenzo", "Sara"},
+    {"Rossi", "Russo", "Ferrari", "Esposito", "Bianchi", "Romano", "Colombo", "Ricci"}
+};
+static const NameList dutch = {
+    {"Daan", "Emma", "Sem", "Julia", "Lucas", "Tess", "Finn", "Anna"},
+    {"de Jong", "Jansen", "de Vries", "van den Berg", "Bakker", "Visser", "Smit", "Meijer"}
+};
+static const NameList swedish = {
+    {"Erik", "Alice", "Oscar", "Maja", "William", "Elsa", "Hugo", "Astrid"},
+    {"Andersson", "Johansson", "Karlsson", "Nilsson", "Eriksson", "Larsson", "Olsson", "Persson"}
+};
+static const NameList polish = {
+    {"Jakub", "Zuzanna", "Antoni", "Julia", "Jan", "Maja", "Szymon", "Hanna"},
+    {"Nowak", "Kowalski", "Wisniewski", "Wojcik", "Kowalczyk", "Kaminski", "Lewandowski", "Zielinski"}
+};
+static const NameList indian = {
+    {"Aarav", "Priya", "Vihaan", "Ananya", "Arjun", "Diya", "Rohan", "Kavya"},
+    {"Sharma", "Patel", "Singh", "Kumar", "Gupta", "Reddy", "Iyer", "Nair"}
+};
+static const NameList japanese = {
+    {"Haruto", "Yui", "Sota", "Hina", "Ren", "Sakura", "Yuto", "Aoi"},
+    {"Sato", "Suzuki", "Takahashi", "Tanaka", "Watanabe", "Ito", "Yamamoto", "Nakamura"}
+};
+static const NameList chinese = {
+    {"Wei", "Fang", "Hao", "Li Na", "Jun", "Xiu Ying", "Ming", "Yan"},
+    {"Wang", "Li", "Zhang", "Liu", "Chen", "Yang", "Huang", "Zhao"}
+};
+static const NameList russian = {
+    {"Alexander", "Anastasia", "Dmitry", "Maria", "Ivan", "Daria", "Mikhail", "Polina"},
+    {"Ivanov", "Smirnov", "Kuznetsov", "Popov", "Vasiliev", "Petrov", "Sokolov", "Morozov"}
+};
+
+// Regions users and validations are spread over, the first more often.
+// Where the metadata in use has no example for one, its users go without
+// a phone and its validations are of malformed input.
+static const struct {
+    const char* region;
+    const NameList* names;
+} regions[] = {
+    {"US", &english}, {"GB", &english}, {"DE", &german}, {"FR", &french}, {"IN", &indian},
+    {"BR", &portuguese}, {"CA", &english}, {"AU", &english}, {"ES", &spanish}, {"MX", &spanish},
+    {"IT", &italian}, {"NL", &dutch}, {"JP", &japanese}, {"SE", &swedish}, {"PL", &polish},
+    {"ZA", &english}, {"CN", &chinese}, {"RU", &russian}, {"IE", &english}, {"NZ", &english},
+    {"SG", &english},
+};
+
+#define REGION_COUNT (int)(sizeof(regions) / sizeof(regions[0]))
+
+static const char* domains[] = {"example.com", "example.org", "example.net"};
+
+// How often each endpoint family shows up in the history, out of 100
+static const struct {
+    const char* source;
+    int weight;
+} sources[] = {
+    {"validate", 50}, {"webhook", 20}, {"batch", 12}, {"checkout", 8}, {"csv", 5},
+    {"websocket", 5},
+};
+
+// Made up keys the history's callers are fingerprints of, plus one slot
+// for calls made without a key
+#define CALLER_COUNT 4
+
+// splitmix64 of index and what it is for, so each record's choices
+// depend on nothing but its index
+static uint64_t mix(uint64_t index, uint64_t salt) {
+    uint64_t z = index * 0x9e3779b97f4a7c15ULL + salt * 0xbf58476d1ce4e5b9ULL + 0x94d049bb133111ebULL;
+    z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9ULL;
+    z = (z ^ (z >> 27)) * 0x94d049bb133111ebULL;
+    return z ^ (z >> 31);
+}
+
+// A third of picks go to the US, the rest spread over every region
+static int pick_region(uint64_t roll) {
+    return roll % 3 == 0 ? 0 : (int)((roll / 3) % REGION_COUNT);
+}
+
+// Writes a valid number of region in E.164, variant choosing which: the
+// region's example with its last four digits changed until it is still
+// valid, or the example itself. False if the metadata has no example.
+static bool demo_number(const char* region, uint64_t variant, char* out, size_t out_size) {
+    PhoneNumber example;
+    PhoneNumberType type = variant % 3 == 0 ? PHONE_TYPE_FIXED_LINE : PHONE_TYPE_MOBILE;
+    if (!phone_get_example(region, type, &example) &&
+        !phone_get_example(region, PHONE_TYPE_UNKNOWN, &example)) {
+        return false;
+    }
+
+    size_t length = strlen(example.national_number);
+    for (int attempt = 0; attempt < 8 && length > 4; attempt++) {
+        PhoneNumber number = example;
+        snprintf(number.national_number + length - 4, 5, "%04u",
+                 (unsigned int)(mix(variant, (uint64_t)attempt + 100) % 10000));
+        char e164[32];
+        snprintf(e164, sizeof(e164), "+%d%s", number.country_code, number.national_number);
+        PhoneNumber parsed;
+        if (phone_parse(e164, NULL, &parsed) == PHONE_OK && phone_validity_reason(&parsed) == PHONE_OK) {
+            snprintf(out, out_size, "%s", e164);
+            return true;
+        }
+    }
+    return phone_format(&example, PHONE_FORMAT_E164, out, out_size);
+}
+
+// Lowercase letters of text, for an email's local part
+static void email_word(const char* text, char* out, size_t out_size) {
+    size_t length = 0;
+    for (const char* p = text; *p && length + 1 < out_size; p++) {
+        if (isalpha((unsigned char)*p)) out[length++] = (char)tolower((unsigned char)*p);
+    }
+    out[length] = '\0';
+}
+
+void seed_user(int index, User* user, bool* deleted) {
+    memset(user, 0, sizeof(User));
+    int region = pick_region(mix((uint64_t)index, 1));
+    const NameList* names = regions[region].names;
+    const char* first = names->first[mix((uint64_t)index, 2) % 8];
+    const char* last = names->last[mix((uint64_t)index, 3) % 8];
+    snprintf(user->name, sizeof(user->name), "%s %s", first, last);
+
+    // The index keeps emails apart when the names are alike
+    char first_word[32];
+    char last_word[32];
+    email_word(first, first_word, sizeof(first_word));
+    email_word(last, last_word, sizeof(last_word));
+    snprintf(user->email, USER_EMAIL_LENGTH + 1, "%s.%s%d@%s", first_word, last_word, index + 1,
+             domains[mix((uint64_t)index, 4) % 3]);
+
+    // One in twelve has no phone; the rest each get their own number
+    if (mix((uint64_t)index, 5) % 12 != 0 &&
+        !demo_number(regions[region].region, (uint64_t)index, user->phone, USER_PHONE_LENGTH + 1)) {
+        user->phone[0] = '\0';
+    }
+    // One in twenty-five is in the bin, never the first, which tells a
+    // seeded store
+    *deleted = index > 0 && mix((uint64_t)index, 6) % 25 == 0;
+}
+
+void seed_validation(int index, int count, long long now, SeedValidation* validation) {
+    memset(validation, 0, sizeof(SeedValidation));
+    uint64_t roll = mix((uint64_t)index, 10) % 100;
+    const char* region = regions[pick_region(mix((uint64_t)index, 11))].region;
+    // Numbers come from a pool small enough that some are validated again
+    uint64_t variant = mix((uint64_t)index, 12) % 400;
+
+    char number[32];
+    if (roll >= 97 || !demo_number(region, variant, number, sizeof(number))) {
+        static const char* garbage[] = {"call me", "n/a", "000", "+999 123 4567", "12"};
+        snprintf(validation->input, sizeof(validation->input), "%s", garbage[variant % 5]);
+    } else if (roll < 80) {
+        snprintf(validation->input, sizeof(validation->input), "%s", number);
+    } else if (roll < 87) {
+        // Too short: a digit or three dropped
+        number[strlen(number) - 1 - variant % 3] = '\0';
+        snprintf(validation->input, sizeof(validation->input), "%s", number);
+    } else if (roll < 92) {
+        // Too long: digits typed twice
+        snprintf(validation->input, sizeof(validation->input), "%s%s", number,
+                 number + strlen(number) - 4);
+    } else {
+        snprintf(validation->input, sizeof(validation->input), "%s", number);
+        validation->blocked = true;
+    }
+
+    int weight = (int)(mix((uint64_t)index, 13) % 100);
+    validation->source = sources[0].source;
+    for (size_t i = 0; i < sizeof(sources) / sizeof(sources[0]); i++) {
+        if (weight < sources[i].weight) {
+            validation->source = sources[i].source;
+            break;
+        }
+        weight -= sources[i].weight;
+    }
+
+    int caller = (int)(mix((uint64_t)index, 14) % CALLER_COUNT);
+    if (caller > 0) {
+        char key[32];
+        char digest[65];
+        snprintf(key, sizeof(key), "pv_demo_key_%d", caller);
+        sha256_hex(key, strlen(key), digest);
+        snprintf(validation->caller, sizeof(validation->caller), "%.16s", digest);
+    }
+    // Somewhere in the index's share of the days, the last one ending now
+    long long window = (long long)SEED_HISTORY_DAYS * 86400;
+    long long start = now - window + window * index / count;
+    long long share = window / count > 1 ? window / count : 1;
+    validation->timestamp = start + (long long)(mix((uint64_t)index, 15) % (uint64_t)share);
+}
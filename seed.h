@@ -0,0 +1,44 @@
+#ifndef SEED_H
+#define SEED_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+#include "store.h"
+
+// Fake but plausible users and validation history, for trying the
+// dashboard and pagination out locally. Record number index gets the same
+// name, email, number and outcome on every run and every machine, so two
+// seeded stores look alike and a screenshot can be taken again. Names are
+// common ones from the regions the phones are in; emails are at
+// example.com, .org and .net, which RFC 2606 reserves, so nothing seeded
+// can reach anyone.
+
+#define SEED_USERS 250          // Users seeded when not told otherwise
+#define SEED_HISTORY 2000       // History records likewise
+#define SEED_MAX_USERS 10000
+#define SEED_MAX_HISTORY 100000
+#define SEED_HISTORY_DAYS 90    // History is spread over the days up to now
+
+// One seeded validation, as a request would have made it
+typedef struct {
+    char input[40];             // What was sent: mostly E.164, some of it malformed
+    bool blocked;               // Blocklisted, with reason SEED_BLOCKED_REASON
+    const char* source;         // Endpoint family, e.g. "validate"
+    char caller[17];            // Fingerprint of one of a few made up keys, or empty
+    long long timestamp;        // Unix seconds
+} SeedValidation;
+
+#define SEED_BLOCKED_REASON "Demo blocklist entry"
+
+// Fills user with demo user index (0 on): a name, a unique email and,
+// for most, a phone valid under the metadata in use, in E.164. Some are
+// meant to be soft deleted once created; deleted tells which.
+void seed_user(int index, User* user, bool* deleted);
+
+// Fills validation with demo validation index of count, made before now.
+// Later indexes are later in time, so that the history's ids run in the
+// order the validations were made, as they would for real ones.
+void seed_validation(int index, int count, long long now, SeedValidation* validation);
+
+#endif
@@ -0,0 +1,125 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <pthread.h>
+
+#include "session.h"
+
+#define SWEEP_INTERVAL 64       // Sessions created between sweeps of expired ones
+
+typedef struct Entry {
+    Session session;
+    struct Entry* next;
+} Entry;
+
+struct SessionStore {
+    int timeout;
+    Entry* entries;
+    int creations;
+    pthread_mutex_t lock;
+};
+
+bool session_new_token(char* out) {
+    unsigned char bytes[SESSION_ID_LENGTH / 2];
+    FILE* random = fopen("/dev/urandom", "rb");
+    if (!random) return false;
+    bool ok = fread(bytes, 1, sizeof(bytes), random) == sizeof(bytes);
+    fclose(random);
+    for (size_t i = 0; ok && i < sizeof(bytes); i++) {
+        sprintf(out + i * 2, "%02x", bytes[i]);
+    }
+    return ok;
+}
+
+// Compares every character, so the time taken doesn't tell an attacker how
+// much of a guessed id was right
+static bool id_equal(const char* a, const char* b) {
+    unsigned char diff = 0;
+    for (int i = 0; i < SESSION_ID_LENGTH; i++) {
+        diff |= (unsigned char)(a[i] ^ b[i]);
+        if (!a[i] || !b[i]) return false;
+    }
+    return diff == 0 && b[SESSION_ID_LENGTH] == '\0';
+}
+
+// Caller holds the lock
+static void sweep(SessionStore* sessions, long long now) {
+    Entry** link = &sessions->entries;
+    while (*link) {
+        Entry* entry = *link;
+        if (entry->session.expires <= now) {
+            *link = entry->next;
+            free(entry);
+        } else {
+            link = &entry->next;
+        }
+    }
+}
+
+SessionStore* session_store_create(int timeout) {
+    SessionStore* sessions = calloc(1, sizeof(SessionStore));
+    sessions->timeout = timeout > 0 ? timeout : 1;
+    pthread_mutex_init(&sessions->lock, NULL);
+    return sessions;
+}
+
+void session_store_free(SessionStore* sessions) {
+    Entry* entry = sessions->entries;
+    while (entry) {
+        Entry* next = entry->next;
+        free(entry);
+        entry = next;
+    }
+    pthread_mutex_destroy(&sessions->lock);
+    free(sessions);
+}
+
+bool session_create(SessionStore* sessions, const char* user, long long now, Session* session) {
+    Entry* entry = calloc(1, sizeof(Entry));
+    if (!session_new_token(entry->session.id) || !session_new_token(entry->session.csrf_token)) {
+        free(entry);
+        return false;
+    }
+    snprintf(entry->session.user, sizeof(entry->session.user), "%s", user);
+    entry->session.expires = now + sessions->timeout;
+
+    pthread_mutex_lock(&sessions->lock);
+    if (++sessions->creations % SWEEP_INTERVAL == 0) {
+        sweep(sessions, now);
+    }
+    entry->next = sessions->entries;
+    sessions->entries = entry;
+    *session = entry->session;
+    pthread_mutex_unlock(&sessions->lock);
+    return true;
+}
+
+bool session_find(SessionStore* sessions, const char* id, long long now, Session* session) {
+    pthread_mutex_lock(&sessions->lock);
+    Entry* entry = sessions->entries;
+    while (entry && !id_equal(entry->session.id, id)) {
+        entry = entry->next;
+    }
+    bool found = entry && entry->session.expires > now;
+    if (found) {
+        entry->session.expires = now + sessions->timeout;
+        *session = entry->session;
+    }
+    pthread_mutex_unlock(&sessions->lock);
+    return found;
+}
+
+void session_destroy(SessionStore* sessions, const char* id) {
+    pthread_mutex_lock(&sessions->lock);
+    Entry** link = &sessions->entries;
+    while (*link) {
+        Entry* entry = *link;
+        if (id_equal(entry->session.id, id)) {
+            *link = entry->next;
+            free(entry);
+            break;
+        }
+        link = &entry->next;
+    }
+    pthread_mutex_unlock(&sessions->lock);
+}
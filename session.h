@@ -0,0 +1,37 @@
+#ifndef SESSION_H
+#define SESSION_H
+
+#include <stdbool.h>
+
+#define SESSION_ID_LENGTH 64    // Hex characters, 256 random bits
+
+// A signed in admin. The id goes in the session cookie; csrf_token is put in
+// every form and has to come back with each post.
+typedef struct {
+    char id[SESSION_ID_LENGTH + 1];
+    char user[64];
+    char csrf_token[SESSION_ID_LENGTH + 1];
+    long long expires;      // Unix seconds, pushed back on each use
+} Session;
+
+// Sessions in memory, so a restart signs everyone out. Each lasts timeout
+// seconds from its last use. Safe to share between threads.
+typedef struct SessionStore SessionStore;
+
+SessionStore* session_store_create(int timeout);
+void session_store_free(SessionStore* sessions);
+
+// Starts a session for user at time now and copies it to session. Returns
+// false when no random bytes could be read.
+bool session_create(SessionStore* sessions, const char* user, long long now, Session* session);
+
+// Looks up a live session by id and extends it
+bool session_find(SessionStore* sessions, const char* id, long long now, Session* session);
+
+void session_destroy(SessionStore* sessions, const char* id);
+
+// Writes SESSION_ID_LENGTH random hex characters and a NUL to out, for
+// tokens that live outside a session. False when /dev/urandom can't be read.
+bool session_new_token(char* out);
+
+#endif
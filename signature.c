@@ -0,0 +1,274 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <stdint.h>
+#include <pthread.h>
+
+#include "signature.h"
+
+#define SHA256_BLOCK_SIZE 64
+#define SHA256_DIGEST_SIZE 32
+#define NONCE_BINS 1024
+#define SWEEP_INTERVAL 4096     // Insertions between sweeps of expired nonces
+
+// ============= SHA-256 =============
+
+typedef struct {
+    uint32_t state[8];
+    uint64_t length;            // Bytes hashed so far
+    unsigned char block[SHA256_BLOCK_SIZE];
+    size_t block_used;
+} Sha256;
+
+static const uint32_t round_constants[64] = {
+    0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+    0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+    0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+    0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+    0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+    0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+    0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+    0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2,
+};
+
+static uint32_t rotate_right(uint32_t value, int bits) {
+    return (value >> bits) | (value << (32 - bits));
+}
+
+static void sha256_init(Sha256* sha) {
+    static const uint32_t initial_state[8] = {
+        0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a,
+        0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+    };
+    memcpy(sha->state, initial_state, sizeof(initial_state));
+    sha->length = 0;
+    sha->block_used = 0;
+}
+
+static void sha256_compress(Sha256* sha, const unsigned char* block) {
+    uint32_t w[64];
+    for (int i = 0; i < 16; i++) {
+        w[i] = (uint32_t)block[i * 4] << 24 | (uint32_t)block[i * 4 + 1] << 16 |
+               (uint32_t)block[i * 4 + 2] << 8 | (uint32_t)block[i * 4 + 3];
+    }
+    for (int i = 16; i < 64; i++) {
+        uint32_t s0 = rotate_right(w[i - 15], 7) ^ rotate_right(w[i - 15], 18) ^ (w[i - 15] >> 3);
+        uint32_t s1 = rotate_right(w[i - 2], 17) ^ rotate_right(w[i - 2], 19) ^ (w[i - 2] >> 10);
+        w[i] = w[i - 16] + s0 + w[i - 7] + s1;
+    }
+
+    uint32_t a = sha->state[0], b = sha->state[1], c = sha->state[2], d = sha->state[3];
+    uint32_t e = sha->state[4], f = sha->state[5], g = sha->state[6], h = sha->state[7];
+    for (int i = 0; i < 64; i++) {
+        uint32_t s1 = rotate_right(e, 6) ^ rotate_right(e, 11) ^ rotate_right(e, 25);
+        uint32_t choice = (e & f) ^ (~e & g);
+        uint32_t temp1 = h + s1 + choice + round_constants[i] + w[i];
+        uint32_t s0 = rotate_right(a, 2) ^ rotate_right(a, 13) ^ rotate_right(a, 22);
+        uint32_t majority = (a & b) ^ (a & c) ^ (b & c);
+        uint32_t temp2 = s0 + majority;
+        h = g;
+        g = f;
+        f = e;
+        e = d + temp1;
+        d = c;
+        c = b;
+        b = a;
+        a = temp1 + temp2;
+    }
+    sha->state[0] += a;
+    sha->state[1] += b;
+    sha->state[2] += c;
+    sha->state[3] += d;
+    sha->state[4] += e;
+    sha->state[5] += f;
+    sha->state[6] += g;
+    sha->state[7] += h;
+}
+
+static void sha256_update(Sha256* sha, const void* data, size_t length) {
+    const unsigned char* bytes = data;
+    sha->length += length;
+    while (length > 0) {
+        size_t take = SHA256_BLOCK_SIZE - sha->block_used;
+        if (take > length) take = length;
+        memcpy(sha->block + sha->block_used, bytes, take);
+        sha->block_used += take;
+        bytes += take;
+        length -= take;
+        if (sha->block_used == SHA256_BLOCK_SIZE) {
+            sha256_compress(sha, sha->block);
+            sha->block_used = 0;
+        }
+    }
+}
+
+static void sha256_final(Sha256* sha, unsigned char* digest) {
+    uint64_t bits = sha->length * 8;
+    unsigned char padding[SHA256_BLOCK_SIZE + 8] = {0x80};
+    size_t pad_length = (sha->block_used < 56 ? 56 : 120) - sha->block_used;
+    sha256_update(sha, padding, pad_length);
+
+    unsigned char length_bytes[8];
+    for (int i = 0; i < 8; i++) {
+        length_bytes[i] = (unsigned char)(bits >> (56 - i * 8));
+    }
+    sha256_update(sha, length_bytes, sizeof(length_bytes));
+
+    for (int i = 0; i < 8; i++) {
+        digest[i * 4] = (unsigned char)(sha->state[i] >> 24);
+        digest[i * 4 + 1] = (unsigned char)(sha->state[i] >> 16);
+        digest[i * 4 + 2] = (unsigned char)(sha->state[i] >> 8);
+        digest[i * 4 + 3] = (unsigned char)sha->state[i];
+    }
+}
+
+void sha256_hex(const char* data, size_t data_length, char* out) {
+    unsigned char digest[SHA256_DIGEST_SIZE];
+    Sha256 sha;
+    sha256_init(&sha);
+    sha256_update(&sha, data, data_length);
+    sha256_final(&sha, digest);
+
+    for (int i = 0; i < SHA256_DIGEST_SIZE; i++) {
+        snprintf(out + i * 2, 3, "%02x", digest[i]);
+    }
+}
+
+// ============= HMAC =============
+
+void hmac_sha256_hex(const char* key, size_t key_length,
+                     const char* data, size_t data_length, char* out) {
+    // Keys longer than a block are hashed first (RFC 2104)
+    unsigned char block_key[SHA256_BLOCK_SIZE] = {0};
+    Sha256 sha;
+    if (key_length > SHA256_BLOCK_SIZE) {
+        sha256_init(&sha);
+        sha256_update(&sha, key, key_length);
+        sha256_final(&sha, block_key);
+    } else {
+        memcpy(block_key, key, key_length);
+    }
+
+    unsigned char inner_pad[SHA256_BLOCK_SIZE];
+    unsigned char outer_pad[SHA256_BLOCK_SIZE];
+    for (int i = 0; i < SHA256_BLOCK_SIZE; i++) {
+        inner_pad[i] = block_key[i] ^ 0x36;
+        outer_pad[i] = block_key[i] ^ 0x5c;
+    }
+
+    unsigned char inner_digest[SHA256_DIGEST_SIZE];
+    sha256_init(&sha);
+    sha256_update(&sha, inner_pad, sizeof(inner_pad));
+    sha256_update(&sha, data, data_length);
+    sha256_final(&sha, inner_digest);
+
+    unsigned char digest[SHA256_DIGEST_SIZE];
+    sha256_init(&sha);
+    sha256_update(&sha, outer_pad, sizeof(outer_pad));
+    sha256_update(&sha, inner_digest, sizeof(inner_digest));
+    sha256_final(&sha, digest);
+
+    for (int i = 0; i < SHA256_DIGEST_SIZE; i++) {
+        snprintf(out + i * 2, 3, "%02x", digest[i]);
+    }
+}
+
+bool signature_equal(const char* a, const char* b) {
+    size_t length = strlen(a);
+    if (length != strlen(b)) return false;
+
+    unsigned char difference = 0;
+    for (size_t i = 0; i < length; i++) {
+        difference |= (unsigned char)a[i] ^ (unsigned char)b[i];
+    }
+    return difference == 0;
+}
+
+// ============= Nonce Cache =============
+
+typedef struct Nonce {
+    char value[128];
+    double seen;
+    struct Nonce* next;
+} Nonce;
+
+struct NonceCache {
+    int window;
+    Nonce* bins[NONCE_BINS];
+    int insertions;
+    pthread_mutex_t lock;
+};
+
+// FNV-1a
+static unsigned int hash_nonce(const char* nonce) {
+    unsigned int hash = 2166136261u;
+    for (; *nonce; nonce++) {
+        hash ^= (unsigned char)*nonce;
+        hash *= 16777619u;
+    }
+    return hash % NONCE_BINS;
+}
+
+// Drops nonces older than the window; a request reusing one would be
+// rejected for its timestamp anyway. Caller holds the lock.
+static void sweep(NonceCache* cache, double now) {
+    for (int i = 0; i < NONCE_BINS; i++) {
+        Nonce** link = &cache->bins[i];
+        while (*link) {
+            Nonce* nonce = *link;
+            if (now - nonce->seen > cache->window) {
+                *link = nonce->next;
+                free(nonce);
+            } else {
+                link = &nonce->next;
+            }
+        }
+    }
+}
+
+NonceCache* nonce_cache_create(int window) {
+    NonceCache* cache = calloc(1, sizeof(NonceCache));
+    cache->window = window;
+    pthread_mutex_init(&cache->lock, NULL);
+    return cache;
+}
+
+void nonce_cache_free(NonceCache* cache) {
+    for (int i = 0; i < NONCE_BINS; i++) {
+        Nonce* nonce = cache->bins[i];
+        while (nonce) {
+            Nonce* next = nonce->next;
+            free(nonce);
+            nonce = next;
+        }
+    }
+    pthread_mutex_destroy(&cache->lock);
+    free(cache);
+}
+
+bool nonce_cache_add(NonceCache* cache, const char* nonce, double now) {
+    pthread_mutex_lock(&cache->lock);
+
+    unsigned int bin = hash_nonce(nonce);
+    Nonce* entry = cache->bins[bin];
+    while (entry && strcmp(entry->value, nonce) != 0) {
+        entry = entry->next;
+    }
+
+    bool fresh = !entry || now - entry->seen > cache->window;
+    if (entry) {
+        if (fresh) entry->seen = now;
+    } else {
+        if (++cache->insertions % SWEEP_INTERVAL == 0) {
+            sweep(cache, now);
+        }
+        entry = calloc(1, sizeof(Nonce));
+        strncpy(entry->value, nonce, sizeof(entry->value) - 1);
+        entry->seen = now;
+        entry->next = cache->bins[bin];
+        cache->bins[bin] = entry;
+    }
+
+    pthread_mutex_unlock(&cache->lock);
+    return fresh;
+}
@@ -0,0 +1,35 @@
+#ifndef SIGNATURE_H
+#define SIGNATURE_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+// HMAC-SHA256 request signatures, so that the WordPress plugin can
+// authenticate with a shared secret instead of sending an API key.
+
+#define SIGNATURE_HEX_LENGTH 64
+
+// Writes SHA-256(data) as lowercase hex to out, which must hold
+// SIGNATURE_HEX_LENGTH + 1 bytes
+void sha256_hex(const char* data, size_t data_length, char* out);
+
+// Writes HMAC-SHA256(key, data) as lowercase hex to out, which must hold
+// SIGNATURE_HEX_LENGTH + 1 bytes
+void hmac_sha256_hex(const char* key, size_t key_length,
+                     const char* data, size_t data_length, char* out);
+
+// Compares two signatures in time that doesn't depend on where they differ
+bool signature_equal(const char* a, const char* b);
+
+// Nonces seen within the last window seconds, to reject replayed requests.
+// Safe to share between threads.
+typedef struct NonceCache NonceCache;
+
+NonceCache* nonce_cache_create(int window);
+void nonce_cache_free(NonceCache* cache);
+
+// Records nonce at time now (seconds). Returns false if it was already used
+// within the window.
+bool nonce_cache_add(NonceCache* cache, const char* nonce, double now);
+
+#endif
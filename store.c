@@ -0,0 +1,411 @@
+#include <ctype.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+
+#include "store.h"
+
+static const char* list_names[] = {"block", "allow"};
+static const char* match_names[] = {"number", "prefix", "country"};
+static const char* action_names[] = {"allow", "deny"};
+static const char* rule_match_names[] = {"type", "country", "prefix", "any"};
+static const char* plugin_names[] = {"gravityforms", "wpforms"};
+static const char* sort_names[] = {"id", "name", "email", "phone"};
+static const char* deleted_names[] = {"exclude", "include", "only"};
+static const char* scope_names[] = {"validate", "read-users", "admin"};
+
+const char* list_name_string(ListName list) {
+    return list_names[list];
+}
+
+bool list_name_parse(const char* name, ListName* list) {
+    for (int i = 0; i < (int)(sizeof(list_names) / sizeof(list_names[0])); i++) {
+        if (strcmp(name, list_names[i]) == 0) {
+            *list = (ListName)i;
+            return true;
+        }
+    }
+    return false;
+}
+
+const char* list_match_string(ListMatch match) {
+    return match_names[match];
+}
+
+bool list_match_parse(const char* name, ListMatch* match) {
+    for (int i = 0; i < (int)(sizeof(match_names) / sizeof(match_names[0])); i++) {
+        if (strcmp(name, match_names[i]) == 0) {
+            *match = (ListMatch)i;
+            return true;
+        }
+    }
+    return false;
+}
+
+const char* rule_action_string(RuleAction action) {
+    return action_names[action];
+}
+
+bool rule_action_parse(const char* name, RuleAction* action) {
+    for (int i = 0; i < (int)(sizeof(action_names) / sizeof(action_names[0])); i++) {
+        if (strcmp(name, action_names[i]) == 0) {
+            *action = (RuleAction)i;
+            return true;
+        }
+    }
+    return false;
+}
+
+const char* rule_match_string(RuleMatch match) {
+    return rule_match_names[match];
+}
+
+bool rule_match_parse(const char* name, RuleMatch* match) {
+    for (int i = 0; i < (int)(sizeof(rule_match_names) / sizeof(rule_match_names[0])); i++) {
+        if (strcmp(name, rule_match_names[i]) == 0) {
+            *match = (RuleMatch)i;
+            return true;
+        }
+    }
+    return false;
+}
+
+const char* form_plugin_string(FormPlugin plugin) {
+    return plugin_names[plugin];
+}
+
+bool form_plugin_parse(const char* name, FormPlugin* plugin) {
+    for (int i = 0; i < (int)(sizeof(plugin_names) / sizeof(plugin_names[0])); i++) {
+        if (strcmp(name, plugin_names[i]) == 0) {
+            *plugin = (FormPlugin)i;
+            return true;
+        }
+    }
+    return false;
+}
+
+const char* key_scope_string(KeyScope scope) {
+    for (int i = 0; i < (int)(sizeof(scope_names) / sizeof(scope_names[0])); i++) {
+        if ((int)scope == 1 << i) return scope_names[i];
+    }
+    return "";
+}
+
+bool key_scope_parse(const char* name, KeyScope* scope) {
+    for (int i = 0; i < (int)(sizeof(scope_names) / sizeof(scope_names[0])); i++) {
+        if (strcmp(name, scope_names[i]) == 0) {
+            *scope = (KeyScope)(1 << i);
+            return true;
+        }
+    }
+    return false;
+}
+
+const char* user_sort_string(UserSort sort) {
+    return sort_names[sort];
+}
+
+bool user_sort_parse(const char* name, UserSort* sort) {
+    for (int i = 0; i < (int)(sizeof(sort_names) / sizeof(sort_names[0])); i++) {
+        if (strcmp(name, sort_names[i]) == 0) {
+            *sort = (UserSort)i;
+            return true;
+        }
+    }
+    return false;
+}
+
+const char* user_deleted_string(UserDeleted deleted) {
+    return deleted_names[deleted];
+}
+
+bool user_deleted_parse(const char* name, UserDeleted* deleted) {
+    for (int i = 0; i < (int)(sizeof(deleted_names) / sizeof(deleted_names[0])); i++) {
+        if (strcmp(name, deleted_names[i]) == 0) {
+            *deleted = (UserDeleted)i;
+            return true;
+        }
+    }
+    return false;
+}
+
+static bool contains_ignoring_case(const char* text, const char* part) {
+    size_t len = strlen(part);
+    for (; *text; text++) {
+        if (strncasecmp(text, part, len) == 0) return true;
+    }
+    return false;
+}
+
+bool user_filter_matches(const User* user, const UserFilter* filter) {
+    if (filter->deleted == USERS_EXCLUDE_DELETED && user->deleted_at) return false;
+    if (filter->deleted == USERS_ONLY_DELETED && !user->deleted_at) return false;
+    if (filter->phone_invalid && !user->phone_invalid_since) return false;
+    const char* query = filter->query;
+    return !query[0] || contains_ignoring_case(user->name, query) ||
+           contains_ignoring_case(user->email, query) || contains_ignoring_case(user->phone, query);
+}
+
+static int compare_ids(const User* a, const User* b) {
+    return (a->id > b->id) - (a->id < b->id);
+}
+
+static int compare_by_id(const void* a, const void* b) {
+    return compare_ids(a, b);
+}
+
+static int compare_by_name(const void* a, const void* b) {
+    int order = strcasecmp(((const User*)a)->name, ((const User*)b)->name);
+    return order ? order : compare_ids(a, b);
+}
+
+static int compare_by_email(const void* a, const void* b) {
+    int order = strcasecmp(((const User*)a)->email, ((const User*)b)->email);
+    return order ? order : compare_ids(a, b);
+}
+
+static int compare_by_phone(const void* a, const void* b) {
+    int order = strcmp(((const User*)a)->phone, ((const User*)b)->phone);
+    return order ? order : compare_ids(a, b);
+}
+
+// Indexed by UserSort
+static int (*const user_comparators[])(const void*, const void*) = {
+    compare_by_id, compare_by_name, compare_by_email, compare_by_phone
+};
+
+
+int user_filter_page(User* users, int count, const UserFilter* filter) {
+    qsort(users, count, sizeof(User), user_comparators[filter->sort]);
+    if (filter->descending) {
+        for (int i = 0, j = count - 1; i < j; i++, j--) {
+            User swap = users[i];
+            users[i] = users[j];
+            users[j] = swap;
+        }
+    }
+
+    int start = filter->offset < count ? filter->offset : count;
+    int page = count - start < filter->limit ? count - start : filter->limit;
+    memmove(users, users + start, sizeof(User) * page);
+    return page;
+}
+
+void user_query_pattern(const char* query, char* out, size_t out_size) {
+    size_t len = 0;
+    if (query[0] && out_size > 2) out[len++] = '%';
+    for (const char* p = query; *p && len + 3 < out_size; p++) {
+        if (*p == '%' || *p == '_' || *p == '\\') out[len++] = '\\';
+        out[len++] = *p;
+    }
+    if (query[0] && len + 1 < out_size) out[len++] = '%';
+    out[len] = '\0';
+}
+
+// Letters and digits, counting every byte of a UTF-8 sequence as a letter
+static bool is_word_byte(unsigned char c) {
+    return isalnum(c) || c >= 0x80;
+}
+
+static void add_term(SearchTerm* terms, int* count, SearchTermKind kind, const char* text,
+                     size_t len) {
+    if (*count == USER_SEARCH_TERMS || len == 0) return;
+    if (len >= sizeof(terms[0].text)) len = sizeof(terms[0].text) - 1;
+    SearchTerm* term = &terms[(*count)++];
+    term->kind = kind;
+    for (size_t i = 0; i < len; i++) term->text[i] = (char)tolower((unsigned char)text[i]);
+    term->text[len] = '\0';
+}
+
+// A token of digits, with an optional leading + and the separators
+// numbers are written with, e.g. "+1 (415)" or "555-0123"
+static bool is_phone_token(const char* token, size_t len) {
+    bool digits = false;
+    for (size_t i = 0; i < len; i++) {
+        if (isdigit((unsigned char)token[i])) {
+            digits = true;
+        } else if (!(token[i] == '+' && i == 0) && !strchr("-().", token[i])) {
+            return false;
+        }
+    }
+    return digits;
+}
+
+int user_search_terms(const char* query, SearchTerm* terms) {
+    int count = 0;
+    const char* p = query;
+    while (*p) {
+        while (isspace((unsigned char)*p)) p++;
+        const char* token = p;
+        while (*p && !isspace((unsigned char)*p)) p++;
+        size_t len = (size_t)(p - token);
+        if (len == 0) break;
+
+        if (is_phone_token(token, len)) {
+            char digits[sizeof(terms[0].text)];
+            size_t n = 0;
+            if (token[0] == '+') digits[n++] = '+';
+            for (size_t i = 0; i < len && n + 1 < sizeof(digits); i++) {
+                if (isdigit((unsigned char)token[i])) digits[n++] = token[i];
+            }
+            add_term(terms, &count, SEARCH_TERM_PHONE, digits, n);
+        } else if (token[0] == '@') {
+            add_term(terms, &count, SEARCH_TERM_DOMAIN, token + 1, len - 1);
+        } else {
+            for (size_t i = 0; i < len;) {
+                size_t start = i;
+                while (i < len && is_word_byte((unsigned char)token[i])) i++;
+                add_term(terms, &count, SEARCH_TERM_WORD, token + start, i - start);
+                while (i < len && !is_word_byte((unsigned char)token[i])) i++;
+            }
+        }
+    }
+    return count;
+}
+
+// How well word starts a word of text: whole words score exact, prefixes
+// prefix, anything else 0
+static int word_score(const char* text, const char* word, int exact, int prefix) {
+    size_t len = strlen(word);
+    int best = 0;
+    for (const char* p = text; *p;) {
+        while (*p && !is_word_byte((unsigned char)*p)) p++;
+        const char* start = p;
+        while (*p && is_word_byte((unsigned char)*p)) p++;
+        if ((size_t)(p - start) < len || strncasecmp(start, word, len) != 0) continue;
+        int score = (size_t)(p - start) == len ? exact : prefix;
+        if (score > best) best = score;
+    }
+    return best;
+}
+
+static int term_score(const User* user, const SearchTerm* term) {
+    switch (term->kind) {
+    case SEARCH_TERM_WORD: {
+        int name = word_score(user->name, term->text, 8, 6);
+        int email = word_score(user->email, term->text, 4, 3);
+        return name > email ? name : email;
+    }
+    case SEARCH_TERM_DOMAIN: {
+        const char* at = strrchr(user->email, '@');
+        if (!at) return 0;
+        if (strcasecmp(at + 1, term->text) == 0) return 8;
+        return strncasecmp(at + 1, term->text, strlen(term->text)) == 0 ? 6 : 0;
+    }
+    case SEARCH_TERM_PHONE: {
+        // Bare digits are compared with the phone's digits, after its +
+        const char* phone = term->text[0] == '+' || !user->phone[0] ? user->phone : user->phone + 1;
+        if (strcmp(phone, term->text) == 0) return 10;
+        if (strncmp(phone, term->text, strlen(term->text)) == 0) return 6;
+        return term->text[0] != '+' && strstr(phone, term->text) ? 3 : 0;
+    }
+    }
+    return 0;
+}
+
+int user_search_score(const User* user, const SearchTerm* terms, int term_count) {
+    int total = 0;
+    for (int i = 0; i < term_count; i++) {
+        int score = term_score(user, &terms[i]);
+        if (score == 0) return 0;
+        total += score;
+    }
+    return total;
+}
+
+static int compare_matches(const void* a, const void* b) {
+    const UserMatch* x = a;
+    const UserMatch* y = b;
+    if (x->score != y->score) return x->score > y->score ? -1 : 1;
+    return (x->user.id > y->user.id) - (x->user.id < y->user.id);
+}
+
+void user_search_rank(const User* candidates, int candidate_count, const SearchTerm* terms,
+                      int term_count, int limit, UserMatch** matches, int* count) {
+    *matches = malloc(sizeof(UserMatch) * (candidate_count > 0 ? candidate_count : 1));
+    *count = 0;
+    for (int i = 0; i < candidate_count; i++) {
+        int score = term_count > 0 ? user_search_score(&candidates[i], terms, term_count) : 0;
+        if (score > 0 && !candidates[i].deleted_at) {
+            (*matches)[*count].user = candidates[i];
+            (*matches)[(*count)++].score = score;
+        }
+    }
+    if (*count > 0) qsort(*matches, *count, sizeof(UserMatch), compare_matches);
+    if (*count > limit) *count = limit;
+}
+
+Store* store_open(const char* dsn, const StoreOptions* options, char* error, size_t error_size) {
+    if (strcmp(dsn, "memory") == 0) {
+        return memory_store_open();
+    }
+
+    if (strncmp(dsn, "sqlite:", 7) == 0) {
+#ifdef HAVE_SQLITE
+        return sqlite_store_open(dsn + 7, options, error, error_size);
+#else
+        snprintf(error, error_size, "built without SQLite support (libsqlite3 wasn't found to build with)");
+        return NULL;
+#endif
+    }
+
+    if (strncmp(dsn, "postgres://", 11) == 0 || strncmp(dsn, "postgresql://", 13) == 0) {
+#ifdef HAVE_POSTGRES
+        return postgres_store_open(dsn, POSTGRES_POOL_SIZE, options, error, error_size);
+#else
+        snprintf(error, error_size, "built without Postgres support (make WITH_POSTGRES=1)");
+        return NULL;
+#endif
+    }
+
+    if (strncmp(dsn, "mysql://", 8) == 0 || strncmp(dsn, "mariadb://", 10) == 0) {
+#ifdef HAVE_MYSQL
+        return mysql_store_open(dsn, MYSQL_POOL_SIZE, options, error, error_size);
+#else
+        snprintf(error, error_size, "built without MySQL support (make WITH_MYSQL=1)");
+        return NULL;
+#endif
+    }
+
+    snprintf(error, error_size, "unknown store \"%s\"", dsn);
+    return NULL;
+}
+
+bool store_migrate(const char* dsn, const StoreOptions* options, MigrateCommand command, int target,
+                   char* error, size_t error_size) {
+    if (strcmp(dsn, "memory") == 0) {
+        snprintf(error, error_size, "the memory store has no schema to migrate");
+        return false;
+    }
+
+    if (strncmp(dsn, "sqlite:", 7) == 0) {
+#ifdef HAVE_SQLITE
+        return sqlite_store_migrate(dsn + 7, command, target, error, error_size);
+#else
+        snprintf(error, error_size, "built without SQLite support (libsqlite3 wasn't found to build with)");
+        return false;
+#endif
+    }
+
+    if (strncmp(dsn, "postgres://", 11) == 0 || strncmp(dsn, "postgresql://", 13) == 0) {
+#ifdef HAVE_POSTGRES
+        return postgres_store_migrate(dsn, command, target, error, error_size);
+#else
+        snprintf(error, error_size, "built without Postgres support (make WITH_POSTGRES=1)");
+        return false;
+#endif
+    }
+
+    if (strncmp(dsn, "mysql://", 8) == 0 || strncmp(dsn, "mariadb://", 10) == 0) {
+#ifdef HAVE_MYSQL
+        return mysql_store_migrate(dsn, options, command, target, error, error_size);
+#else
+        snprintf(error, error_size, "built without MySQL support (make WITH_MYSQL=1)");
+        return false;
+#endif
+    }
+
+    snprintf(error, error_size, "unknown store \"%s\"", dsn);
+    return false;
+}
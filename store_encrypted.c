@@ -0,0 +1,656 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <ctype.h>
+
+#include "store.h"
+
+// Users read from the inner store at a time, when every one is needed
+#define ENCRYPTED_SCAN_BATCH 1000
+
+typedef struct {
+    Store* inner;
+    Keyring* keyring;
+} EncryptedStore;
+
+static EncryptedStore* encrypted(Store* store) {
+    return store->data;
+}
+
+static Store* inner_store(Store* store) {
+    return encrypted(store)->inner;
+}
+
+// What field of user id is sealed as, e.g. "email:42". Id 0 leaves the
+// user out, as values were sealed before they were bound to their users.
+static void bound_field(const char* field, int id, char* out, size_t out_size) {
+    if (id > 0) snprintf(out, out_size, "%s:%d", field, id);
+    else snprintf(out, out_size, "%s", field);
+}
+
+// Seals field of user id into out, which is empty if value is
+static bool seal_field(EncryptedStore* enc, int id, const char* field, const char* value,
+                       char* out, size_t out_size) {
+    if (!value[0]) {
+        out[0] = '\0';
+        return true;
+    }
+    char bound[64];
+    bound_field(field, id, bound, sizeof(bound));
+    return keyring_seal(enc->keyring, bound, value, out, out_size);
+}
+
+// Opens field in place. A value sealed before values were bound to their
+// users opens too, setting *unbound (may be NULL) for the reseal task.
+static bool open_field(EncryptedStore* enc, int id, const char* field, char* value,
+                       size_t value_size, bool* unbound) {
+    char bound[64];
+    char opened[256];
+    char error[128];
+    bound_field(field, id, bound, sizeof(bound));
+    if (!keyring_open(enc->keyring, bound, value, opened, sizeof(opened), error, sizeof(error))) {
+        char unbound_error[128];
+        if (!is_sealed(value) ||
+            !keyring_open(enc->keyring, field, value, opened, sizeof(opened), unbound_error,
+                          sizeof(unbound_error))) {
+            fprintf(stderr, "Cannot open user %d's %s: %s\n", id, field, error);
+            return false;
+        }
+        if (unbound) *unbound = true;
+    }
+    snprintf(value, value_size, "%s", opened);
+    return true;
+}
+
+// Writes the blind indexes of email, compared ignoring case, and phone
+// under the keyring's key-th key. An empty phone gets an empty index.
+static bool index_values(EncryptedStore* enc, int key, const char* email, const char* phone,
+                         char* email_index, char* phone_index) {
+    char lowered[USER_EMAIL_LENGTH + 1];
+    size_t length = 0;
+    for (; email[length] && length < sizeof(lowered) - 1; length++) {
+        lowered[length] = (char)tolower((unsigned char)email[length]);
+    }
+    lowered[length] = '\0';
+    phone_index[0] = '\0';
+    return keyring_blind_index(enc->keyring, key, "email", lowered, email_index,
+                               BLIND_INDEX_LENGTH + 1) &&
+           (!phone[0] || keyring_blind_index(enc->keyring, key, "phone", phone, phone_index,
+                                             BLIND_INDEX_LENGTH + 1));
+}
+
+// Seals user's values, bound to user->id, and indexes them under the
+// current key
+static bool seal_user(EncryptedStore* enc, const User* user, User* sealed) {
+    *sealed = *user;
+    return seal_field(enc, user->id, "email", user->email, sealed->email, sizeof(sealed->email)) &&
+           seal_field(enc, user->id, "phone", user->phone, sealed->phone, sizeof(sealed->phone)) &&
+           seal_field(enc, user->id, "wp_phone", user->wp_phone, sealed->wp_phone,
+                      sizeof(sealed->wp_phone)) &&
+           index_values(enc, 0, user->email, user->phone, sealed->email_index,
+                        sealed->phone_index);
+}
+
+static bool open_user(EncryptedStore* enc, User* user, bool* unbound) {
+    return open_field(enc, user->id, "email", user->email, sizeof(user->email), unbound) &&
+           open_field(enc, user->id, "phone", user->phone, sizeof(user->phone), unbound) &&
+           open_field(enc, user->id, "wp_phone", user->wp_phone, sizeof(user->wp_phone), unbound);
+}
+
+// Reads every user passing deleted and phone_invalid, opened, in id
+// order. Returns a heap array, caller frees.
+static StoreResult load_users(EncryptedStore* enc, const Context* ctx, UserDeleted deleted,
+                              bool phone_invalid, User** users, int* count) {
+    UserFilter filter = {0};
+    filter.deleted = deleted;
+    filter.phone_invalid = phone_invalid;
+    filter.sort = USER_SORT_ID;
+    filter.limit = ENCRYPTED_SCAN_BATCH;
+    *users = NULL;
+    *count = 0;
+    for (;;) {
+        User* page;
+        int page_count;
+        int total;
+        StoreResult result = enc->inner->list(enc->inner, ctx, &filter, &page, &page_count, &total);
+        if (result != STORE_OK) {
+            free(*users);
+            return result;
+        }
+        *users = realloc(*users, sizeof(User) * (*count + page_count + 1));
+        for (int i = 0; i < page_count; i++) {
+            (*users)[*count] = page[i];
+            if (!open_user(enc, &(*users)[*count], NULL)) {
+                free(page);
+                free(*users);
+                return STORE_ERROR;
+            }
+            (*count)++;
+        }
+        free(page);
+        if (page_count < filter.limit) return STORE_OK;
+        filter.offset += page_count;
+    }
+}
+
+// Reads the live users who may have email (may be empty) or phone (may be
+// empty), opened, lowest id first: those the inner store finds by their
+// indexes under each key in the keyring, so that users indexed under a
+// key that was current before are found until the reseal task indexes
+// them again, and those not indexed yet. Returns a heap array, caller
+// frees; the caller still compares the values.
+static StoreResult find_candidates(EncryptedStore* enc, const Context* ctx, const char* email,
+                                   const char* phone, User** users, int* count) {
+    *users = malloc(sizeof(User));
+    *count = 0;
+    for (int key = 0; key < keyring_count(enc->keyring); key++) {
+        char email_index[BLIND_INDEX_LENGTH + 1] = "";
+        char phone_index[BLIND_INDEX_LENGTH + 1] = "";
+        if (!index_values(enc, key, email, phone, email_index, phone_index)) {
+            free(*users);
+            return STORE_ERROR;
+        }
+        // An empty email matches those not indexed yet, who are read anyway
+        if (!email[0]) email_index[0] = '\0';
+        User* found;
+        int found_count;
+        StoreResult result = enc->inner->find_by_index(enc->inner, ctx, email_index, phone_index,
+                                                       &found, &found_count);
+        if (result != STORE_OK) {
+            free(*users);
+            return result;
+        }
+
+        // Both are in id order; merged, each user once
+        User* merged = malloc(sizeof(User) * (*count + found_count + 1));
+        int merged_count = 0;
+        int i = 0;
+        int j = 0;
+        while (i < *count || j < found_count) {
+            if (j == found_count || (i < *count && (*users)[i].id < found[j].id)) {
+                merged[merged_count++] = (*users)[i++];
+            } else if (i == *count || found[j].id < (*users)[i].id) {
+                merged[merged_count++] = found[j++];
+            } else {
+                merged[merged_count++] = (*users)[i++];
+                j++;
+            }
+        }
+        free(found);
+        free(*users);
+        *users = merged;
+        *count = merged_count;
+    }
+
+    for (int i = 0; i < *count; i++) {
+        if (!open_user(enc, &(*users)[i], NULL)) {
+            free(*users);
+            return STORE_ERROR;
+        }
+    }
+    return STORE_OK;
+}
+
+static StoreResult encrypted_create(Store* store, const Context* ctx, User* user) {
+    EncryptedStore* enc = encrypted(store);
+    // The id the values are bound to is the inner store's to assign, so
+    // they go in unbound and are sealed again bound to it straight after
+    User unbound = *user;
+    unbound.id = 0;
+    unbound.wp_id = 0;
+    unbound.wp_phone[0] = '\0';
+    User sealed;
+    if (!seal_user(enc, &unbound, &sealed)) return STORE_ERROR;
+    StoreResult result = enc->inner->create(enc->inner, ctx, &sealed);
+    if (result != STORE_OK) return result;
+    // The inner store fills in the id and resets what a new user can't have
+    User created = sealed;
+    if (!open_user(enc, &created, NULL)) return STORE_ERROR;
+
+    User bound;
+    if (!seal_user(enc, &created, &bound)) return STORE_ERROR;
+    if (enc->inner->rewrite_user(enc->inner, ctx, &sealed, &bound) == STORE_OK) {
+        created = bound;
+        if (!open_user(enc, &created, NULL)) return STORE_ERROR;
+    } else {
+        // Still readable; the reseal task binds them
+        fprintf(stderr, "Cannot bind user %d's values to the user yet\n", created.id);
+    }
+    *user = created;
+    return STORE_OK;
+}
+
+static StoreResult encrypted_get(Store* store, const Context* ctx, int id, User* user) {
+    StoreResult result = inner_store(store)->get(inner_store(store), ctx, id, user);
+    if (result == STORE_OK && !open_user(encrypted(store), user, NULL)) return STORE_ERROR;
+    return result;
+}
+
+static StoreResult encrypted_list(Store* store, const Context* ctx, const UserFilter* filter,
+                                  User** users, int* count, int* total) {
+    // Ids and names aren't sealed, so the inner store can still page by them
+    if (!filter->query[0] && (filter->sort == USER_SORT_ID || filter->sort == USER_SORT_NAME)) {
+        StoreResult result = inner_store(store)->list(inner_store(store), ctx, filter, users,
+                                                      count, total);
+        for (int i = 0; result == STORE_OK && i < *count; i++) {
+            if (!open_user(encrypted(store), &(*users)[i], NULL)) {
+                free(*users);
+                result = STORE_ERROR;
+            }
+        }
+        return result;
+    }
+
+    StoreResult result = load_users(encrypted(store), ctx, filter->deleted, filter->phone_invalid,
+                                    users, total);
+    if (result != STORE_OK) return result;
+    int matched = 0;
+    for (int i = 0; i < *total; i++) {
+        if (user_filter_matches(&(*users)[i], filter)) (*users)[matched++] = (*users)[i];
+    }
+    *count = user_filter_page(*users, matched, filter);
+    *total = matched;
+    return STORE_OK;
+}
+
+static StoreResult encrypted_update(Store* store, const Context* ctx, const User* user) {
+    User stored;
+    StoreResult result = inner_store(store)->get(inner_store(store), ctx, user->id, &stored);
+    if (result != STORE_OK) return result;
+    User opened = stored;
+    if (!open_user(encrypted(store), &opened, NULL)) return STORE_ERROR;
+
+    // Unchanged values keep their sealed form, so the inner store sees that
+    // the phone is the same and keeps its flag
+    User sealed;
+    if (!seal_user(encrypted(store), user, &sealed)) return STORE_ERROR;
+    if (strcmp(user->email, opened.email) == 0) {
+        memcpy(sealed.email, stored.email, sizeof(sealed.email));
+    }
+    if (strcmp(user->phone, opened.phone) == 0) {
+        memcpy(sealed.phone, stored.phone, sizeof(sealed.phone));
+    }
+    return inner_store(store)->update(inner_store(store), ctx, &sealed);
+}
+
+static StoreResult encrypted_link_user(Store* store, const Context* ctx, int id, int wp_id,
+                                       const char* wp_phone) {
+    char sealed[sizeof(((User*)0)->wp_phone)];
+    if (!seal_field(encrypted(store), id, "wp_phone", wp_phone, sealed, sizeof(sealed))) {
+        return STORE_ERROR;
+    }
+    return inner_store(store)->link_user(inner_store(store), ctx, id, wp_id, sealed);
+}
+
+static StoreResult encrypted_flag_phone(Store* store, const Context* ctx, int id, const char* phone,
+                                        long long invalid_since, const char* reason) {
+    User stored;
+    StoreResult result = inner_store(store)->get(inner_store(store), ctx, id, &stored);
+    if (result != STORE_OK) return result;
+    char opened[sizeof(stored.phone)];
+    memcpy(opened, stored.phone, sizeof(opened));
+    if (!open_field(encrypted(store), id, "phone", opened, sizeof(opened), NULL)) {
+        return STORE_ERROR;
+    }
+    if (stored.deleted_at || strcmp(opened, phone) != 0) return STORE_NOT_FOUND;
+    // The inner store checks the phone hasn't changed since, in its sealed form
+    return inner_store(store)->flag_phone(inner_store(store), ctx, id, stored.phone,
+                                          invalid_since, reason);
+}
+
+static StoreResult encrypted_rewrite_user(Store* store, const Context* ctx, const User* from,
+                                          const User* to) {
+    User stored;
+    StoreResult result = inner_store(store)->get(inner_store(store), ctx, from->id, &stored);
+    if (result != STORE_OK) return result;
+    User opened = stored;
+    if (!open_user(encrypted(store), &opened, NULL)) return STORE_ERROR;
+    if (strcmp(opened.email, from->email) != 0 || strcmp(opened.phone, from->phone) != 0 ||
+        strcmp(opened.wp_phone, from->wp_phone) != 0) {
+        return STORE_NOT_FOUND;
+    }
+    User rewritten = *to;
+    rewritten.id = from->id;
+    User sealed;
+    if (!seal_user(encrypted(store), &rewritten, &sealed)) return STORE_ERROR;
+    return inner_store(store)->rewrite_user(inner_store(store), ctx, &stored, &sealed);
+}
+
+static StoreResult encrypted_find_duplicate(Store* store, const Context* ctx, const User* user,
+                                            User* existing) {
+    User* users;
+    int count;
+    StoreResult result = find_candidates(encrypted(store), ctx, user->email, user->phone, &users,
+                                         &count);
+    if (result != STORE_OK) return result;
+    result = STORE_NOT_FOUND;
+    for (int i = 0; i < count && result == STORE_NOT_FOUND; i++) {
+        if (users[i].id != user->id &&
+            (strcasecmp(users[i].email, user->email) == 0 ||
+             (user->phone[0] && strcmp(users[i].phone, user->phone) == 0))) {
+            *existing = users[i];
+            result = STORE_OK;
+        }
+    }
+    free(users);
+    return result;
+}
+
+static StoreResult encrypted_find_by_phone(Store* store, const Context* ctx, const char* phone,
+                                           User** users, int* count) {
+    if (!phone[0]) {
+        *users = malloc(sizeof(User));
+        *count = 0;
+        return STORE_OK;
+    }
+    int total;
+    StoreResult result = find_candidates(encrypted(store), ctx, "", phone, users, &total);
+    if (result != STORE_OK) return result;
+    *count = 0;
+    for (int i = 0; i < total; i++) {
+        if (strcmp((*users)[i].phone, phone) == 0) (*users)[(*count)++] = (*users)[i];
+    }
+    return STORE_OK;
+}
+
+static StoreResult encrypted_search_users(Store* store, const Context* ctx, const char* query,
+                                          int limit, UserMatch** matches, int* count) {
+    SearchTerm terms[USER_SEARCH_TERMS];
+    int term_count = user_search_terms(query, terms);
+    User* users;
+    int user_count;
+    StoreResult result = load_users(encrypted(store), ctx, USERS_EXCLUDE_DELETED, false, &users,
+                                    &user_count);
+    if (result != STORE_OK) return result;
+    user_search_rank(users, user_count, terms, term_count, limit, matches, count);
+    free(users);
+    return STORE_OK;
+}
+
+// Opens every user, since whether a value is bound to its user only
+// shows when it is opened
+StoreResult encrypted_store_reseal(Store* store, const Context* ctx, int* resealed) {
+    EncryptedStore* enc = encrypted(store);
+    UserFilter filter = {0};
+    filter.deleted = USERS_INCLUDE_DELETED;
+    filter.sort = USER_SORT_ID;
+    filter.limit = ENCRYPTED_SCAN_BATCH;
+    *resealed = 0;
+    for (;;) {
+        User* page;
+        int page_count;
+        int total;
+        StoreResult result = enc->inner->list(enc->inner, ctx, &filter, &page, &page_count, &total);
+        if (result != STORE_OK) return result;
+        for (int i = 0; i < page_count && result == STORE_OK; i++) {
+            const User* stored = &page[i];
+            User opened = *stored;
+            bool unbound = false;
+            User sealed;
+            if (!open_user(enc, &opened, &unbound) || !seal_user(enc, &opened, &sealed)) {
+                result = STORE_ERROR;
+                break;
+            }
+            if (!unbound &&
+                (!stored->email[0] || is_sealed_current(enc->keyring, stored->email)) &&
+                (!stored->phone[0] || is_sealed_current(enc->keyring, stored->phone)) &&
+                (!stored->wp_phone[0] || is_sealed_current(enc->keyring, stored->wp_phone)) &&
+                strcmp(stored->email_index, sealed.email_index) == 0 &&
+                strcmp(stored->phone_index, sealed.phone_index) == 0) {
+                continue;
+            }
+            // One changed since was sealed under the current key by then
+            result = enc->inner->rewrite_user(enc->inner, ctx, stored, &sealed);
+            if (result == STORE_OK) (*resealed)++;
+            if (result == STORE_NOT_FOUND) result = STORE_OK;
+        }
+        free(page);
+        if (result != STORE_OK) return result;
+        if (page_count < filter.limit) return STORE_OK;
+        filter.offset += page_count;
+    }
+}
+
+// ============= Passed Through =============
+
+static StoreResult passthrough_find_by_index(Store* store, const Context* ctx,
+                                             const char* email_index, const char* phone_index,
+                                             User** users, int* count) {
+    return inner_store(store)->find_by_index(inner_store(store), ctx, email_index, phone_index,
+                                             users, count);
+}
+
+static StoreResult passthrough_remove(Store* store, const Context* ctx, int id,
+                                      long long deleted_at) {
+    return inner_store(store)->remove(inner_store(store), ctx, id, deleted_at);
+}
+
+static StoreResult passthrough_restore(Store* store, const Context* ctx, int id) {
+    return inner_store(store)->restore(inner_store(store), ctx, id);
+}
+
+static StoreResult passthrough_purge_users(Store* store, const Context* ctx,
+                                           long long deleted_before, int* purged) {
+    return inner_store(store)->purge_users(inner_store(store), ctx, deleted_before, purged);
+}
+
+static StoreResult passthrough_erase_user(Store* store, const Context* ctx, int id) {
+    return inner_store(store)->erase_user(inner_store(store), ctx, id);
+}
+
+static StoreResult passthrough_create_entry(Store* store, const Context* ctx, ListEntry* entry) {
+    return inner_store(store)->create_entry(inner_store(store), ctx, entry);
+}
+
+static StoreResult passthrough_list_entries(Store* store, const Context* ctx, ListEntry** entries,
+                                            int* count) {
+    return inner_store(store)->list_entries(inner_store(store), ctx, entries, count);
+}
+
+static StoreResult passthrough_remove_entry(Store* store, const Context* ctx, ListName list,
+                                            int id) {
+    return inner_store(store)->remove_entry(inner_store(store), ctx, list, id);
+}
+
+static StoreResult passthrough_create_rule(Store* store, const Context* ctx, Rule* rule) {
+    return inner_store(store)->create_rule(inner_store(store), ctx, rule);
+}
+
+static StoreResult passthrough_list_rules(Store* store, const Context* ctx, Rule** rules,
+                                          int* count) {
+    return inner_store(store)->list_rules(inner_store(store), ctx, rules, count);
+}
+
+static StoreResult passthrough_update_rule(Store* store, const Context* ctx, const Rule* rule) {
+    return inner_store(store)->update_rule(inner_store(store), ctx, rule);
+}
+
+static StoreResult passthrough_remove_rule(Store* store, const Context* ctx, int id) {
+    return inner_store(store)->remove_rule(inner_store(store), ctx, id);
+}
+
+static StoreResult passthrough_create_profile(Store* store, const Context* ctx,
+                                              FormProfile* profile) {
+    return inner_store(store)->create_profile(inner_store(store), ctx, profile);
+}
+
+static StoreResult passthrough_list_profiles(Store* store, const Context* ctx,
+                                             FormProfile** profiles, int* count) {
+    return inner_store(store)->list_profiles(inner_store(store), ctx, profiles, count);
+}
+
+static StoreResult passthrough_update_profile(Store* store, const Context* ctx,
+                                              const FormProfile* profile) {
+    return inner_store(store)->update_profile(inner_store(store), ctx, profile);
+}
+
+static StoreResult passthrough_remove_profile(Store* store, const Context* ctx, int id) {
+    return inner_store(store)->remove_profile(inner_store(store), ctx, id);
+}
+
+static StoreResult passthrough_add_history(Store* store, const Context* ctx,
+                                           const HistoryRecord* records, int count) {
+    return inner_store(store)->add_history(inner_store(store), ctx, records, count);
+}
+
+static StoreResult passthrough_list_history(Store* store, const Context* ctx,
+                                            const HistoryFilter* filter, HistoryRecord** records,
+                                            int* count) {
+    return inner_store(store)->list_history(inner_store(store), ctx, filter, records, count);
+}
+
+static StoreResult passthrough_count_history(Store* store, const Context* ctx,
+                                             const HistoryFilter* filter, HistoryCounts* counts) {
+    return inner_store(store)->count_history(inner_store(store), ctx, filter, counts);
+}
+
+static StoreResult passthrough_purge_history(Store* store, const Context* ctx,
+                                             long long created_before, int* purged) {
+    return inner_store(store)->purge_history(inner_store(store), ctx, created_before, purged);
+}
+
+static StoreResult passthrough_scrub_history(Store* store, const Context* ctx,
+                                             long long created_before, int* scrubbed) {
+    return inner_store(store)->scrub_history(inner_store(store), ctx, created_before, scrubbed);
+}
+
+static StoreResult passthrough_erase_history(Store* store, const Context* ctx,
+                                             const char* number_hash, int* erased) {
+    return inner_store(store)->erase_history(inner_store(store), ctx, number_hash, erased);
+}
+
+static StoreResult passthrough_add_audit(Store* store, const Context* ctx, AuditEntry* entry) {
+    return inner_store(store)->add_audit(inner_store(store), ctx, entry);
+}
+
+static StoreResult passthrough_list_audit(Store* store, const Context* ctx,
+                                          const AuditFilter* filter,
+                                          AuditEntry** entries, int* count) {
+    return inner_store(store)->list_audit(inner_store(store), ctx, filter, entries, count);
+}
+
+static StoreResult passthrough_create_tenant(Store* store, const Context* ctx, Tenant* tenant) {
+    return inner_store(store)->create_tenant(inner_store(store), ctx, tenant);
+}
+
+static StoreResult passthrough_get_tenant(Store* store, const Context* ctx, int id,
+                                          Tenant* tenant) {
+    return inner_store(store)->get_tenant(inner_store(store), ctx, id, tenant);
+}
+
+static StoreResult passthrough_list_tenants(Store* store, const Context* ctx, Tenant** tenants,
+                                            int* count) {
+    return inner_store(store)->list_tenants(inner_store(store), ctx, tenants, count);
+}
+
+static StoreResult passthrough_update_tenant(Store* store, const Context* ctx,
+                                             const Tenant* tenant) {
+    return inner_store(store)->update_tenant(inner_store(store), ctx, tenant);
+}
+
+static StoreResult passthrough_remove_tenant(Store* store, const Context* ctx, int id) {
+    return inner_store(store)->remove_tenant(inner_store(store), ctx, id);
+}
+
+static StoreResult passthrough_add_usage(Store* store, const Context* ctx, int tenant_id,
+                                         const char* month, long long count) {
+    return inner_store(store)->add_usage(inner_store(store), ctx, tenant_id, month, count);
+}
+
+static StoreResult passthrough_get_usage(Store* store, const Context* ctx, int tenant_id,
+                                         const char* month, TenantUsage* usage) {
+    return inner_store(store)->get_usage(inner_store(store), ctx, tenant_id, month, usage);
+}
+
+static StoreResult passthrough_list_usage(Store* store, const Context* ctx, int tenant_id,
+                                          TenantUsage** usage, int* count) {
+    return inner_store(store)->list_usage(inner_store(store), ctx, tenant_id, usage, count);
+}
+
+static StoreResult passthrough_create_key(Store* store, const Context* ctx, ApiKey* key) {
+    return inner_store(store)->create_key(inner_store(store), ctx, key);
+}
+
+static StoreResult passthrough_find_key(Store* store, const Context* ctx, const char* key_hash,
+                                        ApiKey* key) {
+    return inner_store(store)->find_key(inner_store(store), ctx, key_hash, key);
+}
+
+static StoreResult passthrough_list_keys(Store* store, const Context* ctx, ApiKey** keys,
+                                         int* count) {
+    return inner_store(store)->list_keys(inner_store(store), ctx, keys, count);
+}
+
+static StoreResult passthrough_remove_key(Store* store, const Context* ctx, int id) {
+    return inner_store(store)->remove_key(inner_store(store), ctx, id);
+}
+
+static StoreResult passthrough_ping(Store* store, const Context* ctx) {
+    return inner_store(store)->ping(inner_store(store), ctx);
+}
+
+static void encrypted_close(Store* store) {
+    inner_store(store)->close(inner_store(store));
+    free(store->data);
+    free(store);
+}
+
+Store* encrypted_store_wrap(Store* inner, Keyring* keyring) {
+    EncryptedStore* enc = calloc(1, sizeof(EncryptedStore));
+    enc->inner = inner;
+    enc->keyring = keyring;
+
+    Store* store = calloc(1, sizeof(Store));
+    store->name = inner->name;
+    store->create = encrypted_create;
+    store->get = encrypted_get;
+    store->list = encrypted_list;
+    store->update = encrypted_update;
+    store->link_user = encrypted_link_user;
+    store->flag_phone = encrypted_flag_phone;
+    store->rewrite_user = encrypted_rewrite_user;
+    store->find_duplicate = encrypted_find_duplicate;
+    store->find_by_phone = encrypted_find_by_phone;
+    store->find_by_index = passthrough_find_by_index;
+    store->search_users = encrypted_search_users;
+    store->remove = passthrough_remove;
+    store->restore = passthrough_restore;
+    store->purge_users = passthrough_purge_users;
+    store->erase_user = passthrough_erase_user;
+    store->create_entry = passthrough_create_entry;
+    store->list_entries = passthrough_list_entries;
+    store->remove_entry = passthrough_remove_entry;
+    store->create_rule = passthrough_create_rule;
+    store->list_rules = passthrough_list_rules;
+    store->update_rule = passthrough_update_rule;
+    store->remove_rule = passthrough_remove_rule;
+    store->create_profile = passthrough_create_profile;
+    store->list_profiles = passthrough_list_profiles;
+    store->update_profile = passthrough_update_profile;
+    store->remove_profile = passthrough_remove_profile;
+    store->add_history = passthrough_add_history;
+    store->list_history = passthrough_list_history;
+    store->count_history = passthrough_count_history;
+    store->purge_history = passthrough_purge_history;
+    store->scrub_history = passthrough_scrub_history;
+    store->erase_history = passthrough_erase_history;
+    store->add_audit = passthrough_add_audit;
+    store->list_audit = passthrough_list_audit;
+    store->create_tenant = passthrough_create_tenant;
+    store->get_tenant = passthrough_get_tenant;
+    store->list_tenants = passthrough_list_tenants;
+    store->update_tenant = passthrough_update_tenant;
+    store->remove_tenant = passthrough_remove_tenant;
+    store->add_usage = passthrough_add_usage;
+    store->get_usage = passthrough_get_usage;
+    store->list_usage = passthrough_list_usage;
+    store->create_key = passthrough_create_key;
+    store->find_key = passthrough_find_key;
+    store->list_keys = passthrough_list_keys;
+    store->remove_key = passthrough_remove_key;
+    store->ping = passthrough_ping;
+    store->close = encrypted_close;
+    store->data = enc;
+    return store;
+}
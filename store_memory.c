@@ -0,0 +1,953 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <strings.h>
+#include <pthread.h>
+
+#include "store.h"
+
+// Oldest validation history is dropped beyond this many records
+#define MEMORY_HISTORY_LIMIT 100000
+
+// In-memory store, contents are lost on restart. Connections are served
+// on separate threads, so every operation holds the lock.
+typedef struct {
+    User* users;
+    int count;
+    int capacity;
+    int next_id;
+    ListEntry* entries;
+    int entry_count;
+    int entry_capacity;
+    int next_entry_id;
+    Rule* rules;                // Kept in position order
+    int rule_count;
+    int rule_capacity;
+    int next_rule_id;
+    FormProfile* profiles;
+    int profile_count;
+    int profile_capacity;
+    int next_profile_id;
+    ApiKey* keys;
+    int key_count;
+    int key_capacity;
+    int next_key_id;
+    Tenant* tenants;
+    int tenant_count;
+    int tenant_capacity;
+    int next_tenant_id;
+    TenantUsage* usage;         // Ordered by month, then tenant
+    int usage_count;
+    int usage_capacity;
+    HistoryRecord* history;     // Ring buffer, history_start is the oldest
+    int history_count;
+    int history_capacity;
+    int history_start;
+    int next_history_id;
+    AuditEntry* audit;          // Oldest first
+    int audit_count;
+    int audit_capacity;
+    pthread_mutex_t lock;
+} MemoryStore;
+
+static int find_index(MemoryStore* mem, int id) {
+    for (int i = 0; i < mem->count; i++) {
+        if (mem->users[i].id == id) return i;
+    }
+    return -1;
+}
+
+static StoreResult memory_create(Store* store, const Context* ctx, User* user) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    if (mem->count == mem->capacity) {
+        mem->capacity = mem->capacity ? mem->capacity * 2 : 16;
+        mem->users = realloc(mem->users, sizeof(User) * mem->capacity);
+    }
+    user->id = mem->next_id++;
+    user->deleted_at = 0;
+    user->wp_id = 0;
+    user->wp_phone[0] = '\0';
+    user->phone_invalid_since = 0;
+    user->phone_invalid_reason[0] = '\0';
+    mem->users[mem->count++] = *user;
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static StoreResult memory_get(Store* store, const Context* ctx, int id, User* user) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    int index = find_index(mem, id);
+    if (index >= 0) {
+        *user = mem->users[index];
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return index < 0 ? STORE_NOT_FOUND : STORE_OK;
+}
+
+static StoreResult memory_list(Store* store, const Context* ctx, const UserFilter* filter,
+                               User** users, int* count, int* total) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    *users = malloc(sizeof(User) * (mem->count > 0 ? mem->count : 1));
+    int matched = 0;
+    for (int i = 0; i < mem->count; i++) {
+        if (user_filter_matches(&mem->users[i], filter)) {
+            (*users)[matched++] = mem->users[i];
+        }
+    }
+    pthread_mutex_unlock(&mem->lock);
+
+    *count = user_filter_page(*users, matched, filter);
+    *total = matched;
+    return STORE_OK;
+}
+
+static StoreResult memory_find_duplicate(Store* store, const Context* ctx, const User* user,
+                                         User* existing) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    int index = -1;
+    for (int i = 0; i < mem->count && index < 0; i++) {
+        const User* other = &mem->users[i];
+        if (other->id != user->id && !other->deleted_at &&
+            (strcasecmp(other->email, user->email) == 0 ||
+             (user->phone[0] && strcmp(other->phone, user->phone) == 0))) {
+            index = i;
+        }
+    }
+    if (index >= 0) {
+        *existing = mem->users[index];
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return index < 0 ? STORE_NOT_FOUND : STORE_OK;
+}
+
+static StoreResult memory_find_by_phone(Store* store, const Context* ctx, const char* phone,
+                                        User** users, int* count) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    *users = malloc(sizeof(User) * (mem->count > 0 ? mem->count : 1));
+    *count = 0;
+    // Users are kept in id order
+    for (int i = 0; i < mem->count; i++) {
+        if (!mem->users[i].deleted_at && phone[0] && strcmp(mem->users[i].phone, phone) == 0) {
+            (*users)[(*count)++] = mem->users[i];
+        }
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static StoreResult memory_find_by_index(Store* store, const Context* ctx,
+                                        const char* email_index, const char* phone_index,
+                                        User** users, int* count) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    *users = malloc(sizeof(User) * (mem->count > 0 ? mem->count : 1));
+    *count = 0;
+    // Users are kept in id order
+    for (int i = 0; i < mem->count; i++) {
+        const User* user = &mem->users[i];
+        if (!user->deleted_at &&
+            (!user->email_index[0] || strcmp(user->email_index, email_index) == 0 ||
+             (phone_index[0] && strcmp(user->phone_index, phone_index) == 0))) {
+            (*users)[(*count)++] = *user;
+        }
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+// Scans every user; the ranking drops soft deleted ones
+static StoreResult memory_search_users(Store* store, const Context* ctx, const char* query,
+                                       int limit, UserMatch** matches, int* count) {
+    SearchTerm terms[USER_SEARCH_TERMS];
+    int term_count = user_search_terms(query, terms);
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    user_search_rank(mem->users, mem->count, terms, term_count, limit, matches, count);
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static StoreResult memory_update(Store* store, const Context* ctx, const User* user) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    int index = find_index(mem, user->id);
+    if (index >= 0 && mem->users[index].deleted_at) index = -1;
+    if (index >= 0) {
+        User updated = *user;
+        updated.deleted_at = 0;
+        updated.wp_id = mem->users[index].wp_id;
+        memcpy(updated.wp_phone, mem->users[index].wp_phone, sizeof(updated.wp_phone));
+        bool same_phone = strcmp(updated.phone, mem->users[index].phone) == 0;
+        updated.phone_invalid_since = same_phone ? mem->users[index].phone_invalid_since : 0;
+        snprintf(updated.phone_invalid_reason, sizeof(updated.phone_invalid_reason), "%s",
+                 same_phone ? mem->users[index].phone_invalid_reason : "");
+        mem->users[index] = updated;
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return index < 0 ? STORE_NOT_FOUND : STORE_OK;
+}
+
+static StoreResult memory_link_user(Store* store, const Context* ctx, int id, int wp_id,
+                                    const char* wp_phone) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    int index = find_index(mem, id);
+    if (index >= 0 && mem->users[index].deleted_at) index = -1;
+    if (index >= 0) {
+        mem->users[index].wp_id = wp_id;
+        snprintf(mem->users[index].wp_phone, sizeof(mem->users[index].wp_phone), "%s", wp_phone);
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return index < 0 ? STORE_NOT_FOUND : STORE_OK;
+}
+
+static StoreResult memory_flag_phone(Store* store, const Context* ctx, int id, const char* phone,
+                                     long long invalid_since, const char* reason) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    int index = find_index(mem, id);
+    if (index >= 0 && (mem->users[index].deleted_at || strcmp(mem->users[index].phone, phone) != 0)) {
+        index = -1;
+    }
+    if (index >= 0) {
+        User* user = &mem->users[index];
+        user->phone_invalid_since = invalid_since;
+        snprintf(user->phone_invalid_reason, sizeof(user->phone_invalid_reason), "%s", reason);
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return index < 0 ? STORE_NOT_FOUND : STORE_OK;
+}
+
+static StoreResult memory_rewrite_user(Store* store, const Context* ctx, const User* from,
+                                       const User* to) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    int index = find_index(mem, from->id);
+    if (index >= 0) {
+        User* user = &mem->users[index];
+        if (strcmp(user->email, from->email) != 0 || strcmp(user->phone, from->phone) != 0 ||
+            strcmp(user->wp_phone, from->wp_phone) != 0) {
+            index = -1;
+        } else {
+            memcpy(user->email, to->email, sizeof(user->email));
+            memcpy(user->phone, to->phone, sizeof(user->phone));
+            memcpy(user->wp_phone, to->wp_phone, sizeof(user->wp_phone));
+            memcpy(user->email_index, to->email_index, sizeof(user->email_index));
+            memcpy(user->phone_index, to->phone_index, sizeof(user->phone_index));
+        }
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return index < 0 ? STORE_NOT_FOUND : STORE_OK;
+}
+
+static StoreResult memory_remove(Store* store, const Context* ctx, int id, long long deleted_at) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    int index = find_index(mem, id);
+    if (index >= 0 && mem->users[index].deleted_at) index = -1;
+    if (index >= 0) {
+        mem->users[index].deleted_at = deleted_at;
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return index < 0 ? STORE_NOT_FOUND : STORE_OK;
+}
+
+static StoreResult memory_restore(Store* store, const Context* ctx, int id) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    int index = find_index(mem, id);
+    if (index >= 0 && !mem->users[index].deleted_at) index = -1;
+    if (index >= 0) {
+        mem->users[index].deleted_at = 0;
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return index < 0 ? STORE_NOT_FOUND : STORE_OK;
+}
+
+static StoreResult memory_purge_users(Store* store, const Context* ctx, long long deleted_before,
+                                      int* purged) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    int kept = 0;
+    for (int i = 0; i < mem->count; i++) {
+        const User* user = &mem->users[i];
+        if (!user->deleted_at || user->deleted_at >= deleted_before) {
+            mem->users[kept++] = *user;
+        }
+    }
+    *purged = mem->count - kept;
+    mem->count = kept;
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static StoreResult memory_erase_user(Store* store, const Context* ctx, int id) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    int index = find_index(mem, id);
+    if (index >= 0) {
+        // Users are kept in id order
+        memmove(&mem->users[index], &mem->users[index + 1],
+                sizeof(User) * (mem->count - index - 1));
+        mem->count--;
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return index < 0 ? STORE_NOT_FOUND : STORE_OK;
+}
+
+static StoreResult memory_create_entry(Store* store, const Context* ctx, ListEntry* entry) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    if (mem->entry_count == mem->entry_capacity) {
+        mem->entry_capacity = mem->entry_capacity ? mem->entry_capacity * 2 : 16;
+        mem->entries = realloc(mem->entries, sizeof(ListEntry) * mem->entry_capacity);
+    }
+    entry->id = mem->next_entry_id++;
+    mem->entries[mem->entry_count++] = *entry;
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static StoreResult memory_list_entries(Store* store, const Context* ctx, ListEntry** entries,
+                                       int* count) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    *entries = malloc(sizeof(ListEntry) * (mem->entry_count > 0 ? mem->entry_count : 1));
+    memcpy(*entries, mem->entries, sizeof(ListEntry) * mem->entry_count);
+    *count = mem->entry_count;
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static StoreResult memory_remove_entry(Store* store, const Context* ctx, ListName list, int id) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    int index = -1;
+    for (int i = 0; i < mem->entry_count; i++) {
+        if (mem->entries[i].id == id && mem->entries[i].list == list) {
+            index = i;
+            break;
+        }
+    }
+    if (index >= 0) {
+        memmove(&mem->entries[index], &mem->entries[index + 1],
+                sizeof(ListEntry) * (mem->entry_count - index - 1));
+        mem->entry_count--;
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return index < 0 ? STORE_NOT_FOUND : STORE_OK;
+}
+
+static int find_rule_index(MemoryStore* mem, int id) {
+    for (int i = 0; i < mem->rule_count; i++) {
+        if (mem->rules[i].id == id) return i;
+    }
+    return -1;
+}
+
+// Moves the rule at index to its place by position, then id, in an
+// otherwise ordered array
+static void place_rule(MemoryStore* mem, int index) {
+    Rule rule = mem->rules[index];
+    memmove(&mem->rules[index], &mem->rules[index + 1], sizeof(Rule) * (mem->rule_count - index - 1));
+    int to = 0;
+    while (to < mem->rule_count - 1 &&
+           (mem->rules[to].position < rule.position ||
+            (mem->rules[to].position == rule.position && mem->rules[to].id < rule.id))) {
+        to++;
+    }
+    memmove(&mem->rules[to + 1], &mem->rules[to], sizeof(Rule) * (mem->rule_count - 1 - to));
+    mem->rules[to] = rule;
+}
+
+static StoreResult memory_create_rule(Store* store, const Context* ctx, Rule* rule) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    if (mem->rule_count == mem->rule_capacity) {
+        mem->rule_capacity = mem->rule_capacity ? mem->rule_capacity * 2 : 16;
+        mem->rules = realloc(mem->rules, sizeof(Rule) * mem->rule_capacity);
+    }
+    rule->id = mem->next_rule_id++;
+    mem->rules[mem->rule_count++] = *rule;
+    place_rule(mem, mem->rule_count - 1);
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static StoreResult memory_list_rules(Store* store, const Context* ctx, Rule** rules, int* count) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    *rules = malloc(sizeof(Rule) * (mem->rule_count > 0 ? mem->rule_count : 1));
+    memcpy(*rules, mem->rules, sizeof(Rule) * mem->rule_count);
+    *count = mem->rule_count;
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static StoreResult memory_update_rule(Store* store, const Context* ctx, const Rule* rule) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    int index = find_rule_index(mem, rule->id);
+    if (index >= 0) {
+        mem->rules[index] = *rule;
+        place_rule(mem, index);
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return index < 0 ? STORE_NOT_FOUND : STORE_OK;
+}
+
+static StoreResult memory_remove_rule(Store* store, const Context* ctx, int id) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    int index = find_rule_index(mem, id);
+    if (index >= 0) {
+        memmove(&mem->rules[index], &mem->rules[index + 1],
+                sizeof(Rule) * (mem->rule_count - index - 1));
+        mem->rule_count--;
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return index < 0 ? STORE_NOT_FOUND : STORE_OK;
+}
+
+static int find_profile_index(MemoryStore* mem, int id) {
+    for (int i = 0; i < mem->profile_count; i++) {
+        if (mem->profiles[i].id == id) return i;
+    }
+    return -1;
+}
+
+static StoreResult memory_create_profile(Store* store, const Context* ctx, FormProfile* profile) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    if (mem->profile_count == mem->profile_capacity) {
+        mem->profile_capacity = mem->profile_capacity ? mem->profile_capacity * 2 : 16;
+        mem->profiles = realloc(mem->profiles, sizeof(FormProfile) * mem->profile_capacity);
+    }
+    profile->id = mem->next_profile_id++;
+    mem->profiles[mem->profile_count++] = *profile;
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static StoreResult memory_list_profiles(Store* store, const Context* ctx, FormProfile** profiles,
+                                        int* count) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    *profiles = malloc(sizeof(FormProfile) * (mem->profile_count > 0 ? mem->profile_count : 1));
+    memcpy(*profiles, mem->profiles, sizeof(FormProfile) * mem->profile_count);
+    *count = mem->profile_count;
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static StoreResult memory_update_profile(Store* store, const Context* ctx,
+                                         const FormProfile* profile) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    int index = find_profile_index(mem, profile->id);
+    if (index >= 0) mem->profiles[index] = *profile;
+    pthread_mutex_unlock(&mem->lock);
+    return index < 0 ? STORE_NOT_FOUND : STORE_OK;
+}
+
+static StoreResult memory_remove_profile(Store* store, const Context* ctx, int id) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    int index = find_profile_index(mem, id);
+    if (index >= 0) {
+        memmove(&mem->profiles[index], &mem->profiles[index + 1],
+                sizeof(FormProfile) * (mem->profile_count - index - 1));
+        mem->profile_count--;
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return index < 0 ? STORE_NOT_FOUND : STORE_OK;
+}
+
+static StoreResult memory_create_key(Store* store, const Context* ctx, ApiKey* key) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    if (mem->key_count == mem->key_capacity) {
+        mem->key_capacity = mem->key_capacity ? mem->key_capacity * 2 : 16;
+        mem->keys = realloc(mem->keys, sizeof(ApiKey) * mem->key_capacity);
+    }
+    key->id = mem->next_key_id++;
+    mem->keys[mem->key_count++] = *key;
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static StoreResult memory_find_key(Store* store, const Context* ctx, const char* key_hash,
+                                   ApiKey* key) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    bool found = false;
+    for (int i = 0; i < mem->key_count && !found; i++) {
+        if (strcmp(mem->keys[i].key_hash, key_hash) == 0) {
+            *key = mem->keys[i];
+            found = true;
+        }
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return found ? STORE_OK : STORE_NOT_FOUND;
+}
+
+static StoreResult memory_list_keys(Store* store, const Context* ctx, ApiKey** keys, int* count) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    *keys = malloc(sizeof(ApiKey) * (mem->key_count > 0 ? mem->key_count : 1));
+    memcpy(*keys, mem->keys, sizeof(ApiKey) * mem->key_count);
+    *count = mem->key_count;
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static StoreResult memory_remove_key(Store* store, const Context* ctx, int id) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    int index = -1;
+    for (int i = 0; i < mem->key_count; i++) {
+        if (mem->keys[i].id == id) {
+            index = i;
+            break;
+        }
+    }
+    if (index >= 0) {
+        memmove(&mem->keys[index], &mem->keys[index + 1],
+                sizeof(ApiKey) * (mem->key_count - index - 1));
+        mem->key_count--;
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return index < 0 ? STORE_NOT_FOUND : STORE_OK;
+}
+
+static StoreResult memory_add_history(Store* store, const Context* ctx,
+                                      const HistoryRecord* records, int count) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    for (int i = 0; i < count; i++) {
+        // Grow until the limit, then overwrite the oldest
+        if (mem->history_count == mem->history_capacity &&
+            mem->history_capacity < MEMORY_HISTORY_LIMIT) {
+            int capacity = mem->history_capacity ? mem->history_capacity * 2 : 256;
+            if (capacity > MEMORY_HISTORY_LIMIT) capacity = MEMORY_HISTORY_LIMIT;
+            mem->history = realloc(mem->history, sizeof(HistoryRecord) * capacity);
+            mem->history_capacity = capacity;
+        }
+
+        int slot;
+        if (mem->history_count < mem->history_capacity) {
+            slot = mem->history_count++;
+        } else {
+            slot = mem->history_start;
+            mem->history_start = (mem->history_start + 1) % mem->history_capacity;
+        }
+        mem->history[slot] = records[i];
+        mem->history[slot].id = mem->next_history_id++;
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static bool history_matches(const HistoryFilter* filter, const HistoryRecord* record) {
+    if (filter->from && record->timestamp < filter->from) return false;
+    if (filter->to && record->timestamp >= filter->to) return false;
+    if (filter->caller[0] && strcmp(filter->caller, record->caller) != 0) return false;
+    if (filter->result[0] && strcmp(filter->result, record->result) != 0) return false;
+    if (filter->number_hash[0] && strcmp(filter->number_hash, record->number_hash) != 0) return false;
+    if (filter->tenant_id && filter->tenant_id != record->tenant_id) return false;
+    return true;
+}
+
+static StoreResult memory_list_history(Store* store, const Context* ctx,
+                                       const HistoryFilter* filter,
+                                       HistoryRecord** records, int* count) {
+    MemoryStore* mem = store->data;
+    *records = malloc(sizeof(HistoryRecord) * (filter->limit > 0 ? filter->limit : 1));
+    *count = 0;
+
+    pthread_mutex_lock(&mem->lock);
+    int skipped = 0;
+    for (int i = mem->history_count - 1; i >= 0 && *count < filter->limit; i--) {
+        const HistoryRecord* record = &mem->history[(mem->history_start + i) % mem->history_capacity];
+        if (!history_matches(filter, record)) continue;
+        if (skipped < filter->offset) {
+            skipped++;
+            continue;
+        }
+        (*records)[(*count)++] = *record;
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+// Keeps the records made from created_before on, oldest first, so the ring
+// starts over at the front of the array
+static StoreResult memory_purge_history(Store* store, const Context* ctx,
+                                        long long created_before, int* purged) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    int capacity = mem->history_capacity ? mem->history_capacity : 1;
+    HistoryRecord* kept = malloc(sizeof(HistoryRecord) * capacity);
+    int count = 0;
+    for (int i = 0; i < mem->history_count; i++) {
+        const HistoryRecord* record = &mem->history[(mem->history_start + i) % mem->history_capacity];
+        if (record->timestamp >= created_before) kept[count++] = *record;
+    }
+    free(mem->history);
+    mem->history = kept;
+    *purged = mem->history_count - count;
+    mem->history_count = count;
+    mem->history_start = 0;
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static StoreResult memory_scrub_history(Store* store, const Context* ctx,
+                                        long long created_before, int* scrubbed) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    *scrubbed = 0;
+    for (int i = 0; i < mem->history_count; i++) {
+        HistoryRecord* record = &mem->history[(mem->history_start + i) % mem->history_capacity];
+        if (record->timestamp < created_before && record->number_hash[0]) {
+            record->number_hash[0] = '\0';
+            (*scrubbed)++;
+        }
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+// Keeps the other records, oldest first, as purge_history does
+static StoreResult memory_erase_history(Store* store, const Context* ctx, const char* number_hash,
+                                        int* erased) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    int capacity = mem->history_capacity ? mem->history_capacity : 1;
+    HistoryRecord* kept = malloc(sizeof(HistoryRecord) * capacity);
+    int count = 0;
+    for (int i = 0; i < mem->history_count; i++) {
+        const HistoryRecord* record = &mem->history[(mem->history_start + i) % mem->history_capacity];
+        if (strcmp(record->number_hash, number_hash) != 0) kept[count++] = *record;
+    }
+    free(mem->history);
+    mem->history = kept;
+    *erased = mem->history_count - count;
+    mem->history_count = count;
+    mem->history_start = 0;
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static StoreResult memory_count_history(Store* store, const Context* ctx,
+                                        const HistoryFilter* filter, HistoryCounts* counts) {
+    MemoryStore* mem = store->data;
+    memset(counts, 0, sizeof(*counts));
+    pthread_mutex_lock(&mem->lock);
+    for (int i = 0; i < mem->history_count; i++) {
+        const HistoryRecord* record = &mem->history[i];
+        if (!history_matches(filter, record)) continue;
+        if (strcmp(record->result, "valid") == 0) {
+            counts->valid++;
+        } else if (strcmp(record->result, "blocked") == 0) {
+            counts->blocked++;
+        } else {
+            counts->invalid++;
+        }
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static StoreResult memory_add_audit(Store* store, const Context* ctx, AuditEntry* entry) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    if (mem->audit_count == mem->audit_capacity) {
+        mem->audit_capacity = mem->audit_capacity ? mem->audit_capacity * 2 : 64;
+        mem->audit = realloc(mem->audit, sizeof(AuditEntry) * mem->audit_capacity);
+    }
+    entry->id = mem->audit_count + 1;
+    mem->audit[mem->audit_count++] = *entry;
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static bool audit_matches(const AuditFilter* filter, const AuditEntry* entry) {
+    if (filter->from && entry->timestamp < filter->from) return false;
+    if (filter->to && entry->timestamp >= filter->to) return false;
+    if (filter->actor[0] && strcmp(filter->actor, entry->actor) != 0) return false;
+    if (filter->action[0] && strcmp(filter->action, entry->action) != 0) {
+        // "rule" matches "rule.create"
+        size_t length = strlen(filter->action);
+        if (strchr(filter->action, '.') || strncmp(filter->action, entry->action, length) != 0 ||
+            entry->action[length] != '.') {
+            return false;
+        }
+    }
+    if (filter->target[0] && strcmp(filter->target, entry->target) != 0) return false;
+    if (filter->tenant_id && filter->tenant_id != entry->tenant_id) return false;
+    return true;
+}
+
+static StoreResult memory_list_audit(Store* store, const Context* ctx, const AuditFilter* filter,
+                                     AuditEntry** entries, int* count) {
+    MemoryStore* mem = store->data;
+    *entries = malloc(sizeof(AuditEntry) * (filter->limit > 0 ? filter->limit : 1));
+    *count = 0;
+
+    pthread_mutex_lock(&mem->lock);
+    int skipped = 0;
+    for (int i = mem->audit_count - 1; i >= 0 && *count < filter->limit; i--) {
+        if (!audit_matches(filter, &mem->audit[i])) continue;
+        if (skipped < filter->offset) {
+            skipped++;
+            continue;
+        }
+        (*entries)[(*count)++] = mem->audit[i];
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static int find_tenant_index(MemoryStore* mem, int id) {
+    for (int i = 0; i < mem->tenant_count; i++) {
+        if (mem->tenants[i].id == id) return i;
+    }
+    return -1;
+}
+
+static StoreResult memory_create_tenant(Store* store, const Context* ctx, Tenant* tenant) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    if (mem->tenant_count == mem->tenant_capacity) {
+        mem->tenant_capacity = mem->tenant_capacity ? mem->tenant_capacity * 2 : 16;
+        mem->tenants = realloc(mem->tenants, sizeof(Tenant) * mem->tenant_capacity);
+    }
+    tenant->id = mem->next_tenant_id++;
+    mem->tenants[mem->tenant_count++] = *tenant;
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static StoreResult memory_get_tenant(Store* store, const Context* ctx, int id, Tenant* tenant) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    int index = find_tenant_index(mem, id);
+    if (index >= 0) *tenant = mem->tenants[index];
+    pthread_mutex_unlock(&mem->lock);
+    return index < 0 ? STORE_NOT_FOUND : STORE_OK;
+}
+
+static StoreResult memory_list_tenants(Store* store, const Context* ctx, Tenant** tenants,
+                                       int* count) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    *tenants = malloc(sizeof(Tenant) * (mem->tenant_count > 0 ? mem->tenant_count : 1));
+    memcpy(*tenants, mem->tenants, sizeof(Tenant) * mem->tenant_count);
+    *count = mem->tenant_count;
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static StoreResult memory_update_tenant(Store* store, const Context* ctx, const Tenant* tenant) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    int index = find_tenant_index(mem, tenant->id);
+    if (index >= 0) {
+        long long created_at = mem->tenants[index].created_at;
+        mem->tenants[index] = *tenant;
+        mem->tenants[index].created_at = created_at;
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return index < 0 ? STORE_NOT_FOUND : STORE_OK;
+}
+
+static StoreResult memory_remove_tenant(Store* store, const Context* ctx, int id) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    int index = find_tenant_index(mem, id);
+    if (index >= 0) {
+        memmove(&mem->tenants[index], &mem->tenants[index + 1],
+                sizeof(Tenant) * (mem->tenant_count - index - 1));
+        mem->tenant_count--;
+
+        // Compact what belonged to it, keeping the order
+        int kept = 0;
+        for (int i = 0; i < mem->key_count; i++) {
+            if (mem->keys[i].tenant_id != id) mem->keys[kept++] = mem->keys[i];
+        }
+        mem->key_count = kept;
+        kept = 0;
+        for (int i = 0; i < mem->entry_count; i++) {
+            if (mem->entries[i].tenant_id != id) mem->entries[kept++] = mem->entries[i];
+        }
+        mem->entry_count = kept;
+        kept = 0;
+        for (int i = 0; i < mem->rule_count; i++) {
+            if (mem->rules[i].tenant_id != id) mem->rules[kept++] = mem->rules[i];
+        }
+        mem->rule_count = kept;
+        kept = 0;
+        for (int i = 0; i < mem->profile_count; i++) {
+            if (mem->profiles[i].tenant_id != id) mem->profiles[kept++] = mem->profiles[i];
+        }
+        mem->profile_count = kept;
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return index < 0 ? STORE_NOT_FOUND : STORE_OK;
+}
+
+// Where the counter for tenant_id and month is, or would go to keep the order
+static int find_usage_index(MemoryStore* mem, int tenant_id, const char* month, bool* found) {
+    int i = 0;
+    while (i < mem->usage_count) {
+        int order = strcmp(mem->usage[i].month, month);
+        if (order > 0 || (order == 0 && mem->usage[i].tenant_id >= tenant_id)) break;
+        i++;
+    }
+    *found = i < mem->usage_count && mem->usage[i].tenant_id == tenant_id &&
+             strcmp(mem->usage[i].month, month) == 0;
+    return i;
+}
+
+static StoreResult memory_add_usage(Store* store, const Context* ctx, int tenant_id,
+                                    const char* month, long long count) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    bool found;
+    int index = find_usage_index(mem, tenant_id, month, &found);
+    if (!found) {
+        if (mem->usage_count == mem->usage_capacity) {
+            mem->usage_capacity = mem->usage_capacity ? mem->usage_capacity * 2 : 16;
+            mem->usage = realloc(mem->usage, sizeof(TenantUsage) * mem->usage_capacity);
+        }
+        memmove(&mem->usage[index + 1], &mem->usage[index],
+                sizeof(TenantUsage) * (mem->usage_count - index));
+        mem->usage_count++;
+        TenantUsage* usage = &mem->usage[index];
+        memset(usage, 0, sizeof(*usage));
+        usage->tenant_id = tenant_id;
+        snprintf(usage->month, sizeof(usage->month), "%s", month);
+    }
+    mem->usage[index].validations += count;
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static StoreResult memory_get_usage(Store* store, const Context* ctx, int tenant_id,
+                                    const char* month, TenantUsage* usage) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    bool found;
+    int index = find_usage_index(mem, tenant_id, month, &found);
+    usage->tenant_id = tenant_id;
+    snprintf(usage->month, sizeof(usage->month), "%s", month);
+    usage->validations = found ? mem->usage[index].validations : 0;
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static StoreResult memory_list_usage(Store* store, const Context* ctx, int tenant_id,
+                                     TenantUsage** usage, int* count) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_lock(&mem->lock);
+    *usage = malloc(sizeof(TenantUsage) * (mem->usage_count > 0 ? mem->usage_count : 1));
+    *count = 0;
+    for (int i = 0; i < mem->usage_count; i++) {
+        if (tenant_id == 0 || mem->usage[i].tenant_id == tenant_id) {
+            (*usage)[(*count)++] = mem->usage[i];
+        }
+    }
+    pthread_mutex_unlock(&mem->lock);
+    return STORE_OK;
+}
+
+static StoreResult memory_ping(Store* store, const Context* ctx) {
+    return STORE_OK;
+}
+
+static void memory_close(Store* store) {
+    MemoryStore* mem = store->data;
+    pthread_mutex_destroy(&mem->lock);
+    free(mem->users);
+    free(mem->entries);
+    free(mem->rules);
+    free(mem->profiles);
+    free(mem->keys);
+    free(mem->tenants);
+    free(mem->usage);
+    free(mem->history);
+    free(mem->audit);
+    free(mem);
+    free(store);
+}
+
+Store* memory_store_open(void) {
+    MemoryStore* mem = calloc(1, sizeof(MemoryStore));
+    mem->next_id = 1;
+    mem->next_entry_id = 1;
+    mem->next_rule_id = 1;
+    mem->next_profile_id = 1;
+    mem->next_key_id = 1;
+    mem->next_tenant_id = 1;
+    mem->next_history_id = 1;
+    pthread_mutex_init(&mem->lock, NULL);
+
+    Store* store = calloc(1, sizeof(Store));
+    store->name = "memory";
+    store->create = memory_create;
+    store->get = memory_get;
+    store->list = memory_list;
+    store->update = memory_update;
+    store->link_user = memory_link_user;
+    store->flag_phone = memory_flag_phone;
+    store->rewrite_user = memory_rewrite_user;
+    store->find_duplicate = memory_find_duplicate;
+    store->find_by_phone = memory_find_by_phone;
+    store->find_by_index = memory_find_by_index;
+    store->search_users = memory_search_users;
+    store->remove = memory_remove;
+    store->restore = memory_restore;
+    store->purge_users = memory_purge_users;
+    store->erase_user = memory_erase_user;
+    store->create_entry = memory_create_entry;
+    store->list_entries = memory_list_entries;
+    store->remove_entry = memory_remove_entry;
+    store->create_rule = memory_create_rule;
+    store->list_rules = memory_list_rules;
+    store->update_rule = memory_update_rule;
+    store->remove_rule = memory_remove_rule;
+    store->create_profile = memory_create_profile;
+    store->list_profiles = memory_list_profiles;
+    store->update_profile = memory_update_profile;
+    store->remove_profile = memory_remove_profile;
+    store->create_key = memory_create_key;
+    store->find_key = memory_find_key;
+    store->list_keys = memory_list_keys;
+    store->remove_key = memory_remove_key;
+    store->add_history = memory_add_history;
+    store->list_history = memory_list_history;
+    store->count_history = memory_count_history;
+    store->purge_history = memory_purge_history;
+    store->scrub_history = memory_scrub_history;
+    store->erase_history = memory_erase_history;
+    store->add_audit = memory_add_audit;
+    store->list_audit = memory_list_audit;
+    store->create_tenant = memory_create_tenant;
+    store->get_tenant = memory_get_tenant;
+    store->list_tenants = memory_list_tenants;
+    store->update_tenant = memory_update_tenant;
+    store->remove_tenant = memory_remove_tenant;
+    store->add_usage = memory_add_usage;
+    store->get_usage = memory_get_usage;
+    store->list_usage = memory_list_usage;
+    store->ping = memory_ping;
+    store->close = memory_close;
+    store->data = mem;
+    return store;
+}
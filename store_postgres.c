@@ -0,0 +1,1376 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+#include <poll.h>
+#include <pthread.h>
+#include <libpq-fe.h>
+
+#include "store.h"
+
+// migrations/postgres/, see migrate.h
+static const Migration migrations[] = {
+#include "migrations/postgres.inc"
+};
+
+// Arbitrary key so replicas starting together migrate one at a time
+#define MIGRATION_LOCK_KEY 727001
+
+// $1 is the query as a LIKE pattern, '' to match everyone, $2 a
+// UserDeleted and $3 whether only flagged phones count
+#define USER_FILTER_WHERE \
+    "WHERE ($1 = '' OR name ILIKE $1 OR email ILIKE $1 OR phone ILIKE $1) " \
+    "AND ($2::integer = 1 OR (deleted_at <> 0) = ($2::integer = 2)) " \
+    "AND (NOT $3::boolean OR phone_invalid_since <> 0)"
+// In the order read_user() reads them
+#define USER_COLUMNS \
+    "id, name, email, phone, deleted_at, wp_id, wp_phone, phone_invalid_since, phone_invalid_reason, " \
+    "email_index, phone_index"
+// $1 to $6 are the from, to, caller, result, number hash and tenant of a HistoryFilter
+#define HISTORY_FILTER_WHERE \
+    "WHERE created_at >= $1 AND ($2::bigint = 0 OR created_at < $2) AND ($3 = '' OR caller = $3) " \
+    "AND ($4 = '' OR result = $4) AND ($5 = '' OR number_hash = $5) " \
+    "AND ($6::integer = 0 OR tenant_id = $6)"
+// What the users_search trigram index holds, for search_users
+#define USER_SEARCH_TEXT "lower(name || ' ' || email || ' ' || phone)"
+// In the order read_tenant() reads them
+#define TENANT_COLUMNS \
+    "id, name, rate_limit, rate_burst, created_at, monthly_quota, suspended, stripe_customer, " \
+    "billing_updated_at"
+#define USER_SORT_COLUMN \
+    "CASE $4 WHEN 'name' THEN lower(name) WHEN 'email' THEN lower(email) WHEN 'phone' THEN phone END"
+
+// Prepared on every pooled connection
+static const struct {
+    const char* name;
+    const char* sql;
+    int param_count;
+} statements[] = {
+    {"user_create", "INSERT INTO users (name, email, phone, email_index, phone_index) "
+                    "VALUES ($1, $2, $3, $4, $5) RETURNING id", 5},
+    {"user_get", "SELECT " USER_COLUMNS " FROM users WHERE id = $1", 1},
+    // $4 is a user_sort_string() and $5 whether to sort descending;
+    // ORDER BY can't take a column as a parameter, so CASE picks it
+    {"user_list", "SELECT " USER_COLUMNS " FROM users " USER_FILTER_WHERE " ORDER BY "
+                  "CASE WHEN NOT $5::boolean THEN " USER_SORT_COLUMN " END ASC, "
+                  "CASE WHEN $5::boolean THEN " USER_SORT_COLUMN " END DESC, "
+                  "CASE WHEN $5::boolean THEN -id ELSE id END LIMIT $6 OFFSET $7", 7},
+    {"user_count", "SELECT COUNT(*) FROM users " USER_FILTER_WHERE, 3},
+    // The right hand sides see the row as it was, phone included
+    {"user_update", "UPDATE users SET name = $2, email = $3, phone = $4, "
+                    "phone_invalid_since = CASE WHEN phone = $4 THEN phone_invalid_since ELSE 0 END, "
+                    "phone_invalid_reason = CASE WHEN phone = $4 THEN phone_invalid_reason ELSE '' END, "
+                    "email_index = $5, phone_index = $6 "
+                    "WHERE id = $1 AND deleted_at = 0", 6},
+    {"user_link", "UPDATE users SET wp_id = $2, wp_phone = $3 WHERE id = $1 AND deleted_at = 0", 3},
+    {"user_flag_phone", "UPDATE users SET phone_invalid_since = $3, phone_invalid_reason = $4 "
+                        "WHERE id = $1 AND phone = $2 AND deleted_at = 0", 4},
+    {"user_rewrite", "UPDATE users SET email = $5, phone = $6, wp_phone = $7, "
+                     "email_index = $8, phone_index = $9 "
+                     "WHERE id = $1 AND email = $2 AND phone = $3 AND wp_phone = $4", 9},
+    {"user_remove", "UPDATE users SET deleted_at = $2 WHERE id = $1 AND deleted_at = 0", 2},
+    {"user_restore", "UPDATE users SET deleted_at = 0 WHERE id = $1 AND deleted_at <> 0", 1},
+    {"user_purge", "DELETE FROM users WHERE deleted_at <> 0 AND deleted_at < $1", 1},
+    {"user_erase", "DELETE FROM users WHERE id = $1", 1},
+    {"user_find_duplicate", "SELECT " USER_COLUMNS " FROM users WHERE id <> $1 AND deleted_at = 0 "
+                            "AND (lower(email) = lower($2) OR ($3 <> '' AND phone = $3)) "
+                            "ORDER BY id LIMIT 1", 3},
+    // phone <> '' lets the partial users_phone index serve it
+    {"user_find_by_phone", "SELECT " USER_COLUMNS " FROM users WHERE phone = $1 AND phone <> '' "
+                           "AND deleted_at = 0 ORDER BY id", 1},
+    // Served by the users_email_index and users_phone_index indexes
+    {"user_find_by_index", "SELECT " USER_COLUMNS " FROM users WHERE deleted_at = 0 "
+                           "AND (email_index = $1 OR email_index = '' "
+                           "OR ($2 <> '' AND phone_index = $2)) ORDER BY id", 2},
+    // $1 is one term as a LIKE pattern, which users_search serves, and $2
+    // the whole query, whose most similar users are taken first
+    {"user_search", "SELECT " USER_COLUMNS " FROM users WHERE deleted_at = 0 "
+                    "AND " USER_SEARCH_TEXT " LIKE $1 "
+                    "ORDER BY similarity(" USER_SEARCH_TEXT ", $2) DESC, id LIMIT $3", 3},
+    {"entry_create", "INSERT INTO number_lists (list, match, value, reason, tenant_id) "
+                     "VALUES ($1, $2, $3, $4, $5) RETURNING id", 5},
+    {"entry_list", "SELECT id, list, match, value, reason, tenant_id FROM number_lists "
+                   "ORDER BY id", 0},
+    {"entry_remove", "DELETE FROM number_lists WHERE id = $1 AND list = $2", 2},
+    {"rule_create", "INSERT INTO validation_rules (position, action, match, match_values, caller, "
+                    "reason, tenant_id) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id", 7},
+    {"rule_list", "SELECT id, position, action, match, match_values, caller, reason, tenant_id "
+                  "FROM validation_rules ORDER BY position, id", 0},
+    {"rule_update", "UPDATE validation_rules SET position = $2, action = $3, match = $4, "
+                    "match_values = $5, caller = $6, reason = $7, tenant_id = $8 WHERE id = $1", 8},
+    {"rule_remove", "DELETE FROM validation_rules WHERE id = $1", 1},
+    {"profile_create", "INSERT INTO form_profiles (name, plugin, form_id, fields, region, tenant_id) "
+                       "VALUES ($1, $2, $3, $4, $5, $6) RETURNING id", 6},
+    {"profile_list", "SELECT id, name, plugin, form_id, fields, region, tenant_id "
+                     "FROM form_profiles ORDER BY id", 0},
+    {"profile_update", "UPDATE form_profiles SET name = $2, plugin = $3, form_id = $4, fields = $5, "
+                       "region = $6, tenant_id = $7 WHERE id = $1", 7},
+    {"profile_remove", "DELETE FROM form_profiles WHERE id = $1", 1},
+    {"key_create", "INSERT INTO api_keys (name, key_hash, scopes, created_at, tenant_id, sandbox) "
+                   "VALUES ($1, $2, $3, $4, $5, $6) RETURNING id", 6},
+    {"key_find", "SELECT id, name, key_hash, scopes, created_at, tenant_id, sandbox FROM api_keys "
+                 "WHERE key_hash = $1", 1},
+    {"key_list", "SELECT id, name, key_hash, scopes, created_at, tenant_id, sandbox FROM api_keys "
+                 "ORDER BY id", 0},
+    {"key_remove", "DELETE FROM api_keys WHERE id = $1", 1},
+    {"history_add", "INSERT INTO validation_history "
+                    "(created_at, number_hash, caller, source, result, reason, region, tenant_id) "
+                    "VALUES ($1, $2, $3, $4, $5, $6, $7, $8)", 8},
+    {"history_list", "SELECT id, created_at, number_hash, caller, source, result, reason, region, "
+                     "tenant_id FROM validation_history " HISTORY_FILTER_WHERE
+                     " ORDER BY id DESC LIMIT $7 OFFSET $8", 8},
+    {"history_count", "SELECT result, COUNT(*) FROM validation_history " HISTORY_FILTER_WHERE
+                      " GROUP BY result", 6},
+    {"history_purge", "DELETE FROM validation_history WHERE created_at < $1", 1},
+    {"history_scrub", "UPDATE validation_history SET number_hash = '' "
+                      "WHERE created_at < $1 AND number_hash <> ''", 1},
+    {"history_erase", "DELETE FROM validation_history WHERE number_hash = $1", 1},
+    {"audit_add", "INSERT INTO audit_log (created_at, actor, client_ip, action, target, "
+                  "before_state, after_state, tenant_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) "
+                  "RETURNING id", 8},
+    // An action without a dot matches every action on that resource
+    {"audit_list", "SELECT id, created_at, actor, client_ip, action, target, before_state, "
+                   "after_state, tenant_id FROM audit_log "
+                   "WHERE created_at >= $1 AND ($2::bigint = 0 OR created_at < $2) "
+                   "AND ($3 = '' OR actor = $3) AND ($4 = '' OR action = $4 OR "
+                   "(strpos($4, '.') = 0 AND left(action, length($4) + 1) = $4 || '.')) "
+                   "AND ($5 = '' OR target = $5) AND ($6::integer = 0 OR tenant_id = $6) "
+                   "ORDER BY id DESC LIMIT $7 OFFSET $8", 8},
+    {"tenant_create", "INSERT INTO tenants (name, rate_limit, rate_burst, monthly_quota, suspended, "
+                      "stripe_customer, billing_updated_at, created_at) "
+                      "VALUES ($2, $3, $4, $5, $6, $7, $8, $1) RETURNING id", 8},
+    {"tenant_get", "SELECT " TENANT_COLUMNS " FROM tenants WHERE id = $1", 1},
+    {"tenant_list", "SELECT " TENANT_COLUMNS " FROM tenants ORDER BY id", 0},
+    {"tenant_update", "UPDATE tenants SET name = $2, rate_limit = $3, rate_burst = $4, "
+                      "monthly_quota = $5, suspended = $6, stripe_customer = $7, "
+                      "billing_updated_at = $8 WHERE id = $1", 8},
+    {"tenant_remove_keys", "DELETE FROM api_keys WHERE tenant_id = $1", 1},
+    {"tenant_remove_entries", "DELETE FROM number_lists WHERE tenant_id = $1", 1},
+    {"tenant_remove_rules", "DELETE FROM validation_rules WHERE tenant_id = $1", 1},
+    {"tenant_remove_profiles", "DELETE FROM form_profiles WHERE tenant_id = $1", 1},
+    {"tenant_remove", "DELETE FROM tenants WHERE id = $1", 1},
+    {"usage_add", "INSERT INTO tenant_usage (tenant_id, month, validations) VALUES ($1, $2, $3) "
+                  "ON CONFLICT (tenant_id, month) "
+                  "DO UPDATE SET validations = tenant_usage.validations + EXCLUDED.validations", 3},
+    {"usage_get", "SELECT validations FROM tenant_usage WHERE tenant_id = $1 AND month = $2", 2},
+    {"usage_list", "SELECT tenant_id, month, validations FROM tenant_usage "
+                   "WHERE $1::integer = 0 OR tenant_id = $1 ORDER BY month, tenant_id", 1},
+};
+
+#define STATEMENT_COUNT (int)(sizeof(statements) / sizeof(statements[0]))
+
+// Fixed-size pool of connections handed out one request at a time
+typedef struct {
+    PGconn** connections;
+    bool* in_use;
+    int size;
+    pthread_mutex_t lock;
+    pthread_cond_t available;
+} PostgresPool;
+
+// Waits for a free connection, or returns NULL once ctx is done
+static PGconn* pool_acquire(PostgresPool* pool, const Context* ctx) {
+    pthread_mutex_lock(&pool->lock);
+    while (1) {
+        for (int i = 0; i < pool->size; i++) {
+            if (!pool->in_use[i]) {
+                pool->in_use[i] = true;
+                pthread_mutex_unlock(&pool->lock);
+
+                // Reconnect transparently if the server dropped us
+                if (PQstatus(pool->connections[i]) != CONNECTION_OK) {
+                    PQreset(pool->connections[i]);
+                }
+                return pool->connections[i];
+            }
+        }
+        if (!ctx) {
+            pthread_cond_wait(&pool->available, &pool->lock);
+            continue;
+        }
+        if (context_done(ctx)) {
+            pthread_mutex_unlock(&pool->lock);
+            return NULL;
+        }
+        struct timespec wake;
+        clock_gettime(CLOCK_REALTIME, &wake);
+        wake.tv_nsec += CONTEXT_POLL_MS * 1000000L;
+        if (wake.tv_nsec >= 1000000000L) {
+            wake.tv_sec++;
+            wake.tv_nsec -= 1000000000L;
+        }
+        pthread_cond_timedwait(&pool->available, &pool->lock, &wake);
+    }
+}
+
+static void pool_release(PostgresPool* pool, PGconn* conn) {
+    pthread_mutex_lock(&pool->lock);
+    for (int i = 0; i < pool->size; i++) {
+        if (pool->connections[i] == conn) {
+            pool->in_use[i] = false;
+            break;
+        }
+    }
+    pthread_cond_signal(&pool->available);
+    pthread_mutex_unlock(&pool->lock);
+}
+
+static bool prepare_statements(PGconn* conn, char* error, size_t error_size) {
+    for (int i = 0; i < STATEMENT_COUNT; i++) {
+        PGresult* result = PQprepare(conn, statements[i].name, statements[i].sql,
+                                     statements[i].param_count, NULL);
+        bool ok = PQresultStatus(result) == PGRES_COMMAND_OK;
+        if (!ok) {
+            snprintf(error, error_size, "cannot prepare %s: %s",
+                     statements[i].name, PQerrorMessage(conn));
+        }
+        PQclear(result);
+        if (!ok) return false;
+    }
+    return true;
+}
+
+// Runs a statement that returns no rows, used by migrations
+static bool exec_command(PGconn* conn, const char* sql, char* error, size_t error_size) {
+    PGresult* result = PQexec(conn, sql);
+    ExecStatusType status = PQresultStatus(result);
+    bool ok = status == PGRES_COMMAND_OK || status == PGRES_TUPLES_OK;
+    if (!ok) {
+        snprintf(error, error_size, "%s", PQerrorMessage(conn));
+    }
+    PQclear(result);
+    return ok;
+}
+
+static bool migration_exec(void* conn, const char* sql, char* error, size_t error_size) {
+    return exec_command(conn, sql, error, error_size);
+}
+
+static bool migration_query_int(void* conn, const char* sql, int* value, char* error,
+                                size_t error_size) {
+    PGresult* result = PQexec(conn, sql);
+    bool ok = PQresultStatus(result) == PGRES_TUPLES_OK && PQntuples(result) == 1;
+    if (ok) *value = atoi(PQgetvalue(result, 0, 0));
+    else snprintf(error, error_size, "%s", PQerrorMessage(conn));
+    PQclear(result);
+    return ok;
+}
+
+static Migrator migrator_for(PGconn* conn) {
+    return (Migrator){
+        .name = "Postgres",
+        .migrations = migrations,
+        .count = (int)(sizeof(migrations) / sizeof(migrations[0])),
+        .table = "schema_migrations",
+        .version_table = "CREATE TABLE IF NOT EXISTS schema_migrations ("
+                         "  version INTEGER PRIMARY KEY,"
+                         "  applied_at TIMESTAMPTZ NOT NULL DEFAULT now()"
+                         ")",
+        .db = conn,
+        .exec = migration_exec,
+        .query_int = migration_query_int,
+    };
+}
+
+// Takes or lets go of the lock that has replicas starting together, and
+// the migrate subcommand, migrate one at a time
+static bool lock_migrations(PGconn* conn, bool lock, char* error, size_t error_size) {
+    char sql[128];
+    snprintf(sql, sizeof(sql), "SELECT pg_advisory_%s(%d)", lock ? "lock" : "unlock",
+             MIGRATION_LOCK_KEY);
+    return exec_command(conn, sql, error, error_size);
+}
+
+static bool migrate_on_open(PGconn* conn, bool apply, char* error, size_t error_size) {
+    if (!lock_migrations(conn, true, error, error_size)) return false;
+    Migrator migrator = migrator_for(conn);
+    bool ok = migrate_startup(&migrator, apply, error, error_size);
+    char ignored[256];
+    lock_migrations(conn, false, ignored, sizeof(ignored));
+    return ok;
+}
+
+bool postgres_store_migrate(const char* conninfo, MigrateCommand command, int target, char* error,
+                            size_t error_size) {
+    PGconn* conn = PQconnectdb(conninfo);
+    if (PQstatus(conn) != CONNECTION_OK) {
+        snprintf(error, error_size, "cannot connect: %s", PQerrorMessage(conn));
+        PQfinish(conn);
+        return false;
+    }
+    Migrator migrator = migrator_for(conn);
+    bool ok = lock_migrations(conn, true, error, error_size) &&
+              migrate_run(&migrator, command, target, error, error_size);
+    char ignored[256];
+    lock_migrations(conn, false, ignored, sizeof(ignored));
+    PQfinish(conn);
+    return ok;
+}
+
+static void read_user(PGresult* result, int row, User* user) {
+    user->id = atoi(PQgetvalue(result, row, 0));
+    snprintf(user->name, sizeof(user->name), "%s", PQgetvalue(result, row, 1));
+    snprintf(user->email, sizeof(user->email), "%s", PQgetvalue(result, row, 2));
+    snprintf(user->phone, sizeof(user->phone), "%s", PQgetvalue(result, row, 3));
+    user->deleted_at = atoll(PQgetvalue(result, row, 4));
+    user->wp_id = atoi(PQgetvalue(result, row, 5));
+    snprintf(user->wp_phone, sizeof(user->wp_phone), "%s", PQgetvalue(result, row, 6));
+    user->phone_invalid_since = atoll(PQgetvalue(result, row, 7));
+    snprintf(user->phone_invalid_reason, sizeof(user->phone_invalid_reason), "%s",
+             PQgetvalue(result, row, 8));
+    snprintf(user->email_index, sizeof(user->email_index), "%s", PQgetvalue(result, row, 9));
+    snprintf(user->phone_index, sizeof(user->phone_index), "%s", PQgetvalue(result, row, 10));
+}
+
+// Asks the server to stop the query running on conn. The query still ends
+// with a result, an error one unless it had already finished.
+static void cancel_query(PGconn* conn) {
+    PGcancel* cancel = PQgetCancel(conn);
+    if (cancel) {
+        char ignored[256];
+        PQcancel(cancel, ignored, sizeof(ignored));
+        PQfreeCancel(cancel);
+    }
+}
+
+// PQexecPrepared() that cancels the statement on the server once ctx is
+// done, and then returns NULL. PQresultStatus() and PQclear() take NULL.
+static PGresult* exec_prepared(PGconn* conn, const Context* ctx, const char* name,
+                               int param_count, const char** params) {
+    if (context_done(ctx) ||
+        !PQsendQueryPrepared(conn, name, param_count, params, NULL, NULL, 0)) {
+        return NULL;
+    }
+
+    bool cancelled = false;
+    while (PQisBusy(conn)) {
+        if (!cancelled && context_done(ctx)) {
+            cancel_query(conn);
+            cancelled = true;
+        }
+        struct pollfd readable = {.fd = PQsocket(conn), .events = POLLIN};
+        poll(&readable, 1, CONTEXT_POLL_MS);
+        if (!PQconsumeInput(conn)) break;
+    }
+
+    // The connection takes no new query until every result is read
+    PGresult* result = NULL;
+    PGresult* next;
+    while ((next = PQgetResult(conn)) != NULL) {
+        PQclear(result);
+        result = next;
+    }
+    if (cancelled) {
+        PQclear(result);
+        return NULL;
+    }
+    return result;
+}
+
+// Executes a prepared statement on a pooled connection
+static PGresult* execute(Store* store, const Context* ctx, const char* name, int param_count,
+                         const char** params) {
+    PostgresPool* pool = store->data;
+    PGconn* conn = pool_acquire(pool, ctx);
+    if (!conn) return NULL;
+    PGresult* result = exec_prepared(conn, ctx, name, param_count, params);
+    pool_release(pool, conn);
+    return result;
+}
+
+// Maps the outcome of a statement that affects a single row
+static StoreResult affected_row_result(PGresult* result) {
+    StoreResult outcome = STORE_ERROR;
+    if (PQresultStatus(result) == PGRES_COMMAND_OK) {
+        outcome = atoi(PQcmdTuples(result)) > 0 ? STORE_OK : STORE_NOT_FOUND;
+    }
+    PQclear(result);
+    return outcome;
+}
+
+static StoreResult postgres_create(Store* store, const Context* ctx, User* user) {
+    const char* params[] = {user->name, user->email, user->phone, user->email_index,
+                            user->phone_index};
+    PGresult* result = execute(store, ctx, "user_create", 5, params);
+
+    StoreResult outcome = STORE_ERROR;
+    if (PQresultStatus(result) == PGRES_TUPLES_OK && PQntuples(result) == 1) {
+        user->id = atoi(PQgetvalue(result, 0, 0));
+        outcome = STORE_OK;
+    }
+    PQclear(result);
+    return outcome;
+}
+
+static StoreResult postgres_get(Store* store, const Context* ctx, int id, User* user) {
+    char id_text[16];
+    snprintf(id_text, sizeof(id_text), "%d", id);
+    const char* params[] = {id_text};
+    PGresult* result = execute(store, ctx, "user_get", 1, params);
+
+    StoreResult outcome = STORE_ERROR;
+    if (PQresultStatus(result) == PGRES_TUPLES_OK) {
+        if (PQntuples(result) == 1) {
+            read_user(result, 0, user);
+            outcome = STORE_OK;
+        } else {
+            outcome = STORE_NOT_FOUND;
+        }
+    }
+    PQclear(result);
+    return outcome;
+}
+
+static StoreResult postgres_list(Store* store, const Context* ctx, const UserFilter* filter,
+                                 User** users, int* count, int* total) {
+    char pattern[300];
+    user_query_pattern(filter->query, pattern, sizeof(pattern));
+
+    char deleted[16];
+    snprintf(deleted, sizeof(deleted), "%d", filter->deleted);
+    const char* phone_invalid = filter->phone_invalid ? "true" : "false";
+    const char* count_params[] = {pattern, deleted, phone_invalid};
+    PGresult* result = execute(store, ctx, "user_count", 3, count_params);
+    if (PQresultStatus(result) != PGRES_TUPLES_OK || PQntuples(result) != 1) {
+        PQclear(result);
+        return STORE_ERROR;
+    }
+    *total = atoi(PQgetvalue(result, 0, 0));
+    PQclear(result);
+
+    char limit[16];
+    char offset[16];
+    snprintf(limit, sizeof(limit), "%d", filter->limit);
+    snprintf(offset, sizeof(offset), "%d", filter->offset);
+    const char* params[] = {pattern, deleted, phone_invalid, user_sort_string(filter->sort),
+                            filter->descending ? "true" : "false", limit, offset};
+    result = execute(store, ctx, "user_list", 7, params);
+    if (PQresultStatus(result) != PGRES_TUPLES_OK) {
+        PQclear(result);
+        return STORE_ERROR;
+    }
+
+    *count = PQntuples(result);
+    *users = malloc(sizeof(User) * (*count > 0 ? *count : 1));
+    for (int i = 0; i < *count; i++) {
+        read_user(result, i, &(*users)[i]);
+    }
+    PQclear(result);
+    return STORE_OK;
+}
+
+static StoreResult postgres_update(Store* store, const Context* ctx, const User* user) {
+    char id_text[16];
+    snprintf(id_text, sizeof(id_text), "%d", user->id);
+    const char* params[] = {id_text, user->name, user->email, user->phone, user->email_index,
+                            user->phone_index};
+    return affected_row_result(execute(store, ctx, "user_update", 6, params));
+}
+
+static StoreResult postgres_link_user(Store* store, const Context* ctx, int id, int wp_id,
+                                      const char* wp_phone) {
+    char id_text[16];
+    char wp_id_text[16];
+    snprintf(id_text, sizeof(id_text), "%d", id);
+    snprintf(wp_id_text, sizeof(wp_id_text), "%d", wp_id);
+    const char* params[] = {id_text, wp_id_text, wp_phone};
+    return affected_row_result(execute(store, ctx, "user_link", 3, params));
+}
+
+static StoreResult postgres_flag_phone(Store* store, const Context* ctx, int id, const char* phone,
+                                       long long invalid_since, const char* reason) {
+    char id_text[16];
+    char since_text[24];
+    snprintf(id_text, sizeof(id_text), "%d", id);
+    snprintf(since_text, sizeof(since_text), "%lld", invalid_since);
+    const char* params[] = {id_text, phone, since_text, reason};
+    return affected_row_result(execute(store, ctx, "user_flag_phone", 4, params));
+}
+
+static StoreResult postgres_rewrite_user(Store* store, const Context* ctx, const User* from,
+                                         const User* to) {
+    char id_text[16];
+    snprintf(id_text, sizeof(id_text), "%d", from->id);
+    const char* params[] = {id_text, from->email, from->phone, from->wp_phone,
+                            to->email, to->phone, to->wp_phone, to->email_index, to->phone_index};
+    return affected_row_result(execute(store, ctx, "user_rewrite", 9, params));
+}
+
+static StoreResult postgres_find_duplicate(Store* store, const Context* ctx, const User* user,
+                                           User* existing) {
+    char id_text[16];
+    snprintf(id_text, sizeof(id_text), "%d", user->id);
+    const char* params[] = {id_text, user->email, user->phone};
+    PGresult* result = execute(store, ctx, "user_find_duplicate", 3, params);
+
+    StoreResult outcome = STORE_ERROR;
+    if (PQresultStatus(result) == PGRES_TUPLES_OK) {
+        if (PQntuples(result) == 1) {
+            read_user(result, 0, existing);
+            outcome = STORE_OK;
+        } else {
+            outcome = STORE_NOT_FOUND;
+        }
+    }
+    PQclear(result);
+    return outcome;
+}
+
+static StoreResult postgres_find_by_phone(Store* store, const Context* ctx, const char* phone,
+                                          User** users, int* count) {
+    const char* params[] = {phone};
+    PGresult* result = execute(store, ctx, "user_find_by_phone", 1, params);
+    if (PQresultStatus(result) != PGRES_TUPLES_OK) {
+        PQclear(result);
+        return STORE_ERROR;
+    }
+
+    *count = PQntuples(result);
+    *users = malloc(sizeof(User) * (*count > 0 ? *count : 1));
+    for (int i = 0; i < *count; i++) {
+        read_user(result, i, &(*users)[i]);
+    }
+    PQclear(result);
+    return STORE_OK;
+}
+
+static StoreResult postgres_find_by_index(Store* store, const Context* ctx,
+                                          const char* email_index, const char* phone_index,
+                                          User** users, int* count) {
+    const char* params[] = {email_index, phone_index};
+    PGresult* result = execute(store, ctx, "user_find_by_index", 2, params);
+    if (PQresultStatus(result) != PGRES_TUPLES_OK) {
+        PQclear(result);
+        return STORE_ERROR;
+    }
+
+    *count = PQntuples(result);
+    *users = malloc(sizeof(User) * (*count > 0 ? *count : 1));
+    for (int i = 0; i < *count; i++) {
+        read_user(result, i, &(*users)[i]);
+    }
+    PQclear(result);
+    return STORE_OK;
+}
+
+// Narrows the search with the longest term, which has the most trigrams
+// to look up, and leaves the other terms to the ranking
+static StoreResult postgres_search_users(Store* store, const Context* ctx, const char* query,
+                                         int limit, UserMatch** matches, int* count) {
+    SearchTerm terms[USER_SEARCH_TERMS];
+    int term_count = user_search_terms(query, terms);
+    const SearchTerm* longest = NULL;
+    for (int i = 0; i < term_count; i++) {
+        if (!longest || strlen(terms[i].text) > strlen(longest->text)) longest = &terms[i];
+    }
+    if (!longest) {
+        user_search_rank(NULL, 0, terms, term_count, limit, matches, count);
+        return STORE_OK;
+    }
+
+    char text[sizeof(longest->text) + 1];
+    snprintf(text, sizeof(text), "%s%s", longest->kind == SEARCH_TERM_DOMAIN ? "@" : "",
+             longest->text);
+    char pattern[2 * sizeof(text) + 3];
+    user_query_pattern(text, pattern, sizeof(pattern));
+    char limit_text[16];
+    snprintf(limit_text, sizeof(limit_text), "%d", USER_SEARCH_CANDIDATES);
+    const char* params[] = {pattern, query, limit_text};
+    PGresult* result = execute(store, ctx, "user_search", 3, params);
+    if (PQresultStatus(result) != PGRES_TUPLES_OK) {
+        PQclear(result);
+        return STORE_ERROR;
+    }
+
+    int candidate_count = PQntuples(result);
+    User* candidates = malloc(sizeof(User) * (candidate_count > 0 ? candidate_count : 1));
+    for (int i = 0; i < candidate_count; i++) {
+        read_user(result, i, &candidates[i]);
+    }
+    PQclear(result);
+    user_search_rank(candidates, candidate_count, terms, term_count, limit, matches, count);
+    free(candidates);
+    return STORE_OK;
+}
+
+static StoreResult postgres_remove(Store* store, const Context* ctx, int id, long long deleted_at) {
+    char id_text[16];
+    char deleted_text[24];
+    snprintf(id_text, sizeof(id_text), "%d", id);
+    snprintf(deleted_text, sizeof(deleted_text), "%lld", deleted_at);
+    const char* params[] = {id_text, deleted_text};
+    return affected_row_result(execute(store, ctx, "user_remove", 2, params));
+}
+
+static StoreResult postgres_restore(Store* store, const Context* ctx, int id) {
+    char id_text[16];
+    snprintf(id_text, sizeof(id_text), "%d", id);
+    const char* params[] = {id_text};
+    return affected_row_result(execute(store, ctx, "user_restore", 1, params));
+}
+
+static StoreResult postgres_purge_users(Store* store, const Context* ctx, long long deleted_before,
+                                        int* purged) {
+    char before_text[24];
+    snprintf(before_text, sizeof(before_text), "%lld", deleted_before);
+    const char* params[] = {before_text};
+    PGresult* result = execute(store, ctx, "user_purge", 1, params);
+    StoreResult outcome = STORE_ERROR;
+    if (PQresultStatus(result) == PGRES_COMMAND_OK) {
+        *purged = atoi(PQcmdTuples(result));
+        outcome = STORE_OK;
+    }
+    PQclear(result);
+    return outcome;
+}
+
+static StoreResult postgres_erase_user(Store* store, const Context* ctx, int id) {
+    char id_text[16];
+    snprintf(id_text, sizeof(id_text), "%d", id);
+    const char* params[] = {id_text};
+    return affected_row_result(execute(store, ctx, "user_erase", 1, params));
+}
+
+static void read_entry(PGresult* result, int row, ListEntry* entry) {
+    entry->id = atoi(PQgetvalue(result, row, 0));
+    list_name_parse(PQgetvalue(result, row, 1), &entry->list);
+    list_match_parse(PQgetvalue(result, row, 2), &entry->match);
+    snprintf(entry->value, sizeof(entry->value), "%s", PQgetvalue(result, row, 3));
+    snprintf(entry->reason, sizeof(entry->reason), "%s", PQgetvalue(result, row, 4));
+    entry->tenant_id = atoi(PQgetvalue(result, row, 5));
+}
+
+static StoreResult postgres_create_entry(Store* store, const Context* ctx, ListEntry* entry) {
+    char tenant_id[16];
+    snprintf(tenant_id, sizeof(tenant_id), "%d", entry->tenant_id);
+    const char* params[] = {list_name_string(entry->list), list_match_string(entry->match),
+                            entry->value, entry->reason, tenant_id};
+    PGresult* result = execute(store, ctx, "entry_create", 5, params);
+
+    StoreResult outcome = STORE_ERROR;
+    if (PQresultStatus(result) == PGRES_TUPLES_OK && PQntuples(result) == 1) {
+        entry->id = atoi(PQgetvalue(result, 0, 0));
+        outcome = STORE_OK;
+    }
+    PQclear(result);
+    return outcome;
+}
+
+static StoreResult postgres_list_entries(Store* store, const Context* ctx, ListEntry** entries,
+                                         int* count) {
+    PGresult* result = execute(store, ctx, "entry_list", 0, NULL);
+    if (PQresultStatus(result) != PGRES_TUPLES_OK) {
+        PQclear(result);
+        return STORE_ERROR;
+    }
+
+    *count = PQntuples(result);
+    *entries = malloc(sizeof(ListEntry) * (*count > 0 ? *count : 1));
+    for (int i = 0; i < *count; i++) {
+        read_entry(result, i, &(*entries)[i]);
+    }
+    PQclear(result);
+    return STORE_OK;
+}
+
+static StoreResult postgres_remove_entry(Store* store, const Context* ctx, ListName list, int id) {
+    char id_text[16];
+    snprintf(id_text, sizeof(id_text), "%d", id);
+    const char* params[] = {id_text, list_name_string(list)};
+    return affected_row_result(execute(store, ctx, "entry_remove", 2, params));
+}
+
+static void read_rule(PGresult* result, int row, Rule* rule) {
+    rule->id = atoi(PQgetvalue(result, row, 0));
+    rule->position = atoi(PQgetvalue(result, row, 1));
+    rule_action_parse(PQgetvalue(result, row, 2), &rule->action);
+    rule_match_parse(PQgetvalue(result, row, 3), &rule->match);
+    snprintf(rule->values, sizeof(rule->values), "%s", PQgetvalue(result, row, 4));
+    snprintf(rule->caller, sizeof(rule->caller), "%s", PQgetvalue(result, row, 5));
+    snprintf(rule->reason, sizeof(rule->reason), "%s", PQgetvalue(result, row, 6));
+    rule->tenant_id = atoi(PQgetvalue(result, row, 7));
+}
+
+static StoreResult postgres_create_rule(Store* store, const Context* ctx, Rule* rule) {
+    char position_text[16];
+    char tenant_id[16];
+    snprintf(position_text, sizeof(position_text), "%d", rule->position);
+    snprintf(tenant_id, sizeof(tenant_id), "%d", rule->tenant_id);
+    const char* params[] = {position_text, rule_action_string(rule->action),
+                            rule_match_string(rule->match), rule->values, rule->caller,
+                            rule->reason, tenant_id};
+    PGresult* result = execute(store, ctx, "rule_create", 7, params);
+
+    StoreResult outcome = STORE_ERROR;
+    if (PQresultStatus(result) == PGRES_TUPLES_OK && PQntuples(result) == 1) {
+        rule->id = atoi(PQgetvalue(result, 0, 0));
+        outcome = STORE_OK;
+    }
+    PQclear(result);
+    return outcome;
+}
+
+static StoreResult postgres_list_rules(Store* store, const Context* ctx, Rule** rules, int* count) {
+    PGresult* result = execute(store, ctx, "rule_list", 0, NULL);
+    if (PQresultStatus(result) != PGRES_TUPLES_OK) {
+        PQclear(result);
+        return STORE_ERROR;
+    }
+
+    *count = PQntuples(result);
+    *rules = malloc(sizeof(Rule) * (*count > 0 ? *count : 1));
+    for (int i = 0; i < *count; i++) {
+        read_rule(result, i, &(*rules)[i]);
+    }
+    PQclear(result);
+    return STORE_OK;
+}
+
+static StoreResult postgres_update_rule(Store* store, const Context* ctx, const Rule* rule) {
+    char id_text[16];
+    char position_text[16];
+    char tenant_id[16];
+    snprintf(id_text, sizeof(id_text), "%d", rule->id);
+    snprintf(position_text, sizeof(position_text), "%d", rule->position);
+    snprintf(tenant_id, sizeof(tenant_id), "%d", rule->tenant_id);
+    const char* params[] = {id_text, position_text, rule_action_string(rule->action),
+                            rule_match_string(rule->match), rule->values, rule->caller,
+                            rule->reason, tenant_id};
+    return affected_row_result(execute(store, ctx, "rule_update", 8, params));
+}
+
+static StoreResult postgres_remove_rule(Store* store, const Context* ctx, int id) {
+    char id_text[16];
+    snprintf(id_text, sizeof(id_text), "%d", id);
+    const char* params[] = {id_text};
+    return affected_row_result(execute(store, ctx, "rule_remove", 1, params));
+}
+
+static void read_profile(PGresult* result, int row, FormProfile* profile) {
+    profile->id = atoi(PQgetvalue(result, row, 0));
+    snprintf(profile->name, sizeof(profile->name), "%s", PQgetvalue(result, row, 1));
+    form_plugin_parse(PQgetvalue(result, row, 2), &profile->plugin);
+    snprintf(profile->form_id, sizeof(profile->form_id), "%s", PQgetvalue(result, row, 3));
+    snprintf(profile->fields, sizeof(profile->fields), "%s", PQgetvalue(result, row, 4));
+    snprintf(profile->region, sizeof(profile->region), "%s", PQgetvalue(result, row, 5));
+    profile->tenant_id = atoi(PQgetvalue(result, row, 6));
+}
+
+static StoreResult postgres_create_profile(Store* store, const Context* ctx, FormProfile* profile) {
+    char tenant_id[16];
+    snprintf(tenant_id, sizeof(tenant_id), "%d", profile->tenant_id);
+    const char* params[] = {profile->name, form_plugin_string(profile->plugin), profile->form_id,
+                            profile->fields, profile->region, tenant_id};
+    PGresult* result = execute(store, ctx, "profile_create", 6, params);
+
+    StoreResult outcome = STORE_ERROR;
+    if (PQresultStatus(result) == PGRES_TUPLES_OK && PQntuples(result) == 1) {
+        profile->id = atoi(PQgetvalue(result, 0, 0));
+        outcome = STORE_OK;
+    }
+    PQclear(result);
+    return outcome;
+}
+
+static StoreResult postgres_list_profiles(Store* store, const Context* ctx, FormProfile** profiles,
+                                          int* count) {
+    PGresult* result = execute(store, ctx, "profile_list", 0, NULL);
+    if (PQresultStatus(result) != PGRES_TUPLES_OK) {
+        PQclear(result);
+        return STORE_ERROR;
+    }
+
+    *count = PQntuples(result);
+    *profiles = malloc(sizeof(FormProfile) * (*count > 0 ? *count : 1));
+    for (int i = 0; i < *count; i++) {
+        read_profile(result, i, &(*profiles)[i]);
+    }
+    PQclear(result);
+    return STORE_OK;
+}
+
+static StoreResult postgres_update_profile(Store* store, const Context* ctx,
+                                           const FormProfile* profile) {
+    char id_text[16];
+    char tenant_id[16];
+    snprintf(id_text, sizeof(id_text), "%d", profile->id);
+    snprintf(tenant_id, sizeof(tenant_id), "%d", profile->tenant_id);
+    const char* params[] = {id_text, profile->name, form_plugin_string(profile->plugin),
+                            profile->form_id, profile->fields, profile->region, tenant_id};
+    return affected_row_result(execute(store, ctx, "profile_update", 7, params));
+}
+
+static StoreResult postgres_remove_profile(Store* store, const Context* ctx, int id) {
+    char id_text[16];
+    snprintf(id_text, sizeof(id_text), "%d", id);
+    const char* params[] = {id_text};
+    return affected_row_result(execute(store, ctx, "profile_remove", 1, params));
+}
+
+static void read_key(PGresult* result, int row, ApiKey* key) {
+    key->id = atoi(PQgetvalue(result, row, 0));
+    snprintf(key->name, sizeof(key->name), "%s", PQgetvalue(result, row, 1));
+    snprintf(key->key_hash, sizeof(key->key_hash), "%s", PQgetvalue(result, row, 2));
+    key->scopes = atoi(PQgetvalue(result, row, 3));
+    key->created_at = atoll(PQgetvalue(result, row, 4));
+    key->tenant_id = atoi(PQgetvalue(result, row, 5));
+    key->sandbox = strcmp(PQgetvalue(result, row, 6), "t") == 0;
+}
+
+static StoreResult postgres_create_key(Store* store, const Context* ctx, ApiKey* key) {
+    char scopes[16];
+    char created_at[24];
+    char tenant_id[16];
+    snprintf(scopes, sizeof(scopes), "%d", key->scopes);
+    snprintf(created_at, sizeof(created_at), "%lld", key->created_at);
+    snprintf(tenant_id, sizeof(tenant_id), "%d", key->tenant_id);
+    const char* params[] = {key->name, key->key_hash, scopes, created_at, tenant_id,
+                            key->sandbox ? "true" : "false"};
+    PGresult* result = execute(store, ctx, "key_create", 6, params);
+
+    StoreResult outcome = STORE_ERROR;
+    if (PQresultStatus(result) == PGRES_TUPLES_OK && PQntuples(result) == 1) {
+        key->id = atoi(PQgetvalue(result, 0, 0));
+        outcome = STORE_OK;
+    }
+    PQclear(result);
+    return outcome;
+}
+
+static StoreResult postgres_find_key(Store* store, const Context* ctx, const char* key_hash,
+                                     ApiKey* key) {
+    const char* params[] = {key_hash};
+    PGresult* result = execute(store, ctx, "key_find", 1, params);
+
+    StoreResult outcome = STORE_ERROR;
+    if (PQresultStatus(result) == PGRES_TUPLES_OK) {
+        if (PQntuples(result) == 1) {
+            read_key(result, 0, key);
+            outcome = STORE_OK;
+        } else {
+            outcome = STORE_NOT_FOUND;
+        }
+    }
+    PQclear(result);
+    return outcome;
+}
+
+static StoreResult postgres_list_keys(Store* store, const Context* ctx, ApiKey** keys, int* count) {
+    PGresult* result = execute(store, ctx, "key_list", 0, NULL);
+    if (PQresultStatus(result) != PGRES_TUPLES_OK) {
+        PQclear(result);
+        return STORE_ERROR;
+    }
+
+    *count = PQntuples(result);
+    *keys = malloc(sizeof(ApiKey) * (*count > 0 ? *count : 1));
+    for (int i = 0; i < *count; i++) {
+        read_key(result, i, &(*keys)[i]);
+    }
+    PQclear(result);
+    return STORE_OK;
+}
+
+static StoreResult postgres_remove_key(Store* store, const Context* ctx, int id) {
+    char id_text[16];
+    snprintf(id_text, sizeof(id_text), "%d", id);
+    const char* params[] = {id_text};
+    return affected_row_result(execute(store, ctx, "key_remove", 1, params));
+}
+
+// Inserts on one pooled connection in a single transaction
+static StoreResult postgres_add_history(Store* store, const Context* ctx,
+                                        const HistoryRecord* records, int count) {
+    PostgresPool* pool = store->data;
+    PGconn* conn = pool_acquire(pool, ctx);
+    if (!conn) return STORE_ERROR;
+    char error[256];
+
+    bool ok = exec_command(conn, "BEGIN", error, sizeof(error));
+    for (int i = 0; i < count && ok; i++) {
+        const HistoryRecord* record = &records[i];
+        char timestamp[24];
+        char tenant_id[16];
+        snprintf(timestamp, sizeof(timestamp), "%lld", record->timestamp);
+        snprintf(tenant_id, sizeof(tenant_id), "%d", record->tenant_id);
+        const char* params[] = {timestamp, record->number_hash, record->caller, record->source,
+                                record->result, record->reason, record->region, tenant_id};
+        PGresult* result = exec_prepared(conn, ctx, "history_add", 8, params);
+        ok = PQresultStatus(result) == PGRES_COMMAND_OK;
+        PQclear(result);
+    }
+    ok = ok && exec_command(conn, "COMMIT", error, sizeof(error));
+    if (!ok) {
+        exec_command(conn, "ROLLBACK", error, sizeof(error));
+    }
+
+    pool_release(pool, conn);
+    return ok ? STORE_OK : STORE_ERROR;
+}
+
+static void read_history(PGresult* result, int row, HistoryRecord* record) {
+    record->id = atoi(PQgetvalue(result, row, 0));
+    record->timestamp = atoll(PQgetvalue(result, row, 1));
+    snprintf(record->number_hash, sizeof(record->number_hash), "%s", PQgetvalue(result, row, 2));
+    snprintf(record->caller, sizeof(record->caller), "%s", PQgetvalue(result, row, 3));
+    snprintf(record->source, sizeof(record->source), "%s", PQgetvalue(result, row, 4));
+    snprintf(record->result, sizeof(record->result), "%s", PQgetvalue(result, row, 5));
+    snprintf(record->reason, sizeof(record->reason), "%s", PQgetvalue(result, row, 6));
+    snprintf(record->region, sizeof(record->region), "%s", PQgetvalue(result, row, 7));
+    record->tenant_id = atoi(PQgetvalue(result, row, 8));
+}
+
+static StoreResult postgres_list_history(Store* store, const Context* ctx,
+                                         const HistoryFilter* filter,
+                                         HistoryRecord** records, int* count) {
+    char from[24];
+    char to[24];
+    char tenant_id[16];
+    char limit[16];
+    char offset[16];
+    snprintf(from, sizeof(from), "%lld", filter->from);
+    snprintf(to, sizeof(to), "%lld", filter->to);
+    snprintf(tenant_id, sizeof(tenant_id), "%d", filter->tenant_id);
+    snprintf(limit, sizeof(limit), "%d", filter->limit);
+    snprintf(offset, sizeof(offset), "%d", filter->offset);
+    const char* params[] = {from, to, filter->caller, filter->result, filter->number_hash,
+                            tenant_id, limit, offset};
+    PGresult* result = execute(store, ctx, "history_list", 8, params);
+    if (PQresultStatus(result) != PGRES_TUPLES_OK) {
+        PQclear(result);
+        return STORE_ERROR;
+    }
+
+    *count = PQntuples(result);
+    *records = malloc(sizeof(HistoryRecord) * (*count > 0 ? *count : 1));
+    for (int i = 0; i < *count; i++) {
+        read_history(result, i, &(*records)[i]);
+    }
+    PQclear(result);
+    return STORE_OK;
+}
+
+static StoreResult postgres_count_history(Store* store, const Context* ctx,
+                                          const HistoryFilter* filter, HistoryCounts* counts) {
+    char from[24];
+    char to[24];
+    char tenant_id[16];
+    snprintf(from, sizeof(from), "%lld", filter->from);
+    snprintf(to, sizeof(to), "%lld", filter->to);
+    snprintf(tenant_id, sizeof(tenant_id), "%d", filter->tenant_id);
+    const char* params[] = {from, to, filter->caller, filter->result, filter->number_hash,
+                            tenant_id};
+    PGresult* result = execute(store, ctx, "history_count", 6, params);
+    if (PQresultStatus(result) != PGRES_TUPLES_OK) {
+        PQclear(result);
+        return STORE_ERROR;
+    }
+
+    memset(counts, 0, sizeof(*counts));
+    for (int i = 0; i < PQntuples(result); i++) {
+        const char* name = PQgetvalue(result, i, 0);
+        int count = atoi(PQgetvalue(result, i, 1));
+        if (strcmp(name, "valid") == 0) {
+            counts->valid += count;
+        } else if (strcmp(name, "blocked") == 0) {
+            counts->blocked += count;
+        } else {
+            counts->invalid += count;
+        }
+    }
+    PQclear(result);
+    return STORE_OK;
+}
+
+static StoreResult postgres_purge_history(Store* store, const Context* ctx,
+                                          long long created_before, int* purged) {
+    char before_text[24];
+    snprintf(before_text, sizeof(before_text), "%lld", created_before);
+    const char* params[] = {before_text};
+    PGresult* result = execute(store, ctx, "history_purge", 1, params);
+    StoreResult outcome = STORE_ERROR;
+    if (PQresultStatus(result) == PGRES_COMMAND_OK) {
+        *purged = atoi(PQcmdTuples(result));
+        outcome = STORE_OK;
+    }
+    PQclear(result);
+    return outcome;
+}
+
+static StoreResult postgres_scrub_history(Store* store, const Context* ctx,
+                                          long long created_before, int* scrubbed) {
+    char before_text[24];
+    snprintf(before_text, sizeof(before_text), "%lld", created_before);
+    const char* params[] = {before_text};
+    PGresult* result = execute(store, ctx, "history_scrub", 1, params);
+    StoreResult outcome = STORE_ERROR;
+    if (PQresultStatus(result) == PGRES_COMMAND_OK) {
+        *scrubbed = atoi(PQcmdTuples(result));
+        outcome = STORE_OK;
+    }
+    PQclear(result);
+    return outcome;
+}
+
+static StoreResult postgres_erase_history(Store* store, const Context* ctx,
+                                          const char* number_hash, int* erased) {
+    const char* params[] = {number_hash};
+    PGresult* result = execute(store, ctx, "history_erase", 1, params);
+    StoreResult outcome = STORE_ERROR;
+    if (PQresultStatus(result) == PGRES_COMMAND_OK) {
+        *erased = atoi(PQcmdTuples(result));
+        outcome = STORE_OK;
+    }
+    PQclear(result);
+    return outcome;
+}
+
+static StoreResult postgres_add_audit(Store* store, const Context* ctx, AuditEntry* entry) {
+    char timestamp[24];
+    char tenant_id[16];
+    snprintf(timestamp, sizeof(timestamp), "%lld", entry->timestamp);
+    snprintf(tenant_id, sizeof(tenant_id), "%d", entry->tenant_id);
+    const char* params[] = {timestamp, entry->actor, entry->client_ip, entry->action,
+                            entry->target, entry->before, entry->after, tenant_id};
+    PGresult* result = execute(store, ctx, "audit_add", 8, params);
+
+    StoreResult outcome = STORE_ERROR;
+    if (PQresultStatus(result) == PGRES_TUPLES_OK && PQntuples(result) == 1) {
+        entry->id = atoi(PQgetvalue(result, 0, 0));
+        outcome = STORE_OK;
+    }
+    PQclear(result);
+    return outcome;
+}
+
+static StoreResult postgres_list_audit(Store* store, const Context* ctx,
+                                       const AuditFilter* filter,
+                                       AuditEntry** entries, int* count) {
+    char from[24];
+    char to[24];
+    char tenant_id[16];
+    char limit[16];
+    char offset[16];
+    snprintf(from, sizeof(from), "%lld", filter->from);
+    snprintf(to, sizeof(to), "%lld", filter->to);
+    snprintf(tenant_id, sizeof(tenant_id), "%d", filter->tenant_id);
+    snprintf(limit, sizeof(limit), "%d", filter->limit);
+    snprintf(offset, sizeof(offset), "%d", filter->offset);
+    const char* params[] = {from, to, filter->actor, filter->action, filter->target,
+                            tenant_id, limit, offset};
+    PGresult* result = execute(store, ctx, "audit_list", 8, params);
+    if (PQresultStatus(result) != PGRES_TUPLES_OK) {
+        PQclear(result);
+        return STORE_ERROR;
+    }
+
+    *count = PQntuples(result);
+    *entries = malloc(sizeof(AuditEntry) * (*count > 0 ? *count : 1));
+    for (int i = 0; i < *count; i++) {
+        AuditEntry* entry = &(*entries)[i];
+        entry->id = atoi(PQgetvalue(result, i, 0));
+        entry->timestamp = atoll(PQgetvalue(result, i, 1));
+        snprintf(entry->actor, sizeof(entry->actor), "%s", PQgetvalue(result, i, 2));
+        snprintf(entry->client_ip, sizeof(entry->client_ip), "%s", PQgetvalue(result, i, 3));
+        snprintf(entry->action, sizeof(entry->action), "%s", PQgetvalue(result, i, 4));
+        snprintf(entry->target, sizeof(entry->target), "%s", PQgetvalue(result, i, 5));
+        snprintf(entry->before, sizeof(entry->before), "%s", PQgetvalue(result, i, 6));
+        snprintf(entry->after, sizeof(entry->after), "%s", PQgetvalue(result, i, 7));
+        entry->tenant_id = atoi(PQgetvalue(result, i, 8));
+    }
+    PQclear(result);
+    return STORE_OK;
+}
+
+static void read_tenant(PGresult* result, int row, Tenant* tenant) {
+    tenant->id = atoi(PQgetvalue(result, row, 0));
+    snprintf(tenant->name, sizeof(tenant->name), "%s", PQgetvalue(result, row, 1));
+    tenant->rate_limit = atof(PQgetvalue(result, row, 2));
+    tenant->rate_burst = atoi(PQgetvalue(result, row, 3));
+    tenant->created_at = atoll(PQgetvalue(result, row, 4));
+    tenant->monthly_quota = atoll(PQgetvalue(result, row, 5));
+    tenant->suspended = strcmp(PQgetvalue(result, row, 6), "t") == 0;
+    snprintf(tenant->stripe_customer, sizeof(tenant->stripe_customer), "%s",
+             PQgetvalue(result, row, 7));
+    tenant->billing_updated_at = atoll(PQgetvalue(result, row, 8));
+}
+
+// Text for the parameters of tenant_create and tenant_update: $1 is first
+// (created_at or id) and $2 to $8 are the tenant's fields
+typedef struct {
+    char first[24];
+    char rate_limit[32];
+    char rate_burst[16];
+    char monthly_quota[24];
+    char billing_updated_at[24];
+    const char* values[8];
+} TenantParams;
+
+static void tenant_params(const Tenant* tenant, long long first, TenantParams* params) {
+    snprintf(params->first, sizeof(params->first), "%lld", first);
+    snprintf(params->rate_limit, sizeof(params->rate_limit), "%.17g", tenant->rate_limit);
+    snprintf(params->rate_burst, sizeof(params->rate_burst), "%d", tenant->rate_burst);
+    snprintf(params->monthly_quota, sizeof(params->monthly_quota), "%lld", tenant->monthly_quota);
+    snprintf(params->billing_updated_at, sizeof(params->billing_updated_at), "%lld",
+             tenant->billing_updated_at);
+    const char* values[] = {params->first, tenant->name, params->rate_limit, params->rate_burst,
+                            params->monthly_quota, tenant->suspended ? "true" : "false",
+                            tenant->stripe_customer, params->billing_updated_at};
+    memcpy(params->values, values, sizeof(values));
+}
+
+static StoreResult postgres_create_tenant(Store* store, const Context* ctx, Tenant* tenant) {
+    TenantParams params;
+    tenant_params(tenant, tenant->created_at, &params);
+    PGresult* result = execute(store, ctx, "tenant_create", 8, params.values);
+
+    StoreResult outcome = STORE_ERROR;
+    if (PQresultStatus(result) == PGRES_TUPLES_OK && PQntuples(result) == 1) {
+        tenant->id = atoi(PQgetvalue(result, 0, 0));
+        outcome = STORE_OK;
+    }
+    PQclear(result);
+    return outcome;
+}
+
+static StoreResult postgres_get_tenant(Store* store, const Context* ctx, int id, Tenant* tenant) {
+    char id_text[16];
+    snprintf(id_text, sizeof(id_text), "%d", id);
+    const char* params[] = {id_text};
+    PGresult* result = execute(store, ctx, "tenant_get", 1, params);
+
+    StoreResult outcome = STORE_ERROR;
+    if (PQresultStatus(result) == PGRES_TUPLES_OK) {
+        if (PQntuples(result) == 1) {
+            read_tenant(result, 0, tenant);
+            outcome = STORE_OK;
+        } else {
+            outcome = STORE_NOT_FOUND;
+        }
+    }
+    PQclear(result);
+    return outcome;
+}
+
+static StoreResult postgres_list_tenants(Store* store, const Context* ctx, Tenant** tenants,
+                                         int* count) {
+    PGresult* result = execute(store, ctx, "tenant_list", 0, NULL);
+    if (PQresultStatus(result) != PGRES_TUPLES_OK) {
+        PQclear(result);
+        return STORE_ERROR;
+    }
+
+    *count = PQntuples(result);
+    *tenants = malloc(sizeof(Tenant) * (*count > 0 ? *count : 1));
+    for (int i = 0; i < *count; i++) {
+        read_tenant(result, i, &(*tenants)[i]);
+    }
+    PQclear(result);
+    return STORE_OK;
+}
+
+static StoreResult postgres_update_tenant(Store* store, const Context* ctx, const Tenant* tenant) {
+    TenantParams params;
+    tenant_params(tenant, tenant->id, &params);
+    return affected_row_result(execute(store, ctx, "tenant_update", 8, params.values));
+}
+
+// Removes what belonged to the tenant, then the tenant, on one pooled
+// connection in a single transaction
+static StoreResult postgres_remove_tenant(Store* store, const Context* ctx, int id) {
+    static const char* removals[] = {
+        "tenant_remove_keys", "tenant_remove_entries", "tenant_remove_rules",
+        "tenant_remove_profiles", "tenant_remove",
+    };
+    PostgresPool* pool = store->data;
+    PGconn* conn = pool_acquire(pool, ctx);
+    if (!conn) return STORE_ERROR;
+    char error[256];
+    char id_text[16];
+    snprintf(id_text, sizeof(id_text), "%d", id);
+    const char* params[] = {id_text};
+
+    StoreResult outcome = exec_command(conn, "BEGIN", error, sizeof(error)) ? STORE_OK : STORE_ERROR;
+    for (size_t i = 0; i < sizeof(removals) / sizeof(removals[0]) && outcome == STORE_OK; i++) {
+        PGresult* result = exec_prepared(conn, ctx, removals[i], 1, params);
+        if (PQresultStatus(result) != PGRES_COMMAND_OK) {
+            outcome = STORE_ERROR;
+        } else if (i == sizeof(removals) / sizeof(removals[0]) - 1 &&
+                   atoi(PQcmdTuples(result)) == 0) {
+            outcome = STORE_NOT_FOUND;
+        }
+        PQclear(result);
+    }
+    if (outcome == STORE_OK && !exec_command(conn, "COMMIT", error, sizeof(error))) {
+        outcome = STORE_ERROR;
+    }
+    if (outcome != STORE_OK) {
+        exec_command(conn, "ROLLBACK", error, sizeof(error));
+    }
+
+    pool_release(pool, conn);
+    return outcome;
+}
+
+static StoreResult postgres_add_usage(Store* store, const Context* ctx, int tenant_id,
+                                      const char* month, long long count) {
+    char tenant_text[16];
+    char count_text[24];
+    snprintf(tenant_text, sizeof(tenant_text), "%d", tenant_id);
+    snprintf(count_text, sizeof(count_text), "%lld", count);
+    const char* params[] = {tenant_text, month, count_text};
+    PGresult* result = execute(store, ctx, "usage_add", 3, params);
+    StoreResult outcome = PQresultStatus(result) == PGRES_COMMAND_OK ? STORE_OK : STORE_ERROR;
+    PQclear(result);
+    return outcome;
+}
+
+static StoreResult postgres_get_usage(Store* store, const Context* ctx, int tenant_id,
+                                      const char* month, TenantUsage* usage) {
+    char tenant_text[16];
+    snprintf(tenant_text, sizeof(tenant_text), "%d", tenant_id);
+    const char* params[] = {tenant_text, month};
+    PGresult* result = execute(store, ctx, "usage_get", 2, params);
+
+    StoreResult outcome = STORE_ERROR;
+    if (PQresultStatus(result) == PGRES_TUPLES_OK) {
+        usage->tenant_id = tenant_id;
+        snprintf(usage->month, sizeof(usage->month), "%s", month);
+        usage->validations = PQntuples(result) == 1 ? atoll(PQgetvalue(result, 0, 0)) : 0;
+        outcome = STORE_OK;
+    }
+    PQclear(result);
+    return outcome;
+}
+
+static StoreResult postgres_list_usage(Store* store, const Context* ctx, int tenant_id,
+                                       TenantUsage** usage, int* count) {
+    char tenant_text[16];
+    snprintf(tenant_text, sizeof(tenant_text), "%d", tenant_id);
+    const char* params[] = {tenant_text};
+    PGresult* result = execute(store, ctx, "usage_list", 1, params);
+    if (PQresultStatus(result) != PGRES_TUPLES_OK) {
+        PQclear(result);
+        return STORE_ERROR;
+    }
+
+    *count = PQntuples(result);
+    *usage = malloc(sizeof(TenantUsage) * (*count > 0 ? *count : 1));
+    for (int i = 0; i < *count; i++) {
+        TenantUsage* row = &(*usage)[i];
+        row->tenant_id = atoi(PQgetvalue(result, i, 0));
+        snprintf(row->month, sizeof(row->month), "%s", PQgetvalue(result, i, 1));
+        row->validations = atoll(PQgetvalue(result, i, 2));
+    }
+    PQclear(result);
+    return STORE_OK;
+}
+
+static StoreResult postgres_ping(Store* store, const Context* ctx) {
+    PostgresPool* pool = store->data;
+    PGconn* conn = pool_acquire(pool, ctx);
+    if (!conn) return STORE_ERROR;
+    PGresult* result = PQexec(conn, "SELECT 1");
+    StoreResult outcome = PQresultStatus(result) == PGRES_TUPLES_OK ? STORE_OK : STORE_ERROR;
+    PQclear(result);
+    pool_release(pool, conn);
+    return outcome;
+}
+
+static void postgres_close(Store* store) {
+    PostgresPool* pool = store->data;
+    for (int i = 0; i < pool->size; i++) {
+        PQfinish(pool->connections[i]);
+    }
+    pthread_mutex_destroy(&pool->lock);
+    pthread_cond_destroy(&pool->available);
+    free(pool->connections);
+    free(pool->in_use);
+    free(pool);
+    free(store);
+}
+
+Store* postgres_store_open(const char* conninfo, int pool_size, const StoreOptions* options,
+                           char* error, size_t error_size) {
+    PostgresPool* pool = calloc(1, sizeof(PostgresPool));
+    pool->connections = calloc(pool_size, sizeof(PGconn*));
+    pool->in_use = calloc(pool_size, sizeof(bool));
+    pthread_mutex_init(&pool->lock, NULL);
+    pthread_cond_init(&pool->available, NULL);
+
+    Store* store = calloc(1, sizeof(Store));
+    store->name = "postgres";
+    store->create = postgres_create;
+    store->get = postgres_get;
+    store->list = postgres_list;
+    store->update = postgres_update;
+    store->link_user = postgres_link_user;
+    store->flag_phone = postgres_flag_phone;
+    store->rewrite_user = postgres_rewrite_user;
+    store->find_duplicate = postgres_find_duplicate;
+    store->find_by_phone = postgres_find_by_phone;
+    store->find_by_index = postgres_find_by_index;
+    store->search_users = postgres_search_users;
+    store->remove = postgres_remove;
+    store->restore = postgres_restore;
+    store->purge_users = postgres_purge_users;
+    store->erase_user = postgres_erase_user;
+    store->create_entry = postgres_create_entry;
+    store->list_entries = postgres_list_entries;
+    store->remove_entry = postgres_remove_entry;
+    store->create_rule = postgres_create_rule;
+    store->list_rules = postgres_list_rules;
+    store->update_rule = postgres_update_rule;
+    store->remove_rule = postgres_remove_rule;
+    store->create_profile = postgres_create_profile;
+    store->list_profiles = postgres_list_profiles;
+    store->update_profile = postgres_update_profile;
+    store->remove_profile = postgres_remove_profile;
+    store->create_key = postgres_create_key;
+    store->find_key = postgres_find_key;
+    store->list_keys = postgres_list_keys;
+    store->remove_key = postgres_remove_key;
+    store->add_history = postgres_add_history;
+    store->list_history = postgres_list_history;
+    store->count_history = postgres_count_history;
+    store->purge_history = postgres_purge_history;
+    store->scrub_history = postgres_scrub_history;
+    store->erase_history = postgres_erase_history;
+    store->add_audit = postgres_add_audit;
+    store->list_audit = postgres_list_audit;
+    store->create_tenant = postgres_create_tenant;
+    store->get_tenant = postgres_get_tenant;
+    store->list_tenants = postgres_list_tenants;
+    store->update_tenant = postgres_update_tenant;
+    store->remove_tenant = postgres_remove_tenant;
+    store->add_usage = postgres_add_usage;
+    store->get_usage = postgres_get_usage;
+    store->list_usage = postgres_list_usage;
+    store->ping = postgres_ping;
+    store->close = postgres_close;
+    store->data = pool;
+
+    for (int i = 0; i < pool_size; i++) {
+        PGconn* conn = PQconnectdb(conninfo);
+        pool->connections[i] = conn;
+        pool->size = i + 1;
+
+        if (PQstatus(conn) != CONNECTION_OK) {
+            snprintf(error, error_size, "cannot connect: %s", PQerrorMessage(conn));
+            postgres_close(store);
+            return NULL;
+        }
+
+        // The first connection brings the schema up to date before any
+        // statements are prepared against it
+        if ((i == 0 && !migrate_on_open(conn, options->migrate, error, error_size)) ||
+            !prepare_statements(conn, error, error_size)) {
+            postgres_close(store);
+            return NULL;
+        }
+    }
+
+    return store;
+}
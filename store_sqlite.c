@@ -0,0 +1,1794 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <ctype.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <sqlite3.h>
+
+#include "store.h"
+
+// Milliseconds a statement waits on another process's lock, such as the
+// sqlite3 shell's, before failing with SQLITE_BUSY
+#define BUSY_TIMEOUT 5000
+
+typedef struct {
+    sqlite3* db;
+    bool backup;            // Copy the database to PATH.bak on close
+} SqliteStore;
+
+static sqlite3* database(Store* store) {
+    return ((SqliteStore*)store->data)->db;
+}
+
+// migrations/sqlite/, see migrate.h
+static const Migration migrations[] = {
+#include "migrations/sqlite.inc"
+};
+
+// Columns added after the first release and before migrations were
+// versioned, which a database from then may lack. The baseline migration's
+// CREATE TABLE IF NOT EXISTS leaves an existing table as it was, so they
+// are added ahead of it.
+static const struct {
+    const char* table;
+    const char* column;
+    const char* definition;
+} added_columns[] = {
+    {"users", "phone", "TEXT NOT NULL DEFAULT ''"},
+    {"number_lists", "tenant_id", "INTEGER NOT NULL DEFAULT 0"},
+    {"validation_rules", "tenant_id", "INTEGER NOT NULL DEFAULT 0"},
+    {"validation_history", "tenant_id", "INTEGER NOT NULL DEFAULT 0"},
+    {"api_keys", "tenant_id", "INTEGER NOT NULL DEFAULT 0"},
+    {"tenants", "monthly_quota", "INTEGER NOT NULL DEFAULT 0"},
+    {"tenants", "suspended", "INTEGER NOT NULL DEFAULT 0"},
+    {"tenants", "stripe_customer", "TEXT NOT NULL DEFAULT ''"},
+    {"tenants", "billing_updated_at", "INTEGER NOT NULL DEFAULT 0"},
+    {"users", "deleted_at", "INTEGER NOT NULL DEFAULT 0"},
+    {"users", "wp_id", "INTEGER NOT NULL DEFAULT 0"},
+    {"users", "wp_phone", "TEXT NOT NULL DEFAULT ''"},
+    {"users", "phone_invalid_since", "INTEGER NOT NULL DEFAULT 0"},
+    {"users", "phone_invalid_reason", "TEXT NOT NULL DEFAULT ''"},
+    {"api_keys", "sandbox", "INTEGER NOT NULL DEFAULT 0"},
+};
+
+static bool has_table(sqlite3* db, const char* table) {
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "SELECT 1 FROM sqlite_master WHERE name = ?", -1, &stmt,
+                           NULL) != SQLITE_OK) {
+        return false;
+    }
+    sqlite3_bind_text(stmt, 1, table, -1, SQLITE_STATIC);
+    bool found = sqlite3_step(stmt) == SQLITE_ROW;
+    sqlite3_finalize(stmt);
+    return found;
+}
+
+static bool has_column(sqlite3* db, const char* table, const char* column) {
+    char sql[128];
+    snprintf(sql, sizeof(sql), "PRAGMA table_info(%s)", table);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, sql, -1, &stmt, NULL) != SQLITE_OK) return false;
+
+    bool found = false;
+    while (!found && sqlite3_step(stmt) == SQLITE_ROW) {
+        const unsigned char* name = sqlite3_column_text(stmt, 1);
+        found = name && strcmp((const char*)name, column) == 0;
+    }
+    sqlite3_finalize(stmt);
+    return found;
+}
+
+// Tables the database doesn't have yet are left to the baseline
+static bool add_missing_columns(sqlite3* db, char* error, size_t error_size) {
+    for (size_t i = 0; i < sizeof(added_columns) / sizeof(added_columns[0]); i++) {
+        if (!has_table(db, added_columns[i].table) ||
+            has_column(db, added_columns[i].table, added_columns[i].column)) {
+            continue;
+        }
+
+        char sql[256];
+        snprintf(sql, sizeof(sql), "ALTER TABLE %s ADD COLUMN %s %s", added_columns[i].table,
+                 added_columns[i].column, added_columns[i].definition);
+        char* message = NULL;
+        if (sqlite3_exec(db, sql, NULL, NULL, &message) != SQLITE_OK) {
+            snprintf(error, error_size, "cannot add %s.%s: %s", added_columns[i].table,
+                     added_columns[i].column, message);
+            sqlite3_free(message);
+            return false;
+        }
+    }
+    return true;
+}
+
+static bool migration_exec(void* db, const char* sql, char* error, size_t error_size) {
+    char* message = NULL;
+    if (sqlite3_exec(db, sql, NULL, NULL, &message) != SQLITE_OK) {
+        snprintf(error, error_size, "%s", message ? message : sqlite3_errmsg(db));
+        sqlite3_free(message);
+        return false;
+    }
+    return true;
+}
+
+static bool migration_query_int(void* db, const char* sql, int* value, char* error,
+                                size_t error_size) {
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, sql, -1, &stmt, NULL) != SQLITE_OK) {
+        snprintf(error, error_size, "%s", sqlite3_errmsg(db));
+        return false;
+    }
+    bool ok = sqlite3_step(stmt) == SQLITE_ROW;
+    if (ok) *value = sqlite3_column_int(stmt, 0);
+    else snprintf(error, error_size, "%s", sqlite3_errmsg(db));
+    sqlite3_finalize(stmt);
+    return ok;
+}
+
+// The migrator for db. A database from before versioned migrations, with
+// tables but no version yet, first has the columns it lacks added.
+static bool open_migrator(sqlite3* db, Migrator* migrator, char* error, size_t error_size) {
+    *migrator = (Migrator){
+        .name = "SQLite",
+        .migrations = migrations,
+        .count = (int)(sizeof(migrations) / sizeof(migrations[0])),
+        .table = "schema_migrations",
+        .version_table = "CREATE TABLE IF NOT EXISTS schema_migrations ("
+                         "  version INTEGER PRIMARY KEY,"
+                         "  applied_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))"
+                         ")",
+        .db = db,
+        .exec = migration_exec,
+        .query_int = migration_query_int,
+    };
+    int current;
+    if (!migrate_current(migrator, &current, error, error_size)) return false;
+    return current > 0 || add_missing_columns(db, error, error_size);
+}
+
+static void copy_column(sqlite3_stmt* stmt, int column, char* out, size_t out_size) {
+    const unsigned char* text = sqlite3_column_text(stmt, column);
+    snprintf(out, out_size, "%s", text ? (const char*)text : "");
+}
+
+// In the order read_user() reads them
+#define USER_COLUMNS \
+    "id, name, email, phone, deleted_at, wp_id, wp_phone, phone_invalid_since, phone_invalid_reason, " \
+    "email_index, phone_index"
+
+static void read_user(sqlite3_stmt* stmt, User* user) {
+    user->id = sqlite3_column_int(stmt, 0);
+    copy_column(stmt, 1, user->name, sizeof(user->name));
+    copy_column(stmt, 2, user->email, sizeof(user->email));
+    copy_column(stmt, 3, user->phone, sizeof(user->phone));
+    user->deleted_at = sqlite3_column_int64(stmt, 4);
+    user->wp_id = sqlite3_column_int(stmt, 5);
+    copy_column(stmt, 6, user->wp_phone, sizeof(user->wp_phone));
+    user->phone_invalid_since = sqlite3_column_int64(stmt, 7);
+    copy_column(stmt, 8, user->phone_invalid_reason, sizeof(user->phone_invalid_reason));
+    copy_column(stmt, 9, user->email_index, sizeof(user->email_index));
+    copy_column(stmt, 10, user->phone_index, sizeof(user->phone_index));
+}
+
+// Virtual machine instructions between checks of a statement's Context
+#define PROGRESS_INSTRUCTIONS 10000
+
+// The Context of the statement this thread is stepping. The connection is
+// shared, so its one progress handler can't be handed a request's Context
+// directly; the handler runs on the stepping thread and looks here.
+static _Thread_local const Context* stepping;
+
+// Progress handler: returning non-zero interrupts the statement
+static int check_progress(void* unused) {
+    return context_done(stepping);
+}
+
+// sqlite3_step() that stops with SQLITE_INTERRUPT once ctx is done
+static int step(const Context* ctx, sqlite3_stmt* stmt) {
+    stepping = ctx;
+    int rc = sqlite3_step(stmt);
+    stepping = NULL;
+    return rc;
+}
+
+// sqlite3_last_insert_rowid() and sqlite3_changes() are per connection, so
+// writers hold the connection mutex until they have read them back
+static StoreResult sqlite_create(Store* store, const Context* ctx, User* user) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "INSERT INTO users (name, email, phone, email_index, phone_index) "
+                               "VALUES (?, ?, ?, ?, ?)",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_text(stmt, 1, user->name, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 2, user->email, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 3, user->phone, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 4, user->email_index, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 5, user->phone_index, -1, SQLITE_TRANSIENT);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        user->id = (int)sqlite3_last_insert_rowid(db);
+        result = STORE_OK;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_get(Store* store, const Context* ctx, int id, User* user) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "SELECT " USER_COLUMNS " FROM users WHERE id = ?",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_int(stmt, 1, id);
+
+    StoreResult result;
+    int rc = step(ctx, stmt);
+    if (rc == SQLITE_ROW) {
+        read_user(stmt, user);
+        result = STORE_OK;
+    } else {
+        result = rc == SQLITE_DONE ? STORE_NOT_FOUND : STORE_ERROR;
+    }
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+// ?1 is the query as a LIKE pattern, '' to match everyone, ?4 a
+// UserDeleted and ?5 whether only flagged phones count. LIKE ignores case
+// for ASCII.
+#define USER_FILTER_WHERE \
+    "WHERE (?1 = '' OR name LIKE ?1 ESCAPE '\\' OR email LIKE ?1 ESCAPE '\\' " \
+    "OR phone LIKE ?1 ESCAPE '\\') AND (?4 = 1 OR (deleted_at <> 0) = (?4 = 2)) " \
+    "AND (?5 = 0 OR phone_invalid_since <> 0)"
+
+static StoreResult sqlite_list(Store* store, const Context* ctx, const UserFilter* filter,
+                               User** users, int* count, int* total) {
+    sqlite3* db = database(store);
+    char pattern[300];
+    user_query_pattern(filter->query, pattern, sizeof(pattern));
+
+    // The sort column comes from user_sort_string(), never from the request
+    const char* direction = filter->descending ? "DESC" : "ASC";
+    char sql[768];
+    snprintf(sql, sizeof(sql),
+             "SELECT " USER_COLUMNS " FROM users " USER_FILTER_WHERE " "
+             "ORDER BY %s COLLATE NOCASE %s, id %s LIMIT ?2 OFFSET ?3",
+             user_sort_string(filter->sort), direction, direction);
+
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "SELECT COUNT(*) FROM users " USER_FILTER_WHERE,
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_text(stmt, 1, pattern, -1, SQLITE_STATIC);
+    sqlite3_bind_int(stmt, 4, filter->deleted);
+    sqlite3_bind_int(stmt, 5, filter->phone_invalid);
+    int rc = step(ctx, stmt);
+    *total = sqlite3_column_int(stmt, 0);
+    sqlite3_finalize(stmt);
+    if (rc != SQLITE_ROW) return STORE_ERROR;
+
+    if (sqlite3_prepare_v2(db, sql, -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_text(stmt, 1, pattern, -1, SQLITE_STATIC);
+    sqlite3_bind_int(stmt, 2, filter->limit);
+    sqlite3_bind_int(stmt, 3, filter->offset);
+    sqlite3_bind_int(stmt, 4, filter->deleted);
+    sqlite3_bind_int(stmt, 5, filter->phone_invalid);
+
+    *users = malloc(sizeof(User) * (filter->limit > 0 ? filter->limit : 1));
+    *count = 0;
+
+    while ((rc = step(ctx, stmt)) == SQLITE_ROW && *count < filter->limit) {
+        read_user(stmt, &(*users)[(*count)++]);
+    }
+    sqlite3_finalize(stmt);
+
+    if (rc != SQLITE_DONE && rc != SQLITE_ROW) {
+        free(*users);
+        *users = NULL;
+        *count = 0;
+        return STORE_ERROR;
+    }
+    return STORE_OK;
+}
+
+static StoreResult sqlite_update(Store* store, const Context* ctx, const User* user) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    // The right hand sides see the row as it was, phone included
+    if (sqlite3_prepare_v2(db, "UPDATE users SET name = ?1, email = ?2, phone = ?3, "
+                               "phone_invalid_since = CASE WHEN phone = ?3 "
+                               "THEN phone_invalid_since ELSE 0 END, "
+                               "phone_invalid_reason = CASE WHEN phone = ?3 "
+                               "THEN phone_invalid_reason ELSE '' END, "
+                               "email_index = ?5, phone_index = ?6 "
+                               "WHERE id = ?4 AND deleted_at = 0",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_text(stmt, 1, user->name, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 2, user->email, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 3, user->phone, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_int(stmt, 4, user->id);
+    sqlite3_bind_text(stmt, 5, user->email_index, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 6, user->phone_index, -1, SQLITE_TRANSIENT);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        result = sqlite3_changes(db) > 0 ? STORE_OK : STORE_NOT_FOUND;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_link_user(Store* store, const Context* ctx, int id, int wp_id,
+                                    const char* wp_phone) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "UPDATE users SET wp_id = ?, wp_phone = ? "
+                               "WHERE id = ? AND deleted_at = 0",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_int(stmt, 1, wp_id);
+    sqlite3_bind_text(stmt, 2, wp_phone, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_int(stmt, 3, id);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        result = sqlite3_changes(db) > 0 ? STORE_OK : STORE_NOT_FOUND;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_flag_phone(Store* store, const Context* ctx, int id, const char* phone,
+                                     long long invalid_since, const char* reason) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "UPDATE users SET phone_invalid_since = ?, phone_invalid_reason = ? "
+                               "WHERE id = ? AND phone = ? AND deleted_at = 0",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_int64(stmt, 1, invalid_since);
+    sqlite3_bind_text(stmt, 2, reason, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_int(stmt, 3, id);
+    sqlite3_bind_text(stmt, 4, phone, -1, SQLITE_TRANSIENT);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        result = sqlite3_changes(db) > 0 ? STORE_OK : STORE_NOT_FOUND;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_rewrite_user(Store* store, const Context* ctx, const User* from,
+                                       const User* to) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "UPDATE users SET email = ?1, phone = ?2, wp_phone = ?3, "
+                               "email_index = ?8, phone_index = ?9 "
+                               "WHERE id = ?4 AND email = ?5 AND phone = ?6 AND wp_phone = ?7",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_text(stmt, 1, to->email, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 2, to->phone, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 3, to->wp_phone, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_int(stmt, 4, from->id);
+    sqlite3_bind_text(stmt, 5, from->email, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 6, from->phone, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 7, from->wp_phone, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 8, to->email_index, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 9, to->phone_index, -1, SQLITE_TRANSIENT);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        result = sqlite3_changes(db) > 0 ? STORE_OK : STORE_NOT_FOUND;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_find_duplicate(Store* store, const Context* ctx, const User* user,
+                                         User* existing) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "SELECT " USER_COLUMNS " FROM users "
+                               "WHERE id <> ?1 AND deleted_at = 0 AND (email = ?2 COLLATE NOCASE "
+                               "OR (?3 <> '' AND phone = ?3)) ORDER BY id LIMIT 1",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_int(stmt, 1, user->id);
+    sqlite3_bind_text(stmt, 2, user->email, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 3, user->phone, -1, SQLITE_TRANSIENT);
+
+    StoreResult result;
+    int rc = step(ctx, stmt);
+    if (rc == SQLITE_ROW) {
+        read_user(stmt, existing);
+        result = STORE_OK;
+    } else {
+        result = rc == SQLITE_DONE ? STORE_NOT_FOUND : STORE_ERROR;
+    }
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+// Served by the users_phone index
+static StoreResult sqlite_find_by_phone(Store* store, const Context* ctx, const char* phone,
+                                        User** users, int* count) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "SELECT " USER_COLUMNS " FROM users "
+                               "WHERE phone = ?1 AND ?1 <> '' AND deleted_at = 0 ORDER BY id",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_text(stmt, 1, phone, -1, SQLITE_TRANSIENT);
+
+    int capacity = 4;
+    *users = malloc(sizeof(User) * capacity);
+    *count = 0;
+
+    int rc;
+    while ((rc = step(ctx, stmt)) == SQLITE_ROW) {
+        if (*count == capacity) {
+            capacity *= 2;
+            *users = realloc(*users, sizeof(User) * capacity);
+        }
+        read_user(stmt, &(*users)[(*count)++]);
+    }
+    sqlite3_finalize(stmt);
+
+    if (rc != SQLITE_DONE) {
+        free(*users);
+        *users = NULL;
+        *count = 0;
+        return STORE_ERROR;
+    }
+    return STORE_OK;
+}
+
+// Served by the users_email_index and users_phone_index indexes
+static StoreResult sqlite_find_by_index(Store* store, const Context* ctx,
+                                        const char* email_index, const char* phone_index,
+                                        User** users, int* count) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "SELECT " USER_COLUMNS " FROM users "
+                               "WHERE deleted_at = 0 AND (email_index = ?1 OR email_index = '' "
+                               "OR (?2 <> '' AND phone_index = ?2)) ORDER BY id",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_text(stmt, 1, email_index, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 2, phone_index, -1, SQLITE_TRANSIENT);
+
+    int capacity = 4;
+    *users = malloc(sizeof(User) * capacity);
+    *count = 0;
+
+    int rc;
+    while ((rc = step(ctx, stmt)) == SQLITE_ROW) {
+        if (*count == capacity) {
+            capacity *= 2;
+            *users = realloc(*users, sizeof(User) * capacity);
+        }
+        read_user(stmt, &(*users)[(*count)++]);
+    }
+    sqlite3_finalize(stmt);
+
+    if (rc != SQLITE_DONE) {
+        free(*users);
+        *users = NULL;
+        *count = 0;
+        return STORE_ERROR;
+    }
+    return STORE_OK;
+}
+
+// Appends the words of text to an FTS5 query as one phrase, the last word
+// a prefix, so "example.co" finds "example.com". Returns false, appending
+// nothing, if text has no words.
+static bool append_phrase(char* out, size_t out_size, const char* prefix, const char* text) {
+    char phrase[80];
+    size_t len = 0;
+    bool words = false;
+    for (const char* p = text; *p && len + 1 < sizeof(phrase); p++) {
+        unsigned char c = (unsigned char)*p;
+        words = words || isalnum(c) || c >= 0x80;
+        phrase[len++] = isalnum(c) || c >= 0x80 ? *p : ' ';
+    }
+    phrase[len] = '\0';
+    if (!words) return false;
+
+    len = strlen(out);
+    snprintf(out + len, out_size - len, "%s%s\"%s\"*", out[0] ? " AND " : "", prefix, phrase);
+    return true;
+}
+
+// Narrows the search to at most USER_SEARCH_CANDIDATES users: words and
+// domains through users_fts, best first, and phone prefixes through the
+// users_phone index, then ranks them as every backend does
+static StoreResult sqlite_search_users(Store* store, const Context* ctx, const char* query,
+                                       int limit, UserMatch** matches, int* count) {
+    SearchTerm terms[USER_SEARCH_TERMS];
+    int term_count = user_search_terms(query, terms);
+
+    char match[USER_SEARCH_TERMS * 80] = "";
+    for (int i = 0; i < term_count; i++) {
+        if (terms[i].kind == SEARCH_TERM_WORD) {
+            append_phrase(match, sizeof(match), "", terms[i].text);
+        } else if (terms[i].kind == SEARCH_TERM_DOMAIN) {
+            append_phrase(match, sizeof(match), "email : ", terms[i].text);
+        }
+    }
+
+    char sql[1024];
+    int len = snprintf(sql, sizeof(sql), "SELECT " USER_COLUMNS " FROM users WHERE deleted_at = 0");
+    if (match[0]) {
+        len += snprintf(sql + len, sizeof(sql) - len,
+                        " AND id IN (SELECT rowid FROM users_fts WHERE users_fts MATCH ?1"
+                        " ORDER BY rank LIMIT %d)", USER_SEARCH_CANDIDATES);
+    }
+    char globs[USER_SEARCH_TERMS][sizeof(terms[0].text) + 2];
+    int glob_count = 0;
+    for (int i = 0; i < term_count; i++) {
+        if (terms[i].kind != SEARCH_TERM_PHONE) continue;
+        snprintf(globs[glob_count], sizeof(globs[0]), "%s%s*",
+                 terms[i].text[0] == '+' ? "" : "*", terms[i].text);
+        glob_count++;
+        len += snprintf(sql + len, sizeof(sql) - len, " AND phone GLOB ?%d", 1 + glob_count);
+    }
+    snprintf(sql + len, sizeof(sql) - len, " LIMIT %d", USER_SEARCH_CANDIDATES);
+
+    if (!match[0] && glob_count == 0) {
+        user_search_rank(NULL, 0, terms, term_count, limit, matches, count);
+        return STORE_OK;
+    }
+
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, sql, -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_text(stmt, 1, match, -1, SQLITE_TRANSIENT);
+    for (int i = 0; i < glob_count; i++) {
+        sqlite3_bind_text(stmt, 2 + i, globs[i], -1, SQLITE_TRANSIENT);
+    }
+
+    int capacity = 16;
+    User* candidates = malloc(sizeof(User) * capacity);
+    int candidate_count = 0;
+
+    int rc;
+    while ((rc = step(ctx, stmt)) == SQLITE_ROW) {
+        if (candidate_count == capacity) {
+            capacity *= 2;
+            candidates = realloc(candidates, sizeof(User) * capacity);
+        }
+        read_user(stmt, &candidates[candidate_count++]);
+    }
+    sqlite3_finalize(stmt);
+
+    if (rc != SQLITE_DONE) {
+        free(candidates);
+        return STORE_ERROR;
+    }
+    user_search_rank(candidates, candidate_count, terms, term_count, limit, matches, count);
+    free(candidates);
+    return STORE_OK;
+}
+
+static StoreResult sqlite_remove(Store* store, const Context* ctx, int id, long long deleted_at) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "UPDATE users SET deleted_at = ? WHERE id = ? AND deleted_at = 0",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_int64(stmt, 1, deleted_at);
+    sqlite3_bind_int(stmt, 2, id);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        result = sqlite3_changes(db) > 0 ? STORE_OK : STORE_NOT_FOUND;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_restore(Store* store, const Context* ctx, int id) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "UPDATE users SET deleted_at = 0 WHERE id = ? AND deleted_at <> 0",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_int(stmt, 1, id);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        result = sqlite3_changes(db) > 0 ? STORE_OK : STORE_NOT_FOUND;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_purge_users(Store* store, const Context* ctx, long long deleted_before,
+                                      int* purged) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "DELETE FROM users WHERE deleted_at <> 0 AND deleted_at < ?",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_int64(stmt, 1, deleted_before);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        *purged = sqlite3_changes(db);
+        result = STORE_OK;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_erase_user(Store* store, const Context* ctx, int id) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "DELETE FROM users WHERE id = ?", -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_int(stmt, 1, id);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        result = sqlite3_changes(db) > 0 ? STORE_OK : STORE_NOT_FOUND;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static void read_entry(sqlite3_stmt* stmt, ListEntry* entry) {
+    char name[16];
+    entry->id = sqlite3_column_int(stmt, 0);
+    copy_column(stmt, 1, name, sizeof(name));
+    list_name_parse(name, &entry->list);
+    copy_column(stmt, 2, name, sizeof(name));
+    list_match_parse(name, &entry->match);
+    copy_column(stmt, 3, entry->value, sizeof(entry->value));
+    copy_column(stmt, 4, entry->reason, sizeof(entry->reason));
+    entry->tenant_id = sqlite3_column_int(stmt, 5);
+}
+
+static StoreResult sqlite_create_entry(Store* store, const Context* ctx, ListEntry* entry) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "INSERT INTO number_lists (list, match, value, reason, tenant_id) "
+                           "VALUES (?, ?, ?, ?, ?)", -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_text(stmt, 1, list_name_string(entry->list), -1, SQLITE_STATIC);
+    sqlite3_bind_text(stmt, 2, list_match_string(entry->match), -1, SQLITE_STATIC);
+    sqlite3_bind_text(stmt, 3, entry->value, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 4, entry->reason, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_int(stmt, 5, entry->tenant_id);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        entry->id = (int)sqlite3_last_insert_rowid(db);
+        result = STORE_OK;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_list_entries(Store* store, const Context* ctx, ListEntry** entries,
+                                       int* count) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "SELECT id, list, match, value, reason, tenant_id FROM number_lists "
+                           "ORDER BY id",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+
+    int capacity = 16;
+    *entries = malloc(sizeof(ListEntry) * capacity);
+    *count = 0;
+
+    int rc;
+    while ((rc = step(ctx, stmt)) == SQLITE_ROW) {
+        if (*count == capacity) {
+            capacity *= 2;
+            *entries = realloc(*entries, sizeof(ListEntry) * capacity);
+        }
+        read_entry(stmt, &(*entries)[(*count)++]);
+    }
+    sqlite3_finalize(stmt);
+
+    if (rc != SQLITE_DONE) {
+        free(*entries);
+        *entries = NULL;
+        *count = 0;
+        return STORE_ERROR;
+    }
+    return STORE_OK;
+}
+
+static StoreResult sqlite_remove_entry(Store* store, const Context* ctx, ListName list, int id) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "DELETE FROM number_lists WHERE id = ? AND list = ?",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_int(stmt, 1, id);
+    sqlite3_bind_text(stmt, 2, list_name_string(list), -1, SQLITE_STATIC);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        result = sqlite3_changes(db) > 0 ? STORE_OK : STORE_NOT_FOUND;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static void read_rule(sqlite3_stmt* stmt, Rule* rule) {
+    char name[16];
+    rule->id = sqlite3_column_int(stmt, 0);
+    rule->position = sqlite3_column_int(stmt, 1);
+    copy_column(stmt, 2, name, sizeof(name));
+    rule_action_parse(name, &rule->action);
+    copy_column(stmt, 3, name, sizeof(name));
+    rule_match_parse(name, &rule->match);
+    copy_column(stmt, 4, rule->values, sizeof(rule->values));
+    copy_column(stmt, 5, rule->caller, sizeof(rule->caller));
+    copy_column(stmt, 6, rule->reason, sizeof(rule->reason));
+    rule->tenant_id = sqlite3_column_int(stmt, 7);
+}
+
+// Binds position, action, match, values, caller, reason and tenant_id as
+// parameters 1-7
+static void bind_rule(sqlite3_stmt* stmt, const Rule* rule) {
+    sqlite3_bind_int(stmt, 1, rule->position);
+    sqlite3_bind_text(stmt, 2, rule_action_string(rule->action), -1, SQLITE_STATIC);
+    sqlite3_bind_text(stmt, 3, rule_match_string(rule->match), -1, SQLITE_STATIC);
+    sqlite3_bind_text(stmt, 4, rule->values, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 5, rule->caller, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 6, rule->reason, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_int(stmt, 7, rule->tenant_id);
+}
+
+static StoreResult sqlite_create_rule(Store* store, const Context* ctx, Rule* rule) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "INSERT INTO validation_rules "
+                           "(position, action, match, match_values, caller, reason, tenant_id) "
+                           "VALUES (?, ?, ?, ?, ?, ?, ?)", -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    bind_rule(stmt, rule);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        rule->id = (int)sqlite3_last_insert_rowid(db);
+        result = STORE_OK;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_list_rules(Store* store, const Context* ctx, Rule** rules, int* count) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "SELECT id, position, action, match, match_values, caller, reason, "
+                           "tenant_id FROM validation_rules ORDER BY position, id",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+
+    int capacity = 16;
+    *rules = malloc(sizeof(Rule) * capacity);
+    *count = 0;
+
+    int rc;
+    while ((rc = step(ctx, stmt)) == SQLITE_ROW) {
+        if (*count == capacity) {
+            capacity *= 2;
+            *rules = realloc(*rules, sizeof(Rule) * capacity);
+        }
+        read_rule(stmt, &(*rules)[(*count)++]);
+    }
+    sqlite3_finalize(stmt);
+
+    if (rc != SQLITE_DONE) {
+        free(*rules);
+        *rules = NULL;
+        *count = 0;
+        return STORE_ERROR;
+    }
+    return STORE_OK;
+}
+
+static StoreResult sqlite_update_rule(Store* store, const Context* ctx, const Rule* rule) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "UPDATE validation_rules SET position = ?, action = ?, match = ?, "
+                           "match_values = ?, caller = ?, reason = ?, tenant_id = ? WHERE id = ?",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    bind_rule(stmt, rule);
+    sqlite3_bind_int(stmt, 8, rule->id);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        result = sqlite3_changes(db) > 0 ? STORE_OK : STORE_NOT_FOUND;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_remove_rule(Store* store, const Context* ctx, int id) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "DELETE FROM validation_rules WHERE id = ?",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_int(stmt, 1, id);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        result = sqlite3_changes(db) > 0 ? STORE_OK : STORE_NOT_FOUND;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static void read_profile(sqlite3_stmt* stmt, FormProfile* profile) {
+    char plugin[16];
+    profile->id = sqlite3_column_int(stmt, 0);
+    copy_column(stmt, 1, profile->name, sizeof(profile->name));
+    copy_column(stmt, 2, plugin, sizeof(plugin));
+    form_plugin_parse(plugin, &profile->plugin);
+    copy_column(stmt, 3, profile->form_id, sizeof(profile->form_id));
+    copy_column(stmt, 4, profile->fields, sizeof(profile->fields));
+    copy_column(stmt, 5, profile->region, sizeof(profile->region));
+    profile->tenant_id = sqlite3_column_int(stmt, 6);
+}
+
+// Binds name, plugin, form_id, fields, region and tenant_id as parameters 1-6
+static void bind_profile(sqlite3_stmt* stmt, const FormProfile* profile) {
+    sqlite3_bind_text(stmt, 1, profile->name, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 2, form_plugin_string(profile->plugin), -1, SQLITE_STATIC);
+    sqlite3_bind_text(stmt, 3, profile->form_id, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 4, profile->fields, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 5, profile->region, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_int(stmt, 6, profile->tenant_id);
+}
+
+static StoreResult sqlite_create_profile(Store* store, const Context* ctx, FormProfile* profile) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "INSERT INTO form_profiles "
+                           "(name, plugin, form_id, fields, region, tenant_id) "
+                           "VALUES (?, ?, ?, ?, ?, ?)", -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    bind_profile(stmt, profile);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        profile->id = (int)sqlite3_last_insert_rowid(db);
+        result = STORE_OK;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_list_profiles(Store* store, const Context* ctx, FormProfile** profiles,
+                                        int* count) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "SELECT id, name, plugin, form_id, fields, region, tenant_id "
+                           "FROM form_profiles ORDER BY id", -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+
+    int capacity = 16;
+    *profiles = malloc(sizeof(FormProfile) * capacity);
+    *count = 0;
+
+    int rc;
+    while ((rc = step(ctx, stmt)) == SQLITE_ROW) {
+        if (*count == capacity) {
+            capacity *= 2;
+            *profiles = realloc(*profiles, sizeof(FormProfile) * capacity);
+        }
+        read_profile(stmt, &(*profiles)[(*count)++]);
+    }
+    sqlite3_finalize(stmt);
+
+    if (rc != SQLITE_DONE) {
+        free(*profiles);
+        *profiles = NULL;
+        *count = 0;
+        return STORE_ERROR;
+    }
+    return STORE_OK;
+}
+
+static StoreResult sqlite_update_profile(Store* store, const Context* ctx,
+                                         const FormProfile* profile) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "UPDATE form_profiles SET name = ?, plugin = ?, form_id = ?, "
+                           "fields = ?, region = ?, tenant_id = ? WHERE id = ?",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    bind_profile(stmt, profile);
+    sqlite3_bind_int(stmt, 7, profile->id);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        result = sqlite3_changes(db) > 0 ? STORE_OK : STORE_NOT_FOUND;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_remove_profile(Store* store, const Context* ctx, int id) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "DELETE FROM form_profiles WHERE id = ?",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_int(stmt, 1, id);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        result = sqlite3_changes(db) > 0 ? STORE_OK : STORE_NOT_FOUND;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static void read_key(sqlite3_stmt* stmt, ApiKey* key) {
+    key->id = sqlite3_column_int(stmt, 0);
+    copy_column(stmt, 1, key->name, sizeof(key->name));
+    copy_column(stmt, 2, key->key_hash, sizeof(key->key_hash));
+    key->scopes = sqlite3_column_int(stmt, 3);
+    key->created_at = sqlite3_column_int64(stmt, 4);
+    key->tenant_id = sqlite3_column_int(stmt, 5);
+    key->sandbox = sqlite3_column_int(stmt, 6) != 0;
+}
+
+static StoreResult sqlite_create_key(Store* store, const Context* ctx, ApiKey* key) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "INSERT INTO api_keys (name, key_hash, scopes, created_at, tenant_id, "
+                           "sandbox) VALUES (?, ?, ?, ?, ?, ?)", -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_text(stmt, 1, key->name, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_text(stmt, 2, key->key_hash, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_int(stmt, 3, key->scopes);
+    sqlite3_bind_int64(stmt, 4, key->created_at);
+    sqlite3_bind_int(stmt, 5, key->tenant_id);
+    sqlite3_bind_int(stmt, 6, key->sandbox);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        key->id = (int)sqlite3_last_insert_rowid(db);
+        result = STORE_OK;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_find_key(Store* store, const Context* ctx, const char* key_hash,
+                                   ApiKey* key) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "SELECT id, name, key_hash, scopes, created_at, tenant_id, "
+                           "sandbox FROM api_keys WHERE key_hash = ?", -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_text(stmt, 1, key_hash, -1, SQLITE_TRANSIENT);
+
+    StoreResult result;
+    int rc = step(ctx, stmt);
+    if (rc == SQLITE_ROW) {
+        read_key(stmt, key);
+        result = STORE_OK;
+    } else {
+        result = rc == SQLITE_DONE ? STORE_NOT_FOUND : STORE_ERROR;
+    }
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_list_keys(Store* store, const Context* ctx, ApiKey** keys, int* count) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "SELECT id, name, key_hash, scopes, created_at, tenant_id, "
+                           "sandbox FROM api_keys ORDER BY id", -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+
+    int capacity = 16;
+    *keys = malloc(sizeof(ApiKey) * capacity);
+    *count = 0;
+
+    int rc;
+    while ((rc = step(ctx, stmt)) == SQLITE_ROW) {
+        if (*count == capacity) {
+            capacity *= 2;
+            *keys = realloc(*keys, sizeof(ApiKey) * capacity);
+        }
+        read_key(stmt, &(*keys)[(*count)++]);
+    }
+    sqlite3_finalize(stmt);
+
+    if (rc != SQLITE_DONE) {
+        free(*keys);
+        *keys = NULL;
+        *count = 0;
+        return STORE_ERROR;
+    }
+    return STORE_OK;
+}
+
+static StoreResult sqlite_remove_key(Store* store, const Context* ctx, int id) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "DELETE FROM api_keys WHERE id = ?", -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_int(stmt, 1, id);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        result = sqlite3_changes(db) > 0 ? STORE_OK : STORE_NOT_FOUND;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+// One transaction for the whole batch. The connection mutex is recursive,
+// so holding it keeps other threads' statements out of the transaction.
+static StoreResult sqlite_add_history(Store* store, const Context* ctx,
+                                      const HistoryRecord* records, int count) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "INSERT INTO validation_history "
+                           "(created_at, number_hash, caller, source, result, reason, region, "
+                           "tenant_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+
+    StoreResult result = STORE_OK;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (sqlite3_exec(db, "BEGIN", NULL, NULL, NULL) != SQLITE_OK) {
+        result = STORE_ERROR;
+    }
+    for (int i = 0; i < count && result == STORE_OK; i++) {
+        const HistoryRecord* record = &records[i];
+        sqlite3_bind_int64(stmt, 1, record->timestamp);
+        sqlite3_bind_text(stmt, 2, record->number_hash, -1, SQLITE_STATIC);
+        sqlite3_bind_text(stmt, 3, record->caller, -1, SQLITE_STATIC);
+        sqlite3_bind_text(stmt, 4, record->source, -1, SQLITE_STATIC);
+        sqlite3_bind_text(stmt, 5, record->result, -1, SQLITE_STATIC);
+        sqlite3_bind_text(stmt, 6, record->reason, -1, SQLITE_STATIC);
+        sqlite3_bind_text(stmt, 7, record->region, -1, SQLITE_STATIC);
+        sqlite3_bind_int(stmt, 8, record->tenant_id);
+        if (step(ctx, stmt) != SQLITE_DONE) {
+            result = STORE_ERROR;
+        }
+        sqlite3_reset(stmt);
+    }
+    if (result == STORE_OK && sqlite3_exec(db, "COMMIT", NULL, NULL, NULL) != SQLITE_OK) {
+        result = STORE_ERROR;
+    }
+    if (result != STORE_OK) {
+        sqlite3_exec(db, "ROLLBACK", NULL, NULL, NULL);
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static void read_history(sqlite3_stmt* stmt, HistoryRecord* record) {
+    record->id = sqlite3_column_int(stmt, 0);
+    record->timestamp = sqlite3_column_int64(stmt, 1);
+    copy_column(stmt, 2, record->number_hash, sizeof(record->number_hash));
+    copy_column(stmt, 3, record->caller, sizeof(record->caller));
+    copy_column(stmt, 4, record->source, sizeof(record->source));
+    copy_column(stmt, 5, record->result, sizeof(record->result));
+    copy_column(stmt, 6, record->reason, sizeof(record->reason));
+    copy_column(stmt, 7, record->region, sizeof(record->region));
+    record->tenant_id = sqlite3_column_int(stmt, 8);
+}
+
+// ?1 to ?6 are bound by bind_history_filter()
+#define HISTORY_FILTER_WHERE \
+    "WHERE created_at >= ?1 AND (?2 = 0 OR created_at < ?2) AND (?3 = '' OR caller = ?3) " \
+    "AND (?4 = '' OR result = ?4) AND (?5 = '' OR number_hash = ?5) " \
+    "AND (?6 = 0 OR tenant_id = ?6)"
+
+static void bind_history_filter(sqlite3_stmt* stmt, const HistoryFilter* filter) {
+    sqlite3_bind_int64(stmt, 1, filter->from);
+    sqlite3_bind_int64(stmt, 2, filter->to);
+    sqlite3_bind_text(stmt, 3, filter->caller, -1, SQLITE_STATIC);
+    sqlite3_bind_text(stmt, 4, filter->result, -1, SQLITE_STATIC);
+    sqlite3_bind_text(stmt, 5, filter->number_hash, -1, SQLITE_STATIC);
+    sqlite3_bind_int(stmt, 6, filter->tenant_id);
+}
+
+static StoreResult sqlite_list_history(Store* store, const Context* ctx,
+                                       const HistoryFilter* filter,
+                                       HistoryRecord** records, int* count) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "SELECT id, created_at, number_hash, caller, source, result, reason, "
+                           "region, tenant_id FROM validation_history " HISTORY_FILTER_WHERE
+                           " ORDER BY id DESC LIMIT ?7 OFFSET ?8", -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    bind_history_filter(stmt, filter);
+    sqlite3_bind_int(stmt, 7, filter->limit);
+    sqlite3_bind_int(stmt, 8, filter->offset);
+
+    *records = malloc(sizeof(HistoryRecord) * (filter->limit > 0 ? filter->limit : 1));
+    *count = 0;
+
+    int rc;
+    while ((rc = step(ctx, stmt)) == SQLITE_ROW && *count < filter->limit) {
+        read_history(stmt, &(*records)[(*count)++]);
+    }
+    sqlite3_finalize(stmt);
+
+    if (rc != SQLITE_DONE && rc != SQLITE_ROW) {
+        free(*records);
+        *records = NULL;
+        *count = 0;
+        return STORE_ERROR;
+    }
+    return STORE_OK;
+}
+
+static StoreResult sqlite_count_history(Store* store, const Context* ctx,
+                                        const HistoryFilter* filter, HistoryCounts* counts) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "SELECT result, COUNT(*) FROM validation_history "
+                           HISTORY_FILTER_WHERE " GROUP BY result", -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    bind_history_filter(stmt, filter);
+
+    memset(counts, 0, sizeof(*counts));
+    int rc;
+    while ((rc = step(ctx, stmt)) == SQLITE_ROW) {
+        char result[16];
+        copy_column(stmt, 0, result, sizeof(result));
+        int count = sqlite3_column_int(stmt, 1);
+        if (strcmp(result, "valid") == 0) {
+            counts->valid += count;
+        } else if (strcmp(result, "blocked") == 0) {
+            counts->blocked += count;
+        } else {
+            counts->invalid += count;
+        }
+    }
+    sqlite3_finalize(stmt);
+    return rc == SQLITE_DONE ? STORE_OK : STORE_ERROR;
+}
+
+static StoreResult sqlite_purge_history(Store* store, const Context* ctx,
+                                        long long created_before, int* purged) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "DELETE FROM validation_history WHERE created_at < ?",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_int64(stmt, 1, created_before);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        *purged = sqlite3_changes(db);
+        result = STORE_OK;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_scrub_history(Store* store, const Context* ctx,
+                                        long long created_before, int* scrubbed) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "UPDATE validation_history SET number_hash = '' "
+                               "WHERE created_at < ? AND number_hash <> ''",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_int64(stmt, 1, created_before);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        *scrubbed = sqlite3_changes(db);
+        result = STORE_OK;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_erase_history(Store* store, const Context* ctx,
+                                        const char* number_hash, int* erased) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "DELETE FROM validation_history WHERE number_hash = ?",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_text(stmt, 1, number_hash, -1, SQLITE_TRANSIENT);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        *erased = sqlite3_changes(db);
+        result = STORE_OK;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_add_audit(Store* store, const Context* ctx, AuditEntry* entry) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "INSERT INTO audit_log (created_at, actor, client_ip, action, "
+                           "target, before_state, after_state, tenant_id) "
+                           "VALUES (?, ?, ?, ?, ?, ?, ?, ?)", -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_int64(stmt, 1, entry->timestamp);
+    sqlite3_bind_text(stmt, 2, entry->actor, -1, SQLITE_STATIC);
+    sqlite3_bind_text(stmt, 3, entry->client_ip, -1, SQLITE_STATIC);
+    sqlite3_bind_text(stmt, 4, entry->action, -1, SQLITE_STATIC);
+    sqlite3_bind_text(stmt, 5, entry->target, -1, SQLITE_STATIC);
+    sqlite3_bind_text(stmt, 6, entry->before, -1, SQLITE_STATIC);
+    sqlite3_bind_text(stmt, 7, entry->after, -1, SQLITE_STATIC);
+    sqlite3_bind_int(stmt, 8, entry->tenant_id);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        entry->id = (int)sqlite3_last_insert_rowid(db);
+        result = STORE_OK;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_list_audit(Store* store, const Context* ctx, const AuditFilter* filter,
+                                     AuditEntry** entries, int* count) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    // An action without a dot matches every action on that resource
+    if (sqlite3_prepare_v2(db, "SELECT id, created_at, actor, client_ip, action, target, "
+                           "before_state, after_state, tenant_id FROM audit_log "
+                           "WHERE created_at >= ?1 AND (?2 = 0 OR created_at < ?2) "
+                           "AND (?3 = '' OR actor = ?3) AND (?4 = '' OR action = ?4 OR "
+                           "(instr(?4, '.') = 0 AND substr(action, 1, length(?4) + 1) = ?4 || '.')) "
+                           "AND (?5 = '' OR target = ?5) AND (?6 = 0 OR tenant_id = ?6) "
+                           "ORDER BY id DESC LIMIT ?7 OFFSET ?8", -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_int64(stmt, 1, filter->from);
+    sqlite3_bind_int64(stmt, 2, filter->to);
+    sqlite3_bind_text(stmt, 3, filter->actor, -1, SQLITE_STATIC);
+    sqlite3_bind_text(stmt, 4, filter->action, -1, SQLITE_STATIC);
+    sqlite3_bind_text(stmt, 5, filter->target, -1, SQLITE_STATIC);
+    sqlite3_bind_int(stmt, 6, filter->tenant_id);
+    sqlite3_bind_int(stmt, 7, filter->limit);
+    sqlite3_bind_int(stmt, 8, filter->offset);
+
+    *entries = malloc(sizeof(AuditEntry) * (filter->limit > 0 ? filter->limit : 1));
+    *count = 0;
+
+    int rc;
+    while ((rc = step(ctx, stmt)) == SQLITE_ROW && *count < filter->limit) {
+        AuditEntry* entry = &(*entries)[(*count)++];
+        entry->id = sqlite3_column_int(stmt, 0);
+        entry->timestamp = sqlite3_column_int64(stmt, 1);
+        copy_column(stmt, 2, entry->actor, sizeof(entry->actor));
+        copy_column(stmt, 3, entry->client_ip, sizeof(entry->client_ip));
+        copy_column(stmt, 4, entry->action, sizeof(entry->action));
+        copy_column(stmt, 5, entry->target, sizeof(entry->target));
+        copy_column(stmt, 6, entry->before, sizeof(entry->before));
+        copy_column(stmt, 7, entry->after, sizeof(entry->after));
+        entry->tenant_id = sqlite3_column_int(stmt, 8);
+    }
+    sqlite3_finalize(stmt);
+
+    if (rc != SQLITE_DONE && rc != SQLITE_ROW) {
+        free(*entries);
+        *entries = NULL;
+        *count = 0;
+        return STORE_ERROR;
+    }
+    return STORE_OK;
+}
+
+// In the order read_tenant() reads them
+#define TENANT_COLUMNS \
+    "id, name, rate_limit, rate_burst, created_at, monthly_quota, suspended, stripe_customer, " \
+    "billing_updated_at"
+
+static void read_tenant(sqlite3_stmt* stmt, Tenant* tenant) {
+    tenant->id = sqlite3_column_int(stmt, 0);
+    copy_column(stmt, 1, tenant->name, sizeof(tenant->name));
+    tenant->rate_limit = sqlite3_column_double(stmt, 2);
+    tenant->rate_burst = sqlite3_column_int(stmt, 3);
+    tenant->created_at = sqlite3_column_int64(stmt, 4);
+    tenant->monthly_quota = sqlite3_column_int64(stmt, 5);
+    tenant->suspended = sqlite3_column_int(stmt, 6) != 0;
+    copy_column(stmt, 7, tenant->stripe_customer, sizeof(tenant->stripe_customer));
+    tenant->billing_updated_at = sqlite3_column_int64(stmt, 8);
+}
+
+// Binds name, rate_limit, rate_burst, monthly_quota, suspended,
+// stripe_customer and billing_updated_at as parameters 1 to 7
+static void bind_tenant(sqlite3_stmt* stmt, const Tenant* tenant) {
+    sqlite3_bind_text(stmt, 1, tenant->name, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_double(stmt, 2, tenant->rate_limit);
+    sqlite3_bind_int(stmt, 3, tenant->rate_burst);
+    sqlite3_bind_int64(stmt, 4, tenant->monthly_quota);
+    sqlite3_bind_int(stmt, 5, tenant->suspended);
+    sqlite3_bind_text(stmt, 6, tenant->stripe_customer, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_int64(stmt, 7, tenant->billing_updated_at);
+}
+
+static StoreResult sqlite_create_tenant(Store* store, const Context* ctx, Tenant* tenant) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "INSERT INTO tenants (name, rate_limit, rate_burst, monthly_quota, "
+                           "suspended, stripe_customer, billing_updated_at, created_at) "
+                           "VALUES (?, ?, ?, ?, ?, ?, ?, ?)", -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    bind_tenant(stmt, tenant);
+    sqlite3_bind_int64(stmt, 8, tenant->created_at);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        tenant->id = (int)sqlite3_last_insert_rowid(db);
+        result = STORE_OK;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_get_tenant(Store* store, const Context* ctx, int id, Tenant* tenant) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "SELECT " TENANT_COLUMNS " FROM tenants WHERE id = ?", -1, &stmt,
+                           NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_int(stmt, 1, id);
+
+    StoreResult result;
+    int rc = step(ctx, stmt);
+    if (rc == SQLITE_ROW) {
+        read_tenant(stmt, tenant);
+        result = STORE_OK;
+    } else {
+        result = rc == SQLITE_DONE ? STORE_NOT_FOUND : STORE_ERROR;
+    }
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_list_tenants(Store* store, const Context* ctx, Tenant** tenants,
+                                       int* count) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "SELECT " TENANT_COLUMNS " FROM tenants ORDER BY id", -1, &stmt,
+                           NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+
+    int capacity = 16;
+    *tenants = malloc(sizeof(Tenant) * capacity);
+    *count = 0;
+
+    int rc;
+    while ((rc = step(ctx, stmt)) == SQLITE_ROW) {
+        if (*count == capacity) {
+            capacity *= 2;
+            *tenants = realloc(*tenants, sizeof(Tenant) * capacity);
+        }
+        read_tenant(stmt, &(*tenants)[(*count)++]);
+    }
+    sqlite3_finalize(stmt);
+
+    if (rc != SQLITE_DONE) {
+        free(*tenants);
+        *tenants = NULL;
+        *count = 0;
+        return STORE_ERROR;
+    }
+    return STORE_OK;
+}
+
+static StoreResult sqlite_update_tenant(Store* store, const Context* ctx, const Tenant* tenant) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "UPDATE tenants SET name = ?, rate_limit = ?, rate_burst = ?, "
+                           "monthly_quota = ?, suspended = ?, stripe_customer = ?, "
+                           "billing_updated_at = ? WHERE id = ?", -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    bind_tenant(stmt, tenant);
+    sqlite3_bind_int(stmt, 8, tenant->id);
+
+    StoreResult result = STORE_ERROR;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (step(ctx, stmt) == SQLITE_DONE) {
+        result = sqlite3_changes(db) > 0 ? STORE_OK : STORE_NOT_FOUND;
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+// One transaction, so a tenant is never left half removed
+static StoreResult sqlite_remove_tenant(Store* store, const Context* ctx, int id) {
+    static const char* deletes[] = {
+        "DELETE FROM api_keys WHERE tenant_id = ?",
+        "DELETE FROM number_lists WHERE tenant_id = ?",
+        "DELETE FROM validation_rules WHERE tenant_id = ?",
+        "DELETE FROM form_profiles WHERE tenant_id = ?",
+        "DELETE FROM tenants WHERE id = ?",
+    };
+    sqlite3* db = database(store);
+
+    StoreResult result = STORE_OK;
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    if (sqlite3_exec(db, "BEGIN", NULL, NULL, NULL) != SQLITE_OK) {
+        result = STORE_ERROR;
+    }
+    for (size_t i = 0; i < sizeof(deletes) / sizeof(deletes[0]) && result == STORE_OK; i++) {
+        sqlite3_stmt* stmt;
+        if (sqlite3_prepare_v2(db, deletes[i], -1, &stmt, NULL) != SQLITE_OK) {
+            result = STORE_ERROR;
+            break;
+        }
+        sqlite3_bind_int(stmt, 1, id);
+        if (step(ctx, stmt) != SQLITE_DONE) {
+            result = STORE_ERROR;
+        } else if (i == sizeof(deletes) / sizeof(deletes[0]) - 1 && sqlite3_changes(db) == 0) {
+            result = STORE_NOT_FOUND;
+        }
+        sqlite3_finalize(stmt);
+    }
+    if (result == STORE_OK && sqlite3_exec(db, "COMMIT", NULL, NULL, NULL) != SQLITE_OK) {
+        result = STORE_ERROR;
+    }
+    if (result != STORE_OK) {
+        sqlite3_exec(db, "ROLLBACK", NULL, NULL, NULL);
+    }
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    return result;
+}
+
+static StoreResult sqlite_add_usage(Store* store, const Context* ctx, int tenant_id,
+                                    const char* month, long long count) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "INSERT INTO tenant_usage (tenant_id, month, validations) "
+                           "VALUES (?, ?, ?) ON CONFLICT (tenant_id, month) "
+                           "DO UPDATE SET validations = validations + excluded.validations",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_int(stmt, 1, tenant_id);
+    sqlite3_bind_text(stmt, 2, month, -1, SQLITE_TRANSIENT);
+    sqlite3_bind_int64(stmt, 3, count);
+
+    sqlite3_mutex_enter(sqlite3_db_mutex(db));
+    StoreResult result = step(ctx, stmt) == SQLITE_DONE ? STORE_OK : STORE_ERROR;
+    sqlite3_mutex_leave(sqlite3_db_mutex(db));
+    sqlite3_finalize(stmt);
+    return result;
+}
+
+static StoreResult sqlite_get_usage(Store* store, const Context* ctx, int tenant_id,
+                                    const char* month, TenantUsage* usage) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "SELECT validations FROM tenant_usage WHERE tenant_id = ? AND month = ?",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_int(stmt, 1, tenant_id);
+    sqlite3_bind_text(stmt, 2, month, -1, SQLITE_TRANSIENT);
+
+    usage->tenant_id = tenant_id;
+    snprintf(usage->month, sizeof(usage->month), "%s", month);
+    usage->validations = 0;
+    int rc = step(ctx, stmt);
+    if (rc == SQLITE_ROW) {
+        usage->validations = sqlite3_column_int64(stmt, 0);
+    }
+    sqlite3_finalize(stmt);
+    return rc == SQLITE_ROW || rc == SQLITE_DONE ? STORE_OK : STORE_ERROR;
+}
+
+static StoreResult sqlite_list_usage(Store* store, const Context* ctx, int tenant_id,
+                                     TenantUsage** usage, int* count) {
+    sqlite3* db = database(store);
+    sqlite3_stmt* stmt;
+    if (sqlite3_prepare_v2(db, "SELECT tenant_id, month, validations FROM tenant_usage "
+                           "WHERE ?1 = 0 OR tenant_id = ?1 ORDER BY month, tenant_id",
+                           -1, &stmt, NULL) != SQLITE_OK) {
+        return STORE_ERROR;
+    }
+    sqlite3_bind_int(stmt, 1, tenant_id);
+
+    int capacity = 16;
+    *usage = malloc(sizeof(TenantUsage) * capacity);
+    *count = 0;
+
+    int rc;
+    while ((rc = step(ctx, stmt)) == SQLITE_ROW) {
+        if (*count == capacity) {
+            capacity *= 2;
+            *usage = realloc(*usage, sizeof(TenantUsage) * capacity);
+        }
+        TenantUsage* row = &(*usage)[(*count)++];
+        row->tenant_id = sqlite3_column_int(stmt, 0);
+        copy_column(stmt, 1, row->month, sizeof(row->month));
+        row->validations = sqlite3_column_int64(stmt, 2);
+    }
+    sqlite3_finalize(stmt);
+
+    if (rc != SQLITE_DONE) {
+        free(*usage);
+        *usage = NULL;
+        *count = 0;
+        return STORE_ERROR;
+    }
+    return STORE_OK;
+}
+
+static StoreResult sqlite_ping(Store* store, const Context* ctx) {
+    char* message = NULL;
+    if (sqlite3_exec(database(store), "SELECT 1 FROM users LIMIT 1", NULL, NULL, &message) != SQLITE_OK) {
+        sqlite3_free(message);
+        return STORE_ERROR;
+    }
+    return STORE_OK;
+}
+
+// Copies the whole database to PATH.bak through the online backup API,
+// by way of PATH.bak.tmp so that a backup cut short never replaces the
+// last good one. An in-memory database has no PATH and isn't copied.
+static bool backup_database(sqlite3* db, char* error, size_t error_size) {
+    const char* path = sqlite3_db_filename(db, "main");
+    if (!path || !*path) return true;
+
+    char backup[4096];
+    char temporary[4096 + 4];
+    snprintf(backup, sizeof(backup), "%s.bak", path);
+    snprintf(temporary, sizeof(temporary), "%s.tmp", backup);
+    sqlite3* copy;
+    if (sqlite3_open(temporary, &copy) != SQLITE_OK) {
+        snprintf(error, error_size, "cannot open %s: %s", temporary, sqlite3_errmsg(copy));
+        sqlite3_close(copy);
+        return false;
+    }
+    sqlite3_backup* job = sqlite3_backup_init(copy, "main", db, "main");
+    int rc = job ? sqlite3_backup_step(job, -1) : SQLITE_ERROR;
+    if (job) sqlite3_backup_finish(job);
+    if (rc != SQLITE_DONE) {
+        snprintf(error, error_size, "cannot copy to %s: %s", temporary, sqlite3_errmsg(copy));
+        sqlite3_close(copy);
+        remove(temporary);
+        return false;
+    }
+    sqlite3_close(copy);
+    if (rename(temporary, backup) != 0) {
+        snprintf(error, error_size, "cannot replace %s", backup);
+        remove(temporary);
+        return false;
+    }
+    printf("Backed up the SQLite store to %s\n", backup);
+    return true;
+}
+
+static void sqlite_close(Store* store) {
+    SqliteStore* sqlite = store->data;
+    // Folds the write-ahead log back into the database file, so that the
+    // file alone is the whole database once the server has stopped
+    sqlite3_exec(sqlite->db, "PRAGMA wal_checkpoint(TRUNCATE)", NULL, NULL, NULL);
+    char error[4200];
+    if (sqlite->backup && !backup_database(sqlite->db, error, sizeof(error))) {
+        fprintf(stderr, "Failed to back up the SQLite store: %s\n", error);
+    }
+    sqlite3_close(sqlite->db);
+    free(sqlite);
+    free(store);
+}
+
+// Opens, or creates, the database at path, NULL with error set if it can't
+static sqlite3* open_database(const char* path, char* error, size_t error_size) {
+    sqlite3* db;
+    // Serialized mode: one connection shared by all request threads
+    int flags = SQLITE_OPEN_READWRITE | SQLITE_OPEN_CREATE | SQLITE_OPEN_FULLMUTEX;
+    if (sqlite3_open_v2(path, &db, flags, NULL) != SQLITE_OK) {
+        snprintf(error, error_size, "cannot open %s: %s", path, sqlite3_errmsg(db));
+        sqlite3_close(db);
+        return NULL;
+    }
+    sqlite3_busy_timeout(db, BUSY_TIMEOUT);
+
+    // Write-ahead logging: a crash mid-write loses at most the last
+    // transactions rather than corrupting the file, and the sqlite3 shell
+    // can read while the server writes. With it, NORMAL only syncs at
+    // checkpoints, which is still safe against corruption. An in-memory
+    // database stays in "memory" mode, which is fine.
+    char* message = NULL;
+    if (sqlite3_exec(db, "PRAGMA journal_mode = WAL; PRAGMA synchronous = NORMAL", NULL, NULL,
+                     &message) != SQLITE_OK) {
+        snprintf(error, error_size, "cannot turn on write-ahead logging: %s", message);
+        sqlite3_free(message);
+        sqlite3_close(db);
+        return NULL;
+    }
+    return db;
+}
+
+bool sqlite_store_migrate(const char* path, MigrateCommand command, int target, char* error,
+                          size_t error_size) {
+    sqlite3* db = open_database(path, error, error_size);
+    if (!db) return false;
+    Migrator migrator;
+    bool ok = open_migrator(db, &migrator, error, error_size) &&
+              migrate_run(&migrator, command, target, error, error_size);
+    sqlite3_close(db);
+    return ok;
+}
+
+Store* sqlite_store_open(const char* path, const StoreOptions* options, char* error,
+                         size_t error_size) {
+    sqlite3* db = open_database(path, error, error_size);
+    if (!db) return NULL;
+    Migrator migrator;
+    if (!open_migrator(db, &migrator, error, error_size) ||
+        !migrate_startup(&migrator, options->migrate, error, error_size)) {
+        sqlite3_close(db);
+        return NULL;
+    }
+
+    sqlite3_progress_handler(db, PROGRESS_INSTRUCTIONS, check_progress, NULL);
+
+    Store* store = calloc(1, sizeof(Store));
+    store->name = "sqlite";
+    store->create = sqlite_create;
+    store->get = sqlite_get;
+    store->list = sqlite_list;
+    store->update = sqlite_update;
+    store->link_user = sqlite_link_user;
+    store->flag_phone = sqlite_flag_phone;
+    store->rewrite_user = sqlite_rewrite_user;
+    store->find_duplicate = sqlite_find_duplicate;
+    store->find_by_phone = sqlite_find_by_phone;
+    store->find_by_index = sqlite_find_by_index;
+    store->search_users = sqlite_search_users;
+    store->remove = sqlite_remove;
+    store->restore = sqlite_restore;
+    store->purge_users = sqlite_purge_users;
+    store->erase_user = sqlite_erase_user;
+    store->create_entry = sqlite_create_entry;
+    store->list_entries = sqlite_list_entries;
+    store->remove_entry = sqlite_remove_entry;
+    store->create_rule = sqlite_create_rule;
+    store->list_rules = sqlite_list_rules;
+    store->update_rule = sqlite_update_rule;
+    store->remove_rule = sqlite_remove_rule;
+    store->create_profile = sqlite_create_profile;
+    store->list_profiles = sqlite_list_profiles;
+    store->update_profile = sqlite_update_profile;
+    store->remove_profile = sqlite_remove_profile;
+    store->create_key = sqlite_create_key;
+    store->find_key = sqlite_find_key;
+    store->list_keys = sqlite_list_keys;
+    store->remove_key = sqlite_remove_key;
+    store->add_history = sqlite_add_history;
+    store->list_history = sqlite_list_history;
+    store->count_history = sqlite_count_history;
+    store->purge_history = sqlite_purge_history;
+    store->scrub_history = sqlite_scrub_history;
+    store->erase_history = sqlite_erase_history;
+    store->add_audit = sqlite_add_audit;
+    store->list_audit = sqlite_list_audit;
+    store->create_tenant = sqlite_create_tenant;
+    store->get_tenant = sqlite_get_tenant;
+    store->list_tenants = sqlite_list_tenants;
+    store->update_tenant = sqlite_update_tenant;
+    store->remove_tenant = sqlite_remove_tenant;
+    store->add_usage = sqlite_add_usage;
+    store->get_usage = sqlite_get_usage;
+    store->list_usage = sqlite_list_usage;
+    store->ping = sqlite_ping;
+    store->close = sqlite_close;
+    SqliteStore* sqlite = calloc(1, sizeof(SqliteStore));
+    sqlite->db = db;
+    sqlite->backup = options->backup;
+    store->data = sqlite;
+    return store;
+}
@@ -0,0 +1,438 @@
+#include <stdlib.h>
+
+#include "store.h"
+#include "tracing.h"
+
+static Store* inner_store(Store* store) {
+    return store->data;
+}
+
+// A client span for an operation on inner, under ctx's span
+static Span* store_span(Store* inner, const Context* ctx, const char* name) {
+    Span* span = span_start(ctx, name, SPAN_CLIENT);
+    span_set_string(span, "db.system", inner->name);
+    span_set_string(span, "db.operation.name", name + sizeof("store.") - 1);
+    return span;
+}
+
+static StoreResult end_store_span(Span* span, StoreResult result) {
+    if (result == STORE_ERROR) span_set_error(span, "store error");
+    else span_set_bool(span, "store.found", result == STORE_OK);
+    span_end(span);
+    return result;
+}
+
+static StoreResult traced_create(Store* store, const Context* ctx, User* user) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.create");
+    StoreResult result = inner->create(inner, ctx, user);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_get(Store* store, const Context* ctx, int id, User* user) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.get");
+    StoreResult result = inner->get(inner, ctx, id, user);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_list(Store* store, const Context* ctx, const UserFilter* filter,
+                               User** users, int* count, int* total) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.list");
+    StoreResult result = inner->list(inner, ctx, filter, users, count, total);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_update(Store* store, const Context* ctx, const User* user) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.update");
+    StoreResult result = inner->update(inner, ctx, user);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_link_user(Store* store, const Context* ctx, int id, int wp_id,
+                                    const char* wp_phone) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.link_user");
+    StoreResult result = inner->link_user(inner, ctx, id, wp_id, wp_phone);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_flag_phone(Store* store, const Context* ctx, int id, const char* phone,
+                                     long long invalid_since, const char* reason) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.flag_phone");
+    StoreResult result = inner->flag_phone(inner, ctx, id, phone, invalid_since, reason);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_rewrite_user(Store* store, const Context* ctx, const User* from,
+                                       const User* to) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.rewrite_user");
+    StoreResult result = inner->rewrite_user(inner, ctx, from, to);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_find_duplicate(Store* store, const Context* ctx, const User* user,
+                                         User* existing) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.find_duplicate");
+    StoreResult result = inner->find_duplicate(inner, ctx, user, existing);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_find_by_phone(Store* store, const Context* ctx, const char* phone,
+                                        User** users, int* count) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.find_by_phone");
+    StoreResult result = inner->find_by_phone(inner, ctx, phone, users, count);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_find_by_index(Store* store, const Context* ctx,
+                                        const char* email_index, const char* phone_index,
+                                        User** users, int* count) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.find_by_index");
+    StoreResult result = inner->find_by_index(inner, ctx, email_index, phone_index, users, count);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_search_users(Store* store, const Context* ctx, const char* query,
+                                       int limit, UserMatch** matches, int* count) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.search_users");
+    StoreResult result = inner->search_users(inner, ctx, query, limit, matches, count);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_remove(Store* store, const Context* ctx, int id, long long deleted_at) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.remove");
+    StoreResult result = inner->remove(inner, ctx, id, deleted_at);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_restore(Store* store, const Context* ctx, int id) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.restore");
+    StoreResult result = inner->restore(inner, ctx, id);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_purge_users(Store* store, const Context* ctx, long long deleted_before,
+                                      int* purged) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.purge_users");
+    StoreResult result = inner->purge_users(inner, ctx, deleted_before, purged);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_erase_user(Store* store, const Context* ctx, int id) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.erase_user");
+    StoreResult result = inner->erase_user(inner, ctx, id);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_create_entry(Store* store, const Context* ctx, ListEntry* entry) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.create_entry");
+    StoreResult result = inner->create_entry(inner, ctx, entry);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_list_entries(Store* store, const Context* ctx, ListEntry** entries,
+                                       int* count) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.list_entries");
+    StoreResult result = inner->list_entries(inner, ctx, entries, count);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_remove_entry(Store* store, const Context* ctx, ListName list, int id) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.remove_entry");
+    StoreResult result = inner->remove_entry(inner, ctx, list, id);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_create_rule(Store* store, const Context* ctx, Rule* rule) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.create_rule");
+    StoreResult result = inner->create_rule(inner, ctx, rule);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_list_rules(Store* store, const Context* ctx, Rule** rules, int* count) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.list_rules");
+    StoreResult result = inner->list_rules(inner, ctx, rules, count);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_update_rule(Store* store, const Context* ctx, const Rule* rule) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.update_rule");
+    StoreResult result = inner->update_rule(inner, ctx, rule);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_remove_rule(Store* store, const Context* ctx, int id) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.remove_rule");
+    StoreResult result = inner->remove_rule(inner, ctx, id);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_create_profile(Store* store, const Context* ctx, FormProfile* profile) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.create_profile");
+    StoreResult result = inner->create_profile(inner, ctx, profile);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_list_profiles(Store* store, const Context* ctx, FormProfile** profiles,
+                                        int* count) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.list_profiles");
+    StoreResult result = inner->list_profiles(inner, ctx, profiles, count);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_update_profile(Store* store, const Context* ctx,
+                                         const FormProfile* profile) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.update_profile");
+    StoreResult result = inner->update_profile(inner, ctx, profile);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_remove_profile(Store* store, const Context* ctx, int id) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.remove_profile");
+    StoreResult result = inner->remove_profile(inner, ctx, id);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_add_history(Store* store, const Context* ctx,
+                                      const HistoryRecord* records, int count) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.add_history");
+    StoreResult result = inner->add_history(inner, ctx, records, count);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_list_history(Store* store, const Context* ctx,
+                                       const HistoryFilter* filter, HistoryRecord** records,
+                                       int* count) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.list_history");
+    StoreResult result = inner->list_history(inner, ctx, filter, records, count);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_count_history(Store* store, const Context* ctx,
+                                        const HistoryFilter* filter, HistoryCounts* counts) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.count_history");
+    StoreResult result = inner->count_history(inner, ctx, filter, counts);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_purge_history(Store* store, const Context* ctx, long long created_before,
+                                        int* purged) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.purge_history");
+    StoreResult result = inner->purge_history(inner, ctx, created_before, purged);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_scrub_history(Store* store, const Context* ctx, long long created_before,
+                                        int* scrubbed) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.scrub_history");
+    StoreResult result = inner->scrub_history(inner, ctx, created_before, scrubbed);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_erase_history(Store* store, const Context* ctx, const char* number_hash,
+                                        int* erased) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.erase_history");
+    StoreResult result = inner->erase_history(inner, ctx, number_hash, erased);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_add_audit(Store* store, const Context* ctx, AuditEntry* entry) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.add_audit");
+    StoreResult result = inner->add_audit(inner, ctx, entry);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_list_audit(Store* store, const Context* ctx, const AuditFilter* filter,
+                                     AuditEntry** entries, int* count) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.list_audit");
+    StoreResult result = inner->list_audit(inner, ctx, filter, entries, count);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_create_tenant(Store* store, const Context* ctx, Tenant* tenant) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.create_tenant");
+    StoreResult result = inner->create_tenant(inner, ctx, tenant);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_get_tenant(Store* store, const Context* ctx, int id, Tenant* tenant) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.get_tenant");
+    StoreResult result = inner->get_tenant(inner, ctx, id, tenant);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_list_tenants(Store* store, const Context* ctx, Tenant** tenants,
+                                       int* count) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.list_tenants");
+    StoreResult result = inner->list_tenants(inner, ctx, tenants, count);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_update_tenant(Store* store, const Context* ctx, const Tenant* tenant) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.update_tenant");
+    StoreResult result = inner->update_tenant(inner, ctx, tenant);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_remove_tenant(Store* store, const Context* ctx, int id) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.remove_tenant");
+    StoreResult result = inner->remove_tenant(inner, ctx, id);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_add_usage(Store* store, const Context* ctx, int tenant_id,
+                                    const char* month, long long count) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.add_usage");
+    StoreResult result = inner->add_usage(inner, ctx, tenant_id, month, count);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_get_usage(Store* store, const Context* ctx, int tenant_id,
+                                    const char* month, TenantUsage* usage) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.get_usage");
+    StoreResult result = inner->get_usage(inner, ctx, tenant_id, month, usage);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_list_usage(Store* store, const Context* ctx, int tenant_id,
+                                     TenantUsage** usage, int* count) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.list_usage");
+    StoreResult result = inner->list_usage(inner, ctx, tenant_id, usage, count);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_create_key(Store* store, const Context* ctx, ApiKey* key) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.create_key");
+    StoreResult result = inner->create_key(inner, ctx, key);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_find_key(Store* store, const Context* ctx, const char* key_hash,
+                                   ApiKey* key) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.find_key");
+    StoreResult result = inner->find_key(inner, ctx, key_hash, key);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_list_keys(Store* store, const Context* ctx, ApiKey** keys, int* count) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.list_keys");
+    StoreResult result = inner->list_keys(inner, ctx, keys, count);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_remove_key(Store* store, const Context* ctx, int id) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.remove_key");
+    StoreResult result = inner->remove_key(inner, ctx, id);
+    return end_store_span(span, result);
+}
+
+static StoreResult traced_ping(Store* store, const Context* ctx) {
+    Store* inner = inner_store(store);
+    Span* span = store_span(inner, ctx, "store.ping");
+    StoreResult result = inner->ping(inner, ctx);
+    return end_store_span(span, result);
+}
+
+static void traced_close(Store* store) {
+    inner_store(store)->close(inner_store(store));
+    free(store);
+}
+
+Store* traced_store_wrap(Store* inner) {
+    Store* store = calloc(1, sizeof(Store));
+    store->name = inner->name;
+    store->create = traced_create;
+    store->get = traced_get;
+    store->list = traced_list;
+    store->update = traced_update;
+    store->link_user = traced_link_user;
+    store->flag_phone = traced_flag_phone;
+    store->rewrite_user = traced_rewrite_user;
+    store->find_duplicate = traced_find_duplicate;
+    store->find_by_phone = traced_find_by_phone;
+    store->find_by_index = traced_find_by_index;
+    store->search_users = traced_search_users;
+    store->remove = traced_remove;
+    store->restore = traced_restore;
+    store->purge_users = traced_purge_users;
+    store->erase_user = traced_erase_user;
+    store->create_entry = traced_create_entry;
+    store->list_entries = traced_list_entries;
+    store->remove_entry = traced_remove_entry;
+    store->create_rule = traced_create_rule;
+    store->list_rules = traced_list_rules;
+    store->update_rule = traced_update_rule;
+    store->remove_rule = traced_remove_rule;
+    store->create_profile = traced_create_profile;
+    store->list_profiles = traced_list_profiles;
+    store->update_profile = traced_update_profile;
+    store->remove_profile = traced_remove_profile;
+    store->add_history = traced_add_history;
+    store->list_history = traced_list_history;
+    store->count_history = traced_count_history;
+    store->purge_history = traced_purge_history;
+    store->scrub_history = traced_scrub_history;
+    store->erase_history = traced_erase_history;
+    store->add_audit = traced_add_audit;
+    store->list_audit = traced_list_audit;
+    store->create_tenant = traced_create_tenant;
+    store->get_tenant = traced_get_tenant;
+    store->list_tenants = traced_list_tenants;
+    store->update_tenant = traced_update_tenant;
+    store->remove_tenant = traced_remove_tenant;
+    store->add_usage = traced_add_usage;
+    store->get_usage = traced_get_usage;
+    store->list_usage = traced_list_usage;
+    store->create_key = traced_create_key;
+    store->find_key = traced_find_key;
+    store->list_keys = traced_list_keys;
+    store->remove_key = traced_remove_key;
+    store->ping = traced_ping;
+    store->close = traced_close;
+    store->data = inner;
+    return store;
+}
@@ -0,0 +1,386 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+#include <pthread.h>
+
+#include "tenants.h"
+#include "metrics.h"
+
+#define QUOTA_ALERTS 256            // Tenants whose quota.exhausted alert is remembered for the month
+
+static void tenant_to_json(const Tenant* tenant, char* out, size_t out_size) {
+    char name[256];
+    json_escape(tenant->name, name, sizeof(name));
+    char created_at[32];
+    format_utc_time(tenant->created_at, created_at, sizeof(created_at));
+    char customer[80] = "null";
+    if (tenant->stripe_customer[0]) {
+        char escaped[72];
+        json_escape(tenant->stripe_customer, escaped, sizeof(escaped));
+        snprintf(customer, sizeof(customer), "\"%s\"", escaped);
+    }
+    snprintf(out, out_size,
+             "{\"id\": %d, \"name\": \"%s\", \"rate_limit\": %g, \"rate_burst\": %d, "
+             "\"monthly_quota\": %lld, \"suspended\": %s, \"stripe_customer\": %s, "
+             "\"created_at\": \"%s\"}",
+             tenant->id, name, tenant->rate_limit, tenant->rate_burst, tenant->monthly_quota,
+             tenant->suspended ? "true" : "false", customer, created_at);
+}
+
+// Reads a tenant from the body for POST and PUT: name is required;
+// rate_limit (requests per second shared by the tenant's keys, 0 for
+// key_rate_limit per key), rate_burst, monthly_quota (validations per
+// calendar month, 0 for no limit), suspended and stripe_customer (the
+// customer id Stripe webhooks name it by) are optional
+static bool read_tenant_fields(HttpRequest* req, Tenant* tenant, HttpResponse* res) {
+    FieldErrors errors;
+    field_errors_init(&errors);
+    read_text_field(req->body, &errors, "name", true, tenant->name, sizeof(tenant->name));
+    
+    tenant->rate_limit = 0;
+    const char* p = json_member(req->body, "rate_limit");
+    if (p) {
+        char* end;
+        tenant->rate_limit = strtod(p, &end);
+        if (end == p || tenant->rate_limit < 0) {
+            field_errors_add(&errors, "rate_limit", "invalid_rate_limit",
+                             "Must be a number of requests per second, 0 or more");
+        }
+    }
+    tenant->rate_burst = config.key_rate_burst;
+    p = json_member(req->body, "rate_burst");
+    if (p) {
+        char* end;
+        long burst = strtol(p, &end, 10);
+        if (end == p || burst < 1 || burst > 1000000) {
+            field_errors_add(&errors, "rate_burst", "invalid_rate_burst",
+                             "Must be a whole number from 1 to 1000000");
+        } else {
+            tenant->rate_burst = (int)burst;
+        }
+    }
+    tenant->monthly_quota = 0;
+    p = json_member(req->body, "monthly_quota");
+    if (p) {
+        char* end;
+        tenant->monthly_quota = strtoll(p, &end, 10);
+        if (end == p || tenant->monthly_quota < 0) {
+            field_errors_add(&errors, "monthly_quota", "invalid_monthly_quota",
+                             "Must be a whole number of validations, 0 for no limit");
+        }
+    }
+    tenant->suspended = false;
+    p = json_member(req->body, "suspended");
+    if (p) {
+        if (strncmp(p, "true", 4) == 0) {
+            tenant->suspended = true;
+        } else if (strncmp(p, "false", 5) != 0) {
+            field_errors_add(&errors, "suspended", "invalid_type", "Must be true or false");
+        }
+    }
+    read_text_field(req->body, &errors, "stripe_customer", false, tenant->stripe_customer,
+                    sizeof(tenant->stripe_customer));
+    return field_errors_finish(&errors, res);
+}
+
+void handle_tenants_list(HttpRequest* req, HttpResponse* res) {
+    Tenant* tenants;
+    int count;
+    if (store->list_tenants(store, &req->context, &tenants, &count) != STORE_OK) {
+        error_internal(res, "Failed to list tenants");
+        return;
+    }
+    
+    StringBuilder sb;
+    sb_init(&sb);
+    sb_append(&sb, "{\"tenants\": [");
+    for (int i = 0; i < count; i++) {
+        char json[768];
+        tenant_to_json(&tenants[i], json, sizeof(json));
+        sb_appendf(&sb, "%s%s", i > 0 ? ", " : "", json);
+    }
+    sb_appendf(&sb, "], \"count\": %d}", count);
+    
+    set_json_response(res, 200, sb.data);
+    sb_free(&sb);
+    free(tenants);
+}
+
+void handle_tenant_get(HttpRequest* req, HttpResponse* res) {
+    Tenant tenant;
+    StoreResult result = store->get_tenant(store, &req->context, path_id(req), &tenant);
+    if (result == STORE_NOT_FOUND) {
+        error_not_found(res, "tenant_not_found", "Tenant not found");
+        return;
+    } else if (result != STORE_OK) {
+        error_internal(res, "Failed to load tenant");
+        return;
+    }
+    
+    char json[768];
+    tenant_to_json(&tenant, json, sizeof(json));
+    set_json_response(res, 200, json);
+}
+
+void handle_tenant_create(HttpRequest* req, HttpResponse* res) {
+    Tenant tenant = {0};
+    if (!read_tenant_fields(req, &tenant, res)) return;
+    
+    tenant.created_at = time(NULL);
+    if (store->create_tenant(store, &req->context, &tenant) != STORE_OK) {
+        error_internal(res, "Failed to create tenant");
+        return;
+    }
+    
+    char json[768];
+    tenant_to_json(&tenant, json, sizeof(json));
+    audit(req, "tenant.create", tenant.id, tenant.id, NULL, json);
+    set_json_response(res, 201, json);
+}
+
+// Replaces the tenant's fields, but keeps when Stripe last changed it so
+// that older billing events still can't undo what the operator set
+void handle_tenant_update(HttpRequest* req, HttpResponse* res) {
+    Tenant tenant = {0};
+    tenant.id = path_id(req);
+    if (!read_tenant_fields(req, &tenant, res)) return;
+    
+    Tenant current;
+    StoreResult result = store->get_tenant(store, &req->context, tenant.id, &current);
+    if (result == STORE_OK) {
+        tenant.billing_updated_at = current.billing_updated_at;
+        result = store->update_tenant(store, &req->context, &tenant);
+    }
+    if (result == STORE_OK) {
+        result = store->get_tenant(store, &req->context, tenant.id, &tenant);
+    }
+    if (result == STORE_NOT_FOUND) {
+        error_not_found(res, "tenant_not_found", "Tenant not found");
+        return;
+    } else if (result != STORE_OK) {
+        error_internal(res, "Failed to update tenant");
+        return;
+    }
+    
+    char before[768];
+    char json[768];
+    tenant_to_json(&current, before, sizeof(before));
+    tenant_to_json(&tenant, json, sizeof(json));
+    audit(req, "tenant.update", tenant.id, tenant.id, before, json);
+    set_json_response(res, 200, json);
+}
+
+// Takes the tenant's keys, list entries and rules with it. Its history
+// stays, so past usage can still be counted.
+void handle_tenant_delete(HttpRequest* req, HttpResponse* res) {
+    int tenant_id = path_id(req);
+    
+    Tenant tenant;
+    StoreResult result = store->get_tenant(store, &req->context, tenant_id, &tenant);
+    if (result == STORE_OK) {
+        result = store->remove_tenant(store, &req->context, tenant_id);
+    }
+    if (result == STORE_NOT_FOUND) {
+        error_not_found(res, "tenant_not_found", "Tenant not found");
+        return;
+    } else if (result != STORE_OK) {
+        error_internal(res, "Failed to delete tenant");
+        return;
+    }
+    char before[768];
+    tenant_to_json(&tenant, before, sizeof(before));
+    audit(req, "tenant.delete", tenant_id, tenant_id, before, NULL);
+    
+    char json[128];
+    snprintf(json, sizeof(json), "{\"message\": \"Tenant %d deleted\", \"success\": true}",
+             tenant_id);
+    set_json_response(res, 200, json);
+}
+// Unix seconds at which the month after timestamp's begins, when a
+// monthly quota starts again
+static long long next_month_start(long long timestamp) {
+    time_t seconds = (time_t)timestamp;
+    struct tm tm;
+    gmtime_r(&seconds, &tm);
+    int year = tm.tm_year + 1900;
+    int month = tm.tm_mon + 2;
+    if (month > 12) {
+        month = 1;
+        year++;
+    }
+    return days_from_civil(year, month, 1) * 86400;
+}
+
+// Tenants told about as quota.exhausted, each for the month it happened
+// in, so that every refused request after the first doesn't alert again
+static struct {
+    int tenant_id;
+    char month[8];
+} quota_alerts[QUOTA_ALERTS];
+static int quota_alert_next = 0;
+static pthread_mutex_t quota_alerts_lock = PTHREAD_MUTEX_INITIALIZER;
+
+// Sends quota.exhausted for tenant the first time this month its quota
+// turns a request away
+static void notify_quota_exhausted(const Tenant* tenant, const char* month, long long used,
+                                   const char* resets_at) {
+    if (!notify_wanted(notifications, NOTIFY_QUOTA_EXHAUSTED)) return;
+    
+    pthread_mutex_lock(&quota_alerts_lock);
+    bool alerted = false;
+    for (int i = 0; i < QUOTA_ALERTS && !alerted; i++) {
+        alerted = quota_alerts[i].tenant_id == tenant->id &&
+                  strcmp(quota_alerts[i].month, month) == 0;
+    }
+    if (!alerted) {
+        // The oldest are forgotten first, by then likely a past month's
+        quota_alerts[quota_alert_next].tenant_id = tenant->id;
+        snprintf(quota_alerts[quota_alert_next].month, sizeof(quota_alerts[0].month), "%s", month);
+        quota_alert_next = (quota_alert_next + 1) % QUOTA_ALERTS;
+    }
+    pthread_mutex_unlock(&quota_alerts_lock);
+    if (alerted) return;
+    
+    char name[256];
+    json_escape(tenant->name, name, sizeof(name));
+    char subject[256];
+    snprintf(subject, sizeof(subject), "Tenant %d (%s) used up its monthly quota", tenant->id,
+             tenant->name);
+    char details[512];
+    snprintf(details, sizeof(details),
+             "{\"tenant\": %d, \"name\": \"%s\", \"month\": \"%s\", \"quota\": %lld, "
+             "\"used\": %lld, \"resets_at\": \"%s\"}",
+             tenant->id, name, month, tenant->monthly_quota, used, resets_at);
+    notify(notifications, NOTIFY_QUOTA_EXHAUSTED, subject, details);
+}
+
+// Whether tenant_id may validate more this month, answering 402
+// tenant_suspended for a suspended tenant and quota_exceeded when its
+// monthly_quota is used up. The operator, tenants without a quota, sandbox
+// keys, which aren't counted, and store errors are let through: a store
+// that can't be read shouldn't stop validation.
+bool quota_allows(const Context* ctx, int tenant_id, HttpResponse* res) {
+    if (tenant_id <= 0 || (ctx && ctx->sandbox)) return true;
+    
+    Tenant tenant;
+    if (store->get_tenant(store, ctx, tenant_id, &tenant) != STORE_OK) return true;
+    if (tenant.suspended) {
+        set_error_response(res, 402, "tenant_suspended",
+                           "The tenant is suspended until its subscription is paid", NULL);
+        return false;
+    }
+    if (tenant.monthly_quota <= 0) return true;
+    long long now = time(NULL);
+    char month[8];
+    usage_month(now, month, sizeof(month));
+    TenantUsage usage;
+    if (store->get_usage(store, ctx, tenant_id, month, &usage) != STORE_OK ||
+        usage.validations < tenant.monthly_quota) {
+        return true;
+    }
+    
+    metrics_count_quota_rejection(tenant_id);
+    char resets_at[32];
+    format_utc_time(next_month_start(now), resets_at, sizeof(resets_at));
+    char details[128];
+    snprintf(details, sizeof(details),
+             "{\"quota\": %lld, \"used\": %lld, \"resets_at\": \"%s\"}",
+             tenant.monthly_quota, usage.validations, resets_at);
+    notify_quota_exhausted(&tenant, month, usage.validations, resets_at);
+    set_error_response(res, 402, "quota_exceeded",
+                       "The tenant's monthly validation quota is used up", details);
+    return false;
+}
+
+// Validation routes: refuses a suspended tenant's keys, and any tenant's
+// once its monthly quota is used up. Runs after the key has been checked.
+void quota_middleware(HttpRequest* req, HttpResponse* res, Chain* chain) {
+    if (quota_allows(&req->context, request_tenant(req), res)) {
+        chain_next(req, res, chain);
+    }
+}
+
+// Adds "quota" for a tenant: its monthly_quota, what is used of it this
+// month, what remains and when it starts again. No quota is null, and a
+// deleted tenant, whose counts are kept, has no "quota" at all.
+static bool append_tenant_quota(const Context* ctx, int tenant_id, StringBuilder* sb) {
+    Tenant tenant;
+    StoreResult result = store->get_tenant(store, ctx, tenant_id, &tenant);
+    if (result == STORE_NOT_FOUND) return true;
+    TenantUsage usage;
+    long long now = time(NULL);
+    char month[8];
+    usage_month(now, month, sizeof(month));
+    if (result != STORE_OK || store->get_usage(store, ctx, tenant_id, month, &usage) != STORE_OK) {
+        return false;
+    }
+    
+    char resets_at[32];
+    format_utc_time(next_month_start(now), resets_at, sizeof(resets_at));
+    if (tenant.monthly_quota > 0) {
+        long long remaining = tenant.monthly_quota - usage.validations;
+        sb_appendf(sb,
+                   ", \"quota\": {\"monthly\": %lld, \"used\": %lld, \"remaining\": %lld, "
+                   "\"resets_at\": \"%s\"}",
+                   tenant.monthly_quota, usage.validations, remaining > 0 ? remaining : 0,
+                   resets_at);
+    } else {
+        sb_appendf(sb,
+                   ", \"quota\": {\"monthly\": null, \"used\": %lld, \"remaining\": null, "
+                   "\"resets_at\": \"%s\"}",
+                   usage.validations, resets_at);
+    }
+    return true;
+}
+
+// Validations counted from history by outcome, for billing a tenant or
+// watching one. Takes the same from, to and tenant as history. months
+// holds the metered count per tenant and calendar month, which is what a
+// monthly_quota is checked against and is kept when history is pruned.
+void handle_usage(HttpRequest* req, HttpResponse* res) {
+    HistoryFilter filter = {0};
+    if (!read_history_range(req, &filter, res)) return;
+    
+    HistoryCounts counts;
+    if (store->count_history(store, &req->context, &filter, &counts) != STORE_OK) {
+        error_internal(res, "Failed to count validations");
+        return;
+    }
+    TenantUsage* months;
+    int month_count;
+    if (store->list_usage(store, &req->context, filter.tenant_id, &months, &month_count) !=
+        STORE_OK) {
+        error_internal(res, "Failed to load usage");
+        return;
+    }
+    
+    char tenant[16];
+    tenant_id_to_json(filter.tenant_id, tenant, sizeof(tenant));
+    StringBuilder sb;
+    sb_init(&sb);
+    sb_appendf(&sb,
+               "{\"tenant\": %s, \"validations\": %d, \"valid\": %d, \"invalid\": %d, "
+               "\"blocked\": %d, \"months\": [",
+               tenant, counts.valid + counts.invalid + counts.blocked, counts.valid, counts.invalid,
+               counts.blocked);
+    for (int i = 0; i < month_count; i++) {
+        sb_appendf(&sb, "%s{\"tenant\": %d, \"month\": \"%s\", \"validations\": %lld}",
+                   i > 0 ? ", " : "", months[i].tenant_id, months[i].month,
+                   months[i].validations);
+    }
+    sb_append(&sb, "]");
+    free(months);
+    if (filter.tenant_id > 0 && !append_tenant_quota(&req->context, filter.tenant_id, &sb)) {
+        sb_free(&sb);
+        error_internal(res, "Failed to load the tenant's quota");
+        return;
+    }
+    sb_append(&sb, "}");
+    
+    set_json_response(res, 200, sb.data);
+    sb_free(&sb);
+}
+
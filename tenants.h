@@ -0,0 +1,35 @@
+#ifndef TENANTS_H
+#define TENANTS_H
+
+#include "webserver.h"
+
+// The /api/v1/tenants routes, with which the operator manages the sites
+// one server serves, and the monthly quotas their validations are metered
+// against. Each tenant has its own keys, lists, rules, rate limit and
+// quota, resolved from the API key a request carries; see request_tenant().
+
+// GET and POST /api/v1/tenants
+void handle_tenants_list(HttpRequest* req, HttpResponse* res);
+void handle_tenant_create(HttpRequest* req, HttpResponse* res);
+
+// GET, PUT and DELETE /api/v1/tenants/:id. Deleting a tenant takes its
+// keys, list entries and rules with it, but not its history.
+void handle_tenant_get(HttpRequest* req, HttpResponse* res);
+void handle_tenant_update(HttpRequest* req, HttpResponse* res);
+void handle_tenant_delete(HttpRequest* req, HttpResponse* res);
+
+// Whether tenant_id may validate more this month, answering 402
+// tenant_suspended for a suspended tenant and quota_exceeded when its
+// monthly_quota is used up, the first time in a month with a
+// quota.exhausted notification. The operator, tenants without a quota,
+// sandbox keys and store errors are let through.
+bool quota_allows(const Context* ctx, int tenant_id, HttpResponse* res);
+
+// quota_allows() for validation routes, after the key has been checked
+void quota_middleware(HttpRequest* req, HttpResponse* res, Chain* chain);
+
+// GET /api/v1/usage: validations counted by outcome and metered per
+// month, with the tenant's quota when the range names one
+void handle_usage(HttpRequest* req, HttpResponse* res);
+
+#endif
@@ -0,0 +1,231 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <pthread.h>
+#include <sys/types.h>
+#include <sys/socket.h>
+
+#ifdef HAVE_OPENSSL
+#include <openssl/ssl.h>
+#include <openssl/err.h>
+#endif
+
+#include "tls.h"
+
+#ifdef HAVE_OPENSSL
+#define TLS_MAX_SOCKET 65536    // Sockets at or above this are refused a session
+
+struct TlsContext {
+    char cert_file[512];
+    char key_file[512];
+    bool http2;
+    SSL_CTX* ctx;               // Replaced by tls_context_reload()
+    pthread_mutex_t lock;
+};
+
+// Each socket's session, by descriptor. Only the thread serving a socket
+// touches its entry.
+static SSL* sessions[TLS_MAX_SOCKET];
+
+static void openssl_error(const char* what, char* error, size_t error_size) {
+    char reason[256];
+    ERR_error_string_n(ERR_get_error(), reason, sizeof(reason));
+    ERR_clear_error();
+    snprintf(error, error_size, "%s: %s", what, reason);
+}
+
+// ALPN protocol lists, each name prefixed with its length
+static const unsigned char alpn_http2[] = "\x02h2\x08http/1.1";
+static const unsigned char alpn_http1[] = "\x08http/1.1";
+
+// Picks the first of our protocols the client offers. Clients offering
+// none of them carry on without ALPN, as HTTP/1.1.
+static int select_alpn(SSL* ssl, const unsigned char** out, unsigned char* out_length,
+                       const unsigned char* offered, unsigned int offered_length, void* arg) {
+    const unsigned char* ours = arg ? alpn_http2 : alpn_http1;
+    unsigned int ours_length = arg ? sizeof(alpn_http2) - 1 : sizeof(alpn_http1) - 1;
+    unsigned char* selected;
+    if (SSL_select_next_proto(&selected, out_length, ours, ours_length,
+                              offered, offered_length) != OPENSSL_NPN_NEGOTIATED) {
+        return SSL_TLSEXT_ERR_NOACK;
+    }
+    *out = selected;
+    return SSL_TLSEXT_ERR_OK;
+}
+
+static SSL_CTX* load_ctx(const char* cert_file, const char* key_file, bool http2,
+                         char* error, size_t error_size) {
+    SSL_CTX* ctx = SSL_CTX_new(TLS_server_method());
+    if (!ctx) {
+        openssl_error("creating the TLS context", error, error_size);
+        return NULL;
+    }
+    SSL_CTX_set_min_proto_version(ctx, TLS1_2_VERSION);
+    SSL_CTX_set_options(ctx, SSL_OP_CIPHER_SERVER_PREFERENCE | SSL_OP_NO_RENEGOTIATION);
+    // Any non-NULL arg means h2 is on offer
+    SSL_CTX_set_alpn_select_cb(ctx, select_alpn, http2 ? (void*)alpn_http2 : NULL);
+
+    if (SSL_CTX_use_certificate_chain_file(ctx, cert_file) != 1) {
+        openssl_error(cert_file, error, error_size);
+        SSL_CTX_free(ctx);
+        return NULL;
+    }
+    if (SSL_CTX_use_PrivateKey_file(ctx, key_file, SSL_FILETYPE_PEM) != 1) {
+        openssl_error(key_file, error, error_size);
+        SSL_CTX_free(ctx);
+        return NULL;
+    }
+    if (SSL_CTX_check_private_key(ctx) != 1) {
+        snprintf(error, error_size, "%s doesn't match the certificate in %s", key_file, cert_file);
+        ERR_clear_error();
+        SSL_CTX_free(ctx);
+        return NULL;
+    }
+    return ctx;
+}
+
+TlsContext* tls_context_create(const char* cert_file, const char* key_file, bool http2,
+                               char* error, size_t error_size) {
+    SSL_CTX* ctx = load_ctx(cert_file, key_file, http2, error, error_size);
+    if (!ctx) return NULL;
+
+    TlsContext* tls = calloc(1, sizeof(TlsContext));
+    snprintf(tls->cert_file, sizeof(tls->cert_file), "%s", cert_file);
+    snprintf(tls->key_file, sizeof(tls->key_file), "%s", key_file);
+    tls->http2 = http2;
+    tls->ctx = ctx;
+    pthread_mutex_init(&tls->lock, NULL);
+    return tls;
+}
+
+bool tls_context_reload(TlsContext* tls, char* error, size_t error_size) {
+    SSL_CTX* ctx = load_ctx(tls->cert_file, tls->key_file, tls->http2, error, error_size);
+    if (!ctx) return false;
+
+    // Sessions hold their own reference, so the old context lives on
+    // until the last connection using it closes
+    pthread_mutex_lock(&tls->lock);
+    SSL_CTX* old = tls->ctx;
+    tls->ctx = ctx;
+    pthread_mutex_unlock(&tls->lock);
+    SSL_CTX_free(old);
+    return true;
+}
+
+void tls_context_free(TlsContext* tls) {
+    SSL_CTX_free(tls->ctx);
+    pthread_mutex_destroy(&tls->lock);
+    free(tls);
+}
+
+bool tls_accept(TlsContext* tls, int sock) {
+    if (sock < 0 || sock >= TLS_MAX_SOCKET) return false;
+
+    pthread_mutex_lock(&tls->lock);
+    SSL* ssl = SSL_new(tls->ctx);
+    pthread_mutex_unlock(&tls->lock);
+    if (!ssl) return false;
+
+    if (SSL_set_fd(ssl, sock) != 1 || SSL_accept(ssl) != 1) {
+        ERR_clear_error();
+        SSL_free(ssl);
+        return false;
+    }
+    sessions[sock] = ssl;
+    return true;
+}
+
+void tls_close(int sock) {
+    if (sock < 0 || sock >= TLS_MAX_SOCKET || !sessions[sock]) return;
+    SSL_shutdown(sessions[sock]);
+    SSL_free(sessions[sock]);
+    sessions[sock] = NULL;
+    ERR_clear_error();
+}
+
+bool tls_negotiated_http2(int sock) {
+    if (sock < 0 || sock >= TLS_MAX_SOCKET || !sessions[sock]) return false;
+    const unsigned char* protocol;
+    unsigned int length;
+    SSL_get0_alpn_selected(sessions[sock], &protocol, &length);
+    return length == 2 && memcmp(protocol, "h2", 2) == 0;
+}
+
+bool tls_available(char* error, size_t error_size) {
+    return true;
+}
+
+ssize_t net_send(int sock, const void* data, size_t length) {
+    if (sock >= 0 && sock < TLS_MAX_SOCKET && sessions[sock]) {
+        size_t written = 0;
+        if (SSL_write_ex(sessions[sock], data, length, &written) != 1) {
+            ERR_clear_error();
+            return -1;
+        }
+        return written;
+    }
+    return send(sock, data, length, 0);
+}
+
+ssize_t net_recv(int sock, void* buffer, size_t length) {
+    if (sock >= 0 && sock < TLS_MAX_SOCKET && sessions[sock]) {
+        size_t received = 0;
+        if (SSL_read_ex(sessions[sock], buffer, length, &received) != 1) {
+            // A clean close_notify reads as the end of the stream
+            bool closed = SSL_get_error(sessions[sock], 0) == SSL_ERROR_ZERO_RETURN;
+            ERR_clear_error();
+            return closed ? 0 : -1;
+        }
+        return received;
+    }
+    return recv(sock, buffer, length, 0);
+}
+
+size_t net_pending(int sock) {
+    if (sock < 0 || sock >= TLS_MAX_SOCKET || !sessions[sock]) return 0;
+    return SSL_pending(sessions[sock]);
+}
+#else
+TlsContext* tls_context_create(const char* cert_file, const char* key_file, bool http2,
+                               char* error, size_t error_size) {
+    tls_available(error, error_size);
+    return NULL;
+}
+
+bool tls_context_reload(TlsContext* tls, char* error, size_t error_size) {
+    return tls_available(error, error_size);
+}
+
+void tls_context_free(TlsContext* tls) {
+}
+
+bool tls_accept(TlsContext* tls, int sock) {
+    return false;
+}
+
+void tls_close(int sock) {
+}
+
+bool tls_negotiated_http2(int sock) {
+    return false;
+}
+
+bool tls_available(char* error, size_t error_size) {
+    snprintf(error, error_size, "built without TLS support (make WITH_TLS=1)");
+    return false;
+}
+
+ssize_t net_send(int sock, const void* data, size_t length) {
+    return send(sock, data, length, 0);
+}
+
+ssize_t net_recv(int sock, void* buffer, size_t length) {
+    return recv(sock, buffer, length, 0);
+}
+
+size_t net_pending(int sock) {
+    return 0;
+}
+#endif
@@ -0,0 +1,48 @@
+#ifndef TLS_H
+#define TLS_H
+
+#include <stdbool.h>
+#include <stddef.h>
+#include <sys/types.h>
+
+// HTTPS for the HTTP listener, using OpenSSL. The rest of the server keeps
+// working with plain sockets: tls_accept() attaches a TLS session to an
+// accepted socket, and net_send() and net_recv() go through it from then on.
+
+typedef struct TlsContext TlsContext;
+
+// Loads cert_file (PEM, the certificate followed by any intermediates) and
+// key_file. Returns NULL with error set if either can't be used. With http2,
+// ALPN offers clients h2 ahead of http/1.1.
+TlsContext* tls_context_create(const char* cert_file, const char* key_file, bool http2,
+                               char* error, size_t error_size);
+
+// Reads the files again, e.g. after a renewal. The old certificate stays in
+// use if the new one fails to load. Open connections keep the one they
+// started with.
+bool tls_context_reload(TlsContext* tls, char* error, size_t error_size);
+
+void tls_context_free(TlsContext* tls);
+
+// Runs the handshake on sock. False if it failed, in which case sock has
+// no session and only needs closing.
+bool tls_accept(TlsContext* tls, int sock);
+
+// Ends sock's session, if it has one. Call before closing sock.
+void tls_close(int sock);
+
+// Whether the client on sock chose h2 during the handshake
+bool tls_negotiated_http2(int sock);
+
+// False, with error set, when built without OpenSSL
+bool tls_available(char* error, size_t error_size);
+
+// send() and recv() on sock, through its TLS session if it has one
+ssize_t net_send(int sock, const void* data, size_t length);
+ssize_t net_recv(int sock, void* buffer, size_t length);
+
+// Bytes already decrypted and waiting to be read on sock. poll() can't see
+// them, so check this before waiting on a TLS socket.
+size_t net_pending(int sock);
+
+#endif
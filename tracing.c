@@ -0,0 +1,644 @@
+#define _POSIX_C_SOURCE 200809L
+
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <errno.h>
+#include <fcntl.h>
+#include <time.h>
+#include <unistd.h>
+#include <netdb.h>
+#include <pthread.h>
+#include <sys/socket.h>
+#include <sys/time.h>
+
+#include "tracing.h"
+
+typedef enum {
+    ATTRIBUTE_STRING,
+    ATTRIBUTE_INT,
+    ATTRIBUTE_BOOL
+} AttributeType;
+
+typedef struct {
+    const char* key;
+    AttributeType type;
+    char* string;           // Heap allocated
+    long long number;       // Int, or 1 and 0 for a bool
+} Attribute;
+
+struct Span {
+    Tracer* tracer;
+    Span* root;             // Of the trace, which counts its spans; itself for a root
+    unsigned char trace_id[16];
+    unsigned char span_id[8];
+    unsigned char parent_id[8];
+    bool has_parent;
+    char name[128];
+    SpanKind kind;
+    long long start;        // Nanoseconds since the epoch
+    long long end;
+    Attribute attributes[TRACE_MAX_ATTRIBUTES];
+    int attribute_count;
+    bool failed;
+    char* status_message;
+    int span_count;         // Root only: spans started in the trace, atomic
+    int spans_dropped;      // Root only: spans refused past TRACE_MAX_SPANS, atomic
+    Span* next;             // In the export queue
+};
+
+struct Tracer {
+    char host[256];
+    char port[8];
+    char path[512];         // Of the traces endpoint, e.g. /v1/traces
+    char service_name[64];
+    char instance[256];     // Host name, to tell replicas apart
+    double sample_ratio;
+    int random;             // /dev/urandom
+    pthread_mutex_t lock;
+    pthread_cond_t changed;
+    Span* queue;            // Oldest first
+    Span* queue_tail;
+    int queued;
+    long long dropped;      // Spans that didn't fit in the queue since the last report
+    bool failing;           // The last export failed and was reported
+    bool stopping;
+    pthread_t thread;
+};
+
+static long long now_nanos(void) {
+    struct timespec now;
+    clock_gettime(CLOCK_REALTIME, &now);
+    return (long long)now.tv_sec * 1000000000LL + now.tv_nsec;
+}
+
+static void random_bytes(Tracer* tracer, unsigned char* out, size_t size) {
+    size_t filled = 0;
+    while (filled < size) {
+        ssize_t got = read(tracer->random, out + filled, size - filled);
+        if (got <= 0 && errno != EINTR) break;
+        if (got > 0) filled += got;
+    }
+    // Not secret, just unlikely to collide, so a short read still leaves
+    // usable ids
+    for (; filled < size; filled++) out[filled] = (unsigned char)rand();
+}
+
+static bool all_zero(const unsigned char* bytes, size_t size) {
+    for (size_t i = 0; i < size; i++) {
+        if (bytes[i]) return false;
+    }
+    return true;
+}
+
+// Ids must not be all zeros, which means "none" in OTLP and traceparent
+static void new_id(Tracer* tracer, unsigned char* id, size_t size) {
+    do {
+        random_bytes(tracer, id, size);
+    } while (all_zero(id, size));
+}
+
+static void hex_encode(const unsigned char* bytes, size_t size, char* out) {
+    static const char digits[] = "0123456789abcdef";
+    for (size_t i = 0; i < size; i++) {
+        out[i * 2] = digits[bytes[i] >> 4];
+        out[i * 2 + 1] = digits[bytes[i] & 0x0f];
+    }
+    out[size * 2] = '\0';
+}
+
+// Lowercase only, as traceparent requires
+static bool hex_decode(const char* hex, unsigned char* bytes, size_t size) {
+    for (size_t i = 0; i < size * 2; i++) {
+        char c = hex[i];
+        int digit;
+        if (c >= '0' && c <= '9') digit = c - '0';
+        else if (c >= 'a' && c <= 'f') digit = c - 'a' + 10;
+        else return false;
+        if (i % 2 == 0) bytes[i / 2] = digit << 4;
+        else bytes[i / 2] |= digit;
+    }
+    return true;
+}
+
+// "version-trace_id-parent_id-flags" (W3C Trace Context). Versions past
+// 00 may add fields after the flags, which are ignored.
+static bool parse_traceparent(const char* header, unsigned char* trace_id,
+                              unsigned char* parent_id, bool* sampled) {
+    size_t length = strlen(header);
+    unsigned char version;
+    unsigned char flags;
+    if (length < 55 || header[2] != '-' || header[35] != '-' || header[52] != '-' ||
+        !hex_decode(header, &version, 1) || version == 0xff ||
+        (version == 0 && length != 55) || (length > 55 && header[55] != '-') ||
+        !hex_decode(header + 3, trace_id, 16) || !hex_decode(header + 36, parent_id, 8) ||
+        !hex_decode(header + 53, &flags, 1)) {
+        return false;
+    }
+    *sampled = flags & 0x01;
+    return !all_zero(trace_id, 16) && !all_zero(parent_id, 8);
+}
+
+// ============= Spans =============
+
+static Span* span_new(Tracer* tracer, const char* name, SpanKind kind) {
+    Span* span = calloc(1, sizeof(Span));
+    span->tracer = tracer;
+    snprintf(span->name, sizeof(span->name), "%s", name);
+    span->kind = kind;
+    new_id(tracer, span->span_id, sizeof(span->span_id));
+    span->start = now_nanos();
+    return span;
+}
+
+static void span_free(Span* span) {
+    for (int i = 0; i < span->attribute_count; i++) free(span->attributes[i].string);
+    free(span->status_message);
+    free(span);
+}
+
+Span* tracer_start(Tracer* tracer, const char* traceparent, const char* name, SpanKind kind) {
+    if (!tracer) return NULL;
+
+    unsigned char trace_id[16];
+    unsigned char parent_id[8];
+    bool sampled;
+    bool continued = traceparent && parse_traceparent(traceparent, trace_id, parent_id, &sampled);
+    if (!continued) {
+        // The top 53 bits of a random id, as a fraction of 1
+        unsigned char draw[8];
+        random_bytes(tracer, draw, sizeof(draw));
+        unsigned long long bits = 0;
+        for (int i = 0; i < 8; i++) bits = bits << 8 | draw[i];
+        sampled = (double)(bits >> 11) / (double)(1ULL << 53) < tracer->sample_ratio;
+    }
+    // A parent that wasn't sampled left holes in the trace already
+    if (!sampled) return NULL;
+
+    Span* span = span_new(tracer, name, kind);
+    span->root = span;
+    span->span_count = 1;
+    if (continued) {
+        memcpy(span->trace_id, trace_id, sizeof(trace_id));
+        memcpy(span->parent_id, parent_id, sizeof(parent_id));
+        span->has_parent = true;
+    } else {
+        new_id(tracer, span->trace_id, sizeof(span->trace_id));
+    }
+    return span;
+}
+
+Span* span_start(const Context* ctx, const char* name, SpanKind kind) {
+    if (!ctx || !ctx->span) return NULL;
+    Span* parent = ctx->span;
+    Span* root = parent->root;
+    if (__atomic_add_fetch(&root->span_count, 1, __ATOMIC_RELAXED) > TRACE_MAX_SPANS) {
+        __atomic_add_fetch(&root->spans_dropped, 1, __ATOMIC_RELAXED);
+        return NULL;
+    }
+
+    Span* span = span_new(parent->tracer, name, kind);
+    span->root = root;
+    memcpy(span->trace_id, parent->trace_id, sizeof(span->trace_id));
+    memcpy(span->parent_id, parent->span_id, sizeof(span->parent_id));
+    span->has_parent = true;
+    return span;
+}
+
+const Context* span_context(const Context* ctx, Span* span, Context* storage) {
+    if (!span) return ctx;
+    *storage = *ctx;
+    storage->span = span;
+    return storage;
+}
+
+void span_set_name(Span* span, const char* name) {
+    if (span) snprintf(span->name, sizeof(span->name), "%s", name);
+}
+
+// The attribute named key, replacing its value, or a new one; NULL once
+// the span has TRACE_MAX_ATTRIBUTES
+static Attribute* attribute_slot(Span* span, const char* key) {
+    for (int i = 0; i < span->attribute_count; i++) {
+        if (strcmp(span->attributes[i].key, key) == 0) {
+            free(span->attributes[i].string);
+            span->attributes[i].string = NULL;
+            return &span->attributes[i];
+        }
+    }
+    if (span->attribute_count == TRACE_MAX_ATTRIBUTES) return NULL;
+    Attribute* attribute = &span->attributes[span->attribute_count++];
+    attribute->key = key;
+    return attribute;
+}
+
+void span_set_string(Span* span, const char* key, const char* value) {
+    Attribute* attribute = span ? attribute_slot(span, key) : NULL;
+    if (!attribute) return;
+    attribute->type = ATTRIBUTE_STRING;
+    attribute->string = strdup(value);
+}
+
+void span_set_int(Span* span, const char* key, long long value) {
+    Attribute* attribute = span ? attribute_slot(span, key) : NULL;
+    if (!attribute) return;
+    attribute->type = ATTRIBUTE_INT;
+    attribute->number = value;
+}
+
+void span_set_bool(Span* span, const char* key, bool value) {
+    Attribute* attribute = span ? attribute_slot(span, key) : NULL;
+    if (!attribute) return;
+    attribute->type = ATTRIBUTE_BOOL;
+    attribute->number = value;
+}
+
+void span_set_error(Span* span, const char* message) {
+    if (!span) return;
+    span->failed = true;
+    free(span->status_message);
+    span->status_message = strdup(message);
+}
+
+void span_end(Span* span) {
+    if (!span) return;
+    span->end = now_nanos();
+    if (span->root == span) {
+        int dropped = __atomic_load_n(&span->spans_dropped, __ATOMIC_RELAXED);
+        if (dropped > 0) span_set_int(span, "phoneval.spans_dropped", dropped);
+    }
+
+    Tracer* tracer = span->tracer;
+    pthread_mutex_lock(&tracer->lock);
+    if (tracer->queued >= TRACE_QUEUE_SPANS) {
+        tracer->dropped++;
+        pthread_mutex_unlock(&tracer->lock);
+        span_free(span);
+        return;
+    }
+    span->next = NULL;
+    if (tracer->queue_tail) tracer->queue_tail->next = span;
+    else tracer->queue = span;
+    tracer->queue_tail = span;
+    tracer->queued++;
+    if (tracer->queued >= TRACE_EXPORT_BATCH) pthread_cond_signal(&tracer->changed);
+    pthread_mutex_unlock(&tracer->lock);
+}
+
+void span_traceparent(const Span* span, char* out, size_t out_size) {
+    if (!span) {
+        if (out_size > 0) out[0] = '\0';
+        return;
+    }
+    char trace_id[33];
+    char span_id[17];
+    hex_encode(span->trace_id, sizeof(span->trace_id), trace_id);
+    hex_encode(span->span_id, sizeof(span->span_id), span_id);
+    // Only sampled traces have spans
+    snprintf(out, out_size, "00-%s-%s-01", trace_id, span_id);
+}
+
+// ============= Export =============
+
+typedef struct {
+    char* data;
+    size_t length;
+    size_t capacity;
+} Buffer;
+
+static void buffer_append(Buffer* buffer, const char* text, size_t length) {
+    if (buffer->length + length + 1 > buffer->capacity) {
+        while (buffer->length + length + 1 > buffer->capacity) buffer->capacity *= 2;
+        buffer->data = realloc(buffer->data, buffer->capacity);
+    }
+    memcpy(buffer->data + buffer->length, text, length);
+    buffer->length += length;
+    buffer->data[buffer->length] = '\0';
+}
+
+static void buffer_append_text(Buffer* buffer, const char* text) {
+    buffer_append(buffer, text, strlen(text));
+}
+
+// Appends text as a JSON string, quotes included
+static void buffer_append_string(Buffer* buffer, const char* text) {
+    buffer_append_text(buffer, "\"");
+    for (const unsigned char* c = (const unsigned char*)text; *c; c++) {
+        char escaped[8];
+        switch (*c) {
+            case '"':  buffer_append_text(buffer, "\\\""); break;
+            case '\\': buffer_append_text(buffer, "\\\\"); break;
+            case '\n': buffer_append_text(buffer, "\\n"); break;
+            case '\r': buffer_append_text(buffer, "\\r"); break;
+            case '\t': buffer_append_text(buffer, "\\t"); break;
+            default:
+                if (*c < 0x20) {
+                    snprintf(escaped, sizeof(escaped), "\\u%04x", *c);
+                    buffer_append_text(buffer, escaped);
+                } else {
+                    buffer_append(buffer, (const char*)c, 1);
+                }
+        }
+    }
+    buffer_append_text(buffer, "\"");
+}
+
+static void buffer_append_attribute(Buffer* buffer, const char* key, const Attribute* attribute,
+                                    const char* string) {
+    char number[32];
+    buffer_append_text(buffer, "{\"key\": ");
+    buffer_append_string(buffer, key);
+    buffer_append_text(buffer, ", \"value\": {");
+    if (string) {
+        buffer_append_text(buffer, "\"stringValue\": ");
+        buffer_append_string(buffer, string);
+    } else if (attribute->type == ATTRIBUTE_STRING) {
+        buffer_append_text(buffer, "\"stringValue\": ");
+        buffer_append_string(buffer, attribute->string);
+    } else if (attribute->type == ATTRIBUTE_INT) {
+        // 64 bit integers are strings in OTLP's JSON, as in protobuf's
+        snprintf(number, sizeof(number), "\"intValue\": \"%lld\"", attribute->number);
+        buffer_append_text(buffer, number);
+    } else {
+        buffer_append_text(buffer, attribute->number ? "\"boolValue\": true" : "\"boolValue\": false");
+    }
+    buffer_append_text(buffer, "}}");
+}
+
+// An ExportTraceServiceRequest of spans, in OTLP's JSON encoding
+static char* spans_json(Tracer* tracer, Span* spans) {
+    Buffer buffer = {malloc(4096), 0, 4096};
+    buffer.data[0] = '\0';
+    buffer_append_text(&buffer, "{\"resourceSpans\": [{\"resource\": {\"attributes\": [");
+    buffer_append_attribute(&buffer, "service.name", NULL, tracer->service_name);
+    buffer_append_text(&buffer, ", ");
+    buffer_append_attribute(&buffer, "service.instance.id", NULL, tracer->instance);
+    buffer_append_text(&buffer, "]}, \"scopeSpans\": [{\"scope\": {\"name\": \"phoneval\"}, \"spans\": [");
+    for (Span* span = spans; span; span = span->next) {
+        char trace_id[33];
+        char span_id[17];
+        char parent_id[17];
+        char times[128];
+        hex_encode(span->trace_id, sizeof(span->trace_id), trace_id);
+        hex_encode(span->span_id, sizeof(span->span_id), span_id);
+        hex_encode(span->parent_id, sizeof(span->parent_id), parent_id);
+        if (span != spans) buffer_append_text(&buffer, ", ");
+        buffer_append_text(&buffer, "{\"traceId\": \"");
+        buffer_append_text(&buffer, trace_id);
+        buffer_append_text(&buffer, "\", \"spanId\": \"");
+        buffer_append_text(&buffer, span_id);
+        if (span->has_parent) {
+            buffer_append_text(&buffer, "\", \"parentSpanId\": \"");
+            buffer_append_text(&buffer, parent_id);
+        }
+        buffer_append_text(&buffer, "\", \"name\": ");
+        buffer_append_string(&buffer, span->name);
+        snprintf(times, sizeof(times),
+                 ", \"kind\": %d, \"startTimeUnixNano\": \"%lld\", \"endTimeUnixNano\": \"%lld\"",
+                 span->kind, span->start, span->end);
+        buffer_append_text(&buffer, times);
+        buffer_append_text(&buffer, ", \"attributes\": [");
+        for (int i = 0; i < span->attribute_count; i++) {
+            if (i > 0) buffer_append_text(&buffer, ", ");
+            buffer_append_attribute(&buffer, span->attributes[i].key, &span->attributes[i], NULL);
+        }
+        buffer_append_text(&buffer, "]");
+        if (span->failed) {
+            // STATUS_CODE_ERROR
+            buffer_append_text(&buffer, ", \"status\": {\"code\": 2, \"message\": ");
+            buffer_append_string(&buffer, span->status_message ? span->status_message : "");
+            buffer_append_text(&buffer, "}");
+        }
+        buffer_append_text(&buffer, "}");
+    }
+    buffer_append_text(&buffer, "]}]}]}");
+    return buffer.data;
+}
+
+static bool send_all(int sock, const char* data, size_t length) {
+    while (length > 0) {
+        ssize_t sent = send(sock, data, length, MSG_NOSIGNAL);
+        if (sent < 0 && errno == EINTR) continue;
+        if (sent <= 0) return false;
+        data += sent;
+        length -= sent;
+    }
+    return true;
+}
+
+// POSTs body to the collector and checks for a 2xx status. The connection
+// is closed afterwards, since a batch goes at most every few seconds.
+static bool post_spans(Tracer* tracer, const char* body, char* error, size_t error_size) {
+    struct addrinfo hints = {0};
+    hints.ai_family = AF_UNSPEC;
+    hints.ai_socktype = SOCK_STREAM;
+    struct addrinfo* addresses;
+    int status = getaddrinfo(tracer->host, tracer->port, &hints, &addresses);
+    if (status != 0) {
+        snprintf(error, error_size, "%s: %s", tracer->host, gai_strerror(status));
+        return false;
+    }
+    int sock = -1;
+    struct timeval timeout = {TRACE_EXPORT_TIMEOUT, 0};
+    for (struct addrinfo* address = addresses; address; address = address->ai_next) {
+        sock = socket(address->ai_family, address->ai_socktype, address->ai_protocol);
+        if (sock < 0) continue;
+        // Also bounds connect() on Linux
+        setsockopt(sock, SOL_SOCKET, SO_SNDTIMEO, &timeout, sizeof(timeout));
+        setsockopt(sock, SOL_SOCKET, SO_RCVTIMEO, &timeout, sizeof(timeout));
+        if (connect(sock, address->ai_addr, address->ai_addrlen) == 0) break;
+        close(sock);
+        sock = -1;
+    }
+    freeaddrinfo(addresses);
+    if (sock < 0) {
+        snprintf(error, error_size, "cannot connect to %s:%s: %s", tracer->host, tracer->port,
+                 strerror(errno));
+        return false;
+    }
+
+    size_t length = strlen(body);
+    char head[1024];
+    snprintf(head, sizeof(head),
+             "POST %s HTTP/1.1\r\nHost: %s:%s\r\nContent-Type: application/json\r\n"
+             "Content-Length: %zu\r\nConnection: close\r\n\r\n",
+             tracer->path, tracer->host, tracer->port, length);
+    char reply[256];
+    ssize_t got = 0;
+    if (send_all(sock, head, strlen(head)) && send_all(sock, body, length)) {
+        got = recv(sock, reply, sizeof(reply) - 1, 0);
+    }
+    close(sock);
+    if (got <= 0) {
+        snprintf(error, error_size, "no reply from %s:%s", tracer->host, tracer->port);
+        return false;
+    }
+    reply[got] = '\0';
+
+    int code = 0;
+    if (sscanf(reply, "HTTP/%*s %d", &code) != 1 || code < 200 || code > 299) {
+        snprintf(error, error_size, "the collector answered %.*s", (int)strcspn(reply, "\r\n"),
+                 reply);
+        return false;
+    }
+    return true;
+}
+
+// Sends up to TRACE_EXPORT_BATCH queued spans. Call with the lock held;
+// it is let go while they're sent.
+static void export_batch(Tracer* tracer) {
+    Span* batch = tracer->queue;
+    Span* last = batch;
+    int count = 1;
+    while (last->next && count < TRACE_EXPORT_BATCH) {
+        last = last->next;
+        count++;
+    }
+    tracer->queue = last->next;
+    if (!tracer->queue) tracer->queue_tail = NULL;
+    tracer->queued -= count;
+    last->next = NULL;
+    long long dropped = tracer->dropped;
+    tracer->dropped = 0;
+    pthread_mutex_unlock(&tracer->lock);
+
+    if (dropped > 0) {
+        fprintf(stderr, "Dropped %lld span(s) that didn't fit in the export queue\n", dropped);
+    }
+    char* body = spans_json(tracer, batch);
+    char error[512];
+    bool sent = post_spans(tracer, body, error, sizeof(error));
+    free(body);
+    while (batch) {
+        Span* next = batch->next;
+        span_free(batch);
+        batch = next;
+    }
+
+    pthread_mutex_lock(&tracer->lock);
+    // Reported once until an export goes through again
+    if (!sent && !tracer->failing) {
+        fprintf(stderr, "Failed to export %d span(s), dropping them: %s\n", count, error);
+    }
+    tracer->failing = !sent;
+}
+
+static void* export_thread(void* arg) {
+    Tracer* tracer = arg;
+    pthread_mutex_lock(&tracer->lock);
+    while (!tracer->stopping) {
+        struct timespec until;
+        clock_gettime(CLOCK_REALTIME, &until);
+        until.tv_sec += TRACE_EXPORT_INTERVAL;
+        while (!tracer->stopping && tracer->queued < TRACE_EXPORT_BATCH) {
+            if (pthread_cond_timedwait(&tracer->changed, &tracer->lock, &until) == ETIMEDOUT) {
+                break;
+            }
+        }
+        if (tracer->queue) export_batch(tracer);
+    }
+    // What's left on the way out
+    while (tracer->queue) export_batch(tracer);
+    pthread_mutex_unlock(&tracer->lock);
+    return NULL;
+}
+
+// ============= Tracer =============
+
+// Splits "http://host[:port][/path]" into the tracer's host, port and the
+// path of its traces endpoint
+static bool parse_endpoint(Tracer* tracer, const char* endpoint, char* error,
+                           size_t error_size) {
+    if (strncmp(endpoint, "http://", 7) != 0) {
+        snprintf(error, error_size,
+                 "otlp_endpoint must be an http:// URL; run a collector nearby to reach one over TLS");
+        return false;
+    }
+    const char* host = endpoint + 7;
+    const char* host_end;
+    const char* rest;
+    if (*host == '[') {
+        // IPv6 literal
+        host_end = strchr(host, ']');
+        if (!host_end) {
+            snprintf(error, error_size, "otlp_endpoint has an unclosed [");
+            return false;
+        }
+        rest = host_end + 1;
+        host++;
+    } else {
+        host_end = host + strcspn(host, ":/");
+        rest = host_end;
+    }
+    size_t host_length = host_end - host;
+    if (host_length == 0 || host_length >= sizeof(tracer->host)) {
+        snprintf(error, error_size, "otlp_endpoint has no usable host");
+        return false;
+    }
+    memcpy(tracer->host, host, host_length);
+    tracer->host[host_length] = '\0';
+
+    snprintf(tracer->port, sizeof(tracer->port), "80");
+    if (*rest == ':') {
+        size_t port_length = strcspn(rest + 1, "/");
+        char* end;
+        long port = strtol(rest + 1, &end, 10);
+        if (port_length == 0 || end != rest + 1 + port_length || port < 1 || port > 65535) {
+            snprintf(error, error_size, "otlp_endpoint has a bad port");
+            return false;
+        }
+        snprintf(tracer->port, sizeof(tracer->port), "%ld", port);
+        rest += 1 + port_length;
+    }
+    size_t path_length = strlen(rest);
+    while (path_length > 0 && rest[path_length - 1] == '/') path_length--;
+    if (path_length + sizeof("/v1/traces") > sizeof(tracer->path)) {
+        snprintf(error, error_size, "otlp_endpoint's path is too long");
+        return false;
+    }
+    snprintf(tracer->path, sizeof(tracer->path), "%.*s/v1/traces", (int)path_length, rest);
+    return true;
+}
+
+Tracer* tracer_open(const char* endpoint, const char* service_name, double sample_ratio,
+                    char* error, size_t error_size) {
+    Tracer* tracer = calloc(1, sizeof(Tracer));
+    if (!parse_endpoint(tracer, endpoint, error, error_size)) {
+        free(tracer);
+        return NULL;
+    }
+    snprintf(tracer->service_name, sizeof(tracer->service_name), "%s", service_name);
+    if (gethostname(tracer->instance, sizeof(tracer->instance) - 1) != 0) {
+        snprintf(tracer->instance, sizeof(tracer->instance), "unknown");
+    }
+    tracer->sample_ratio = sample_ratio;
+    tracer->random = open("/dev/urandom", O_RDONLY | O_CLOEXEC);
+    if (tracer->random < 0) {
+        snprintf(error, error_size, "/dev/urandom: %s", strerror(errno));
+        free(tracer);
+        return NULL;
+    }
+    pthread_mutex_init(&tracer->lock, NULL);
+    pthread_cond_init(&tracer->changed, NULL);
+    if (pthread_create(&tracer->thread, NULL, export_thread, tracer) != 0) {
+        snprintf(error, error_size, "cannot start the span export thread");
+        pthread_mutex_destroy(&tracer->lock);
+        pthread_cond_destroy(&tracer->changed);
+        close(tracer->random);
+        free(tracer);
+        return NULL;
+    }
+    return tracer;
+}
+
+void tracer_close(Tracer* tracer) {
+    pthread_mutex_lock(&tracer->lock);
+    tracer->stopping = true;
+    pthread_cond_signal(&tracer->changed);
+    pthread_mutex_unlock(&tracer->lock);
+    pthread_join(tracer->thread, NULL);
+    pthread_mutex_destroy(&tracer->lock);
+    pthread_cond_destroy(&tracer->changed);
+    close(tracer->random);
+    free(tracer);
+}
@@ -0,0 +1,76 @@
+#ifndef TRACING_H
+#define TRACING_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+#include "context.h"
+
+// Distributed tracing in OpenTelemetry's model: a request is a trace, and
+// the work done for it (store calls, lookups, validation) spans within it,
+// each timed and tagged with attributes. Finished spans are batched and
+// sent to a collector over OTLP/HTTP as JSON, on a background thread.
+// Trace context comes in and goes out in W3C traceparent headers.
+
+#define TRACE_MAX_SPANS 1000        // Spans a trace keeps, so a big batch doesn't flood the collector
+#define TRACE_MAX_ATTRIBUTES 16     // Per span, more are ignored
+#define TRACE_QUEUE_SPANS 8192      // Finished spans waiting to be sent before more are dropped
+#define TRACE_EXPORT_BATCH 512      // Spans per request to the collector
+#define TRACE_EXPORT_INTERVAL 5     // Seconds spans wait at most before they're sent
+#define TRACE_EXPORT_TIMEOUT 10     // Seconds for the collector to answer
+#define TRACEPARENT_LENGTH 56       // "00-" trace id "-" span id "-01", with its NUL
+
+// As OTLP numbers them
+typedef enum {
+    SPAN_INTERNAL = 1,
+    SPAN_SERVER = 2,        // Handling a request from a client
+    SPAN_CLIENT = 3         // Waiting on a store or provider
+} SpanKind;
+
+typedef struct Tracer Tracer;
+typedef struct Span Span;
+
+// endpoint is the collector's OTLP/HTTP base URL, e.g.
+// http://localhost:4318, which spans are POSTed to at /v1/traces. Only
+// plain http:// is spoken, so a collector on the same host or network
+// relays to anywhere further. Traces without a sampled parent are kept
+// at random, sample_ratio of them (0 to 1).
+Tracer* tracer_open(const char* endpoint, const char* service_name, double sample_ratio,
+                    char* error, size_t error_size);
+
+// Sends the spans still waiting, then stops the background thread
+void tracer_close(Tracer* tracer);
+
+// Starts the root span of a request, continuing the trace a traceparent
+// header names, or a new one when it's NULL or malformed. NULL when the
+// trace isn't sampled, or tracer is NULL: nothing is recorded for it.
+Span* tracer_start(Tracer* tracer, const char* traceparent, const char* name, SpanKind kind);
+
+// Starts a span for work done for ctx, a child of ctx's span. NULL when
+// ctx is NULL or has no span, or its trace has TRACE_MAX_SPANS already.
+Span* span_start(const Context* ctx, const char* name, SpanKind kind);
+
+// A copy of ctx in storage carrying span, for handing span on to the work
+// it times so that calls made in turn are its children. ctx itself when
+// span is NULL.
+const Context* span_context(const Context* ctx, Span* span, Context* storage);
+
+// Every span function takes NULL and does nothing with it, so untraced
+// requests cost a branch. Keys are string literals, kept by reference,
+// named as in OpenTelemetry's semantic conventions where one fits.
+void span_set_name(Span* span, const char* name);
+void span_set_string(Span* span, const char* key, const char* value);
+void span_set_int(Span* span, const char* key, long long value);
+void span_set_bool(Span* span, const char* key, bool value);
+// Marks the span as failed, for message
+void span_set_error(Span* span, const char* message);
+
+// Finishes the span and queues it for the collector. The span is gone
+// afterwards, and so must its children be.
+void span_end(Span* span);
+
+// The traceparent header for calls made for span, so that whatever
+// answers them can join the trace. "" for NULL.
+void span_traceparent(const Span* span, char* out, size_t out_size);
+
+#endif
@@ -0,0 +1,234 @@
+#ifndef WEBSERVER_H
+#define WEBSERVER_H
+
+#include <stdbool.h>
+#include <stddef.h>
+#include <pthread.h>
+
+#include "phonevalidator.h"
+#include "store.h"
+#include "config.h"
+#include "context.h"
+#include "carrier.h"
+#include "cnam.h"
+#include "callback.h"
+#include "notify.h"
+#include "cache.h"
+
+// Requests, responses and the helpers route handlers share, for the
+// modules that hold handlers of their own. Everything here is defined in
+// webserver.c, which describes it.
+
+#define BUFFER_SIZE 4096
+#define MAX_REQUEST_HEADERS (BUFFER_SIZE * 4)  // Request line and headers, more are refused with 431
+#define VALIDATION_JSON_SIZE 4096   // Room for one result with time zones, carrier and enrichment
+#define MAX_RESPONSE_HEADERS 1536   // Room for pagination Links next to the CORS headers
+
+// Versioned API prefixes. A new version registers its own routes under its
+// prefix and can share handlers with older ones where nothing changed.
+#define API_V1 "/api/v1"
+
+// HTTP Methods
+typedef enum {
+    GET,
+    POST,
+    PUT,
+    PATCH,
+    DELETE,
+    OPTIONS,
+    UNSUPPORTED
+} HttpMethod;
+
+// Request structure
+typedef struct {
+    HttpMethod method;
+    char path[256];
+    char query_string[512];
+    char* body;             // Heap allocated, always NUL terminated
+    int body_length;
+    char headers[MAX_REQUEST_HEADERS + 1];  // Request line and headers, up to the blank line
+    char client_ip[64];     // Peer address of the connection
+    int sock;               // Client socket, used by streaming routes
+    bool secure;            // Arrived on the HTTPS listener
+    long body_remaining;    // Streaming routes: body bytes not yet read from sock
+    int body_consumed;      // Streaming routes: bytes of body already handed out
+    Context context;        // Deadline and socket the work done for the request is cancelled by
+} HttpRequest;
+
+// Response structure
+typedef struct {
+    int status_code;
+    char content_type[64];
+    char* body;             // Heap allocated by the set_*_response helpers
+    int body_length;
+    char headers[MAX_RESPONSE_HEADERS];  // Extra "Name: value\r\n" lines, see add_response_header()
+    ResponseFormat format;  // How set_error_response() shapes errors
+    bool streamed;          // Already sent with stream_begin(), nothing left to send
+} HttpResponse;
+
+// Growable string for responses that don't fit a fixed buffer
+typedef struct {
+    char* data;
+    size_t length;
+    size_t capacity;
+} StringBuilder;
+
+// Handler function type
+typedef void (*RouteHandler)(HttpRequest*, HttpResponse*);
+
+typedef struct Chain Chain;
+
+// Middleware function type. Calls chain_next() to run the rest of the chain
+// (and can act on the response afterwards), or returns without calling it
+// to answer the request itself.
+typedef void (*Middleware)(HttpRequest*, HttpResponse*, Chain*);
+
+// NULL terminated middleware list for register_route_chain()
+#define CHAIN(...) (Middleware[]){__VA_ARGS__, NULL}
+
+// Problems with the fields of a request body, collected so that one 422
+// reports all of them:
+//   {"error": {"code": "invalid_fields", "message": "...", "details": {"fields": [
+//       {"field": "email", "code": "invalid_email", "message": "..."}, ...]}}}
+typedef struct {
+    StringBuilder json;
+    int count;
+    char first[192];        // "field: message" of the first problem, for HTML forms
+} FieldErrors;
+
+// CRM whose field mapping ?enrich= shapes the enrichment block for
+typedef enum {
+    CRM_NONE,
+    CRM_HUBSPOT,
+    CRM_SALESFORCE
+} Crm;
+
+// Outcome of validating one raw input
+typedef struct {
+    char input[128];
+    PhoneError error;       // From parsing
+    PhoneError reason;      // Why it isn't valid, PHONE_OK if it is
+    PhoneNumber number;
+    bool has_carrier;       // Set when a carrier lookup filled in carrier
+    CarrierInfo carrier;
+    bool has_cnam;          // Set when a caller name lookup filled in cnam
+    CnamInfo cnam;          // Empty name when none is registered
+    bool geocoded;          // Set when location was looked up, even if not found
+    char location[128];
+    bool blocked;           // Matched the blocklist, or a deny rule, and not the allowlist
+    char blocked_reason[160];
+    int rule_id;            // Validation rule that decided, 0 if none matched
+    RuleAction rule_action;
+    Crm enrich;             // Adds "enrichment" in this CRM's property names
+} ValidationResult;
+
+// Snapshot of the blocklist, allowlist and the caller's validation rules,
+// the operator's and its tenant's, loaded once per request
+typedef struct {
+    ListEntry* entries;
+    int count;
+    Rule* rules;            // In the order they are tried
+    int rule_count;
+} NumberLists;
+
+// Settings, the store and the server's state, see webserver.c
+extern Config config;
+extern Store* store;
+extern CallbackQueue* callbacks;
+extern NotifyQueue* notifications;
+
+// Recent validations and caller names, NULL when their cache is off
+extern Cache* validation_cache;
+extern Cache* cnam_cache;
+
+// In-flight connections; a job or task that uses the store counts as one
+extern int active_connections;
+extern bool shutting_down;
+extern pthread_mutex_t connections_lock;
+extern pthread_cond_t connections_drained;
+
+// Runs the rest of a middleware chain
+void chain_next(HttpRequest* req, HttpResponse* res, Chain* chain);
+
+// Growable strings
+void sb_init(StringBuilder* sb);
+void sb_append(StringBuilder* sb, const char* text);
+void sb_appendf(StringBuilder* sb, const char* format, ...);
+void sb_free(StringBuilder* sb);
+
+// JSON
+void json_escape(const char* src, char* dst, size_t dst_size);
+const char* json_member(const char* p, const char* key);
+const char* json_read_string(const char* p, char* out, size_t out_size);
+const char* json_skip_value(const char* p);
+bool json_get_string(const char* json, const char* key, char* out, size_t out_size);
+
+// Times
+void format_utc_time(long long timestamp, char* out, size_t out_size);
+long long days_from_civil(int year, int month, int day);
+void usage_month(long long timestamp, char* out, size_t out_size);
+
+// Requests
+bool get_query_param(HttpRequest* req, const char* name, char* out, size_t out_size);
+bool get_query_flag(HttpRequest* req, const char* name);
+bool get_header(HttpRequest* req, const char* name, char* out, size_t out_size);
+void caller_fingerprint(HttpRequest* req, char* out, size_t out_size);
+int request_tenant(HttpRequest* req);
+int path_id(HttpRequest* req);
+bool read_number_array(const char* json, int max, char (**numbers)[128], int* count,
+                       HttpResponse* res);
+
+// Request bodies' fields, with every problem reported in one 422
+void field_errors_init(FieldErrors* errors);
+void field_errors_add(FieldErrors* errors, const char* field, const char* code,
+                      const char* message);
+bool field_errors_finish(FieldErrors* errors, HttpResponse* res);
+bool read_text_field(const char* body, FieldErrors* errors, const char* field, bool required,
+                     char* out, size_t out_size);
+
+// Responses
+void set_json_response(HttpResponse* res, int status, const char* json);
+void set_error_response(HttpResponse* res, int status, const char* code,
+                        const char* message, const char* details);
+void add_response_header(HttpResponse* res, const char* name, const char* value);
+void error_bad_request(HttpResponse* res, const char* code, const char* message);
+void error_not_found(HttpResponse* res, const char* code, const char* message);
+void error_missing_field(HttpResponse* res, const char* field);
+void error_internal(HttpResponse* res, const char* message);
+
+// Responses streamed as they are written, for routes registered with register_socket_route()
+bool stream_begin(HttpRequest* req, HttpResponse* res, int status, const char* content_type);
+bool stream_write(HttpRequest* req, const char* data, size_t length);
+bool stream_end(HttpRequest* req);
+
+// Validation
+void validate_number(const Context* ctx, const char* raw, const char* region,
+                     ValidationResult* result);
+void geocode_result(ValidationResult* result);
+void validation_result_to_json(const ValidationResult* result, char* out, size_t out_size);
+bool fetch_number_lists(const Context* ctx, const char* caller, int tenant_id,
+                        NumberLists* lists);
+void check_number_lists(const NumberLists* lists, ValidationResult* result);
+void free_number_lists(NumberLists* lists);
+void record_history_as(const char* caller, int tenant_id, const char* source,
+                       const ValidationResult* results, int count);
+
+// Users and list entries
+void user_to_json(const User* user, char* out, size_t out_size);
+void list_entry_to_json(const ListEntry* entry, char* out, size_t out_size);
+
+// History
+bool read_history_range(HttpRequest* req, HistoryFilter* filter, HttpResponse* res);
+void history_number_hash(const ValidationResult* result, char* out);
+void history_record_fill(HistoryRecord* record, const ValidationResult* result, const char* caller,
+                         int tenant_id, const char* source, long long timestamp);
+void history_record_to_json(const HistoryRecord* record, char* out, size_t out_size);
+void tenant_id_to_json(int tenant_id, char* out, size_t out_size);
+
+// The audit trail of admin changes
+void audit(HttpRequest* req, const char* action, int id, int tenant_id, const char* before,
+           const char* after);
+void record_audit(HttpRequest* req, const char* action, const char* target, int tenant_id,
+                  const char* before, const char* after);
+
+#endif
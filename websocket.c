@@ -0,0 +1,266 @@
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <stdint.h>
+#include <sys/types.h>
+#include <sys/socket.h>
+#include <poll.h>
+
+#include "websocket.h"
+#include "tls.h"
+
+#define WS_GUID "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+#define WS_MAX_CONTROL_PAYLOAD 125
+
+// ============= SHA-1 =============
+
+// Only used for the handshake, which RFC 6455 defines with SHA-1
+
+static uint32_t rotate_left(uint32_t value, int bits) {
+    return (value << bits) | (value >> (32 - bits));
+}
+
+static void sha1_block(uint32_t state[5], const unsigned char* block) {
+    uint32_t w[80];
+    for (int i = 0; i < 16; i++) {
+        w[i] = (uint32_t)block[i * 4] << 24 | (uint32_t)block[i * 4 + 1] << 16 |
+               (uint32_t)block[i * 4 + 2] << 8 | block[i * 4 + 3];
+    }
+    for (int i = 16; i < 80; i++) {
+        w[i] = rotate_left(w[i - 3] ^ w[i - 8] ^ w[i - 14] ^ w[i - 16], 1);
+    }
+
+    uint32_t a = state[0], b = state[1], c = state[2], d = state[3], e = state[4];
+    for (int i = 0; i < 80; i++) {
+        uint32_t f, k;
+        if (i < 20) {
+            f = (b & c) | (~b & d);
+            k = 0x5a827999;
+        } else if (i < 40) {
+            f = b ^ c ^ d;
+            k = 0x6ed9eba1;
+        } else if (i < 60) {
+            f = (b & c) | (b & d) | (c & d);
+            k = 0x8f1bbcdc;
+        } else {
+            f = b ^ c ^ d;
+            k = 0xca62c1d6;
+        }
+        uint32_t temp = rotate_left(a, 5) + f + e + k + w[i];
+        e = d;
+        d = c;
+        c = rotate_left(b, 30);
+        b = a;
+        a = temp;
+    }
+    state[0] += a;
+    state[1] += b;
+    state[2] += c;
+    state[3] += d;
+    state[4] += e;
+}
+
+static void sha1(const unsigned char* data, size_t length, unsigned char digest[20]) {
+    uint32_t state[5] = {0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476, 0xc3d2e1f0};
+    size_t offset = 0;
+    for (; offset + 64 <= length; offset += 64) {
+        sha1_block(state, data + offset);
+    }
+
+    // Pad with 0x80, zeros and the bit length in the last 8 bytes
+    unsigned char tail[128] = {0};
+    size_t rest = length - offset;
+    memcpy(tail, data + offset, rest);
+    tail[rest] = 0x80;
+    size_t tail_length = rest + 9 <= 64 ? 64 : 128;
+    uint64_t bits = (uint64_t)length * 8;
+    for (int i = 0; i < 8; i++) {
+        tail[tail_length - 1 - i] = (unsigned char)(bits >> (i * 8));
+    }
+    sha1_block(state, tail);
+    if (tail_length == 128) {
+        sha1_block(state, tail + 64);
+    }
+
+    for (int i = 0; i < 5; i++) {
+        digest[i * 4] = (unsigned char)(state[i] >> 24);
+        digest[i * 4 + 1] = (unsigned char)(state[i] >> 16);
+        digest[i * 4 + 2] = (unsigned char)(state[i] >> 8);
+        digest[i * 4 + 3] = (unsigned char)state[i];
+    }
+}
+
+static void base64_encode(const unsigned char* data, size_t length, char* out) {
+    static const char alphabet[] =
+        "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/";
+    size_t o = 0;
+    for (size_t i = 0; i < length; i += 3) {
+        uint32_t group = (uint32_t)data[i] << 16;
+        if (i + 1 < length) group |= (uint32_t)data[i + 1] << 8;
+        if (i + 2 < length) group |= data[i + 2];
+        out[o++] = alphabet[(group >> 18) & 63];
+        out[o++] = alphabet[(group >> 12) & 63];
+        out[o++] = i + 1 < length ? alphabet[(group >> 6) & 63] : '=';
+        out[o++] = i + 2 < length ? alphabet[group & 63] : '=';
+    }
+    out[o] = '\0';
+}
+
+void websocket_accept_key(const char* key, char* out) {
+    char joined[128];
+    int len = snprintf(joined, sizeof(joined), "%.64s" WS_GUID, key);
+    unsigned char digest[20];
+    sha1((const unsigned char*)joined, len, digest);
+    base64_encode(digest, sizeof(digest), out);
+}
+
+// ============= Frames =============
+
+static bool recv_all(int sock, unsigned char* buffer, size_t length) {
+    size_t received = 0;
+    while (received < length) {
+        ssize_t n = net_recv(sock, buffer + received, length - received);
+        if (n <= 0) return false;
+        received += n;
+    }
+    return true;
+}
+
+static bool send_all(int sock, const unsigned char* data, size_t length) {
+    size_t sent = 0;
+    while (sent < length) {
+        ssize_t n = net_send(sock, data + sent, length - sent);
+        if (n <= 0) return false;
+        sent += n;
+    }
+    return true;
+}
+
+bool websocket_send(int sock, WebSocketOpcode opcode, const char* data, size_t length) {
+    // Server frames are sent whole and unmasked
+    unsigned char header[10];
+    size_t header_length = 2;
+    header[0] = 0x80 | opcode;
+    if (length < 126) {
+        header[1] = (unsigned char)length;
+    } else if (length <= 0xFFFF) {
+        header[1] = 126;
+        header[2] = (unsigned char)(length >> 8);
+        header[3] = (unsigned char)length;
+        header_length = 4;
+    } else {
+        header[1] = 127;
+        for (int i = 0; i < 8; i++) {
+            header[2 + i] = (unsigned char)((uint64_t)length >> (56 - i * 8));
+        }
+        header_length = 10;
+    }
+    return send_all(sock, header, header_length) &&
+           send_all(sock, (const unsigned char*)data, length);
+}
+
+bool websocket_close(int sock, int code, const char* reason) {
+    char payload[WS_MAX_CONTROL_PAYLOAD];
+    payload[0] = (char)(code >> 8);
+    payload[1] = (char)code;
+    size_t reason_length = strlen(reason);
+    if (reason_length > sizeof(payload) - 2) reason_length = sizeof(payload) - 2;
+    memcpy(payload + 2, reason, reason_length);
+    return websocket_send(sock, WS_CLOSE, payload, reason_length + 2);
+}
+
+void websocket_linger(int sock) {
+    shutdown(sock, SHUT_WR);
+    char discard[4096];
+    struct pollfd readable = {sock, POLLIN, 0};
+    while (poll(&readable, 1, 1000) > 0 && net_recv(sock, discard, sizeof(discard)) > 0);
+}
+
+int websocket_read_message(int sock, size_t max_size, char** data, size_t* length,
+                           int* close_code) {
+    char* message = NULL;
+    size_t message_length = 0;
+    int message_opcode = -1;    // Set by the first frame of a data message
+    *close_code = 0;
+
+    while (1) {
+        unsigned char header[2];
+        if (!recv_all(sock, header, 2)) break;
+        bool final = header[0] & 0x80;
+        int opcode = header[0] & 0x0F;
+        bool masked = header[1] & 0x80;
+        uint64_t payload_length = header[1] & 0x7F;
+
+        if (payload_length == 126 || payload_length == 127) {
+            unsigned char extended[8];
+            size_t size = payload_length == 126 ? 2 : 8;
+            if (!recv_all(sock, extended, size)) break;
+            // The 64-bit form's top bit must be 0 (RFC 6455 5.2); a length
+            // that big is past any max_size, and would wrap the sums below
+            if (size == 8 && (extended[0] & 0x80)) {
+                *close_code = WS_CLOSE_TOO_BIG;
+                break;
+            }
+            payload_length = 0;
+            for (size_t i = 0; i < size; i++) {
+                payload_length = payload_length << 8 | extended[i];
+            }
+        }
+
+        // Clients must mask, control frames must be short and unfragmented,
+        // and continuations must continue something
+        bool control = opcode & 0x8;
+        if (!masked || (header[0] & 0x70) ||
+            (control && (!final || payload_length > WS_MAX_CONTROL_PAYLOAD)) ||
+            (opcode == WS_CONTINUATION && message_opcode < 0) ||
+            ((opcode == WS_TEXT || opcode == WS_BINARY) && message_opcode >= 0) ||
+            (opcode > WS_BINARY && !control) || opcode > WS_PONG) {
+            *close_code = WS_CLOSE_PROTOCOL_ERROR;
+            break;
+        }
+        // message_length never exceeds max_size, so this can't wrap
+        if (!control && payload_length > max_size - message_length) {
+            *close_code = WS_CLOSE_TOO_BIG;
+            break;
+        }
+
+        unsigned char mask[4];
+        if (!recv_all(sock, mask, 4)) break;
+        unsigned char control_payload[WS_MAX_CONTROL_PAYLOAD];
+        unsigned char* payload = control_payload;
+        if (!control) {
+            char* grown = realloc(message, message_length + payload_length + 1);
+            if (!grown) break;
+            message = grown;
+            payload = (unsigned char*)message + message_length;
+        }
+        if (!recv_all(sock, payload, payload_length)) break;
+        for (uint64_t i = 0; i < payload_length; i++) {
+            payload[i] ^= mask[i % 4];
+        }
+
+        if (opcode == WS_PING) {
+            if (!websocket_send(sock, WS_PONG, (const char*)payload, payload_length)) break;
+            continue;
+        }
+        if (opcode == WS_PONG) continue;
+        if (opcode == WS_CLOSE) {
+            // Echo the client's code, as RFC 6455 asks
+            websocket_send(sock, WS_CLOSE, (const char*)payload, payload_length >= 2 ? 2 : 0);
+            free(message);
+            return WS_CLOSE;
+        }
+
+        if (opcode != WS_CONTINUATION) message_opcode = opcode;
+        message_length += payload_length;
+        if (final) {
+            message[message_length] = '\0';
+            *data = message;
+            *length = message_length;
+            return message_opcode;
+        }
+    }
+
+    free(message);
+    return -1;
+}
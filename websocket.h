@@ -0,0 +1,48 @@
+#ifndef WEBSOCKET_H
+#define WEBSOCKET_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+// Server side of RFC 6455 WebSockets over an already upgraded socket
+
+typedef enum {
+    WS_CONTINUATION = 0x0,
+    WS_TEXT = 0x1,
+    WS_BINARY = 0x2,
+    WS_CLOSE = 0x8,
+    WS_PING = 0x9,
+    WS_PONG = 0xA
+} WebSocketOpcode;
+
+// Close codes sent to the client
+#define WS_CLOSE_NORMAL 1000
+#define WS_CLOSE_GOING_AWAY 1001
+#define WS_CLOSE_PROTOCOL_ERROR 1002
+#define WS_CLOSE_TOO_BIG 1009
+
+#define WS_ACCEPT_LENGTH 28         // Base64 of a SHA-1 digest
+
+// Writes the Sec-WebSocket-Accept value for a client's Sec-WebSocket-Key
+// to out, which must hold WS_ACCEPT_LENGTH + 1 bytes
+void websocket_accept_key(const char* key, char* out);
+
+// Reads one whole message, reassembling fragments and answering pings on
+// the way. Returns WS_TEXT or WS_BINARY with *data heap allocated and NUL
+// terminated (caller frees), WS_CLOSE once the client has closed, or -1
+// when the connection broke or the client broke the protocol, in which
+// case *close_code says what to close with (0 when it's already gone).
+int websocket_read_message(int sock, size_t max_size, char** data, size_t* length,
+                           int* close_code);
+
+bool websocket_send(int sock, WebSocketOpcode opcode, const char* data, size_t length);
+
+// Sends a close frame with code and a short reason
+bool websocket_close(int sock, int code, const char* reason);
+
+// Stops sending and discards what the client still sends, for up to a
+// second, so that close() doesn't reset the connection before the client
+// has read the close frame
+void websocket_linger(int sock);
+
+#endif
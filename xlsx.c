@@ -0,0 +1,372 @@
+#include <pthread.h>
+#include <stdint.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+#include <time.h>
+
+#include "xlsx.h"
+
+// Buffered output is handed to write once it reaches this
+#define FLUSH_SIZE (64 * 1024)
+
+#define ZIP_VERSION 20      // 2.0, which brought data descriptors
+#define ZIP_DATA_DESCRIPTOR 0x08    // Flag: the CRC and sizes follow the data
+
+// Cell styles in styles.xml, by index
+#define STYLE_HEADER 1
+#define STYLE_TIME 2
+
+// Days from Excel's epoch, 1899-12-30, to the Unix one
+#define EXCEL_UNIX_EPOCH 25569
+
+#define SHEET_PATH "xl/worksheets/sheet1.xml"
+
+static const char* content_types =
+    "<?xml version=\"1.0\" encoding=\"UTF-8\" standalone=\"yes\"?>\n"
+    "<Types xmlns=\"http://schemas.openxmlformats.org/package/2006/content-types\">"
+    "<Default Extension=\"rels\" "
+    "ContentType=\"application/vnd.openxmlformats-package.relationships+xml\"/>"
+    "<Default Extension=\"xml\" ContentType=\"application/xml\"/>"
+    "<Override PartName=\"/xl/workbook.xml\" "
+    "ContentType=\"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml\"/>"
+    "<Override PartName=\"/" SHEET_PATH "\" "
+    "ContentType=\"application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml\"/>"
+    "<Override PartName=\"/xl/styles.xml\" "
+    "ContentType=\"application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml\"/>"
+    "</Types>";
+
+static const char* package_rels =
+    "<?xml version=\"1.0\" encoding=\"UTF-8\" standalone=\"yes\"?>\n"
+    "<Relationships xmlns=\"http://schemas.openxmlformats.org/package/2006/relationships\">"
+    "<Relationship Id=\"rId1\" Target=\"xl/workbook.xml\" Type=\"http://schemas.openxmlformats.org/"
+    "officeDocument/2006/relationships/officeDocument\"/>"
+    "</Relationships>";
+
+static const char* workbook_rels =
+    "<?xml version=\"1.0\" encoding=\"UTF-8\" standalone=\"yes\"?>\n"
+    "<Relationships xmlns=\"http://schemas.openxmlformats.org/package/2006/relationships\">"
+    "<Relationship Id=\"rId1\" Target=\"worksheets/sheet1.xml\" Type=\"http://schemas."
+    "openxmlformats.org/officeDocument/2006/relationships/worksheet\"/>"
+    "<Relationship Id=\"rId2\" Target=\"styles.xml\" Type=\"http://schemas.openxmlformats.org/"
+    "officeDocument/2006/relationships/styles\"/>"
+    "</Relationships>";
+
+// Normal, bold for headers, and a date and time format
+static const char* styles =
+    "<?xml version=\"1.0\" encoding=\"UTF-8\" standalone=\"yes\"?>\n"
+    "<styleSheet xmlns=\"http://schemas.openxmlformats.org/spreadsheetml/2006/main\">"
+    "<numFmts count=\"1\"><numFmt numFmtId=\"164\" formatCode=\"yyyy-mm-dd hh:mm:ss\"/></numFmts>"
+    "<fonts count=\"2\"><font><sz val=\"11\"/><name val=\"Calibri\"/></font>"
+    "<font><b/><sz val=\"11\"/><name val=\"Calibri\"/></font></fonts>"
+    "<fills count=\"2\"><fill><patternFill patternType=\"none\"/></fill>"
+    "<fill><patternFill patternType=\"gray125\"/></fill></fills>"
+    "<borders count=\"1\"><border><left/><right/><top/><bottom/><diagonal/></border></borders>"
+    "<cellStyleXfs count=\"1\"><xf numFmtId=\"0\" fontId=\"0\" fillId=\"0\" borderId=\"0\"/>"
+    "</cellStyleXfs>"
+    "<cellXfs count=\"3\"><xf numFmtId=\"0\" fontId=\"0\" fillId=\"0\" borderId=\"0\" xfId=\"0\"/>"
+    "<xf numFmtId=\"0\" fontId=\"1\" fillId=\"0\" borderId=\"0\" xfId=\"0\" applyFont=\"1\"/>"
+    "<xf numFmtId=\"164\" fontId=\"0\" fillId=\"0\" borderId=\"0\" xfId=\"0\" "
+    "applyNumberFormat=\"1\"/></cellXfs>"
+    "<cellStyles count=\"1\"><cellStyle name=\"Normal\" xfId=\"0\" builtinId=\"0\"/></cellStyles>"
+    "</styleSheet>";
+
+// The header row stays in view while scrolling
+static const char* sheet_head =
+    "<?xml version=\"1.0\" encoding=\"UTF-8\" standalone=\"yes\"?>\n"
+    "<worksheet xmlns=\"http://schemas.openxmlformats.org/spreadsheetml/2006/main\">"
+    "<sheetViews><sheetView workbookViewId=\"0\">"
+    "<pane ySplit=\"1\" topLeftCell=\"A2\" activePane=\"bottomLeft\" state=\"frozen\"/>"
+    "</sheetView></sheetViews><sheetData>";
+
+#define MAX_ENTRIES 6
+
+typedef struct {
+    const char* name;
+    uint16_t flags;
+    uint32_t crc;
+    uint32_t size;
+    uint32_t offset;
+} ZipEntry;
+
+struct XlsxWriter {
+    XlsxWrite write;
+    void* context;
+    char* buffer;
+    size_t length;
+    size_t capacity;
+    unsigned long long position;    // Bytes of output so far, buffered or written
+    bool failed;
+
+    // The sheet, whose CRC and size are worked out as it goes
+    bool in_sheet;
+    bool row_open;
+    uint32_t sheet_crc;
+    unsigned long long sheet_size;
+
+    ZipEntry entries[MAX_ENTRIES];
+    int entry_count;
+    uint16_t dos_time;
+    uint16_t dos_date;
+};
+
+static uint32_t crc_table[256];
+static pthread_once_t crc_table_once = PTHREAD_ONCE_INIT;
+
+static void init_crc_table(void) {
+    for (uint32_t i = 0; i < 256; i++) {
+        uint32_t c = i;
+        for (int k = 0; k < 8; k++) c = c & 1 ? 0xEDB88320u ^ (c >> 1) : c >> 1;
+        crc_table[i] = c;
+    }
+}
+
+// Continues a CRC-32 begun with crc 0
+static uint32_t crc32_update(uint32_t crc, const char* data, size_t length) {
+    crc = ~crc;
+    for (size_t i = 0; i < length; i++) {
+        crc = crc_table[(crc ^ (unsigned char)data[i]) & 0xFF] ^ (crc >> 8);
+    }
+    return ~crc;
+}
+
+static void emit(XlsxWriter* writer, const char* data, size_t length) {
+    if (writer->length + length > writer->capacity) {
+        while (writer->length + length > writer->capacity) writer->capacity *= 2;
+        writer->buffer = realloc(writer->buffer, writer->capacity);
+    }
+    memcpy(writer->buffer + writer->length, data, length);
+    writer->length += length;
+    writer->position += length;
+    if (writer->in_sheet) {
+        writer->sheet_crc = crc32_update(writer->sheet_crc, data, length);
+        writer->sheet_size += length;
+    }
+}
+
+static void emit_text(XlsxWriter* writer, const char* text) {
+    emit(writer, text, strlen(text));
+}
+
+// Little endian, as every ZIP field is
+static void emit_u16(XlsxWriter* writer, uint16_t value) {
+    char bytes[2] = {(char)(value & 0xFF), (char)(value >> 8)};
+    emit(writer, bytes, sizeof(bytes));
+}
+
+static void emit_u32(XlsxWriter* writer, uint32_t value) {
+    char bytes[4] = {(char)(value & 0xFF), (char)((value >> 8) & 0xFF),
+                     (char)((value >> 16) & 0xFF), (char)(value >> 24)};
+    emit(writer, bytes, sizeof(bytes));
+}
+
+// Markup characters escaped, and control characters XML can't hold dropped
+static void emit_escaped(XlsxWriter* writer, const char* text) {
+    for (const char* p = text; *p; p++) {
+        switch (*p) {
+        case '&': emit_text(writer, "&amp;"); break;
+        case '<': emit_text(writer, "&lt;"); break;
+        case '>': emit_text(writer, "&gt;"); break;
+        case '"': emit_text(writer, "&quot;"); break;
+        default:
+            if ((unsigned char)*p >= 0x20 || *p == '\t' || *p == '\n' || *p == '\r') {
+                emit(writer, p, 1);
+            }
+        }
+    }
+}
+
+static void local_header(XlsxWriter* writer, ZipEntry* entry) {
+    emit_u32(writer, 0x04034b50);
+    emit_u16(writer, ZIP_VERSION);
+    emit_u16(writer, entry->flags);
+    emit_u16(writer, 0);                // Stored
+    emit_u16(writer, writer->dos_time);
+    emit_u16(writer, writer->dos_date);
+    emit_u32(writer, entry->crc);
+    emit_u32(writer, entry->size);      // Compressed, the same when stored
+    emit_u32(writer, entry->size);
+    emit_u16(writer, (uint16_t)strlen(entry->name));
+    emit_u16(writer, 0);                // Extra field length
+    emit_text(writer, entry->name);
+}
+
+static ZipEntry* add_entry(XlsxWriter* writer, const char* name) {
+    ZipEntry* entry = &writer->entries[writer->entry_count++];
+    memset(entry, 0, sizeof(*entry));
+    entry->name = name;
+    entry->offset = (uint32_t)writer->position;
+    return entry;
+}
+
+static void add_file(XlsxWriter* writer, const char* name, const char* content) {
+    ZipEntry* entry = add_entry(writer, name);
+    entry->size = (uint32_t)strlen(content);
+    entry->crc = crc32_update(0, content, entry->size);
+    local_header(writer, entry);
+    emit(writer, content, entry->size);
+}
+
+// For the sheet name in workbook.xml
+static void escape_attribute(const char* text, char* out, size_t out_size) {
+    size_t len = 0;
+    for (const char* p = text; *p && len + 7 < out_size; p++) {
+        const char* entity = *p == '&' ? "&amp;" : *p == '<' ? "&lt;" : *p == '"' ? "&quot;" : NULL;
+        if (entity) {
+            len += snprintf(out + len, out_size - len, "%s", entity);
+        } else {
+            out[len++] = *p;
+        }
+    }
+    out[len] = '\0';
+}
+
+XlsxWriter* xlsx_open(const char* sheet_name, XlsxWrite write, void* context) {
+    pthread_once(&crc_table_once, init_crc_table);
+
+    XlsxWriter* writer = calloc(1, sizeof(XlsxWriter));
+    writer->write = write;
+    writer->context = context;
+    writer->capacity = FLUSH_SIZE * 2;
+    writer->buffer = malloc(writer->capacity);
+
+    // MS-DOS date and time, which ZIP entries are stamped with
+    time_t now = time(NULL);
+    struct tm tm;
+    gmtime_r(&now, &tm);
+    writer->dos_time = (uint16_t)(tm.tm_hour << 11 | tm.tm_min << 5 | tm.tm_sec / 2);
+    writer->dos_date = (uint16_t)((tm.tm_year - 80) << 9 | (tm.tm_mon + 1) << 5 | tm.tm_mday);
+
+    // Only the sheet is made as it goes, so the rest is written up front
+    char escaped[128];
+    escape_attribute(sheet_name, escaped, sizeof(escaped));
+    char workbook[512];
+    snprintf(workbook, sizeof(workbook),
+             "<?xml version=\"1.0\" encoding=\"UTF-8\" standalone=\"yes\"?>\n"
+             "<workbook xmlns=\"http://schemas.openxmlformats.org/spreadsheetml/2006/main\" "
+             "xmlns:r=\"http://schemas.openxmlformats.org/officeDocument/2006/relationships\">"
+             "<sheets><sheet name=\"%s\" sheetId=\"1\" r:id=\"rId1\"/></sheets></workbook>",
+             escaped);
+    add_file(writer, "[Content_Types].xml", content_types);
+    add_file(writer, "_rels/.rels", package_rels);
+    add_file(writer, "xl/workbook.xml", workbook);
+    add_file(writer, "xl/_rels/workbook.xml.rels", workbook_rels);
+    add_file(writer, "xl/styles.xml", styles);
+
+    ZipEntry* sheet = add_entry(writer, SHEET_PATH);
+    sheet->flags = ZIP_DATA_DESCRIPTOR;
+    local_header(writer, sheet);
+    writer->in_sheet = true;
+    emit_text(writer, sheet_head);
+    return writer;
+}
+
+void xlsx_row(XlsxWriter* writer) {
+    if (writer->row_open) emit_text(writer, "</row>");
+    emit_text(writer, "<row>");
+    writer->row_open = true;
+}
+
+static void string_cell(XlsxWriter* writer, const char* text, int style) {
+    char open[64];
+    size_t len = strlen(text);
+    // Spaces at either end are dropped unless asked to be kept
+    bool preserve = len > 0 && (text[0] == ' ' || text[len - 1] == ' ');
+    snprintf(open, sizeof(open), "<c t=\"inlineStr\"%s><is><t%s>",
+             style == STYLE_HEADER ? " s=\"1\"" : "", preserve ? " xml:space=\"preserve\"" : "");
+    emit_text(writer, open);
+    emit_escaped(writer, text);
+    emit_text(writer, "</t></is></c>");
+}
+
+void xlsx_header(XlsxWriter* writer, const char* text) {
+    string_cell(writer, text, STYLE_HEADER);
+}
+
+void xlsx_string(XlsxWriter* writer, const char* text) {
+    string_cell(writer, text, 0);
+}
+
+void xlsx_number(XlsxWriter* writer, double value) {
+    char cell[64];
+    snprintf(cell, sizeof(cell), "<c><v>%.15g</v></c>", value);
+    emit_text(writer, cell);
+}
+
+void xlsx_time(XlsxWriter* writer, long long seconds) {
+    char cell[64];
+    snprintf(cell, sizeof(cell), "<c s=\"%d\"><v>%.10f</v></c>", STYLE_TIME,
+             (double)seconds / 86400.0 + EXCEL_UNIX_EPOCH);
+    emit_text(writer, cell);
+}
+
+void xlsx_blank(XlsxWriter* writer) {
+    emit_text(writer, "<c/>");
+}
+
+static bool send_buffer(XlsxWriter* writer) {
+    if (!writer->failed && writer->length > 0 &&
+        !writer->write(writer->context, writer->buffer, writer->length)) {
+        writer->failed = true;
+    }
+    writer->length = 0;
+    return !writer->failed;
+}
+
+bool xlsx_flush(XlsxWriter* writer) {
+    if (writer->length < FLUSH_SIZE) return !writer->failed;
+    return send_buffer(writer);
+}
+
+bool xlsx_close(XlsxWriter* writer) {
+    if (writer->row_open) emit_text(writer, "</row>");
+    emit_text(writer, "</sheetData></worksheet>");
+    writer->in_sheet = false;
+
+    ZipEntry* sheet = &writer->entries[writer->entry_count - 1];
+    sheet->crc = writer->sheet_crc;
+    sheet->size = (uint32_t)writer->sheet_size;
+    emit_u32(writer, 0x08074b50);
+    emit_u32(writer, sheet->crc);
+    emit_u32(writer, sheet->size);
+    emit_u32(writer, sheet->size);
+
+    // Offsets and sizes past 4 GiB would need ZIP64
+    bool fits = writer->position <= UINT32_MAX;
+    uint32_t directory_offset = (uint32_t)writer->position;
+    for (int i = 0; i < writer->entry_count; i++) {
+        const ZipEntry* entry = &writer->entries[i];
+        emit_u32(writer, 0x02014b50);
+        emit_u16(writer, ZIP_VERSION);      // Made by
+        emit_u16(writer, ZIP_VERSION);      // Needed
+        emit_u16(writer, entry->flags);
+        emit_u16(writer, 0);
+        emit_u16(writer, writer->dos_time);
+        emit_u16(writer, writer->dos_date);
+        emit_u32(writer, entry->crc);
+        emit_u32(writer, entry->size);
+        emit_u32(writer, entry->size);
+        emit_u16(writer, (uint16_t)strlen(entry->name));
+        emit_u16(writer, 0);                // Extra field length
+        emit_u16(writer, 0);                // Comment length
+        emit_u16(writer, 0);                // Disk
+        emit_u16(writer, 0);                // Internal attributes
+        emit_u32(writer, 0);                // External attributes
+        emit_u32(writer, entry->offset);
+        emit_text(writer, entry->name);
+    }
+    uint32_t directory_size = (uint32_t)(writer->position - directory_offset);
+    emit_u32(writer, 0x06054b50);
+    emit_u16(writer, 0);
+    emit_u16(writer, 0);
+    emit_u16(writer, (uint16_t)writer->entry_count);
+    emit_u16(writer, (uint16_t)writer->entry_count);
+    emit_u32(writer, directory_size);
+    emit_u32(writer, directory_offset);
+    emit_u16(writer, 0);                    // Comment length
+
+    bool ok = send_buffer(writer) && fits;
+    free(writer->buffer);
+    free(writer);
+    return ok;
+}
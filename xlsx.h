@@ -0,0 +1,39 @@
+#ifndef XLSX_H
+#define XLSX_H
+
+#include <stdbool.h>
+#include <stddef.h>
+
+// Streaming writer for a one sheet Excel workbook (.xlsx). Rows go out as
+// they are added, through write, so a sheet of any length takes a few
+// kilobytes of memory. The ZIP it writes is stored, not deflated, and
+// holds up to 4 GiB.
+typedef struct XlsxWriter XlsxWriter;
+
+// Sends output on; returns false to give up, e.g. when the client is gone
+typedef bool (*XlsxWrite)(void* context, const char* data, size_t length);
+
+// Most rows a sheet holds, the header included
+#define XLSX_MAX_ROWS 1048576
+
+XlsxWriter* xlsx_open(const char* sheet_name, XlsxWrite write, void* context);
+
+// Starts the next row; cells fill it left to right. header cells are bold,
+// time cells are Unix seconds shown as a UTC date and time, and blank
+// cells hold nothing.
+void xlsx_row(XlsxWriter* writer);
+void xlsx_header(XlsxWriter* writer, const char* text);
+void xlsx_string(XlsxWriter* writer, const char* text);
+void xlsx_number(XlsxWriter* writer, double value);
+void xlsx_time(XlsxWriter* writer, long long seconds);
+void xlsx_blank(XlsxWriter* writer);
+
+// Passes what is buffered to write once there is enough of it to be
+// worth a write. Returns false once a write has failed.
+bool xlsx_flush(XlsxWriter* writer);
+
+// Finishes the workbook and frees the writer. Returns false if a write
+// failed; what was written then isn't a workbook.
+bool xlsx_close(XlsxWriter* writer);
+
+#endif